@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ServerInfo returns the server's description from /api/server/info.
+func (c *Client) ServerInfo(ctx context.Context) (map[string]string, error) {
+	body, err := c.Do(ctx, "GET", "server/info", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var info map[string]string
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("Bad server info from %s: %s", c.URL, err.Error())
+	}
+	return info, nil
+}
+
+// NewDataset creates a dataset and returns the UUID of its root node.
+func (c *Client) NewDataset(ctx context.Context) (dvid.UUID, error) {
+	body, err := c.Do(ctx, "POST", "datasets/new", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var reply struct{ Root dvid.UUID }
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return "", fmt.Errorf("Bad reply to new dataset from %s: %s", c.URL, err.Error())
+	}
+	return reply.Root, nil
+}
+
+// NewData creates data of a datatype in the dataset holding the given version, using
+// settings like "BlockSize" or "Versioned".
+func (c *Client) NewData(ctx context.Context, uuid dvid.UUID, typename dvid.TypeString, name dvid.DataString,
+	settings map[string]string) error {
+	if settings == nil {
+		settings = map[string]string{}
+	}
+	config, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("dataset/%s/new/%s/%s", uuid, typename, url.PathEscape(string(name)))
+	_, err = c.Do(ctx, "POST", endpoint, config, nil)
+	return err
+}
+
+// DataInfo decodes the JSON of data's info endpoint into v.
+func (c *Client) DataInfo(ctx context.Context, uuid dvid.UUID, name dvid.DataString, v interface{}) error {
+	body, err := c.Do(ctx, "GET", dataEndpoint(uuid, name, "info"), nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("Bad info for data %q from %s: %s", name, c.URL, err.Error())
+	}
+	return nil
+}
+
+// Lock commits a version so it can't be modified.
+func (c *Client) Lock(ctx context.Context, uuid dvid.UUID) error {
+	_, err := c.Do(ctx, "POST", fmt.Sprintf("node/%s/lock", uuid), nil, nil)
+	return err
+}
+
+// NewVersion creates a child of a locked version and returns its UUID.
+func (c *Client) NewVersion(ctx context.Context, uuid dvid.UUID) (dvid.UUID, error) {
+	body, err := c.Do(ctx, "POST", fmt.Sprintf("node/%s/branch", uuid), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var reply struct{ Branch dvid.UUID }
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return "", fmt.Errorf("Bad reply to branch of %s from %s: %s", uuid, c.URL, err.Error())
+	}
+	return reply.Branch, nil
+}
+
+// GetSlice returns an encoded 2d image of voxels data, e.g., a PNG of a XY slice.  The
+// plane is "xy", "xz", "yz", or axes like "0_1", and format is any 2d format of "raw"
+// requests, e.g., "png" or "jpg:80".  An empty format gets the server's default.
+func (c *Client) GetSlice(ctx context.Context, uuid dvid.UUID, name dvid.DataString, plane string,
+	size dvid.Point2d, offset dvid.Point3d, format string) ([]byte, error) {
+	endpoint := fmt.Sprintf("raw/%s/%d_%d/%s", plane, size[0], size[1], pointString(offset))
+	if format != "" {
+		endpoint += "/" + format
+	}
+	return c.Do(ctx, "GET", dataEndpoint(uuid, name, endpoint), nil, nil)
+}
+
+// GetSubvolume returns the packed voxels of a 3d subvolume of voxels data in x, y, z
+// order.
+func (c *Client) GetSubvolume(ctx context.Context, uuid dvid.UUID, name dvid.DataString,
+	offset, size dvid.Point3d) ([]byte, error) {
+	endpoint := fmt.Sprintf("raw/0_1_2/%s/%s", pointString(size), pointString(offset))
+	return c.Do(ctx, "GET", dataEndpoint(uuid, name, endpoint), nil, nil)
+}
+
+// PutSubvolume stores the packed voxels of a 3d subvolume of voxels data in x, y, z
+// order.
+func (c *Client) PutSubvolume(ctx context.Context, uuid dvid.UUID, name dvid.DataString,
+	offset, size dvid.Point3d, voxels []byte) error {
+	endpoint := fmt.Sprintf("raw/0_1_2/%s/%s", pointString(size), pointString(offset))
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	_, err := c.Do(ctx, "POST", dataEndpoint(uuid, name, endpoint), voxels, header)
+	return err
+}
+
+// GetKey returns the value of a key of keyvalue data, or found is false if the key has
+// no value.
+func (c *Client) GetKey(ctx context.Context, uuid dvid.UUID, name dvid.DataString, key string) (value []byte,
+	found bool, err error) {
+	value, err = c.Do(ctx, "GET", dataEndpoint(uuid, name, url.PathEscape(key)), nil, nil)
+	if IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// PutKey stores the value of a key of keyvalue data.
+func (c *Client) PutKey(ctx context.Context, uuid dvid.UUID, name dvid.DataString, key string, value []byte) error {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	_, err := c.Do(ctx, "POST", dataEndpoint(uuid, name, url.PathEscape(key)), value, header)
+	return err
+}
+
+// BlocksExist returns whether each block, given by its block coordinate, has been written
+// at the version of voxels or labels data, e.g., to resume an interrupted load.
+func (c *Client) BlocksExist(ctx context.Context, uuid dvid.UUID, name dvid.DataString,
+	blocks [][]int32) ([]bool, error) {
+	return c.exists(ctx, uuid, name, blocks, len(blocks))
+}
+
+// KeysExist returns whether each key of keyvalue data has a value written at the version.
+func (c *Client) KeysExist(ctx context.Context, uuid dvid.UUID, name dvid.DataString, keys []string) ([]bool, error) {
+	return c.exists(ctx, uuid, name, keys, len(keys))
+}
+
+// exists sends a JSON list of n blocks or keys to data's exists endpoint and decodes the
+// bitmask reply.
+func (c *Client) exists(ctx context.Context, uuid dvid.UUID, name dvid.DataString, list interface{},
+	n int) ([]bool, error) {
+	request, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	bitmask, err := c.Do(ctx, "POST", dataEndpoint(uuid, name, "exists"), request, header)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExists(bitmask, n)
+}
+
+// decodeExists returns the n flags of an existence bitmask, where bit i counts from the
+// least significant bit of the first byte.
+func decodeExists(bitmask []byte, n int) ([]bool, error) {
+	if len(bitmask) != (n+7)/8 {
+		return nil, fmt.Errorf("Existence bitmask has %d bytes, not %d", len(bitmask), (n+7)/8)
+	}
+	found := make([]bool, n)
+	for i := range found {
+		found[i] = bitmask[i/8]&(1<<uint(i%8)) != 0
+	}
+	return found, nil
+}
+
+// dataEndpoint returns the API endpoint of data at a version.
+func dataEndpoint(uuid dvid.UUID, name dvid.DataString, endpoint string) string {
+	return fmt.Sprintf("node/%s/%s/%s", uuid, url.PathEscape(string(name)), endpoint)
+}
+
+// pointString formats a point like "x_y_z" as used in API endpoints.
+func pointString(p dvid.Point3d) string {
+	return fmt.Sprintf("%d_%d_%d", p[0], p[1], p[2])
+}
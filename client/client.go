@@ -0,0 +1,268 @@
+/*
+Package client provides typed access to a DVID server's HTTP and RPC APIs for Go tools,
+so they don't need to build request URLs by hand.  Connections are pooled, failed
+requests are retried, and every method takes a context for cancellation and deadlines.
+
+	c, err := client.NewClient("emdata2:8000")
+	if err != nil {
+		...
+	}
+	child, err := c.NewVersion(ctx, uuid)
+	...
+	err = c.PutSubvolume(ctx, child, "grayscale", dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64}, voxels)
+
+Requests that modify data are sent with an idempotency key, so a retry after a lost
+reply doesn't apply the change twice.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// DefaultRetries is the number of attempts made for each request before giving up.
+	DefaultRetries = 3
+
+	// DefaultConnections is the number of idle HTTP connections kept for reuse.
+	DefaultConnections = 16
+
+	// idempotencyKeyHeader is the HTTP header the server uses to recognize retries.
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// StatusError is returned when the server replies to a HTTP request with an error status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s returned status %d: %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if the error is a reply with status 404.
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
+// Client makes requests of one DVID server.  It is safe for concurrent use.
+type Client struct {
+	// URL is the base URL of the server, e.g., "http://emdata2:8000".
+	URL string
+
+	// RPCAddress is the address of the server's RPC interface, e.g., "emdata2:8001".
+	// Commands can't be run without it.
+	RPCAddress string
+
+	// Token, if set, is sent as a bearer token, e.g., an API key.
+	Token string
+
+	// Retries is the number of attempts made for requests failing with network errors
+	// or server errors.
+	Retries int
+
+	http *http.Client
+
+	rpcMu     sync.Mutex
+	rpcClient *rpc.Client
+}
+
+// NewClient returns a client of the server with the given base URL.  A URL without a
+// scheme uses HTTP.
+func NewClient(baseURL string) (*Client, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Bad DVID server URL %q", baseURL)
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        DefaultConnections,
+		MaxIdleConnsPerHost: DefaultConnections,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{
+		URL:     strings.TrimRight(baseURL, "/"),
+		Retries: DefaultRetries,
+		http:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// Close releases the client's connections.
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+	if c.rpcClient == nil {
+		return nil
+	}
+	err := c.rpcClient.Close()
+	c.rpcClient = nil
+	return err
+}
+
+// Do sends a request to an endpoint relative to the server's API path, e.g.,
+// "node/3f8c/grayscale/info", and returns the body of a successful reply.  Requests
+// failing with network errors or 5xx statuses are retried.
+func (c *Client) Do(ctx context.Context, method, endpoint string, body []byte, header http.Header) ([]byte, error) {
+	reqURL := c.URL + "/api/" + strings.TrimLeft(endpoint, "/")
+	if header == nil {
+		header = make(http.Header)
+	}
+	if method != "GET" && method != "HEAD" && header.Get(idempotencyKeyHeader) == "" {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		header.Set(idempotencyKeyHeader, key)
+	}
+	retries := c.Retries
+	if retries < 1 {
+		retries = 1
+	}
+	var lastErr error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		reply, retry, err := c.send(ctx, method, reqURL, body, header)
+		if err == nil || !retry {
+			return reply, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// send makes one attempt of a request, returning whether a failure may be retried.
+func (c *Client) send(ctx context.Context, method, reqURL string, body []byte, header http.Header) ([]byte, bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, reqURL, reader)
+	if err != nil {
+		return nil, false, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode >= 300 {
+		statusErr := &StatusError{
+			Method:     method,
+			URL:        reqURL,
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(reply)),
+		}
+		return nil, resp.StatusCode >= 500, statusErr
+	}
+	return reply, false, nil
+}
+
+// newIdempotencyKey returns a random key identifying a request and its retries.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Command runs a RPC command, e.g., "node 3f8c grayscale load ...", with optional input
+// as if given via -stdin, and returns the reply's text.  The RPC connection is kept for
+// later commands.
+func (c *Client) Command(ctx context.Context, input []byte, args ...string) (string, error) {
+	if c.RPCAddress == "" {
+		return "", fmt.Errorf("No RPC address set for DVID server %s", c.URL)
+	}
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return "", err
+	}
+	request := datastore.Request{Command: dvid.Command(args), Input: input, IdempotencyKey: key}
+	retries := c.Retries
+	if retries < 1 {
+		retries = 1
+	}
+	var lastErr error
+	for attempt := 0; attempt < retries; attempt++ {
+		rpcClient, err := c.rpcConnection()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var reply datastore.Response
+		call := rpcClient.Go("RPCConnection.Do", request, &reply, nil)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-call.Done:
+		}
+		if call.Error == nil {
+			return reply.Text + string(reply.Output), nil
+		}
+		if _, isServerErr := call.Error.(rpc.ServerError); isServerErr {
+			return "", call.Error
+		}
+		// The connection failed, so drop it and retry with a new one.
+		lastErr = call.Error
+		c.rpcMu.Lock()
+		if c.rpcClient == rpcClient {
+			c.rpcClient.Close()
+			c.rpcClient = nil
+		}
+		c.rpcMu.Unlock()
+	}
+	return "", fmt.Errorf("RPC error for %q: %s", args, lastErr)
+}
+
+// rpcConnection returns the RPC connection, dialing the server if needed.
+func (c *Client) rpcConnection() (*rpc.Client, error) {
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+	if c.rpcClient == nil {
+		rpcClient, err := rpc.DialHTTP("tcp", c.RPCAddress)
+		if err != nil {
+			return nil, err
+		}
+		c.rpcClient = rpcClient
+	}
+	return c.rpcClient, nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) TestRequests(c *C) {
+	var mu sync.Mutex
+	values := make(map[string][]byte)
+	keysSeen := make(map[string]int)
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/node/3f8c/branch":
+			w.Write([]byte(`{"Branch": "9a2e"}`))
+		case r.Method == "GET":
+			value, found := values[r.URL.Path]
+			if !found {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write(value)
+		case r.Method == "POST":
+			// Fail the first write so it's retried with the same idempotency key.
+			keysSeen[r.Header.Get("Idempotency-Key")]++
+			if failures > 0 {
+				failures--
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			values[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	ctx := context.Background()
+
+	_, err = client.NewVersion(ctx, "3f8c")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*StatusError).StatusCode, Equals, http.StatusUnauthorized)
+
+	client.Token = "secret"
+	child, err := client.NewVersion(ctx, "3f8c")
+	c.Assert(err, IsNil)
+	c.Assert(child, Equals, dvid.UUID("9a2e"))
+
+	_, found, err := client.GetKey(ctx, "3f8c", "stuff", "mykey")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+	c.Assert(client.PutKey(ctx, "3f8c", "stuff", "mykey", []byte("hello")), IsNil)
+	c.Assert(keysSeen, HasLen, 1)
+	for _, attempts := range keysSeen {
+		c.Assert(attempts, Equals, 2)
+	}
+	value, found, err := client.GetKey(ctx, "3f8c", "stuff", "mykey")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(string(value), Equals, "hello")
+
+	voxels := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c.Assert(client.PutSubvolume(ctx, "3f8c", "grayscale", dvid.Point3d{0, 0, 10}, dvid.Point3d{2, 2, 2}, voxels), IsNil)
+	c.Assert(values["/api/node/3f8c/grayscale/raw/0_1_2/2_2_2/0_0_10"], DeepEquals, voxels)
+	got, err := client.GetSubvolume(ctx, "3f8c", "grayscale", dvid.Point3d{0, 0, 10}, dvid.Point3d{2, 2, 2})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, voxels)
+
+	_, err = client.Command(ctx, nil, "about")
+	c.Assert(err, NotNil)
+}
+
+func (s *ClientSuite) TestDecodeExists(c *C) {
+	found, err := decodeExists([]byte{0x05, 0x01}, 9)
+	c.Assert(err, IsNil)
+	c.Assert(found, DeepEquals, []bool{true, false, true, false, false, false, false, false, true})
+	_, err = decodeExists([]byte{0x05}, 9)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,244 @@
+/*
+	This file accounts for storage across the version DAG of a dataset.  Each version node
+	stores only the key/value pairs, e.g., blocks, written at that node and inherits the
+	rest from its ancestors, so the marginal storage cost of a node is what it wrote.
+	Blocks rewritten with the same content as the inherited block are counted as duplicates,
+	which could be deduplicated.  The accounting is stored with each node so it's part of
+	the dataset's DAG description.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// BlockCounts counts the blocks, i.e., key/value pairs, of data visible at a version node.
+type BlockCounts struct {
+	// Blocks is the number of blocks visible at the node.
+	Blocks int64
+
+	// Unique is the number of blocks written at the node that are new or differ from
+	// the inherited block.
+	Unique int64
+
+	// Duplicate is the number of blocks written at the node with the same content as
+	// the inherited block.
+	Duplicate int64
+
+	// Inherited is the number of blocks visible from ancestors and not written at the node.
+	Inherited int64
+
+	// Bytes is the size of the keys and values written at the node, i.e., its marginal
+	// storage cost, and DuplicateBytes is the part of it spent on duplicate blocks.
+	Bytes          int64
+	DuplicateBytes int64
+}
+
+func (counts *BlockCounts) add(other BlockCounts) {
+	counts.Blocks += other.Blocks
+	counts.Unique += other.Unique
+	counts.Duplicate += other.Duplicate
+	counts.Inherited += other.Inherited
+	counts.Bytes += other.Bytes
+	counts.DuplicateBytes += other.DuplicateBytes
+}
+
+// NodeStorage is the storage accounting of a version node, in total and per data.
+type NodeStorage struct {
+	BlockCounts
+	Data     map[dvid.DataString]BlockCounts
+	Computed time.Time
+}
+
+// storedBlock describes a block written at a version.
+type storedBlock struct {
+	version dvid.VersionLocalID
+	hash    uint64
+	size    int64
+}
+
+// AccountStorage computes the storage accounting of every node in the dataset holding
+// the given UUID, stores it with the nodes, and returns it.  If progress is not nil, it's
+// called with the fraction of data instances accounted.  Keys of a block's versions are
+// adjacent, so each data instance is accounted in one streaming scan holding only the
+// versions of the current block.
+func (s *Service) AccountStorage(ctx context.Context, u dvid.UUID,
+	progress func(float32)) (map[dvid.UUID]*NodeStorage, error) {
+
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rank the versions of each node's lineage by distance, nearest first, with the
+	// node itself at 0.
+	dataset.mapLock.Lock()
+	lineages := make(map[dvid.UUID]map[dvid.VersionLocalID]int, len(dataset.Nodes))
+	for node := range dataset.Nodes {
+		lineage, err := dataset.lineage(node)
+		if err != nil {
+			dataset.mapLock.Unlock()
+			return nil, err
+		}
+		ranks := make(map[dvid.VersionLocalID]int, len(lineage))
+		for i, ancestor := range lineage {
+			ranks[dataset.VersionMap[ancestor]] = i
+		}
+		lineages[node] = ranks
+	}
+	dataset.mapLock.Unlock()
+
+	computed := time.Now()
+	accounting := make(map[dvid.UUID]*NodeStorage, len(lineages))
+	for node := range lineages {
+		accounting[node] = &NodeStorage{Data: make(map[dvid.DataString]BlockCounts), Computed: computed}
+	}
+	names := dataset.sortedDataNames()
+	for n, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			return nil, err
+		}
+		data, ok := dataservice.(expiringData)
+		if !ok {
+			return nil, fmt.Errorf("Unable to get keys of data '%s'", name)
+		}
+		counts, err := s.accountData(ctx, data.DatasetID(), data.LocalID(), lineages)
+		if err != nil {
+			return nil, err
+		}
+		for node, nodeStorage := range accounting {
+			nodeStorage.Data[name] = *counts[node]
+			nodeStorage.add(*counts[node])
+		}
+		if progress != nil {
+			progress(float32(n+1) / float32(len(names)))
+		}
+	}
+
+	dataset.mapLock.Lock()
+	for node, nodeStorage := range accounting {
+		if dagNode, found := dataset.Nodes[node]; found {
+			dagNode.Storage = nodeStorage
+		}
+	}
+	dataset.mapLock.Unlock()
+	if err := dataset.Put(s.kvSetter); err != nil {
+		return nil, err
+	}
+	return accounting, nil
+}
+
+// accountData counts the blocks of data visible at each node given the ranked versions
+// of its lineage.  Keys are scanned in order, and the versions of each block are
+// accounted once the scan moves past the block.
+func (s *Service) accountData(ctx context.Context, dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	lineages map[dvid.UUID]map[dvid.VersionLocalID]int) (map[dvid.UUID]*BlockCounts, error) {
+
+	counts := make(map[dvid.UUID]*BlockCounts, len(lineages))
+	for node := range lineages {
+		counts[node] = new(BlockCounts)
+	}
+	var index []byte
+	var written []storedBlock
+	flush := func() {
+		if len(written) != 0 {
+			accountBlock(written, lineages, counts)
+			written = written[:0]
+		}
+	}
+	begKey := &DataKey{dsetID, dataID, 0, dvid.IndexBytes{}}
+	endKey := &DataKey{dsetID, dataID + 1, 0, dvid.IndexBytes{}}
+	err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{Ctx: ctx}, func(chunk *storage.Chunk) {
+		key, ok := chunk.K.(*DataKey)
+		if !ok || key.Data != dataID {
+			return
+		}
+		keyBytes := key.Bytes()
+		if blockIndex := DataKeyIndexBytes(keyBytes); !bytes.Equal(blockIndex, index) {
+			flush()
+			index = append(index[:0], blockIndex...)
+		}
+		hash := fnv.New64a()
+		hash.Write(chunk.V)
+		written = append(written, storedBlock{key.Version, hash.Sum64(), int64(len(keyBytes) + len(chunk.V))})
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	return counts, nil
+}
+
+// accountBlock adds a block, given its versions, to the counts of each node.  The block
+// is owned by a node that wrote it and inherited from the nearest ancestor that did.
+func accountBlock(written []storedBlock, lineages map[dvid.UUID]map[dvid.VersionLocalID]int,
+	counts map[dvid.UUID]*BlockCounts) {
+
+	for node, ranks := range lineages {
+		var own, inherited *storedBlock
+		nearest := -1
+		for i := range written {
+			rank, found := ranks[written[i].version]
+			switch {
+			case !found:
+			case rank == 0:
+				own = &written[i]
+			case nearest < 0 || rank < nearest:
+				nearest = rank
+				inherited = &written[i]
+			}
+		}
+		c := counts[node]
+		switch {
+		case own != nil && inherited != nil && own.hash == inherited.hash:
+			c.Duplicate++
+			c.DuplicateBytes += own.size
+		case own != nil:
+			c.Unique++
+		case inherited != nil:
+			c.Inherited++
+		default:
+			continue
+		}
+		c.Blocks++
+		if own != nil {
+			c.Bytes += own.size
+		}
+	}
+}
+
+// StorageAccounting returns the last computed storage accounting of each node in the
+// dataset holding the given UUID, omitting nodes that haven't been accounted.
+func (s *Service) StorageAccounting(u dvid.UUID) (map[dvid.UUID]*NodeStorage, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	accounting := make(map[dvid.UUID]*NodeStorage, len(dataset.Nodes))
+	for node, dagNode := range dataset.Nodes {
+		if dagNode.Storage != nil {
+			accounting[node] = dagNode.Storage
+		}
+	}
+	return accounting, nil
+}
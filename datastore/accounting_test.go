@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"context"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestAccountBlock(c *C) {
+	// Root version 1 has child 2, which has child 3.
+	lineages := map[dvid.UUID]map[dvid.VersionLocalID]int{
+		"root":       {1: 0},
+		"child":      {2: 0, 1: 1},
+		"grandchild": {3: 0, 2: 1, 1: 2},
+	}
+	counts := map[dvid.UUID]*BlockCounts{"root": {}, "child": {}, "grandchild": {}}
+
+	// A block written at the root, rewritten unchanged at the child, and changed at the
+	// grandchild.
+	accountBlock([]storedBlock{{1, 7, 10}, {2, 7, 10}, {3, 8, 12}}, lineages, counts)
+	c.Assert(*counts["root"], DeepEquals, BlockCounts{Blocks: 1, Unique: 1, Bytes: 10})
+	c.Assert(*counts["child"], DeepEquals, BlockCounts{Blocks: 1, Duplicate: 1, Bytes: 10, DuplicateBytes: 10})
+	c.Assert(*counts["grandchild"], DeepEquals, BlockCounts{Blocks: 1, Unique: 1, Bytes: 12})
+
+	// A block written only at the child is inherited by the grandchild.
+	accountBlock([]storedBlock{{2, 9, 5}}, lineages, counts)
+	c.Assert(counts["root"].Blocks, Equals, int64(1))
+	c.Assert(counts["child"].Unique, Equals, int64(1))
+	c.Assert(counts["grandchild"].Inherited, Equals, int64(1))
+	c.Assert(counts["grandchild"].Blocks, Equals, int64(2))
+}
+
+func (s *DataSuite) TestStorageAccounting(c *C) {
+	service, root, accounted, done := newTestData(c, "accounted", dvid.NewConfig())
+	defer done()
+	putTestKeys(c, service, root, accounted, 0, 8, []byte("root"))
+	c.Assert(service.Lock(root), IsNil)
+
+	// The child rewrites one block unchanged and changes another.
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	putTestKeys(c, service, child, accounted, 0, 1, []byte("root"))
+	putTestKeys(c, service, child, accounted, 1, 2, []byte("chg!"))
+
+	accounting, err := service.AccountStorage(context.Background(), root, nil)
+	c.Assert(err, IsNil)
+	c.Assert(accounting, HasLen, 2)
+	rootCounts := accounting[root].Data["accounted"]
+	c.Assert(rootCounts.Blocks, Equals, int64(8))
+	c.Assert(rootCounts.Unique, Equals, int64(8))
+	c.Assert(rootCounts.Inherited, Equals, int64(0))
+	childCounts := accounting[child].Data["accounted"]
+	c.Assert(childCounts.Blocks, Equals, int64(8))
+	c.Assert(childCounts.Unique, Equals, int64(1))
+	c.Assert(childCounts.Duplicate, Equals, int64(1))
+	c.Assert(childCounts.Inherited, Equals, int64(6))
+	c.Assert(childCounts.DuplicateBytes*2, Equals, childCounts.Bytes)
+	c.Assert(accounting[child].Blocks >= childCounts.Blocks, Equals, true)
+
+	stored, err := service.StorageAccounting(child)
+	c.Assert(err, IsNil)
+	c.Assert(stored[child].Data["accounted"], DeepEquals, childCounts)
+}
@@ -0,0 +1,94 @@
+/*
+	This file supports aliases of data instances, e.g., "segmentation" for the latest
+	generation "seg_v5_agglo", so clients can use a stable name while the data it refers
+	to is replaced.  Aliases are resolved wherever data is looked up by name.
+*/
+
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Aliases returns the aliases of the dataset holding the given UUID mapped to the names
+// of the data they refer to.
+func (s *Service) Aliases(u dvid.UUID) (map[dvid.DataString]dvid.DataString, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	aliases := make(map[dvid.DataString]dvid.DataString, len(dataset.Aliases))
+	for alias, name := range dataset.Aliases {
+		aliases[alias] = name
+	}
+	return aliases, nil
+}
+
+// SetAlias makes an alias refer to data in the dataset holding the given UUID and
+// returns the name of the data the alias previously referred to, if any.
+func (s *Service) SetAlias(u dvid.UUID, alias, name dvid.DataString) (previous dvid.DataString, err error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return "", err
+	}
+	if alias == "" || alias == name {
+		return "", fmt.Errorf("Bad alias %q for data '%s'", alias, name)
+	}
+	dataset.mapLock.Lock()
+	_, aliasIsData := dataset.DataMap[alias]
+	_, aliasIsTrash := dataset.Trash[alias]
+	_, nameFound := dataset.DataMap[name]
+	if !aliasIsData && !aliasIsTrash && nameFound {
+		if dataset.Aliases == nil {
+			dataset.Aliases = make(map[dvid.DataString]dvid.DataString)
+		}
+		previous = dataset.Aliases[alias]
+		dataset.Aliases[alias] = name
+	}
+	dataset.mapLock.Unlock()
+	switch {
+	case aliasIsData:
+		return "", fmt.Errorf("Alias %q is the name of data in dataset %s", alias, dataset.Root)
+	case aliasIsTrash:
+		return "", fmt.Errorf("Alias %q is the name of data in the trash of dataset %s", alias, dataset.Root)
+	case !nameFound:
+		return "", fmt.Errorf("Data '%s' not found in dataset %s", name, dataset.Root)
+	}
+	return previous, dataset.Put(s.kvSetter)
+}
+
+// DeleteAlias removes an alias from the dataset holding the given UUID and returns the
+// name of the data it referred to.
+func (s *Service) DeleteAlias(u dvid.UUID, alias dvid.DataString) (dvid.DataString, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return "", err
+	}
+	dataset.mapLock.Lock()
+	name, found := dataset.Aliases[alias]
+	delete(dataset.Aliases, alias)
+	dataset.mapLock.Unlock()
+	if !found {
+		return "", fmt.Errorf("No alias %q in dataset %s", alias, dataset.Root)
+	}
+	return name, dataset.Put(s.kvSetter)
+}
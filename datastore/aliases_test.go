@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestAliases(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg_v1", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg_v2", dvid.NewConfig()), IsNil)
+
+	// Aliases must refer to existing data and can't shadow data names.
+	_, err = service.SetAlias(root, "segmentation", "missing")
+	c.Assert(err, NotNil)
+	_, err = service.SetAlias(root, "seg_v1", "seg_v2")
+	c.Assert(err, NotNil)
+
+	previous, err := service.SetAlias(root, "segmentation", "seg_v1")
+	c.Assert(err, IsNil)
+	c.Assert(previous, Equals, dvid.DataString(""))
+	dataservice, err := service.DataServiceByUUID(root, "segmentation")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DataName(), Equals, dvid.DataString("seg_v1"))
+
+	// Data can't be created with the name of an alias.
+	c.Assert(service.NewData(root, "migratetest", "segmentation", dvid.NewConfig()), NotNil)
+
+	// Nor can aliases take the name of trashed data, which would shadow it once restored.
+	c.Assert(service.NewData(root, "migratetest", "seg_v0", dvid.NewConfig()), IsNil)
+	c.Assert(service.DeleteData(root, "seg_v0"), IsNil)
+	_, err = service.SetAlias(root, "seg_v0", "seg_v1")
+	c.Assert(err, ErrorMatches, ".*trash.*")
+	c.Assert(service.RestoreData(root, "seg_v0"), IsNil)
+	dataservice, err = service.DataServiceByUUID(root, "seg_v0")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DataName(), Equals, dvid.DataString("seg_v0"))
+
+	// Reassignment returns the data previously referred to and is kept across restarts.
+	previous, err = service.SetAlias(root, "segmentation", "seg_v2")
+	c.Assert(err, IsNil)
+	c.Assert(previous, Equals, dvid.DataString("seg_v1"))
+	service.Shutdown()
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+
+	aliases, err := service.Aliases(root)
+	c.Assert(err, IsNil)
+	c.Assert(aliases, DeepEquals, map[dvid.DataString]dvid.DataString{"segmentation": "seg_v2"})
+	dataservice, err = service.DataServiceByUUID(root, "segmentation")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DataName(), Equals, dvid.DataString("seg_v2"))
+
+	name, err := service.DeleteAlias(root, "segmentation")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, dvid.DataString("seg_v2"))
+	_, err = service.DataServiceByUUID(root, "segmentation")
+	c.Assert(err, NotNil)
+	_, err = service.DeleteAlias(root, "segmentation")
+	c.Assert(err, NotNil)
+}
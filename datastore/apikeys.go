@@ -0,0 +1,254 @@
+/*
+	This file supports API keys that administrators issue to users, e.g., for pipelines,
+	so their credentials can be rotated without touching human accounts.  A user can have
+	many keys, each scoped to some datasets and to reads or reads and writes.  Only a hash
+	of each key's secret is stored, and revoked keys are kept so the audit log's key IDs
+	can still be traced to their users.
+*/
+
+package datastore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	// APIKeyPrefix starts every API key so they can be told apart from ID tokens.
+	APIKeyPrefix = "dvid_"
+
+	// apiKeyIDSize and apiKeySecretSize are the number of random bytes in a key's ID
+	// and secret.
+	apiKeyIDSize     = 8
+	apiKeySecretSize = 24
+)
+
+// APIKey describes a key issued to a user.  The key itself is only returned when issued.
+type APIKey struct {
+	// ID identifies the key in listings and the audit log.
+	ID string
+
+	User string
+
+	// Datasets are the root UUIDs of the datasets the key can access.  A key without
+	// datasets can access all datasets.
+	Datasets []dvid.UUID `json:",omitempty"`
+
+	// Write allows requests that modify data.  Other keys are read-only.
+	Write bool
+
+	// Bandwidth caps the bytes per second of replies to all requests made with the key.
+	// Zero is unlimited.
+	Bandwidth int64 `json:",omitempty"`
+
+	Created time.Time
+	Revoked *time.Time `json:",omitempty"`
+
+	// Hash is the hex SHA-256 hash of the key's secret.
+	Hash string `json:",omitempty"`
+}
+
+// APIKeyAllows returns an error if a key can't access the dataset holding a UUID, or
+// can't write to it if write is true.  An empty UUID is for requests outside datasets,
+// e.g., of the server, cluster, or federation, which only keys for all datasets may make.
+func (s *Service) APIKeyAllows(key *APIKey, u dvid.UUID, write bool) error {
+	if write && !key.Write {
+		return fmt.Errorf("API key %s is read-only", key.ID)
+	}
+	if len(key.Datasets) == 0 {
+		return nil
+	}
+	if u == "" {
+		return fmt.Errorf("API key %s can only access its datasets", key.ID)
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	for _, root := range key.Datasets {
+		if root == dataset.Root {
+			return nil
+		}
+	}
+	return fmt.Errorf("API key %s can't access dataset %s", key.ID, dataset.Root)
+}
+
+// APIKeyKey is an implementation of storage.Key for API keys.
+type APIKeyKey struct {
+	ID string
+}
+
+func (k *APIKeyKey) KeyType() storage.KeyType {
+	return storage.KeyAPIKey
+}
+
+func (k *APIKeyKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed APIKeyKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyAPIKey) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into APIKeyKey", storage.KeyType(b[0]))
+	}
+	return &APIKeyKey{ID: string(b[1:])}, nil
+}
+
+func (k *APIKeyKey) Bytes() []byte {
+	return append([]byte{byte(storage.KeyAPIKey)}, k.ID...)
+}
+
+func (k *APIKeyKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *APIKeyKey) String() string {
+	return fmt.Sprintf("API key %s", k.ID)
+}
+
+func hashAPIKeySecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewAPIKey issues a key to a user that can access the datasets holding the given UUIDs,
+// or all datasets if none are given.  It returns the key's description and the key,
+// which can't be recovered later.
+func (s *Service) NewAPIKey(user string, uuids []dvid.UUID, write bool) (*APIKey, string, error) {
+	if user == "" {
+		return nil, "", fmt.Errorf("API keys must be issued to a user")
+	}
+	key := &APIKey{User: user, Write: write, Created: time.Now()}
+	for _, u := range uuids {
+		dataset, err := s.Datasets.DatasetFromUUID(u)
+		if err != nil {
+			return nil, "", err
+		}
+		key.Datasets = append(key.Datasets, dataset.Root)
+	}
+	random := make([]byte, apiKeyIDSize+apiKeySecretSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	key.ID = hex.EncodeToString(random[:apiKeyIDSize])
+	secret := hex.EncodeToString(random[apiKeyIDSize:])
+	key.Hash = hashAPIKeySecret(secret)
+	if err := s.putAPIKey(key); err != nil {
+		return nil, "", err
+	}
+	return key, APIKeyPrefix + key.ID + "_" + secret, nil
+}
+
+func (s *Service) putAPIKey(key *APIKey) error {
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.kvSetter.Put(&APIKeyKey{ID: key.ID}, value)
+}
+
+// GetAPIKey returns the key with the given ID.
+func (s *Service) GetAPIKey(id string) (*APIKey, error) {
+	value, err := s.kvGetter.Get(&APIKeyKey{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("No API key with ID %q", id)
+	}
+	var key APIKey
+	if err := json.Unmarshal(value, &key); err != nil {
+		return nil, fmt.Errorf("Bad API key %s: %s", id, err.Error())
+	}
+	return &key, nil
+}
+
+// APIKeys returns all keys issued to a user, or all keys if user is empty, including
+// revoked keys.
+func (s *Service) APIKeys(user string) ([]*APIKey, error) {
+	begKey := &APIKeyKey{}
+	endKey := &APIKeyKey{ID: strings.Repeat("f", 2*apiKeyIDSize)}
+	keys := []*APIKey{}
+	var decodeErr error
+	err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if decodeErr != nil {
+			return
+		}
+		var key APIKey
+		if err := json.Unmarshal(chunk.V, &key); err != nil {
+			decodeErr = fmt.Errorf("Bad API key with key %s: %s", chunk.K, err.Error())
+			return
+		}
+		if user == "" || key.User == user {
+			keys = append(keys, &key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, decodeErr
+}
+
+// RevokeAPIKey permanently disables a key.
+func (s *Service) RevokeAPIKey(id string) (*APIKey, error) {
+	key, err := s.GetAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked != nil {
+		return nil, fmt.Errorf("API key %s was already revoked at %s", id,
+			key.Revoked.Format(time.RFC3339))
+	}
+	now := time.Now()
+	key.Revoked = &now
+	if err := s.putAPIKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SetAPIKeyBandwidth caps the bytes per second of replies to requests made with a key,
+// where zero removes the cap.
+func (s *Service) SetAPIKeyBandwidth(id string, bytesPerSec int64) (*APIKey, error) {
+	if bytesPerSec < 0 {
+		return nil, fmt.Errorf("API key bandwidth can't be negative: %d", bytesPerSec)
+	}
+	key, err := s.GetAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.Revoked != nil {
+		return nil, fmt.Errorf("API key %s was revoked", id)
+	}
+	key.Bandwidth = bytesPerSec
+	if err := s.putAPIKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AuthenticateAPIKey returns the unrevoked key matching an API key.
+func (s *Service) AuthenticateAPIKey(apiKey string) (*APIKey, error) {
+	fields := strings.Split(strings.TrimPrefix(apiKey, APIKeyPrefix), "_")
+	if !strings.HasPrefix(apiKey, APIKeyPrefix) || len(fields) != 2 || len(fields[0]) != 2*apiKeyIDSize {
+		return nil, fmt.Errorf("Malformed API key")
+	}
+	key, err := s.GetAPIKey(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Unknown API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(fields[1])), []byte(key.Hash)) != 1 {
+		return nil, fmt.Errorf("Bad API key")
+	}
+	if key.Revoked != nil {
+		return nil, fmt.Errorf("API key %s was revoked", key.ID)
+	}
+	return key, nil
+}
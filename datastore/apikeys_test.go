@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestAPIKeys(c *C) {
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	root1, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(root1), IsNil)
+	child1, err := service.NewVersion(root1)
+	c.Assert(err, IsNil)
+	root2, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+
+	// Keys are scoped to the datasets holding the given nodes.
+	pipeline, pipelineKey, err := service.NewAPIKey("alice", []dvid.UUID{child1}, false)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(pipelineKey, APIKeyPrefix), Equals, true)
+	c.Assert(pipeline.Datasets, DeepEquals, []dvid.UUID{root1})
+	writer, writerKey, err := service.NewAPIKey("alice", nil, true)
+	c.Assert(err, IsNil)
+	_, _, err = service.NewAPIKey("bob", nil, false)
+	c.Assert(err, IsNil)
+	_, _, err = service.NewAPIKey("", nil, false)
+	c.Assert(err, NotNil)
+
+	key, err := service.AuthenticateAPIKey(pipelineKey)
+	c.Assert(err, IsNil)
+	c.Assert(key.ID, Equals, pipeline.ID)
+	c.Assert(key.User, Equals, "alice")
+	_, err = service.AuthenticateAPIKey(pipelineKey[:len(pipelineKey)-1] + "x")
+	c.Assert(err, NotNil)
+	_, err = service.AuthenticateAPIKey("not a key")
+	c.Assert(err, NotNil)
+
+	c.Assert(service.APIKeyAllows(key, root1, false), IsNil)
+	c.Assert(service.APIKeyAllows(key, child1, false), IsNil)
+	c.Assert(service.APIKeyAllows(key, "", false), NotNil)
+	c.Assert(service.APIKeyAllows(key, root1, true), NotNil)
+	c.Assert(service.APIKeyAllows(key, root2, false), NotNil)
+	c.Assert(service.APIKeyAllows(writer, root2, true), IsNil)
+	c.Assert(service.APIKeyAllows(writer, "", true), IsNil)
+	c.Assert(service.APIKeyAllows(writer, "", false), IsNil)
+
+	keys, err := service.APIKeys("alice")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	keys, err = service.APIKeys("")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+
+	// Bandwidth caps are kept with the key.
+	_, err = service.SetAPIKeyBandwidth(writer.ID, -1)
+	c.Assert(err, NotNil)
+	capped, err := service.SetAPIKeyBandwidth(writer.ID, 1000000)
+	c.Assert(err, IsNil)
+	c.Assert(capped.Bandwidth, Equals, int64(1000000))
+	key, err = service.AuthenticateAPIKey(writerKey)
+	c.Assert(err, IsNil)
+	c.Assert(key.Bandwidth, Equals, int64(1000000))
+
+	// Revoking one key leaves the user's other keys working.
+	revoked, err := service.RevokeAPIKey(pipeline.ID)
+	c.Assert(err, IsNil)
+	c.Assert(revoked.Revoked, NotNil)
+	_, err = service.RevokeAPIKey(pipeline.ID)
+	c.Assert(err, NotNil)
+	_, err = service.SetAPIKeyBandwidth(pipeline.ID, 1000)
+	c.Assert(err, NotNil)
+	_, err = service.AuthenticateAPIKey(pipelineKey)
+	c.Assert(err, NotNil)
+	_, err = service.AuthenticateAPIKey(writerKey)
+	c.Assert(err, IsNil)
+	keys, err = service.APIKeys("alice")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	service.Shutdown()
+}
@@ -0,0 +1,215 @@
+/*
+	This file supports an append-only audit log of mutating operations so servers shared
+	by many labs can tell who did what when.  Entries are keyed by time and only removed
+	once they're older than the retention period.
+*/
+
+package datastore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// AuditEntry records one mutating HTTP request or RPC command.
+type AuditEntry struct {
+	Time time.Time
+
+	// User is the authenticated user or "anonymous".
+	User string
+
+	// Key is the ID of the API key used, if any.
+	Key string `json:",omitempty"`
+
+	// Remote is the address of the client.
+	Remote string
+
+	// Operation is the HTTP method and endpoint, e.g., "POST /api/node/3f8c/grayscale/raw/xy",
+	// or the RPC command, e.g., "rpc node 3f8c grayscale load".
+	Operation string
+
+	UUID dvid.UUID       `json:",omitempty"`
+	Data dvid.DataString `json:",omitempty"`
+
+	// Status is the HTTP status code replied, or 200 or 500 for RPC commands.
+	Status int
+
+	BytesIn  int64
+	BytesOut int64
+
+	Error string `json:",omitempty"`
+}
+
+// AuditQuery selects audit entries.  Zero values match all entries.
+type AuditQuery struct {
+	Since time.Time
+	Until time.Time
+	User  string
+	Key   string
+	UUID  dvid.UUID
+	Data  dvid.DataString
+
+	// Limit is the maximum number of entries returned, with the oldest returned first.
+	Limit int
+}
+
+func (q AuditQuery) matches(entry *AuditEntry) bool {
+	if q.User != "" && q.User != entry.User {
+		return false
+	}
+	if q.Key != "" && q.Key != entry.Key {
+		return false
+	}
+	if q.UUID != "" && q.UUID != entry.UUID {
+		return false
+	}
+	if q.Data != "" && q.Data != entry.Data {
+		return false
+	}
+	return true
+}
+
+// AuditKey is an implementation of storage.Key for audit entries, ordered by time.
+// The sequence number keeps keys of entries recorded at the same time distinct.
+type AuditKey struct {
+	Time     int64
+	Sequence uint32
+}
+
+const auditKeySize = 1 + 8 + 4
+
+func (k *AuditKey) KeyType() storage.KeyType {
+	return storage.KeyAudit
+}
+
+func (k *AuditKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < auditKeySize {
+		return nil, fmt.Errorf("Malformed AuditKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyAudit) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into AuditKey", storage.KeyType(b[0]))
+	}
+	return &AuditKey{
+		Time:     int64(binary.BigEndian.Uint64(b[1:9])),
+		Sequence: binary.BigEndian.Uint32(b[9:13]),
+	}, nil
+}
+
+func (k *AuditKey) Bytes() []byte {
+	b := make([]byte, auditKeySize)
+	b[0] = byte(storage.KeyAudit)
+	binary.BigEndian.PutUint64(b[1:9], uint64(k.Time))
+	binary.BigEndian.PutUint32(b[9:13], k.Sequence)
+	return b
+}
+
+func (k *AuditKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *AuditKey) String() string {
+	return fmt.Sprintf("%x", k.Bytes())
+}
+
+// auditTime returns nanoseconds since the epoch, with the zero time before all entries.
+func auditTime(t time.Time) int64 {
+	if t.IsZero() || t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// auditSequence keeps keys of entries recorded in the same nanosecond distinct.
+var auditSequence struct {
+	sync.Mutex
+	last int64
+	seq  uint32
+}
+
+// AppendAudit adds an entry to the audit log, setting its time if not already set.
+func (s *Service) AppendAudit(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := &AuditKey{Time: auditTime(entry.Time)}
+	auditSequence.Lock()
+	if key.Time == auditSequence.last {
+		auditSequence.seq++
+	} else {
+		auditSequence.last = key.Time
+		auditSequence.seq = 0
+	}
+	key.Sequence = auditSequence.seq
+	auditSequence.Unlock()
+	return s.kvSetter.Put(key, value)
+}
+
+// QueryAudit returns the entries recorded between the query's Since and Until times
+// that match its user, UUID, and data.
+func (s *Service) QueryAudit(q AuditQuery) ([]AuditEntry, error) {
+	begKey := &AuditKey{Time: auditTime(q.Since)}
+	endKey := &AuditKey{Time: 1<<63 - 1, Sequence: 1<<32 - 1}
+	if !q.Until.IsZero() {
+		endKey.Time = auditTime(q.Until)
+	}
+	entries := []AuditEntry{}
+	var decodeErr error
+	err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if decodeErr != nil || (q.Limit > 0 && len(entries) >= q.Limit) {
+			return
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(chunk.V, &entry); err != nil {
+			decodeErr = fmt.Errorf("Bad audit entry with key %s: %s", chunk.K, err.Error())
+			return
+		}
+		if q.matches(&entry) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, decodeErr
+}
+
+// DeleteAuditBefore removes all audit entries recorded before a time and returns the
+// number of entries removed.  It's used to enforce the audit retention period.
+func (s *Service) DeleteAuditBefore(t time.Time) (int, error) {
+	begKey := &AuditKey{}
+	endKey := &AuditKey{Time: auditTime(t)}
+	keys, err := s.kvGetter.KeysInRange(begKey, endKey)
+	if err != nil {
+		return 0, err
+	}
+	var expired []storage.Key
+	for _, key := range keys {
+		if auditKey, ok := key.(*AuditKey); ok && auditKey.Time < endKey.Time {
+			expired = append(expired, key)
+		}
+	}
+	if batcher, ok := s.kvSetter.(storage.Batcher); ok {
+		batch := batcher.NewBatch()
+		for _, key := range expired {
+			batch.Delete(key)
+		}
+		err = batch.Commit()
+	} else {
+		for _, key := range expired {
+			if err = s.kvSetter.Delete(key); err != nil {
+				break
+			}
+		}
+	}
+	return len(expired), err
+}
@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestAudit(c *C) {
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	start := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{Time: start, User: "alice", Operation: "POST /api/node/3f8c/grayscale/raw/xy", UUID: "3f8c", Data: "grayscale", BytesIn: 100},
+		{Time: start, User: "bob", Operation: "rpc node 3f8c lock", UUID: "3f8c"},
+		{Time: start.Add(time.Hour), User: "alice", Operation: "DELETE /api/node/9a2b/labels", UUID: "9a2b", Data: "labels"},
+		{Time: start.Add(2 * time.Hour), User: "alice", Operation: "POST /api/node/9a2b/labels/raw/xy", UUID: "9a2b", Data: "labels", Status: 400},
+	}
+	for _, entry := range entries {
+		c.Assert(service.AppendAudit(entry), IsNil)
+	}
+
+	// Entries recorded at the same time are all kept in order.
+	found, err := service.QueryAudit(AuditQuery{})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 4)
+	c.Assert(found[0].User, Equals, "alice")
+	c.Assert(found[0].BytesIn, Equals, int64(100))
+	c.Assert(found[1].User, Equals, "bob")
+	c.Assert(found[3].Status, Equals, 400)
+
+	found, err = service.QueryAudit(AuditQuery{User: "alice", Data: "labels"})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+
+	found, err = service.QueryAudit(AuditQuery{Since: start.Add(30 * time.Minute), Until: start.Add(90 * time.Minute)})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Assert(found[0].Operation, Equals, "DELETE /api/node/9a2b/labels")
+
+	found, err = service.QueryAudit(AuditQuery{UUID: "3f8c", Limit: 1})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Assert(found[0].User, Equals, "alice")
+
+	// Retention deletes only older entries.
+	deleted, err := service.DeleteAuditBefore(start.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 2)
+	found, err = service.QueryAudit(AuditQuery{})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+	c.Assert(found[0].UUID, Equals, dvid.UUID("9a2b"))
+	service.Shutdown()
+}
@@ -0,0 +1,81 @@
+/*
+	This file provides candidates for completing command lines, e.g., UUID prefixes and
+	data names, so interactive clients can offer tab-completion using the server's state.
+*/
+
+package datastore
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// CompleteUUID returns the UUIDs of all versions starting with the given prefix, sorted.
+func (s *Service) CompleteUUID(prefix string) []string {
+	if s.Datasets == nil {
+		return nil
+	}
+	var uuids []string
+	for _, u := range s.Datasets.UUIDs() {
+		if strings.HasPrefix(string(u), prefix) {
+			uuids = append(uuids, string(u))
+		}
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// CompleteDataName returns the names and aliases of data in the dataset holding the given
+// version that start with the given prefix, sorted.
+func (s *Service) CompleteDataName(u dvid.UUID, prefix string) ([]string, error) {
+	if s.Datasets == nil {
+		return nil, nil
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	var names []string
+	for name := range dataset.DataMap {
+		if strings.HasPrefix(string(name), prefix) {
+			names = append(names, string(name))
+		}
+	}
+	for alias := range dataset.Aliases {
+		if strings.HasPrefix(string(alias), prefix) {
+			names = append(names, string(alias))
+		}
+	}
+	dataset.mapLock.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+// DatatypeCommands returns the commands of a datatype as documented in its help, i.e.,
+// lines like "$ dvid node <UUID> <data name> load ...", sorted.
+func DatatypeCommands(t TypeService) []string {
+	const usage = "dvid node <UUID> <data name> "
+	found := make(map[string]bool)
+	for _, line := range strings.Split(t.Help(), "\n") {
+		i := strings.Index(line, usage)
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+len(usage):])
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "<") {
+			found[fields[0]] = true
+		}
+	}
+	commands := make([]string, 0, len(found)+1)
+	for command := range found {
+		commands = append(commands, command)
+	}
+	if !found["help"] {
+		commands = append(commands, "help")
+	}
+	sort.Strings(commands)
+	return commands
+}
@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+type helpType struct {
+	*migrateType
+}
+
+func (t *helpType) Help() string {
+	return `
+Command-line:
+
+$ dvid node <UUID> <data name> load <offset> <image glob>
+$ dvid node <UUID> <data name> load local <plane> <offset>
+$ dvid node <UUID> <data name> stats
+`
+}
+
+func (s *DataSuite) TestCompletion(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "grayscale", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "migratetest", "segmentation", dvid.NewConfig()), IsNil)
+	_, err = service.SetAlias(root, "seg", "segmentation")
+	c.Assert(err, IsNil)
+
+	c.Assert(service.CompleteUUID(string(root)[:4]), DeepEquals, []string{string(root)})
+	c.Assert(service.CompleteUUID("not-a-uuid"), HasLen, 0)
+
+	names, err := service.CompleteDataName(root, "se")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"seg", "segmentation"})
+	names, err = service.CompleteDataName(root, "")
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 3)
+
+	commands := DatatypeCommands(&helpType{newMigrateType("0.1")})
+	c.Assert(commands, DeepEquals, []string{"help", "load", "stats"})
+}
@@ -6,6 +6,7 @@
 package datastore
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -32,6 +33,21 @@ type Datasets struct {
 
 	// Counter that provides the local ID of the next new dataset.
 	newDatasetID dvid.DatasetLocalID
+
+	// Layout of the data keys in the datastore.
+	keyFormat KeyFormat
+
+	// Closed when the migrations started on opening the datastore are done.
+	migrated chan struct{}
+
+	// Versions of each dataset created before the version index whose keys aren't all
+	// in the index yet.  Set when loaded and emptied as the versions are indexed.
+	indexMu   sync.RWMutex
+	unindexed map[dvid.DatasetLocalID]map[dvid.VersionLocalID]bool
+
+	// Closed when the versions unindexed on opening the datastore have been indexed.
+	indexed      chan struct{}
+	stopIndexing context.CancelFunc
 }
 
 // DataServiceByUUID returns a service for data of a given name under a Dataset referenced by UUID.
@@ -41,6 +57,7 @@ func (dsets *Datasets) DataServiceByUUID(u dvid.UUID, name dvid.DataString) (Dat
 	if !found {
 		return nil, fmt.Errorf("No node with UUID %s found", u)
 	}
+	dataset.touchScratch(u)
 	dataservice, err := dataset.DataService(name)
 	if err != nil {
 		return nil, fmt.Errorf("No data named '%s' at node with UUID %s: %s", name, u, err.Error())
@@ -71,6 +88,7 @@ func (dsets *Datasets) DatasetFromUUID(u dvid.UUID) (*Dataset, error) {
 	if !found {
 		return nil, fmt.Errorf("DatasetFromUUID(): Illegal UUID (%s) not found", u)
 	}
+	dataset.touchScratch(u)
 	return dataset, nil
 }
 
@@ -139,13 +157,20 @@ func (dsets *Datasets) VerifyCompiledTypes() error {
 }
 
 // newDataset creates a new Dataset, which constitutes a version DAG and allows storing
-// arbitrary data within the nodes of the DAG.
-func (dsets *Datasets) newDataset() (dset *Dataset, err error) {
+// arbitrary data within the nodes of the DAG.  If root is empty, a new UUID is used
+// for the root node.
+func (dsets *Datasets) newDataset(root dvid.UUID) (dset *Dataset, err error) {
 	dsets.writeLock.Lock()
 	defer dsets.writeLock.Unlock()
 
+	if root == "" {
+		root = dvid.NewUUID()
+	} else if _, found := dsets.mapUUID[root]; found {
+		err = fmt.Errorf("A node with UUID %s already exists", root)
+		return
+	}
 	dset = &Dataset{
-		VersionDAG: NewVersionDAG(),
+		VersionDAG: newVersionDAG(root),
 		DatasetID:  dsets.newDatasetID,
 	}
 	dsets.newDatasetID++
@@ -158,6 +183,12 @@ func (dsets *Datasets) newDataset() (dset *Dataset, err error) {
 // newChild creates a new child node off a LOCKED parent node.  Will return
 // an error if the parent node has not been locked.
 func (dsets *Datasets) newChild(parent dvid.UUID) (dset *Dataset, u dvid.UUID, err error) {
+	return dsets.addChild(parent, false, 0)
+}
+
+// addChild creates a new child node, possibly a scratch node, off a LOCKED parent node.
+func (dsets *Datasets) addChild(parent dvid.UUID, scratch bool, idle time.Duration) (dset *Dataset,
+	u dvid.UUID, err error) {
 	// Find the Dataset with this UUID
 	var found bool
 	dset, found = dsets.mapUUID[parent]
@@ -165,27 +196,57 @@ func (dsets *Datasets) newChild(parent dvid.UUID) (dset *Dataset, u dvid.UUID, e
 		err = fmt.Errorf("No node found with UUID %s", parent)
 		return
 	}
+	if manifest := dset.published(); manifest != nil && manifest.Node == parent {
+		err = fmt.Errorf("Cannot branch published node %s", parent)
+		return
+	}
 
 	// Create the child in this Dataset's DAG
-	u, err = dset.VersionDAG.newChild(parent)
+	u, err = dset.VersionDAG.addChild(parent, scratch, idle)
 	if err != nil {
 		return
 	}
+	dsets.writeLock.Lock()
 	dsets.mapUUID[u] = dset
+	dsets.writeLock.Unlock()
 	return
 }
 
+// UUIDs returns the UUIDs of all nodes in all datasets.
+func (dsets *Datasets) UUIDs() []dvid.UUID {
+	dsets.writeLock.Lock()
+	defer dsets.writeLock.Unlock()
+	uuids := make([]dvid.UUID, 0, len(dsets.mapUUID))
+	for u := range dsets.mapUUID {
+		uuids = append(uuids, u)
+	}
+	return uuids
+}
+
+// Roots returns the root UUIDs of all datasets.
+func (dsets *Datasets) Roots() []dvid.UUID {
+	dsets.writeLock.Lock()
+	defer dsets.writeLock.Unlock()
+	roots := make([]dvid.UUID, 0, len(dsets.list))
+	for _, dset := range dsets.list {
+		roots = append(roots, dset.Root)
+	}
+	return roots
+}
+
 // -- Datasets Serialization and Deserialization ---
 
 type serializableDatasets struct {
 	DatasetsUUID []dvid.UUID
 	NewDatasetID dvid.DatasetLocalID
+	KeyFormat    KeyFormat
 }
 
 func (dsets *Datasets) serializableStruct() (sdata *serializableDatasets) {
 	sdata = &serializableDatasets{
 		DatasetsUUID: []dvid.UUID{},
 		NewDatasetID: dsets.newDatasetID,
+		KeyFormat:    dsets.keyFormat,
 	}
 	for _, dset := range dsets.list {
 		sdata.DatasetsUUID = append(sdata.DatasetsUUID, dset.Root)
@@ -217,12 +278,15 @@ func (dsets *Datasets) MarshalJSON() (m []byte, err error) {
 	return json.Marshal(dsets.serializableStruct())
 }
 
-// AllJSON returns JSON of all the datasets information.
+// AllJSON returns JSON of all the datasets information, excluding scratch nodes.
 func (dsets *Datasets) AllJSON() (m []byte, err error) {
 	data := struct {
 		Datasets []*Dataset
 	}{
-		dsets.list,
+		make([]*Dataset, len(dsets.list)),
+	}
+	for i, dset := range dsets.list {
+		data.Datasets[i] = dset.withoutScratch()
 	}
 	return json.Marshal(data)
 }
@@ -256,11 +320,13 @@ func (dsets *Datasets) Load(db storage.OrderedKeyValueGetter) (err error) {
 			deserialization.NewDatasetID, len(keyvalues))
 	}
 	dsets.newDatasetID = deserialization.NewDatasetID
+	dsets.keyFormat = deserialization.KeyFormat
 
 	// Reconstruct the Datasets by associating UUIDs.
 	dsets.list = []*Dataset{}
 	dsets.mapUUID = make(map[dvid.UUID]*Dataset)
 	dsets.dsetIDs = make(map[dvid.DatasetLocalID]*Dataset)
+	dsets.unindexed = make(map[dvid.DatasetLocalID]map[dvid.VersionLocalID]bool)
 	for _, value := range keyvalues {
 		dataset := new(Dataset)
 		err := dvid.Deserialize(value.V, dataset)
@@ -268,8 +334,18 @@ func (dsets *Datasets) Load(db storage.OrderedKeyValueGetter) (err error) {
 			return err
 		}
 		dsets.list = append(dsets.list, dataset)
-		for u, _ := range dataset.Nodes {
+		loaded := time.Now()
+		for u, node := range dataset.Nodes {
 			dsets.mapUUID[u] = dataset
+			if node.Scratch {
+				node.lastUsed = loaded // Idle periods restart when the server does.
+			}
+			if !node.KeysIndexed {
+				if dsets.unindexed[dataset.DatasetID] == nil {
+					dsets.unindexed[dataset.DatasetID] = make(map[dvid.VersionLocalID]bool)
+				}
+				dsets.unindexed[dataset.DatasetID][node.VersionID] = true
+			}
 		}
 		dsets.dsetIDs[dataset.DatasetID] = dataset
 	}
@@ -309,6 +385,35 @@ type Dataset struct {
 	// the DataService(name) function to also match possible prefix data names,
 	// e.g., multichannel types.
 	DataMap map[dvid.DataString]DataService
+
+	// Published is the manifest of a published dataset or nil if unpublished.
+	Published *Manifest
+
+	// Trash holds deleted data, which is hidden from listings, until it's restored
+	// or purged.
+	Trash map[dvid.DataString]*TrashedData `json:"-"`
+
+	// Templates are sets of data instances defined for this dataset that can be
+	// created together.
+	Templates map[string]*Template `json:",omitempty"`
+
+	// Aliases maps alternate names to the names of data in DataMap.
+	Aliases map[dvid.DataString]dvid.DataString `json:",omitempty"`
+
+	// Transforms map the coordinates of data to the canonical space of this dataset.
+	Transforms map[dvid.DataString]*Transform `json:",omitempty"`
+
+	// migrations are pending migrations of data written by older data type versions,
+	// which are stored in migrationDB once run, and migrationErrs are failed ones.  Both
+	// are guarded by migrationMu, and unmigrated counts the data not yet migrated.
+	migrations    map[dvid.DataString][]Migration
+	migrationErrs map[dvid.DataString]error
+	migrationDB   storage.OrderedKeyValueSetter
+	migrationMu   sync.Mutex
+	unmigrated    int32
+
+	// publishing is true while the dataset's manifest is computed, guarded by publishMutex.
+	publishing bool
 }
 
 // TypeService returns the TypeService underlying data of a given name.
@@ -327,21 +432,35 @@ func (dset *Dataset) DataService(name dvid.DataString) (dataservice DataService,
 	var found bool
 	dataservice, found = dset.DataMap[name]
 	if !found {
+		if target, isAlias := dset.Aliases[name]; isAlias {
+			if dataservice, found = dset.DataMap[target]; !found {
+				err = fmt.Errorf("Alias '%s' refers to missing data '%s'", name, target)
+				return
+			}
+			err = dset.migrate(target, dataservice)
+			return
+		}
 		// Also allow numerical suffixes on names.
 		for basename, service := range dset.DataMap {
 			if strings.HasPrefix(string(name), string(basename)) {
-				return service, nil
+				return service, dset.migrate(basename, service)
 			}
 		}
 		err = fmt.Errorf("Cannot find data '%s'", name)
 		return
 	}
+	err = dset.migrate(name, dataservice)
 	return
 }
 
-// JSONString returns the JSON for this Data's configuration
+// DataNames returns the names of all data in the dataset in sorted order.
+func (dset *Dataset) DataNames() []dvid.DataString {
+	return dset.sortedDataNames()
+}
+
+// JSONString returns the JSON for this Data's configuration, excluding scratch nodes.
 func (dset *Dataset) JSONString() (jsonStr string, err error) {
-	m, err := json.Marshal(dset)
+	m, err := json.Marshal(dset.withoutScratch())
 	if err != nil {
 		return "", err
 	}
@@ -377,10 +496,20 @@ func (dset *Dataset) newData(name dvid.DataString, typeName dvid.TypeString, con
 	// Only allow unique data names per dataset.
 	// TODO -- Do more elaborate check that prevents prefixing data names using
 	// data types that allow different suffixes, e.g., multichannel data.
+	if err := dset.checkUnpublished(); err != nil {
+		return err
+	}
 	dataservice, found := dset.DataMap[name]
 	if found {
 		return fmt.Errorf("Data named '%s' already exists in dataset %s", name, dset.Root)
 	}
+	if _, found := dset.Trash[name]; found {
+		return fmt.Errorf("Data named '%s' is in the trash of dataset %s; restore or purge it first",
+			name, dset.Root)
+	}
+	if target, found := dset.Aliases[name]; found {
+		return fmt.Errorf("'%s' is an alias of data '%s' in dataset %s", name, target, dset.Root)
+	}
 
 	// Create new data for this dataset.
 	typeService, err := TypeServiceByName(typeName)
@@ -407,7 +536,13 @@ func (dset *Dataset) newData(name dvid.DataString, typeName dvid.TypeString, con
 // modifyData modifies preexisting Data within a Dataset.  Settings can be passed
 // via the 'config' argument.  Only settings within the passed config are modified.
 func (dset *Dataset) modifyData(name dvid.DataString, config dvid.Config) error {
+	if err := dset.checkUnpublished(); err != nil {
+		return err
+	}
 	dataservice, found := dset.DataMap[name]
+	if target, isAlias := dset.Aliases[name]; isAlias && !found {
+		dataservice, found = dset.DataMap[target]
+	}
 	if !found {
 		return fmt.Errorf("Data '%s' not found in dataset %s", name, dset.Root)
 	}
@@ -452,11 +587,20 @@ type NodeVersion struct {
 	// Parents is an ordered list of parent nodes.
 	Parents []dvid.UUID
 
-	// Children is a list of child nodes.
+	// Children is a list of child nodes.  Scratch children aren't included.
 	Children []dvid.UUID
 
 	Created time.Time
 	Updated time.Time
+
+	// Scratch nodes are ephemeral children that are hidden from listings and deleted
+	// once unused for ScratchIdle.  See scratch.go.
+	Scratch     bool          `json:",omitempty"`
+	ScratchIdle time.Duration `json:",omitempty"`
+
+	// KeysIndexed is true if every key written at this version is in the version index,
+	// i.e., the node was created by a DVID maintaining the index.  See versionindex.go.
+	KeysIndexed bool `json:",omitempty"`
 }
 
 // NodeText holds provenance and other information useful for analysis.  It's
@@ -482,7 +626,18 @@ type Node struct {
 	// if unversioned.
 	Avail map[dvid.DataString]DataAvail
 
+	// Storage is the node's storage accounting as of its last computation, if any.
+	Storage *NodeStorage `json:",omitempty"`
+
+	// lastUsed is when a scratch node was last requested since the server started.
+	lastUsed time.Time
+
 	writeLock sync.Mutex
+
+	// writes is read-locked by each write in progress at the node, so deleting the node
+	// can wait for them, and deleted refuses later writes.  See BeginWrite.
+	writes  sync.RWMutex
+	deleted bool
 }
 
 // VersionDAG is the directed acyclic graph of NodeVersion and an index by UUID into
@@ -504,17 +659,22 @@ type VersionDAG struct {
 // NewVersionDAG creates a version DAG and initializes the first unlocked node,
 // assigning its UUID.
 func NewVersionDAG() *VersionDAG {
+	return newVersionDAG(dvid.NewUUID())
+}
+
+func newVersionDAG(root dvid.UUID) *VersionDAG {
 	dag := VersionDAG{
-		Root:       dvid.NewUUID(),
+		Root:       root,
 		Nodes:      make(map[dvid.UUID]*Node),
 		VersionMap: make(map[dvid.UUID]dvid.VersionLocalID),
 	}
 	t := time.Now()
 	version := &NodeVersion{
-		GlobalID:  dag.Root,
-		VersionID: 0,
-		Created:   t,
-		Updated:   t,
+		GlobalID:    dag.Root,
+		VersionID:   0,
+		Created:     t,
+		Updated:     t,
+		KeysIndexed: true,
 	}
 	dag.Nodes[dag.Root] = &Node{NodeVersion: version}
 	dag.VersionMap[dag.Root] = 0
@@ -525,10 +685,15 @@ func NewVersionDAG() *VersionDAG {
 // Lock locks a node.  This is an irreversible operation since some nodes
 // can be cloned externally.
 func (dag *VersionDAG) Lock(u dvid.UUID) error {
+	dag.mapLock.Lock()
+	defer dag.mapLock.Unlock()
 	node, found := dag.Nodes[u]
 	if !found {
 		return fmt.Errorf("No node found with UUID %s", u)
 	}
+	if node.Scratch {
+		return fmt.Errorf("Cannot lock scratch node %s", u)
+	}
 	node.Locked = true
 	return nil
 }
@@ -536,6 +701,12 @@ func (dag *VersionDAG) Lock(u dvid.UUID) error {
 // newChild creates a new child node off a LOCKED parent node.  Will return
 // an error if the parent node has not been locked.
 func (dag *VersionDAG) newChild(parent dvid.UUID) (u dvid.UUID, err error) {
+	return dag.addChild(parent, false, 0)
+}
+
+// addChild creates a child node off a LOCKED parent node.  Scratch children are deleted
+// after being idle for the given duration and aren't added to the parent's children.
+func (dag *VersionDAG) addChild(parent dvid.UUID, scratch bool, idle time.Duration) (u dvid.UUID, err error) {
 	node, found := dag.Nodes[parent]
 	if !found {
 		err = fmt.Errorf("No node found with UUID %s", parent)
@@ -549,20 +720,25 @@ func (dag *VersionDAG) newChild(parent dvid.UUID) (u dvid.UUID, err error) {
 	u = dvid.NewUUID()
 	t := time.Now()
 
-	node.writeLock.Lock()
-	node.Children = append(node.Children, u)
-	node.Updated = t
-	node.writeLock.Unlock()
+	if !scratch {
+		node.writeLock.Lock()
+		node.Children = append(node.Children, u)
+		node.Updated = t
+		node.writeLock.Unlock()
+	}
 
 	dag.mapLock.Lock()
 	version := &NodeVersion{
-		GlobalID:  u,
-		VersionID: dag.NewVersionID,
-		Created:   t,
-		Updated:   t,
-		Parents:   []dvid.UUID{parent},
-	}
-	dag.Nodes[u] = &Node{NodeVersion: version}
+		GlobalID:    u,
+		VersionID:   dag.NewVersionID,
+		Created:     t,
+		Updated:     t,
+		Parents:     []dvid.UUID{parent},
+		Scratch:     scratch,
+		ScratchIdle: idle,
+		KeysIndexed: true,
+	}
+	dag.Nodes[u] = &Node{NodeVersion: version, lastUsed: t}
 	dag.VersionMap[u] = version.VersionID
 	dag.NewVersionID++
 	dag.mapLock.Unlock()
@@ -578,6 +754,21 @@ func (dag *VersionDAG) LogInfo() string {
 	return text
 }
 
+// LatestLocked returns the most recently created locked node, i.e., the latest commit,
+// or the root if no node is locked.
+func (dag *VersionDAG) LatestLocked() dvid.UUID {
+	dag.mapLock.Lock()
+	defer dag.mapLock.Unlock()
+	latest := dag.Root
+	var latestNode *Node
+	for u, node := range dag.Nodes {
+		if node.Locked && (latestNode == nil || node.VersionID > latestNode.VersionID) {
+			latest, latestNode = u, node
+		}
+	}
+	return latest
+}
+
 // Versions returns a slice of UUID within this version DAG.
 func (dag *VersionDAG) Versions() []dvid.UUID {
 	uuids := []dvid.UUID{}
@@ -5,6 +5,7 @@
 package datastore
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -50,7 +51,7 @@ func Init(directory string, create bool, config dvid.Config) error {
 	if !ok {
 		return fmt.Errorf("Datastore at %s does not support setting of key-value pairs!", directory)
 	}
-	datasets := new(Datasets)
+	datasets := &Datasets{keyFormat: CurrentKeyFormat}
 	err = datasets.Put(db)
 	return err
 }
@@ -73,6 +74,8 @@ const (
 	ErrorOpening OpenErrorType = iota
 	ErrorDatasets
 	ErrorDatatypeUnavailable
+	ErrorDatatypeVersion
+	ErrorKeyFormat
 )
 
 type OpenError struct {
@@ -131,6 +134,16 @@ func Open(path string) (s *Service, openErr *OpenError) {
 		return
 	}
 
+	// Verify that data keys have the layout this DVID expects.
+	if datasets.keyFormat != CurrentKeyFormat {
+		engine.Close()
+		openErr = &OpenError{
+			fmt.Errorf("Data keys use an older layout.  Run \"dvid migrate-keys %s\" first.", path),
+			ErrorKeyFormat,
+		}
+		return
+	}
+
 	// Verify that the runtime configuration can be supported by this DVID's
 	// compiled-in data types.
 	dvid.Fmt(dvid.Debug, "Verifying datastore's supported types were compiled into DVID...\n")
@@ -143,8 +156,36 @@ func Open(path string) (s *Service, openErr *OpenError) {
 		return
 	}
 
+	// Verify that data written by older data type versions can be migrated.
+	err = datasets.checkTypeVersions(kvSetter)
+	if err != nil {
+		openErr = &OpenError{
+			fmt.Errorf("Data were written by unsupported data type versions:\n%s", err.Error()),
+			ErrorDatatypeVersion,
+		}
+		return
+	}
+
+	// Index data keys by version as they're written.
+	indexed, err := newIndexingDB(kvDB, datasets)
+	if err != nil {
+		engine.Close()
+		openErr = &OpenError{err, ErrorOpening}
+		return
+	}
+
+	// Migrate data written by older data type versions in the background.
+	datasets.migrated = make(chan struct{})
+	go datasets.runMigrations()
+
 	fmt.Printf("\nDatastoreService successfully opened: %s\n", path)
-	s = &Service{datasets, engine, kvDB, kvSetter, kvGetter}
+	s = &Service{datasets, engine, indexed, indexed, indexed}
+
+	// Index the keys of versions created before the version index in the background.
+	ctx, cancel := context.WithCancel(context.Background())
+	datasets.indexed = make(chan struct{})
+	datasets.stopIndexing = cancel
+	go s.indexVersions(ctx)
 	return
 }
 
@@ -180,6 +221,8 @@ func (s *Service) Batcher() (db storage.Batcher, err error) {
 
 // Shutdown closes a DVID datastore.
 func (s *Service) Shutdown() {
+	s.WaitForMigrations()
+	s.stopVersionIndexing()
 	s.engine.Close()
 }
 
@@ -231,23 +274,25 @@ func (s *Service) DatasetJSON(root dvid.UUID) (stringJSON string, err error) {
 
 // NewDataset creates a new dataset.
 func (s *Service) NewDataset() (root dvid.UUID, datasetID dvid.DatasetLocalID, err error) {
+	return s.NewDatasetWithRoot("")
+}
+
+// NewDatasetWithRoot creates a new dataset whose root node has the given UUID, e.g.,
+// one chosen by another server.  A new UUID is used if root is empty.
+func (s *Service) NewDatasetWithRoot(root dvid.UUID) (dvid.UUID, dvid.DatasetLocalID, error) {
 	if s.Datasets == nil {
-		err = fmt.Errorf("Datastore service has no datasets available")
-		return
+		return "", 0, fmt.Errorf("Datastore service has no datasets available")
 	}
-	var dataset *Dataset
-	dataset, err = s.Datasets.newDataset()
+	dataset, err := s.Datasets.newDataset(root)
 	if err != nil {
-		return
+		return "", 0, err
 	}
 	err = s.Datasets.Put(s.kvSetter) // Need to persist change to list of Dataset
 	if err != nil {
-		return
+		return "", 0, err
 	}
 	err = dataset.Put(s.kvSetter)
-	root = dataset.Root
-	datasetID = dataset.DatasetID
-	return
+	return dataset.Root, dataset.DatasetID, err
 }
 
 // NewVersions creates a new version (child node) off of a LOCKED parent node.
@@ -314,6 +359,22 @@ func (s *Service) Lock(u dvid.UUID) error {
 	return dataset.Put(s.kvSetter)
 }
 
+// Locked returns true if the node with the given UUID is locked.
+func (s *Service) Locked(u dvid.UUID) (bool, error) {
+	if s.Datasets == nil {
+		return false, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return false, err
+	}
+	node, found := dataset.Nodes[u]
+	if !found {
+		return false, fmt.Errorf("No node found with UUID %s", u)
+	}
+	return node.Locked, nil
+}
+
 // SaveDataset forces this service to persist the dataset with given UUID.
 // It is useful when modifying datasets internally.
 func (s *Service) SaveDataset(u dvid.UUID) error {
@@ -348,6 +409,45 @@ func (s *Service) LocalIDFromUUID(u dvid.UUID) (dID dvid.DatasetLocalID, vID dvi
 	return
 }
 
+// UUIDFromLocalID returns the UUID of a version given the local IDs of its dataset and
+// version.
+func (s *Service) UUIDFromLocalID(dID dvid.DatasetLocalID, vID dvid.VersionLocalID) (dvid.UUID, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromLocalID(dID)
+	if err != nil {
+		return "", err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	for u, v := range dataset.VersionMap {
+		if v == vID {
+			return u, nil
+		}
+	}
+	return "", fmt.Errorf("No version with local ID %d in dataset %d", vID, dID)
+}
+
+// HasParents returns true if the node with the given UUID has a parent, so data at its
+// ancestors can be visible at the node.
+func (s *Service) HasParents(u dvid.UUID) (bool, error) {
+	if s.Datasets == nil {
+		return false, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return false, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	node, found := dataset.Nodes[u]
+	if !found {
+		return false, fmt.Errorf("No node found with UUID %s", u)
+	}
+	return len(node.Parents) > 0, nil
+}
+
 // NodeIDFromString when supplied a UUID string, returns the matched UUID as well as
 // more compact local IDs that identify the dataset and a version.  Partial matches
 // are allowed, similar to DatasetFromString.
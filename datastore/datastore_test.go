@@ -32,3 +32,41 @@ func (suite *DataSuite) SetUpSuite(c *C) {
 	suite.service, err = Open(suite.dir)
 	c.Assert(err, IsNil)
 }
+
+// newTestData opens a datastore in a new directory with migratetest data of the given
+// name in a new dataset.  The returned function shuts the datastore down.
+func newTestData(c *C, name dvid.DataString, config dvid.Config) (*Service, dvid.UUID, *migrateData, func()) {
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", name, config), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, name)
+	c.Assert(err, IsNil)
+	return service, root, dataservice.(*migrateData), func() {
+		service.Shutdown()
+		delete(CompiledTypes, migrateTypeUrl)
+	}
+}
+
+// putTestKeys writes the keys of data with indices beg up to end at a version, standing
+// in for blocks of voxels.
+func putTestKeys(c *C, service *Service, uuid dvid.UUID, data *migrateData, beg, end byte, value []byte) {
+	_, version, err := service.LocalIDFromUUID(uuid)
+	c.Assert(err, IsNil)
+	for i := beg; i < end; i++ {
+		c.Assert(service.kvSetter.Put(data.DataKey(version, dvid.IndexBytes{i}), value), IsNil)
+	}
+}
+
+// countTestKeys returns the number of keys of data across all versions.
+func countTestKeys(c *C, service *Service, data *migrateData) int {
+	begKey := data.DataKey(0, dvid.IndexBytes{})
+	endKey := &DataKey{Dataset: data.DsetID, Data: data.ID + 1, Index: dvid.IndexBytes{}}
+	keys, err := service.kvGetter.KeysInRange(begKey, endKey)
+	c.Assert(err, IsNil)
+	return len(keys)
+}
@@ -5,12 +5,14 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/storage"
@@ -63,6 +65,22 @@ type Subsetter interface {
 	AvailableExtents() dvid.IndexRange
 }
 
+// ReadOnlyPoster is implemented by data with POST endpoints that only read, e.g., bulk
+// existence checks whose lists of keys are too long for a query string.
+type ReadOnlyPoster interface {
+	// ReadOnlyPost returns true if a POST to the endpoint, i.e., the URL part after the
+	// data name with nothing following, doesn't modify data.
+	ReadOnlyPost(endpoint string) bool
+}
+
+// ReadOnlyCommander is implemented by data with RPC commands that only read, e.g.,
+// exports, so they can run at nodes whose writes are blocked.
+type ReadOnlyCommander interface {
+	// ReadOnlyCommand returns true if the command, e.g., "node <UUID> <data name>
+	// export ...", doesn't modify data.
+	ReadOnlyCommand(request Request) bool
+}
+
 // DataService is an interface for operations on arbitrary data that
 // use a supported TypeService.  Chunk handlers are allocated at this level,
 // so an implementation can own a number of goroutines.
@@ -97,6 +115,35 @@ type DataService interface {
 type Request struct {
 	dvid.Command
 	Input []byte
+
+	// IdempotencyKey is an optional client-generated key so retries of a command that
+	// modifies data return the original reply instead of repeating the command.
+	IdempotencyKey string
+
+	// InputUpload is the ID of an upload session whose contents become the Input, so
+	// large input can be streamed in chunks instead of sent in one message.
+	InputUpload string
+
+	// AdminToken authenticates commands sent to the admin RPC port.
+	AdminToken string
+
+	// ctx is set by the server and is not sent over RPC.
+	ctx context.Context
+}
+
+// Context returns the context of the request, which is canceled if the server shuts
+// down.  It is never nil.
+func (r Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a copy of the request with the given context.
+func (r Request) WithContext(ctx context.Context) Request {
+	r.ctx = ctx
+	return r
 }
 
 var (
@@ -155,6 +202,9 @@ func CompiledTypeChart() string {
 	for _, datatype := range CompiledTypes {
 		writeLine(datatype.DatatypeName(), datatype.DatatypeUrl())
 	}
+	for url, path := range PluginTypes {
+		text += fmt.Sprintf("\n%s loaded from plugin %s", url, path)
+	}
 	return text + "\n"
 }
 
@@ -266,6 +316,12 @@ type Data struct {
 
 	// If false (default), we allow changes along nodes.
 	Unversioned bool
+
+	// Limits on the size of requests to this data.
+	Limits QueryLimits
+
+	// Expires is when this data is deleted.  The zero time means it never expires.
+	Expires time.Time
 }
 
 func (d *Data) UseCompression() dvid.Compression {
@@ -334,7 +390,10 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 			return fmt.Errorf("Illegal checksum specified: %s", s)
 		}
 	}
-	return nil
+	if err := d.SetTTL(config); err != nil {
+		return err
+	}
+	return d.SetLimits(config)
 }
 
 func (d *Data) UnknownCommand(request Request) error {
@@ -352,6 +411,7 @@ type nodeID struct {
 
 // Map of mutexes at the granularity of dataset/data/version
 var versionMutexes map[nodeID]*sync.Mutex
+var versionMutexesMu sync.Mutex
 
 func init() {
 	versionMutexes = make(map[nodeID]*sync.Mutex)
@@ -359,14 +419,13 @@ func init() {
 
 // VersionMutex returns a Mutex that is specific for data at a particular version.
 func (d *Data) VersionMutex(versionID dvid.VersionLocalID) *sync.Mutex {
-	var mutex sync.Mutex
-	mutex.Lock()
+	versionMutexesMu.Lock()
+	defer versionMutexesMu.Unlock()
 	id := nodeID{d.DsetID, d.ID, versionID}
 	vmutex, found := versionMutexes[id]
 	if !found {
 		vmutex = new(sync.Mutex)
 		versionMutexes[id] = vmutex
 	}
-	mutex.Unlock()
 	return vmutex
 }
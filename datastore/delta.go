@@ -0,0 +1,419 @@
+/*
+	This file supports incremental replication.  A delta holds the key/value pairs of a
+	dataset written in versions since a synced node, which are found directly from the
+	version in each data key, so mirrors only transfer what changed.
+*/
+
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DeltaBatchSize is the number of key/value pairs written per batch when applying a delta.
+const DeltaBatchSize = 1000
+
+// DeltaStats describes a written or applied delta.
+type DeltaStats struct {
+	Versions int
+	Keys     int64
+	Bytes    int64
+}
+
+// deltaVersions returns the versions in the lineage of node u that aren't in the lineage
+// of the synced node, which must be a locked ancestor of u so it can't change afterwards.
+func (dset *Dataset) deltaVersions(u, synced dvid.UUID) ([]dvid.VersionLocalID, error) {
+	node, found := dset.Nodes[synced]
+	if !found {
+		return nil, fmt.Errorf("Synced node %s is not in dataset %s", synced, dset.Root)
+	}
+	if !node.Locked {
+		return nil, fmt.Errorf("Synced node %s must be locked to compute a delta", synced)
+	}
+	lineage, err := dset.lineage(u)
+	if err != nil {
+		return nil, err
+	}
+	syncedLineage, err := dset.lineage(synced)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[dvid.UUID]bool, len(syncedLineage))
+	for _, ancestor := range syncedLineage {
+		have[ancestor] = true
+	}
+	if !containsUUID(lineage, synced) {
+		return nil, fmt.Errorf("Synced node %s is not an ancestor of node %s", synced, u)
+	}
+	var versions []dvid.VersionLocalID
+	for _, ancestor := range lineage {
+		if !have[ancestor] {
+			versions = append(versions, dset.VersionMap[ancestor])
+		}
+	}
+	return versions, nil
+}
+
+// containsUUID returns true if the UUID is in the slice.
+func containsUUID(uuids []dvid.UUID, u dvid.UUID) bool {
+	for _, v := range uuids {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits on the sizes of the keys and values of a delta, so a bad delta can't make a
+// server allocate unbounded memory.
+const (
+	MaxDeltaKeySize   = dvid.Mega
+	MaxDeltaValueSize = dvid.Giga
+)
+
+// writeDeltaPair writes a length-prefixed key and value.
+func writeDeltaPair(w io.Writer, key, value []byte) error {
+	var sizes [8]byte
+	binary.BigEndian.PutUint32(sizes[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(sizes[4:8], uint32(len(value)))
+	if _, err := w.Write(sizes[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(key); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+// readDeltaPair reads a length-prefixed key and value.  The end of a delta is marked by
+// an empty key so truncated deltas are detected.  Sizes beyond MaxDeltaKeySize and
+// MaxDeltaValueSize are refused, and memory is only allocated as bytes arrive.
+func readDeltaPair(r io.Reader) (key, value []byte, err error) {
+	var sizes [8]byte
+	if _, err = io.ReadFull(r, sizes[:]); err != nil {
+		err = fmt.Errorf("Delta is incomplete: %s", err.Error())
+		return
+	}
+	keySize := int64(binary.BigEndian.Uint32(sizes[0:4]))
+	valueSize := int64(binary.BigEndian.Uint32(sizes[4:8]))
+	if keySize > MaxDeltaKeySize || valueSize > MaxDeltaValueSize {
+		err = fmt.Errorf("Delta has a %d byte key and %d byte value, exceeding the limits of %d and %d bytes",
+			keySize, valueSize, MaxDeltaKeySize, MaxDeltaValueSize)
+		return
+	}
+	readBytes := func(n int64) ([]byte, error) {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, n); err != nil {
+			return nil, fmt.Errorf("Delta is incomplete: %s", err.Error())
+		}
+		return buf.Bytes(), nil
+	}
+	if key, err = readBytes(keySize); err == nil {
+		value, err = readBytes(valueSize)
+	}
+	return
+}
+
+// WriteDelta writes the dataset metadata and all key/value pairs of the dataset's data
+// written in versions of node u's lineage after the locked, synced node.  Keys of
+// versions with KeysIndexed are found from the version index.  Only versions of nodes
+// created before the index, until they're indexed in the background after the datastore
+// is opened, require a scan of every key of the dataset's data.
+func (s *Service) WriteDelta(ctx context.Context, w io.Writer, u, synced dvid.UUID) (*DeltaStats, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := dataset.deltaVersions(u, synced)
+	if err != nil {
+		return nil, err
+	}
+	metadataKey := dataset.Key()
+	metadata, err := s.kvGetter.Get(metadataKey)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeDeltaPair(bw, metadataKey.Bytes(), metadata); err != nil {
+		return nil, err
+	}
+	stats := &DeltaStats{Versions: len(versions)}
+	writePair := func(keyBytes, value []byte) error {
+		stats.Keys++
+		stats.Bytes += int64(len(keyBytes) + len(value))
+		return writeDeltaPair(bw, keyBytes, value)
+	}
+
+	// Only write keys of data in the dataset, not of deleted data.
+	live := make(map[dvid.DataLocalID]bool)
+	var liveData []expiringData
+	for _, name := range dataset.sortedDataNames() {
+		data, ok := dataset.DataMap[name].(expiringData)
+		if !ok {
+			return nil, fmt.Errorf("Unable to get keys of data '%s'", name)
+		}
+		live[data.LocalID()] = true
+		liveData = append(liveData, data)
+	}
+	indexed := make(map[dvid.VersionLocalID]bool)
+	dataset.mapLock.Lock()
+	for _, node := range dataset.Nodes {
+		if node.KeysIndexed {
+			indexed[node.VersionID] = true
+		}
+	}
+	dataset.mapLock.Unlock()
+
+	unindexed := make(map[dvid.VersionLocalID]bool)
+	for _, version := range versions {
+		if !indexed[version] {
+			unindexed[version] = true
+			continue
+		}
+		err := s.processVersionKeys(ctx, dataset.DatasetID, version, func(keyBytes []byte) error {
+			key, err := (&DataKey{Index: dvid.IndexBytes{}}).BytesToKey(keyBytes)
+			if err != nil {
+				return err
+			}
+			if !live[key.(*DataKey).Data] {
+				return nil
+			}
+			value, err := s.kvGetter.Get(key)
+			if err != nil || value == nil {
+				return err
+			}
+			return writePair(keyBytes, value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(unindexed) != 0 {
+		for _, data := range liveData {
+			begKey := &DataKey{Dataset: dataset.DatasetID, Data: data.LocalID(), Index: dvid.IndexBytes{}}
+			endKey := &DataKey{Dataset: dataset.DatasetID, Data: data.LocalID() + 1, Index: dvid.IndexBytes{}}
+			var writeErr error
+			err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{Ctx: ctx}, func(chunk *storage.Chunk) {
+				key, ok := chunk.K.(*DataKey)
+				if writeErr != nil || !ok || key.Data != data.LocalID() || !unindexed[key.Version] {
+					return
+				}
+				writeErr = writePair(key.Bytes(), chunk.V)
+			})
+			if err == nil {
+				err = writeErr
+			}
+			if err == nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := writeDeltaPair(bw, nil, nil); err != nil {
+		return nil, err
+	}
+	return stats, bw.Flush()
+}
+
+// checkDelta returns an error if a dataset read from a delta can't replace the dataset
+// held by this server, i.e., it isn't a later state of the same dataset.
+func (dsets *Datasets) checkDelta(dataset *Dataset) error {
+	dsets.writeLock.Lock()
+	old, found := dsets.dsetIDs[dataset.DatasetID]
+	dsets.writeLock.Unlock()
+	if !found || old.Root != dataset.Root {
+		return fmt.Errorf("Dataset %s is not held by this server", dataset.Root)
+	}
+	old.mapLock.Lock()
+	defer old.mapLock.Unlock()
+	for u, node := range old.Nodes {
+		newNode, found := dataset.Nodes[u]
+		if !found || newNode.VersionID != node.VersionID {
+			return fmt.Errorf("Delta for dataset %s doesn't include node %s", dataset.Root, u)
+		}
+	}
+	return nil
+}
+
+// checkDeltaKey returns an error if a key of a delta isn't a key of the delta's dataset
+// at a version that can still be written.
+func (dsets *Datasets) checkDeltaKey(dataset *Dataset, writable map[dvid.VersionLocalID]bool,
+	dataIDs map[dvid.DataLocalID]bool, key *DataKey) error {
+
+	if key.Dataset != dataset.DatasetID {
+		return fmt.Errorf("Delta for dataset %s has a key of another dataset", dataset.Root)
+	}
+	if !writable[key.Version] {
+		return fmt.Errorf("Delta for dataset %s has a key of version %d, which isn't a new or unlocked node",
+			dataset.Root, key.Version)
+	}
+	if !dataIDs[key.Data] {
+		return fmt.Errorf("Delta for dataset %s has a key of unknown data %d", dataset.Root, key.Data)
+	}
+	return nil
+}
+
+// ApplyDelta stores the key/value pairs of a delta written by WriteDelta, then replaces
+// the in-memory dataset with the delta's metadata so new nodes become visible only after
+// their data is stored.  The whole delta is read and checked before anything is written,
+// so a bad or truncated delta changes nothing.
+func (s *Service) ApplyDelta(r io.Reader) (*DeltaStats, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	br := bufio.NewReader(r)
+	keyBytes, metadata, err := readDeltaPair(br)
+	if err != nil {
+		return nil, err
+	}
+	metadataKey, err := (&DatasetKey{}).BytesToKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Delta must start with dataset metadata: %s", err.Error())
+	}
+	dataset := new(Dataset)
+	if err := dvid.Deserialize(metadata, dataset); err != nil {
+		return nil, err
+	}
+	if err := s.Datasets.checkDelta(dataset); err != nil {
+		return nil, err
+	}
+	old, err := s.Datasets.DatasetFromUUID(dataset.Root)
+	if err != nil {
+		return nil, err
+	}
+	old.mapLock.Lock()
+	writable := make(map[dvid.VersionLocalID]bool)
+	for u, node := range dataset.Nodes {
+		if oldNode, found := old.Nodes[u]; !found || !oldNode.Locked {
+			writable[node.VersionID] = true
+		}
+	}
+	old.mapLock.Unlock()
+	dataIDs := make(map[dvid.DataLocalID]bool)
+	for name, dataservice := range dataset.DataMap {
+		data, ok := dataservice.(expiringData)
+		if !ok {
+			return nil, fmt.Errorf("Unable to get ID of data '%s' in delta", name)
+		}
+		dataIDs[data.LocalID()] = true
+	}
+
+	// Check the pairs while copying them to a temporary file, then store them.
+	spool, err := ioutil.TempFile("", "dvid-delta-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	sw := bufio.NewWriter(spool)
+	stats := new(DeltaStats)
+	versions := make(map[dvid.VersionLocalID]bool)
+	for {
+		keyBytes, value, err := readDeltaPair(br)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeDeltaPair(sw, keyBytes, value); err != nil {
+			return nil, err
+		}
+		if len(keyBytes) == 0 {
+			break
+		}
+		key, err := (&DataKey{Index: dvid.IndexBytes{}}).BytesToKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		dataKey := key.(*DataKey)
+		if err := s.Datasets.checkDeltaKey(dataset, writable, dataIDs, dataKey); err != nil {
+			return nil, err
+		}
+		versions[dataKey.Version] = true
+		stats.Keys++
+		stats.Bytes += int64(len(keyBytes) + len(value))
+	}
+	if err := sw.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := spool.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	sr := bufio.NewReader(spool)
+	var batch []storage.KeyValue
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := s.kvSetter.PutRange(batch)
+		batch = batch[:0]
+		return err
+	}
+	for {
+		keyBytes, value, err := readDeltaPair(sr)
+		if err != nil {
+			return nil, err
+		}
+		if len(keyBytes) == 0 {
+			break
+		}
+		key, err := (&DataKey{Index: dvid.IndexBytes{}}).BytesToKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, storage.KeyValue{K: key, V: value})
+		if len(batch) == DeltaBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if err := s.kvSetter.Put(metadataKey, metadata); err != nil {
+		return nil, err
+	}
+	if err := s.Datasets.replaceDataset(dataset); err != nil {
+		return nil, err
+	}
+	stats.Versions = len(versions)
+	return stats, nil
+}
+
+// replaceDataset replaces a known dataset with the given one, e.g., one with new nodes.
+func (dsets *Datasets) replaceDataset(dataset *Dataset) error {
+	dsets.writeLock.Lock()
+	defer dsets.writeLock.Unlock()
+	old, found := dsets.dsetIDs[dataset.DatasetID]
+	if !found || old.Root != dataset.Root {
+		return fmt.Errorf("Dataset %s is not held by this server", dataset.Root)
+	}
+	for i, dset := range dsets.list {
+		if dset == old {
+			dsets.list[i] = dataset
+		}
+	}
+	for u := range dataset.Nodes {
+		dsets.mapUUID[u] = dataset
+	}
+	dsets.dsetIDs[dataset.DatasetID] = dataset
+	return nil
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestDelta(c *C) {
+	service, root, mirrored, done := newTestData(c, "mirrored", dvid.NewConfig())
+	defer done()
+	putTestKeys(c, service, root, mirrored, 0, 8, []byte("root"))
+
+	// Deltas must start from a locked node.
+	var buf bytes.Buffer
+	_, err := service.WriteDelta(context.Background(), &buf, root, root)
+	c.Assert(err, NotNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	putTestKeys(c, service, child, mirrored, 8, 16, []byte("child"))
+
+	// Only the child's writes are in the delta.
+	buf.Reset()
+	stats, err := service.WriteDelta(context.Background(), &buf, child, root)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Versions, Equals, 1)
+	c.Assert(stats.Keys, Equals, int64(8))
+	_, err = service.WriteDelta(context.Background(), &bytes.Buffer{}, root, child)
+	c.Assert(err, NotNil)
+
+	// Nodes created before the version index are scanned for the same keys.
+	dataset, err := service.Datasets.DatasetFromUUID(child)
+	c.Assert(err, IsNil)
+	node := dataset.Nodes[child]
+	node.KeysIndexed = false
+	var scanned bytes.Buffer
+	scannedStats, err := service.WriteDelta(context.Background(), &scanned, child, root)
+	node.KeysIndexed = true
+	c.Assert(err, IsNil)
+	c.Assert(scannedStats, DeepEquals, stats)
+	c.Assert(scanned.Len(), Equals, buf.Len())
+
+	// Bad or truncated deltas are refused before anything is written.
+	delta := buf.Bytes()
+	_, err = service.ApplyDelta(bytes.NewReader(delta[:len(delta)-4]))
+	c.Assert(err, NotNil)
+	huge := append([]byte{}, delta...)
+	binary.BigEndian.PutUint32(huge[len(huge)-8:], 1<<31)
+	_, err = service.ApplyDelta(bytes.NewReader(huge))
+	c.Assert(err, NotNil)
+	applied, err := service.ApplyDelta(bytes.NewReader(delta))
+	c.Assert(err, IsNil)
+	c.Assert(applied, DeepEquals, stats)
+	locked, err := service.Locked(child)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, false)
+}
@@ -0,0 +1,233 @@
+/*
+	This file supports data instances with a time-to-live, e.g., scratch prediction outputs,
+	which are deleted with all their keys once they expire.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// SetTTL sets when the data expires if the configuration has a "TTL" duration, e.g.,
+// "72h", measured from now.  A TTL of "0" or "none" removes any expiration.
+func (d *Data) SetTTL(config dvid.Config) error {
+	s, found, err := config.GetString("TTL")
+	if err != nil || !found {
+		return err
+	}
+	if s == "0" || strings.ToLower(s) == "none" {
+		d.Expires = time.Time{}
+		return nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("Bad TTL %q: must be a positive duration like \"72h\" or \"none\"", s)
+	}
+	d.Expires = time.Now().Add(ttl)
+	return nil
+}
+
+// ExpiresAt returns when the data expires or the zero time if it never does.
+func (d *Data) ExpiresAt() time.Time {
+	return d.Expires
+}
+
+// expiringData is data that can be deleted when it expires.
+type expiringData interface {
+	DataService
+	ExpiresAt() time.Time
+	LocalID() dvid.DataLocalID
+	DatasetID() dvid.DatasetLocalID
+}
+
+// DeletedData describes a deleted data instance and the keys reclaimed.  Bytes counts the
+// bytes of the keys since values aren't read to delete them.
+type DeletedData struct {
+	Dataset dvid.UUID
+	Name    dvid.DataString
+	Keys    int64
+	Bytes   int64
+}
+
+// purgeData removes data, or trashed data if trashed is true, from the dataset holding
+// the given UUID then deletes all of its keys across versions.
+func (s *Service) purgeData(u dvid.UUID, name dvid.DataString, trashed bool) (*DeletedData, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	var dataservice DataService
+	if trashed {
+		var t *TrashedData
+		var found bool
+		dataset.mapLock.Lock()
+		if t, found = dataset.Trash[name]; found {
+			dataservice = t.Data
+			delete(dataset.Trash, name)
+		}
+		dataset.mapLock.Unlock()
+		if !found {
+			return nil, fmt.Errorf("Data '%s' not found in trash of dataset %s", name, dataset.Root)
+		}
+	} else if dataservice, err = s.removeExpiredData(dataset, name); err != nil {
+		return nil, err
+	}
+	if err := dataset.Put(s.kvSetter); err != nil {
+		return nil, err
+	}
+	data, ok := dataservice.(expiringData)
+	if !ok {
+		return nil, fmt.Errorf("Unable to get keys of data '%s'", name)
+	}
+	deleted := &DeletedData{Dataset: dataset.Root, Name: name}
+	deleted.Keys, deleted.Bytes, err = s.deleteDataKeys(data.DatasetID(), data.LocalID())
+	return deleted, err
+}
+
+// removeExpiredData removes data from its dataset unless the dataset is published or
+// being published, or the data has keys at a locked node, which must not change.  The
+// publication lock and mapLock are held until the data is removed, so neither
+// publication nor the locking of a node can start while the data is still writable.
+func (s *Service) removeExpiredData(dataset *Dataset, name dvid.DataString) (DataService, error) {
+	publishMutex.RLock()
+	defer publishMutex.RUnlock()
+	if err := dataset.publicationErr(); err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	dataservice, found := dataset.DataMap[name]
+	if !found {
+		return nil, fmt.Errorf("Data '%s' not found in dataset %s", name, dataset.Root)
+	}
+	data, ok := dataservice.(expiringData)
+	if !ok {
+		return nil, fmt.Errorf("Unable to get keys of data '%s'", name)
+	}
+	for u, node := range dataset.Nodes {
+		if !node.Locked {
+			continue
+		}
+		// Versions outside the version index may have keys of the data.
+		hasKeys := true
+		if node.KeysIndexed {
+			var err error
+			hasKeys, err = s.versionHasKeys(data.DatasetID(), node.VersionID, data.LocalID())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if hasKeys {
+			return nil, fmt.Errorf("Expired data '%s' is kept since it has keys at locked node %s", name, u)
+		}
+	}
+	delete(dataset.DataMap, name)
+	delete(dataset.Transforms, name)
+	return dataservice, nil
+}
+
+// deleteDataKeys deletes all keys of data across versions, returning the number of
+// keys and the bytes of keys deleted.
+func (s *Service) deleteDataKeys(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID) (int64, int64, error) {
+	begKey := &DataKey{dsetID, dataID, 0, dvid.IndexBytes{}}
+	endKey := &DataKey{dsetID, dataID + 1, 0, dvid.IndexBytes{}}
+	return s.deleteKeyRange(context.Background(), begKey, endKey, func(key *DataKey) bool { return key.Data == dataID })
+}
+
+// deleteKeyRange deletes the keys between begKey and endKey that match, returning the
+// number of keys and the bytes of keys deleted.  Only keys are read, and they're deleted
+// in batches of at most storage.RangeBatchSize keys.
+func (s *Service) deleteKeyRange(ctx context.Context, begKey, endKey *DataKey, match func(*DataKey) bool) (int64, int64, error) {
+	var numKeys, numBytes int64
+	err := storage.ProcessKeyBatches(ctx, s.kvGetter, begKey, endKey, storage.RangeBatchSize,
+		func(keys []storage.Key) error {
+			n, b, err := s.deleteKeys(keys, func(key storage.Key) bool {
+				dataKey, ok := key.(*DataKey)
+				return ok && match(dataKey)
+			})
+			numKeys += n
+			numBytes += b
+			return err
+		})
+	return numKeys, numBytes, err
+}
+
+// deleteKeys deletes the given keys that match in one batch, returning the number of
+// keys and the bytes of keys deleted.
+func (s *Service) deleteKeys(keys []storage.Key, match func(storage.Key) bool) (int64, int64, error) {
+	var numKeys, numBytes int64
+	batcher, ok := s.kvSetter.(storage.Batcher)
+	if !ok {
+		return 0, 0, fmt.Errorf("DVID key-value store does not support batch write")
+	}
+	batch := batcher.NewBatch()
+	for _, key := range keys {
+		if match(key) {
+			batch.Delete(key)
+			numKeys++
+			numBytes += int64(len(key.Bytes()))
+		}
+	}
+	if numKeys == 0 {
+		return 0, 0, nil
+	}
+	if err := batch.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return numKeys, numBytes, nil
+}
+
+// DeleteExpiredData deletes all data that expired before now, without moving it to the
+// trash, and returns what was deleted.  Data in published datasets and data with keys at
+// locked nodes are kept.  Deletion continues past errors, and the first error is returned.
+func (s *Service) DeleteExpiredData(now time.Time) ([]*DeletedData, error) {
+	if s.Datasets == nil {
+		return nil, nil
+	}
+	type expired struct {
+		root dvid.UUID
+		name dvid.DataString
+	}
+	var expiredData []expired
+	s.Datasets.writeLock.Lock()
+	for _, dataset := range s.Datasets.list {
+		if dataset.published() != nil {
+			continue
+		}
+		dataset.mapLock.Lock()
+		for name, dataservice := range dataset.DataMap {
+			data, ok := dataservice.(expiringData)
+			if !ok {
+				continue
+			}
+			if expires := data.ExpiresAt(); !expires.IsZero() && expires.Before(now) {
+				expiredData = append(expiredData, expired{dataset.Root, name})
+			}
+		}
+		dataset.mapLock.Unlock()
+	}
+	s.Datasets.writeLock.Unlock()
+
+	var deleted []*DeletedData
+	var firstErr error
+	for _, e := range expiredData {
+		d, err := s.purgeData(e.root, e.name, false)
+		if d != nil {
+			deleted = append(deleted, d)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return deleted, firstErr
+}
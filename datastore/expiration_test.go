@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestExpiredDataAtLockedNodes(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.Set("TTL", "1h")
+	c.Assert(service.NewData(root, "migratetest", "committed", config), IsNil)
+	c.Assert(service.NewData(root, "migratetest", "open", config), IsNil)
+	committed, err := service.DataServiceByUUID(root, "committed")
+	c.Assert(err, IsNil)
+	dataset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	_, rootVersion, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	key := &DataKey{dataset.DatasetID, committed.(*migrateData).ID, rootVersion, dvid.IndexBytes{1}}
+	c.Assert(service.kvSetter.Put(key, []byte("committed")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+
+	// Data with keys at a locked node is kept past its expiration.
+	deleted, err := service.DeleteExpiredData(time.Now().Add(2 * time.Hour))
+	c.Assert(err, NotNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].Name, Equals, dvid.DataString("open"))
+	_, err = service.DataServiceByUUID(root, "committed")
+	c.Assert(err, IsNil)
+	value, err := service.kvGetter.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "committed")
+}
+
+func (s *DataSuite) TestDataTTL(c *C) {
+	config := dvid.NewConfig()
+	config.Set("TTL", "1h")
+	service, root, scratch, done := newTestData(c, "scratch", config)
+	defer done()
+	c.Assert(scratch.Expires.After(time.Now().Add(50*time.Minute)), Equals, true)
+	c.Assert(service.NewData(root, "migratetest", "kept", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "kept")
+	c.Assert(err, IsNil)
+	kept := dataservice.(*migrateData)
+	putTestKeys(c, service, root, scratch, 0, 8, []byte("scratch"))
+	putTestKeys(c, service, root, kept, 0, 8, []byte("kept"))
+
+	// Nothing expires until the TTL has passed.
+	deleted, err := service.DeleteExpiredData(time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 0)
+
+	deleted, err = service.DeleteExpiredData(time.Now().Add(2 * time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].Name, Equals, dvid.DataString("scratch"))
+	c.Assert(deleted[0].Keys, Equals, int64(8))
+	c.Assert(deleted[0].Bytes > 0, Equals, true)
+	_, err = service.DataServiceByUUID(root, "scratch")
+	c.Assert(err, NotNil)
+	c.Assert(countTestKeys(c, service, scratch), Equals, 0)
+	c.Assert(countTestKeys(c, service, kept), Equals, 8)
+
+	// A TTL of "none" removes the expiration.
+	config = dvid.NewConfig()
+	config.Set("TTL", "none")
+	c.Assert(kept.ModifyConfig(config), IsNil)
+	c.Assert(kept.Expires.IsZero(), Equals, true)
+}
@@ -0,0 +1,662 @@
+/*
+	This file checks the consistency of a datastore like fsck does for file systems.  It
+	validates the datasets list against the stored datasets, the version DAG of each
+	dataset, and the data types of its data, then scans all data keys for orphans, i.e.,
+	keys whose dataset, data, or version is unknown.  Problems can optionally be repaired,
+	with orphaned keys and unreadable metadata first copied to a quarantine file.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// FsckKind classifies problems found by Fsck.
+type FsckKind string
+
+const (
+	FsckMetadata     FsckKind = "metadata"
+	FsckDAG          FsckKind = "dag"
+	FsckDatatype     FsckKind = "datatype"
+	FsckOrphanedKeys FsckKind = "orphaned keys"
+)
+
+// FsckProblem is an inconsistency found in a datastore.
+type FsckProblem struct {
+	Kind        FsckKind
+	Dataset     dvid.UUID       `json:",omitempty"`
+	Data        dvid.DataString `json:",omitempty"`
+	Description string
+
+	// Keys is the number of keys affected by orphaned key problems.
+	Keys int64 `json:",omitempty"`
+
+	// Repaired is true if the problem was repaired.
+	Repaired bool
+
+	repair func() error // nil if the problem can't be repaired
+}
+
+func (p *FsckProblem) String() string {
+	text := fmt.Sprintf("[%s]", p.Kind)
+	if p.Dataset != "" {
+		text += fmt.Sprintf(" dataset %s:", p.Dataset)
+	}
+	text += " " + p.Description
+	switch {
+	case p.Repaired:
+		text += " (repaired)"
+	case p.repair == nil:
+		text += " (not repairable)"
+	}
+	return text
+}
+
+// FsckOptions configures a consistency check.
+type FsckOptions struct {
+	// Quick skips the scan of data keys for orphans.
+	Quick bool
+
+	// Repair fixes repairable problems, deleting orphaned keys and unreadable metadata.
+	Repair bool
+
+	// QuarantineDir, if not empty, receives a file of the keys and values removed by
+	// repairs so they can be examined or restored.
+	QuarantineDir string
+}
+
+// FsckReport is the result of a consistency check.
+type FsckReport struct {
+	Datasets int
+	DataKeys int64
+	Problems []*FsckProblem
+
+	// Quarantine is the file holding removed keys and values, if any.
+	Quarantine string `json:",omitempty"`
+}
+
+// Unrepaired returns the number of problems that weren't repaired.
+func (report *FsckReport) Unrepaired() int {
+	var n int
+	for _, p := range report.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (report *FsckReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Checked %d datasets", report.Datasets)
+	if report.DataKeys > 0 {
+		fmt.Fprintf(&buf, " and %d data keys", report.DataKeys)
+	}
+	fmt.Fprintf(&buf, ": %d problems, %d unrepaired\n", len(report.Problems), report.Unrepaired())
+	for _, p := range report.Problems {
+		fmt.Fprintf(&buf, "%s\n", p)
+	}
+	if report.Quarantine != "" {
+		fmt.Fprintf(&buf, "Removed keys and values were saved to %s\n", report.Quarantine)
+	}
+	return buf.String()
+}
+
+// QuarantinedKeyValue is a key and value removed by a repair, written as a stream of
+// gob-encoded values to the quarantine file.
+type QuarantinedKeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// fsck holds the state of a consistency check of a datastore.
+type fsck struct {
+	db      storage.OrderedKeyValueDB
+	options FsckOptions
+	report  *FsckReport
+
+	datasets   []*Dataset
+	byID       map[dvid.DatasetLocalID]*Dataset
+	dirty      map[*Dataset]bool
+	listDirty  bool
+	listedNext dvid.DatasetLocalID
+	keyFormat  KeyFormat
+
+	quarantine     *os.File
+	quarantineEnc  *gob.Encoder
+	quarantineName string
+}
+
+// Fsck checks the consistency of the datastore at a path, which must not be in use by a
+// server, and repairs problems if requested.
+func Fsck(path string, options FsckOptions) (*FsckReport, error) {
+	engine, err := storage.NewStore(path, false, dvid.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening datastore (%s): %s", path, err.Error())
+	}
+	defer engine.Close()
+	db, ok := engine.(storage.OrderedKeyValueDB)
+	if !ok {
+		return nil, fmt.Errorf("Datastore at %s does not support key-value database ops", path)
+	}
+	// Orphaned data keys are deleted with their version index keys.
+	indexed, err := newIndexingDB(db, nil)
+	if err != nil {
+		return nil, err
+	}
+	check := &fsck{
+		db:        indexed,
+		options:   options,
+		report:    new(FsckReport),
+		byID:      make(map[dvid.DatasetLocalID]*Dataset),
+		dirty:     make(map[*Dataset]bool),
+		keyFormat: CurrentKeyFormat,
+	}
+	defer check.closeQuarantine()
+	if err := check.checkMetadata(); err != nil {
+		return nil, err
+	}
+	for _, dataset := range check.datasets {
+		check.add(checkDataset(dataset, func() { check.dirty[dataset] = true })...)
+	}
+	if !options.Quick {
+		if err := check.checkKeys(); err != nil {
+			return nil, err
+		}
+	}
+	if options.Repair {
+		if err := check.repair(); err != nil {
+			return check.report, err
+		}
+	}
+	return check.report, nil
+}
+
+// QuickCheck checks the version DAG and data of every dataset in an open datastore
+// without reading data keys or repairing anything.
+func (s *Service) QuickCheck() []*FsckProblem {
+	if s.Datasets == nil {
+		return nil
+	}
+	var problems []*FsckProblem
+	for _, dataset := range s.Datasets.list {
+		dataset.mapLock.Lock()
+		problems = append(problems, checkDataset(dataset, func() {})...)
+		dataset.mapLock.Unlock()
+	}
+	return problems
+}
+
+func (check *fsck) add(problems ...*FsckProblem) {
+	check.report.Problems = append(check.report.Problems, problems...)
+}
+
+// checkMetadata loads the datasets list and the stored datasets, checking that they agree.
+func (check *fsck) checkMetadata() error {
+	var listed []dvid.UUID
+	listedOK := false
+	value, err := check.db.Get(&DatasetsKey{})
+	if err == nil && value != nil {
+		var dsets Datasets
+		var deserialization *serializableDatasets
+		if deserialization, err = dsets.deserialize(value); err == nil {
+			listed = deserialization.DatasetsUUID
+			check.listedNext = deserialization.NewDatasetID
+			check.keyFormat = deserialization.KeyFormat
+			listedOK = true
+		}
+	}
+	if check.keyFormat != CurrentKeyFormat {
+		return fmt.Errorf("Data keys use an older layout.  Run \"dvid migrate-keys\" before checking them.")
+	}
+	if !listedOK {
+		description := "Datasets list is missing"
+		if err != nil {
+			description = fmt.Sprintf("Datasets list is unreadable: %s", err.Error())
+		}
+		check.add(&FsckProblem{
+			Kind:        FsckMetadata,
+			Description: description,
+			repair:      func() error { check.listDirty = true; return nil },
+		})
+	}
+
+	keyvalues, err := check.db.GetRange(MinDatasetKey(), MaxDatasetKey())
+	if err != nil {
+		return fmt.Errorf("Unable to read stored datasets: %s", err.Error())
+	}
+	for _, kv := range keyvalues {
+		kv := kv
+		key, _ := kv.K.(*DatasetKey)
+		dataset := new(Dataset)
+		if err := dvid.Deserialize(kv.V, dataset); err != nil || dataset.VersionDAG == nil {
+			if err == nil {
+				err = fmt.Errorf("no version DAG")
+			}
+			check.add(&FsckProblem{
+				Kind:        FsckMetadata,
+				Description: fmt.Sprintf("Dataset at key %s is unreadable: %s", kv.K, err.Error()),
+				repair: func() error {
+					if err := check.quarantineKeyValue(kv.K.Bytes(), kv.V); err != nil {
+						return err
+					}
+					return check.db.Delete(kv.K)
+				},
+			})
+			continue
+		}
+		if other, found := check.byID[dataset.DatasetID]; found {
+			check.add(&FsckProblem{
+				Kind:    FsckMetadata,
+				Dataset: dataset.Root,
+				Description: fmt.Sprintf("Dataset has the same local ID %d as dataset %s",
+					dataset.DatasetID, other.Root),
+			})
+			continue
+		}
+		if key != nil && key.Dataset != dataset.DatasetID {
+			check.add(&FsckProblem{
+				Kind:    FsckMetadata,
+				Dataset: dataset.Root,
+				Description: fmt.Sprintf("Dataset with local ID %d is stored under local ID %d",
+					dataset.DatasetID, key.Dataset),
+				repair: func() error {
+					check.dirty[dataset] = true
+					return check.db.Delete(kv.K)
+				},
+			})
+		}
+		check.datasets = append(check.datasets, dataset)
+		check.byID[dataset.DatasetID] = dataset
+	}
+	sort.Slice(check.datasets, func(i, j int) bool {
+		return check.datasets[i].DatasetID < check.datasets[j].DatasetID
+	})
+	check.report.Datasets = len(check.datasets)
+	if !listedOK {
+		return nil
+	}
+
+	// Compare the datasets list with the stored datasets.
+	relist := func() error { check.listDirty = true; return nil }
+	stored := make(map[dvid.UUID]bool, len(check.datasets))
+	for _, dataset := range check.datasets {
+		stored[dataset.Root] = true
+	}
+	inList := make(map[dvid.UUID]bool, len(listed))
+	for _, root := range listed {
+		inList[root] = true
+		if !stored[root] {
+			check.add(&FsckProblem{
+				Kind:        FsckMetadata,
+				Dataset:     root,
+				Description: "Datasets list has a dataset that isn't stored",
+				repair:      relist,
+			})
+		}
+	}
+	for _, dataset := range check.datasets {
+		if !inList[dataset.Root] {
+			check.add(&FsckProblem{
+				Kind:        FsckMetadata,
+				Dataset:     dataset.Root,
+				Description: "Stored dataset is missing from the datasets list",
+				repair:      relist,
+			})
+		}
+		if dataset.DatasetID >= check.listedNext {
+			check.add(&FsckProblem{
+				Kind:    FsckMetadata,
+				Dataset: dataset.Root,
+				Description: fmt.Sprintf("Dataset local ID %d isn't below the next dataset ID %d",
+					dataset.DatasetID, check.listedNext),
+				repair: relist,
+			})
+		}
+	}
+	return nil
+}
+
+// checkDataset checks the version DAG and data of a dataset.  Repairs modify the dataset
+// and call modified.
+func checkDataset(dataset *Dataset, modified func()) []*FsckProblem {
+	var problems []*FsckProblem
+	add := func(kind FsckKind, data dvid.DataString, repair func(), format string, args ...interface{}) {
+		p := &FsckProblem{
+			Kind:        kind,
+			Dataset:     dataset.Root,
+			Data:        data,
+			Description: fmt.Sprintf(format, args...),
+		}
+		if repair != nil {
+			p.repair = func() error { repair(); modified(); return nil }
+		}
+		problems = append(problems, p)
+	}
+
+	if _, found := dataset.Nodes[dataset.Root]; !found {
+		add(FsckDAG, "", nil, "Root node %s is missing from the version DAG", dataset.Root)
+	}
+	nodes := make([]dvid.UUID, 0, len(dataset.Nodes))
+	for u := range dataset.Nodes {
+		nodes = append(nodes, u)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	versionNodes := make(map[dvid.VersionLocalID]dvid.UUID, len(nodes))
+	var maxVersion dvid.VersionLocalID
+	for _, u := range nodes {
+		u, node := u, dataset.Nodes[u]
+		if node == nil || node.NodeVersion == nil {
+			add(FsckDAG, "", func() { delete(dataset.Nodes, u) }, "Node %s has no version", u)
+			continue
+		}
+		if node.GlobalID != u {
+			add(FsckDAG, "", func() { node.GlobalID = u }, "Node %s is stored as %s", node.GlobalID, u)
+		}
+		for _, parent := range node.Parents {
+			parent := parent
+			parentNode, found := dataset.Nodes[parent]
+			switch {
+			case !found:
+				add(FsckDAG, "", func() { node.Parents = removeUUID(node.Parents, parent) },
+					"Node %s has a dangling reference to parent %s", u, parent)
+			case parentNode != nil && parentNode.NodeVersion != nil && !node.Scratch &&
+				!hasUUID(parentNode.Children, u):
+				add(FsckDAG, "", func() { parentNode.Children = append(parentNode.Children, u) },
+					"Node %s is missing from the children of its parent %s", u, parent)
+			}
+		}
+		for _, child := range node.Children {
+			child := child
+			childNode, found := dataset.Nodes[child]
+			switch {
+			case !found:
+				add(FsckDAG, "", func() { node.Children = removeUUID(node.Children, child) },
+					"Node %s has a dangling reference to child %s", u, child)
+			case childNode != nil && childNode.NodeVersion != nil && !hasUUID(childNode.Parents, u):
+				add(FsckDAG, "", func() { childNode.Parents = append(childNode.Parents, u) },
+					"Node %s is missing from the parents of its child %s", u, child)
+			}
+		}
+		if version, found := dataset.VersionMap[u]; !found || version != node.VersionID {
+			add(FsckDAG, "", func() {
+				if dataset.VersionMap == nil {
+					dataset.VersionMap = make(map[dvid.UUID]dvid.VersionLocalID)
+				}
+				dataset.VersionMap[u] = node.VersionID
+			},
+				"Version map doesn't give node %s its version %d", u, node.VersionID)
+		}
+		if other, found := versionNodes[node.VersionID]; found {
+			add(FsckDAG, "", nil, "Nodes %s and %s have the same version %d", other, u, node.VersionID)
+		}
+		versionNodes[node.VersionID] = u
+		if node.VersionID > maxVersion {
+			maxVersion = node.VersionID
+		}
+	}
+	for u := range dataset.VersionMap {
+		if _, found := dataset.Nodes[u]; !found {
+			u := u
+			add(FsckDAG, "", func() { delete(dataset.VersionMap, u) },
+				"Version map has node %s that isn't in the version DAG", u)
+		}
+	}
+	if len(versionNodes) > 0 && dataset.NewVersionID <= maxVersion {
+		add(FsckDAG, "", func() { dataset.NewVersionID = maxVersion + 1 },
+			"Next version ID %d isn't above the largest version %d", dataset.NewVersionID, maxVersion)
+	}
+
+	// Check the data, including trashed data whose keys are kept.
+	dataNames := make(map[dvid.DataLocalID]dvid.DataString)
+	var maxDataID dvid.DataLocalID
+	checkData := func(name dvid.DataString, data DataService) {
+		local, ok := data.(expiringData)
+		if !ok {
+			add(FsckDatatype, name, nil, "Data has no local IDs")
+			return
+		}
+		if local.DatasetID() != dataset.DatasetID {
+			add(FsckMetadata, name, nil, "Data belongs to dataset ID %d but is in dataset ID %d",
+				local.DatasetID(), dataset.DatasetID)
+		}
+		if other, found := dataNames[local.LocalID()]; found {
+			add(FsckMetadata, name, nil, "Data has the same local ID %d as data '%s'", local.LocalID(), other)
+		}
+		dataNames[local.LocalID()] = name
+		if local.LocalID() > maxDataID {
+			maxDataID = local.LocalID()
+		}
+		compiled, found := CompiledTypes[data.DatatypeUrl()]
+		if !found {
+			add(FsckDatatype, name, nil, "DVID not compiled with data type %s [%s]",
+				data.DatatypeName(), data.DatatypeUrl())
+			return
+		}
+		if stored := data.DatatypeVersion(); stored != compiled.DatatypeVersion() {
+			if _, err := migrationPath(compiled, stored); err != nil {
+				add(FsckDatatype, name, nil, "Data has %s version %s but DVID has version %s: %s",
+					data.DatatypeName(), stored, compiled.DatatypeVersion(), err.Error())
+			}
+		}
+	}
+	names := make([]dvid.DataString, 0, len(dataset.DataMap))
+	for name := range dataset.DataMap {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		checkData(name, dataset.DataMap[name])
+	}
+	for name, trashed := range dataset.Trash {
+		if trashed != nil && trashed.Data != nil {
+			checkData(name, trashed.Data)
+		}
+	}
+	if len(dataNames) > 0 && dataset.NewDataID <= maxDataID {
+		add(FsckMetadata, "", func() { dataset.NewDataID = maxDataID + 1 },
+			"Next data ID %d isn't above the largest data ID %d", dataset.NewDataID, maxDataID)
+	}
+	return problems
+}
+
+func hasUUID(uuids []dvid.UUID, u dvid.UUID) bool {
+	for _, v := range uuids {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+func removeUUID(uuids []dvid.UUID, u dvid.UUID) []dvid.UUID {
+	kept := uuids[:0]
+	for _, v := range uuids {
+		if v != u {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// checkKeys scans all data keys for ones whose dataset, data, or version is unknown.
+func (check *fsck) checkKeys() error {
+	type datasetIDs struct {
+		data     map[dvid.DataLocalID]bool
+		versions map[dvid.VersionLocalID]bool
+	}
+	known := make(map[dvid.DatasetLocalID]datasetIDs, len(check.datasets))
+	for _, dataset := range check.datasets {
+		ids := datasetIDs{make(map[dvid.DataLocalID]bool), make(map[dvid.VersionLocalID]bool)}
+		for _, data := range dataset.DataMap {
+			if local, ok := data.(expiringData); ok {
+				ids.data[local.LocalID()] = true
+			}
+		}
+		for _, trashed := range dataset.Trash {
+			if local, ok := trashed.Data.(expiringData); ok {
+				ids.data[local.LocalID()] = true
+			}
+		}
+		for _, node := range dataset.Nodes {
+			if node != nil && node.NodeVersion != nil {
+				ids.versions[node.VersionID] = true
+			}
+		}
+		known[dataset.DatasetID] = ids
+	}
+
+	// Orphans being repaired are quarantined and deleted in bounded batches as the keys
+	// are scanned.
+	orphans := make(map[string]*FsckProblem)
+	var order []string
+	var pending []storage.Key
+	begKey := &DataKey{0, 0, 0, dvid.IndexBytes{}}
+	endKey := &DataKey{maxDatasetLocalID, maxDataLocalID, dvid.MaxLocalID, dvid.IndexBytes(bytes.Repeat([]byte{0xff}, 64))}
+	err := storage.ProcessRangeBatches(context.Background(), check.db, begKey, endKey, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			key, ok := kv.K.(*DataKey)
+			if !ok {
+				return nil
+			}
+			check.report.DataKeys++
+			var dataset dvid.UUID
+			var description string
+			ids, found := known[key.Dataset]
+			switch {
+			case !found:
+				description = fmt.Sprintf("Keys of unknown dataset ID %d", key.Dataset)
+			case !ids.data[key.Data]:
+				dataset = check.byID[key.Dataset].Root
+				description = fmt.Sprintf("Keys of unknown data ID %d", key.Data)
+			case !ids.versions[key.Version]:
+				dataset = check.byID[key.Dataset].Root
+				description = fmt.Sprintf("Keys of data ID %d at unknown version %d", key.Data, key.Version)
+			default:
+				return nil
+			}
+			p, found := orphans[description+string(dataset)]
+			if !found {
+				p = &FsckProblem{Kind: FsckOrphanedKeys, Dataset: dataset}
+				orphans[description+string(dataset)] = p
+				order = append(order, description+string(dataset))
+				p.Description = description
+				p.repair = func() error { return nil }
+			}
+			p.Keys++
+			if !check.options.Repair {
+				return nil
+			}
+			if err := check.quarantineKeyValue(key.Bytes(), kv.V); err != nil {
+				return fmt.Errorf("Unable to quarantine orphaned keys: %s", err.Error())
+			}
+			pending = append(pending, key)
+			if len(pending) < storage.RangeBatchSize {
+				return nil
+			}
+			err := check.deleteKeys(pending)
+			pending = pending[:0]
+			return err
+		})
+	if err == nil && len(pending) != 0 {
+		err = check.deleteKeys(pending)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to scan data keys: %s", err.Error())
+	}
+	for _, id := range order {
+		p := orphans[id]
+		p.Description = fmt.Sprintf("%s (%d keys)", p.Description, p.Keys)
+		check.add(p)
+	}
+	return nil
+}
+
+// deleteKeys deletes orphaned data keys in one batch.
+func (check *fsck) deleteKeys(keys []storage.Key) error {
+	batcher, ok := check.db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("DVID key-value store does not support batch write")
+	}
+	batch := batcher.NewBatch()
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("Unable to delete orphaned keys: %s", err.Error())
+	}
+	return nil
+}
+
+// quarantineKeyValue appends a key and value to the quarantine file, if any.
+func (check *fsck) quarantineKeyValue(key, value []byte) error {
+	if check.options.QuarantineDir == "" {
+		return nil
+	}
+	if check.quarantine == nil {
+		if err := os.MkdirAll(check.options.QuarantineDir, 0755); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("dvid-fsck-%s.gob", time.Now().Format("20060102-150405"))
+		check.quarantineName = filepath.Join(check.options.QuarantineDir, name)
+		file, err := os.Create(check.quarantineName)
+		if err != nil {
+			return err
+		}
+		check.quarantine = file
+		check.quarantineEnc = gob.NewEncoder(file)
+		check.report.Quarantine = check.quarantineName
+	}
+	return check.quarantineEnc.Encode(QuarantinedKeyValue{key, value})
+}
+
+func (check *fsck) closeQuarantine() {
+	if check.quarantine != nil {
+		check.quarantine.Close()
+	}
+}
+
+// repair runs the repair of each repairable problem then stores modified metadata.
+func (check *fsck) repair() error {
+	for _, p := range check.report.Problems {
+		if p.repair == nil {
+			continue
+		}
+		if err := p.repair(); err != nil {
+			return fmt.Errorf("Unable to repair %q: %s", p.Description, err.Error())
+		}
+		p.Repaired = true
+	}
+	for _, dataset := range check.datasets {
+		if check.dirty[dataset] {
+			if err := dataset.Put(check.db); err != nil {
+				return err
+			}
+		}
+	}
+	if !check.listDirty {
+		return nil
+	}
+	dsets := &Datasets{list: check.datasets, keyFormat: check.keyFormat}
+	for _, dataset := range check.datasets {
+		if dataset.DatasetID >= dsets.newDatasetID {
+			dsets.newDatasetID = dataset.DatasetID + 1
+		}
+	}
+	if check.listedNext > dsets.newDatasetID {
+		dsets.newDatasetID = check.listedNext
+	}
+	return dsets.Put(check.db)
+}
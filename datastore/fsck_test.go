@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"encoding/gob"
+	"os"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestFsck(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "kept", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "kept")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+
+	// Store a good key and keys of an unknown dataset, data, and version.
+	db, err := service.OrderedKeyValueSetter()
+	c.Assert(err, IsNil)
+	index := dvid.IndexBytes{1, 2, 3}
+	c.Assert(db.Put(&DataKey{data.DsetID, data.ID, 0, index}, []byte("good")), IsNil)
+	c.Assert(db.Put(&DataKey{data.DsetID + 7, data.ID, 0, index}, []byte("dataset")), IsNil)
+	c.Assert(db.Put(&DataKey{data.DsetID, data.ID + 9, 0, index}, []byte("data")), IsNil)
+	c.Assert(db.Put(&DataKey{data.DsetID, data.ID, 42, index}, []byte("version")), IsNil)
+
+	// Add a dangling child to the root node.
+	dataset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	dataset.Nodes[root].Children = append(dataset.Nodes[root].Children, dvid.NewUUID())
+	c.Assert(service.SaveDataset(root), IsNil)
+	c.Assert(service.QuickCheck(), HasLen, 1)
+	service.Shutdown()
+
+	// A quick check finds only the DAG problem.
+	report, err := Fsck(dir, FsckOptions{Quick: true})
+	c.Assert(err, IsNil)
+	c.Assert(report.Datasets, Equals, 1)
+	c.Assert(report.Problems, HasLen, 1)
+	c.Assert(report.Problems[0].Kind, Equals, FsckDAG)
+	c.Assert(report.Problems[0].Description, Matches, ".*dangling reference to child.*")
+
+	// A full check also finds the orphaned keys.
+	report, err = Fsck(dir, FsckOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(report.DataKeys, Equals, int64(4))
+	c.Assert(report.Problems, HasLen, 4)
+	c.Assert(report.Unrepaired(), Equals, 4)
+	var orphans int64
+	for _, p := range report.Problems[1:] {
+		c.Assert(p.Kind, Equals, FsckOrphanedKeys)
+		orphans += p.Keys
+	}
+	c.Assert(orphans, Equals, int64(3))
+
+	// Repair quarantines and deletes the orphaned keys.
+	quarantine := c.MkDir()
+	report, err = Fsck(dir, FsckOptions{Repair: true, QuarantineDir: quarantine})
+	c.Assert(err, IsNil)
+	c.Assert(report.Unrepaired(), Equals, 0)
+	f, err := os.Open(report.Quarantine)
+	c.Assert(err, IsNil)
+	decoder := gob.NewDecoder(f)
+	var values []string
+	for {
+		var kv QuarantinedKeyValue
+		if decoder.Decode(&kv) != nil {
+			break
+		}
+		values = append(values, string(kv.Value))
+	}
+	f.Close()
+	c.Assert(values, HasLen, 3)
+
+	report, err = Fsck(dir, FsckOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Problems, HasLen, 0)
+	c.Assert(report.DataKeys, Equals, int64(1))
+
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	c.Assert(service.QuickCheck(), HasLen, 0)
+	value, err := service.kvGetter.Get(&DataKey{data.DsetID, data.ID, 0, index})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "good")
+}
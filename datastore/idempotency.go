@@ -0,0 +1,74 @@
+/*
+	This file stores the results of requests with client-generated idempotency keys, so
+	retries get the original result even after the server restarts.
+*/
+
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// IdempotencyKey is an implementation of storage.Key for the result of a request with
+// an idempotency key.
+type IdempotencyKey struct {
+	Key string
+}
+
+func (k *IdempotencyKey) KeyType() storage.KeyType {
+	return storage.KeyIdempotency
+}
+
+func (k *IdempotencyKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed IdempotencyKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyIdempotency) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into IdempotencyKey", storage.KeyType(b[0]))
+	}
+	return &IdempotencyKey{Key: string(b[1:])}, nil
+}
+
+func (k *IdempotencyKey) Bytes() []byte {
+	return append([]byte{byte(storage.KeyIdempotency)}, k.Key...)
+}
+
+func (k *IdempotencyKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *IdempotencyKey) String() string {
+	return fmt.Sprintf("Idempotency key %q", k.Key)
+}
+
+// PutIdempotentResult stores the encoded result of a request with an idempotency key.
+func (s *Service) PutIdempotentResult(key string, value []byte) error {
+	return s.kvSetter.Put(&IdempotencyKey{key}, value)
+}
+
+// GetIdempotentResult returns the encoded result of a request with an idempotency key
+// or nil if there's none.
+func (s *Service) GetIdempotentResult(key string) ([]byte, error) {
+	return s.kvGetter.Get(&IdempotencyKey{key})
+}
+
+// DeleteIdempotentResult removes the stored result of a request with an idempotency key.
+func (s *Service) DeleteIdempotentResult(key string) error {
+	return s.kvSetter.Delete(&IdempotencyKey{key})
+}
+
+// ProcessIdempotentResults calls f with each stored result of a request with an
+// idempotency key.
+func (s *Service) ProcessIdempotentResults(f func(key string, value []byte)) error {
+	begKey := &IdempotencyKey{}
+	endKey := &IdempotencyKey{Key: "\xff"}
+	return s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		key, ok := chunk.K.(*IdempotencyKey)
+		if !ok {
+			return
+		}
+		f(key.Key, chunk.V)
+	})
+}
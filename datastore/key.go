@@ -97,6 +97,11 @@ func MaxDatasetKey() storage.Key {
 	the backend drivers need the additional DVID information.  For example,
 	Couchbase allows configuration at the bucket level (RAM cache, CPUs)
 	and datasets could be placed in different buckets.
+
+	The version follows the index in the key's bytes, so all versions of an index
+	are adjacent and one scan of a range of indices finds what's visible at any
+	version, falling back to ancestors without a lookup per version.  Stores written
+	before this layout are converted by MigrateKeys.
 */
 type DataKey struct {
 	// The DVID server-specific 32-bit ID for a dataset.
@@ -116,7 +121,12 @@ type DataKey struct {
 }
 
 // The offset to the Index in bytes of a DataKey bytes representation
-const DataKeyIndexOffset = dvid.LocalIDSize*2 + dvid.LocalID32Size + 1
+const DataKeyIndexOffset = dvid.LocalIDSize + dvid.LocalID32Size + 1
+
+// DataKeyIndexBytes returns the bytes of the Index within the bytes of a DataKey.
+func DataKeyIndexBytes(b []byte) []byte {
+	return b[DataKeyIndexOffset : len(b)-dvid.LocalIDSize]
+}
 
 // DataKey returns a DataKey for this data given a local version and a data-specific Index.
 func (d *Data) DataKey(versionID dvid.VersionLocalID, index dvid.Index) *DataKey {
@@ -156,13 +166,13 @@ func (key *DataKey) BytesToKey(b []byte) (storage.Key, error) {
 	start += length
 	data, length := dvid.LocalIDFromBytes(b[start:])
 	start += length
-	version, _ := dvid.LocalIDFromBytes(b[start:])
-	start += length
+	end := len(b) - dvid.LocalIDSize
+	version, _ := dvid.LocalIDFromBytes(b[end:])
 
 	var index dvid.Index
 	var err error
-	if start < len(b) {
-		index, err = key.Index.IndexFromBytes(b[start:])
+	if start < end {
+		index, err = key.Index.IndexFromBytes(b[start:end])
 	}
 	return &DataKey{dvid.DatasetLocalID(dataset), dvid.DataLocalID(data), dvid.VersionLocalID(version), index}, err
 }
@@ -172,13 +182,25 @@ func (key *DataKey) Bytes() (b []byte) {
 	b = []byte{byte(storage.KeyData)}
 	b = append(b, dvid.LocalID32(key.Dataset).Bytes()...)
 	b = append(b, dvid.LocalID(key.Data).Bytes()...)
-	b = append(b, dvid.LocalID(key.Version).Bytes()...)
 	if key.Index != nil {
 		b = append(b, key.Index.Bytes()...)
 	}
+	b = append(b, dvid.LocalID(key.Version).Bytes()...)
 	return
 }
 
+// InRange returns true if a key found in a range query from this key to kEnd belongs
+// to the range.  Since versions of an index are adjacent, a range of indices at one
+// version of data also spans other versions, which don't belong to the range.
+func (key *DataKey) InRange(kEnd, k storage.Key) bool {
+	end, ok := kEnd.(*DataKey)
+	if !ok || end.Dataset != key.Dataset || end.Data != key.Data || end.Version != key.Version {
+		return true
+	}
+	found, ok := k.(*DataKey)
+	return !ok || found.Version == key.Version
+}
+
 // Bytes returns a string derived from the concatenation of the key elements.
 func (key *DataKey) BytesString() string {
 	return string(key.Bytes())
@@ -0,0 +1,339 @@
+/*
+	This file handles the layout of data keys, which puts each key's version after its
+	index so a single range scan finds the key/value visible at any version, and the
+	migration of datastores written with the older layout, which put the version first.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// KeyFormat identifies the layout of data keys in a datastore.
+type KeyFormat int
+
+const (
+	// VersionFirstKeys is the layout of datastores created before index-first keys,
+	// where a key's version precedes its index.
+	VersionFirstKeys KeyFormat = iota
+
+	// IndexFirstKeys is the layout where a key's version follows its index.
+	IndexFirstKeys
+
+	// CurrentKeyFormat is the layout of data keys written by this DVID.
+	CurrentKeyFormat = IndexFirstKeys
+
+	// migratingKeys marks a datastore whose keys have all been converted but not yet
+	// moved back from the temporary key space.
+	migratingKeys KeyFormat = -1
+)
+
+// keyMigrationBatch is the number of keys moved in each batch during migration.
+const keyMigrationBatch = 1000
+
+// dataKeyPrefixSize is the number of bytes of the key type, dataset, and data IDs.
+const dataKeyPrefixSize = 1 + dvid.LocalID32Size + dvid.LocalIDSize
+
+// KeyMigration reports the data keys converted to the current layout.
+type KeyMigration struct {
+	Keys  int64
+	Bytes int64
+}
+
+// rawKey is a storage.Key of unparsed bytes, used to move keys in any layout.
+type rawKey []byte
+
+func (k rawKey) KeyType() storage.KeyType {
+	if len(k) == 0 {
+		return storage.KeyData
+	}
+	return storage.KeyType(k[0])
+}
+
+func (k rawKey) BytesToKey(b []byte) (storage.Key, error) {
+	return rawKey(append([]byte(nil), b...)), nil
+}
+
+func (k rawKey) Bytes() []byte {
+	return []byte(k)
+}
+
+func (k rawKey) BytesString() string {
+	return string(k)
+}
+
+func (k rawKey) String() string {
+	return fmt.Sprintf("%x", []byte(k))
+}
+
+// indexFirst returns the bytes of a version-first data key in the index-first layout
+// under the given key type.
+func indexFirst(b []byte, t storage.KeyType) ([]byte, error) {
+	if len(b) < dataKeyPrefixSize+dvid.LocalIDSize {
+		return nil, fmt.Errorf("Malformed data key (too few bytes): %x", b)
+	}
+	version := b[dataKeyPrefixSize : dataKeyPrefixSize+dvid.LocalIDSize]
+	converted := make([]byte, 0, len(b))
+	converted = append(converted, byte(t))
+	converted = append(converted, b[1:dataKeyPrefixSize]...)
+	converted = append(converted, b[dataKeyPrefixSize+dvid.LocalIDSize:]...)
+	return append(converted, version...), nil
+}
+
+// MigrateKeys converts the data keys of the datastore at a path, which must not be in
+// use by a server, to the current layout.  Keys are converted into a temporary key
+// space then moved back, so an interrupted migration can simply be run again.
+func MigrateKeys(path string) (*KeyMigration, error) {
+	engine, err := storage.NewStore(path, false, dvid.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening datastore (%s): %s", path, err.Error())
+	}
+	defer engine.Close()
+	db, ok := engine.(storage.OrderedKeyValueDB)
+	if !ok {
+		return nil, fmt.Errorf("Datastore at %s does not support key-value database ops", path)
+	}
+	datasets := new(Datasets)
+	if err := datasets.Load(db); err != nil {
+		return nil, fmt.Errorf("Error reading datasets: %s", err.Error())
+	}
+	if datasets.keyFormat == CurrentKeyFormat {
+		return nil, fmt.Errorf("Data keys of datastore at %s already use the current layout", path)
+	}
+
+	migration := new(KeyMigration)
+	if datasets.keyFormat == VersionFirstKeys {
+		// Convert each data instance in turn, then any keys of unknown instances.
+		var prefixes [][]byte
+		for _, dataset := range datasets.list {
+			for _, id := range dataset.dataLocalIDs() {
+				prefix := (&DataKey{Dataset: dataset.DatasetID, Data: id}).Bytes()
+				prefixes = append(prefixes, prefix[:dataKeyPrefixSize])
+			}
+		}
+		prefixes = append(prefixes, []byte{byte(storage.KeyData)})
+		for _, prefix := range prefixes {
+			err := moveKeys(db, prefix, migration, func(b []byte) ([]byte, error) {
+				return indexFirst(b, storage.KeyMigration)
+			})
+			if err != nil {
+				return migration, err
+			}
+		}
+		datasets.keyFormat = migratingKeys
+		if err := datasets.Put(db); err != nil {
+			return migration, err
+		}
+	}
+
+	// Move the converted keys back into the data key space.
+	err = moveKeys(db, []byte{byte(storage.KeyMigration)}, nil, func(b []byte) ([]byte, error) {
+		moved := append([]byte(nil), b...)
+		moved[0] = byte(storage.KeyData)
+		return moved, nil
+	})
+	if err != nil {
+		return migration, err
+	}
+	datasets.keyFormat = CurrentKeyFormat
+	return migration, datasets.Put(db)
+}
+
+// moveKeys rewrites every key starting with the prefix as the converted key, counting
+// the keys and bytes moved if migration is not nil.  Keys are read and moved a batch at a
+// time, and converted keys never start with the prefix, so the scan never sees keys it
+// wrote.
+func moveKeys(db storage.OrderedKeyValueDB, prefix []byte, migration *KeyMigration,
+	convert func([]byte) ([]byte, error)) error {
+
+	end := append(append([]byte(nil), prefix...), bytes.Repeat([]byte{0xff}, 64)...)
+	batcher, canBatch := db.(storage.Batcher)
+	var batch storage.Batch
+	var batched int
+	err := storage.ProcessRangeBatches(context.Background(), db, rawKey(prefix), rawKey(end), keyMigrationBatch,
+		func(kv *storage.KeyValue) error {
+			b := kv.K.Bytes()
+			if !bytes.HasPrefix(b, prefix) {
+				return nil
+			}
+			converted, err := convert(b)
+			if err != nil {
+				return err
+			}
+			if migration != nil {
+				migration.Keys++
+				migration.Bytes += int64(len(b) + len(kv.V))
+			}
+			if !canBatch {
+				if err := db.Put(rawKey(converted), kv.V); err != nil {
+					return err
+				}
+				return db.Delete(kv.K)
+			}
+			if batch == nil {
+				batch = batcher.NewBatch()
+			}
+			batch.Put(rawKey(converted), kv.V)
+			batch.Delete(kv.K)
+			batched++
+			if batched == keyMigrationBatch {
+				err := batch.Commit()
+				batch, batched = nil, 0
+				return err
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		return batch.Commit()
+	}
+	return nil
+}
+
+// dataLocalIDs returns the local IDs of the dataset's data, including trashed data.
+func (dset *Dataset) dataLocalIDs() []dvid.DataLocalID {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+	var ids []dvid.DataLocalID
+	for _, dataservice := range dset.DataMap {
+		if data, ok := dataservice.(expiringData); ok {
+			ids = append(ids, data.LocalID())
+		}
+	}
+	for _, t := range dset.Trash {
+		if data, ok := t.Data.(expiringData); ok {
+			ids = append(ids, data.LocalID())
+		}
+	}
+	return ids
+}
+
+// ProcessVisible calls f for each index between begIndex and endIndex, in order, with
+// the key/value visible at version u of data: the value written at u or else at its
+// nearest ancestor.  All versions of the indices are read in one range scan rather
+// than looking up each index at each ancestor, which relies on indices having a fixed
+// length, like block coordinates, so the versions of each index are adjacent.  The scan
+// stops once ctx is done.
+func (s *Service) ProcessVisible(ctx context.Context, u dvid.UUID, dataID dvid.DataLocalID,
+	begIndex, endIndex dvid.Index, f func(*storage.KeyValue)) error {
+
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	lineage, err := dataset.lineage(u)
+	rank := make(map[dvid.VersionLocalID]int, len(lineage))
+	if err == nil {
+		for i, ancestor := range lineage {
+			rank[dataset.VersionMap[ancestor]] = i
+		}
+	}
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	begKey := &DataKey{dataset.DatasetID, dataID, 0, begIndex}
+	endKey := &DataKey{dataset.DatasetID, dataID, dvid.MaxLocalID, endIndex}
+	begBytes, endBytes := begIndex.Bytes(), endIndex.Bytes()
+	var visible *storage.KeyValue
+	var visibleIndex []byte
+	visibleRank := len(lineage)
+	err = s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{Ctx: ctx}, func(chunk *storage.Chunk) {
+		key, ok := chunk.K.(*DataKey)
+		if !ok || key.Data != dataID {
+			return
+		}
+		r, inLineage := rank[key.Version]
+		if !inLineage {
+			return
+		}
+		// Skip keys whose version bytes, not index, put them within the range.
+		index := DataKeyIndexBytes(key.Bytes())
+		if bytes.Compare(index, begBytes) < 0 || bytes.Compare(index, endBytes) > 0 {
+			return
+		}
+		if visible != nil && !bytes.Equal(index, visibleIndex) {
+			f(visible)
+			visible = nil
+		}
+		if visible == nil || r < visibleRank {
+			visible = &storage.KeyValue{K: key, V: chunk.V}
+			visibleIndex = index
+			visibleRank = r
+		}
+	})
+	if err == nil && visible != nil {
+		f(visible)
+	}
+	return err
+}
+
+// ProcessVisibleBatches calls f on the key/values visible at version u of data between
+// begIndex and endIndex like ProcessVisible, but reads at most batchSize key/values at a
+// time and calls f between reads, so a slow f doesn't hold the database open.  It stops
+// at the first error returned by f or once ctx is done.
+func (s *Service) ProcessVisibleBatches(ctx context.Context, u dvid.UUID, dataID dvid.DataLocalID,
+	begIndex, endIndex dvid.Index, batchSize int, f func(*storage.KeyValue) error) error {
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for {
+		batch := make([]storage.KeyValue, 0, batchSize)
+		scanCtx, cancel := context.WithCancel(ctx)
+		err := s.ProcessVisible(scanCtx, u, dataID, begIndex, endIndex, func(kv *storage.KeyValue) {
+			if len(batch) == batchSize {
+				return
+			}
+			value := make([]byte, len(kv.V))
+			copy(value, kv.V)
+			batch = append(batch, storage.KeyValue{K: kv.K, V: value})
+			if len(batch) == batchSize {
+				cancel()
+			}
+		})
+		cancel()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil && len(batch) < batchSize {
+			return err
+		}
+		for i := range batch {
+			if err := f(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		// Resume just past the last index read, i.e., at the next index of the same length.
+		next := DataKeyIndexBytes(batch[len(batch)-1].K.Bytes())
+		next = append([]byte{}, next...)
+		i := len(next) - 1
+		for ; i >= 0; i-- {
+			next[i]++
+			if next[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			return nil
+		}
+		begIndex = dvid.IndexBytes(next)
+	}
+}
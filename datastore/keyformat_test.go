@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+func (s *DataSuite) TestDataKeyLayout(c *C) {
+	key := &DataKey{3, 4, 5, dvid.IndexBytes{1, 2, 3}}
+	b := key.Bytes()
+	c.Assert(DataKeyIndexBytes(b), DeepEquals, []byte{1, 2, 3})
+	parsed, err := (&DataKey{Index: dvid.IndexBytes{}}).BytesToKey(b)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.(*DataKey).Version, Equals, dvid.VersionLocalID(5))
+	c.Assert(parsed.Bytes(), DeepEquals, b)
+
+	// Versions of an index are adjacent and ordered.
+	c.Assert(string((&DataKey{3, 4, 6, dvid.IndexBytes{1, 2, 3}}).Bytes()) > string(b), Equals, true)
+	c.Assert(string((&DataKey{3, 4, 0, dvid.IndexBytes{1, 2, 4}}).Bytes()) > string(b), Equals, true)
+
+	// Ranges of a version exclude other versions found within them.
+	begKey := &DataKey{3, 4, 5, dvid.IndexBytes{0, 0, 0}}
+	endKey := &DataKey{3, 4, 5, dvid.IndexBytes{9, 9, 9}}
+	c.Assert(begKey.InRange(endKey, key), Equals, true)
+	c.Assert(begKey.InRange(endKey, &DataKey{3, 4, 6, dvid.IndexBytes{1, 2, 3}}), Equals, false)
+	allKey := &DataKey{3, 5, 0, dvid.IndexBytes{}}
+	c.Assert(begKey.InRange(allKey, &DataKey{3, 4, 6, dvid.IndexBytes{1, 2, 3}}), Equals, true)
+}
+
+func (s *DataSuite) TestMigrateKeys(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "seg")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+
+	// Write keys in the version-first layout of older datastores.
+	legacy := func(version dvid.VersionLocalID, index []byte) rawKey {
+		b := []byte{byte(storage.KeyData)}
+		b = append(b, dvid.LocalID32(data.DsetID).Bytes()...)
+		b = append(b, dvid.LocalID(data.ID).Bytes()...)
+		b = append(b, dvid.LocalID(version).Bytes()...)
+		return rawKey(append(b, index...))
+	}
+	c.Assert(service.kvSetter.Put(legacy(0, []byte{1, 2, 3}), []byte("root")), IsNil)
+	c.Assert(service.kvSetter.Put(legacy(1, []byte{1, 2, 3}), []byte("child")), IsNil)
+	service.Datasets.keyFormat = VersionFirstKeys
+	c.Assert(service.Datasets.Put(service.kvSetter), IsNil)
+	service.Shutdown()
+
+	_, openErr = Open(dir)
+	c.Assert(openErr, NotNil)
+	c.Assert(openErr.ErrorType, Equals, ErrorKeyFormat)
+
+	migration, err := MigrateKeys(dir)
+	c.Assert(err, IsNil)
+	c.Assert(migration.Keys, Equals, int64(2))
+	_, err = MigrateKeys(dir)
+	c.Assert(err, NotNil)
+
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	index := dvid.IndexBytes{1, 2, 3}
+	value, err := service.kvGetter.Get(&DataKey{data.DsetID, data.ID, 0, index})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root")
+	value, err = service.kvGetter.Get(&DataKey{data.DsetID, data.ID, 1, index})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "child")
+}
+
+func (s *DataSuite) TestProcessVisible(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "seg")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	sibling, err := service.NewScratchVersion(root, time.Hour)
+	c.Assert(err, IsNil)
+	_, childVersion, err := service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+	_, siblingVersion, err := service.LocalIDFromUUID(sibling)
+	c.Assert(err, IsNil)
+
+	db := service.kvSetter
+	c.Assert(db.Put(data.DataKey(0, dvid.IndexBytes{1}), []byte("root 1")), IsNil)
+	c.Assert(db.Put(data.DataKey(0, dvid.IndexBytes{2}), []byte("root 2")), IsNil)
+	c.Assert(db.Put(data.DataKey(childVersion, dvid.IndexBytes{2}), []byte("child 2")), IsNil)
+	c.Assert(db.Put(data.DataKey(siblingVersion, dvid.IndexBytes{3}), []byte("sibling 3")), IsNil)
+
+	var values []string
+	err = service.ProcessVisible(context.Background(), child, data.ID, dvid.IndexBytes{0}, dvid.IndexBytes{9},
+		func(kv *storage.KeyValue) { values = append(values, string(kv.V)) })
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"root 1", "child 2"})
+
+	values = nil
+	err = service.ProcessVisible(context.Background(), root, data.ID, dvid.IndexBytes{0}, dvid.IndexBytes{9},
+		func(kv *storage.KeyValue) { values = append(values, string(kv.V)) })
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"root 1", "root 2"})
+
+	// A range at one version only returns that version's keys.
+	keys, err := service.kvGetter.KeysInRange(data.DataKey(0, dvid.IndexBytes{0}), data.DataKey(0, dvid.IndexBytes{9}))
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	// Keys of longer indices between the versions of an index are skipped.
+	c.Assert(db.Put(data.DataKey(0, dvid.IndexBytes{2, 0, 0}), []byte("root 2.0.0")), IsNil)
+	values = nil
+	err = service.ProcessVisible(context.Background(), child, data.ID, dvid.IndexBytes{2}, dvid.IndexBytes{2},
+		func(kv *storage.KeyValue) { values = append(values, string(kv.V)) })
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"child 2"})
+}
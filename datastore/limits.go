@@ -0,0 +1,103 @@
+/*
+	This file supports per-instance limits on query sizes so shared servers aren't
+	brought down by accidental whole-volume requests.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// QueryLimits are optional maximums on the size of requests to a data instance.
+// A zero value means there is no limit.
+type QueryLimits struct {
+	// MaxSliceArea is the maximum number of voxels in a 2d slice request.
+	MaxSliceArea int64 `json:",omitempty"`
+
+	// MaxSubvolumeVoxels is the maximum number of voxels in a 3d subvolume request.
+	MaxSubvolumeVoxels int64 `json:",omitempty"`
+
+	// MaxListKeys is the maximum number of items returned by a listing.
+	MaxListKeys int64 `json:",omitempty"`
+}
+
+// LimitError is returned for requests that exceed a query limit of a data instance.
+type LimitError struct {
+	Data      dvid.DataString
+	Setting   string
+	Units     string
+	Limit     int64
+	Requested int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Request for %d %s exceeds the %s of %d for data '%s'.  "+
+		"Split the request into smaller ones, or have an administrator POST {\"%s\": \"<new limit>\"} to the data",
+		e.Requested, e.Units, e.Setting, e.Limit, e.Data, e.Setting)
+}
+
+// SetLimits sets any query limits within the configuration.  Only limits within the
+// passed config are modified, and a limit of 0 removes it.
+func (d *Data) SetLimits(config dvid.Config) error {
+	limits := []struct {
+		setting string
+		value   *int64
+	}{
+		{"MaxSliceArea", &d.Limits.MaxSliceArea},
+		{"MaxSubvolumeVoxels", &d.Limits.MaxSubvolumeVoxels},
+		{"MaxListKeys", &d.Limits.MaxListKeys},
+	}
+	for _, limit := range limits {
+		s, found, err := config.GetString(limit.setting)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		value, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || value < 0 {
+			return fmt.Errorf("Bad %s %q: must be a non-negative integer", limit.setting, s)
+		}
+		*limit.value = value
+	}
+	return nil
+}
+
+func (d *Data) checkLimit(setting, units string, limit, requested int64) error {
+	if limit == 0 || requested <= limit {
+		return nil
+	}
+	return &LimitError{Data: d.Name, Setting: setting, Units: units, Limit: limit, Requested: requested}
+}
+
+// CheckSlice returns a *LimitError if the slice exceeds the instance's MaxSliceArea.
+func (d *Data) CheckSlice(geom dvid.Geometry) error {
+	return d.checkLimit("MaxSliceArea", "voxels", d.Limits.MaxSliceArea, geom.NumVoxels())
+}
+
+// CheckSubvolume returns a *LimitError if the subvolume exceeds the instance's
+// MaxSubvolumeVoxels.
+func (d *Data) CheckSubvolume(geom dvid.Geometry) error {
+	return d.checkLimit("MaxSubvolumeVoxels", "voxels", d.Limits.MaxSubvolumeVoxels, geom.NumVoxels())
+}
+
+// CheckGeometry returns a *LimitError if a request for the voxels in a 2d geometry
+// exceeds the instance's MaxSliceArea or one in a 3d geometry exceeds its
+// MaxSubvolumeVoxels.
+func (d *Data) CheckGeometry(geom dvid.Geometry) error {
+	if geom.DataShape().ShapeDimensions() == 2 {
+		return d.CheckSlice(geom)
+	}
+	return d.CheckSubvolume(geom)
+}
+
+// CheckListKeys returns a *LimitError if a listing of n items exceeds the instance's
+// MaxListKeys.
+func (d *Data) CheckListKeys(n int) error {
+	return d.checkLimit("MaxListKeys", "items", d.Limits.MaxListKeys, int64(n))
+}
@@ -0,0 +1,307 @@
+/*
+	This file backs up dataset metadata, i.e., the version DAGs and data configurations,
+	to an object store so a datastore whose metadata is lost or corrupted can be recovered
+	without a full backup of its data.  Backups are laid out like a git repository:
+
+		objects/<hash>    A dataset snapshot or a commit, named by the SHA-256 of its JSON.
+		HEAD              The hash of the latest commit.
+
+	A commit lists the snapshot of each dataset and the hash of its parent commit, so the
+	history of metadata can be walked back from HEAD.  Each backup only uploads snapshots
+	of datasets that changed since the last commit and makes no commit if nothing changed.
+*/
+
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// MetadataHead is the key of the latest commit's hash in a metadata backup.
+const MetadataHead = "HEAD"
+
+// DatasetSnapshot is the metadata of a dataset at a point in time.  Stored is the exact
+// form kept in the datastore, which is restored, and JSON is for reading without DVID.
+type DatasetSnapshot struct {
+	Root      dvid.UUID
+	DatasetID dvid.DatasetLocalID
+	JSON      json.RawMessage
+	Stored    []byte
+}
+
+// MetadataCommit records the snapshots of all datasets at a point in time.
+type MetadataCommit struct {
+	Parent  string `json:",omitempty"`
+	Created time.Time
+
+	// Datasets is the stored list of datasets.
+	Datasets []byte
+
+	// Snapshots refer to the snapshot of each dataset by root UUID.
+	Snapshots map[dvid.UUID]SnapshotRef
+}
+
+// SnapshotRef refers to a dataset snapshot.  Since the stored form of a dataset isn't
+// deterministic, changes are detected by the Digest, the SHA-256 of the dataset's JSON
+// and trash.
+type SnapshotRef struct {
+	Object string
+	Digest string
+}
+
+// MetadataBackup writes commits of changed metadata to an object store.
+type MetadataBackup struct {
+	store storage.ObjectStore
+	head  string
+	last  map[dvid.UUID]SnapshotRef
+}
+
+// putObject stores a JSON object under its hash, returning the hash.
+func putObject(store storage.ObjectStore, v interface{}) (string, error) {
+	m, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(m)
+	hash := hex.EncodeToString(sum[:])
+	return hash, store.PutObject("objects/"+hash, m)
+}
+
+// getObject reads the JSON object with a hash, verifying its content.
+func getObject(store storage.ObjectStore, hash string, v interface{}) error {
+	m, err := store.GetObject("objects/" + hash)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("Metadata backup %s has no object %s", store, hash)
+	}
+	sum := sha256.Sum256(m)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("Object %s of metadata backup %s is corrupted", hash, store)
+	}
+	return json.Unmarshal(m, v)
+}
+
+// metadataHead returns the latest commit of a backup, which is nil if there is none.
+func metadataHead(store storage.ObjectStore) (hash string, commit *MetadataCommit, err error) {
+	head, err := store.GetObject(MetadataHead)
+	if err != nil || head == nil {
+		return "", nil, err
+	}
+	hash = strings.TrimSpace(string(head))
+	commit = new(MetadataCommit)
+	if err = getObject(store, hash, commit); err != nil {
+		return "", nil, err
+	}
+	return hash, commit, nil
+}
+
+// NewMetadataBackup returns a backup to the store that continues any commits already there.
+func NewMetadataBackup(store storage.ObjectStore) (*MetadataBackup, error) {
+	head, commit, err := metadataHead(store)
+	if err != nil {
+		return nil, err
+	}
+	backup := &MetadataBackup{store: store, head: head, last: make(map[dvid.UUID]SnapshotRef)}
+	if commit != nil {
+		backup.last = commit.Snapshots
+	}
+	return backup, nil
+}
+
+// Head returns the hash of the latest commit, which is empty if nothing has been committed.
+func (b *MetadataBackup) Head() string {
+	return b.head
+}
+
+// Backup commits the metadata of a service if it changed since the last commit, returning
+// true if a commit was made.
+func (b *MetadataBackup) Backup(s *Service) (committed bool, err error) {
+	if s.Datasets == nil {
+		return false, fmt.Errorf("Datastore service has no datasets available")
+	}
+	s.Datasets.writeLock.Lock()
+	list := make([]*Dataset, len(s.Datasets.list))
+	copy(list, s.Datasets.list)
+	datasets, err := s.Datasets.MarshalBinary()
+	s.Datasets.writeLock.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	commit := &MetadataCommit{
+		Parent:    b.head,
+		Created:   time.Now(),
+		Datasets:  datasets,
+		Snapshots: make(map[dvid.UUID]SnapshotRef, len(list)),
+	}
+	changed := len(list) != len(b.last)
+	for _, dataset := range list {
+		m, err := json.Marshal(dataset)
+		if err != nil {
+			return false, err
+		}
+		digest, err := snapshotDigest(dataset, m)
+		if err != nil {
+			return false, err
+		}
+		if ref, found := b.last[dataset.Root]; found && ref.Digest == digest {
+			commit.Snapshots[dataset.Root] = ref
+			continue
+		}
+		changed = true
+		compression, err := dvid.NewCompression(dvid.LZ4, dvid.DefaultCompression)
+		if err != nil {
+			return false, err
+		}
+		stored, err := dvid.Serialize(dataset, compression, dvid.CRC32)
+		if err != nil {
+			return false, err
+		}
+		snapshot := &DatasetSnapshot{Root: dataset.Root, DatasetID: dataset.DatasetID, JSON: m, Stored: stored}
+		hash, err := putObject(b.store, snapshot)
+		if err != nil {
+			return false, err
+		}
+		commit.Snapshots[dataset.Root] = SnapshotRef{Object: hash, Digest: digest}
+	}
+	if !changed {
+		return false, nil
+	}
+	hash, err := putObject(b.store, commit)
+	if err != nil {
+		return false, err
+	}
+	if err := b.store.PutObject(MetadataHead, []byte(hash+"\n")); err != nil {
+		return false, err
+	}
+	b.head = hash
+	b.last = commit.Snapshots
+	return true, nil
+}
+
+// snapshotDigest returns the SHA-256 of a dataset's JSON and of its trash, which the
+// JSON leaves out, so purging trashed data is also a change to back up.
+func snapshotDigest(dataset *Dataset, m []byte) (string, error) {
+	dataset.mapLock.Lock()
+	trash, err := json.Marshal(dataset.Trash)
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(m)
+	hash.Write(trash)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// MetadataHistory returns the commits of a backup, newest first, up to the given number
+// or all if max is zero.
+func MetadataHistory(store storage.ObjectStore, max int) ([]string, []*MetadataCommit, error) {
+	hash, commit, err := metadataHead(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hashes []string
+	var commits []*MetadataCommit
+	for commit != nil && (max == 0 || len(commits) < max) {
+		hashes = append(hashes, hash)
+		commits = append(commits, commit)
+		if hash = commit.Parent; hash == "" {
+			break
+		}
+		commit = new(MetadataCommit)
+		if err := getObject(store, hash, commit); err != nil {
+			return hashes, commits, err
+		}
+	}
+	return hashes, commits, nil
+}
+
+// RestoreMetadata replaces the metadata of the datastore at the path, which must not be
+// served, with a commit of a backup, using the latest commit if the hash is empty.  Data
+// keys are untouched, so data added after the commit is orphaned and can be removed by
+// "fsck".  It returns the restored commit's hash.
+func RestoreMetadata(path string, store storage.ObjectStore, hash string) (string, error) {
+	var commit *MetadataCommit
+	var err error
+	if hash == "" {
+		if hash, commit, err = metadataHead(store); err != nil {
+			return "", err
+		}
+		if commit == nil {
+			return "", fmt.Errorf("Metadata backup %s has no commits", store)
+		}
+	} else {
+		commit = new(MetadataCommit)
+		if err := getObject(store, hash, commit); err != nil {
+			return "", err
+		}
+	}
+	roots := make([]string, 0, len(commit.Snapshots))
+	for root := range commit.Snapshots {
+		roots = append(roots, string(root))
+	}
+	sort.Strings(roots)
+	snapshots := make([]*DatasetSnapshot, len(roots))
+	for i, root := range roots {
+		snapshots[i] = new(DatasetSnapshot)
+		if err := getObject(store, commit.Snapshots[dvid.UUID(root)].Object, snapshots[i]); err != nil {
+			return "", err
+		}
+	}
+
+	engine, err := storage.NewStore(path, false, dvid.Config{})
+	if err != nil {
+		return "", fmt.Errorf("Error opening datastore (%s): %s", path, err.Error())
+	}
+	defer engine.Close()
+	db, ok := engine.(storage.OrderedKeyValueDB)
+	if !ok {
+		return "", fmt.Errorf("Datastore at %s does not support key-value database ops", path)
+	}
+
+	// Replace the stored datasets in one batch, removing any not in the commit, so a
+	// failed restore leaves the previous metadata.
+	batcher, ok := engine.(storage.Batcher)
+	if !ok {
+		return "", fmt.Errorf("Datastore at %s does not support batch write", path)
+	}
+	keys, err := db.KeysInRange(MinDatasetKey(), MaxDatasetKey())
+	if err != nil {
+		return "", err
+	}
+	restoredIDs := make(map[dvid.DatasetLocalID]bool, len(snapshots))
+	for _, snapshot := range snapshots {
+		restoredIDs[snapshot.DatasetID] = true
+	}
+	batch := batcher.NewBatch()
+	for _, key := range keys {
+		if datasetKey, ok := key.(*DatasetKey); !ok || !restoredIDs[datasetKey.Dataset] {
+			batch.Delete(key)
+		}
+	}
+	for _, snapshot := range snapshots {
+		batch.Put(&DatasetKey{snapshot.DatasetID}, snapshot.Stored)
+	}
+	batch.Put(&DatasetsKey{}, commit.Datasets)
+	if err := batch.Commit(); err != nil {
+		return "", err
+	}
+
+	// Make sure the restored metadata loads.
+	if err := new(Datasets).Load(db); err != nil {
+		return "", fmt.Errorf("Restored metadata of commit %s doesn't load: %s", hash, err.Error())
+	}
+	return hash, nil
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+func (s *DataSuite) TestMetadataBackup(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+
+	// Only changed metadata is committed.
+	store := storage.NewDirStore(c.MkDir())
+	backup, err := NewMetadataBackup(store)
+	c.Assert(err, IsNil)
+	c.Assert(backup.Head(), Equals, "")
+	committed, err := backup.Backup(service)
+	c.Assert(err, IsNil)
+	c.Assert(committed, Equals, true)
+	first := backup.Head()
+	committed, err = backup.Backup(service)
+	c.Assert(err, IsNil)
+	c.Assert(committed, Equals, false)
+	c.Assert(backup.Head(), Equals, first)
+
+	c.Assert(service.NewData(root, "migratetest", "segmentation", dvid.NewConfig()), IsNil)
+	committed, err = backup.Backup(service)
+	c.Assert(err, IsNil)
+	c.Assert(committed, Equals, true)
+	second := backup.Head()
+	c.Assert(second, Not(Equals), first)
+
+	// A new backup of the same store continues its history.
+	backup, err = NewMetadataBackup(store)
+	c.Assert(err, IsNil)
+	c.Assert(backup.Head(), Equals, second)
+	hashes, commits, err := MetadataHistory(store, 0)
+	c.Assert(err, IsNil)
+	c.Assert(hashes, DeepEquals, []string{second, first})
+	c.Assert(commits[0].Parent, Equals, first)
+	c.Assert(commits[0].Snapshots[root].Digest, Not(Equals), commits[1].Snapshots[root].Digest)
+	service.Shutdown()
+
+	// Restoring the first commit loses the data added since.
+	restored, err := RestoreMetadata(dir, store, first)
+	c.Assert(err, IsNil)
+	c.Assert(restored, Equals, first)
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	_, err = service.DataServiceByUUID(root, "segmentation")
+	c.Assert(err, NotNil)
+	service.Shutdown()
+
+	restored, err = RestoreMetadata(dir, store, "")
+	c.Assert(err, IsNil)
+	c.Assert(restored, Equals, second)
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	_, err = service.DataServiceByUUID(root, "segmentation")
+	c.Assert(err, IsNil)
+	service.Shutdown()
+}
+
+func (s *DataSuite) TestMetadataBackupTrash(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "segmentation", dvid.NewConfig()), IsNil)
+	c.Assert(service.DeleteData(root, "segmentation"), IsNil)
+	backup, err := NewMetadataBackup(storage.NewDirStore(c.MkDir()))
+	c.Assert(err, IsNil)
+	committed, err := backup.Backup(service)
+	c.Assert(err, IsNil)
+	c.Assert(committed, Equals, true)
+
+	// Purging trashed data only changes the trash, which is still committed.
+	_, err = service.PurgeData(root, "segmentation")
+	c.Assert(err, IsNil)
+	committed, err = backup.Backup(service)
+	c.Assert(err, IsNil)
+	c.Assert(committed, Equals, true)
+}
@@ -0,0 +1,204 @@
+/*
+	This file supports upgrading data written by older versions of a data type.  Each data
+	type's version is its on-disk format version, which is stored with every data instance.
+	When a datastore is opened, data with an older version is migrated in the background if
+	the compiled data type has migrations from that version, and otherwise the datastore is
+	refused with a report of the data that can't be read.  Requests for data that hasn't
+	been migrated yet are refused until its migration is done.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Migration upgrades data of a data type from one format version to the next.
+type Migration struct {
+	From string
+	To   string
+
+	// Migrate upgrades data in place, e.g., setting new configuration or rewriting
+	// stored values.  It should be safe to rerun since the data's version is only
+	// stored once all its migrations succeed.
+	Migrate func(DataService) error
+}
+
+// Migrator is implemented by data types whose format changed across versions.
+type Migrator interface {
+	Migrations() []Migration
+}
+
+// typeServiceSetter is implemented by data embedding Data.
+type typeServiceSetter interface {
+	setTypeService(TypeService)
+}
+
+func (d *Data) setTypeService(t TypeService) {
+	d.TypeService = t
+}
+
+// migrationPath returns the migrations that upgrade a data type's data from a version
+// to the compiled version of the data type.
+func migrationPath(compiled TypeService, from string) ([]Migration, error) {
+	to := compiled.DatatypeVersion()
+	migrator, ok := compiled.(Migrator)
+	if !ok {
+		return nil, fmt.Errorf("%s has no migrations", compiled.DatatypeName())
+	}
+	migrations := migrator.Migrations()
+	var path []Migration
+	for version := from; version != to; {
+		if len(path) > len(migrations) {
+			return nil, fmt.Errorf("%s migrations from version %s form a cycle", compiled.DatatypeName(), from)
+		}
+		found := false
+		for _, migration := range migrations {
+			if migration.From == version {
+				path = append(path, migration)
+				version = migration.To
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has no migration from version %s", compiled.DatatypeName(), version)
+		}
+	}
+	return path, nil
+}
+
+// checkTypeVersions finds data written by other versions of their data types.  Data
+// that can be migrated to the compiled versions is migrated by runMigrations and then
+// stored in the given database.  If any data can't be migrated, an error reports all of it.
+func (dsets *Datasets) checkTypeVersions(db storage.OrderedKeyValueSetter) error {
+	var report string
+	for _, dset := range dsets.list {
+		dset.migrationDB = db
+		for _, name := range dset.sortedDataNames() {
+			data := dset.DataMap[name]
+			compiled, found := CompiledTypes[data.DatatypeUrl()]
+			if !found {
+				continue // Reported by VerifyCompiledTypes.
+			}
+			stored := data.DatatypeVersion()
+			if stored == compiled.DatatypeVersion() {
+				continue
+			}
+			path, err := migrationPath(compiled, stored)
+			if err != nil {
+				report += fmt.Sprintf("Data '%s' in dataset %s has %s version %s but DVID has version %s: %s\n",
+					name, dset.Root, data.DatatypeName(), stored, compiled.DatatypeVersion(), err.Error())
+				continue
+			}
+			dset.migrationMu.Lock()
+			if dset.migrations == nil {
+				dset.migrations = make(map[dvid.DataString][]Migration)
+			}
+			dset.migrations[name] = path
+			dset.migrationMu.Unlock()
+			atomic.AddInt32(&dset.unmigrated, 1)
+			dvid.Log(dvid.Normal, "Data '%s' in dataset %s will be migrated from %s version %s to %s\n",
+				name, dset.Root, data.DatatypeName(), stored, compiled.DatatypeVersion())
+		}
+	}
+	if report != "" {
+		return fmt.Errorf("%s", report)
+	}
+	return nil
+}
+
+// runMigrations runs the pending migrations of all datasets, then closes dsets.migrated.
+func (dsets *Datasets) runMigrations() {
+	defer close(dsets.migrated)
+	for _, dset := range dsets.list {
+		dset.migrationMu.Lock()
+		names := make([]dvid.DataString, 0, len(dset.migrations))
+		for name := range dset.migrations {
+			names = append(names, name)
+		}
+		dset.migrationMu.Unlock()
+		for _, name := range names {
+			if err := dset.runMigration(name); err != nil {
+				dvid.Error("%s\n", err.Error())
+			}
+		}
+	}
+}
+
+// WaitForMigrations returns once the migrations started when the datastore was opened
+// are done.
+func (dsets *Datasets) WaitForMigrations() {
+	if dsets.migrated != nil {
+		<-dsets.migrated
+	}
+}
+
+// runMigration runs the pending migrations of data then stores the upgraded data.  If a
+// migration fails, the data is refused until a restart retries it.
+func (dset *Dataset) runMigration(name dvid.DataString) error {
+	dset.migrationMu.Lock()
+	path := dset.migrations[name]
+	data, found := dset.DataMap[name]
+	dset.migrationMu.Unlock()
+	if !found || len(path) == 0 {
+		return nil
+	}
+	compiled := CompiledTypes[data.DatatypeUrl()]
+	setter, ok := data.(typeServiceSetter)
+	if !ok {
+		return dset.failMigration(name, fmt.Errorf("Unable to set the version of data '%s'", name))
+	}
+	for _, migration := range path {
+		if migration.Migrate != nil {
+			if err := migration.Migrate(data); err != nil {
+				return dset.failMigration(name, fmt.Errorf("Unable to migrate data '%s' from %s version %s to %s: %s",
+					name, data.DatatypeName(), migration.From, migration.To, err.Error()))
+			}
+		}
+		dvid.Log(dvid.Normal, "Migrated data '%s' in dataset %s from %s version %s to %s\n",
+			name, dset.Root, data.DatatypeName(), migration.From, migration.To)
+	}
+	setter.setTypeService(compiled)
+	if err := dset.Put(dset.migrationDB); err != nil {
+		return dset.failMigration(name, err)
+	}
+	dset.migrationMu.Lock()
+	delete(dset.migrations, name)
+	dset.migrationMu.Unlock()
+	atomic.AddInt32(&dset.unmigrated, -1)
+	return nil
+}
+
+// failMigration records the error of a failed migration, which is returned for requests
+// of the data.
+func (dset *Dataset) failMigration(name dvid.DataString, err error) error {
+	dset.migrationMu.Lock()
+	if dset.migrationErrs == nil {
+		dset.migrationErrs = make(map[dvid.DataString]error)
+	}
+	dset.migrationErrs[name] = err
+	dset.migrationMu.Unlock()
+	return err
+}
+
+// migrate returns an error if data hasn't been migrated to the compiled version of its
+// data type.  Datasets without pending migrations are checked with one atomic load.
+func (dset *Dataset) migrate(name dvid.DataString, data DataService) error {
+	if atomic.LoadInt32(&dset.unmigrated) == 0 {
+		return nil
+	}
+	dset.migrationMu.Lock()
+	defer dset.migrationMu.Unlock()
+	if err, failed := dset.migrationErrs[name]; failed {
+		return err
+	}
+	if _, pending := dset.migrations[name]; pending {
+		return fmt.Errorf("Data '%s' is being migrated to a new format.  Retry once it's done.", name)
+	}
+	return nil
+}
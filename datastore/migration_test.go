@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const migrateTypeUrl = "github.com/janelia-flyem/dvid/datastore/migratetest"
+
+// migrateType is a data type whose format versions can be changed for testing.
+type migrateType struct {
+	Datatype
+	migrations []Migration
+}
+
+func newMigrateType(version string, migrations ...Migration) *migrateType {
+	t := &migrateType{migrations: migrations}
+	t.DatatypeID = MakeDatatypeID("migratetest", migrateTypeUrl, version)
+	return t
+}
+
+func (t *migrateType) NewDataService(id *DataID, config dvid.Config) (DataService, error) {
+	d, err := NewDataService(id, t, config)
+	return &migrateData{Data: d}, err
+}
+
+func (t *migrateType) Migrations() []Migration {
+	return t.migrations
+}
+
+type migrateData struct {
+	*Data
+	Steps []string
+}
+
+func (d *migrateData) DoRPC(request Request, reply *Response) error {
+	return d.UnknownCommand(request)
+}
+
+func (d *migrateData) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return fmt.Errorf("Unsupported")
+}
+
+func init() {
+	gob.Register(&migrateType{})
+	gob.Register(&migrateData{})
+}
+
+func (s *DataSuite) TestMigration(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "old", dvid.NewConfig()), IsNil)
+	service.Shutdown()
+
+	step := func(from, to string) Migration {
+		return Migration{From: from, To: to, Migrate: func(data DataService) error {
+			d := data.(*migrateData)
+			d.Steps = append(d.Steps, from+"->"+to)
+			return nil
+		}}
+	}
+	RegisterDatatype(newMigrateType("0.3", step("0.2", "0.3"), step("0.1", "0.2")))
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+
+	// Data is migrated in the background after opening.
+	service.WaitForMigrations()
+	dataservice, err := service.DataServiceByUUID(root, "old")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DatatypeVersion(), Equals, "0.3")
+	c.Assert(dataservice.(*migrateData).Steps, DeepEquals, []string{"0.1->0.2", "0.2->0.3"})
+	service.Shutdown()
+
+	// The migrated data is stored.
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	service.WaitForMigrations()
+	dataservice, err = service.DataServiceByUUID(root, "old")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DatatypeVersion(), Equals, "0.3")
+	c.Assert(dataservice.(*migrateData).Steps, HasLen, 2)
+	service.Shutdown()
+
+	// Data without a migration path is refused.
+	RegisterDatatype(newMigrateType("0.5", step("0.4", "0.5")))
+	_, openErr = Open(dir)
+	c.Assert(openErr, NotNil)
+	c.Assert(openErr.ErrorType, Equals, ErrorDatatypeVersion)
+	c.Assert(openErr.Error(), Matches, "(?s).*Data 'old'.*version 0.3.*no migration from version 0.3.*")
+}
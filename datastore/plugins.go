@@ -0,0 +1,82 @@
+/*
+	This file loads data types from Go plugins so labs can add custom data types without
+	forking and rebuilding DVID.  A plugin is a main package built with
+	"go build -buildmode=plugin" against the same DVID source and Go version as the server.
+	It registers its data types with RegisterDatatype in an init() function or exports a
+	function "Datatypes" of type func() []datastore.TypeService returning them.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"sort"
+)
+
+// PluginSymbol is the name of the function a plugin can export to return its data types.
+const PluginSymbol = "Datatypes"
+
+// PluginTypes maps the URLs of data types loaded from plugins to the plugin paths.
+var PluginTypes = map[UrlString]string{}
+
+// LoadPlugins loads all plugins, i.e., files ending in ".so", in a directory.
+func LoadPlugins(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPlugin loads a plugin and registers its data types.
+func LoadPlugin(path string) error {
+	compiled := make(map[UrlString]bool, len(CompiledTypes))
+	for url := range CompiledTypes {
+		compiled[url] = true
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to load plugin %s: %s", path, err.Error())
+	}
+	return registerPluginTypes(path, p.Lookup, compiled)
+}
+
+// registerPluginTypes registers the data types returned by a plugin's exported function,
+// if any, and records all data types that weren't compiled before the plugin was opened.
+func registerPluginTypes(path string, lookup func(string) (plugin.Symbol, error),
+	compiled map[UrlString]bool) error {
+
+	if symbol, err := lookup(PluginSymbol); err == nil {
+		datatypes, ok := symbol.(func() []TypeService)
+		if !ok {
+			return fmt.Errorf("Plugin %s exports %s that isn't a func() []datastore.TypeService",
+				path, PluginSymbol)
+		}
+		for _, t := range datatypes() {
+			if compiled[t.DatatypeUrl()] {
+				return fmt.Errorf("Plugin %s data type %s [%s] is already compiled into DVID",
+					path, t.DatatypeName(), t.DatatypeUrl())
+			}
+			RegisterDatatype(t)
+		}
+	}
+	var added int
+	for url := range CompiledTypes {
+		if !compiled[url] {
+			PluginTypes[url] = path
+			added++
+		}
+	}
+	if added == 0 {
+		return fmt.Errorf("Plugin %s registered no data types", path)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"plugin"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *DataSuite) TestPluginTypes(c *C) {
+	const url = "github.com/example/dvid-plugins/plugintest"
+	defer delete(CompiledTypes, url)
+	defer delete(PluginTypes, url)
+	t := &migrateType{}
+	t.DatatypeID = MakeDatatypeID("plugintest", url, "0.1")
+	exported := func(symbol plugin.Symbol) func(string) (plugin.Symbol, error) {
+		return func(name string) (plugin.Symbol, error) {
+			if name != PluginSymbol || symbol == nil {
+				return nil, fmt.Errorf("symbol %s not found", name)
+			}
+			return symbol, nil
+		}
+	}
+	compiled := func() map[UrlString]bool {
+		m := make(map[UrlString]bool)
+		for u := range CompiledTypes {
+			m[u] = true
+		}
+		return m
+	}
+
+	err := registerPluginTypes("bad.so", exported(func() {}), compiled())
+	c.Assert(err, ErrorMatches, ".*isn't a func.*")
+	err = registerPluginTypes("none.so", exported(nil), compiled())
+	c.Assert(err, ErrorMatches, ".*registered no data types")
+
+	datatypes := func() []TypeService { return []TypeService{t} }
+	c.Assert(registerPluginTypes("custom.so", exported(datatypes), compiled()), IsNil)
+	c.Assert(CompiledTypes[url], Equals, TypeService(t))
+	c.Assert(PluginTypes[url], Equals, "custom.so")
+	typeService, err := TypeServiceByName("plugintest")
+	c.Assert(err, IsNil)
+	c.Assert(typeService, Equals, TypeService(t))
+
+	err = registerPluginTypes("again.so", exported(datatypes), compiled())
+	c.Assert(err, ErrorMatches, ".*already compiled.*")
+
+	// Files that aren't plugins aren't loaded.
+	dir := c.MkDir()
+	c.Assert(LoadPlugins(dir), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "fake.so"), []byte("not a plugin"), 0644), IsNil)
+	c.Assert(LoadPlugins(dir), ErrorMatches, "Unable to load plugin .*fake.so.*")
+}
@@ -0,0 +1,332 @@
+/*
+	This file supports publishing a dataset at a node, e.g., for a data paper.  Publishing
+	freezes the node and its ancestors and records a manifest with checksums of every
+	data instance so readers can verify they have the published data.
+*/
+
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// publishMutex guards the publication of all datasets.
+var publishMutex sync.RWMutex
+
+// Manifest describes a published dataset.
+type Manifest struct {
+	// Dataset is the UUID of the dataset's root node.
+	Dataset dvid.UUID
+
+	// Node is the published node.
+	Node dvid.UUID
+
+	// Lineage is the published node followed by its ancestors, which are all frozen.
+	Lineage []dvid.UUID
+
+	Published time.Time
+
+	// Citation is user-supplied JSON, e.g., authors, title, and DOI.
+	Citation json.RawMessage `json:",omitempty"`
+
+	Instances []InstanceManifest
+}
+
+// InstanceManifest describes a published data instance.  The checksum is a SHA-256 over
+// the published lineage, in order, of each version's UUID and the SHA-256 of its indices
+// and values in index order, so it doesn't depend on any server's local IDs.
+type InstanceManifest struct {
+	Name        dvid.DataString
+	TypeName    dvid.TypeString
+	TypeUrl     UrlString
+	TypeVersion string
+	Versioned   bool
+
+	// MinPoint and MaxPoint give the extents of spatial data, e.g., voxels.
+	MinPoint []int32 `json:",omitempty"`
+	MaxPoint []int32 `json:",omitempty"`
+
+	Keys   int64
+	Bytes  int64
+	SHA256 string
+}
+
+// extentData is data with spatial extents.
+type extentData interface {
+	VoxelExtents() (minPt, maxPt dvid.Point)
+}
+
+// pointValues returns the values of a point or nil if there is no point.
+func pointValues(pt dvid.Point) []int32 {
+	if pt == nil {
+		return nil
+	}
+	values := make([]int32, pt.NumDims())
+	for dim := range values {
+		values[dim] = pt.Value(uint8(dim))
+	}
+	return values
+}
+
+// lineage returns a node and all its ancestors, nearest first.
+func (dag *VersionDAG) lineage(u dvid.UUID) ([]dvid.UUID, error) {
+	if _, found := dag.Nodes[u]; !found {
+		return nil, fmt.Errorf("No node found with UUID %s", u)
+	}
+	uuids := []dvid.UUID{u}
+	visited := map[dvid.UUID]bool{u: true}
+	for i := 0; i < len(uuids); i++ {
+		node, found := dag.Nodes[uuids[i]]
+		if !found {
+			return nil, fmt.Errorf("No node found with UUID %s", uuids[i])
+		}
+		for _, parent := range node.Parents {
+			if !visited[parent] {
+				visited[parent] = true
+				uuids = append(uuids, parent)
+			}
+		}
+	}
+	return uuids, nil
+}
+
+// Publish freezes the dataset at the node with the given UUID and returns its manifest.
+// The node is locked, and afterwards no data in the node or its ancestors can be written,
+// no data can be added to or deleted from the dataset, and the node cannot be branched.
+// The citation must be a JSON object or empty.  Data is checksummed without holding the
+// publication lock since the locked lineage can't change; if that fails, the node is
+// unlocked again unless it was already locked.
+func (s *Service) Publish(u dvid.UUID, citation []byte) (*Manifest, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	if len(citation) != 0 {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(citation, &fields); err != nil {
+			return nil, fmt.Errorf("Citation must be a JSON object: %s", err.Error())
+		}
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	lineage, wasLocked, err := dataset.startPublishing(u)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := s.newManifest(dataset, u, lineage, citation)
+
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	dataset.publishing = false
+	if err == nil {
+		dataset.Published = manifest
+		if err = dataset.Put(s.kvSetter); err != nil {
+			dataset.Published = nil
+		}
+	}
+	if err != nil {
+		if !wasLocked {
+			dataset.Nodes[u].Locked = false
+		}
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// startPublishing marks the dataset as being published and locks the node, returning
+// the node's lineage and whether the node was already locked.
+func (dset *Dataset) startPublishing(u dvid.UUID) (lineage []dvid.UUID, wasLocked bool, err error) {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	if dset.Published != nil {
+		return nil, false, fmt.Errorf("Dataset %s was already published at node %s", dset.Root,
+			dset.Published.Node)
+	}
+	if dset.publishing {
+		return nil, false, fmt.Errorf("Dataset %s is already being published", dset.Root)
+	}
+	if lineage, err = dset.lineage(u); err != nil {
+		return nil, false, err
+	}
+	wasLocked = dset.Nodes[u].Locked
+	if err = dset.Lock(u); err != nil {
+		return nil, false, err
+	}
+	dset.publishing = true
+	return lineage, wasLocked, nil
+}
+
+// newManifest returns the manifest of a dataset published at a node with the given
+// lineage, checksumming all its data.
+func (s *Service) newManifest(dataset *Dataset, u dvid.UUID, lineage []dvid.UUID, citation []byte) (*Manifest, error) {
+	manifest := &Manifest{
+		Dataset:   dataset.Root,
+		Node:      u,
+		Lineage:   lineage,
+		Published: time.Now(),
+	}
+	if len(citation) != 0 {
+		manifest.Citation = json.RawMessage(citation)
+	}
+	for _, name := range dataset.sortedDataNames() {
+		instance, err := s.instanceManifest(dataset, dataset.DataMap[name], lineage)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Instances = append(manifest.Instances, *instance)
+	}
+	return manifest, nil
+}
+
+// instanceManifest returns the manifest of data, checksumming its indices and values
+// within the given lineage.
+func (s *Service) instanceManifest(dataset *Dataset, dataservice DataService,
+	lineage []dvid.UUID) (*InstanceManifest, error) {
+
+	instance := &InstanceManifest{
+		Name:        dataservice.DataName(),
+		TypeName:    dataservice.DatatypeName(),
+		TypeUrl:     dataservice.DatatypeUrl(),
+		TypeVersion: dataservice.DatatypeVersion(),
+		Versioned:   dataservice.IsVersioned(),
+	}
+	if e, ok := dataservice.(extentData); ok {
+		minPt, maxPt := e.VoxelExtents()
+		instance.MinPoint, instance.MaxPoint = pointValues(minPt), pointValues(maxPt)
+	}
+	data, ok := dataservice.(expiringData)
+	if !ok {
+		return nil, fmt.Errorf("Unable to get keys of data '%s'", instance.Name)
+	}
+	dataID := data.LocalID()
+	versionHashes := make(map[dvid.VersionLocalID]hash.Hash, len(lineage))
+	for _, u := range lineage {
+		versionHashes[dataset.VersionMap[u]] = sha256.New()
+	}
+	begKey := &DataKey{Dataset: dataset.DatasetID, Data: dataID, Index: dvid.IndexBytes{}}
+	endKey := &DataKey{Dataset: dataset.DatasetID, Data: dataID + 1, Index: dvid.IndexBytes{}}
+	err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		key, ok := chunk.K.(*DataKey)
+		if !ok || key.Data != dataID {
+			return
+		}
+		h, found := versionHashes[key.Version]
+		if !found {
+			return
+		}
+		indexBytes := key.Index.Bytes()
+		writeChecksumBytes(h, indexBytes)
+		writeChecksumBytes(h, chunk.V)
+		instance.Keys++
+		instance.Bytes += int64(len(indexBytes) + len(chunk.V))
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, u := range lineage {
+		writeChecksumBytes(h, []byte(u))
+		writeChecksumBytes(h, versionHashes[dataset.VersionMap[u]].Sum(nil))
+	}
+	instance.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return instance, nil
+}
+
+// writeChecksumBytes adds length-prefixed bytes to a checksum so key and value
+// boundaries are unambiguous.
+func writeChecksumBytes(h hash.Hash, b []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+	h.Write(size[:])
+	h.Write(b)
+}
+
+// sortedDataNames returns the names of the dataset's data in order.
+func (dset *Dataset) sortedDataNames() []dvid.DataString {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+	names := make([]dvid.DataString, 0, len(dset.DataMap))
+	for name := range dset.DataMap {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// Manifest returns the manifest of the dataset holding the given UUID or an error if
+// the dataset hasn't been published.
+func (s *Service) Manifest(u dvid.UUID) (*Manifest, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	publishMutex.RLock()
+	defer publishMutex.RUnlock()
+	if dataset.Published == nil {
+		return nil, fmt.Errorf("Dataset %s has not been published", dataset.Root)
+	}
+	return dataset.Published, nil
+}
+
+// published returns the manifest of a dataset or nil if it hasn't been published.
+func (dset *Dataset) published() *Manifest {
+	publishMutex.RLock()
+	defer publishMutex.RUnlock()
+	return dset.Published
+}
+
+// WritesBlocked returns an error if data at the node with the given UUID cannot be
+// written because the node is in the lineage of a published node.
+func (s *Service) WritesBlocked(u dvid.UUID) error {
+	if s.Datasets == nil {
+		return nil
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	manifest := dataset.published()
+	if manifest == nil {
+		return nil
+	}
+	for _, frozen := range manifest.Lineage {
+		if frozen == u {
+			return fmt.Errorf("Node %s is frozen by publication of dataset %s at node %s", u,
+				dataset.Root, manifest.Node)
+		}
+	}
+	return nil
+}
+
+// checkUnpublished returns an error if the dataset has been or is being published.
+func (dset *Dataset) checkUnpublished() error {
+	publishMutex.RLock()
+	defer publishMutex.RUnlock()
+	return dset.publicationErr()
+}
+
+// publicationErr is checkUnpublished for callers holding publishMutex.
+func (dset *Dataset) publicationErr() error {
+	if dset.publishing {
+		return fmt.Errorf("Dataset %s is being published", dset.Root)
+	}
+	if dset.Published != nil {
+		return fmt.Errorf("Dataset %s is frozen by publication at node %s", dset.Root, dset.Published.Node)
+	}
+	return nil
+}
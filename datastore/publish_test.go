@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestPublish(c *C) {
+	service, root, published, done := newTestData(c, "published", dvid.NewConfig())
+	defer done()
+	putTestKeys(c, service, root, published, 0, 8, []byte("published"))
+
+	_, err := service.Publish(root, []byte(`["not", "an", "object"]`))
+	c.Assert(err, NotNil)
+	_, err = service.Manifest(root)
+	c.Assert(err, NotNil)
+
+	citation := `{"title": "A connectome", "doi": "10.0000/example"}`
+	manifest, err := service.Publish(root, []byte(citation))
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Node, Equals, root)
+	c.Assert(manifest.Lineage, DeepEquals, []dvid.UUID{root})
+	c.Assert(string(manifest.Citation), Equals, citation)
+	c.Assert(manifest.Instances, HasLen, 1)
+	instance := manifest.Instances[0]
+	c.Assert(instance.Name, Equals, dvid.DataString("published"))
+	c.Assert(instance.TypeName, Equals, dvid.TypeString("migratetest"))
+	c.Assert(instance.Keys, Equals, int64(8))
+	c.Assert(instance.SHA256, HasLen, 64)
+
+	locked, err := service.Locked(root)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+	stored, err := service.Manifest(root)
+	c.Assert(err, IsNil)
+	c.Assert(stored, Equals, manifest)
+
+	// The dataset and its lineage are frozen.
+	c.Assert(service.WritesBlocked(root), NotNil)
+	_, err = service.Publish(root, nil)
+	c.Assert(err, NotNil)
+	_, err = service.NewVersion(root)
+	c.Assert(err, NotNil)
+	c.Assert(service.NewData(root, "migratetest", "added", dvid.NewConfig()), NotNil)
+	c.Assert(service.DeleteData(root, "published"), NotNil)
+
+	// Unpublished datasets aren't affected.
+	other, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.WritesBlocked(other), IsNil)
+}
@@ -0,0 +1,266 @@
+/*
+	This file supports scratch nodes, ephemeral children of a version for trying out
+	writes, e.g., an experimental segmentation, without leaving permanent versions behind.
+	A scratch node isn't one of its parent's children, so it never keeps ancestors from
+	being cleaned up, it's hidden from dataset listings, and it can't be locked or
+	branched.  It's deleted with all its keys once it hasn't been requested for its idle
+	period.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultScratchIdle is how long a scratch node can go unused before it's deleted.
+const DefaultScratchIdle = time.Hour
+
+// ScratchNode describes a scratch node.
+type ScratchNode struct {
+	UUID     dvid.UUID
+	Parent   dvid.UUID
+	Created  time.Time
+	LastUsed time.Time
+	Idle     time.Duration
+}
+
+// DeletedScratch describes a deleted scratch node and the keys reclaimed.  Bytes counts
+// the bytes of the keys since values aren't read to delete them.
+type DeletedScratch struct {
+	Dataset dvid.UUID
+	Node    dvid.UUID
+	Keys    int64
+	Bytes   int64
+}
+
+// touchScratch records use of a node if it's a scratch node.
+func (dset *Dataset) touchScratch(u dvid.UUID) {
+	dset.mapLock.Lock()
+	node, found := dset.Nodes[u]
+	dset.mapLock.Unlock()
+	if !found || !node.Scratch {
+		return
+	}
+	node.writeLock.Lock()
+	node.lastUsed = time.Now()
+	node.writeLock.Unlock()
+}
+
+// scratchLastUsed returns when a scratch node was last requested, or when it was created
+// if it hasn't been requested.
+func (node *Node) scratchLastUsed() time.Time {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+	if node.lastUsed.IsZero() {
+		return node.Created
+	}
+	return node.lastUsed
+}
+
+// withoutScratch returns the dataset with scratch nodes removed from its version DAG
+// for listings.
+func (dset *Dataset) withoutScratch() *Dataset {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+	hasScratch := false
+	for _, node := range dset.Nodes {
+		if node.Scratch {
+			hasScratch = true
+			break
+		}
+	}
+	if !hasScratch {
+		return dset
+	}
+	dag := &VersionDAG{
+		Root:         dset.Root,
+		Nodes:        make(map[dvid.UUID]*Node, len(dset.Nodes)),
+		VersionMap:   make(map[dvid.UUID]dvid.VersionLocalID, len(dset.VersionMap)),
+		NewVersionID: dset.NewVersionID,
+		NewDataID:    dset.NewDataID,
+	}
+	for u, node := range dset.Nodes {
+		if !node.Scratch {
+			dag.Nodes[u] = node
+			dag.VersionMap[u] = dset.VersionMap[u]
+		}
+	}
+	listed := *dset
+	listed.VersionDAG = dag
+	return &listed
+}
+
+// NewScratchVersion creates a scratch node off of a LOCKED parent node that's deleted
+// once it hasn't been requested for the idle duration, or DefaultScratchIdle if the
+// duration isn't positive.
+func (s *Service) NewScratchVersion(parent dvid.UUID, idle time.Duration) (dvid.UUID, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	if idle <= 0 {
+		idle = DefaultScratchIdle
+	}
+	dataset, u, err := s.Datasets.addChild(parent, true, idle)
+	if err != nil {
+		return "", err
+	}
+	return u, dataset.Put(s.kvSetter)
+}
+
+// ScratchVersions returns the scratch nodes of the dataset holding the given UUID,
+// ordered by creation.
+func (s *Service) ScratchVersions(u dvid.UUID) ([]ScratchNode, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*Node
+	dataset.mapLock.Lock()
+	for _, node := range dataset.Nodes {
+		if node.Scratch {
+			nodes = append(nodes, node)
+		}
+	}
+	dataset.mapLock.Unlock()
+	scratch := make([]ScratchNode, len(nodes))
+	for i, node := range nodes {
+		scratch[i] = ScratchNode{
+			UUID:     node.GlobalID,
+			Parent:   node.Parents[0],
+			Created:  node.Created,
+			LastUsed: node.scratchLastUsed(),
+			Idle:     node.ScratchIdle,
+		}
+	}
+	sort.Slice(scratch, func(i, j int) bool { return scratch[i].Created.Before(scratch[j].Created) })
+	return scratch, nil
+}
+
+// BeginWrite registers a write of data at the node with the given UUID and returns a
+// function to call once the write is done.  A node can't be deleted while writes are in
+// progress, and writes are refused once it has been.
+func (s *Service) BeginWrite(u dvid.UUID) (done func(), err error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	node, found := dataset.Nodes[u]
+	dataset.mapLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("No node found with UUID %s", u)
+	}
+	node.writes.RLock()
+	if node.deleted {
+		node.writes.RUnlock()
+		return nil, fmt.Errorf("Node %s has been deleted", u)
+	}
+	return node.writes.RUnlock, nil
+}
+
+// DeleteScratchVersion removes a scratch node from its dataset and deletes all keys
+// written at it.  Writes to the node are refused and those in progress finish before
+// the node's keys are deleted by version in batches of bounded size.
+func (s *Service) DeleteScratchVersion(u dvid.UUID) (*DeletedScratch, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	node, found := dataset.Nodes[u]
+	if !found || !node.Scratch {
+		dataset.mapLock.Unlock()
+		return nil, fmt.Errorf("Node %s is not a scratch node", u)
+	}
+	versionID := dataset.VersionMap[u]
+	dataset.mapLock.Unlock()
+
+	node.writes.Lock()
+	alreadyDeleted := node.deleted
+	node.deleted = true
+	node.writes.Unlock()
+	if alreadyDeleted {
+		return nil, fmt.Errorf("Scratch node %s is already being deleted", u)
+	}
+
+	dataset.mapLock.Lock()
+	delete(dataset.Nodes, u)
+	delete(dataset.VersionMap, u)
+	dataset.mapLock.Unlock()
+	s.Datasets.writeLock.Lock()
+	delete(s.Datasets.mapUUID, u)
+	s.Datasets.writeLock.Unlock()
+	if err := dataset.Put(s.kvSetter); err != nil {
+		return nil, err
+	}
+
+	deleted := &DeletedScratch{Dataset: dataset.Root, Node: u}
+	if node.KeysIndexed {
+		deleted.Keys, deleted.Bytes, err = s.deleteVersionKeys(context.Background(), dataset.DatasetID, versionID)
+		return deleted, err
+	}
+	// Nodes created before the version index are found by scanning each data.
+	for _, dataID := range dataset.dataLocalIDs() {
+		dataID := dataID
+		begKey := &DataKey{dataset.DatasetID, dataID, 0, dvid.IndexBytes{}}
+		endKey := &DataKey{dataset.DatasetID, dataID + 1, 0, dvid.IndexBytes{}}
+		keys, bytes, err := s.deleteKeyRange(context.Background(), begKey, endKey, func(key *DataKey) bool {
+			return key.Data == dataID && key.Version == versionID
+		})
+		deleted.Keys += keys
+		deleted.Bytes += bytes
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteIdleScratch deletes all scratch nodes that haven't been requested within their
+// idle period as of now and returns what was deleted.  Deletion continues past errors,
+// and the first error is returned.
+func (s *Service) DeleteIdleScratch(now time.Time) ([]*DeletedScratch, error) {
+	if s.Datasets == nil {
+		return nil, nil
+	}
+	var idle []dvid.UUID
+	s.Datasets.writeLock.Lock()
+	for _, dataset := range s.Datasets.list {
+		dataset.mapLock.Lock()
+		for u, node := range dataset.Nodes {
+			if node.Scratch && now.Sub(node.scratchLastUsed()) > node.ScratchIdle {
+				idle = append(idle, u)
+			}
+		}
+		dataset.mapLock.Unlock()
+	}
+	s.Datasets.writeLock.Unlock()
+
+	var deleted []*DeletedScratch
+	var firstErr error
+	for _, u := range idle {
+		d, err := s.DeleteScratchVersion(u)
+		if d != nil {
+			deleted = append(deleted, d)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return deleted, firstErr
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestScratchVersions(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "seg")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+
+	// Scratch nodes need a locked parent, like branches.
+	_, err = service.NewScratchVersion(root, time.Hour)
+	c.Assert(err, NotNil)
+	c.Assert(service.Lock(root), IsNil)
+	scratch, err := service.NewScratchVersion(root, time.Hour)
+	c.Assert(err, IsNil)
+
+	// They're hidden from listings and the parent's children and can't be locked.
+	jsonStr, err := service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, string(scratch)), Equals, false)
+	dataset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	c.Assert(dataset.Nodes[root].Children, HasLen, 0)
+	c.Assert(service.Lock(scratch), NotNil)
+	c.Assert(service.QuickCheck(), HasLen, 0)
+
+	db, err := service.OrderedKeyValueSetter()
+	c.Assert(err, IsNil)
+	_, scratchVersion, err := service.LocalIDFromUUID(scratch)
+	c.Assert(err, IsNil)
+	index := dvid.IndexBytes{1, 2, 3}
+	c.Assert(db.Put(&DataKey{data.DsetID, data.ID, 0, index}, []byte("root")), IsNil)
+	c.Assert(db.Put(&DataKey{data.DsetID, data.ID, scratchVersion, index}, []byte("scratch")), IsNil)
+
+	// Scratch nodes survive restarts until idle.
+	service.Shutdown()
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	nodes, err := service.ScratchVersions(root)
+	c.Assert(err, IsNil)
+	c.Assert(nodes, HasLen, 1)
+	c.Assert(nodes[0].UUID, Equals, scratch)
+	c.Assert(nodes[0].Parent, Equals, root)
+
+	deleted, err := service.DeleteIdleScratch(time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 0)
+	deleted, err = service.DeleteIdleScratch(time.Now().Add(2 * time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].Node, Equals, scratch)
+	c.Assert(deleted[0].Keys, Equals, int64(1))
+
+	_, err = service.DatasetFromUUID(scratch)
+	c.Assert(err, NotNil)
+	value, err := service.kvGetter.Get(&DataKey{data.DsetID, data.ID, scratchVersion, index})
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	value, err = service.kvGetter.Get(&DataKey{data.DsetID, data.ID, 0, index})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root")
+}
+
+func (s *DataSuite) TestScratchDeletionWaitsForWrites(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "seg", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "seg")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+	c.Assert(service.Lock(root), IsNil)
+	scratch, err := service.NewScratchVersion(root, time.Hour)
+	c.Assert(err, IsNil)
+	_, scratchVersion, err := service.LocalIDFromUUID(scratch)
+	c.Assert(err, IsNil)
+
+	// Deletion waits for a write in progress, and its keys are deleted too.
+	done, err := service.BeginWrite(scratch)
+	c.Assert(err, IsNil)
+	result := make(chan *DeletedScratch)
+	go func() {
+		deleted, err := service.DeleteScratchVersion(scratch)
+		c.Check(err, IsNil)
+		result <- deleted
+	}()
+	select {
+	case <-result:
+		c.Fatal("Scratch node deleted during a write")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for i := byte(0); i < 3; i++ {
+		key := &DataKey{data.DsetID, data.ID, scratchVersion, dvid.IndexBytes{i}}
+		c.Assert(service.kvSetter.Put(key, []byte("scratch")), IsNil)
+	}
+	done()
+	deleted := <-result
+	c.Assert(deleted.Keys, Equals, int64(3))
+	keys, err := service.kvGetter.KeysInRange(&DataKey{data.DsetID, data.ID, 0, dvid.IndexBytes{}},
+		&DataKey{data.DsetID, data.ID + 1, 0, dvid.IndexBytes{}})
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+	_, err = service.BeginWrite(scratch)
+	c.Assert(err, NotNil)
+}
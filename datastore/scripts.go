@@ -0,0 +1,185 @@
+/*
+	This file stores script hooks, which bind scripts that transform values to reads or
+	writes of a data instance, e.g., to redact a region or remap label IDs for one
+	collaborator's copy of a dataset.  See dvid/script.go for the scripts themselves.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	// ScriptRead hooks transform the replies to GET requests.
+	ScriptRead = "read"
+
+	// ScriptWrite hooks transform the bodies of POST and PUT requests.
+	ScriptWrite = "write"
+)
+
+// ScriptHook binds a script to the reads or writes of a data instance.
+type ScriptHook struct {
+	Name string
+
+	// Dataset is the root UUID of the dataset holding the data.
+	Dataset dvid.UUID
+	Data    dvid.DataString
+
+	// Event is ScriptRead or ScriptWrite.
+	Event string
+
+	// Endpoints limit the hook to some of the data's endpoints, e.g., "raw" or
+	// "elements".  Hooks without endpoints apply to all of the data's endpoints.
+	Endpoints []string `json:",omitempty"`
+
+	// Source is the Starlark source of the script.
+	Source string
+
+	Created time.Time
+}
+
+// Applies returns true if the hook transforms requests of an event to an endpoint.
+func (hook *ScriptHook) Applies(event, endpoint string) bool {
+	if hook.Event != event {
+		return false
+	}
+	if len(hook.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range hook.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// ScriptKey is an implementation of storage.Key for script hooks.
+type ScriptKey struct {
+	Name string
+}
+
+func (k *ScriptKey) KeyType() storage.KeyType {
+	return storage.KeyScript
+}
+
+func (k *ScriptKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed ScriptKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyScript) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into ScriptKey", storage.KeyType(b[0]))
+	}
+	return &ScriptKey{Name: string(b[1:])}, nil
+}
+
+func (k *ScriptKey) Bytes() []byte {
+	return append([]byte{byte(storage.KeyScript)}, k.Name...)
+}
+
+func (k *ScriptKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *ScriptKey) String() string {
+	return fmt.Sprintf("Script %s", k.Name)
+}
+
+// checkScriptName returns an error unless a name only has letters, digits, '-', and '_'.
+func checkScriptName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Script hooks must have a name")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("Script hook name %q can only have letters, digits, '-', and '_'", name)
+		}
+	}
+	return nil
+}
+
+// PutScriptHook stores a hook, replacing any hook with the same name.  The hook's
+// dataset can be given by any UUID in the dataset and is stored as the dataset's root.
+func (s *Service) PutScriptHook(hook *ScriptHook) error {
+	if err := checkScriptName(hook.Name); err != nil {
+		return err
+	}
+	if hook.Event != ScriptRead && hook.Event != ScriptWrite {
+		return fmt.Errorf("Script hook event must be %q or %q, not %q", ScriptRead, ScriptWrite, hook.Event)
+	}
+	if strings.TrimSpace(hook.Source) == "" {
+		return fmt.Errorf("Script hook %q has no source", hook.Name)
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(hook.Dataset)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Datasets.DataServiceByUUID(dataset.Root, hook.Data); err != nil {
+		return err
+	}
+	hook.Dataset = dataset.Root
+	hook.Created = time.Now()
+	value, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	return s.kvSetter.Put(&ScriptKey{Name: hook.Name}, value)
+}
+
+// GetScriptHook returns the hook with the given name.
+func (s *Service) GetScriptHook(name string) (*ScriptHook, error) {
+	value, err := s.kvGetter.Get(&ScriptKey{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("No script hook named %q", name)
+	}
+	var hook ScriptHook
+	if err := json.Unmarshal(value, &hook); err != nil {
+		return nil, fmt.Errorf("Bad script hook %s: %s", name, err.Error())
+	}
+	return &hook, nil
+}
+
+// ScriptHooks returns all hooks ordered by name.
+func (s *Service) ScriptHooks() ([]*ScriptHook, error) {
+	begKey := &ScriptKey{}
+	endKey := &ScriptKey{Name: "\xff"}
+	hooks := []*ScriptHook{}
+	var decodeErr error
+	err := s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if decodeErr != nil {
+			return
+		}
+		var hook ScriptHook
+		if err := json.Unmarshal(chunk.V, &hook); err != nil {
+			decodeErr = fmt.Errorf("Bad script hook with key %s: %s", chunk.K, err.Error())
+			return
+		}
+		hooks = append(hooks, &hook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hooks, decodeErr
+}
+
+// DeleteScriptHook removes the hook with the given name and returns it.
+func (s *Service) DeleteScriptHook(name string) (*ScriptHook, error) {
+	hook, err := s.GetScriptHook(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.kvSetter.Delete(&ScriptKey{Name: name}); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
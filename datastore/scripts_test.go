@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestScriptHooks(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "segmentation", dvid.NewConfig()), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	// Hooks need a valid name and event, existing data, and source.
+	source := "def transform(value, request):\n    return value\n"
+	for _, bad := range []*ScriptHook{
+		{Name: "bad name", Dataset: root, Data: "segmentation", Event: ScriptRead, Source: source},
+		{Name: "remap", Dataset: root, Data: "segmentation", Event: "delete", Source: source},
+		{Name: "remap", Dataset: root, Data: "missing", Event: ScriptRead, Source: source},
+		{Name: "remap", Dataset: root, Data: "segmentation", Event: ScriptRead},
+	} {
+		c.Assert(service.PutScriptHook(bad), NotNil)
+	}
+
+	// Hooks are stored with the dataset root.
+	remap := &ScriptHook{Name: "remap", Dataset: child, Data: "segmentation", Event: ScriptRead,
+		Endpoints: []string{"raw", "label"}, Source: source}
+	c.Assert(service.PutScriptHook(remap), IsNil)
+	c.Assert(service.PutScriptHook(&ScriptHook{Name: "clean", Dataset: root, Data: "segmentation",
+		Event: ScriptWrite, Source: source}), IsNil)
+	hook, err := service.GetScriptHook("remap")
+	c.Assert(err, IsNil)
+	c.Assert(hook.Dataset, Equals, root)
+	c.Assert(hook.Applies(ScriptRead, "raw"), Equals, true)
+	c.Assert(hook.Applies(ScriptRead, "info"), Equals, false)
+	c.Assert(hook.Applies(ScriptWrite, "raw"), Equals, false)
+
+	hooks, err := service.ScriptHooks()
+	c.Assert(err, IsNil)
+	c.Assert(hooks, HasLen, 2)
+	c.Assert(hooks[0].Name, Equals, "clean")
+	c.Assert(hooks[1].Applies(ScriptRead, "label"), Equals, true)
+
+	deleted, err := service.DeleteScriptHook("clean")
+	c.Assert(err, IsNil)
+	c.Assert(deleted.Event, Equals, ScriptWrite)
+	_, err = service.GetScriptHook("clean")
+	c.Assert(err, NotNil)
+	_, err = service.DeleteScriptHook("clean")
+	c.Assert(err, NotNil)
+	service.Shutdown()
+}
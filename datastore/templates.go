@@ -0,0 +1,217 @@
+/*
+	This file supports templates of data instances, so projects that share a layout, e.g.,
+	grayscale, segmentation, synapses, and an ROI with the same block sizes, can be set up
+	with one command.  Every dataset can use the DefaultTemplates and can define its own
+	templates, which take precedence over defaults of the same name.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// InstanceTemplate describes one data instance created by a template.
+type InstanceTemplate struct {
+	Name     dvid.DataString
+	TypeName dvid.TypeString
+
+	// Config holds the settings used to create the data, e.g., "Versioned".
+	Config map[string]string `json:",omitempty"`
+}
+
+// Template is a named set of data instances that can be created together.  If BlockSize
+// is set, it's the "BlockSize" setting of every instance that doesn't set its own.
+type Template struct {
+	Name      string
+	BlockSize string `json:",omitempty"`
+	Instances []InstanceTemplate
+}
+
+// DefaultTemplates are available in every dataset that doesn't define a template of the
+// same name.
+var DefaultTemplates = map[string]*Template{
+	"standard": {
+		Name:      "standard",
+		BlockSize: "32,32,32",
+		Instances: []InstanceTemplate{
+			{"grayscale", "grayscale8", map[string]string{"Versioned": "true"}},
+			{"segmentation", "labels64", map[string]string{"Versioned": "true"}},
+			{"synapses", "annotation", map[string]string{"Versioned": "true", "Labels": "segmentation"}},
+			{"roi", "roi", map[string]string{"Versioned": "true"}},
+		},
+	},
+}
+
+// check returns an error if the template has no instances, repeats a data name, or uses
+// a datatype not compiled into this server.
+func (t *Template) check() error {
+	if t.Name == "" {
+		return fmt.Errorf("Templates must have a name")
+	}
+	if len(t.Instances) == 0 {
+		return fmt.Errorf("Template %q has no instances", t.Name)
+	}
+	names := make(map[dvid.DataString]bool, len(t.Instances))
+	for _, instance := range t.Instances {
+		if instance.Name == "" {
+			return fmt.Errorf("Template %q has an instance without a name", t.Name)
+		}
+		if names[instance.Name] {
+			return fmt.Errorf("Template %q has more than one instance named %q", t.Name, instance.Name)
+		}
+		names[instance.Name] = true
+		if _, err := TypeServiceByName(instance.TypeName); err != nil {
+			return fmt.Errorf("Template %q instance %q: %s", t.Name, instance.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// config returns the settings used to create an instance of the template.
+func (t *Template) config(instance InstanceTemplate) dvid.Config {
+	config := dvid.NewConfig()
+	if t.BlockSize != "" {
+		config.Set("BlockSize", t.BlockSize)
+	}
+	for key, value := range instance.Config {
+		config.Set(key, value)
+	}
+	return config
+}
+
+// template returns the dataset's template of the given name, falling back to the
+// DefaultTemplates.
+func (dset *Dataset) template(name string) (*Template, error) {
+	dset.mapLock.Lock()
+	t, found := dset.Templates[name]
+	dset.mapLock.Unlock()
+	if found {
+		return t, nil
+	}
+	if t, found = DefaultTemplates[name]; found {
+		return t, nil
+	}
+	return nil, fmt.Errorf("No template %q in dataset %s", name, dset.Root)
+}
+
+// Templates returns the templates available to the dataset holding the given UUID,
+// sorted by name.
+func (s *Service) Templates(u dvid.UUID) ([]*Template, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Template)
+	for name, t := range DefaultTemplates {
+		byName[name] = t
+	}
+	dataset.mapLock.Lock()
+	for name, t := range dataset.Templates {
+		byName[name] = t
+	}
+	dataset.mapLock.Unlock()
+	templates := make([]*Template, 0, len(byName))
+	for _, t := range byName {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// SetTemplate adds a template to the dataset holding the given UUID, replacing any
+// template of the same name.
+func (s *Service) SetTemplate(u dvid.UUID, t *Template) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	if err := t.check(); err != nil {
+		return err
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	if dataset.Templates == nil {
+		dataset.Templates = make(map[string]*Template)
+	}
+	dataset.Templates[t.Name] = t
+	dataset.mapLock.Unlock()
+	return dataset.Put(s.kvSetter)
+}
+
+// DeleteTemplate removes a template defined by the dataset holding the given UUID.
+// Default templates can't be deleted.
+func (s *Service) DeleteTemplate(u dvid.UUID, name string) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	_, found := dataset.Templates[name]
+	delete(dataset.Templates, name)
+	dataset.mapLock.Unlock()
+	if !found {
+		return fmt.Errorf("Dataset %s defines no template %q", dataset.Root, name)
+	}
+	return dataset.Put(s.kvSetter)
+}
+
+// InitTemplate creates the data instances of a template in the dataset holding the
+// given UUID and returns their names.  No data is created if any instance's name is
+// already used.
+func (s *Service) InitTemplate(u dvid.UUID, name string) ([]dvid.DataString, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	t, err := dataset.template(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	for _, instance := range t.Instances {
+		_, found := dataset.DataMap[instance.Name]
+		if !found {
+			_, found = dataset.Trash[instance.Name]
+		}
+		if !found {
+			_, found = dataset.Aliases[instance.Name]
+		}
+		if found {
+			dataset.mapLock.Unlock()
+			return nil, fmt.Errorf("Data or an alias named '%s' already exists in dataset %s, so template %q can't be used",
+				instance.Name, dataset.Root, name)
+		}
+	}
+	dataset.mapLock.Unlock()
+
+	var created []dvid.DataString
+	for _, instance := range t.Instances {
+		if err = dataset.newData(instance.Name, instance.TypeName, t.config(instance)); err != nil {
+			err = fmt.Errorf("Template %q instance %q: %s", name, instance.Name, err.Error())
+			break
+		}
+		created = append(created, instance.Name)
+	}
+	if putErr := dataset.Put(s.kvSetter); err == nil {
+		err = putErr
+	}
+	return created, err
+}
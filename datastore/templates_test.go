@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestTemplates(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+
+	// Templates need known datatypes and unique instance names.
+	bad := &Template{Name: "bad", Instances: []InstanceTemplate{{Name: "a", TypeName: "unknowntype"}}}
+	c.Assert(service.SetTemplate(root, bad), NotNil)
+	bad.Instances = []InstanceTemplate{{Name: "a", TypeName: "migratetest"}, {Name: "a", TypeName: "migratetest"}}
+	c.Assert(service.SetTemplate(root, bad), NotNil)
+
+	project := &Template{
+		Name:      "project",
+		BlockSize: "64,64,64",
+		Instances: []InstanceTemplate{
+			{Name: "first", TypeName: "migratetest", Config: map[string]string{"Versioned": "true"}},
+			{Name: "second", TypeName: "migratetest"},
+		},
+	}
+	c.Assert(service.SetTemplate(root, project), IsNil)
+	templates, err := service.Templates(root)
+	c.Assert(err, IsNil)
+	c.Assert(templates, HasLen, 2)
+	c.Assert(templates[0].Name, Equals, "project")
+	c.Assert(templates[1].Name, Equals, "standard")
+
+	// Templates are kept across restarts.
+	service.Shutdown()
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+
+	created, err := service.InitTemplate(root, "project")
+	c.Assert(err, IsNil)
+	c.Assert(created, DeepEquals, []dvid.DataString{"first", "second"})
+	dataservice, err := service.DataServiceByUUID(root, "first")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.IsVersioned(), Equals, true)
+
+	// Using a template again would reuse data names, so nothing is created.
+	_, err = service.InitTemplate(root, "project")
+	c.Assert(err, NotNil)
+	_, err = service.InitTemplate(root, "missing")
+	c.Assert(err, NotNil)
+
+	c.Assert(service.DeleteTemplate(root, "project"), IsNil)
+	c.Assert(service.DeleteTemplate(root, "standard"), NotNil)
+}
@@ -0,0 +1,65 @@
+/*
+	This file stores the thumbnails of data instances shown by the dataset gallery of the
+	web console.  They're kept apart from the datasets so generating them adds no data.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// ThumbnailKey is an implementation of storage.Key for a thumbnail of a dataset, e.g.,
+// the PNG of a data instance or the gallery listing them.
+type ThumbnailKey struct {
+	Root dvid.UUID
+	Name string
+}
+
+func (k *ThumbnailKey) KeyType() storage.KeyType {
+	return storage.KeyThumbnail
+}
+
+func (k *ThumbnailKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed ThumbnailKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyThumbnail) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into ThumbnailKey", storage.KeyType(b[0]))
+	}
+	// The root is hexadecimal so the first slash ends it.
+	sep := bytes.IndexByte(b[1:], '/')
+	if sep < 0 {
+		return nil, fmt.Errorf("Malformed ThumbnailKey bytes (no name): %x", b)
+	}
+	return &ThumbnailKey{Root: dvid.UUID(b[1 : 1+sep]), Name: string(b[2+sep:])}, nil
+}
+
+func (k *ThumbnailKey) Bytes() []byte {
+	b := append([]byte{byte(storage.KeyThumbnail)}, k.Root...)
+	b = append(b, '/')
+	return append(b, k.Name...)
+}
+
+func (k *ThumbnailKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *ThumbnailKey) String() string {
+	return fmt.Sprintf("Thumbnail %q of %s", k.Name, k.Root)
+}
+
+// PutThumbnail stores a thumbnail of the dataset with the given root.
+func (s *Service) PutThumbnail(root dvid.UUID, name string, value []byte) error {
+	return s.kvSetter.Put(&ThumbnailKey{root, name}, value)
+}
+
+// GetThumbnail returns a thumbnail of the dataset with the given root or nil if there's
+// none.
+func (s *Service) GetThumbnail(root dvid.UUID, name string) ([]byte, error) {
+	return s.kvGetter.Get(&ThumbnailKey{root, name})
+}
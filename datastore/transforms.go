@@ -0,0 +1,420 @@
+/*
+	This file supports a registry of coordinate transforms between data instances so
+	acquisitions of a dataset that aren't aligned to each other can be related.  Each
+	instance may register a transform from its coordinates to a canonical space shared by
+	the dataset, which is the composition of an optional displacement field, applied first,
+	and an optional affine transform.  Instances without a transform are in canonical
+	space.  Points are mapped between two instances through the canonical space.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Iteration limits for inverting displacement fields.
+const (
+	maxFieldIterations = 50
+	fieldTolerance     = 1e-3
+)
+
+// DisplacementField is a regular grid of displacement vectors, with x varying fastest,
+// sampled by trilinear interpolation.  Points outside the grid use the nearest vectors.
+type DisplacementField struct {
+	// Origin is the coordinate of the first grid point.
+	Origin [3]float64
+
+	// Spacing is the distance between grid points along each axis.
+	Spacing [3]float64
+
+	// Size is the number of grid points along each axis.
+	Size [3]int32
+
+	// Vectors are the displacements at the grid points.
+	Vectors [][3]float64
+}
+
+// Transform maps the coordinates of a data instance to the canonical space of its dataset.
+// A point p maps to Affine * (p + Field(p)).
+type Transform struct {
+	// Affine is a 3x4 matrix in row-major order whose last column is the translation.
+	// Identity is used if it's empty.
+	Affine []float64 `json:",omitempty"`
+
+	// Field is an optional displacement field applied before the affine transform.
+	Field *DisplacementField `json:",omitempty"`
+}
+
+// Box is an axis-aligned box given by its minimum and maximum corners.
+type Box struct {
+	Min [3]float64
+	Max [3]float64
+}
+
+// finite returns an error if any of the values is NaN or infinite.
+func finite(what string, values ...float64) error {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%s must be finite, not %g", what, v)
+		}
+	}
+	return nil
+}
+
+// check returns an error if the field is malformed.
+func (f *DisplacementField) check() error {
+	n := int64(1)
+	for i := 0; i < 3; i++ {
+		if f.Size[i] <= 0 {
+			return fmt.Errorf("Displacement field must have a positive size along each axis")
+		}
+		if f.Spacing[i] <= 0 {
+			return fmt.Errorf("Displacement field must have a positive spacing along each axis")
+		}
+		if n *= int64(f.Size[i]); n > int64(len(f.Vectors)) {
+			break
+		}
+	}
+	if int64(len(f.Vectors)) != n {
+		return fmt.Errorf("Displacement field of size %v doesn't match its %d vectors", f.Size, len(f.Vectors))
+	}
+	if err := finite("Displacement field origin and spacing", append(f.Origin[:], f.Spacing[:]...)...); err != nil {
+		return err
+	}
+	for _, v := range f.Vectors {
+		if err := finite("Displacement vectors", v[:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// At returns the displacement at a point.
+func (f *DisplacementField) At(p [3]float64) [3]float64 {
+	var lo [3]int
+	var frac [3]float64
+	for i := 0; i < 3; i++ {
+		g := (p[i] - f.Origin[i]) / f.Spacing[i]
+		g = math.Max(0, math.Min(g, float64(f.Size[i]-1)))
+		lo[i] = int(math.Floor(g))
+		if lo[i] == int(f.Size[i]-1) && lo[i] > 0 {
+			lo[i]--
+		}
+		frac[i] = g - float64(lo[i])
+	}
+	var d [3]float64
+	for corner := 0; corner < 8; corner++ {
+		weight := 1.0
+		index := 0
+		stride := 1
+		for i := 0; i < 3; i++ {
+			offset := (corner >> uint(i)) & 1
+			if offset == 1 {
+				weight *= frac[i]
+			} else {
+				weight *= 1 - frac[i]
+			}
+			g := lo[i] + offset
+			if g >= int(f.Size[i]) {
+				g = int(f.Size[i]) - 1
+			}
+			index += g * stride
+			stride *= int(f.Size[i])
+		}
+		if weight == 0 {
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			d[i] += weight * f.Vectors[index][i]
+		}
+	}
+	return d
+}
+
+// affine returns the 3x4 affine matrix of the transform, which is identity if unset.
+func (t *Transform) affine() []float64 {
+	if t == nil || len(t.Affine) == 0 {
+		return []float64{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0}
+	}
+	return t.Affine
+}
+
+// inverseAffine returns the 3x4 inverse of the transform's affine matrix.
+func (t *Transform) inverseAffine() ([]float64, error) {
+	a := t.affine()
+	det := a[0]*(a[5]*a[10]-a[6]*a[9]) - a[1]*(a[4]*a[10]-a[6]*a[8]) + a[2]*(a[4]*a[9]-a[5]*a[8])
+	if math.Abs(det) < 1e-12 {
+		return nil, fmt.Errorf("Affine transform is not invertible")
+	}
+	inv := make([]float64, 12)
+	inv[0] = (a[5]*a[10] - a[6]*a[9]) / det
+	inv[1] = (a[2]*a[9] - a[1]*a[10]) / det
+	inv[2] = (a[1]*a[6] - a[2]*a[5]) / det
+	inv[4] = (a[6]*a[8] - a[4]*a[10]) / det
+	inv[5] = (a[0]*a[10] - a[2]*a[8]) / det
+	inv[6] = (a[2]*a[4] - a[0]*a[6]) / det
+	inv[8] = (a[4]*a[9] - a[5]*a[8]) / det
+	inv[9] = (a[1]*a[8] - a[0]*a[9]) / det
+	inv[10] = (a[0]*a[5] - a[1]*a[4]) / det
+	for row := 0; row < 3; row++ {
+		r := inv[4*row : 4*row+3]
+		inv[4*row+3] = -(r[0]*a[3] + r[1]*a[7] + r[2]*a[11])
+	}
+	return inv, nil
+}
+
+// applyAffine multiplies a point by a 3x4 affine matrix.
+func applyAffine(a []float64, p [3]float64) [3]float64 {
+	var q [3]float64
+	for row := 0; row < 3; row++ {
+		q[row] = a[4*row]*p[0] + a[4*row+1]*p[1] + a[4*row+2]*p[2] + a[4*row+3]
+	}
+	return q
+}
+
+// check returns an error if the transform is malformed or not invertible.
+func (t *Transform) check() error {
+	if len(t.Affine) != 0 && len(t.Affine) != 12 {
+		return fmt.Errorf("Affine transform must have 12 values, a 3x4 matrix in row-major order")
+	}
+	if err := finite("Affine transform values", t.Affine...); err != nil {
+		return err
+	}
+	if _, err := t.inverseAffine(); err != nil {
+		return err
+	}
+	if t.Field != nil {
+		return t.Field.check()
+	}
+	return nil
+}
+
+// ToCanonical maps a point of the instance to canonical space.
+func (t *Transform) ToCanonical(p [3]float64) [3]float64 {
+	if t == nil {
+		return p
+	}
+	if t.Field != nil {
+		d := t.Field.At(p)
+		p = [3]float64{p[0] + d[0], p[1] + d[1], p[2] + d[2]}
+	}
+	return applyAffine(t.affine(), p)
+}
+
+// FromCanonical maps a point of canonical space to the instance.  Displacement fields
+// are inverted by fixed-point iteration, which fails if the field isn't smooth enough.
+func (t *Transform) FromCanonical(c [3]float64) ([3]float64, error) {
+	if t == nil {
+		return c, nil
+	}
+	inv, err := t.inverseAffine()
+	if err != nil {
+		return c, err
+	}
+	q := applyAffine(inv, c)
+	if t.Field == nil {
+		return q, nil
+	}
+	p := q
+	for i := 0; i < maxFieldIterations; i++ {
+		d := t.Field.At(p)
+		next := [3]float64{q[0] - d[0], q[1] - d[1], q[2] - d[2]}
+		delta := math.Max(math.Abs(next[0]-p[0]), math.Max(math.Abs(next[1]-p[1]), math.Abs(next[2]-p[2])))
+		p = next
+		if delta < fieldTolerance {
+			return p, nil
+		}
+	}
+	return p, fmt.Errorf("Unable to invert displacement field at %v", c)
+}
+
+// transformName returns the name of data, resolving any alias, if it's in the dataset.
+// Like DataService, data names take precedence over aliases.  The dataset's mapLock
+// must be held.
+func (dset *Dataset) transformName(name dvid.DataString) (dvid.DataString, error) {
+	if _, found := dset.DataMap[name]; found {
+		return name, nil
+	}
+	if target, isAlias := dset.Aliases[name]; isAlias {
+		name = target
+	}
+	if _, found := dset.DataMap[name]; !found {
+		return "", fmt.Errorf("Data '%s' not found in dataset %s", name, dset.Root)
+	}
+	return name, nil
+}
+
+// Transforms returns the transforms registered for data in the dataset holding the given
+// UUID, keyed by data name.
+func (s *Service) Transforms(u dvid.UUID) (map[dvid.DataString]*Transform, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	transforms := make(map[dvid.DataString]*Transform, len(dataset.Transforms))
+	for name, t := range dataset.Transforms {
+		transforms[name] = t
+	}
+	return transforms, nil
+}
+
+// Transform returns the transform of data, resolving any alias, in the dataset holding
+// the given UUID.  If the data has no transform, found is false.
+func (s *Service) Transform(u dvid.UUID, name dvid.DataString) (t *Transform, found bool, err error) {
+	if s.Datasets == nil {
+		return nil, false, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, false, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	if name, err = dataset.transformName(name); err != nil {
+		return nil, false, err
+	}
+	t, found = dataset.Transforms[name]
+	return t, found, nil
+}
+
+// SetTransform registers the transform of data to the canonical space of the dataset
+// holding the given UUID, replacing any previous transform.
+func (s *Service) SetTransform(u dvid.UUID, name dvid.DataString, t *Transform) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return err
+	}
+	if err := t.check(); err != nil {
+		return fmt.Errorf("Bad transform for data '%s': %s", name, err.Error())
+	}
+	dataset.mapLock.Lock()
+	name, err = dataset.transformName(name)
+	if err == nil {
+		if dataset.Transforms == nil {
+			dataset.Transforms = make(map[dvid.DataString]*Transform)
+		}
+		dataset.Transforms[name] = t
+	}
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return dataset.Put(s.kvSetter)
+}
+
+// DeleteTransform removes the transform of data in the dataset holding the given UUID,
+// returning it to canonical space.
+func (s *Service) DeleteTransform(u dvid.UUID, name dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	if _, isData := dataset.DataMap[name]; !isData {
+		if target, isAlias := dataset.Aliases[name]; isAlias {
+			name = target
+		}
+	}
+	_, found := dataset.Transforms[name]
+	delete(dataset.Transforms, name)
+	dataset.mapLock.Unlock()
+	if !found {
+		return fmt.Errorf("No transform for data '%s' in dataset %s", name, dataset.Root)
+	}
+	return dataset.Put(s.kvSetter)
+}
+
+// transformPair returns the transforms of two data in the dataset holding the given UUID.
+func (s *Service) transformPair(u dvid.UUID, from, to dvid.DataString) (tFrom, tTo *Transform, err error) {
+	if s.Datasets == nil {
+		return nil, nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	if from, err = dataset.transformName(from); err != nil {
+		return nil, nil, err
+	}
+	if to, err = dataset.transformName(to); err != nil {
+		return nil, nil, err
+	}
+	return dataset.Transforms[from], dataset.Transforms[to], nil
+}
+
+// MapPoints maps points from the coordinates of one data instance to another's.
+func (s *Service) MapPoints(u dvid.UUID, from, to dvid.DataString, points [][3]float64) ([][3]float64, error) {
+	tFrom, tTo, err := s.transformPair(u, from, to)
+	if err != nil {
+		return nil, err
+	}
+	mapped := make([][3]float64, len(points))
+	for i, p := range points {
+		if mapped[i], err = tTo.FromCanonical(tFrom.ToCanonical(p)); err != nil {
+			return nil, err
+		}
+		if err := finite(fmt.Sprintf("Mapped point %v", p), mapped[i][:]...); err != nil {
+			return nil, err
+		}
+	}
+	return mapped, nil
+}
+
+// MapBoxes maps boxes from the coordinates of one data instance to another's.  Each box
+// maps to the bounding box of its mapped corners, which may hold points outside the
+// mapped box if the transforms are non-linear.
+func (s *Service) MapBoxes(u dvid.UUID, from, to dvid.DataString, boxes []Box) ([]Box, error) {
+	corners := make([][3]float64, 0, 8*len(boxes))
+	for _, box := range boxes {
+		for corner := 0; corner < 8; corner++ {
+			var p [3]float64
+			for i := 0; i < 3; i++ {
+				if (corner>>uint(i))&1 == 0 {
+					p[i] = box.Min[i]
+				} else {
+					p[i] = box.Max[i]
+				}
+			}
+			corners = append(corners, p)
+		}
+	}
+	mapped, err := s.MapPoints(u, from, to, corners)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Box, len(boxes))
+	for b := range boxes {
+		box := Box{Min: mapped[8*b], Max: mapped[8*b]}
+		for _, p := range mapped[8*b+1 : 8*b+8] {
+			for i := 0; i < 3; i++ {
+				box.Min[i] = math.Min(box.Min[i], p[i])
+				box.Max[i] = math.Max(box.Max[i], p[i])
+			}
+		}
+		result[b] = box
+	}
+	return result, nil
+}
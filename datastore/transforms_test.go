@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"math"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func closeTo(c *C, got, expected [3]float64) {
+	for i := 0; i < 3; i++ {
+		if math.Abs(got[i]-expected[i]) > 0.01 {
+			c.Fatalf("Expected point %v, got %v", expected, got)
+		}
+	}
+}
+
+func (s *DataSuite) TestTransforms(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "aligned", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "migratetest", "raw", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "migratetest", "warped", dvid.NewConfig()), IsNil)
+
+	// Transforms must be for existing data and invertible.
+	scale := &Transform{Affine: []float64{2, 0, 0, 10, 0, 2, 0, 20, 0, 0, 2, 30}}
+	c.Assert(service.SetTransform(root, "missing", scale), NotNil)
+	c.Assert(service.SetTransform(root, "raw", &Transform{Affine: make([]float64, 12)}), NotNil)
+	c.Assert(service.SetTransform(root, "raw", &Transform{Affine: []float64{1, 0, 0}}), NotNil)
+	c.Assert(service.SetTransform(root, "raw", &Transform{Affine: []float64{math.NaN(), 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0}}), NotNil)
+	c.Assert(service.SetTransform(root, "raw", &Transform{Affine: []float64{1, 0, 0, math.Inf(1), 0, 1, 0, 0, 0, 0, 1, 0}}), NotNil)
+	c.Assert(service.SetTransform(root, "raw", scale), IsNil)
+
+	// Transforms are found through aliases.
+	_, err = service.SetAlias(root, "rawalias", "raw")
+	c.Assert(err, IsNil)
+	t, found, err := service.Transform(root, "rawalias")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(t.Affine, DeepEquals, scale.Affine)
+	_, found, err = service.Transform(root, "aligned")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	// Points mapping beyond float64 are refused.
+	_, err = service.MapPoints(root, "raw", "aligned", [][3]float64{{math.MaxFloat64, 0, 0}})
+	c.Assert(err, NotNil)
+
+	// Data without a transform is in canonical space.
+	points, err := service.MapPoints(root, "raw", "aligned", [][3]float64{{0, 0, 0}, {1, 2, 3}})
+	c.Assert(err, IsNil)
+	closeTo(c, points[0], [3]float64{10, 20, 30})
+	closeTo(c, points[1], [3]float64{12, 24, 36})
+	points, err = service.MapPoints(root, "aligned", "raw", [][3]float64{{12, 24, 36}})
+	c.Assert(err, IsNil)
+	closeTo(c, points[0], [3]float64{1, 2, 3})
+
+	boxes, err := service.MapBoxes(root, "raw", "aligned", []Box{{Min: [3]float64{0, 0, 0}, Max: [3]float64{1, 1, 1}}})
+	c.Assert(err, IsNil)
+	closeTo(c, boxes[0].Min, [3]float64{10, 20, 30})
+	closeTo(c, boxes[0].Max, [3]float64{12, 22, 32})
+
+	// A displacement field is applied before the affine transform and inverted on the way back.
+	field := &DisplacementField{
+		Spacing: [3]float64{10, 10, 10},
+		Size:    [3]int32{2, 1, 1},
+		Vectors: [][3]float64{{0, 0, 0}, {2, 0, 0}},
+	}
+	c.Assert(service.SetTransform(root, "warped", &Transform{Field: &DisplacementField{Size: [3]int32{2, 1, 1}}}), NotNil)
+	badField := &DisplacementField{Spacing: field.Spacing, Size: field.Size, Vectors: [][3]float64{{0, 0, 0}, {math.Inf(-1), 0, 0}}}
+	c.Assert(service.SetTransform(root, "warped", &Transform{Field: badField}), NotNil)
+	hugeField := &DisplacementField{Spacing: field.Spacing, Size: [3]int32{1 << 30, 1 << 30, 1 << 30}}
+	c.Assert(service.SetTransform(root, "warped", &Transform{Field: hugeField}), NotNil)
+	c.Assert(service.SetTransform(root, "warped", &Transform{Field: field}), IsNil)
+	points, err = service.MapPoints(root, "warped", "aligned", [][3]float64{{5, 0, 0}})
+	c.Assert(err, IsNil)
+	closeTo(c, points[0], [3]float64{6, 0, 0})
+	points, err = service.MapPoints(root, "raw", "warped", [][3]float64{{-2, -10, -15}})
+	c.Assert(err, IsNil)
+	closeTo(c, points[0], [3]float64{5, 0, 0})
+
+	// Transforms are kept across restarts.
+	service.Shutdown()
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+
+	transforms, err := service.Transforms(root)
+	c.Assert(err, IsNil)
+	c.Assert(transforms, HasLen, 2)
+	c.Assert(transforms["raw"].Affine, DeepEquals, scale.Affine)
+	c.Assert(transforms["warped"].Field.Vectors, DeepEquals, field.Vectors)
+
+	// Transforms are trashed and restored with their data.
+	c.Assert(service.DeleteData(root, "warped"), IsNil)
+	transforms, err = service.Transforms(root)
+	c.Assert(err, IsNil)
+	c.Assert(transforms, HasLen, 1)
+	c.Assert(service.RestoreData(root, "warped"), IsNil)
+	transforms, err = service.Transforms(root)
+	c.Assert(err, IsNil)
+	c.Assert(transforms["warped"].Field.Vectors, DeepEquals, field.Vectors)
+
+	c.Assert(service.DeleteTransform(root, "raw"), IsNil)
+	c.Assert(service.DeleteTransform(root, "raw"), NotNil)
+	points, err = service.MapPoints(root, "raw", "aligned", [][3]float64{{1, 2, 3}})
+	c.Assert(err, IsNil)
+	closeTo(c, points[0], [3]float64{1, 2, 3})
+}
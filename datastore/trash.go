@@ -0,0 +1,169 @@
+/*
+	This file supports soft deletion of data instances.  Deleted data is moved to its
+	dataset's trash, where it's hidden from listings but keeps its keys, so it can be
+	restored until it's purged, either explicitly or once it's been in the trash longer
+	than the server's retention period.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TrashedData is deleted data that can be restored until it's purged.
+type TrashedData struct {
+	Data    DataService
+	Deleted time.Time
+
+	// Transform is the data's registered transform, if any, which is restored with it.
+	Transform *Transform
+}
+
+// TrashEntry describes trashed data for listings.
+type TrashEntry struct {
+	Name     dvid.DataString
+	TypeName dvid.TypeString
+	Deleted  time.Time
+}
+
+// DeleteData moves data from the dataset holding the given UUID to the dataset's trash.
+func (s *Service) DeleteData(u dvid.UUID, name dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	dataservice, found := dataset.DataMap[name]
+	if found {
+		delete(dataset.DataMap, name)
+		if dataset.Trash == nil {
+			dataset.Trash = make(map[dvid.DataString]*TrashedData)
+		}
+		dataset.Trash[name] = &TrashedData{Data: dataservice, Deleted: time.Now(),
+			Transform: dataset.Transforms[name]}
+		delete(dataset.Transforms, name)
+	}
+	dataset.mapLock.Unlock()
+	if !found {
+		return fmt.Errorf("Data '%s' not found in dataset %s", name, dataset.Root)
+	}
+	return dataset.Put(s.kvSetter)
+}
+
+// RestoreData moves data from the trash of the dataset holding the given UUID back
+// into the dataset.
+func (s *Service) RestoreData(u dvid.UUID, name dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err := dataset.checkUnpublished(); err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	if target, isAlias := dataset.Aliases[name]; isAlias {
+		dataset.mapLock.Unlock()
+		return fmt.Errorf("'%s' is now an alias of data '%s' in dataset %s; delete the alias first",
+			name, target, dataset.Root)
+	}
+	trashed, found := dataset.Trash[name]
+	if found {
+		delete(dataset.Trash, name)
+		if dataset.DataMap == nil {
+			dataset.DataMap = make(map[dvid.DataString]DataService)
+		}
+		dataset.DataMap[name] = trashed.Data
+		if trashed.Transform != nil {
+			if dataset.Transforms == nil {
+				dataset.Transforms = make(map[dvid.DataString]*Transform)
+			}
+			dataset.Transforms[name] = trashed.Transform
+		}
+	}
+	dataset.mapLock.Unlock()
+	if !found {
+		return fmt.Errorf("Data '%s' not found in trash of dataset %s", name, dataset.Root)
+	}
+	return dataset.Put(s.kvSetter)
+}
+
+// PurgeData permanently deletes data in the trash of the dataset holding the given UUID,
+// including all its keys across versions.
+func (s *Service) PurgeData(u dvid.UUID, name dvid.DataString) (*DeletedData, error) {
+	return s.purgeData(u, name, true)
+}
+
+// Trash lists the trashed data of the dataset holding the given UUID, oldest first.
+func (s *Service) Trash(u dvid.UUID) ([]TrashEntry, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataset.mapLock.Lock()
+	entries := make([]TrashEntry, 0, len(dataset.Trash))
+	for name, trashed := range dataset.Trash {
+		entries = append(entries, TrashEntry{name, trashed.Data.DatatypeName(), trashed.Deleted})
+	}
+	dataset.mapLock.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Deleted.Equal(entries[j].Deleted) {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// PurgeExpiredTrash permanently deletes all data trashed before a time and returns what
+// was deleted.  Deletion continues past errors, and the first error is returned.
+func (s *Service) PurgeExpiredTrash(before time.Time) ([]*DeletedData, error) {
+	if s.Datasets == nil {
+		return nil, nil
+	}
+	type expired struct {
+		root dvid.UUID
+		name dvid.DataString
+	}
+	var expiredData []expired
+	s.Datasets.writeLock.Lock()
+	for _, dataset := range s.Datasets.list {
+		dataset.mapLock.Lock()
+		for name, trashed := range dataset.Trash {
+			if trashed.Deleted.Before(before) {
+				expiredData = append(expiredData, expired{dataset.Root, name})
+			}
+		}
+		dataset.mapLock.Unlock()
+	}
+	s.Datasets.writeLock.Unlock()
+
+	var deleted []*DeletedData
+	var firstErr error
+	for _, e := range expiredData {
+		d, err := s.purgeData(e.root, e.name, true)
+		if d != nil {
+			deleted = append(deleted, d)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return deleted, firstErr
+}
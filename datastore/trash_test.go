@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestTrash(c *C) {
+	service, root, trashed, done := newTestData(c, "trashed", dvid.NewConfig())
+	defer done()
+	putTestKeys(c, service, root, trashed, 0, 8, []byte("trashed"))
+
+	// Deleted data is hidden but keeps its keys.
+	c.Assert(service.DeleteData(root, "trashed"), IsNil)
+	_, err := service.DataServiceByUUID(root, "trashed")
+	c.Assert(err, NotNil)
+	jsonStr, err := service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, "trashed"), Equals, false)
+	c.Assert(countTestKeys(c, service, trashed), Equals, 8)
+	entries, err := service.Trash(root)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Name, Equals, dvid.DataString("trashed"))
+	c.Assert(entries[0].TypeName, Equals, dvid.TypeString("migratetest"))
+	c.Assert(service.NewData(root, "migratetest", "trashed", dvid.NewConfig()), NotNil)
+
+	// Restored data is available again.
+	c.Assert(service.RestoreData(root, "trashed"), IsNil)
+	_, err = service.DataServiceByUUID(root, "trashed")
+	c.Assert(err, IsNil)
+	c.Assert(service.RestoreData(root, "trashed"), NotNil)
+	_, err = service.PurgeData(root, "trashed")
+	c.Assert(err, NotNil)
+
+	// Trash is only purged once it's past the retention.
+	c.Assert(service.DeleteData(root, "trashed"), IsNil)
+	deleted, err := service.PurgeExpiredTrash(time.Now().Add(-time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 0)
+	deleted, err = service.PurgeExpiredTrash(time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, HasLen, 1)
+	c.Assert(deleted[0].Keys, Equals, int64(8))
+	c.Assert(countTestKeys(c, service, trashed), Equals, 0)
+	entries, err = service.Trash(root)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	c.Assert(service.RestoreData(root, "trashed"), NotNil)
+}
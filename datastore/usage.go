@@ -0,0 +1,77 @@
+/*
+	This file stores the read counts of data instances, which the server tracks in memory
+	and saves periodically so access statistics survive restarts.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// UsageKey is an implementation of storage.Key for the read counts of a data instance.
+// Reads of all versions are counted together under the root of the dataset.
+type UsageKey struct {
+	Root dvid.UUID
+	Name dvid.DataString
+}
+
+func (k *UsageKey) KeyType() storage.KeyType {
+	return storage.KeyUsage
+}
+
+func (k *UsageKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed UsageKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyUsage) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into UsageKey", storage.KeyType(b[0]))
+	}
+	// The root is hexadecimal so the first slash ends it.
+	sep := bytes.IndexByte(b[1:], '/')
+	if sep < 0 {
+		return nil, fmt.Errorf("Malformed UsageKey bytes (no data name): %x", b)
+	}
+	return &UsageKey{Root: dvid.UUID(b[1 : 1+sep]), Name: dvid.DataString(b[2+sep:])}, nil
+}
+
+func (k *UsageKey) Bytes() []byte {
+	b := append([]byte{byte(storage.KeyUsage)}, k.Root...)
+	b = append(b, '/')
+	return append(b, k.Name...)
+}
+
+func (k *UsageKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *UsageKey) String() string {
+	return fmt.Sprintf("Usage of %s in %s", k.Name, k.Root)
+}
+
+// PutUsage stores the encoded read counts of a data instance.
+func (s *Service) PutUsage(root dvid.UUID, name dvid.DataString, value []byte) error {
+	return s.kvSetter.Put(&UsageKey{root, name}, value)
+}
+
+// DeleteUsage removes the stored read counts of a data instance.
+func (s *Service) DeleteUsage(root dvid.UUID, name dvid.DataString) error {
+	return s.kvSetter.Delete(&UsageKey{root, name})
+}
+
+// ProcessUsage calls f with the encoded read counts of each data instance.
+func (s *Service) ProcessUsage(f func(root dvid.UUID, name dvid.DataString, value []byte)) error {
+	begKey := &UsageKey{}
+	endKey := &UsageKey{Root: "\xff"}
+	return s.kvGetter.ProcessRange(begKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		key, ok := chunk.K.(*UsageKey)
+		if !ok {
+			return
+		}
+		f(key.Root, key.Name, chunk.V)
+	})
+}
@@ -0,0 +1,446 @@
+/*
+	This file maintains an index of data keys by the version that wrote them.  Data keys
+	end with their version so the versions of an index are adjacent, which means the keys
+	written in one version are spread over the whole key space of their data.  Each write
+	of a data key also writes an empty index key starting with the dataset and version,
+	so the keys of a version, e.g., for a replication delta or deleting a version, can be
+	found with one range query, and range queries of one version of data read only the
+	keys of that version.  Nodes created before the index have KeysIndexed false until
+	their keys are indexed in the background after the datastore is opened.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// dataKeyPrefixSize is the size of the key type and dataset and data IDs that start the
+// bytes of a DataKey.
+const dataKeyPrefixSize = 1 + dvid.LocalID32Size + dvid.LocalIDSize
+
+// VersionIndexKey indexes a data key by its version.  Its bytes are the key type, the
+// dataset, the version, the data, and the index of the data key.
+type VersionIndexKey struct {
+	b []byte
+}
+
+// NewVersionIndexKey returns the key of the version index for a data key's bytes, or nil
+// if the bytes aren't a data key.
+func NewVersionIndexKey(dataKey []byte) *VersionIndexKey {
+	if len(dataKey) < dataKeyPrefixSize+dvid.LocalIDSize || dataKey[0] != byte(storage.KeyData) {
+		return nil
+	}
+	versionStart := len(dataKey) - dvid.LocalIDSize
+	b := make([]byte, 0, len(dataKey))
+	b = append(b, byte(storage.KeyVersionIndex))
+	b = append(b, dataKey[1:1+dvid.LocalID32Size]...)
+	b = append(b, dataKey[versionStart:]...)
+	b = append(b, dataKey[1+dvid.LocalID32Size:versionStart]...)
+	return &VersionIndexKey{b}
+}
+
+// versionIndexRange returns the keys spanning the version index of a version.
+func versionIndexRange(dataset dvid.DatasetLocalID, version dvid.VersionLocalID) (beg, end *VersionIndexKey) {
+	prefix := append([]byte{byte(storage.KeyVersionIndex)}, dvid.LocalID32(dataset).Bytes()...)
+	beg = &VersionIndexKey{append(append([]byte{}, prefix...), dvid.LocalID(version).Bytes()...)}
+	if version+1 == 0 {
+		end = &VersionIndexKey{append([]byte{byte(storage.KeyVersionIndex)}, dvid.LocalID32(dataset+1).Bytes()...)}
+	} else {
+		end = &VersionIndexKey{append(append([]byte{}, prefix...), dvid.LocalID(version+1).Bytes()...)}
+	}
+	return
+}
+
+// DataKey returns the bytes of the indexed data key.
+func (key *VersionIndexKey) DataKey() []byte {
+	versionStart := 1 + dvid.LocalID32Size
+	dataStart := versionStart + dvid.LocalIDSize
+	b := make([]byte, 0, len(key.b))
+	b = append(b, byte(storage.KeyData))
+	b = append(b, key.b[1:versionStart]...)
+	b = append(b, key.b[dataStart:]...)
+	b = append(b, key.b[versionStart:dataStart]...)
+	return b
+}
+
+// ------ Key Interface ----------
+
+func (key *VersionIndexKey) KeyType() storage.KeyType {
+	return storage.KeyVersionIndex
+}
+
+// BytesToKey returns a VersionIndexKey given a slice of bytes
+func (key *VersionIndexKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < dataKeyPrefixSize+dvid.LocalIDSize || b[0] != byte(storage.KeyVersionIndex) {
+		return nil, fmt.Errorf("Malformed VersionIndexKey bytes: %x", b)
+	}
+	return &VersionIndexKey{append([]byte{}, b...)}, nil
+}
+
+// Bytes returns the bytes of the key.
+func (key *VersionIndexKey) Bytes() []byte {
+	return key.b
+}
+
+// BytesString returns the bytes of the key as a string.
+func (key *VersionIndexKey) BytesString() string {
+	return string(key.b)
+}
+
+// String returns a hexadecimal representation of the bytes encoding a key.
+func (key *VersionIndexKey) String() string {
+	return fmt.Sprintf("%x", key.b)
+}
+
+// indexingDB is a key/value database that maintains the version index as data keys are
+// written and deleted.  Each write and its index key are committed in one batch.  Range
+// queries of one indexed version of data, which would otherwise scan the keys of every
+// version, read the keys of the version from the index.
+type indexingDB struct {
+	storage.OrderedKeyValueDB
+	batcher  storage.Batcher
+	datasets *Datasets // gives the indexed versions, or nil if ranges are always scanned
+}
+
+// newIndexingDB returns a database that maintains the version index of a database
+// supporting batches.  Range queries use the index for versions of the datasets that
+// are indexed.
+func newIndexingDB(db storage.OrderedKeyValueDB, datasets *Datasets) (*indexingDB, error) {
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return nil, fmt.Errorf("DVID key-value store does not support batch write")
+	}
+	return &indexingDB{db, batcher, datasets}, nil
+}
+
+// versionRange returns the range of the version index holding the keys of a range query
+// if the query is of one indexed version of data, i.e., one filtered by DataKey.InRange.
+func (db *indexingDB) versionRange(kStart, kEnd storage.Key) (start *DataKey, beg, end *VersionIndexKey, ok bool) {
+	if db.datasets == nil {
+		return nil, nil, nil, false
+	}
+	first, startBytes := storage.RangeStart(kStart)
+	start, startOK := first.(*DataKey)
+	last, endOK := kEnd.(*DataKey)
+	if !startOK || !endOK || start.Dataset != last.Dataset || start.Data != last.Data ||
+		start.Version != last.Version || !db.datasets.versionIndexed(start.Dataset, start.Version) {
+		return nil, nil, nil, false
+	}
+	beg, end = NewVersionIndexKey(startBytes), NewVersionIndexKey(last.Bytes())
+	return start, beg, end, beg != nil && end != nil
+}
+
+// processIndexed calls f with the key-value pairs of the data keys in a range of the
+// version index, in order.  Values are read between batches of index keys since some
+// databases don't allow reads within an iteration, and index keys without data keys,
+// which can be left by indexing old versions while their keys are deleted, are skipped.
+func (db *indexingDB) processIndexed(op *storage.ChunkOp, start *DataKey, beg, end *VersionIndexKey,
+	f func(storage.KeyValue)) error {
+
+	ctx := context.Background()
+	if op != nil && op.Ctx != nil {
+		ctx = op.Ctx
+	}
+	return storage.ProcessKeyBatches(ctx, db.OrderedKeyValueDB, beg, end, storage.RangeBatchSize,
+		func(keys []storage.Key) error {
+			for _, key := range keys {
+				if err := op.Err(); err != nil {
+					return err
+				}
+				indexKey, ok := key.(*VersionIndexKey)
+				if !ok {
+					return fmt.Errorf("Bad version index key %s", key)
+				}
+				dataKey, err := start.BytesToKey(indexKey.DataKey())
+				if err != nil {
+					return err
+				}
+				value, err := db.OrderedKeyValueDB.Get(dataKey)
+				if err != nil {
+					return err
+				}
+				if value != nil {
+					f(storage.KeyValue{dataKey, value})
+				}
+			}
+			return nil
+		})
+}
+
+// GetRange returns the key-value pairs of a range.
+func (db *indexingDB) GetRange(kStart, kEnd storage.Key) ([]storage.KeyValue, error) {
+	start, beg, end, ok := db.versionRange(kStart, kEnd)
+	if !ok {
+		return db.OrderedKeyValueDB.GetRange(kStart, kEnd)
+	}
+	values := []storage.KeyValue{}
+	err := db.processIndexed(nil, start, beg, end, func(kv storage.KeyValue) {
+		values = append(values, kv)
+	})
+	return values, err
+}
+
+// KeysInRange returns the keys of a range.
+func (db *indexingDB) KeysInRange(kStart, kEnd storage.Key) ([]storage.Key, error) {
+	start, beg, end, ok := db.versionRange(kStart, kEnd)
+	if !ok {
+		return db.OrderedKeyValueDB.KeysInRange(kStart, kEnd)
+	}
+	keys := []storage.Key{}
+	err := db.processIndexed(nil, start, beg, end, func(kv storage.KeyValue) {
+		keys = append(keys, kv.K)
+	})
+	return keys, err
+}
+
+// ProcessRange sends the key-value pairs of a range to f.
+func (db *indexingDB) ProcessRange(kStart, kEnd storage.Key, op *storage.ChunkOp, f func(*storage.Chunk)) error {
+	start, beg, end, ok := db.versionRange(kStart, kEnd)
+	if !ok {
+		return db.OrderedKeyValueDB.ProcessRange(kStart, kEnd, op, f)
+	}
+	return db.processIndexed(op, start, beg, end, func(kv storage.KeyValue) {
+		if op != nil && op.Wg != nil {
+			op.Wg.Add(1)
+		}
+		f(&storage.Chunk{op, kv})
+	})
+}
+
+// Put writes a value with given key.
+func (db *indexingDB) Put(k storage.Key, v []byte) error {
+	if k.KeyType() != storage.KeyData {
+		return db.OrderedKeyValueDB.Put(k, v)
+	}
+	batch := db.NewBatch()
+	batch.Put(k, v)
+	return batch.Commit()
+}
+
+// Delete removes an entry given key.
+func (db *indexingDB) Delete(k storage.Key) error {
+	if k.KeyType() != storage.KeyData {
+		return db.OrderedKeyValueDB.Delete(k)
+	}
+	batch := db.NewBatch()
+	batch.Delete(k)
+	return batch.Commit()
+}
+
+// PutRange writes key-value pairs in one batch.
+func (db *indexingDB) PutRange(values []storage.KeyValue) error {
+	batch := db.NewBatch()
+	for _, kv := range values {
+		batch.Put(kv.K, kv.V)
+	}
+	return batch.Commit()
+}
+
+// ProcessKeys sends the keys of a range to f without reading values if the wrapped
+// database supports it.  Keys of one indexed version of data are read from the index.
+func (db *indexingDB) ProcessKeys(kStart, kEnd storage.Key, op *storage.ChunkOp, f func(storage.Key)) error {
+	start, beg, end, ok := db.versionRange(kStart, kEnd)
+	if !ok {
+		return storage.ProcessKeys(db.OrderedKeyValueDB, kStart, kEnd, op, f)
+	}
+	return db.processIndexed(op, start, beg, end, func(kv storage.KeyValue) {
+		f(kv.K)
+	})
+}
+
+// NewBatch returns a batch that also writes the version index.
+func (db *indexingDB) NewBatch() storage.Batch {
+	return &indexingBatch{db.batcher.NewBatch()}
+}
+
+type indexingBatch struct {
+	storage.Batch
+}
+
+func (batch *indexingBatch) Put(k storage.Key, v []byte) {
+	batch.Batch.Put(k, v)
+	if k.KeyType() == storage.KeyData {
+		if indexKey := NewVersionIndexKey(k.Bytes()); indexKey != nil {
+			batch.Batch.Put(indexKey, dvid.EmptyValue())
+		}
+	}
+}
+
+func (batch *indexingBatch) Delete(k storage.Key) {
+	batch.Batch.Delete(k)
+	if k.KeyType() == storage.KeyData {
+		if indexKey := NewVersionIndexKey(k.Bytes()); indexKey != nil {
+			batch.Batch.Delete(indexKey)
+		}
+	}
+}
+
+// versionHasKeys returns true if the version index has any key of data written at a
+// version.
+func (s *Service) versionHasKeys(dataset dvid.DatasetLocalID, version dvid.VersionLocalID,
+	data dvid.DataLocalID) (bool, error) {
+
+	versionBeg, versionEnd := versionIndexRange(dataset, version)
+	beg := &VersionIndexKey{append(append([]byte{}, versionBeg.b...), dvid.LocalID(data).Bytes()...)}
+	end := versionEnd
+	if data+1 != 0 {
+		end = &VersionIndexKey{append(append([]byte{}, versionBeg.b...), dvid.LocalID(data+1).Bytes()...)}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found bool
+	err := storage.ProcessKeys(s.kvGetter, beg, end, &storage.ChunkOp{Ctx: ctx}, func(storage.Key) {
+		found = true
+		cancel()
+	})
+	if found {
+		return true, nil
+	}
+	return false, err
+}
+
+// processVersionKeys calls f with the bytes of each data key written at a version, as
+// given by the version index.  Keys are read in batches so f can write or delete.
+func (s *Service) processVersionKeys(ctx context.Context, dataset dvid.DatasetLocalID,
+	version dvid.VersionLocalID, f func(dataKey []byte) error) error {
+
+	beg, end := versionIndexRange(dataset, version)
+	return storage.ProcessRangeBatches(ctx, s.kvGetter, beg, end, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			indexKey, ok := kv.K.(*VersionIndexKey)
+			if !ok {
+				return fmt.Errorf("Bad version index key %s", kv.K)
+			}
+			return f(indexKey.DataKey())
+		})
+}
+
+// deleteVersionKeys deletes the data keys written at a version, as given by the version
+// index, in batches of at most storage.RangeBatchSize keys.  It returns the number of
+// keys and the bytes of keys deleted.
+func (s *Service) deleteVersionKeys(ctx context.Context, dataset dvid.DatasetLocalID,
+	version dvid.VersionLocalID) (int64, int64, error) {
+
+	var numKeys, numBytes int64
+	beg, end := versionIndexRange(dataset, version)
+	err := storage.ProcessKeyBatches(ctx, s.kvGetter, beg, end, storage.RangeBatchSize,
+		func(keys []storage.Key) error {
+			dataKeys := make([]storage.Key, len(keys))
+			for i, key := range keys {
+				indexKey, ok := key.(*VersionIndexKey)
+				if !ok {
+					return fmt.Errorf("Bad version index key %s", key)
+				}
+				dataKey, err := (&DataKey{}).BytesToKey(indexKey.DataKey())
+				if err != nil {
+					return err
+				}
+				dataKeys[i] = dataKey
+			}
+			n, b, err := s.deleteKeys(dataKeys, func(storage.Key) bool { return true })
+			numKeys += n
+			numBytes += b
+			return err
+		})
+	return numKeys, numBytes, err
+}
+
+// versionIndexed returns true unless a version of a dataset was created before the
+// version index and its keys haven't been indexed since.
+func (dsets *Datasets) versionIndexed(dataset dvid.DatasetLocalID, version dvid.VersionLocalID) bool {
+	dsets.indexMu.RLock()
+	defer dsets.indexMu.RUnlock()
+	return !dsets.unindexed[dataset][version]
+}
+
+// stopVersionIndexing stops indexing versions created before the version index and
+// returns once it has stopped.
+func (dsets *Datasets) stopVersionIndexing() {
+	if dsets.indexed != nil {
+		dsets.stopIndexing()
+		<-dsets.indexed
+	}
+}
+
+// indexVersions adds the keys of versions created before the version index to the
+// index, scanning the data keys of each dataset with such versions once, and marks the
+// versions indexed.  Keys written or deleted during the scan update the index
+// themselves.  It stops once ctx is done, leaving the remaining versions unindexed.
+func (s *Service) indexVersions(ctx context.Context) {
+	defer close(s.Datasets.indexed)
+	s.indexMu.RLock()
+	ids := make([]dvid.DatasetLocalID, 0, len(s.unindexed))
+	for id := range s.unindexed {
+		ids = append(ids, id)
+	}
+	s.indexMu.RUnlock()
+	for _, id := range ids {
+		if err := s.indexDatasetVersions(ctx, id); err != nil {
+			if ctx.Err() == nil {
+				dvid.Error("Unable to index keys of old versions in dataset %d: %s\n", id, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// indexDatasetVersions indexes the keys of the unindexed versions of a dataset.
+func (s *Service) indexDatasetVersions(ctx context.Context, id dvid.DatasetLocalID) error {
+	dataset, err := s.DatasetFromLocalID(id)
+	if err != nil {
+		return err
+	}
+	db, ok := s.kvDB.(*indexingDB)
+	if !ok {
+		return fmt.Errorf("Datastore doesn't maintain a version index")
+	}
+	s.indexMu.RLock()
+	versions := s.unindexed[id]
+	s.indexMu.RUnlock()
+
+	begKey := &DataKey{id, 0, 0, dvid.IndexBytes{}}
+	endKey := &DataKey{id + 1, 0, 0, dvid.IndexBytes{}}
+	err = storage.ProcessKeyBatches(ctx, db.OrderedKeyValueDB, begKey, endKey, storage.RangeBatchSize,
+		func(keys []storage.Key) error {
+			batch := db.batcher.NewBatch()
+			var n int
+			for _, key := range keys {
+				dataKey, ok := key.(*DataKey)
+				if !ok || dataKey.Dataset != id || !versions[dataKey.Version] {
+					continue
+				}
+				if indexKey := NewVersionIndexKey(key.Bytes()); indexKey != nil {
+					batch.Put(indexKey, dvid.EmptyValue())
+					n++
+				}
+			}
+			if n == 0 {
+				return nil
+			}
+			return batch.Commit()
+		})
+	if err != nil {
+		return err
+	}
+
+	dataset.mapLock.Lock()
+	for _, node := range dataset.Nodes {
+		if versions[node.VersionID] {
+			node.KeysIndexed = true
+		}
+	}
+	dataset.mapLock.Unlock()
+	if err := dataset.Put(s.kvSetter); err != nil {
+		return err
+	}
+	s.indexMu.Lock()
+	delete(s.unindexed, id)
+	s.indexMu.Unlock()
+	dvid.Log(dvid.Normal, "Indexed keys of %d old versions in dataset %s\n", len(versions), dataset.Root)
+	return nil
+}
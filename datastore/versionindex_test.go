@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestVersionIndexKey(c *C) {
+	key := &DataKey{Dataset: 3, Data: 7, Version: 5, Index: dvid.IndexZYX{1, 2, 3}}
+	indexKey := NewVersionIndexKey(key.Bytes())
+	c.Assert(indexKey, NotNil)
+	c.Assert(indexKey.DataKey(), DeepEquals, key.Bytes())
+	c.Assert(NewVersionIndexKey((&DatasetKey{}).Bytes()), IsNil)
+
+	// Index keys of a version sort within its range and before the next version's.
+	beg, end := versionIndexRange(3, 5)
+	c.Assert(bytes.Compare(beg.Bytes(), indexKey.Bytes()) < 0, Equals, true)
+	c.Assert(bytes.Compare(indexKey.Bytes(), end.Bytes()) < 0, Equals, true)
+	key.Version = 6
+	c.Assert(bytes.Compare(NewVersionIndexKey(key.Bytes()).Bytes(), end.Bytes()) > 0, Equals, true)
+	_, end = versionIndexRange(3, 0xFFFF)
+	key.Version = 0xFFFF
+	c.Assert(bytes.Compare(NewVersionIndexKey(key.Bytes()).Bytes(), end.Bytes()) < 0, Equals, true)
+}
+
+func (s *DataSuite) TestVersionIndexRanges(c *C) {
+	defer delete(CompiledTypes, migrateTypeUrl)
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	RegisterDatatype(newMigrateType("0.1"))
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "migratetest", "ranges", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "ranges")
+	c.Assert(err, IsNil)
+	data := dataservice.(*migrateData)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	_, childVersion, err := service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+
+	db := service.kvSetter
+	for i := byte(0); i < 5; i++ {
+		c.Assert(db.Put(data.DataKey(0, dvid.IndexBytes{i}), []byte{i}), IsNil)
+	}
+	c.Assert(db.Put(data.DataKey(childVersion, dvid.IndexBytes{3}), []byte("child")), IsNil)
+
+	// Ranges of one version are read from the version index.
+	childKeys := func() int {
+		keys, err := service.kvGetter.KeysInRange(data.DataKey(childVersion, dvid.IndexBytes{0}),
+			data.DataKey(childVersion, dvid.IndexBytes{9}))
+		c.Assert(err, IsNil)
+		for _, key := range keys {
+			c.Assert(key.(*DataKey).Version, Equals, childVersion)
+		}
+		return len(keys)
+	}
+	c.Assert(childKeys(), Equals, 1)
+	values, err := service.kvGetter.GetRange(data.DataKey(0, dvid.IndexBytes{1}), data.DataKey(0, dvid.IndexBytes{3}))
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, 3)
+	c.Assert(values[2].V, DeepEquals, []byte{3})
+
+	// Keys of versions created before the index are scanned until they're indexed.
+	<-service.indexed
+	raw := service.kvDB.(*indexingDB).OrderedKeyValueDB
+	c.Assert(raw.Put(data.DataKey(childVersion, dvid.IndexBytes{4}), []byte("old")), IsNil)
+	dataset, err := service.DatasetFromUUID(child)
+	c.Assert(err, IsNil)
+	dataset.Nodes[child].KeysIndexed = false
+	service.unindexed[dataset.DatasetID] = map[dvid.VersionLocalID]bool{childVersion: true}
+	c.Assert(childKeys(), Equals, 2)
+
+	service.indexed = make(chan struct{})
+	service.indexVersions(context.Background())
+	c.Assert(dataset.Nodes[child].KeysIndexed, Equals, true)
+	c.Assert(service.versionIndexed(dataset.DatasetID, childVersion), Equals, true)
+	c.Assert(childKeys(), Equals, 2)
+}
@@ -0,0 +1,1001 @@
+/*
+	Package annotation implements DVID support for point annotations like synapses and
+	bookmarks, which can be joined with label data to count synapses per body.
+*/
+package annotation
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	Version = "0.1"
+	RepoUrl = "github.com/janelia-flyem/dvid/datatype/annotation"
+)
+
+const HelpMessage = `
+API for 'annotation' datatype (github.com/janelia-flyem/dvid/datatype/annotation)
+=================================================================================
+
+Command-line:
+
+$ dvid dataset <UUID> new annotation <data name> <settings...>
+
+	Adds newly named annotation data to dataset with specified UUID.
+
+	Example:
+
+	$ dvid dataset 3f8c new annotation synapses Labels=bodies
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of data to create, e.g., "synapses"
+    settings       Configuration settings in "key=value" format separated by spaces.
+
+    Configuration Settings (case-insensitive keys)
+
+    Versioned      "true" or "false" (default)
+    Labels         Name of labels64 or labelmap data used to find the body at each annotation.
+    MaxListKeys    Maximum annotations returned by "elements" and "state" queries; larger
+                     results get a 413 (default: no limit)
+
+    ------------------
+
+HTTP API (Level 2 REST):
+
+GET  <api URL>/node/<UUID>/<data name>/help
+
+	Returns data-specific help message.
+
+
+GET  <api URL>/node/<UUID>/<data name>/info
+
+    Retrieves data properties.
+
+    Example:
+
+    GET <api URL>/node/3f8c/synapses/info
+
+    Returns JSON with configuration settings.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+
+
+GET  <api URL>/node/<UUID>/<data name>/element/<coord>
+POST <api URL>/node/<UUID>/<data name>/element/<coord>
+DEL  <api URL>/node/<UUID>/<data name>/element/<coord>
+
+    Retrieves, stores, or deletes the annotation at a point.  Annotations are JSON of the form:
+
+    {
+        "Pos": [3000, 2000, 1500],
+        "Kind": "PreSyn",
+        "Prop": {"conf": "0.93"},
+        "Rels": [{"Rel": "PreSynTo", "To": [3010, 2004, 1500]}]
+    }
+
+    Kind is typically "PreSyn", "PostSyn", or "Note".  Presynaptic elements point to
+    their postsynaptic partners with "PreSynTo" relationships, and postsynaptic elements
+    point back with "PostSynTo" relationships.  The position in the URL overrides any
+    position in a POSTed element.  Annotations used as bookmarks or todos may also have
+    "User", "Status", and "Comment" fields giving their workflow state.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    coord         Coordinate of the annotation in "x_y_z" format.
+
+    GET replies with an ETag header for the annotation.  A POST or DELETE with an
+    "If-Match" header listing ETags only succeeds if the current annotation's ETag is
+    listed (or for "*", if there's an annotation), and a POST with "If-None-Match: *"
+    only succeeds if there's no annotation at the point.  Otherwise, the request fails
+    with status 412, so clients can read the annotation again, merge their edits, and
+    retry.
+
+
+GET  <api URL>/node/<UUID>/<data name>/element/<coord>/state
+POST <api URL>/node/<UUID>/<data name>/element/<coord>/state
+
+    Retrieves or replaces the workflow state of the annotation at a point, leaving the
+    rest of the annotation unchanged.  The state is JSON of the form:
+
+    {"User": "katz", "Status": "open", "Comment": "check for merge with 1023"}
+
+    Empty or missing fields are cleared, so POSTing {} removes the workflow state.
+    GET replies with the ETag of the whole annotation, which POST accepts in an "If-Match"
+    header as for the annotation itself.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    coord         Coordinate of the annotation in "x_y_z" format.
+
+
+GET  <api URL>/node/<UUID>/<data name>/state[?user=<user>&status=<status>&kind=<kind>]
+
+    Returns a JSON list of annotations with a workflow state, optionally restricted to
+    those with the given assigned user, status, and kind.  With an "Accept:
+    application/x-ndjson" header or "format=ndjson", annotations are streamed one per
+    line as they're found and MaxListKeys doesn't apply.  An error after streaming
+    starts ends the stream with a line {"Error": "<message>"}.
+
+    Example:
+
+    GET <api URL>/node/3f8c/bookmarks/state?user=katz&status=open
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    user          Only return annotations assigned to this user.
+    status        Only return annotations with this status.
+    kind          Only return annotations of this kind.
+
+
+POST <api URL>/node/<UUID>/<data name>/elements
+GET  <api URL>/node/<UUID>/<data name>/elements/<size>/<offset>
+
+    Stores a JSON list of annotations or retrieves a JSON list of all annotations within
+    a subvolume.  GETs with an "Accept: application/x-ndjson" header or "format=ndjson"
+    stream annotations one per line like "state" queries.
+
+    Example:
+
+    GET <api URL>/node/3f8c/synapses/elements/512_512_256/0_0_100
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    size          Size in voxels in "x_y_z" format.
+    offset        3d coordinate of the subvolume's first voxel in "x_y_z" format.
+
+
+POST <api URL>/node/<UUID>/<data name>/import[?format=<format>]
+
+    Stores annotations streamed in the request body, writing them in batches.  Each
+    annotation is validated and the import stops at the first invalid one, reporting its
+    line; annotations before it are stored.  Returns JSON with the number imported:
+
+    {"Imported": 1204577}
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    format        "jsonl" (default) for one JSON annotation per line, or "csv" with the columns
+
+                    x,y,z,kind,user,status,comment,props,rels
+
+                  where props are "key=value" pairs and rels are "Rel:x_y_z" items, each
+                  separated by semicolons.  A first line with the column names is optional.
+
+
+GET  <api URL>/node/<UUID>/<data name>/export[?format=<format>&size=<size>&offset=<offset>]
+
+    Streams all annotations, or only those within a subvolume if size and offset are
+    given, in the same formats accepted by import.  CSV exports include the column names.
+
+    Example:
+
+    GET <api URL>/node/3f8c/synapses/export?format=csv&size=512_512_256&offset=0_0_100
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    format        "jsonl" (default) or "csv".
+    size          Size in voxels in "x_y_z" format.
+    offset        3d coordinate of the subvolume's first voxel in "x_y_z" format.
+
+
+GET  <api URL>/node/<UUID>/<data name>/archive?keys=<coord1>,<coord2>,...[&format=<format>]
+
+    Streams the annotations at many coordinates as one zip or tar archive of JSON files
+    named by coordinate, e.g., "3000_2000_1500.json", avoiding a separate request per
+    annotation.  The keys option may also be repeated.  Coordinates without annotations
+    are left out of the archive.
+
+    Example:
+
+    GET <api URL>/node/3f8c/bookmarks/archive?keys=10_20_30,15_20_30&format=tar
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    keys          Comma-separated coordinates in "x_y_z" format.
+    format        "zip" (default) or "tar".
+    checksums     "true" ends the archive with "dvid-checksums.json" listing the size and
+                    SHA-256 checksum of every file.
+
+
+GET  <api URL>/node/<UUID>/<data name>/synapses/bodies
+GET  <api URL>/node/<UUID>/<data name>/synapses/body/<label>
+
+    Joins the synapse annotations with the label data given by the "Labels" setting.
+    The first form returns a JSON list of the number of presynaptic and postsynaptic
+    elements within each body:
+
+    [{"Label": 23, "PreSyn": 12, "PostSyn": 40}, ...]
+
+    The second form returns the counts for one body along with its partner bodies, where
+    "Outgoing" is the number of connections from the body to the partner and "Incoming"
+    is the number of connections from the partner to the body:
+
+    {"Label": 23, "PreSyn": 12, "PostSyn": 40, "Partners": [{"Label": 7, "Outgoing": 3, "Incoming": 0}, ...]}
+
+    Connections are counted from the "PreSynTo" relationships of presynaptic elements.
+    Annotations in label 0 are considered background and not reported.  Results are
+    computed when first requested and kept until either the annotations or the labels
+    change.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of annotation data.
+    label         A 64-bit integer label id.
+`
+
+func init() {
+	atype := NewDatatype()
+	atype.DatatypeID = &datastore.DatatypeID{
+		Name:    "annotation",
+		Url:     RepoUrl,
+		Version: Version,
+	}
+	datastore.RegisterDatatype(atype)
+
+	// Need to register types that will be used to fulfill interfaces.
+	gob.Register(&Datatype{})
+	gob.Register(&Data{})
+	gob.Register(&binary.LittleEndian)
+	gob.Register(&binary.BigEndian)
+}
+
+// Kinds of annotations with special meaning for synapse queries.
+const (
+	PreSyn  = "PreSyn"
+	PostSyn = "PostSyn"
+	Note    = "Note"
+)
+
+// Relationships between annotations with special meaning for synapse queries.
+const (
+	PreSynTo  = "PreSynTo"
+	PostSynTo = "PostSynTo"
+)
+
+// Relationship links an annotation to the annotation at another point.
+type Relationship struct {
+	Rel string
+	To  dvid.Point3d
+}
+
+// Element is a point annotation with an optional workflow state.
+type Element struct {
+	Pos  dvid.Point3d
+	Kind string
+	Prop map[string]string `json:",omitempty"`
+	Rels []Relationship    `json:",omitempty"`
+	State
+}
+
+// Annotations are stored in a few key spaces distinguished by the first byte of the index.
+const (
+	// keyElement have keys of form 'p' where p is the point of the annotation, and have
+	// the JSON annotation as the value.
+	keyElement byte = iota
+
+	// keyState have keys of form 'p' for annotations with a workflow state, so annotations
+	// needing attention can be found without reading every annotation.
+	keyState
+)
+
+// Datatype embeds the datastore's Datatype to create a unique type for annotation functions.
+type Datatype struct {
+	datastore.Datatype
+}
+
+// NewDatatype returns a pointer to a new annotation Datatype with default values set.
+func NewDatatype() (dtype *Datatype) {
+	dtype = new(Datatype)
+	dtype.Requirements = &storage.Requirements{
+		BulkIniter: false,
+		BulkWriter: false,
+		Batcher:    true,
+	}
+	return
+}
+
+// --- TypeService interface ---
+
+// NewData returns a pointer to new annotation data with default values.
+func (dtype *Datatype) NewDataService(id *datastore.DataID, c dvid.Config) (datastore.DataService, error) {
+	basedata, err := datastore.NewDataService(id, dtype, c)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{Data: basedata}
+	name, found, err := c.GetString("Labels")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		data.Labels = dvid.DataString(name)
+	}
+	return data, nil
+}
+
+func (dtype *Datatype) Help() string {
+	return fmt.Sprintf(HelpMessage)
+}
+
+// Data embeds the datastore's Data and extends it with annotation properties.
+type Data struct {
+	*datastore.Data
+
+	// Labels is the name of labels64 or labelmap data that gives the body at each
+	// annotation.
+	Labels dvid.DataString
+}
+
+// GetByUUID returns a pointer to annotation data given a version (UUID) and data name.
+func GetByUUID(uuid dvid.UUID, name dvid.DataString) (*Data, error) {
+	service := server.DatastoreService()
+	if service == nil {
+		return nil, fmt.Errorf("No datastore service established yet!")
+	}
+	source, err := service.DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := source.(*Data)
+	if !ok {
+		return nil, fmt.Errorf("Instance '%s' is not an annotation datatype!", name)
+	}
+	return data, nil
+}
+
+// NewElementKey returns a DataKey for the annotation at a point.
+func (d *Data) NewElementKey(versionID dvid.VersionLocalID, pt dvid.Point3d) *datastore.DataKey {
+	index := make([]byte, 1+dvid.IndexZYXSize)
+	index[0] = keyElement
+	copy(index[1:], dvid.IndexZYX(pt).Bytes())
+	return d.DataKey(versionID, dvid.IndexBytes(index))
+}
+
+// GetElement returns the annotation at a point.
+func (d *Data) GetElement(uuid dvid.UUID, pt dvid.Point3d) (elem *Element, found bool, err error) {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return nil, false, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := db.Get(d.NewElementKey(versionID, pt))
+	if err != nil {
+		return nil, false, err
+	}
+	if value == nil {
+		return nil, false, nil
+	}
+	elem = new(Element)
+	if err = json.Unmarshal(value, elem); err != nil {
+		return nil, false, err
+	}
+	return elem, true, nil
+}
+
+// GetElements returns the annotations within the box from minPt to maxPt inclusive.
+func (d *Data) GetElements(uuid dvid.UUID, minPt, maxPt dvid.Point3d) ([]Element, error) {
+	elements := []Element{}
+	err := d.ProcessElements(context.Background(), uuid, minPt, maxPt, func(elem *Element, value []byte) error {
+		elements = append(elements, *elem)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// ProcessElements calls f on each annotation within the box from minPt to maxPt, in key
+// order, with the annotation and its stored JSON, stopping at the first error or once
+// ctx is done.  Annotations are read in batches, so f may be slow without holding
+// the database open.
+func (d *Data) ProcessElements(ctx context.Context, uuid dvid.UUID, minPt, maxPt dvid.Point3d,
+	f func(*Element, []byte) error) error {
+
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return err
+	}
+	kStart, kEnd := d.NewElementKey(versionID, minPt), d.NewElementKey(versionID, maxPt)
+	return storage.ProcessRangeBatches(ctx, db, kStart, kEnd, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			var elem Element
+			if err := json.Unmarshal(kv.V, &elem); err != nil {
+				return err
+			}
+			if elem.Pos[0] < minPt[0] || elem.Pos[0] > maxPt[0] || elem.Pos[1] < minPt[1] || elem.Pos[1] > maxPt[1] {
+				return nil
+			}
+			return f(&elem, kv.V)
+		})
+}
+
+// AnnotationPoints returns the positions of annotations within the box from minPt to maxPt,
+// e.g., to draw them on voxels overlays.
+func (d *Data) AnnotationPoints(uuid dvid.UUID, minPt, maxPt dvid.Point3d) ([]dvid.Point3d, error) {
+	elements, err := d.GetElements(uuid, minPt, maxPt)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]dvid.Point3d, len(elements))
+	for n, elem := range elements {
+		points[n] = elem.Pos
+	}
+	return points, nil
+}
+
+// lockID identifies the annotation at a point for server.LockWrite.
+func (d *Data) lockID(uuid dvid.UUID, pt dvid.Point3d) string {
+	return fmt.Sprintf("%s/%s/%s", uuid, d.DataName(), pt)
+}
+
+// PutElements stores annotations, replacing any annotations at the same points.
+func (d *Data) PutElements(uuid dvid.UUID, elements []Element) error {
+	ids := make([]string, len(elements))
+	for n, elem := range elements {
+		ids[n] = d.lockID(uuid, elem.Pos)
+	}
+	defer server.LockWrites(ids...)()
+	return d.putElements(uuid, elements)
+}
+
+// putElements stores annotations while their points are locked.
+func (d *Data) putElements(uuid dvid.UUID, elements []Element) error {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.PutElements()", d.DataName())
+	}
+	for _, elem := range elements {
+		if elem.Kind == "" {
+			return fmt.Errorf("Annotation at %s has no Kind", elem.Pos)
+		}
+	}
+	batch := batcher.NewBatch()
+	for _, elem := range elements {
+		value, err := json.Marshal(elem)
+		if err != nil {
+			return err
+		}
+		batch.Put(d.NewElementKey(versionID, elem.Pos), value)
+		if elem.State.IsEmpty() {
+			batch.Delete(d.NewStateKey(versionID, elem.Pos))
+		} else {
+			batch.Put(d.NewStateKey(versionID, elem.Pos), dvid.EmptyValue())
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	d.annotationsModified()
+	return nil
+}
+
+// lockElement keeps writes to the annotation at a point from interleaving and checks any
+// If-Match or If-None-Match preconditions of the request against the ETag of the current
+// annotation.  If the preconditions fail, it replies with a 412 and returns an error.
+// Otherwise, it returns the function that unlocks the annotation.
+func (d *Data) lockElement(w http.ResponseWriter, r *http.Request, uuid dvid.UUID,
+	pt dvid.Point3d) (func(), error) {
+
+	unlock := server.LockWrite(d.lockID(uuid, pt))
+	if !server.HasPreconditions(r) {
+		return unlock, nil
+	}
+	elem, found, err := d.GetElement(uuid, pt)
+	if err != nil {
+		unlock()
+		server.BadRequest(w, r, err.Error())
+		return nil, err
+	}
+	var etag string
+	if found {
+		m, err := json.Marshal(elem)
+		if err != nil {
+			unlock()
+			server.BadRequest(w, r, err.Error())
+			return nil, err
+		}
+		etag = server.ETag(m)
+	}
+	if err := server.CheckPreconditions(r, etag, found); err != nil {
+		unlock()
+		server.PreconditionFailed(w, r, err.Error())
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// DeleteElement removes the annotation at a point.
+func (d *Data) DeleteElement(uuid dvid.UUID, pt dvid.Point3d) error {
+	defer server.LockWrite(d.lockID(uuid, pt))()
+	return d.deleteElement(uuid, pt)
+}
+
+// deleteElement removes the annotation at a point while the point is locked.
+func (d *Data) deleteElement(uuid dvid.UUID, pt dvid.Point3d) error {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueSetter()
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(d.NewElementKey(versionID, pt)); err != nil {
+		return err
+	}
+	if err := db.Delete(d.NewStateKey(versionID, pt)); err != nil {
+		return err
+	}
+	d.annotationsModified()
+	return nil
+}
+
+// JSONString returns the JSON for this Data's configuration
+func (d *Data) JSONString() (jsonStr string, err error) {
+	m, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// --- DataService interface ---
+
+// DoRPC acts as a switchboard for RPC commands.
+func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+	return d.UnknownCommand(request)
+}
+
+// DoHTTP handles all incoming HTTP requests for this data.
+func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+
+	// Allow cross-origin resource sharing.
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	// Break URL request into arguments
+	url := r.URL.Path[len(server.WebAPIPath):]
+	parts := strings.Split(url, "/")
+	if len(parts) < 4 {
+		err := fmt.Errorf("Incomplete API request")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	method := strings.ToLower(r.Method)
+
+	var comment string
+	switch parts[3] {
+	case "help":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, d.Help())
+		return nil
+
+	case "info":
+		jsonStr, err := d.JSONString()
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
+		return nil
+
+	case "element":
+		if len(parts) < 5 {
+			err := fmt.Errorf("'element' must be followed by a coordinate")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		coord, err := dvid.StringToPoint(parts[4], "_")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		pt, ok := coord.(dvid.Point3d)
+		if !ok {
+			err := fmt.Errorf("Annotations require 3d coordinates, not %s", parts[4])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if method != "get" {
+			unlock, err := d.lockElement(w, r, uuid, pt)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+		if len(parts) >= 6 && parts[5] == "state" {
+			if err := d.serveState(w, r, uuid, pt); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			comment = fmt.Sprintf("HTTP %s state of annotation '%s' at %s", method, d.DataName(), pt)
+			break
+		}
+		switch method {
+		case "get":
+			elem, found, err := d.GetElement(uuid, pt)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("No annotation at %s", pt), http.StatusNotFound)
+				return nil
+			}
+			m, err := json.Marshal(elem)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", server.ETag(m))
+			w.Write(m)
+		case "post":
+			var elem Element
+			if err := json.NewDecoder(r.Body).Decode(&elem); err != nil {
+				server.BadRequest(w, r, fmt.Sprintf("Bad annotation JSON: %s", err.Error()))
+				return err
+			}
+			elem.Pos = pt
+			if err := d.putElements(uuid, []Element{elem}); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if m, err := json.Marshal(elem); err == nil {
+				w.Header().Set("ETag", server.ETag(m))
+			}
+		case "delete":
+			if err := d.deleteElement(uuid, pt); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		default:
+			err := fmt.Errorf("Can only handle GET, POST, or DELETE HTTP verbs for 'element'")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		comment = fmt.Sprintf("HTTP %s annotation '%s' at %s", method, d.DataName(), pt)
+
+	case "elements":
+		switch method {
+		case "get":
+			if len(parts) < 6 {
+				err := fmt.Errorf("'elements' must be followed by size/offset")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			subvol, err := dvid.NewSubvolumeFromStrings(parts[5], parts[4], "_")
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			minPt, ok1 := subvol.StartPoint().(dvid.Point3d)
+			maxPt, ok2 := subvol.EndPoint().(dvid.Point3d)
+			if !ok1 || !ok2 {
+				err := fmt.Errorf("Annotations require 3d size and offset")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if server.WantsNDJSON(r) {
+				stream := server.NewNDJSONWriter(w)
+				err := d.ProcessElements(r.Context(), uuid, minPt, maxPt, func(elem *Element, value []byte) error {
+					return stream.WriteLine(value)
+				})
+				if err = stream.Close(err); err != nil {
+					if !stream.Started() {
+						server.BadRequest(w, r, err.Error())
+					}
+					return err
+				}
+				comment = fmt.Sprintf("HTTP GET stream of %d annotations from '%s'", stream.Lines(), d.DataName())
+				break
+			}
+			elements, err := d.GetElements(uuid, minPt, maxPt)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if err := d.CheckListKeys(len(elements)); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
+			m, err := json.Marshal(elements)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(m)
+			comment = fmt.Sprintf("HTTP GET %d annotations from '%s'", len(elements), d.DataName())
+		case "post":
+			data, err := server.ReadBody(r)
+			if err == server.ErrBodyTooLarge {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			var elements []Element
+			if err := json.Unmarshal(data, &elements); err != nil {
+				server.BadRequest(w, r, fmt.Sprintf("Bad annotation JSON: %s", err.Error()))
+				return err
+			}
+			if err := d.PutElements(uuid, elements); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			comment = fmt.Sprintf("HTTP POST %d annotations to '%s'", len(elements), d.DataName())
+		default:
+			err := fmt.Errorf("Can only handle GET or POST HTTP verbs for 'elements'")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+
+	case "state":
+		if method != "get" {
+			err := fmt.Errorf("Annotations by state can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		query := r.URL.Query()
+		filter := State{User: query.Get("user"), Status: query.Get("status")}
+		if server.WantsNDJSON(r) {
+			stream := server.NewNDJSONWriter(w)
+			err := d.ProcessElementsByState(r.Context(), uuid, query.Get("kind"), filter,
+				func(elem *Element, value []byte) error {
+					return stream.WriteLine(value)
+				})
+			if err = stream.Close(err); err != nil {
+				if !stream.Started() {
+					server.BadRequest(w, r, err.Error())
+				}
+				return err
+			}
+			comment = fmt.Sprintf("HTTP GET stream of %d annotations by state from '%s'", stream.Lines(), d.DataName())
+			break
+		}
+		elements, err := d.GetElementsByState(uuid, query.Get("kind"), filter)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := d.CheckListKeys(len(elements)); err != nil {
+			server.TooLarge(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(elements)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		comment = fmt.Sprintf("HTTP GET %d annotations by state from '%s'", len(elements), d.DataName())
+
+	case "import":
+		if method != "post" {
+			err := fmt.Errorf("Annotations can only be imported with POST")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatJSONLines
+		}
+		imported, err := d.Import(uuid, r.Body, format)
+		if err != nil {
+			server.BadRequest(w, r, fmt.Sprintf("%s (%d annotations imported)", err.Error(), imported))
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %d}", "Imported", imported)
+		comment = fmt.Sprintf("HTTP POST import of %d annotations into '%s'", imported, d.DataName())
+
+	case "export":
+		if method != "get" {
+			err := fmt.Errorf("Annotations can only be exported with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = FormatJSONLines
+		}
+		var minPt, maxPt *dvid.Point3d
+		if query.Get("size") != "" || query.Get("offset") != "" {
+			subvol, err := dvid.NewSubvolumeFromStrings(query.Get("offset"), query.Get("size"), "_")
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			start, ok1 := subvol.StartPoint().(dvid.Point3d)
+			end, ok2 := subvol.EndPoint().(dvid.Point3d)
+			if !ok1 || !ok2 {
+				err := fmt.Errorf("Annotation exports require 3d size and offset")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			minPt, maxPt = &start, &end
+		}
+		switch format {
+		case FormatJSONLines:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		case FormatCSV:
+			w.Header().Set("Content-Type", "text/csv")
+		}
+		exported, err := d.Export(r.Context(), uuid, w, format, minPt, maxPt)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		comment = fmt.Sprintf("HTTP GET export of %d annotations from '%s'", exported, d.DataName())
+
+	case "archive":
+		if method != "get" {
+			err := fmt.Errorf("Annotation archives can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		query := r.URL.Query()
+		keys := dvid.ArchiveKeys(query["keys"])
+		if len(keys) == 0 {
+			err := fmt.Errorf("'archive' requires a 'keys' query string option")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		points := make([]dvid.Point3d, len(keys))
+		for n, key := range keys {
+			coord, err := dvid.StringToPoint(key, "_")
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			pt, ok := coord.(dvid.Point3d)
+			if !ok {
+				err := fmt.Errorf("Annotations require 3d coordinates, not %s", key)
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			points[n] = pt
+		}
+		if err := d.CheckListKeys(len(points)); err != nil {
+			server.TooLarge(w, r, err.Error())
+			return err
+		}
+		format := query.Get("format")
+		if format == "" {
+			format = dvid.ArchiveZip
+		}
+		archive, err := dvid.NewArchiveWriter(w, format)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if query.Get("checksums") == "true" {
+			archive.AddChecksums(fmt.Sprintf("annotations %q at version %s", d.DataName(), uuid))
+		}
+		w.Header().Set("Content-Type", archive.ContentType())
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"%s.%s\"", d.DataName(), archive.Format()))
+		written, err := d.WriteArchive(uuid, archive, points)
+		if err != nil {
+			// The archive may have started, so the error can only be logged.
+			dvid.Error("Archive of annotations '%s' stopped: %s\n", d.DataName(), err.Error())
+			return err
+		}
+		comment = fmt.Sprintf("HTTP GET archive of %d of %d annotations from '%s'", written, len(points), d.DataName())
+
+	case "synapses":
+		if method != "get" {
+			err := fmt.Errorf("Synapse queries can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 5 {
+			err := fmt.Errorf("'synapses' must be followed by 'bodies' or 'body/<label>'")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var result interface{}
+		switch parts[4] {
+		case "bodies":
+			bodies, err := d.GetBodySynapses(uuid)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			result = bodies
+		case "body":
+			if len(parts) < 6 {
+				err := fmt.Errorf("'synapses/body' must be followed by a label")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			label, err := strconv.ParseUint(parts[5], 10, 64)
+			if err != nil {
+				server.BadRequest(w, r, fmt.Sprintf("Bad label %q", parts[5]))
+				return err
+			}
+			body, err := d.GetBodyPartners(uuid, label)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			result = body
+		default:
+			err := fmt.Errorf("Unknown synapse query %q", parts[4])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(result)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		comment = fmt.Sprintf("HTTP GET synapses/%s for '%s'", parts[4], d.DataName())
+
+	default:
+		err := fmt.Errorf("Unrecognized API call '%s' for annotation data '%s'.  See API help.",
+			parts[3], d.DataName())
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+
+	dvid.ElapsedTime(dvid.Debug, startTime, comment)
+	return nil
+}
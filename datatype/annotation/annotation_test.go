@@ -0,0 +1,392 @@
+package annotation
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type DataSuite struct {
+	dir     string
+	service *server.Service
+}
+
+var _ = Suite(&DataSuite{})
+
+// This will setup a new datastore and open it up, keeping the service pointer in
+// the DataSuite.
+func (suite *DataSuite) SetUpSuite(c *C) {
+	// Make a temporary testing directory that will be auto-deleted after testing.
+	suite.dir = c.MkDir()
+
+	// Create a new datastore.
+	err := datastore.Init(suite.dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+
+	// Open the datastore
+	suite.service, err = server.OpenDatastore(suite.dir)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TearDownSuite(c *C) {
+	suite.service.Shutdown()
+}
+
+func (suite *DataSuite) TestElements(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "notes", dvid.NewConfig()), IsNil)
+	notes, err := GetByUUID(root, "notes")
+	c.Assert(err, IsNil)
+
+	elements := []Element{
+		{Pos: dvid.Point3d{10, 20, 30}, Kind: Note, Prop: map[string]string{"comment": "merge?"}},
+		{Pos: dvid.Point3d{15, 20, 30}, Kind: Note},
+		{Pos: dvid.Point3d{10, 200, 30}, Kind: Note},
+		{Pos: dvid.Point3d{-5, 20, 31}, Kind: Note},
+	}
+	c.Assert(notes.PutElements(root, elements), IsNil)
+	c.Assert(notes.PutElements(root, []Element{{Pos: dvid.Point3d{1, 2, 3}}}), NotNil)
+
+	elem, found, err := notes.GetElement(root, dvid.Point3d{10, 20, 30})
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(*elem, DeepEquals, elements[0])
+
+	inBox, err := notes.GetElements(root, dvid.Point3d{-10, 0, 0}, dvid.Point3d{50, 50, 50})
+	c.Assert(err, IsNil)
+	c.Assert(inBox, HasLen, 3)
+	c.Assert(inBox[0].Pos, Equals, dvid.Point3d{10, 20, 30})
+	c.Assert(inBox[2].Pos, Equals, dvid.Point3d{-5, 20, 31})
+
+	c.Assert(notes.DeleteElement(root, dvid.Point3d{10, 20, 30}), IsNil)
+	_, found, err = notes.GetElement(root, dvid.Point3d{10, 20, 30})
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+}
+
+// putLabels writes a 64x32x32 labels volume at the origin with label 1 for x < split
+// and label 2 otherwise.
+func putLabels(c *C, uuid dvid.UUID, labelData *labels64.Data, split int32) {
+	size := dvid.Point3d{64, 32, 32}
+	e, err := labelData.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), nil)
+	c.Assert(err, IsNil)
+	data, byteOrder := e.Data(), e.ByteOrder()
+	for i := int32(0); i < int32(size.Prod()); i++ {
+		label := uint64(2)
+		if i%size[0] < split {
+			label = 1
+		}
+		byteOrder.PutUint64(data[i*8:], label)
+	}
+	c.Assert(voxels.PutVoxels(context.Background(), uuid, labelData, e), IsNil)
+}
+
+func (suite *DataSuite) TestSynapses(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "labels64", "bodies", dvid.NewConfig()), IsNil)
+	config := dvid.NewConfig()
+	config.Set("Labels", "bodies")
+	c.Assert(suite.service.NewData(root, "annotation", "synapses", config), IsNil)
+	labelData, err := labels64.GetByUUID(root, "bodies")
+	c.Assert(err, IsNil)
+	synapses, err := GetByUUID(root, "synapses")
+	c.Assert(err, IsNil)
+	putLabels(c, root, labelData, 32)
+
+	// Two connections from body 1 to body 2 and one from body 2 to body 1.
+	elements := []Element{
+		{Pos: dvid.Point3d{10, 10, 10}, Kind: PreSyn, Rels: []Relationship{
+			{PreSynTo, dvid.Point3d{40, 10, 10}}, {PreSynTo, dvid.Point3d{41, 10, 10}}}},
+		{Pos: dvid.Point3d{40, 10, 10}, Kind: PostSyn, Rels: []Relationship{{PostSynTo, dvid.Point3d{10, 10, 10}}}},
+		{Pos: dvid.Point3d{41, 10, 10}, Kind: PostSyn, Rels: []Relationship{{PostSynTo, dvid.Point3d{10, 10, 10}}}},
+		{Pos: dvid.Point3d{50, 20, 20}, Kind: PreSyn, Rels: []Relationship{{PreSynTo, dvid.Point3d{20, 20, 20}}}},
+		{Pos: dvid.Point3d{20, 20, 20}, Kind: PostSyn, Rels: []Relationship{{PostSynTo, dvid.Point3d{50, 20, 20}}}},
+		{Pos: dvid.Point3d{30, 5, 5}, Kind: Note},
+	}
+	c.Assert(synapses.PutElements(root, elements), IsNil)
+
+	bodies, err := synapses.GetBodySynapses(root)
+	c.Assert(err, IsNil)
+	c.Assert(bodies, DeepEquals, []BodySynapses{{1, 1, 1}, {2, 1, 2}})
+
+	body, err := synapses.GetBodyPartners(root, 1)
+	c.Assert(err, IsNil)
+	c.Assert(body.BodySynapses, Equals, BodySynapses{1, 1, 1})
+	c.Assert(body.Partners, DeepEquals, []Partner{{2, 2, 1}})
+
+	// Adding an annotation invalidates the cached join.
+	c.Assert(synapses.PutElements(root, []Element{{Pos: dvid.Point3d{60, 30, 30}, Kind: PostSyn}}), IsNil)
+	bodies, err = synapses.GetBodySynapses(root)
+	c.Assert(err, IsNil)
+	c.Assert(bodies, DeepEquals, []BodySynapses{{1, 1, 1}, {2, 1, 3}})
+
+	// Relabeling so the first postsynaptic element lies in body 1 also invalidates it.
+	putLabels(c, root, labelData, 41)
+	body, err = synapses.GetBodyPartners(root, 1)
+	c.Assert(err, IsNil)
+	c.Assert(body.BodySynapses, Equals, BodySynapses{1, 1, 2})
+	c.Assert(body.Partners, DeepEquals, []Partner{{1, 1, 1}, {2, 1, 1}})
+}
+
+func (suite *DataSuite) TestState(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "todos", dvid.NewConfig()), IsNil)
+	todos, err := GetByUUID(root, "todos")
+	c.Assert(err, IsNil)
+
+	elements := []Element{
+		{Pos: dvid.Point3d{1, 1, 1}, Kind: Note, State: State{User: "katz", Status: "open"}},
+		{Pos: dvid.Point3d{2, 1, 1}, Kind: Note, State: State{User: "plaza", Status: "open"}},
+		{Pos: dvid.Point3d{3, 1, 1}, Kind: Note},
+		{Pos: dvid.Point3d{4, 1, 1}, Kind: PreSyn, State: State{User: "katz", Status: "open"}},
+	}
+	c.Assert(todos.PutElements(root, elements), IsNil)
+
+	found, err := todos.GetElementsByState(root, "", State{})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 3)
+	found, err = todos.GetElementsByState(root, Note, State{User: "katz"})
+	c.Assert(err, IsNil)
+	c.Assert(found, DeepEquals, elements[:1])
+
+	// Close one todo and assign another.
+	c.Assert(todos.SetState(root, dvid.Point3d{1, 1, 1}, State{User: "katz", Status: "done", Comment: "merged"}), IsNil)
+	c.Assert(todos.SetState(root, dvid.Point3d{3, 1, 1}, State{User: "katz", Status: "open"}), IsNil)
+	c.Assert(todos.SetState(root, dvid.Point3d{5, 1, 1}, State{Status: "open"}), NotNil)
+	found, err = todos.GetElementsByState(root, "", State{User: "katz", Status: "open"})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+	c.Assert(found[0].Pos, Equals, dvid.Point3d{3, 1, 1})
+	c.Assert(found[1].Kind, Equals, PreSyn)
+
+	elem, _, err := todos.GetElement(root, dvid.Point3d{1, 1, 1})
+	c.Assert(err, IsNil)
+	c.Assert(elem.Comment, Equals, "merged")
+
+	// Clearing the state or deleting the annotation removes it from state queries.
+	c.Assert(todos.SetState(root, dvid.Point3d{3, 1, 1}, State{}), IsNil)
+	c.Assert(todos.DeleteElement(root, dvid.Point3d{4, 1, 1}), IsNil)
+	found, err = todos.GetElementsByState(root, "", State{Status: "open"})
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Assert(found[0].User, Equals, "plaza")
+}
+
+func (suite *DataSuite) TestImportExport(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "predictions", dvid.NewConfig()), IsNil)
+	predictions, err := GetByUUID(root, "predictions")
+	c.Assert(err, IsNil)
+
+	csvData := `x,y,z,kind,user,status,comment,props,rels
+10,20,30,PreSyn,,,,conf=0.9;source=net,PreSynTo:12_20_30;PreSynTo:8_20_30
+12,20,30,PostSyn,,,,,PostSynTo:10_20_30
+8,20,30,PostSyn,katz,open,"check, maybe false",,
+100,20,30,Note,,,,,
+`
+	imported, err := predictions.Import(root, strings.NewReader(csvData), FormatCSV)
+	c.Assert(err, IsNil)
+	c.Assert(imported, Equals, 4)
+
+	elem, found, err := predictions.GetElement(root, dvid.Point3d{10, 20, 30})
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(elem.Prop, DeepEquals, map[string]string{"conf": "0.9", "source": "net"})
+	c.Assert(elem.Rels, DeepEquals, []Relationship{{PreSynTo, dvid.Point3d{12, 20, 30}}, {PreSynTo, dvid.Point3d{8, 20, 30}}})
+
+	// Round trip through CSV.
+	var buf bytes.Buffer
+	exported, err := predictions.Export(context.Background(), root, &buf, FormatCSV, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(exported, Equals, 4)
+	c.Assert(buf.String(), Equals, `x,y,z,kind,user,status,comment,props,rels
+8,20,30,PostSyn,katz,open,"check, maybe false",,
+10,20,30,PreSyn,,,,conf=0.9;source=net,PreSynTo:12_20_30;PreSynTo:8_20_30
+12,20,30,PostSyn,,,,,PostSynTo:10_20_30
+100,20,30,Note,,,,,
+`)
+
+	// Export a subvolume as JSON lines and import it into another version.
+	buf.Reset()
+	minPt, maxPt := dvid.Point3d{0, 0, 0}, dvid.Point3d{50, 50, 50}
+	exported, err = predictions.Export(context.Background(), root, &buf, FormatJSONLines, &minPt, &maxPt)
+	c.Assert(err, IsNil)
+	c.Assert(exported, Equals, 3)
+	c.Assert(strings.Count(buf.String(), "\n"), Equals, 3)
+
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	imported, err = predictions.Import(child, &buf, FormatJSONLines)
+	c.Assert(err, IsNil)
+	c.Assert(imported, Equals, 3)
+	inBox, err := predictions.GetElements(child, minPt, maxPt)
+	c.Assert(err, IsNil)
+	c.Assert(inBox, HasLen, 3)
+	c.Assert(inBox[0].User, Equals, "katz")
+
+	// Invalid annotations stop the import with the line number.
+	bad := "{\"Pos\":[1,1,1],\"Kind\":\"Note\"}\n{\"Pos\":[2,1,1]}\n{\"Pos\":[3,1,1],\"Kind\":\"Note\"}\n"
+	imported, err = predictions.Import(child, strings.NewReader(bad), FormatJSONLines)
+	c.Assert(err, ErrorMatches, ".*line 2.*")
+	c.Assert(imported, Equals, 1)
+	_, err = predictions.Import(child, strings.NewReader("1,2\n"), FormatCSV)
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestArchive(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "archived", dvid.NewConfig()), IsNil)
+	notes, err := GetByUUID(root, "archived")
+	c.Assert(err, IsNil)
+	elements := []Element{
+		{Pos: dvid.Point3d{10, 20, 30}, Kind: Note},
+		{Pos: dvid.Point3d{-5, 20, 31}, Kind: PreSyn},
+	}
+	c.Assert(notes.PutElements(root, elements), IsNil)
+
+	var buf bytes.Buffer
+	archive, err := dvid.NewArchiveWriter(&buf, "zip")
+	c.Assert(err, IsNil)
+	points := []dvid.Point3d{{-5, 20, 31}, {1, 2, 3}, {10, 20, 30}}
+	written, err := notes.WriteArchive(root, archive, points)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, 2)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, IsNil)
+	c.Assert(zr.File, HasLen, 2)
+	c.Assert(zr.File[0].Name, Equals, "-5_20_31.json")
+	c.Assert(zr.File[1].Name, Equals, "10_20_30.json")
+	rc, err := zr.File[0].Open()
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, IsNil)
+	rc.Close()
+	var elem Element
+	c.Assert(json.Unmarshal(data, &elem), IsNil)
+	c.Assert(elem, DeepEquals, elements[1])
+}
+
+func (suite *DataSuite) TestConditionalWrites(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "condnotes", dvid.NewConfig()), IsNil)
+	notes, err := GetByUUID(root, "condnotes")
+	c.Assert(err, IsNil)
+
+	url := fmt.Sprintf("%snode/%s/condnotes/element/10_20_30", server.WebAPIPath, root)
+	request := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		notes.DoHTTP(root, w, r)
+		return w
+	}
+
+	c.Assert(request("POST", `{"Kind": "Note", "Prop": {"text": "first"}}`, "*").Code, Equals,
+		http.StatusPreconditionFailed)
+	w := request("POST", `{"Kind": "Note", "Prop": {"text": "first"}}`, "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	c.Assert(request("GET", "", "").Header().Get("ETag"), Equals, etag)
+
+	// Two editors read the same annotation and the second write fails.
+	c.Assert(request("POST", `{"Kind": "Note", "Prop": {"text": "second"}}`, etag).Code, Equals, http.StatusOK)
+	c.Assert(request("POST", `{"Kind": "Note", "Prop": {"text": "third"}}`, etag).Code, Equals,
+		http.StatusPreconditionFailed)
+	c.Assert(request("DELETE", "", etag).Code, Equals, http.StatusPreconditionFailed)
+	elem, found, err := notes.GetElement(root, dvid.Point3d{10, 20, 30})
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(elem.Prop["text"], Equals, "second")
+}
+
+func (suite *DataSuite) TestStreamElements(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "annotation", "streamed", dvid.NewConfig()), IsNil)
+	notes, err := GetByUUID(root, "streamed")
+	c.Assert(err, IsNil)
+	elements := []Element{
+		{Pos: dvid.Point3d{10, 20, 30}, Kind: Note},
+		{Pos: dvid.Point3d{15, 20, 30}, Kind: Note},
+		{Pos: dvid.Point3d{10, 200, 30}, Kind: Note},
+	}
+	c.Assert(notes.PutElements(root, elements), IsNil)
+
+	url := fmt.Sprintf("%snode/%s/streamed/elements/50_50_50/0_0_0", server.WebAPIPath, root)
+	r, _ := http.NewRequest("GET", url, nil)
+	r.Header.Set("Accept", server.NDJSONContentType)
+	w := httptest.NewRecorder()
+	c.Assert(notes.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, server.NDJSONContentType)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	for i, line := range lines {
+		var elem Element
+		c.Assert(json.Unmarshal([]byte(line), &elem), IsNil)
+		c.Assert(elem.Pos, Equals, elements[i].Pos)
+	}
+}
+
+func (suite *DataSuite) TestValidate(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "labels64", "bodies", dvid.NewConfig()), IsNil)
+	config := dvid.NewConfig()
+	config.Set("Labels", "bodies")
+	c.Assert(suite.service.NewData(root, "annotation", "synapses", config), IsNil)
+	labelData, err := labels64.GetByUUID(root, "bodies")
+	c.Assert(err, IsNil)
+	synapses, err := GetByUUID(root, "synapses")
+	c.Assert(err, IsNil)
+	putLabels(c, root, labelData, 32)
+
+	elements := []Element{
+		{Pos: dvid.Point3d{10, 10, 10}, Kind: PreSyn, Rels: []Relationship{{PreSynTo, dvid.Point3d{40, 10, 10}}}},
+		{Pos: dvid.Point3d{40, 10, 10}, Kind: PostSyn, Rels: []Relationship{{PostSynTo, dvid.Point3d{10, 10, 10}}}},
+		{Pos: dvid.Point3d{100, 10, 10}, Kind: PreSyn, Rels: []Relationship{{PreSynTo, dvid.Point3d{20, 20, 20}}}},
+	}
+	c.Assert(synapses.PutElements(root, elements), IsNil)
+
+	var violations []server.Violation
+	err = synapses.Validate(context.Background(), root, nil, func(v server.Violation) {
+		violations = append(violations, v)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 2)
+	c.Assert(violations[0].Check, Equals, "relationship-target")
+	c.Assert(violations[1].Check, Equals, "within-extents")
+	c.Assert(violations[1].Related, Equals, dvid.DataString("bodies"))
+
+	report, err := server.Validate(context.Background(), root, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Checks, DeepEquals, []server.ValidationCheck{{Data: "synapses", Violations: 2}})
+	c.Assert(report.Violations[0].Data, Equals, dvid.DataString("synapses"))
+}
@@ -0,0 +1,257 @@
+/*
+	This file handles bulk import and export of annotations as JSON lines or CSV, which
+	are streamed so millions of annotations can be moved without buffering them all.
+*/
+
+package annotation
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ImportBatchSize is the number of annotations written per batch during imports.
+const ImportBatchSize = 10000
+
+// Bulk formats for annotations.
+const (
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+)
+
+// csvHeader gives the columns of CSV annotations.  Properties are "key=value" pairs and
+// relationships are "Rel:x_y_z" items, each separated by semicolons.
+var csvHeader = []string{"x", "y", "z", "kind", "user", "status", "comment", "props", "rels"}
+
+// elementToCSV returns the CSV record for an annotation.
+func elementToCSV(elem *Element) []string {
+	var props, rels []string
+	for key, value := range elem.Prop {
+		props = append(props, key+"="+value)
+	}
+	sort.Strings(props)
+	for _, rel := range elem.Rels {
+		rels = append(rels, fmt.Sprintf("%s:%d_%d_%d", rel.Rel, rel.To[0], rel.To[1], rel.To[2]))
+	}
+	return []string{
+		fmt.Sprintf("%d", elem.Pos[0]),
+		fmt.Sprintf("%d", elem.Pos[1]),
+		fmt.Sprintf("%d", elem.Pos[2]),
+		elem.Kind,
+		elem.User,
+		elem.Status,
+		elem.Comment,
+		strings.Join(props, ";"),
+		strings.Join(rels, ";"),
+	}
+}
+
+// elementFromCSV parses a CSV record of an annotation.
+func elementFromCSV(record []string) (*Element, error) {
+	if len(record) != len(csvHeader) {
+		return nil, fmt.Errorf("Expected %d columns, got %d", len(csvHeader), len(record))
+	}
+	pt, err := dvid.StringToPoint(strings.Join(record[0:3], "_"), "_")
+	if err != nil {
+		return nil, err
+	}
+	elem := &Element{
+		Pos:   pt.(dvid.Point3d),
+		Kind:  record[3],
+		State: State{User: record[4], Status: record[5], Comment: record[6]},
+	}
+	if record[7] != "" {
+		elem.Prop = make(map[string]string)
+		for _, prop := range strings.Split(record[7], ";") {
+			kv := strings.SplitN(prop, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Bad property %q, should be key=value", prop)
+			}
+			elem.Prop[kv[0]] = kv[1]
+		}
+	}
+	if record[8] != "" {
+		for _, relStr := range strings.Split(record[8], ";") {
+			parts := strings.SplitN(relStr, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Bad relationship %q, should be Rel:x_y_z", relStr)
+			}
+			to, err := dvid.StringToPoint(parts[1], "_")
+			if err != nil {
+				return nil, err
+			}
+			toPt, ok := to.(dvid.Point3d)
+			if !ok {
+				return nil, fmt.Errorf("Relationship %q must be to a 3d point", relStr)
+			}
+			elem.Rels = append(elem.Rels, Relationship{Rel: parts[0], To: toPt})
+		}
+	}
+	return elem, nil
+}
+
+// validate checks an annotation read during an import.
+func (elem *Element) validate() error {
+	if elem.Kind == "" {
+		return fmt.Errorf("Annotation at %s has no Kind", elem.Pos)
+	}
+	for _, rel := range elem.Rels {
+		if rel.Rel == "" {
+			return fmt.Errorf("Annotation at %s has a relationship without a Rel", elem.Pos)
+		}
+	}
+	return nil
+}
+
+// Import reads annotations in the given format and stores them in batches.  Reading
+// stops at the first invalid annotation, with the annotations before it stored.  The
+// number of stored annotations is returned.
+func (d *Data) Import(uuid dvid.UUID, r io.Reader, format string) (int, error) {
+	var next func() (*Element, error)
+	var line int
+	switch format {
+	case FormatJSONLines:
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		next = func() (*Element, error) {
+			elem := new(Element)
+			if err := decoder.Decode(elem); err != nil {
+				return nil, err
+			}
+			return elem, nil
+		}
+	case FormatCSV:
+		reader := csv.NewReader(bufio.NewReader(r))
+		reader.FieldsPerRecord = -1
+		next = func() (*Element, error) {
+			record, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			if line == 0 && len(record) > 0 && record[0] == csvHeader[0] {
+				line++
+				if record, err = reader.Read(); err != nil {
+					return nil, err
+				}
+			}
+			return elementFromCSV(record)
+		}
+	default:
+		return 0, fmt.Errorf("Unknown annotation format %q.  Use %q or %q.", format, FormatJSONLines, FormatCSV)
+	}
+
+	var imported int
+	batch := make([]Element, 0, ImportBatchSize)
+	for {
+		elem, err := next()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err == nil {
+			err = elem.validate()
+		}
+		if err != nil {
+			if len(batch) > 0 {
+				if putErr := d.PutElements(uuid, batch); putErr == nil {
+					imported += len(batch)
+				}
+			}
+			return imported, fmt.Errorf("Bad annotation at line %d: %s", line, err.Error())
+		}
+		batch = append(batch, *elem)
+		if len(batch) == ImportBatchSize {
+			if err := d.PutElements(uuid, batch); err != nil {
+				return imported, err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := d.PutElements(uuid, batch); err != nil {
+			return imported, err
+		}
+		imported += len(batch)
+	}
+	dvid.Log(dvid.Normal, "Imported %d annotations into '%s'\n", imported, d.DataName())
+	return imported, nil
+}
+
+// Export writes all annotations, or only those within the box from minPt to maxPt if
+// they are not nil, in the given format.  The number of written annotations is returned.
+// Annotations are read in batches and each batch is written after its read finishes,
+// so a slow client doesn't hold the database open.
+func (d *Data) Export(ctx context.Context, uuid dvid.UUID, w io.Writer, format string,
+	minPt, maxPt *dvid.Point3d) (int, error) {
+
+	if format != FormatJSONLines && format != FormatCSV {
+		return 0, fmt.Errorf("Unknown annotation format %q.  Use %q or %q.", format, FormatJSONLines, FormatCSV)
+	}
+	start := dvid.Point3d{math.MinInt32, math.MinInt32, math.MinInt32}
+	end := dvid.Point3d{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+	if minPt != nil && maxPt != nil {
+		start, end = *minPt, *maxPt
+	}
+
+	buf := bufio.NewWriter(w)
+	csvWriter := csv.NewWriter(buf)
+	if format == FormatCSV {
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return 0, err
+		}
+	}
+	var exported int
+	err := d.ProcessElements(ctx, uuid, start, end, func(elem *Element, value []byte) error {
+		exported++
+		if format == FormatCSV {
+			return csvWriter.Write(elementToCSV(elem))
+		}
+		if _, err := buf.Write(value); err != nil {
+			return err
+		}
+		return buf.WriteByte('\n')
+	})
+	if err != nil {
+		return exported, err
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return exported, err
+	}
+	return exported, buf.Flush()
+}
+
+// WriteArchive writes the annotations at the given points into an archive as JSON files
+// named by coordinate, e.g., "3000_2000_1500.json", returning the number written.  Points
+// without annotations are skipped.
+func (d *Data) WriteArchive(uuid dvid.UUID, archive *dvid.ArchiveWriter, points []dvid.Point3d) (int, error) {
+	var written int
+	for _, pt := range points {
+		elem, found, err := d.GetElement(uuid, pt)
+		if err != nil {
+			return written, err
+		}
+		if !found {
+			continue
+		}
+		data, err := json.Marshal(elem)
+		if err != nil {
+			return written, err
+		}
+		filename := fmt.Sprintf("%d_%d_%d.json", pt[0], pt[1], pt[2])
+		if err := archive.WriteFile(filename, data); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, archive.Close()
+}
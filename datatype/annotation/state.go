@@ -0,0 +1,177 @@
+/*
+	This file handles the workflow state of annotations, which lets bookmarks and todos
+	be assigned to users and tracked through proofreading.
+*/
+
+package annotation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// State is the mutable workflow state of an annotation.
+type State struct {
+	User    string `json:",omitempty"`
+	Status  string `json:",omitempty"`
+	Comment string `json:",omitempty"`
+}
+
+// IsEmpty returns true if no workflow state is set.
+func (s State) IsEmpty() bool {
+	return s.User == "" && s.Status == "" && s.Comment == ""
+}
+
+// matches returns true if the state has the user and status of the filter, where empty
+// filter fields match anything.
+func (s State) matches(filter State) bool {
+	return (filter.User == "" || s.User == filter.User) && (filter.Status == "" || s.Status == filter.Status)
+}
+
+// NewStateKey returns a DataKey that marks an annotation at a point as having a
+// workflow state.
+func (d *Data) NewStateKey(versionID dvid.VersionLocalID, pt dvid.Point3d) *datastore.DataKey {
+	index := make([]byte, 1+dvid.IndexZYXSize)
+	index[0] = keyState
+	copy(index[1:], dvid.IndexZYX(pt).Bytes())
+	return d.DataKey(versionID, dvid.IndexBytes(index))
+}
+
+// SetState replaces the workflow state of the annotation at a point.
+func (d *Data) SetState(uuid dvid.UUID, pt dvid.Point3d, state State) error {
+	defer server.LockWrite(d.lockID(uuid, pt))()
+	return d.setState(uuid, pt, state)
+}
+
+// setState replaces the workflow state of the annotation at a point while the point is
+// locked.
+func (d *Data) setState(uuid dvid.UUID, pt dvid.Point3d, state State) error {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	mu := d.VersionMutex(versionID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	elem, found, err := d.GetElement(uuid, pt)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("No annotation at %s", pt)
+	}
+	elem.State = state
+	value, err := json.Marshal(elem)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueSetter()
+	if err != nil {
+		return err
+	}
+	if err := db.Put(d.NewElementKey(versionID, pt), value); err != nil {
+		return err
+	}
+	if state.IsEmpty() {
+		return db.Delete(d.NewStateKey(versionID, pt))
+	}
+	return db.Put(d.NewStateKey(versionID, pt), dvid.EmptyValue())
+}
+
+// GetElementsByState returns the annotations with a workflow state matching the filter's
+// user and status, where empty filter fields match anything.  If kind is not empty, only
+// annotations of that kind are returned.
+func (d *Data) GetElementsByState(uuid dvid.UUID, kind string, filter State) ([]Element, error) {
+	elements := []Element{}
+	err := d.ProcessElementsByState(context.Background(), uuid, kind, filter, func(elem *Element, value []byte) error {
+		elements = append(elements, *elem)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// ProcessElementsByState calls f on each annotation that GetElementsByState would return,
+// with the annotation and its stored JSON, stopping at the first error or once ctx is done.
+func (d *Data) ProcessElementsByState(ctx context.Context, uuid dvid.UUID, kind string, filter State,
+	f func(*Element, []byte) error) error {
+
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return err
+	}
+	minPt := dvid.Point3d{math.MinInt32, math.MinInt32, math.MinInt32}
+	maxPt := dvid.Point3d{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+
+	// Annotations are read between batches of state keys, not while iterating them,
+	// since some databases don't allow reads within an iteration.
+	kStart, kEnd := d.NewStateKey(versionID, minPt), d.NewStateKey(versionID, maxPt)
+	return storage.ProcessRangeBatches(ctx, db, kStart, kEnd, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			indexBytes := kv.K.(*datastore.DataKey).Index.Bytes()
+			index, err := (dvid.IndexZYX{}).IndexFromBytes(indexBytes[1:])
+			if err != nil {
+				return err
+			}
+			value, err := db.Get(d.NewElementKey(versionID, dvid.Point3d(*(index.(*dvid.IndexZYX)))))
+			if err != nil || value == nil {
+				return err
+			}
+			var elem Element
+			if err := json.Unmarshal(value, &elem); err != nil {
+				return err
+			}
+			if (kind == "" || elem.Kind == kind) && elem.State.matches(filter) {
+				return f(&elem, value)
+			}
+			return nil
+		})
+}
+
+// serveState handles GET and POST of the workflow state of an annotation.
+func (d *Data) serveState(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, pt dvid.Point3d) error {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		elem, found, err := d.GetElement(uuid, pt)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("No annotation at %s", pt)
+		}
+		m, err := json.Marshal(elem.State)
+		if err != nil {
+			return err
+		}
+		if whole, err := json.Marshal(elem); err == nil {
+			w.Header().Set("ETag", server.ETag(whole))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(m)
+		return err
+	case "post":
+		var state State
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			return fmt.Errorf("Bad state JSON: %s", err.Error())
+		}
+		return d.setState(uuid, pt, state)
+	default:
+		return fmt.Errorf("Can only handle GET or POST HTTP verbs for annotation state")
+	}
+}
@@ -0,0 +1,254 @@
+/*
+	This file joins synapse annotations with label data to give synapse counts and
+	partners for each body.  The join is cached per version and recomputed lazily when
+	the annotations or the labels of the dataset change.
+*/
+
+package annotation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// BodySynapses gives the number of synapse annotations within a body.
+type BodySynapses struct {
+	Label   uint64
+	PreSyn  int
+	PostSyn int
+}
+
+// Partner gives the number of connections between a body and a partner body.
+type Partner struct {
+	Label    uint64
+	Outgoing int
+	Incoming int
+}
+
+// BodyPartners gives the synapse counts and partners of a body.
+type BodyPartners struct {
+	BodySynapses
+	Partners []Partner
+}
+
+// pointLabeler is implemented by label data that can return the body at a point,
+// e.g., labels64 and labelmap.
+type pointLabeler interface {
+	GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error)
+}
+
+type synapseKey struct {
+	data      *Data
+	versionID dvid.VersionLocalID
+}
+
+// synapseTable is the join of synapse annotations with labels for a version.
+type synapseTable struct {
+	labelMods uint64
+	bodies    map[uint64]*BodyPartners
+	partners  map[uint64]map[uint64]*Partner
+}
+
+var synapseCache struct {
+	sync.Mutex
+	tables map[synapseKey]*synapseTable
+}
+
+// annotationsModified drops any cached synapse tables for this data.
+func (d *Data) annotationsModified() {
+	synapseCache.Lock()
+	for key := range synapseCache.tables {
+		if key.data == d {
+			delete(synapseCache.tables, key)
+		}
+	}
+	synapseCache.Unlock()
+}
+
+// GetBodySynapses returns the synapse counts of all bodies ordered by label.
+func (d *Data) GetBodySynapses(uuid dvid.UUID) ([]BodySynapses, error) {
+	table, err := d.getSynapseTable(uuid)
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([]BodySynapses, 0, len(table.bodies))
+	for _, body := range table.bodies {
+		bodies = append(bodies, body.BodySynapses)
+	}
+	sort.Sort(byLabel(bodies))
+	return bodies, nil
+}
+
+// GetBodyPartners returns the synapse counts of a body and its partners ordered by label.
+func (d *Data) GetBodyPartners(uuid dvid.UUID, label uint64) (*BodyPartners, error) {
+	table, err := d.getSynapseTable(uuid)
+	if err != nil {
+		return nil, err
+	}
+	body := &BodyPartners{BodySynapses: BodySynapses{Label: label}, Partners: []Partner{}}
+	if found, ok := table.bodies[label]; ok {
+		body.BodySynapses = found.BodySynapses
+	}
+	for _, partner := range table.partners[label] {
+		body.Partners = append(body.Partners, *partner)
+	}
+	sort.Sort(partnersByLabel(body.Partners))
+	return body, nil
+}
+
+// getSynapseTable returns the current join of synapses and labels, recomputing it if
+// the annotations or labels have changed since it was cached.
+func (d *Data) getSynapseTable(uuid dvid.UUID) (*synapseTable, error) {
+	if d.Labels == "" {
+		return nil, fmt.Errorf("Annotation data '%s' has no 'Labels' setting for synapse queries", d.DataName())
+	}
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	source, err := server.DatastoreService().DataServiceByUUID(uuid, d.Labels)
+	if err != nil {
+		return nil, err
+	}
+	labeler, ok := source.(pointLabeler)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' can't give labels at points for synapse queries", d.Labels)
+	}
+
+	key := synapseKey{d, versionID}
+	labelMods := labels.Modifications(d.DsetID)
+	synapseCache.Lock()
+	table, found := synapseCache.tables[key]
+	synapseCache.Unlock()
+	if found && table.labelMods == labelMods {
+		return table, nil
+	}
+
+	table, err = d.computeSynapseTable(uuid, labeler)
+	if err != nil {
+		return nil, err
+	}
+	table.labelMods = labelMods
+	synapseCache.Lock()
+	if synapseCache.tables == nil {
+		synapseCache.tables = make(map[synapseKey]*synapseTable)
+	}
+	synapseCache.tables[key] = table
+	synapseCache.Unlock()
+	return table, nil
+}
+
+// computeSynapseTable finds the body of every synapse annotation and its partners.
+func (d *Data) computeSynapseTable(uuid dvid.UUID, labeler pointLabeler) (*synapseTable, error) {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	minPt := dvid.Point3d{math.MinInt32, math.MinInt32, math.MinInt32}
+	maxPt := dvid.Point3d{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+	keyvalues, err := db.GetRange(d.NewElementKey(versionID, minPt), d.NewElementKey(versionID, maxPt))
+	if err != nil {
+		return nil, err
+	}
+
+	pointLabels := make(map[dvid.Point3d]uint64)
+	labelAt := func(pt dvid.Point3d) (uint64, error) {
+		if label, found := pointLabels[pt]; found {
+			return label, nil
+		}
+		label, err := labeler.GetLabelAtPoint(uuid, pt)
+		if err != nil {
+			return 0, err
+		}
+		pointLabels[pt] = label
+		return label, nil
+	}
+
+	table := &synapseTable{
+		bodies:   make(map[uint64]*BodyPartners),
+		partners: make(map[uint64]map[uint64]*Partner),
+	}
+	getBody := func(label uint64) *BodyPartners {
+		body, found := table.bodies[label]
+		if !found {
+			body = &BodyPartners{BodySynapses: BodySynapses{Label: label}}
+			table.bodies[label] = body
+		}
+		return body
+	}
+	getPartner := func(label, partner uint64) *Partner {
+		partners, found := table.partners[label]
+		if !found {
+			partners = make(map[uint64]*Partner)
+			table.partners[label] = partners
+		}
+		p, found := partners[partner]
+		if !found {
+			p = &Partner{Label: partner}
+			partners[partner] = p
+		}
+		return p
+	}
+
+	for _, kv := range keyvalues {
+		var elem Element
+		if err := json.Unmarshal(kv.V, &elem); err != nil {
+			return nil, err
+		}
+		if elem.Kind != PreSyn && elem.Kind != PostSyn {
+			continue
+		}
+		label, err := labelAt(elem.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if label == 0 {
+			continue
+		}
+		if elem.Kind == PostSyn {
+			getBody(label).PostSyn++
+			continue
+		}
+		getBody(label).PreSyn++
+		for _, rel := range elem.Rels {
+			if rel.Rel != PreSynTo {
+				continue
+			}
+			partner, err := labelAt(rel.To)
+			if err != nil {
+				return nil, err
+			}
+			if partner == 0 {
+				continue
+			}
+			getPartner(label, partner).Outgoing++
+			getPartner(partner, label).Incoming++
+		}
+	}
+	dvid.Log(dvid.Debug, "Joined synapses in '%s' with labels '%s': %d bodies\n",
+		d.DataName(), d.Labels, len(table.bodies))
+	return table, nil
+}
+
+type byLabel []BodySynapses
+
+func (s byLabel) Len() int           { return len(s) }
+func (s byLabel) Less(i, j int) bool { return s[i].Label < s[j].Label }
+func (s byLabel) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type partnersByLabel []Partner
+
+func (s partnersByLabel) Len() int           { return len(s) }
+func (s partnersByLabel) Less(i, j int) bool { return s[i].Label < s[j].Label }
+func (s partnersByLabel) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,84 @@
+/*
+	This file checks invariants between annotations and related data for validation jobs.
+*/
+
+package annotation
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// extentData is implemented by voxels data, e.g., grayscale or labels64, whose extents
+// should hold every annotation.
+type extentData interface {
+	VoxelExtents() (minPt, maxPt dvid.Point)
+}
+
+// within returns true if a point lies within the extents given by minPt and maxPt.
+func within(pt dvid.Point3d, minPt, maxPt dvid.Point) bool {
+	for dim := uint8(0); dim < 3; dim++ {
+		if pt[dim] < minPt.Value(dim) || pt[dim] > maxPt.Value(dim) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that every relationship of an annotation leads to another annotation
+// and that every annotation lies within the extents of the related voxels data, by
+// default the annotation's labels.
+func (d *Data) Validate(ctx context.Context, uuid dvid.UUID, related []dvid.DataString,
+	violation func(server.Violation)) error {
+
+	if len(related) == 0 && d.Labels != "" {
+		related = []dvid.DataString{d.Labels}
+	}
+	service := server.DatastoreService()
+	extents := make([]extentData, len(related))
+	for i, name := range related {
+		dataservice, err := service.DataServiceByUUID(uuid, name)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if extents[i], ok = dataservice.(extentData); !ok {
+			return fmt.Errorf("Data '%s' has no voxel extents to check annotations against", name)
+		}
+	}
+
+	// Annotations are streamed, and relationship targets are looked up individually, so
+	// memory use doesn't grow with the number of annotations.
+	minPt := dvid.Point3d{math.MinInt32, math.MinInt32, math.MinInt32}
+	maxPt := dvid.Point3d{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+	return d.ProcessElements(ctx, uuid, minPt, maxPt, func(elem *Element, value []byte) error {
+		for _, rel := range elem.Rels {
+			_, found, err := d.GetElement(uuid, rel.To)
+			if err != nil {
+				return err
+			}
+			if !found {
+				violation(server.Violation{
+					Check: "relationship-target",
+					Detail: fmt.Sprintf("%s at %s has %s relationship to %s, which has no annotation",
+						elem.Kind, elem.Pos, rel.Rel, rel.To),
+				})
+			}
+		}
+		for i, name := range related {
+			dataMin, dataMax := extents[i].VoxelExtents()
+			if dataMin == nil || dataMax == nil || !within(elem.Pos, dataMin, dataMax) {
+				violation(server.Violation{
+					Related: name,
+					Check:   "within-extents",
+					Detail:  fmt.Sprintf("%s at %s is outside the voxel extents of '%s'", elem.Kind, elem.Pos, name),
+				})
+			}
+		}
+		return nil
+	})
+}
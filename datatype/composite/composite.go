@@ -0,0 +1,655 @@
+/*
+	Package composite implements DVID support for virtual data defined as a function of
+	other voxels data, e.g., grayscale masked by an ROI or the ratio of two channels.
+	Composite voxels are computed from their sources on each read and never stored.
+*/
+package composite
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	Version = "0.1"
+	RepoUrl = "github.com/janelia-flyem/dvid/datatype/composite"
+)
+
+const HelpMessage = `
+API for 'composite' datatype (github.com/janelia-flyem/dvid/datatype/composite)
+===============================================================================
+
+Command-line:
+
+$ dvid dataset <UUID> new composite <data name> <settings...>
+
+	Adds newly named composite data to dataset with specified UUID.  Composite data is
+	virtual: its voxels are computed from other voxels data of the same dataset on each
+	read and never stored.
+
+	Example:
+
+	$ dvid dataset 3f8c new composite ratio 'Definition={"Op": "ratio", "Sources": ["ch1", "ch2"], "Scale": 100}'
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of data to create, e.g., "ratio"
+    settings       Configuration settings in "key=value" format separated by spaces.
+
+    Configuration Settings (case-insensitive keys)
+
+    Definition     JSON definition of the composite voxels (required).  When data is created
+                   via HTTP POST, the definition can be given as a JSON object:
+
+                   POST <api URL>/dataset/3f8c/new/composite/masked
+                   {"Definition": {"Op": "mask", "Sources": ["grayscale"], "ROI": "medulla"}}
+
+    The definition has the following fields:
+
+    Op             "mask", "add", "subtract", "multiply", or "ratio".
+    Sources        Names of single channel voxels data, e.g., grayscale8.  "mask" takes one
+                   source, "subtract" and "ratio" take two, and "add" and "multiply" take two
+                   or more.  Ops are computed in floating point, so sources with 64-bit
+                   integer values, e.g., labels64, can only be masked without a Scale,
+                   Offset, or change of Values, which copies their values exactly.
+    ROI            Name of roi data.  Voxels outside the ROI are zero.  Required for "mask".
+    Scale          Multiplier applied to the result of the op (default 1).
+    Offset         Value added to the scaled result (default 0).
+    Values         Data type of the composite voxels, e.g., [{"DataType": "float32", "Label": "ratio"}].
+                   The default is the data type of the first source.  Results are clamped to
+                   the range of integer data types, and a ratio with a zero denominator is zero.
+
+    ------------------
+
+HTTP API (Level 2 REST):
+
+GET  <api URL>/node/<UUID>/<data name>/help
+
+	Returns data-specific help message.
+
+
+GET  <api URL>/node/<UUID>/<data name>/info
+
+    Retrieves data properties including the definition.
+
+    Example:
+
+    GET <api URL>/node/3f8c/ratio/info
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of composite data.
+
+
+GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
+
+    Computes composite voxels from the sources at the given version.  2d slices are
+    returned as images in the given format, e.g., "png" (default) or "jpg".  3d
+    subvolumes are returned as little-endian binary data with x fastest.
+
+    Example:
+
+    GET <api URL>/node/3f8c/ratio/raw/0_1/512_256/0_0_100/jpg
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of composite data.
+    dims          The axes of data extraction in form "i_j_k,..."  Example: "0_2" can be XZ.
+                    Slice strings ("xy", "xz", or "yz") are also accepted.
+    size          Size in voxels along each dimension specified in <dims>.
+    offset        Gives coordinate of first voxel using dimensionality of data.
+    format        Valid image formats for 2d slices, e.g., "png" or "jpg".
+`
+
+func init() {
+	compositetype := NewDatatype()
+	compositetype.DatatypeID = &datastore.DatatypeID{
+		Name:    "composite",
+		Url:     RepoUrl,
+		Version: Version,
+	}
+	datastore.RegisterDatatype(compositetype)
+
+	// Need to register types that will be used to fulfill interfaces.
+	gob.Register(&Datatype{})
+	gob.Register(&Data{})
+}
+
+// Ops that compute composite voxels from sources.
+const (
+	Mask     = "mask"
+	Add      = "add"
+	Subtract = "subtract"
+	Multiply = "multiply"
+	Ratio    = "ratio"
+)
+
+// Definition describes how composite voxels are computed from other data.
+type Definition struct {
+	Op      string
+	Sources []dvid.DataString
+	ROI     dvid.DataString `json:",omitempty"`
+	Scale   float64
+	Offset  float64
+
+	// Values gives the data type of composite voxels if it differs from the first source.
+	Values dvid.DataValues `json:",omitempty"`
+}
+
+// check returns an error if the definition can't be computed.
+func (def *Definition) check() error {
+	var minSources, maxSources int
+	switch def.Op {
+	case Mask:
+		minSources, maxSources = 1, 1
+		if def.ROI == "" {
+			return fmt.Errorf("Composite op %q requires an ROI", def.Op)
+		}
+	case Subtract, Ratio:
+		minSources, maxSources = 2, 2
+	case Add, Multiply:
+		minSources, maxSources = 2, math.MaxInt32
+	default:
+		return fmt.Errorf("Unknown composite op %q", def.Op)
+	}
+	if len(def.Sources) < minSources || len(def.Sources) > maxSources {
+		return fmt.Errorf("Composite op %q can't use %d sources", def.Op, len(def.Sources))
+	}
+	if def.Values != nil && len(def.Values) != 1 {
+		return fmt.Errorf("Composite data must have single channel values")
+	}
+	return nil
+}
+
+// apply computes the op on the source values of one voxel, before scaling.
+func (def *Definition) apply(values []float64) float64 {
+	switch def.Op {
+	case Add:
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	case Subtract:
+		return values[0] - values[1]
+	case Multiply:
+		product := 1.0
+		for _, v := range values {
+			product *= v
+		}
+		return product
+	case Ratio:
+		if values[1] == 0 {
+			return 0
+		}
+		return values[0] / values[1]
+	default:
+		return values[0]
+	}
+}
+
+// exact returns true if composite voxels are copies of source values, which happens for
+// masks that don't scale, offset, or convert the values.
+func (def *Definition) exact(sourceType, t dvid.DataType) bool {
+	return def.Op == Mask && def.Scale == 1 && def.Offset == 0 && sourceType == t
+}
+
+// clamp limits a value to the range of an integer data type.  The 64-bit limits are the
+// largest float64 values that convert without overflow, and NaN becomes zero.
+func clamp(v float64, t dvid.DataType) float64 {
+	var min, max float64
+	switch t {
+	case dvid.T_uint8:
+		min, max = 0, math.MaxUint8
+	case dvid.T_int8:
+		min, max = math.MinInt8, math.MaxInt8
+	case dvid.T_uint16:
+		min, max = 0, math.MaxUint16
+	case dvid.T_int16:
+		min, max = math.MinInt16, math.MaxInt16
+	case dvid.T_uint32:
+		min, max = 0, math.MaxUint32
+	case dvid.T_int32:
+		min, max = math.MinInt32, math.MaxInt32
+	case dvid.T_uint64:
+		min, max = 0, math.Nextafter(1<<64, 0)
+	case dvid.T_int64:
+		min, max = math.MinInt64, math.Nextafter(1<<63, 0)
+	default:
+		return v
+	}
+	if math.IsNaN(v) {
+		return 0
+	}
+	return math.Max(min, math.Min(max, v))
+}
+
+// Datatype embeds the datastore's Datatype to create a unique type for composite functions.
+type Datatype struct {
+	datastore.Datatype
+}
+
+// NewDatatype returns a pointer to a new composite Datatype with default values set.
+func NewDatatype() (dtype *Datatype) {
+	dtype = new(Datatype)
+	dtype.Requirements = &storage.Requirements{
+		BulkIniter: false,
+		BulkWriter: false,
+		Batcher:    false,
+	}
+	return
+}
+
+// --- TypeService interface ---
+
+// NewData returns a pointer to new composite data given its definition.
+func (dtype *Datatype) NewDataService(id *datastore.DataID, c dvid.Config) (datastore.DataService, error) {
+	basedata, err := datastore.NewDataService(id, dtype, c)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{Data: basedata, Definition: Definition{Scale: 1}}
+	found, err := c.GetJSON("Definition", &(data.Definition))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("Composite data requires a 'Definition' setting")
+	}
+	if err := data.Definition.check(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (dtype *Datatype) Help() string {
+	return fmt.Sprintf(HelpMessage)
+}
+
+// Data embeds the datastore's Data and extends it with the composite definition.
+type Data struct {
+	*datastore.Data
+
+	Definition Definition
+}
+
+// GetByUUID returns a pointer to composite data given a version (UUID) and data name.
+func GetByUUID(uuid dvid.UUID, name dvid.DataString) (*Data, error) {
+	service := server.DatastoreService()
+	if service == nil {
+		return nil, fmt.Errorf("No datastore service established yet!")
+	}
+	source, err := service.DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := source.(*Data)
+	if !ok {
+		return nil, fmt.Errorf("Instance '%s' is not a composite datatype!", name)
+	}
+	return data, nil
+}
+
+// sources returns the voxels data the composite is computed from.
+func (d *Data) sources(uuid dvid.UUID) ([]voxels.IntHandler, error) {
+	service := server.DatastoreService()
+	sources := make([]voxels.IntHandler, len(d.Definition.Sources))
+	for n, name := range d.Definition.Sources {
+		dataservice, err := service.DataServiceByUUID(uuid, name)
+		if err != nil {
+			return nil, err
+		}
+		source, ok := dataservice.(voxels.IntHandler)
+		if !ok {
+			return nil, fmt.Errorf("Source '%s' of composite '%s' is not voxels data", name, d.DataName())
+		}
+		if len(source.Values()) != 1 {
+			return nil, fmt.Errorf("Source '%s' of composite '%s' must have single channel values",
+				name, d.DataName())
+		}
+		sources[n] = source
+	}
+	return sources, nil
+}
+
+// Values returns the data type of the composite voxels at a version.
+func (d *Data) Values(uuid dvid.UUID) (dvid.DataValues, error) {
+	if d.Definition.Values != nil {
+		return d.Definition.Values, nil
+	}
+	sources, err := d.sources(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return dvid.DataValues{{T: sources[0].Values()[0].T, Label: string(d.DataName())}}, nil
+}
+
+// roiMask returns a function that tells whether a voxel lies within the ROI, only
+// considering the ROI blocks that intersect the geometry.
+func (d *Data) roiMask(uuid dvid.UUID, geom dvid.Geometry) (func(dvid.Point3d) bool, error) {
+	roiData, err := roi.GetByUUID(uuid, d.Definition.ROI)
+	if err != nil {
+		return nil, err
+	}
+	spans, err := roiData.GetSpans(uuid)
+	if err != nil {
+		return nil, err
+	}
+	bs := roiData.BlockSize
+	start, end := geom.StartPoint(), geom.EndPoint()
+	type row struct{ z, y int32 }
+	rows := make(map[row][]roi.Span)
+	for _, s := range spans {
+		if s[0] < floorDiv(start.Value(2), bs[2]) || s[0] > floorDiv(end.Value(2), bs[2]) ||
+			s[1] < floorDiv(start.Value(1), bs[1]) || s[1] > floorDiv(end.Value(1), bs[1]) {
+			continue
+		}
+		r := row{s[0], s[1]}
+		rows[r] = append(rows[r], s)
+	}
+	return func(pt dvid.Point3d) bool {
+		x := floorDiv(pt[0], bs[0])
+		for _, s := range rows[row{floorDiv(pt[2], bs[2]), floorDiv(pt[1], bs[1])}] {
+			if x >= s[2] && x <= s[3] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func floorDiv(a, b int32) int32 {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// voxelPoint returns the coordinate of the n-th voxel of a 3d geometry, where voxels are
+// ordered along the geometry's shape dimensions with the first fastest.
+func voxelPoint(geom dvid.Geometry, n int64) (dvid.Point3d, error) {
+	shape, size, start := geom.DataShape(), geom.Size(), geom.StartPoint()
+	if start.NumDims() != 3 {
+		return dvid.Point3d{}, fmt.Errorf("Composite data only supports 3d coordinates")
+	}
+	pt := dvid.Point3d{start.Value(0), start.Value(1), start.Value(2)}
+	for axis := uint8(0); axis < uint8(shape.ShapeDimensions()); axis++ {
+		dim, err := shape.ShapeDimension(axis)
+		if err != nil {
+			return dvid.Point3d{}, err
+		}
+		length := int64(size.Value(axis))
+		pt[dim] += int32(n % length)
+		n /= length
+	}
+	return pt, nil
+}
+
+// AdmitRequest reserves the estimated memory of computing composite voxels in the
+// geometry, i.e., the voxels of every source and the result, waiting if the server's
+// memory budget is in use.  Requests of more than voxels.MaxVoxelsRequest voxels are
+// refused.  The returned function releases the reservation.
+func (d *Data) AdmitRequest(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry) (release func(), err error) {
+	numVoxels := int64(1)
+	size := geom.Size()
+	for dim := uint8(0); dim < size.NumDims(); dim++ {
+		if numVoxels *= int64(size.Value(dim)); numVoxels <= 0 || numVoxels > voxels.MaxVoxelsRequest {
+			return nil, fmt.Errorf("Composite requests must have 1 to %d voxels", int64(voxels.MaxVoxelsRequest))
+		}
+	}
+	sources, err := d.sources(uuid)
+	if err != nil {
+		return nil, err
+	}
+	values, err := d.Values(uuid)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerVoxel := int64(values.BytesPerElement())
+	for _, source := range sources {
+		bytesPerVoxel += int64(source.Values().BytesPerElement())
+	}
+	return server.AdmitMemory(ctx, numVoxels*bytesPerVoxel)
+}
+
+// GetVoxels computes the composite voxels in a geometry at a version from the sources.
+// Callers should admit the request first.  See AdmitRequest.
+func (d *Data) GetVoxels(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry) (voxels.ExtHandler, error) {
+	sources, err := d.sources(uuid)
+	if err != nil {
+		return nil, err
+	}
+	values, err := d.Values(uuid)
+	if err != nil {
+		return nil, err
+	}
+	t := values[0].T
+	for n, source := range sources {
+		switch sourceType := source.Values()[0].T; sourceType {
+		case dvid.T_uint64, dvid.T_int64:
+			if !d.Definition.exact(sourceType, t) {
+				return nil, fmt.Errorf("Source '%s' of composite '%s' has 64-bit integer values, which can only be masked without scaling or conversion",
+					d.Definition.Sources[n], d.DataName())
+			}
+		}
+	}
+	var inside func(dvid.Point3d) bool
+	if d.Definition.ROI != "" {
+		if inside, err = d.roiMask(uuid, geom); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceVoxels := make([]voxels.ExtHandler, len(sources))
+	for n, source := range sources {
+		e, err := source.NewExtHandler(geom, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dvid.PutBuffer(e.Data())
+		if err := voxels.GetVoxels(ctx, uuid, source, e); err != nil {
+			return nil, err
+		}
+		sourceVoxels[n] = e
+	}
+
+	outBytes := int64(values.BytesPerElement())
+	numVoxels := geom.NumVoxels()
+	data := make([]byte, numVoxels*outBytes)
+	sourceValues := make([]float64, len(sources))
+	for i := int64(0); i < numVoxels; i++ {
+		if inside != nil {
+			pt, err := voxelPoint(geom, i)
+			if err != nil {
+				return nil, err
+			}
+			if !inside(pt) {
+				continue
+			}
+		}
+		if e := sourceVoxels[0]; d.Definition.exact(e.Values()[0].T, t) {
+			copyValue(data[i*outBytes:(i+1)*outBytes], e.Data()[i*outBytes:], e.ByteOrder())
+			continue
+		}
+		for n, e := range sourceVoxels {
+			bytesPerVoxel := int64(e.Values().BytesPerElement())
+			sourceValues[n] = voxels.ReadValue(e.Data()[i*bytesPerVoxel:], e.Values()[0].T, e.ByteOrder())
+		}
+		v := d.Definition.apply(sourceValues)*d.Definition.Scale + d.Definition.Offset
+		voxels.WriteValue(data[i*outBytes:], t, binary.LittleEndian, clamp(v, t))
+	}
+	stride := geom.Size().Value(0) * int32(outBytes)
+	return voxels.NewVoxels(geom, values, data, stride, binary.LittleEndian), nil
+}
+
+// copyValue copies a value into dst as little-endian bytes, reversing the bytes of a
+// big-endian source value.
+func copyValue(dst, src []byte, byteOrder binary.ByteOrder) {
+	if byteOrder != binary.BigEndian {
+		copy(dst, src)
+		return
+	}
+	for k := range dst {
+		dst[k] = src[len(dst)-1-k]
+	}
+}
+
+// JSONString returns the JSON for this Data's configuration
+func (d *Data) JSONString() (jsonStr string, err error) {
+	m, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// --- DataService interface ---
+
+// DoRPC acts as a switchboard for RPC commands.
+func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+	return d.UnknownCommand(request)
+}
+
+// DoHTTP handles all incoming HTTP requests for this data.
+func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+
+	// Allow cross-origin resource sharing.
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	// Break URL request into arguments
+	url := r.URL.Path[len(server.WebAPIPath):]
+	parts := strings.Split(url, "/")
+	if len(parts) < 4 {
+		err := fmt.Errorf("Incomplete API request")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+
+	switch parts[3] {
+	case "help":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, d.Help())
+		return nil
+
+	case "info":
+		jsonStr, err := d.JSONString()
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
+		return nil
+
+	case "raw":
+		if strings.ToLower(r.Method) != "get" {
+			err := fmt.Errorf("Composite data '%s' is computed on read and can't be written", d.DataName())
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 7 {
+			err := fmt.Errorf("'raw' must be followed by shape/size/offset")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		planeStr := dvid.DataShapeString(parts[4])
+		plane, err := planeStr.DataShape()
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var formatStr string
+		if len(parts) >= 8 {
+			formatStr = parts[7]
+		}
+		switch plane.ShapeDimensions() {
+		case 2:
+			slice, err := dvid.NewSliceFromStrings(planeStr, parts[6], parts[5], "_")
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if err := d.CheckGeometry(slice); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
+			release, err := d.AdmitRequest(r.Context(), uuid, slice)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer release()
+			e, err := d.GetVoxels(r.Context(), uuid, slice)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			img, err := e.GetImage2d()
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			formatStr = dvid.NegotiateImageFormat(w, r, formatStr)
+			if err := dvid.WriteImageHttp(w, img.Get(), formatStr); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP GET composite %s of '%s' (%s)", plane, d.DataName(), r.URL)
+		case 3:
+			subvol, err := dvid.NewSubvolumeFromStrings(parts[6], parts[5], "_")
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if err := d.CheckGeometry(subvol); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
+			release, err := d.AdmitRequest(r.Context(), uuid, subvol)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer release()
+			e, err := d.GetVoxels(r.Context(), uuid, subvol)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			if _, err := w.Write(e.Data()); err != nil {
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP GET composite %s of '%s' (%s)", subvol, d.DataName(), r.URL)
+		default:
+			err := fmt.Errorf("Composite data supports shapes of only 2 and 3 dimensions")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+
+	default:
+		err := fmt.Errorf("Unrecognized API call '%s' for composite data '%s'.  See API help.",
+			parts[3], d.DataName())
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	return nil
+}
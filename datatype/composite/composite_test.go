@@ -0,0 +1,198 @@
+package composite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type DataSuite struct {
+	dir     string
+	service *server.Service
+}
+
+var _ = Suite(&DataSuite{})
+
+// This will setup a new datastore and open it up, keeping the service pointer in
+// the DataSuite.
+func (suite *DataSuite) SetUpSuite(c *C) {
+	// Make a temporary testing directory that will be auto-deleted after testing.
+	suite.dir = c.MkDir()
+
+	// Create a new datastore.
+	err := datastore.Init(suite.dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+
+	// Open the datastore
+	suite.service, err = server.OpenDatastore(suite.dir)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TearDownSuite(c *C) {
+	suite.service.Shutdown()
+}
+
+// putGrayscale creates grayscale8 data with a 32x32x32 volume of one value at the origin.
+func (suite *DataSuite) putGrayscale(c *C, uuid dvid.UUID, name dvid.DataString, value byte) {
+	c.Assert(suite.service.NewData(uuid, "grayscale8", name, dvid.NewConfig()), IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(uuid, name)
+	c.Assert(err, IsNil)
+	data, ok := dataservice.(*voxels.Data)
+	c.Assert(ok, Equals, true)
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{32, 32, 32})
+	e, err := data.NewExtHandler(subvol, bytes.Repeat([]byte{value}, 32*32*32))
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), uuid, data, e), IsNil)
+}
+
+func (suite *DataSuite) TestDefinition(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "composite", "none", dvid.NewConfig()), NotNil)
+
+	for _, definition := range []string{
+		`{"Op": "divide", "Sources": ["ch1", "ch2"]}`,
+		`{"Op": "ratio", "Sources": ["ch1"]}`,
+		`{"Op": "mask", "Sources": ["ch1"]}`,
+		`{"Op": "add", "Sources": ["ch1", "ch2"], "Values": []}`,
+	} {
+		config := dvid.NewConfig()
+		config.Set("Definition", definition)
+		c.Assert(suite.service.NewData(root, "composite", "bad", config), NotNil)
+	}
+
+	config := dvid.NewConfig()
+	config.Set("Definition", `{"Op": "add", "Sources": ["ch1", "ch2", "ch3"]}`)
+	c.Assert(suite.service.NewData(root, "composite", "sum", config), IsNil)
+	sum, err := GetByUUID(root, "sum")
+	c.Assert(err, IsNil)
+	c.Assert(sum.Definition.Scale, Equals, 1.0)
+	c.Assert(sum.Definition.Sources, DeepEquals, []dvid.DataString{"ch1", "ch2", "ch3"})
+}
+
+func (suite *DataSuite) TestRatio(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	suite.putGrayscale(c, root, "ch1", 200)
+	suite.putGrayscale(c, root, "ch2", 50)
+
+	config := dvid.NewConfig()
+	config.Set("Definition", `{"Op": "ratio", "Sources": ["ch1", "ch2"], "Scale": 10}`)
+	c.Assert(suite.service.NewData(root, "composite", "ratio", config), IsNil)
+	ratio, err := GetByUUID(root, "ratio")
+	c.Assert(err, IsNil)
+
+	// Voxels beyond the written sources have a zero denominator.
+	subvol := dvid.NewSubvolume(dvid.Point3d{30, 0, 0}, dvid.Point3d{4, 1, 1})
+	e, err := ratio.GetVoxels(context.Background(), root, subvol)
+	c.Assert(err, IsNil)
+	c.Assert(e.Data(), DeepEquals, []byte{40, 40, 0, 0})
+
+	// Integer results are clamped.
+	config = dvid.NewConfig()
+	config.Set("Definition", `{"Op": "subtract", "Sources": ["ch2", "ch1"], "Offset": 100}`)
+	c.Assert(suite.service.NewData(root, "composite", "diff", config), IsNil)
+	diff, err := GetByUUID(root, "diff")
+	c.Assert(err, IsNil)
+	e, err = diff.GetVoxels(context.Background(), root, subvol)
+	c.Assert(err, IsNil)
+	c.Assert(e.Data(), DeepEquals, []byte{0, 0, 100, 100})
+}
+
+func (suite *DataSuite) TestMask(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	suite.putGrayscale(c, root, "grayscale", 200)
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "16,16,16")
+	c.Assert(suite.service.NewData(root, "roi", "region", config), IsNil)
+	region, err := roi.GetByUUID(root, "region")
+	c.Assert(err, IsNil)
+	c.Assert(region.PutSpans(root, []roi.Span{{0, 0, 0, 0}}), IsNil)
+
+	config = dvid.NewConfig()
+	config.Set("Definition", `{"Op": "mask", "Sources": ["grayscale"], "ROI": "region"}`)
+	c.Assert(suite.service.NewData(root, "composite", "masked", config), IsNil)
+	masked, err := GetByUUID(root, "masked")
+	c.Assert(err, IsNil)
+
+	subvol := dvid.NewSubvolume(dvid.Point3d{14, 15, 15}, dvid.Point3d{3, 2, 1})
+	e, err := masked.GetVoxels(context.Background(), root, subvol)
+	c.Assert(err, IsNil)
+	c.Assert(e.Data(), DeepEquals, []byte{200, 200, 0, 0, 0, 0})
+
+	// Slices are masked along their own axes.
+	slice, err := dvid.NewOrthogSlice(dvid.XZ, dvid.Point3d{15, 3, 14}, dvid.Point2d{2, 3})
+	c.Assert(err, IsNil)
+	e, err = masked.GetVoxels(context.Background(), root, slice)
+	c.Assert(err, IsNil)
+	c.Assert(e.Data(), DeepEquals, []byte{200, 0, 200, 0, 0, 0})
+}
+
+func (suite *DataSuite) TestLabels(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "labels64", "bodies", dvid.NewConfig()), IsNil)
+	bodies, err := labels64.GetByUUID(root, "bodies")
+	c.Assert(err, IsNil)
+	const label = uint64(1)<<60 + 1
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{32, 32, 32})
+	data := make([]byte, 32*32*32*8)
+	for i := 0; i < len(data); i += 8 {
+		bodies.ByteOrder.PutUint64(data[i:], label)
+	}
+	e, err := bodies.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, bodies, e), IsNil)
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "16,16,16")
+	c.Assert(suite.service.NewData(root, "roi", "labelregion", config), IsNil)
+	region, err := roi.GetByUUID(root, "labelregion")
+	c.Assert(err, IsNil)
+	c.Assert(region.PutSpans(root, []roi.Span{{0, 0, 0, 0}}), IsNil)
+
+	// Masked labels beyond 2^53 are copied exactly.
+	config = dvid.NewConfig()
+	config.Set("Definition", `{"Op": "mask", "Sources": ["bodies"], "ROI": "labelregion"}`)
+	c.Assert(suite.service.NewData(root, "composite", "maskedbodies", config), IsNil)
+	masked, err := GetByUUID(root, "maskedbodies")
+	c.Assert(err, IsNil)
+	e, err = masked.GetVoxels(context.Background(), root, dvid.NewSubvolume(dvid.Point3d{15, 0, 0}, dvid.Point3d{2, 1, 1}))
+	c.Assert(err, IsNil)
+	c.Assert(binary.LittleEndian.Uint64(e.Data()), Equals, label)
+	c.Assert(binary.LittleEndian.Uint64(e.Data()[8:]), Equals, uint64(0))
+
+	// Other ops on 64-bit labels are refused rather than rounded.
+	config = dvid.NewConfig()
+	config.Set("Definition", `{"Op": "add", "Sources": ["bodies", "bodies"]}`)
+	c.Assert(suite.service.NewData(root, "composite", "sumbodies", config), IsNil)
+	sum, err := GetByUUID(root, "sumbodies")
+	c.Assert(err, IsNil)
+	_, err = sum.GetVoxels(context.Background(), root, dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{2, 1, 1}))
+	c.Assert(err, NotNil)
+
+	// Huge requests are refused before any memory is used.
+	_, err = masked.AdmitRequest(context.Background(), root,
+		dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{100000, 100000, 100000}))
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestClamp(c *C) {
+	c.Assert(clamp(1e30, dvid.T_uint64) < math.MaxUint64, Equals, true)
+	c.Assert(clamp(1e30, dvid.T_int64) < math.MaxInt64, Equals, true)
+	c.Assert(clamp(math.NaN(), dvid.T_uint8), Equals, 0.0)
+	c.Assert(clamp(-5, dvid.T_uint8), Equals, 0.0)
+}
@@ -70,7 +70,7 @@ func (d Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
 // ReadDir returns a list of keys available for this data and its version.
 func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	minDataKey := &datastore.DataKey{d.Data.DsetID, d.Data.ID, d.GetVersionID(), dvid.IndexString("")}
-	maxDataKey := &datastore.DataKey{d.Data.DsetID, d.Data.ID, d.GetVersionID() + 1, dvid.IndexString("")}
+	maxDataKey := &datastore.DataKey{d.Data.DsetID, d.Data.ID + 1, d.GetVersionID(), dvid.IndexString("")}
 	db, err := server.OrderedKeyValueGetter()
 	if err != nil {
 		return nil, fuse.EIO
@@ -82,7 +82,7 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	ddirs := []fuse.Dirent{}
 	for _, key := range keys {
 		dataKey, ok := key.(*datastore.DataKey)
-		if ok {
+		if ok && dataKey.Data == d.Data.ID && dataKey.Version == d.GetVersionID() {
 			entry := fuse.Dirent{
 				Inode: storage.GenerateInode(d.Data.LocalID(), d.GetVersionID(), dataKey.Index),
 				Name:  dataKey.Index.String(),
@@ -4,12 +4,13 @@
 package keyvalue
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -82,6 +83,14 @@ $ dvid -stdin node <UUID> <data name> put <key>  <  some_file
     file name     Full file path of the value to be stored, visible to server, or you must
                     use the -stdin flag and pipe the file data in.
 
+$ dvid mirror <remote URL> <UUID> <data name> keys=<key1>,<key2>,... <settings...>
+$ dvid mirror <remote URL> <UUID> <data name> prefix=<prefix> <settings...>
+
+    Starts a job copying the values of keys from keyvalue data of another DVID server into
+    existing local keyvalue data.  Either the keys are listed or all remote keys starting
+    with a prefix are copied, e.g., "prefix=meshes/".  An empty prefix copies every key.
+    See "dvid help" for the other settings.
+
 $ dvid node <UUID> <data name> mount <directory>
 
 	Creates a FUSE file system at given mount directory.  Each version will have
@@ -129,7 +138,7 @@ DEL  <api URL>/node/<UUID>/<data name>/<key>  (TO DO)
     GET <api URL>/node/3f8c/stuff/mykey
 
     Returns the data associated with the key "mykey" of the data "stuff" in version
-    node 3f8c.
+    node 3f8c, or if the key wasn't written in that node, in its nearest ancestor.
 
     The "Content-type" of the HTTP response (and usually the request) are
     "application/octet-stream" for arbitrary binary data.
@@ -139,6 +148,72 @@ DEL  <api URL>/node/<UUID>/<data name>/<key>  (TO DO)
     UUID          Hexidecimal string with enough characters to uniquely identify a version node.
     data name     Name of data to add/retrieve.
     key           An alphanumeric key.
+
+    GET replies with an ETag header for the value.  A POST with an "If-Match" header
+    listing ETags only stores the value if the current value's ETag is listed (or for
+    "*", if the key has a value), and a POST with "If-None-Match: *" only stores the
+    value if the key has none.  Otherwise, the POST fails with status 412, so clients can
+    read the value again, merge their changes, and retry.
+
+
+GET  <api URL>/node/<UUID>/<data name>/archive?keys=<key1>,<key2>,...[&format=<format>]
+
+    Streams the values of many keys as one zip or tar archive with the keys as file names,
+    avoiding a separate request per key.  The keys option may also be repeated.  Keys
+    without values are left out of the archive.  At most MaxListKeys keys may be given.
+    Without a keys option, GET retrieves the value of a key named "archive".
+
+    Example: 
+
+    GET <api URL>/node/3f8c/stuff/archive?keys=a.txt,b.txt&format=tar
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to retrieve.
+    keys          Comma-separated keys that are valid file names, i.e., not absolute paths
+                    and without ".." elements.
+    format        "zip" (default) or "tar".
+    checksums     "true" ends the archive with "dvid-checksums.json" listing the size and
+                    SHA-256 checksum of every file.
+
+GET  <api URL>/node/<UUID>/<data name>/keys[?prefix=<prefix>]
+
+    Returns a JSON list of the keys, optionally only those starting with a prefix, that
+    have values written at the version.  With an "Accept: application/x-ndjson" header
+    or "format=ndjson", keys are streamed one JSON string per line as they're found and
+    MaxListKeys doesn't apply.  An error after streaming starts ends the stream with a
+    line {"Error": "<message>"}.  A key named "keys" must be retrieved with the RPC "get".
+
+    Example: 
+
+    GET <api URL>/node/3f8c/stuff/keys?prefix=meshes/
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    prefix        Only list keys starting with this string.
+
+POST <api URL>/node/<UUID>/<data name>/exists
+
+    Checks which of a JSON list of keys have values written at the version, so an
+    interrupted load can be resumed by only writing the missing keys.  Values of ancestor
+    versions don't count.  Returns a bitmask where bit i, counting from the least
+    significant bit of the first byte, is set if the i-th key exists.  The number of keys
+    checked and found are given in the X-Dvid-Keys and X-Dvid-Found headers.  A key named
+    "exists" can't be stored with POST.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/stuff/exists
+
+    ["a.txt", "b.txt", "c.txt"]
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
 `
 
 func init() {
@@ -193,7 +268,25 @@ type Data struct {
 	*datastore.Data
 }
 
-// GetData gets a value using a key at a given uuid
+// GetByUUID returns a pointer to keyvalue data given a version (UUID) and data name.
+func GetByUUID(uuid dvid.UUID, name dvid.DataString) (*Data, error) {
+	service := server.DatastoreService()
+	if service == nil {
+		return nil, fmt.Errorf("No datastore service established yet!")
+	}
+	source, err := service.DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := source.(*Data)
+	if !ok {
+		return nil, fmt.Errorf("Instance '%s' is not a keyvalue datatype!", name)
+	}
+	return data, nil
+}
+
+// GetData gets the value of a key visible at a given uuid, i.e., the value written at
+// the version or else at its nearest ancestor.
 func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool, err error) {
 	// Compute the key
 	versionID, e := server.VersionLocalID(uuid)
@@ -203,13 +296,12 @@ func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool,
 	}
 	key := d.DataKey(versionID, dvid.IndexString(keyStr))
 
-	// Get the data
-	db, e := server.OrderedKeyValueGetter()
-	if e != nil {
-		err = e
-		return
-	}
-	data, e := db.Get(key)
+	// Get the value visible at the version, written at it or else at its nearest ancestor.
+	var data []byte
+	e = server.DatastoreService().ProcessVisible(context.Background(), uuid, d.ID, key.Index, key.Index,
+		func(kv *storage.KeyValue) {
+			data = kv.V
+		})
 	if e != nil {
 		err = fmt.Errorf("Error in retrieving key '%s': %s", keyStr, e.Error())
 		return
@@ -227,8 +319,20 @@ func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool,
 	return
 }
 
+// lockKey keeps writes to a key from interleaving with conditional writes.  It returns
+// the unlock function.
+func (d *Data) lockKey(uuid dvid.UUID, keyStr string) func() {
+	return server.LockWrite(fmt.Sprintf("%s/%s/%s", uuid, d.DataName(), keyStr))
+}
+
 // PutData puts a key/value at a given uuid
 func (d *Data) PutData(uuid dvid.UUID, keyStr string, value []byte) error {
+	defer d.lockKey(uuid, keyStr)()
+	return d.putData(uuid, keyStr, value)
+}
+
+// putData puts a key/value at a given uuid while the key is locked.
+func (d *Data) putData(uuid dvid.UUID, keyStr string, value []byte) error {
 	// Compute the key
 	versionID, err := server.VersionLocalID(uuid)
 	if err != nil {
@@ -248,6 +352,163 @@ func (d *Data) PutData(uuid dvid.UUID, keyStr string, value []byte) error {
 	return db.Put(key, serialization)
 }
 
+// putConditionally puts a key/value if the request's If-Match or If-None-Match
+// preconditions are met by the current value, replying with an error otherwise.
+func (d *Data) putConditionally(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, keyStr string,
+	value []byte) error {
+
+	defer d.lockKey(uuid, keyStr)()
+	if server.HasPreconditions(r) {
+		old, found, err := d.GetData(uuid, keyStr)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := server.CheckPreconditions(r, server.ETag(old), found); err != nil {
+			server.PreconditionFailed(w, r, err.Error())
+			return err
+		}
+	}
+	if err := d.putData(uuid, keyStr, value); err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	w.Header().Set("ETag", server.ETag(value))
+	return nil
+}
+
+// WriteArchive writes the values of keys at a given uuid into an archive with the keys as
+// file names, returning the number of values written.  Keys without values are skipped.
+func (d *Data) WriteArchive(uuid dvid.UUID, archive *dvid.ArchiveWriter, keys []string) (int, error) {
+	var written int
+	for _, keyStr := range keys {
+		value, found, err := d.GetData(uuid, keyStr)
+		if err != nil {
+			return written, err
+		}
+		if !found {
+			continue
+		}
+		if err := archive.WriteFile(keyStr, value); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, archive.Close()
+}
+
+// prefixEnd returns the least string greater than all strings with a prefix, if any.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// ProcessKeys calls f on each key with a prefix that has a value written at a version,
+// stopping at the first error or once ctx is done.  Values of ancestor versions don't
+// count.  Keys are read in batches, so f may be slow without holding the database open.
+func (d *Data) ProcessKeys(ctx context.Context, uuid dvid.UUID, prefix string, f func(key string) error) error {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return err
+	}
+	// End the range at the first key after all keys with the prefix, at the same version
+	// so other versions of keys are filtered.  Without such a key, i.e., for an empty
+	// prefix, the range spans the whole instance.
+	firstKey := d.DataKey(versionID, dvid.IndexString(prefix))
+	lastKey := &datastore.DataKey{d.DsetID, d.ID + 1, versionID, dvid.IndexString("")}
+	if end, found := prefixEnd(prefix); found {
+		lastKey = d.DataKey(versionID, dvid.IndexString(end))
+	}
+	return storage.ProcessRangeBatches(ctx, db, firstKey, lastKey, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			dataKey, ok := kv.K.(*datastore.DataKey)
+			if !ok || dataKey.Data != d.ID || dataKey.Version != versionID {
+				return nil
+			}
+			if key := dataKey.Index.String(); strings.HasPrefix(key, prefix) {
+				return f(key)
+			}
+			return nil
+		})
+}
+
+// Mirror copies the values of keys, given by a "keys" setting of comma-separated keys or
+// a "prefix" setting for all remote keys starting with it, from a remote instance into
+// this data at a version.  Keys without remote values are skipped.
+func (d *Data) Mirror(ctx context.Context, remote *server.MirrorSource, uuid dvid.UUID,
+	settings dvid.Config, progress func(float32)) error {
+
+	keysStr, found, err := settings.GetString("keys")
+	if err != nil {
+		return err
+	}
+	keys := dvid.ArchiveKeys([]string{keysStr})
+	if !found {
+		prefix, prefixFound, err := settings.GetString("prefix")
+		if err != nil {
+			return err
+		}
+		if prefixFound {
+			if keys, err = mirrorKeys(ctx, remote, prefix); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Mirroring keyvalue data requires a 'keys' setting of comma-separated keys or a 'prefix' setting")
+	}
+	return remote.ForEach(ctx, len(keys), func(ctx context.Context, n int) error {
+		value, found, err := remote.Get(ctx, url.PathEscape(keys[n]))
+		if err != nil || !found {
+			return err
+		}
+		// The version may have been published since the mirror started.
+		if err := server.DatastoreService().WritesBlocked(uuid); err != nil {
+			return err
+		}
+		return d.PutData(uuid, keys[n], value)
+	}, progress)
+}
+
+// mirrorKeys returns the keys of remote data starting with a prefix, read as a stream so
+// the remote's MaxListKeys doesn't apply.
+func mirrorKeys(ctx context.Context, remote *server.MirrorSource, prefix string) ([]string, error) {
+	body, found, err := remote.Get(ctx, "keys?format=ndjson&prefix="+url.QueryEscape(prefix))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("No keys found at %s", remote)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" {
+			continue
+		}
+		var key string
+		if err := json.Unmarshal([]byte(line), &key); err != nil {
+			var streamErr struct{ Error string }
+			if json.Unmarshal([]byte(line), &streamErr) == nil && streamErr.Error != "" {
+				return nil, fmt.Errorf("Listing keys of %s failed: %s", remote, streamErr.Error)
+			}
+			return nil, fmt.Errorf("Bad key listing from %s: %q", remote, line)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // JSONString returns the JSON for this Data's configuration
 func (d *Data) JSONString() (jsonStr string, err error) {
 	m, err := json.Marshal(d)
@@ -274,6 +535,16 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 	return nil
 }
 
+// ReadOnlyPost returns true for the POSTed existence checks, which only read.
+func (d *Data) ReadOnlyPost(endpoint string) bool {
+	return endpoint == "exists"
+}
+
+// ReadOnlyCommand returns true for the "get" command, which only reads.
+func (d *Data) ReadOnlyCommand(request datastore.Request) bool {
+	return request.TypeCommand() == "get"
+}
+
 // DoHTTP handles all incoming HTTP requests for this data.
 func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
@@ -300,6 +571,111 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "archive":
+		query := r.URL.Query()
+		if strings.ToLower(r.Method) != "get" || len(query["keys"]) == 0 {
+			break
+		}
+		keys := dvid.ArchiveKeys(query["keys"])
+		if len(keys) == 0 {
+			err := fmt.Errorf("'archive' requires a 'keys' query string option")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := d.CheckListKeys(len(keys)); err != nil {
+			server.TooLarge(w, r, err.Error())
+			return err
+		}
+		for _, keyStr := range keys {
+			if err := dvid.CheckArchiveName(keyStr); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		}
+		format := query.Get("format")
+		if format == "" {
+			format = dvid.ArchiveZip
+		}
+		archive, err := dvid.NewArchiveWriter(w, format)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if query.Get("checksums") == "true" {
+			archive.AddChecksums(fmt.Sprintf("keyvalue %q at version %s", d.DataName(), uuid))
+		}
+		w.Header().Set("Content-Type", archive.ContentType())
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"%s.%s\"", d.DataName(), archive.Format()))
+		written, err := d.WriteArchive(uuid, archive, keys)
+		if err != nil {
+			// The archive may have started, so the error can only be logged.
+			dvid.Error("Archive of keyvalue '%s' stopped: %s\n", d.DataName(), err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP GET archive of %d of %d keys from keyvalue '%s'",
+			written, len(keys), d.DataName())
+		return nil
+	case "keys":
+		if strings.ToLower(r.Method) != "get" {
+			break
+		}
+		prefix := r.URL.Query().Get("prefix")
+		if server.WantsNDJSON(r) {
+			stream := server.NewNDJSONWriter(w)
+			err := d.ProcessKeys(r.Context(), uuid, prefix, func(key string) error {
+				return stream.Encode(key)
+			})
+			if err = stream.Close(err); err != nil {
+				if !stream.Started() {
+					server.BadRequest(w, r, err.Error())
+				}
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP GET stream of %d keys from keyvalue '%s'",
+				stream.Lines(), d.DataName())
+			return nil
+		}
+		keys := []string{}
+		err := d.ProcessKeys(r.Context(), uuid, prefix, func(key string) error {
+			keys = append(keys, key)
+			return d.CheckListKeys(len(keys))
+		})
+		if err != nil {
+			if _, ok := err.(*datastore.LimitError); ok {
+				server.TooLarge(w, r, err.Error())
+			} else {
+				server.BadRequest(w, r, err.Error())
+			}
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP GET %d keys from keyvalue '%s'", len(keys), d.DataName())
+		return nil
+	case "exists":
+		if strings.ToLower(r.Method) != "post" {
+			break
+		}
+		var keys []string
+		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+			err = fmt.Errorf("Expected JSON list of keys: %s", err.Error())
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		indices := make([]dvid.Index, len(keys))
+		for i, keyStr := range keys {
+			indices[i] = dvid.IndexString(keyStr)
+		}
+		found, err := server.KeysExist(uuid, *d.DataID, indices)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		server.WriteExists(w, found)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP POST exists of %d keys in keyvalue '%s'",
+			len(keys), d.DataName())
+		return nil
 	default:
 	}
 
@@ -318,6 +694,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			return nil
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", server.ETag(value))
 		_, err = w.Write(value)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
@@ -325,16 +702,18 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		}
 		comment = fmt.Sprintf("HTTP GET keyvalue '%s': %d bytes (%s)\n", d.DataName(), len(value), url)
 	case "post":
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			server.BadRequest(w, r, err.Error())
+		data, err := server.ReadBody(r)
+		if err == server.ErrBodyTooLarge {
+			server.TooLarge(w, r, err.Error())
 			return err
 		}
-		err = d.PutData(uuid, keyStr, data)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
+		if err = d.putConditionally(w, r, uuid, keyStr, data); err != nil {
+			return err
+		}
 		comment = fmt.Sprintf("HTTP POST keyvalue '%s': %d bytes (%s)\n", d.DataName(), len(data), url)
 	default:
 		err := fmt.Errorf("Can only handle GET or POST HTTP verbs")
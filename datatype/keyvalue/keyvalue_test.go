@@ -1,6 +1,14 @@
 package keyvalue
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	. "github.com/janelia-flyem/go/gocheck"
 
@@ -101,3 +109,210 @@ func (suite *DataSuite) TestRoundTrip(c *C) {
 
 	c.Assert(retrieved, DeepEquals, value)
 }
+
+func (suite *DataSuite) TestArchive(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvarchive", dvid.NewConfig()), IsNil)
+	kvdata, err := GetByUUID(root, "kvarchive")
+	c.Assert(err, IsNil)
+
+	c.Assert(kvdata.PutData(root, "a.txt", []byte("first")), IsNil)
+	c.Assert(kvdata.PutData(root, "dir/b.txt", []byte("second")), IsNil)
+
+	var buf bytes.Buffer
+	archive, err := dvid.NewArchiveWriter(&buf, "tar")
+	c.Assert(err, IsNil)
+	written, err := kvdata.WriteArchive(root, archive, []string{"a.txt", "missing", "dir/b.txt"})
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, 2)
+
+	read := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		read[header.Name] = string(data)
+	}
+	c.Assert(read, DeepEquals, map[string]string{"a.txt": "first", "dir/b.txt": "second"})
+
+	// Without keys, a key named "archive" is retrieved, and archives are limited to
+	// MaxListKeys keys.
+	c.Assert(kvdata.PutData(root, "archive", []byte("third")), IsNil)
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", fmt.Sprintf("%snode/%s/kvarchive/archive%s", server.WebAPIPath, root, query), nil)
+		w := httptest.NewRecorder()
+		kvdata.DoHTTP(root, w, r)
+		return w
+	}
+	w := get("")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "third")
+	kvdata.Limits.MaxListKeys = 1
+	defer func() { kvdata.Limits.MaxListKeys = 0 }()
+	c.Assert(get("?keys=a.txt").Code, Equals, http.StatusOK)
+	c.Assert(get("?keys=a.txt,dir/b.txt").Code, Equals, http.StatusRequestEntityTooLarge)
+}
+
+func (suite *DataSuite) TestKeys(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvkeys", dvid.NewConfig()), IsNil)
+	kvdata, err := GetByUUID(root, "kvkeys")
+	c.Assert(err, IsNil)
+	for _, key := range []string{"meshes/2", "meshes/1", "skeletons/1"} {
+		c.Assert(kvdata.PutData(root, key, []byte(key)), IsNil)
+	}
+
+	request := func(query, accept string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("%snode/%s/kvkeys/keys%s", server.WebAPIPath, root, query)
+		r, _ := http.NewRequest("GET", url, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		kvdata.DoHTTP(root, w, r)
+		return w
+	}
+	w := request("", "")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.TrimSpace(w.Body.String()), Equals, `["meshes/1","meshes/2","skeletons/1"]`)
+
+	w = request("?prefix=meshes/", server.NDJSONContentType)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Type"), Equals, server.NDJSONContentType)
+	c.Assert(w.Body.String(), Equals, "\"meshes/1\"\n\"meshes/2\"\n")
+
+	// Prefix ranges end after the prefix and only hold keys written at the version.
+	end, found := prefixEnd("meshes/")
+	c.Assert(found, Equals, true)
+	c.Assert(end, Equals, "meshes0")
+	end, found = prefixEnd("a\xff")
+	c.Assert(found, Equals, true)
+	c.Assert(end, Equals, "b")
+	_, found = prefixEnd("")
+	c.Assert(found, Equals, false)
+
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(kvdata.PutData(child, "meshes/3", []byte("meshes/3")), IsNil)
+	c.Assert(kvdata.PutData(child, "meshes0", []byte("meshes0")), IsNil)
+	for uuid, expected := range map[dvid.UUID][]string{root: {"meshes/1", "meshes/2"}, child: {"meshes/3"}} {
+		var keys []string
+		err = kvdata.ProcessKeys(context.Background(), uuid, "meshes/", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(keys, DeepEquals, expected)
+	}
+}
+
+func (suite *DataSuite) TestMirror(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvsource", dvid.NewConfig()), IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvmirror", dvid.NewConfig()), IsNil)
+	source, err := GetByUUID(root, "kvsource")
+	c.Assert(err, IsNil)
+	mirror, err := GetByUUID(root, "kvmirror")
+	c.Assert(err, IsNil)
+	c.Assert(source.PutData(root, "a", []byte("first")), IsNil)
+	c.Assert(source.PutData(root, "b c", []byte("second")), IsNil)
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source.DoHTTP(root, w, r)
+	}))
+	defer remoteServer.Close()
+	remote, err := server.NewMirrorSource(remoteServer.URL, root, "kvsource", 2)
+	c.Assert(err, IsNil)
+
+	c.Assert(mirror.Mirror(context.Background(), remote, root, dvid.NewConfig(), nil), NotNil)
+	settings := dvid.NewConfig()
+	settings.Set("keys", "a,b c,missing")
+	c.Assert(mirror.Mirror(context.Background(), remote, root, settings, nil), IsNil)
+	for key, expected := range map[string]string{"a": "first", "b c": "second"} {
+		value, found, err := mirror.GetData(root, key)
+		c.Assert(err, IsNil)
+		c.Assert(found, Equals, true)
+		c.Assert(string(value), Equals, expected)
+	}
+	_, found, err := mirror.GetData(root, "missing")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	// Keys can be mirrored by prefix.
+	c.Assert(source.PutData(root, "meshes/1", []byte("mesh1")), IsNil)
+	c.Assert(source.PutData(root, "meshes/2", []byte("mesh2")), IsNil)
+	settings = dvid.NewConfig()
+	settings.Set("prefix", "meshes/")
+	c.Assert(mirror.Mirror(context.Background(), remote, root, settings, nil), IsNil)
+	for key, expected := range map[string]string{"meshes/1": "mesh1", "meshes/2": "mesh2"} {
+		value, found, err := mirror.GetData(root, key)
+		c.Assert(err, IsNil)
+		c.Assert(found, Equals, true)
+		c.Assert(string(value), Equals, expected)
+	}
+}
+
+func (suite *DataSuite) TestConditionalWrites(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvcond", dvid.NewConfig()), IsNil)
+	kvdata, err := GetByUUID(root, "kvcond")
+	c.Assert(err, IsNil)
+
+	url := fmt.Sprintf("%snode/%s/kvcond/doc", server.WebAPIPath, root)
+	post := func(value, header, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", url, strings.NewReader(value))
+		if header != "" {
+			r.Header.Set(header, etag)
+		}
+		w := httptest.NewRecorder()
+		kvdata.DoHTTP(root, w, r)
+		return w
+	}
+
+	// Only the first create succeeds.
+	w := post("v1", "If-None-Match", "*")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	etag1 := w.Header().Get("ETag")
+	c.Assert(etag1, Equals, server.ETag([]byte("v1")))
+	c.Assert(post("other", "If-None-Match", "*").Code, Equals, http.StatusPreconditionFailed)
+
+	r, _ := http.NewRequest("GET", url, nil)
+	w = httptest.NewRecorder()
+	c.Assert(kvdata.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Header().Get("ETag"), Equals, etag1)
+
+	// A write based on a stale read fails.
+	c.Assert(post("v2", "If-Match", etag1).Code, Equals, http.StatusOK)
+	c.Assert(post("v3", "If-Match", etag1).Code, Equals, http.StatusPreconditionFailed)
+	value, _, err := kvdata.GetData(root, "doc")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "v2")
+
+	c.Assert(post("v3", "", "").Code, Equals, http.StatusOK)
+}
+
+func (suite *DataSuite) TestReadOnlyPosts(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "keyvalue", "kvexists", dvid.NewConfig()), IsNil)
+
+	post := func(path string) *http.Request {
+		r, _ := http.NewRequest("POST", fmt.Sprintf("%snode/%s/kvexists/%s", server.WebAPIPath, root, path), nil)
+		return r
+	}
+	c.Assert(server.IsWriteRequest(post("exists")), Equals, false)
+	c.Assert(server.IsWriteRequest(post("exists/")), Equals, false)
+
+	// A key named by a POST ending in "exists" is stored, so the POST is a write.
+	c.Assert(server.IsWriteRequest(post("somekey/exists")), Equals, true)
+	c.Assert(server.IsWriteRequest(post("somekey")), Equals, true)
+}
@@ -41,7 +41,7 @@ func (d *Data) computeSurface(surfaceCh chan *storage.Chunk, db storage.OrderedK
 
 	defer func() {
 		wg.Done()
-		server.HandlerToken <- 1
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 	}()
 
 	// Sequentially process all the sparse volume data for each label
@@ -81,28 +81,37 @@ func (d *Data) computeSurface(surfaceCh chan *storage.Chunk, db storage.OrderedK
 }
 
 func (d *Data) computeAndSaveSurface(versionID dvid.VersionLocalID, vol *dvid.SparseVol) error {
-	labelData, err := d.Labels.GetData()
+	serialization, err := d.surfaceSerialization(vol)
 	if err != nil {
 		return err
 	}
-
-	data, err := vol.SurfaceSerialization(labelData.BlockSize().Value(2), labelData.Resolution.VoxelSize)
+	db, err := server.OrderedKeyValueSetter()
 	if err != nil {
 		return err
 	}
+	return db.Put(labels.NewLabelSurfaceKey(d, versionID, vol.Label()), serialization)
+}
 
-	db, err := server.OrderedKeyValueSetter()
+// surfaceSerialization computes the surface of a sparse volume and returns it as stored.
+func (d *Data) surfaceSerialization(vol *dvid.SparseVol) ([]byte, error) {
+	labelData, err := d.Labels.GetData()
 	if err != nil {
-		return err
+		return nil, err
 	}
+
+	data, err := vol.SurfaceSerialization(labelData.BlockSize().Value(2), labelData.Resolution.VoxelSize)
+	if err != nil {
+		return nil, err
+	}
+
 	// Surface blobs are always stored using gzip with best compression, trading off time
 	// during the store for speed during interactive GETs.
 	compression, _ := dvid.NewCompression(dvid.Gzip, dvid.DefaultCompression)
 	serialization, err := dvid.SerializeData(data, compression, dvid.NoChecksum)
 	if err != nil {
-		return fmt.Errorf("Unable to serialize data in surface computation: %s\n", err.Error())
+		return nil, fmt.Errorf("Unable to serialize data in surface computation: %s\n", err.Error())
 	}
-	return db.Put(labels.NewLabelSurfaceKey(d, versionID, vol.Label()), serialization)
+	return serialization, nil
 }
 
 // GetLabelsInVolume returns a JSON list of mapped labels that intersect a volume bounded
@@ -145,7 +154,7 @@ func (d *Data) GetLabelsInVolume(uuid dvid.UUID, minBlock, maxBlock dvid.ChunkPo
 		// Add mapped labels for these keys into the set
 		for _, key := range keys {
 			keyBytes := key.Bytes()
-			indexBytes := keyBytes[datastore.DataKeyIndexOffset:]
+			indexBytes := datastore.DataKeyIndexBytes(keyBytes)
 			mappedLabel := binary.BigEndian.Uint64(indexBytes[offset : offset+8])
 			labelset[mappedLabel] = true
 		}
@@ -190,13 +199,16 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 	}
 	blockSize := labels.BlockSize()
 	blockCoord := coord.Chunk(blockSize).(dvid.ChunkPoint3d) // TODO -- Get rid of this cast
-	key := d.DataKey(versionID, dvid.IndexZYX(blockCoord))
+	key := labels.DataKey(versionID, dvid.IndexZYX(blockCoord))
 
 	// Retrieve the block of labels
 	serialization, err := db.Get(key)
 	if err != nil {
 		return 0, fmt.Errorf("Error getting '%s' block for index %s\n", d.DataName(), blockCoord)
 	}
+	if serialization == nil {
+		return 0, nil
+	}
 	labelData, _, err := dvid.DeserializeData(serialization, true)
 	if err != nil {
 		return 0, fmt.Errorf("Unable to deserialize block %s in '%s': %s\n",
@@ -259,7 +271,7 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	// Process all the b+s keys and their values, which contain RLE runs for that label.
 	wg := new(sync.WaitGroup)
 	op := &sparseOp{versionID: versionID, encoding: buf.Bytes()}
-	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg}, func(chunk *storage.Chunk) {
+	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg, nil}, func(chunk *storage.Chunk) {
 		op := chunk.Op.(*sparseOp)
 		op.numBlocks++
 		op.encoding = append(op.encoding, chunk.V...)
@@ -278,6 +290,17 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	return op.encoding, nil
 }
 
+// GetSupervoxelSparseVol returns an encoded sparse volume of a single supervoxel, i.e., an
+// unmapped label of the underlying labels64 data, regardless of the body it's mapped to.
+// The encoding is the same as GetSparseVol.
+func (d *Data) GetSupervoxelSparseVol(uuid dvid.UUID, supervoxel uint64) ([]byte, error) {
+	labelData, err := d.Labels.GetData()
+	if err != nil {
+		return nil, err
+	}
+	return labelData.GetSparseVol(uuid, supervoxel)
+}
+
 // GetSurface returns a byte array with # voxels and float32 arrays for vertices and
 // normals.
 func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, err error) {
@@ -396,14 +419,14 @@ func (d *Data) GetMappedVoxels(uuid dvid.UUID, e voxels.ExtHandler) error {
 		mapping := make(map[string]uint64, numKeys)
 		for _, key := range keys {
 			keyBytes := key.Bytes()
-			indexBytes := keyBytes[datastore.DataKeyIndexOffset:]
+			indexBytes := datastore.DataKeyIndexBytes(keyBytes)
 			label := string(indexBytes[labelOffset : labelOffset+8])
 			mappedLabel := binary.BigEndian.Uint64(indexBytes[labelOffset+8 : labelOffset+16])
 			mapping[label] = mappedLabel
 		}
 
 		// Send the entire range of key/value pairs to chunk mapper
-		chunkOp := &storage.ChunkOp{&denormOp{labelData, e, 0, versionID, mapping}, wg}
+		chunkOp := &storage.ChunkOp{&denormOp{labelData, e, 0, versionID, mapping}, wg, nil}
 		startKey := &datastore.DataKey{datasetID, dataID, versionID, indexBeg}
 		endKey := &datastore.DataKey{datasetID, dataID, versionID, indexEnd}
 		err = db.ProcessRange(startKey, endKey, chunkOp, d.MapChunk)
@@ -468,7 +491,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		if op.mapping != nil {
 			startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
 			endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
-			chunkOp := &storage.ChunkOp{op, wg}
+			chunkOp := &storage.ChunkOp{op, wg, nil}
 			err = db.ProcessRange(startKey, endKey, chunkOp, d.DenormalizeChunk)
 			wg.Wait()
 		} else {
@@ -498,7 +521,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	numSurfCalculators := dvid.EstimateGoroutines(0.5, goroutineMB)
 	surfaceCh := make([]chan *storage.Chunk, numSurfCalculators, numSurfCalculators)
 	for i := 0; i < numSurfCalculators; i++ {
-		<-server.HandlerToken
+		server.HandlerPoolFor(d.DatatypeName()).Acquire()
 		surfaceCh[i] = make(chan *storage.Chunk, 10000)
 		wg.Add(1)
 		go d.computeSurface(surfaceCh[i], db, versionID, wg)
@@ -511,7 +534,9 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		d.Ready = true
 		if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 			dvid.Error("Could not save READY state to data '%s', uuid %s: %s", d.DataName(), uuid, err.Error())
+			return
 		}
+		labels.MarkModified(d.DsetID)
 	}()
 
 	// Iterate through all mapped labels and send to size and surface processing goroutines.
@@ -520,7 +545,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		dataKey := chunk.K.(*datastore.DataKey)
 		indexBytes := dataKey.Index.Bytes()
 		label := binary.BigEndian.Uint64(indexBytes[1:9])
-		chunk.ChunkOp = &storage.ChunkOp{label, nil}
+		chunk.ChunkOp = &storage.ChunkOp{label, nil, nil}
 
 		// Send RLE of label to size indexer and surface calculator.
 		sizeCh <- chunk
@@ -540,16 +565,16 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 // MapChunk processes a chunk of label data, storing the mapped labels.  The data may be
 // thinner, wider, and longer than the chunk, depending on the data shape (XY, XZ, etc).
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) MapChunk(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.mapChunk(chunk)
 }
 
 func (d *Data) mapChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
@@ -697,16 +722,16 @@ func (d *Data) mapChunk(chunk *storage.Chunk) {
 
 // DenormalizeChunk processes a chunk of data as part of a mapped operation.
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) DenormalizeChunk(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.denormalizeChunk(chunk)
 }
 
 func (d *Data) denormalizeChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
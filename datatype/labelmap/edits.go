@@ -0,0 +1,656 @@
+/*
+	This file supports proofreading edits of a label map, i.e., merging mapped labels and
+	cleaving superpixels off a mapped label into a new one.  Each edit is recorded so the
+	history of a label can be retrieved and the last edit in a node can be undone.
+*/
+
+package labelmap
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Move reassigns superpixels from one mapped label to another.
+type Move struct {
+	From        uint64
+	To          uint64
+	Superpixels []uint64
+}
+
+// Edit is a record of a label map edit.
+type Edit struct {
+	ID      uint64
+	Op      string
+	User    string
+	Time    time.Time
+	Version dvid.UUID
+
+	// Labels are the mapped labels affected by the edit.
+	Labels []uint64
+
+	// Moves are the changes to the label map in the order they were applied.
+	Moves []Move
+
+	// Undone is true if the edit has been undone.
+	Undone bool
+
+	// Undoes is the ID of the edit reversed by an "undo" edit.
+	Undoes uint64
+}
+
+// NewEditKey returns a datastore.DataKey for the record of an edit.
+func (d *Data) NewEditKey(vID dvid.VersionLocalID, editID uint64) *datastore.DataKey {
+	index := make([]byte, 9)
+	index[0] = byte(labels.KeyEditLog)
+	binary.BigEndian.PutUint64(index[1:9], editID)
+	return d.DataKey(vID, dvid.IndexBytes(index))
+}
+
+// NewLabelEditKey returns a datastore.DataKey that encodes a "mapped label + edit ID".
+func (d *Data) NewLabelEditKey(vID dvid.VersionLocalID, label, editID uint64) *datastore.DataKey {
+	index := make([]byte, 17)
+	index[0] = byte(labels.KeyLabelEdits)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	binary.BigEndian.PutUint64(index[9:17], editID)
+	return d.DataKey(vID, dvid.IndexBytes(index))
+}
+
+// NewInverseMapKey returns a datastore.DataKey that encodes a "mapped label + label".
+func (d *Data) NewInverseMapKey(vID dvid.VersionLocalID, mapping, label uint64) *datastore.DataKey {
+	index := make([]byte, 17)
+	index[0] = byte(labels.KeyInverseMap)
+	binary.BigEndian.PutUint64(index[1:9], mapping)
+	binary.BigEndian.PutUint64(index[9:17], label)
+	return d.DataKey(vID, dvid.IndexBytes(index))
+}
+
+func labelBytes(label uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, label)
+	return b
+}
+
+// startEdit makes sure the node can be edited and locks the data for editing, so edits
+// are applied one at a time and get distinct IDs and new labels.  The returned function
+// must be called to unlock the data.
+func (d *Data) startEdit(uuid dvid.UUID) (versionID dvid.VersionLocalID, unlock func(), err error) {
+	if !d.Ready {
+		err = fmt.Errorf("Can't edit labelmap '%s' until it has been loaded and processed", d.DataName())
+		return
+	}
+	service := server.DatastoreService()
+	locked, err := service.Locked(uuid)
+	if err != nil {
+		return
+	}
+	if locked {
+		err = fmt.Errorf("Can't edit labelmap '%s' in locked node %s", d.DataName(), uuid)
+		return
+	}
+	_, versionID, err = service.LocalIDFromUUID(uuid)
+	if err != nil {
+		return
+	}
+	d.editMu.Lock()
+	mutex := d.VersionMutex(versionID)
+	mutex.Lock()
+	unlock = func() {
+		mutex.Unlock()
+		d.editMu.Unlock()
+	}
+	return versionID, unlock, nil
+}
+
+// Merge maps all superpixels of the merged labels to the target label.  Either all labels
+// are merged or, if there's an error, none are.
+func (d *Data) Merge(uuid dvid.UUID, user string, target uint64, merged []uint64) (*Edit, error) {
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("Merge requires at least one label to merge into label %d", target)
+	}
+	versionID, unlock, err := d.startEdit(uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	edit := &Edit{Op: "merge", User: user, Version: uuid, Labels: []uint64{target}}
+	for _, label := range merged {
+		edit.Labels = append(edit.Labels, label)
+		edit.Moves = append(edit.Moves, Move{From: label, To: target})
+	}
+	return edit, d.applyEdit(uuid, versionID, edit, nil)
+}
+
+// Cleave maps the given superpixels of a label to a new label, which is given as the
+// destination of the edit's only move.
+func (d *Data) Cleave(uuid dvid.UUID, user string, label uint64, superpixels []uint64) (*Edit, error) {
+	if len(superpixels) == 0 {
+		return nil, fmt.Errorf("Cleave requires at least one superpixel to cleave from label %d", label)
+	}
+	versionID, unlock, err := d.startEdit(uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	newLabel, err := d.newLabel(versionID)
+	if err != nil {
+		return nil, err
+	}
+	move := Move{From: label, To: newLabel, Superpixels: superpixels}
+	edit := &Edit{Op: "cleave", User: user, Version: uuid, Labels: []uint64{label, newLabel}, Moves: []Move{move}}
+	return edit, d.applyEdit(uuid, versionID, edit, nil)
+}
+
+// Undo reverses the last edit in a node that hasn't been undone and returns the record
+// of the undo, whose Undoes field gives the reversed edit.
+func (d *Data) Undo(uuid dvid.UUID, user string) (*Edit, error) {
+	versionID, unlock, err := d.startEdit(uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return nil, err
+	}
+	keyvalues, err := db.GetRange(d.NewEditKey(versionID, 0), d.NewEditKey(versionID, math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	var last *Edit
+	for i := len(keyvalues) - 1; i >= 0; i-- {
+		var edit Edit
+		if err := json.Unmarshal(keyvalues[i].V, &edit); err != nil {
+			return nil, err
+		}
+		if !edit.Undone && edit.Op != "undo" {
+			last = &edit
+			break
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("No edits to undo in node %s", uuid)
+	}
+
+	undo := &Edit{Op: "undo", User: user, Version: uuid, Labels: last.Labels, Undoes: last.ID}
+	for i := len(last.Moves) - 1; i >= 0; i-- {
+		move := last.Moves[i]
+		undo.Moves = append(undo.Moves, Move{From: move.To, To: move.From, Superpixels: move.Superpixels})
+	}
+	last.Undone = true
+	return undo, d.applyEdit(uuid, versionID, undo, last)
+}
+
+// GetLabelHistory returns all edits in a node that affected a mapped label, oldest first.
+func (d *Data) GetLabelHistory(uuid dvid.UUID, label uint64) ([]Edit, error) {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := db.KeysInRange(d.NewLabelEditKey(versionID, label, 0), d.NewLabelEditKey(versionID, label, math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Edit, 0, len(keys))
+	for _, key := range keys {
+		indexBytes := key.(*datastore.DataKey).Index.Bytes()
+		editID := binary.BigEndian.Uint64(indexBytes[9:17])
+		value, err := db.Get(d.NewEditKey(versionID, editID))
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, fmt.Errorf("Edit %d of label %d not found", editID, label)
+		}
+		var edit Edit
+		if err := json.Unmarshal(value, &edit); err != nil {
+			return nil, err
+		}
+		history = append(history, edit)
+	}
+	return history, nil
+}
+
+// ProcessEdits calls f on each edit in a node with an ID greater than since, oldest
+// first, stopping at the first error or once ctx is done.  Edits are read in batches, so
+// f may be slow without holding the database open.
+func (d *Data) ProcessEdits(ctx context.Context, uuid dvid.UUID, since uint64, f func(*Edit) error) error {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return err
+	}
+	if since == math.MaxUint64 {
+		return nil
+	}
+	kStart, kEnd := d.NewEditKey(versionID, since+1), d.NewEditKey(versionID, math.MaxUint64)
+	return storage.ProcessRangeBatches(ctx, db, kStart, kEnd, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			var edit Edit
+			if err := json.Unmarshal(kv.V, &edit); err != nil {
+				return err
+			}
+			return f(&edit)
+		})
+}
+
+// nextEditID returns the ID for a new edit.  Edits recorded in the version after the
+// dataset was last saved are skipped, so their IDs aren't reused after a restart.
+func (d *Data) nextEditID(db storage.OrderedKeyValueGetter, versionID dvid.VersionLocalID) (uint64, error) {
+	last := d.NextEditID
+	if last == math.MaxUint64 {
+		return 0, fmt.Errorf("No edit IDs left in labelmap '%s'", d.DataName())
+	}
+	keys, err := db.KeysInRange(d.NewEditKey(versionID, last+1), d.NewEditKey(versionID, math.MaxUint64))
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) > 0 {
+		indexBytes := keys[len(keys)-1].(*datastore.DataKey).Index.Bytes()
+		last = binary.BigEndian.Uint64(indexBytes[1:9])
+		if last == math.MaxUint64 {
+			return 0, fmt.Errorf("No edit IDs left in labelmap '%s'", d.DataName())
+		}
+	}
+	return last + 1, nil
+}
+
+// updateMaxLabel makes sure the largest mapped label is known and includes the given
+// labels, so labels emptied by merges aren't reused by later cleaves.
+func (d *Data) updateMaxLabel(versionID dvid.VersionLocalID, mapped ...uint64) error {
+	if d.MaxLabel == 0 {
+		db, err := server.OrderedKeyValueGetter()
+		if err != nil {
+			return err
+		}
+		keys, err := db.KeysInRange(d.NewInverseMapKey(versionID, 0, 0),
+			d.NewInverseMapKey(versionID, math.MaxUint64, math.MaxUint64))
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			indexBytes := keys[len(keys)-1].(*datastore.DataKey).Index.Bytes()
+			d.MaxLabel = binary.BigEndian.Uint64(indexBytes[1:9])
+		}
+	}
+	for _, label := range mapped {
+		if label > d.MaxLabel {
+			d.MaxLabel = label
+		}
+	}
+	return nil
+}
+
+// newLabel returns an unused mapped label.
+func (d *Data) newLabel(versionID dvid.VersionLocalID) (uint64, error) {
+	if err := d.updateMaxLabel(versionID); err != nil {
+		return 0, err
+	}
+	if d.MaxLabel == math.MaxUint64 {
+		return 0, fmt.Errorf("No unused labels left in labelmap '%s'", d.DataName())
+	}
+	d.MaxLabel++
+	return d.MaxLabel, nil
+}
+
+// applyEdit remaps the superpixels of an edit's moves, updates the denormalizations of
+// the affected mapped labels, i.e., the spatial indices, sizes, and surfaces, and records
+// the edit with a new ID, indexed by each affected label.  A move without superpixels
+// moves all superpixels of its source label, which are recorded in the move.  Everything
+// is written in one batch, so a failed edit changes nothing.  If the edit reverses an
+// earlier edit, the updated record of the undone edit is written in the same batch.
+func (d *Data) applyEdit(uuid dvid.UUID, versionID dvid.VersionLocalID, edit, undone *Edit) error {
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.applyEdit()", d.DataName())
+	}
+	labelData, err := d.Labels.GetData()
+	if err != nil {
+		return err
+	}
+
+	// Find the affected labels and where each moved superpixel goes.  All reads are done
+	// before the batch since some stores block reads during a batch write.
+	var affected []uint64
+	isAffected := make(map[uint64]bool)
+	for _, move := range edit.Moves {
+		if move.From == 0 || move.To == 0 {
+			return fmt.Errorf("Label 0 is reserved for background and can't be edited")
+		}
+		if move.From == move.To {
+			return fmt.Errorf("Can't move superpixels from label %d to itself", move.From)
+		}
+		for _, label := range []uint64{move.From, move.To} {
+			if !isAffected[label] {
+				isAffected[label] = true
+				affected = append(affected, label)
+			}
+		}
+	}
+	if err := d.updateMaxLabel(versionID, affected...); err != nil {
+		return err
+	}
+	owned := make(map[uint64]map[uint64]bool)
+	movedTo := make(map[string]uint64)
+	for i := range edit.Moves {
+		move := &edit.Moves[i]
+		if _, found := owned[move.From]; !found {
+			if owned[move.From], err = d.superpixels(db, versionID, move.From); err != nil {
+				return err
+			}
+		}
+		if move.Superpixels == nil {
+			for superpixel := range owned[move.From] {
+				move.Superpixels = append(move.Superpixels, superpixel)
+			}
+			sort.Sort(uint64s(move.Superpixels))
+		}
+		if len(move.Superpixels) == 0 {
+			return fmt.Errorf("Label %d has no superpixels", move.From)
+		}
+		for _, superpixel := range move.Superpixels {
+			if !owned[move.From][superpixel] {
+				return fmt.Errorf("Superpixel %d is not mapped to label %d", superpixel, move.From)
+			}
+			b := string(labelBytes(superpixel))
+			if _, found := movedTo[b]; found {
+				return fmt.Errorf("Superpixel %d can only be moved once in an edit", superpixel)
+			}
+			movedTo[b] = move.To
+		}
+	}
+
+	// Read the runs of each affected label, keyed by block index.
+	runs := make(map[uint64]map[string][]byte, len(affected))
+	oldSizes := make(map[uint64]uint64, len(affected))
+	for _, label := range affected {
+		keyvalues, err := db.GetRange(labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MinIndexZYX),
+			labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MaxIndexZYX))
+		if err != nil {
+			return err
+		}
+		blocks := make(map[string][]byte, len(keyvalues))
+		for _, kv := range keyvalues {
+			indexBytes := kv.K.(*datastore.DataKey).Index.Bytes()
+			blocks[string(indexBytes[9:9+dvid.IndexZYXSize])] = kv.V
+		}
+		runs[label] = blocks
+		if oldSizes[label], err = runsSize(blocks); err != nil {
+			return err
+		}
+	}
+
+	// Remap the spatial indices of each block with a source label and recompute the
+	// runs of the affected labels within those blocks.
+	batch := batcher.NewBatch()
+	var remapped []string
+	isRemapped := make(map[string]bool)
+	for _, move := range edit.Moves {
+		for block := range runs[move.From] {
+			if !isRemapped[block] {
+				isRemapped[block] = true
+				remapped = append(remapped, block)
+			}
+		}
+	}
+	sort.Strings(remapped)
+	for _, blockBytes := range remapped {
+		index, err := dvid.IndexZYX{}.IndexFromBytes([]byte(blockBytes))
+		if err != nil {
+			return err
+		}
+		block := *(index.(*dvid.IndexZYX))
+		mapping, err := d.GetBlockMapping(versionID, block)
+		if err != nil {
+			return err
+		}
+		for a, b := range mapping {
+			if to, found := movedTo[a]; found && b != to {
+				batch.Delete(labels.NewSpatialMapKey(d, versionID, block, []byte(a), b))
+				batch.Put(labels.NewSpatialMapKey(d, versionID, block, []byte(a), to), dvid.EmptyValue())
+				mapping[a] = to
+			}
+		}
+		rles, err := d.blockRLEs(labelData, versionID, block, mapping, affected...)
+		if err != nil {
+			return err
+		}
+		for _, label := range affected {
+			key := labels.NewLabelSpatialMapKey(d, versionID, label, block)
+			if len(rles[label]) == 0 {
+				if _, found := runs[label][blockBytes]; found {
+					batch.Delete(key)
+					delete(runs[label], blockBytes)
+				}
+				continue
+			}
+			runsBytes, err := rles[label].MarshalBinary()
+			if err != nil {
+				return err
+			}
+			batch.Put(key, runsBytes)
+			runs[label][blockBytes] = runsBytes
+		}
+	}
+
+	// Remap the forward and inverse maps.
+	for _, move := range edit.Moves {
+		for _, superpixel := range move.Superpixels {
+			b := labelBytes(superpixel)
+			batch.Delete(labels.NewForwardMapKey(d, versionID, b, move.From))
+			batch.Put(labels.NewForwardMapKey(d, versionID, b, move.To), dvid.EmptyValue())
+			batch.Delete(d.NewInverseMapKey(versionID, move.From, superpixel))
+			batch.Put(d.NewInverseMapKey(versionID, move.To, superpixel), dvid.EmptyValue())
+		}
+	}
+
+	// Update the size index and the surfaces of the affected labels.
+	for _, label := range affected {
+		size, err := runsSize(runs[label])
+		if err != nil {
+			return err
+		}
+		batch.Delete(labels.NewLabelSizesKey(d, versionID, oldSizes[label], label))
+		surfaceKey := labels.NewLabelSurfaceKey(d, versionID, label)
+		if size == 0 {
+			batch.Delete(surfaceKey)
+			continue
+		}
+		batch.Put(labels.NewLabelSizesKey(d, versionID, size, label), dvid.EmptyValue())
+		blocks := make([]string, 0, len(runs[label]))
+		for block := range runs[label] {
+			blocks = append(blocks, block)
+		}
+		sort.Strings(blocks)
+		var vol dvid.SparseVol
+		vol.SetLabel(label)
+		for _, block := range blocks {
+			if err := vol.AddRLEs(runs[label][block]); err != nil {
+				return err
+			}
+		}
+		serialization, err := d.surfaceSerialization(&vol)
+		if err != nil {
+			return err
+		}
+		batch.Put(surfaceKey, serialization)
+	}
+
+	// Record the edit.
+	editID, err := d.nextEditID(db, versionID)
+	if err != nil {
+		return err
+	}
+	edit.ID = editID
+	edit.Time = time.Now()
+	value, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	batch.Put(d.NewEditKey(versionID, edit.ID), value)
+	for _, label := range edit.Labels {
+		batch.Put(d.NewLabelEditKey(versionID, label, edit.ID), dvid.EmptyValue())
+	}
+	if undone != nil {
+		value, err := json.Marshal(undone)
+		if err != nil {
+			return err
+		}
+		batch.Put(d.NewEditKey(versionID, undone.ID), value)
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	d.NextEditID = edit.ID
+	labels.MarkModified(d.DsetID)
+	dvid.Log(dvid.Normal, "Labelmap '%s' edit %d by %q: %s of labels %v\n",
+		d.DataName(), edit.ID, edit.User, edit.Op, edit.Labels)
+	return server.DatastoreService().SaveDataset(uuid)
+}
+
+// superpixels returns the set of superpixels mapped to a label.
+func (d *Data) superpixels(db storage.OrderedKeyValueGetter, versionID dvid.VersionLocalID, label uint64) (map[uint64]bool, error) {
+	keys, err := db.KeysInRange(d.NewInverseMapKey(versionID, label, 0),
+		d.NewInverseMapKey(versionID, label, math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	superpixels := make(map[uint64]bool, len(keys))
+	for _, key := range keys {
+		indexBytes := key.(*datastore.DataKey).Index.Bytes()
+		superpixels[binary.BigEndian.Uint64(indexBytes[9:17])] = true
+	}
+	return superpixels, nil
+}
+
+// runsSize returns the number of voxels in serialized runs.
+func runsSize(blocks map[string][]byte) (uint64, error) {
+	var size uint64
+	for _, runsBytes := range blocks {
+		var rles dvid.RLEs
+		if err := rles.UnmarshalBinary(runsBytes); err != nil {
+			return 0, err
+		}
+		numVoxels, _ := rles.Stats()
+		size += uint64(numVoxels)
+	}
+	return size, nil
+}
+
+// labelSize returns the number of voxels in a mapped label using its spatial index.
+func (d *Data) labelSize(db storage.OrderedKeyValueGetter, versionID dvid.VersionLocalID, label uint64) (uint64, error) {
+	keyvalues, err := db.GetRange(labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MinIndexZYX),
+		labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MaxIndexZYX))
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, kv := range keyvalues {
+		var rles dvid.RLEs
+		if err := rles.UnmarshalBinary(kv.V); err != nil {
+			return 0, err
+		}
+		numVoxels, _ := rles.Stats()
+		size += uint64(numVoxels)
+	}
+	return size, nil
+}
+
+// blockRLEs returns the runs of the given mapped labels in a block of labels.
+func (d *Data) blockRLEs(labelData *labels64.Data, versionID dvid.VersionLocalID, block dvid.IndexZYX,
+	mapping map[string]uint64, mapped ...uint64) (map[uint64]dvid.RLEs, error) {
+
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	serialization, err := db.Get(labelData.DataKey(versionID, block))
+	if err != nil {
+		return nil, err
+	}
+	if serialization == nil {
+		return nil, fmt.Errorf("Block %s of '%s' not found", block, labelData.DataName())
+	}
+	blockData, _, err := dvid.DeserializeData(serialization, true)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(blockData)) != labelData.BlockSize().Prod()*8 {
+		return nil, fmt.Errorf("Block %s of '%s' is the wrong size: %d bytes", block, labelData.DataName(), len(blockData))
+	}
+	wanted := make(map[uint64]bool, len(mapped))
+	for _, label := range mapped {
+		wanted[label] = true
+	}
+
+	rles := make(map[uint64]dvid.RLEs, len(mapped))
+	firstPt := block.MinPoint(labelData.BlockSize()).(dvid.Point3d)
+	lastPt := block.MaxPoint(labelData.BlockSize()).(dvid.Point3d)
+	var curStart dvid.Point3d
+	var curLabel uint64
+	var curRun int32
+	start := 0
+	for z := firstPt[2]; z <= lastPt[2]; z++ {
+		for y := firstPt[1]; y <= lastPt[1]; y++ {
+			for x := firstPt[0]; x <= lastPt[0]; x++ {
+				b := mapping[string(blockData[start:start+8])]
+				start += 8
+				if !wanted[b] {
+					b = 0
+				}
+				if b == 0 || b != curLabel {
+					if curRun > 0 {
+						rles[curLabel] = append(rles[curLabel], dvid.NewRLE(curStart, curRun))
+					}
+					if b != 0 {
+						curStart = dvid.Point3d{x, y, z}
+						curRun = 1
+					} else {
+						curRun = 0
+					}
+					curLabel = b
+				} else {
+					curRun++
+				}
+			}
+			if curRun > 0 {
+				rles[curLabel] = append(rles[curLabel], dvid.NewRLE(curStart, curRun))
+				curLabel = 0
+				curRun = 0
+			}
+		}
+	}
+	return rles, nil
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
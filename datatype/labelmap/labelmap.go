@@ -59,6 +59,16 @@ $ dvid dataset <UUID> new labelmap <data name> <settings...>
 
     Labels           Name of labels64 data for which this is a label mapping. (required)
     Versioned        "true" or "false" (default)
+    MaxSliceArea     Maximum voxels in a GET of a 2d slice of labels; larger requests get a 413
+    MaxSubvolumeVoxels
+                     Maximum voxels in a GET of a 3d subvolume of labels; larger requests get a 413
+    TTL              Time to live, e.g., "72h", after which the data and all its keys are deleted
+    Materialize      "true" or "false" (default).  If true, locking a node stores the mapped labels
+                     of that version in a labels64 view, "<data name>-flat-<UUID>", which serves
+                     GETs of mapped labels at that version without mapping each superpixel.
+                     The labels at a viewed version can no longer be written.
+    MaxViews         Most materialized views kept (default 2).  Once exceeded, the oldest views
+                     are moved to the trash.
 
 $ dvid node <UUID> <data name> load raveler <superpixel-to-segment filename> <segment-to-body filename>
 
@@ -149,6 +159,20 @@ GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
     coord     	  Coordinate of voxel with underscore as separator, e.g., 10_20_30
 
 
+GET <api URL>/node/<UUID>/<data name>/supervoxel/<id>/sparsevol
+
+	Returns a sparse volume with the voxels of a single supervoxel, i.e., an unmapped label
+	of the underlying labels64 data, instead of the body it's mapped to.  This is used by
+	split tools that work below the body level.  The encoding is described in the
+	"sparsevol" request above.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of mapping data.
+    id            Supervoxel (unmapped label) ID.
+
+
 GET <api URL>/node/<UUID>/<data name>/surface/<label>
 
 	Returns array of vertices and normals of surface voxels of given label.
@@ -211,6 +235,67 @@ GET <api URL>/node/<UUID>/<data name>/intersect/<min block>/<max block>
     min block     Minimum block coordinate with underscore as separator, e.g., 10_20_30
     max block     Maximum block coordinate with underscore as separator.
 
+POST <api URL>/node/<UUID>/<data name>/merge?u=<user>
+
+    Merges labels by mapping all their superpixels to a target label.  The POSTed body is
+    a JSON list of labels where the first label is the target, e.g., [23, 145, 1001].
+    Sparse volumes, sizes, and surfaces of the affected labels are updated.  Returns JSON
+    with the ID of the recorded edit, e.g., {"Edit": 12}.  Edits can only be made in
+    unlocked nodes, are applied one at a time, and either succeed completely or change
+    nothing.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of mapping data.
+    user          Optional name of the user making the edit, which is recorded in the history.
+                  If the request is authenticated, the authenticated user is recorded instead.
+
+
+POST <api URL>/node/<UUID>/<data name>/cleave/<label>?u=<user>
+
+    Cleaves superpixels off a label by mapping them to a new label.  The POSTed body is a
+    JSON list of superpixels that must be mapped to the given label.  Returns JSON with the
+    ID of the recorded edit and the new label, e.g., {"Edit": 13, "CleavedLabel": 2001}.
+
+
+POST <api URL>/node/<UUID>/<data name>/undo?u=<user>
+
+    Reverses the last merge or cleave in the node that hasn't been undone.  The undo is
+    recorded as an edit and the reversed edit is marked as undone.  Returns JSON with the
+    IDs of both, e.g., {"Edit": 14, "Undone": 13}.
+
+
+GET <api URL>/node/<UUID>/<data name>/label/<label>/history
+
+    Returns a JSON list of the edits in the node that affected the given label, oldest
+    first.  Each edit has the following form:
+
+    {
+        "ID": 12,
+        "Op": "merge",
+        "User": "jdoe",
+        "Time": "2014-02-21T14:05:19.3457-05:00",
+        "Version": "3f8c...",
+        "Labels": [23, 145],
+        "Moves": [{"From": 145, "To": 23, "Superpixels": [...]}],
+        "Undone": false,
+        "Undoes": 0
+    }
+
+    where "Moves" lists the superpixels mapped from one label to another and "Undoes"
+    is the ID of the edit reversed by an "undo" edit.
+
+
+GET <api URL>/node/<UUID>/<data name>/edits[?since=<edit ID>]
+
+    Returns a JSON list of all edits in the node, or only those after the given edit ID,
+    oldest first, in the form given above.  Clients following the edits of a node can
+    pass the ID of the last edit they've seen.  With an "Accept: application/x-ndjson"
+    header or "format=ndjson", edits are streamed one per line as they're read and
+    MaxListKeys doesn't apply.  An error after streaming starts ends the stream with a
+    line {"Error": "<message>"}.
+
 GET  <api URL>/node/<UUID>/<data name>/labels/<dims>/<size>/<offset>[/<format>]
 
     Retrieves mapped labels for each voxel in the specified extent.
@@ -321,7 +406,21 @@ func (dtype *Datatype) NewDataService(id *datastore.DataID, c dvid.Config) (data
 		return nil, err
 	}
 	fmt.Printf("LabelsRef = %s\n", labelsRef)
-	return &Data{Data: basedata, Labels: labelsRef}, nil
+	data := &Data{Data: basedata, Labels: labelsRef, MaxViews: DefaultMaxViews}
+	if data.Materialize, _, err = c.GetBool("Materialize"); err != nil {
+		return nil, err
+	}
+	maxViews, found, err := c.GetInt("MaxViews")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if maxViews < 1 {
+			return nil, fmt.Errorf("MaxViews must be at least 1, not %d", maxViews)
+		}
+		data.MaxViews = maxViews
+	}
+	return data, nil
 }
 
 func (dtype *Datatype) Help() string {
@@ -435,6 +534,26 @@ type Data struct {
 
 	// Ready is true if inverse map, forward map, and spatial queries are ready.
 	Ready bool
+
+	// NextEditID is the ID of the last recorded edit.
+	NextEditID uint64
+
+	// MaxLabel is the largest mapped label, used to choose labels for cleaved superpixels.
+	MaxLabel uint64
+
+	// Materialize is true if locked versions get flattened views of their mapped labels.
+	Materialize bool
+
+	// MaxViews is the most flattened views kept before the oldest are trashed.
+	MaxViews int
+
+	// Views are the flattened views, oldest first.
+	Views []FlatView
+
+	viewsMu sync.RWMutex
+
+	// editMu serializes edits, which assign edit IDs and new labels.
+	editMu sync.Mutex
 }
 
 // JSONString returns the JSON for this Data's configuration
@@ -472,6 +591,15 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 	return nil
 }
 
+// editUser returns the user recorded for an edit request: the authenticated user or, if
+// the request isn't authenticated, the "u" query string.
+func editUser(r *http.Request) string {
+	if user := server.RequestUser(r); user != nil {
+		return user.Name
+	}
+	return r.URL.Query().Get("u")
+}
+
 // DoHTTP handles all incoming HTTP requests for this data.
 func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
@@ -569,6 +697,32 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol on label %d (%s)",
 			r.Method, label, r.URL)
 
+	case "supervoxel":
+		// GET <api URL>/node/<UUID>/<data name>/supervoxel/<id>/sparsevol
+		if len(parts) < 6 || parts[5] != "sparsevol" {
+			err := fmt.Errorf("ERROR: DVID requires 'supervoxel/<id>/sparsevol' request")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		supervoxel, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		data, err := d.GetSupervoxelSparseVol(uuid, supervoxel)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/octet-stream")
+		_, err = w.Write(data)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol on supervoxel %d (%s)",
+			r.Method, supervoxel, r.URL)
+
 	case "sparsevol-by-point":
 		// GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
 		if len(parts) < 5 {
@@ -715,12 +869,16 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			if err := d.CheckSlice(slice); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
 			e, err := labels.NewExtHandler(slice, nil)
 			if err != nil {
 				server.BadRequest(w, r, err.Error())
 				return err
 			}
-			img, err := d.GetMappedImage(uuid, e)
+			img, err := d.getFlatImage(r.Context(), uuid, e)
 			if err != nil {
 				server.BadRequest(w, r, err.Error())
 				return err
@@ -741,12 +899,16 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			if err := d.CheckSubvolume(subvol); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
 			e, err := labels.NewExtHandler(subvol, nil)
 			if err != nil {
 				server.BadRequest(w, r, err.Error())
 				return err
 			}
-			data, err := d.GetMappedVolume(uuid, e)
+			data, err := d.getFlatVolume(r.Context(), uuid, e)
 			if err != nil {
 				server.BadRequest(w, r, err.Error())
 				return err
@@ -761,6 +923,155 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			return fmt.Errorf("DVID currently supports shapes of only 2 and 3 dimensions")
 		}
 
+	case "merge":
+		// POST <api URL>/node/<UUID>/<data name>/merge?u=<user>
+		if op != voxels.PutOp {
+			err := fmt.Errorf("Merges must be POSTed")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var toMerge []uint64
+		if err := json.NewDecoder(r.Body).Decode(&toMerge); err != nil {
+			err = fmt.Errorf("Merge requires a JSON list of labels: %s", err.Error())
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(toMerge) < 2 {
+			err := fmt.Errorf("Merge requires a target label followed by labels to merge")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		edit, err := d.Merge(uuid, editUser(r), toMerge[0], toMerge[1:])
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, `{"Edit": %d}`, edit.ID)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: merge of %v (%s)", r.Method, toMerge, r.URL)
+
+	case "cleave":
+		// POST <api URL>/node/<UUID>/<data name>/cleave/<label>?u=<user>
+		if op != voxels.PutOp {
+			err := fmt.Errorf("Cleaves must be POSTed")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 5 {
+			err := fmt.Errorf("ERROR: DVID requires label ID to follow 'cleave' command")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var superpixels []uint64
+		if err := json.NewDecoder(r.Body).Decode(&superpixels); err != nil {
+			err = fmt.Errorf("Cleave requires a JSON list of superpixels: %s", err.Error())
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		edit, err := d.Cleave(uuid, editUser(r), label, superpixels)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, `{"Edit": %d, "CleavedLabel": %d}`, edit.ID, edit.Moves[0].To)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: cleave of label %d (%s)", r.Method, label, r.URL)
+
+	case "undo":
+		// POST <api URL>/node/<UUID>/<data name>/undo?u=<user>
+		if op != voxels.PutOp {
+			err := fmt.Errorf("Undo must be POSTed")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		edit, err := d.Undo(uuid, editUser(r))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, `{"Edit": %d, "Undone": %d}`, edit.ID, edit.Undoes)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: undo of edit %d (%s)", r.Method, edit.Undoes, r.URL)
+
+	case "label":
+		// GET <api URL>/node/<UUID>/<data name>/label/<label>/history
+		if len(parts) < 6 || parts[5] != "history" {
+			err := fmt.Errorf("ERROR: DVID requires label ID and 'history' to follow 'label' command")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		history, err := d.GetLabelHistory(uuid, label)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(history); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: history of label %d (%s)", r.Method, label, r.URL)
+
+	case "edits":
+		// GET <api URL>/node/<UUID>/<data name>/edits[?since=<edit ID>]
+		if op != voxels.GetOp {
+			err := fmt.Errorf("Edits can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var since uint64
+		if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+			var err error
+			if since, err = strconv.ParseUint(sinceStr, 10, 64); err != nil {
+				err = fmt.Errorf("Bad edit ID %q", sinceStr)
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		}
+		if server.WantsNDJSON(r) {
+			stream := server.NewNDJSONWriter(w)
+			err := d.ProcessEdits(r.Context(), uuid, since, func(edit *Edit) error {
+				return stream.Encode(edit)
+			})
+			if err = stream.Close(err); err != nil {
+				if !stream.Started() {
+					server.BadRequest(w, r, err.Error())
+				}
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: stream of %d edits (%s)", r.Method, stream.Lines(), r.URL)
+			break
+		}
+		edits := []Edit{}
+		err := d.ProcessEdits(r.Context(), uuid, since, func(edit *Edit) error {
+			edits = append(edits, *edit)
+			return d.CheckListKeys(len(edits))
+		})
+		if err != nil {
+			if _, ok := err.(*datastore.LimitError); ok {
+				server.TooLarge(w, r, err.Error())
+			} else {
+				server.BadRequest(w, r, err.Error())
+			}
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(edits); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: %d edits (%s)", r.Method, len(edits), r.URL)
+
 	case "intersect":
 		// GET <api URL>/node/<UUID>/<data name>/intersect/<min block>/<max block>
 		if len(parts) < 6 {
@@ -877,6 +1188,13 @@ func (d *Data) LoadRavelerMaps(request datastore.Request, reply *datastore.Respo
 	}
 
 	service := server.DatastoreService()
+	locked, err := service.Locked(uuid)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return fmt.Errorf("Can't load maps into labelmap '%s' in locked node %s", d.DataName(), uuid)
+	}
 	_, versionID, err := service.LocalIDFromUUID(uuid)
 	if err != nil {
 		return err
@@ -1030,6 +1348,9 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 			return err
 		}
 	}
+	if err := dest.CheckWrite(uuid); err != nil {
+		return err
+	}
 
 	// Iterate through all labels chunks incrementally in Z, loading and then using the maps
 	// for all blocks in that layer.
@@ -1061,7 +1382,7 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 		if op.mapping != nil {
 			startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
 			endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
-			chunkOp := &storage.ChunkOp{op, wg}
+			chunkOp := &storage.ChunkOp{op, wg, nil}
 			err = db.ProcessRange(startKey, endKey, chunkOp, d.ChunkApplyMap)
 			wg.Wait()
 		}
@@ -1108,7 +1429,7 @@ func (d *Data) GetLabelMapping(versionID dvid.VersionLocalID, label []byte) (uin
 	}
 
 	b := keys[0].Bytes()
-	indexBytes := b[datastore.DataKeyIndexOffset:]
+	indexBytes := datastore.DataKeyIndexBytes(b)
 	mapping := binary.BigEndian.Uint64(indexBytes[9:17])
 
 	return mapping, nil
@@ -1179,7 +1500,7 @@ func (d *Data) GetBlockLayerMapping(blockZ int32, op *denormOp) (minChunkPt, max
 		op.mapping = make(map[string]uint64, numKeys)
 		for _, key := range keys {
 			keyBytes := key.Bytes()
-			indexBytes := keyBytes[datastore.DataKeyIndexOffset:]
+			indexBytes := datastore.DataKeyIndexBytes(keyBytes)
 			label := string(indexBytes[1:9])
 			mappedLabel := binary.BigEndian.Uint64(indexBytes[9:17])
 			op.mapping[label] = mappedLabel
@@ -1190,16 +1511,16 @@ func (d *Data) GetBlockLayerMapping(blockZ int32, op *denormOp) (minChunkPt, max
 
 // ChunkApplyMap maps a chunk of labels using the current mapping.
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) ChunkApplyMap(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.chunkApplyMap(chunk)
 }
 
 func (d *Data) chunkApplyMap(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
@@ -1,10 +1,15 @@
 package labelmap
 
 import (
+	"context"
+	"encoding/binary"
 	"testing"
 	. "github.com/janelia-flyem/go/gocheck"
 
 	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
 )
@@ -80,3 +85,291 @@ func (suite *DataSuite) TestSerialization(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(ref.name, Equals, dvid.DataString("mylabels"))
 }
+
+func (suite *DataSuite) TestEdits(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	c.Assert(suite.service.NewData(root, "labels64", "editlabels", config), IsNil)
+	config.Set("Labels", "editlabels")
+	c.Assert(suite.service.NewData(root, "labelmap", "editmap", config), IsNil)
+	labelData, err := labels64.GetByUUID(root, "editlabels")
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "editmap")
+	c.Assert(err, IsNil)
+	lmap := dataservice.(*Data)
+
+	// Superpixels 1, 2, and 3 are slabs along x across two blocks.
+	size := dvid.Point3d{64, 32, 32}
+	data := make([]byte, size.Prod()*8)
+	for i := int32(0); i < int32(size.Prod()); i++ {
+		superpixel := uint64(3)
+		if x := i % 64; x < 20 {
+			superpixel = 1
+		} else if x < 40 {
+			superpixel = 2
+		}
+		binary.BigEndian.PutUint64(data[i*8:], superpixel)
+	}
+	e, err := labelData.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, labelData, e), IsNil)
+
+	// Map superpixels 1 and 2 to label 10 and superpixel 3 to label 20, then build the
+	// spatial indices and sizes.
+	_, versionID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	db, err := server.OrderedKeyValueDB()
+	c.Assert(err, IsNil)
+	mapping := make(map[string]uint64)
+	for superpixel, label := range map[uint64]uint64{1: 10, 2: 10, 3: 20} {
+		c.Assert(db.Put(labels.NewForwardMapKey(lmap, versionID, labelBytes(superpixel), label), dvid.EmptyValue()), IsNil)
+		c.Assert(db.Put(lmap.NewInverseMapKey(versionID, label, superpixel), dvid.EmptyValue()), IsNil)
+		mapping[string(labelBytes(superpixel))] = label
+	}
+	for x := int32(0); x < 2; x++ {
+		block := dvid.IndexZYX{x, 0, 0}
+		rles, err := lmap.blockRLEs(labelData, versionID, block, mapping, 10, 20)
+		c.Assert(err, IsNil)
+		for label, runs := range rles {
+			runsBytes, err := runs.MarshalBinary()
+			c.Assert(err, IsNil)
+			c.Assert(db.Put(labels.NewLabelSpatialMapKey(lmap, versionID, label, block), runsBytes), IsNil)
+		}
+		for _, superpixel := range []uint64{uint64(x) + 1, uint64(x) + 2} {
+			b := labelBytes(superpixel)
+			key := labels.NewSpatialMapKey(lmap, versionID, &block, b, mapping[string(b)])
+			c.Assert(db.Put(key, dvid.EmptyValue()), IsNil)
+		}
+	}
+	c.Assert(db.Put(labels.NewLabelSizesKey(lmap, versionID, 40*32*32, 10), dvid.EmptyValue()), IsNil)
+	c.Assert(db.Put(labels.NewLabelSizesKey(lmap, versionID, 24*32*32, 20), dvid.EmptyValue()), IsNil)
+	lmap.Ready = true
+
+	sizeOf := func(label uint64) uint64 {
+		size, err := lmap.labelSize(db, versionID, label)
+		c.Assert(err, IsNil)
+		return size
+	}
+	mappingOf := func(superpixel uint64) uint64 {
+		label, err := lmap.GetLabelMapping(versionID, labelBytes(superpixel))
+		c.Assert(err, IsNil)
+		return label
+	}
+
+	// A merge that fails for one label changes nothing.
+	_, err = lmap.Merge(root, "tester", 10, []uint64{20, 99})
+	c.Assert(err, NotNil)
+	c.Assert(mappingOf(3), Equals, uint64(20))
+	c.Assert(sizeOf(20), Equals, uint64(24*32*32))
+	c.Assert(lmap.NextEditID, Equals, uint64(0))
+
+	// Merge label 20 into label 10.
+	merge, err := lmap.Merge(root, "tester", 10, []uint64{20})
+	c.Assert(err, IsNil)
+	c.Assert(mappingOf(3), Equals, uint64(10))
+	c.Assert(sizeOf(10), Equals, uint64(64*32*32))
+	c.Assert(sizeOf(20), Equals, uint64(0))
+	jsonStr, err := labels.GetSizeRange(lmap, root, 1, 0)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "[10]")
+
+	// Cleave superpixel 2 into a new label.
+	cleave, err := lmap.Cleave(root, "tester", 10, []uint64{2})
+	c.Assert(err, IsNil)
+	cleaved := cleave.Moves[0].To
+	c.Assert(cleaved, Equals, uint64(21))
+	c.Assert(mappingOf(2), Equals, cleaved)
+	c.Assert(sizeOf(cleaved), Equals, uint64(20*32*32))
+	c.Assert(sizeOf(10), Equals, uint64(44*32*32))
+	_, err = lmap.Cleave(root, "tester", 10, []uint64{2})
+	c.Assert(err, NotNil)
+
+	history, err := lmap.GetLabelHistory(root, 10)
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 2)
+	c.Assert(history[0].ID, Equals, merge.ID)
+	c.Assert(history[0].User, Equals, "tester")
+	c.Assert(history[1].Op, Equals, "cleave")
+
+	// Undo the cleave and then the merge.
+	undo, err := lmap.Undo(root, "tester")
+	c.Assert(err, IsNil)
+	c.Assert(undo.Undoes, Equals, cleave.ID)
+	c.Assert(mappingOf(2), Equals, uint64(10))
+	c.Assert(sizeOf(cleaved), Equals, uint64(0))
+
+	undo, err = lmap.Undo(root, "tester")
+	c.Assert(err, IsNil)
+	c.Assert(undo.Undoes, Equals, merge.ID)
+	c.Assert(mappingOf(3), Equals, uint64(20))
+	c.Assert(sizeOf(10), Equals, uint64(40*32*32))
+	c.Assert(sizeOf(20), Equals, uint64(24*32*32))
+	jsonStr, err = labels.GetSizeRange(lmap, root, 1, 0)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "[20,10]")
+
+	_, err = lmap.Undo(root, "tester")
+	c.Assert(err, NotNil)
+	history, err = lmap.GetLabelHistory(root, 10)
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 4)
+	c.Assert(history[0].Undone, Equals, true)
+
+	// The edit log lists edits after a given edit.
+	var ops []string
+	err = lmap.ProcessEdits(context.Background(), root, cleave.ID, func(edit *Edit) error {
+		ops = append(ops, edit.Op)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []string{"undo", "undo"})
+
+	// Locked nodes can't be edited.
+	c.Assert(suite.service.Lock(root), IsNil)
+	_, err = lmap.Merge(root, "tester", 10, []uint64{20})
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestSupervoxelSparseVol(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	c.Assert(suite.service.NewData(root, "labels64", "svlabels", config), IsNil)
+	config.Set("Labels", "svlabels")
+	c.Assert(suite.service.NewData(root, "labelmap", "svmap", config), IsNil)
+	labelData, err := labels64.GetByUUID(root, "svlabels")
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "svmap")
+	c.Assert(err, IsNil)
+	lmap := dataservice.(*Data)
+
+	// Superpixels 1 and 2 are slabs along x within one block and both map to body 10.
+	size := dvid.Point3d{32, 32, 32}
+	data := make([]byte, size.Prod()*8)
+	for i := int32(0); i < int32(size.Prod()); i++ {
+		superpixel := uint64(2)
+		if i%32 < 12 {
+			superpixel = 1
+		}
+		binary.BigEndian.PutUint64(data[i*8:], superpixel)
+	}
+	e, err := labelData.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, labelData, e), IsNil)
+
+	// Index the superpixels of the labels64 data and the body of the labelmap.
+	_, versionID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	db, err := server.OrderedKeyValueDB()
+	c.Assert(err, IsNil)
+	block := dvid.IndexZYX{0, 0, 0}
+	identity := map[string]uint64{string(labelBytes(1)): 1, string(labelBytes(2)): 2}
+	rles, err := lmap.blockRLEs(labelData, versionID, block, identity, 1, 2)
+	c.Assert(err, IsNil)
+	for superpixel, runs := range rles {
+		runsBytes, err := runs.MarshalBinary()
+		c.Assert(err, IsNil)
+		c.Assert(db.Put(labels.NewLabelSpatialMapKey(labelData, versionID, superpixel, block), runsBytes), IsNil)
+	}
+	mapping := map[string]uint64{string(labelBytes(1)): 10, string(labelBytes(2)): 10}
+	rles, err = lmap.blockRLEs(labelData, versionID, block, mapping, 10)
+	c.Assert(err, IsNil)
+	runsBytes, err := rles[10].MarshalBinary()
+	c.Assert(err, IsNil)
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(lmap, versionID, 10, block), runsBytes), IsNil)
+
+	numRuns := func(encoding []byte) uint32 {
+		c.Assert(len(encoding) >= 12, Equals, true)
+		return binary.LittleEndian.Uint32(encoding[8:12])
+	}
+	body, err := lmap.GetSparseVol(root, 10)
+	c.Assert(err, IsNil)
+	c.Assert(numRuns(body), Equals, uint32(32*32))
+	for _, superpixel := range []uint64{1, 2} {
+		encoding, err := lmap.GetSupervoxelSparseVol(root, superpixel)
+		c.Assert(err, IsNil)
+		c.Assert(numRuns(encoding), Equals, uint32(32*32))
+		c.Assert(len(encoding), Equals, 12+32*32*16)
+	}
+	encoding, err := lmap.GetSupervoxelSparseVol(root, 10)
+	c.Assert(err, IsNil)
+	c.Assert(numRuns(encoding), Equals, uint32(0))
+}
+
+func (suite *DataSuite) TestFlatView(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	c.Assert(suite.service.NewData(root, "labels64", "flatlabels", config), IsNil)
+	config.Set("Labels", "flatlabels")
+	config.Set("Materialize", "true")
+	config.Set("MaxViews", "1")
+	c.Assert(suite.service.NewData(root, "labelmap", "flatmap", config), IsNil)
+	labelData, err := labels64.GetByUUID(root, "flatlabels")
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "flatmap")
+	c.Assert(err, IsNil)
+	lmap := dataservice.(*Data)
+	c.Assert(lmap.Materialize, Equals, true)
+
+	// Superpixels 1 and 2 are slabs along x within one block and both map to body 10.
+	size := dvid.Point3d{32, 32, 32}
+	data := make([]byte, size.Prod()*8)
+	for i := int32(0); i < int32(size.Prod()); i++ {
+		superpixel := uint64(2)
+		if i%32 < 12 {
+			superpixel = 1
+		}
+		binary.BigEndian.PutUint64(data[i*8:], superpixel)
+	}
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size)
+	e, err := labelData.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, labelData, e), IsNil)
+
+	_, versionID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	db, err := server.OrderedKeyValueDB()
+	c.Assert(err, IsNil)
+	for _, superpixel := range []uint64{1, 2} {
+		c.Assert(db.Put(labels.NewForwardMapKey(lmap, versionID, labelBytes(superpixel), 10), dvid.EmptyValue()), IsNil)
+	}
+	lmap.Ready = true
+
+	// Views are only made for locked nodes.
+	c.Assert(lmap.MaterializeView(context.Background(), root), NotNil)
+	c.Assert(suite.service.Lock(root), IsNil)
+	c.Assert(lmap.Commit(context.Background(), root), IsNil)
+	c.Assert(lmap.flatView(root), NotNil)
+
+	e, err = labelData.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	mapped, err := lmap.getFlatVolume(context.Background(), root, e)
+	c.Assert(err, IsNil)
+	c.Assert(mapped, HasLen, len(data))
+	for i := 0; i < len(mapped); i += 8 {
+		if label := binary.BigEndian.Uint64(mapped[i : i+8]); label != 10 {
+			c.Fatalf("Expected label 10 at byte %d of view, got %d", i, label)
+		}
+	}
+
+	// Labels at the viewed version can no longer be written.
+	e, err = labelData.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, labelData, e), NotNil)
+
+	// A view of a newer locked node replaces the oldest view.
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.Lock(child), IsNil)
+	c.Assert(lmap.Commit(context.Background(), child), IsNil)
+	c.Assert(lmap.Views, HasLen, 1)
+	c.Assert(lmap.Views[0].Version, Equals, child)
+	c.Assert(lmap.flatView(root), IsNil)
+	_, err = suite.service.DataServiceByUUID(root, lmap.flatViewName(root))
+	c.Assert(err, NotNil)
+
+	// Data saved before MaxViews existed keeps the default number of views.
+	c.Assert((&Data{}).maxViews(), Equals, DefaultMaxViews)
+}
@@ -0,0 +1,98 @@
+/*
+	This file checks invariants between a label map and its labels for validation jobs.
+*/
+
+package labelmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Validate checks that every superpixel in the forward map has voxels in the related
+// labels64 data, by default the labels being mapped.  The check uses the label statistics
+// visible at the version, so labels64 data without indexed statistics is reported as a
+// violation instead of being checked.
+func (d *Data) Validate(ctx context.Context, uuid dvid.UUID, related []dvid.DataString,
+	violation func(server.Violation)) error {
+
+	var labelData []*labels64.Data
+	if len(related) == 0 {
+		data, err := d.Labels.GetData()
+		if err != nil {
+			return err
+		}
+		labelData = append(labelData, data)
+	}
+	for _, name := range related {
+		data, err := labels64.GetByUUID(uuid, name)
+		if err != nil {
+			return err
+		}
+		labelData = append(labelData, data)
+	}
+	indexed := labelData[:0]
+	for _, data := range labelData {
+		if data.LabelStatsIndexed() {
+			indexed = append(indexed, data)
+			continue
+		}
+		violation(server.Violation{
+			Related: data.DataName(),
+			Check:   "stats-indexed",
+			Detail: fmt.Sprintf("Superpixels weren't checked against '%s' since its label statistics aren't indexed",
+				data.DataName()),
+		})
+	}
+	if len(indexed) == 0 {
+		return nil
+	}
+
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return err
+	}
+	minLabel := make([]byte, 8)
+	maxLabel := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	begKey := labels.NewForwardMapKey(d, versionID, minLabel, 0)
+	endKey := labels.NewForwardMapKey(d, versionID, maxLabel, math.MaxUint64)
+	return storage.ProcessKeyBatches(ctx, db, begKey, endKey, storage.RangeBatchSize,
+		func(keys []storage.Key) error {
+			for _, key := range keys {
+				index := datastore.DataKeyIndexBytes(key.Bytes())
+				if len(index) != 17 {
+					continue
+				}
+				superpixel := binary.BigEndian.Uint64(index[1:9])
+				mapping := binary.BigEndian.Uint64(index[9:17])
+				for _, data := range indexed {
+					_, found, err := data.GetLabelStats(uuid, superpixel)
+					if err != nil {
+						return err
+					}
+					if !found {
+						violation(server.Violation{
+							Related: data.DataName(),
+							Check:   "superpixel-exists",
+							Detail: fmt.Sprintf("Superpixel %d mapped to label %d has no voxels in '%s'",
+								superpixel, mapping, data.DataName()),
+						})
+					}
+				}
+			}
+			return ctx.Err()
+		})
+}
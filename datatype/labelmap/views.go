@@ -0,0 +1,263 @@
+/*
+	This file handles flattened views, labels64 data holding the mapped labels of a locked
+	version so GETs of mapped labels at that version read stored bodies instead of mapping
+	every superpixel.  Views are made when nodes are locked if Materialize is set, and the
+	oldest views are trashed once there are more than MaxViews.  Views stay current since
+	mappings can't be edited at locked nodes and the labels at a viewed version can no
+	longer be written.
+*/
+
+package labelmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	// DefaultMaxViews is the default number of flattened views kept.
+	DefaultMaxViews = 2
+
+	// flatViewTileBlocks is the width and height in blocks of the subvolumes copied into
+	// a view at a time.
+	flatViewTileBlocks = 8
+)
+
+// FlatView is a labels64 data holding the mapped labels of a locked version.
+type FlatView struct {
+	Version dvid.UUID
+	Name    dvid.DataString
+	Created time.Time
+}
+
+// flatViewName returns the name of the view of a version.
+func (d *Data) flatViewName(uuid dvid.UUID) dvid.DataString {
+	prefix := string(uuid)
+	if len(prefix) > 8 {
+		prefix = prefix[:8]
+	}
+	return dvid.DataString(fmt.Sprintf("%s-flat-%s", d.DataName(), prefix))
+}
+
+// flatView returns the view of a version or nil if the version has none.
+func (d *Data) flatView(uuid dvid.UUID) *labels64.Data {
+	d.viewsMu.RLock()
+	defer d.viewsMu.RUnlock()
+	for _, view := range d.Views {
+		if view.Version == uuid {
+			data, err := labels64.GetByUUID(uuid, view.Name)
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	}
+	return nil
+}
+
+// getFlatImage retrieves a 2d image of mapped labels, using the version's view if any.
+func (d *Data) getFlatImage(ctx context.Context, uuid dvid.UUID, e voxels.ExtHandler) (*dvid.Image, error) {
+	if view := d.flatView(uuid); view != nil {
+		return voxels.GetImage(ctx, uuid, view, e)
+	}
+	return d.GetMappedImage(uuid, e)
+}
+
+// getFlatVolume retrieves a volume of mapped labels, using the version's view if any.
+func (d *Data) getFlatVolume(ctx context.Context, uuid dvid.UUID, e voxels.ExtHandler) ([]byte, error) {
+	if view := d.flatView(uuid); view != nil {
+		return voxels.GetVolume(ctx, uuid, view, e)
+	}
+	return d.GetMappedVolume(uuid, e)
+}
+
+// forwardMapping returns the superpixel to label mapping of a version.  Mappings are read
+// in batches so the database isn't held open while they're all read.
+func (d *Data) forwardMapping(ctx context.Context, versionID dvid.VersionLocalID) (map[uint64]uint64, error) {
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	firstKey := labels.NewForwardMapKey(d, versionID, labelBytes(0), 0)
+	lastKey := labels.NewForwardMapKey(d, versionID, labelBytes(math.MaxUint64), math.MaxUint64)
+	mapping := make(map[uint64]uint64)
+	err = storage.ProcessRangeBatches(ctx, db, firstKey, lastKey, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			indexBytes := kv.K.(*datastore.DataKey).Index.Bytes()
+			mapping[binary.BigEndian.Uint64(indexBytes[1:9])] = binary.BigEndian.Uint64(indexBytes[9:17])
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// maxViews returns the most views kept.  Data saved before MaxViews existed keeps the
+// default number of views.
+func (d *Data) maxViews() int {
+	if d.MaxViews < 1 {
+		return DefaultMaxViews
+	}
+	return d.MaxViews
+}
+
+// Commit fulfills the server.Committer interface, materializing a view of a just locked
+// version if Materialize is set.
+func (d *Data) Commit(ctx context.Context, uuid dvid.UUID) error {
+	if !d.Materialize || !d.Ready {
+		return nil
+	}
+	return d.MaterializeView(ctx, uuid)
+}
+
+// MaterializeView stores the mapped labels of a locked version in a new labels64 view and
+// trashes the oldest views beyond MaxViews.  Superpixels without a mapping are stored as
+// themselves.
+func (d *Data) MaterializeView(ctx context.Context, uuid dvid.UUID) error {
+	startTime := time.Now()
+	service := server.DatastoreService()
+	locked, err := service.Locked(uuid)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("Can't materialize labelmap '%s' at unlocked node %s", d.DataName(), uuid)
+	}
+	_, versionID, err := service.LocalIDFromUUID(uuid)
+	if err != nil {
+		return err
+	}
+	labelData, err := d.Labels.GetData()
+	if err != nil {
+		return err
+	}
+	mapping, err := d.forwardMapping(ctx, versionID)
+	if err != nil {
+		return err
+	}
+
+	// Freeze the labels at the version once any write in progress is done.
+	labelMutex := labelData.VersionMutex(versionID)
+	labelMutex.Lock()
+	labelData.MarkViewed(versionID)
+	labelMutex.Unlock()
+
+	// Use an existing view, e.g., from an interrupted commit, or add one with the same
+	// blocks as the labels.
+	name := d.flatViewName(uuid)
+	view, err := labels64.GetByUUID(uuid, name)
+	if err != nil {
+		blockSize := labelData.BlockSize()
+		config := dvid.NewConfig()
+		config.Set("BlockSize", fmt.Sprintf("%d,%d,%d", blockSize.Value(0), blockSize.Value(1), blockSize.Value(2)))
+		if err := service.NewData(uuid, "labels64", name, config); err != nil {
+			return err
+		}
+		if view, err = labels64.GetByUUID(uuid, name); err != nil {
+			return err
+		}
+	}
+
+	// Copy mapped labels a tile of blocks at a time.
+	minPt, maxPt := labelData.VoxelExtents()
+	if minPt != nil && maxPt != nil {
+		blockSize := labelData.BlockSize()
+		tileSize := dvid.Point3d{
+			blockSize.Value(0) * flatViewTileBlocks,
+			blockSize.Value(1) * flatViewTileBlocks,
+			blockSize.Value(2),
+		}
+		var beg, end dvid.Point3d
+		for dim := uint8(0); dim < 3; dim++ {
+			beg[dim] = alignDown(minPt.Value(dim), blockSize.Value(dim))
+			end[dim] = maxPt.Value(dim)
+		}
+		byteOrder := labelData.ByteOrder
+		for z := beg[2]; z <= end[2]; z += tileSize[2] {
+			for y := beg[1]; y <= end[1]; y += tileSize[1] {
+				for x := beg[0]; x <= end[0]; x += tileSize[0] {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					offset := dvid.Point3d{x, y, z}
+					var size dvid.Point3d
+					for dim := 0; dim < 3; dim++ {
+						size[dim] = tileSize[dim]
+						if offset[dim]+size[dim] > end[dim]+1 {
+							size[dim] = end[dim] + 1 - offset[dim]
+						}
+					}
+					subvol := dvid.NewSubvolume(offset, size)
+					e, err := labelData.NewExtHandler(subvol, nil)
+					if err != nil {
+						return err
+					}
+					data, err := voxels.GetVolume(ctx, uuid, labelData, e)
+					if err != nil {
+						return err
+					}
+					for i := 0; i+8 <= len(data); i += 8 {
+						if label, found := mapping[byteOrder.Uint64(data[i:i+8])]; found {
+							byteOrder.PutUint64(data[i:i+8], label)
+						}
+					}
+					mapped, err := view.NewExtHandler(subvol, data)
+					if err != nil {
+						return err
+					}
+					if err := voxels.PutVoxels(ctx, uuid, view, mapped); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// Record the view and trash the oldest views.
+	d.viewsMu.Lock()
+	views := []FlatView{}
+	for _, v := range d.Views {
+		if v.Version != uuid {
+			views = append(views, v)
+		}
+	}
+	views = append(views, FlatView{Version: uuid, Name: name, Created: time.Now()})
+	var expired []FlatView
+	if maxViews := d.maxViews(); len(views) > maxViews {
+		expired = views[:len(views)-maxViews]
+		views = views[len(views)-maxViews:]
+	}
+	d.Views = views
+	d.viewsMu.Unlock()
+	for _, v := range expired {
+		if err := service.DeleteData(uuid, v.Name); err != nil {
+			dvid.Error("Unable to trash view '%s' of labelmap '%s': %s\n", v.Name, d.DataName(), err.Error())
+		}
+	}
+	if err := service.SaveDataset(uuid); err != nil {
+		return err
+	}
+	dvid.ElapsedTime(dvid.Normal, startTime, "Materialized labelmap '%s' at node %s into '%s'",
+		d.DataName(), uuid, name)
+	return nil
+}
+
+// alignDown returns the largest multiple of n that's at most v.
+func alignDown(v, n int32) int32 {
+	if v < 0 {
+		return -((-v + n - 1) / n * n)
+	}
+	return v / n * n
+}
@@ -51,6 +51,22 @@ const (
 	// KeyLabelSizes have keys of form 'v+b'.
 	// They allow rapid size range queries.
 	KeyLabelSizes
+
+	// KeyLabelStats have keys of form 'b' and have voxel counts, bounding boxes,
+	// and coordinate sums for a label as the value.
+	KeyLabelStats
+
+	// KeyEditLog have keys of form 'e' where e is an edit ID, and have a record of
+	// the edit, e.g., a merge of labels, as the value.
+	KeyEditLog
+
+	// KeyLabelEdits have keys of form 'b+e' and allow retrieval of all edits that
+	// affected a mapped label.
+	KeyLabelEdits
+
+	// KeyLabelStatsSizes have keys of form 'v+b' where v is the complement of the voxel
+	// count, so labels with statistics are ordered by decreasing size.
+	KeyLabelStatsSizes
 )
 
 var (
@@ -74,6 +90,14 @@ func (t KeyType) String() string {
 		return "Forward Label to Spatial Index Map"
 	case KeyLabelSizes:
 		return "Forward Label sorted by volume"
+	case KeyLabelStats:
+		return "Forward Label statistics"
+	case KeyEditLog:
+		return "Label edit log"
+	case KeyLabelEdits:
+		return "Forward Label to edit log"
+	case KeyLabelStatsSizes:
+		return "Forward Label statistics sorted by decreasing volume"
 	default:
 		return "Unknown Key Type"
 	}
@@ -98,6 +122,24 @@ func NewLabelSizesKey(labeler Labeler, vID dvid.VersionLocalID, size, label uint
 	return labeler.DataKey(vID, dvid.IndexBytes(index))
 }
 
+// NewLabelStatsKey returns a datastore.DataKey that provides statistics for a given label.
+func NewLabelStatsKey(labeler Labeler, vID dvid.VersionLocalID, label uint64) *datastore.DataKey {
+	index := make([]byte, 9)
+	index[0] = byte(KeyLabelStats)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	return labeler.DataKey(vID, dvid.IndexBytes(index))
+}
+
+// NewLabelStatsSizeKey returns a datastore.DataKey that encodes a "size + label" for a label
+// with statistics, ordered by decreasing size.
+func NewLabelStatsSizeKey(labeler Labeler, vID dvid.VersionLocalID, size, label uint64) *datastore.DataKey {
+	index := make([]byte, 17)
+	index[0] = byte(KeyLabelStatsSizes)
+	binary.BigEndian.PutUint64(index[1:9], math.MaxUint64-size)
+	binary.BigEndian.PutUint64(index[9:17], label)
+	return labeler.DataKey(vID, dvid.IndexBytes(index))
+}
+
 // NewLabelSurfaceKey returns a datastore.DataKey that provides a surface for a given label.
 func NewLabelSurfaceKey(labeler Labeler, vID dvid.VersionLocalID, label uint64) *datastore.DataKey {
 	index := make([]byte, 8)
@@ -265,3 +307,27 @@ func GetSizeRange(labeler Labeler, uuid dvid.UUID, minSize, maxSize uint64) (str
 	}
 	return string(m), nil
 }
+
+var modifications struct {
+	sync.Mutex
+	counts map[dvid.DatasetLocalID]uint64
+}
+
+// MarkModified notes a change in the labels or label mappings of a dataset so results
+// derived from labels, e.g., synapse counts per body, can be lazily recomputed.
+func MarkModified(dsetID dvid.DatasetLocalID) {
+	modifications.Lock()
+	if modifications.counts == nil {
+		modifications.counts = make(map[dvid.DatasetLocalID]uint64)
+	}
+	modifications.counts[dsetID]++
+	modifications.Unlock()
+}
+
+// Modifications returns the number of label changes within a dataset since the server
+// started.  Derived results that were computed at a different count are stale.
+func Modifications(dsetID dvid.DatasetLocalID) uint64 {
+	modifications.Lock()
+	defer modifications.Unlock()
+	return modifications.counts[dsetID]
+}
@@ -0,0 +1,299 @@
+/*
+	This file maintains the label block index, i.e., the KeyLabelSpatialMap keys that give
+	the runs of a label within each block containing it.  Sparse volume and coarse volume
+	queries only read the keys of the requested label.  The index is updated as blocks are
+	written and can be rebuilt from the stored blocks of a version with a job.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// blockIndexMutex keeps incremental updates of the label block index from interleaving
+// with a rebuild of the index.
+var blockIndexMutex sync.RWMutex
+
+// checkBlockIndex returns an error if the label block index of a version isn't up to date.
+func (d *Data) checkBlockIndex(versionID dvid.VersionLocalID) error {
+	if !d.blocksIndexed(versionID) {
+		return fmt.Errorf("Label block index for '%s' is not up to date.  Use the 'blockindex' command to rebuild it.",
+			d.DataName())
+	}
+	return nil
+}
+
+// blocksIndexed returns true if the label block index of a version is up to date.
+func (d *Data) blocksIndexed(versionID dvid.VersionLocalID) bool {
+	d.blockIndexMu.RLock()
+	defer d.blockIndexMu.RUnlock()
+	return !d.BlocksUnindexed[versionID]
+}
+
+// setBlocksIndexed records whether the label block index of a version is up to date.
+// The map is replaced rather than modified so a concurrent save of the dataset encodes
+// either the old or the new map.
+func (d *Data) setBlocksIndexed(versionID dvid.VersionLocalID, indexed bool) {
+	d.blockIndexMu.Lock()
+	defer d.blockIndexMu.Unlock()
+	unindexed := make(map[dvid.VersionLocalID]bool, len(d.BlocksUnindexed)+1)
+	for v := range d.BlocksUnindexed {
+		if v != versionID {
+			unindexed[v] = true
+		}
+	}
+	if !indexed {
+		unindexed[versionID] = true
+	}
+	d.BlocksUnindexed = unindexed
+}
+
+// blockIndexZYX returns the ZYX index of a block.
+func blockIndexZYX(index dvid.ChunkIndexer) (dvid.IndexZYX, error) {
+	switch zyx := index.(type) {
+	case dvid.IndexZYX:
+		return zyx, nil
+	case *dvid.IndexZYX:
+		return *zyx, nil
+	}
+	return dvid.IndexZYX{}, fmt.Errorf("Label block index requires ZYX indexing, not %s", index)
+}
+
+// blockRLEs returns the runs along x of each nonzero label in a block of labels.
+func (d *Data) blockRLEs(index dvid.ChunkIndexer, blockData []byte) map[uint64]dvid.RLEs {
+	labelRLEs := make(map[uint64]dvid.RLEs, 10)
+	firstPt := index.MinPoint(d.BlockSize()).(dvid.Point3d)
+	lastPt := index.MaxPoint(d.BlockSize()).(dvid.Point3d)
+
+	var curStart dvid.Point3d
+	var voxelLabel, curLabel uint64
+	var curRun int32
+	start := 0
+	for z := firstPt[2]; z <= lastPt[2]; z++ {
+		for y := firstPt[1]; y <= lastPt[1]; y++ {
+			for x := firstPt[0]; x <= lastPt[0]; x++ {
+				voxelLabel = d.Properties.ByteOrder.Uint64(blockData[start : start+8])
+				start += 8
+
+				// If we hit background or have switched label, save old run and start new one.
+				if voxelLabel == 0 || voxelLabel != curLabel {
+					if curRun > 0 {
+						labelRLEs[curLabel] = append(labelRLEs[curLabel], dvid.NewRLE(curStart, curRun))
+					}
+					if voxelLabel != 0 {
+						curStart = dvid.Point3d{x, y, z}
+						curRun = 1
+					} else {
+						curRun = 0
+					}
+					curLabel = voxelLabel
+				} else {
+					curRun++
+				}
+			}
+			// Force break of any runs when we finish x scan.
+			if curRun > 0 {
+				labelRLEs[curLabel] = append(labelRLEs[curLabel], dvid.NewRLE(curStart, curRun))
+				curLabel = 0
+				curRun = 0
+			}
+		}
+	}
+	return labelRLEs
+}
+
+// updateBlockIndex applies the change in labels from writing a block to the label block
+// index.  Keys of labels no longer in the block are deleted and keys of labels whose runs
+// changed are replaced.
+func (d *Data) updateBlockIndex(versionID dvid.VersionLocalID, index dvid.ChunkIndexer,
+	oldData, newData []byte) error {
+
+	zyx, err := blockIndexZYX(index)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.updateBlockIndex()", d.DataName())
+	}
+	oldRLEs := d.blockRLEs(index, oldData)
+	newRLEs := d.blockRLEs(index, newData)
+
+	// Find the changed keys before starting a batch, since empty batches can't be committed.
+	var deleted []uint64
+	for label := range oldRLEs {
+		if _, found := newRLEs[label]; !found {
+			deleted = append(deleted, label)
+		}
+	}
+	changed := make(map[uint64][]byte, len(newRLEs))
+	for label, rles := range newRLEs {
+		runsBytes, err := rles.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if old, found := oldRLEs[label]; found {
+			oldBytes, err := old.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(oldBytes, runsBytes) {
+				continue
+			}
+		}
+		changed[label] = runsBytes
+	}
+	if len(deleted) == 0 && len(changed) == 0 {
+		return nil
+	}
+
+	blockIndexMutex.RLock()
+	defer blockIndexMutex.RUnlock()
+
+	batch := batcher.NewBatch()
+	for _, label := range deleted {
+		batch.Delete(labels.NewLabelSpatialMapKey(d, versionID, label, zyx))
+	}
+	for label, runsBytes := range changed {
+		batch.Put(labels.NewLabelSpatialMapKey(d, versionID, label, zyx), runsBytes)
+	}
+	return batch.Commit()
+}
+
+// StartBlockIndexJob starts a job that rebuilds the label block index of a version from
+// its stored blocks, e.g., for data written before the index was kept up to date.  Queries
+// at the version that use the index return errors until the job finishes, even if the
+// server restarts before then.
+func (d *Data) StartBlockIndexJob(uuid dvid.UUID) (*server.Job, error) {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	d.setBlocksIndexed(versionID, false)
+	if err := server.DatastoreService().SaveDataset(uuid); err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("Rebuild label block index of %q", d.DataName())
+	job := server.NewJob(description)
+	go func() {
+		err := d.computeBlockIndex(versionID, job)
+		if err == nil {
+			d.setBlocksIndexed(versionID, true)
+			err = server.DatastoreService().SaveDataset(uuid)
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	return job, nil
+}
+
+func (d *Data) computeBlockIndex(versionID dvid.VersionLocalID, job *server.Job) error {
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.computeBlockIndex()", d.DataName())
+	}
+	blockIndexMutex.Lock()
+	defer blockIndexMutex.Unlock()
+
+	// Delete the old index a batch at a time.
+	firstKey := labels.NewLabelSpatialMapKey(d, versionID, 0, dvid.MinIndexZYX)
+	lastKey := labels.NewLabelSpatialMapKey(d, versionID, math.MaxUint64, dvid.MaxIndexZYX)
+	var batch storage.Batch
+	var numDeleted int
+	err = storage.ProcessRangeBatches(context.Background(), db, firstKey, lastKey, storage.RangeBatchSize,
+		func(kv *storage.KeyValue) error {
+			if batch == nil {
+				batch = batcher.NewBatch()
+			}
+			batch.Delete(kv.K)
+			numDeleted++
+			if numDeleted%storage.RangeBatchSize != 0 {
+				return nil
+			}
+			err := batch.Commit()
+			batch = nil
+			return err
+		})
+	if err == nil && batch != nil {
+		err = batch.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	job.SetProgress(0.1)
+
+	// Index the blocks a layer at a time.
+	extents := d.Extents()
+	if extents.MinIndex == nil || extents.MaxIndex == nil {
+		return nil
+	}
+	dataID := d.DataID()
+	minIndexZ := extents.MinIndex.Value(2)
+	maxIndexZ := extents.MaxIndex.Value(2)
+	var numBlocks int
+	for z := minIndexZ; z <= maxIndexZ; z++ {
+		minIndex := dvid.IndexZYX{dvid.MinChunkPoint3d[0], dvid.MinChunkPoint3d[1], z}
+		maxIndex := dvid.IndexZYX{dvid.MaxChunkPoint3d[0], dvid.MaxChunkPoint3d[1], z}
+		startKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: versionID, Index: minIndex}
+		endKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: versionID, Index: maxIndex}
+		keyvalues, err := db.GetRange(startKey, endKey)
+		if err != nil {
+			return err
+		}
+		var batch storage.Batch
+		for _, kv := range keyvalues {
+			index, err := datastore.KeyToChunkIndexer(kv.K)
+			if err != nil {
+				return err
+			}
+			zyx, err := blockIndexZYX(index)
+			if err != nil {
+				return err
+			}
+			blockData, _, err := dvid.DeserializeData(kv.V, true)
+			if err != nil {
+				return err
+			}
+			for label, rles := range d.blockRLEs(index, blockData) {
+				runsBytes, err := rles.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				if batch == nil {
+					batch = batcher.NewBatch()
+				}
+				batch.Put(labels.NewLabelSpatialMapKey(d, versionID, label, zyx), runsBytes)
+			}
+		}
+		if batch != nil {
+			if err := batch.Commit(); err != nil {
+				return err
+			}
+		}
+		numBlocks += len(keyvalues)
+		job.SetProgress(0.1 + 0.9*float32(z-minIndexZ+1)/float32(maxIndexZ-minIndexZ+1))
+	}
+	dvid.Log(dvid.Debug, "Indexed labels of %d blocks in %q\n", numBlocks, d.DataName())
+	return nil
+}
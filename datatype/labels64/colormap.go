@@ -0,0 +1,122 @@
+/*
+	This file manages named colormaps of label data, which are stored with the data's
+	configuration and used to color label slices and voxels overlays.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// colormapMutex guards the colormaps of all labels64 data.
+var colormapMutex sync.RWMutex
+
+// Colormap returns a copy of the named colormap.  The DefaultColormap, which colors every
+// label by hash, is available unless a colormap of that name is stored.
+func (d *Data) Colormap(name string) (voxels.Colormap, error) {
+	colormapMutex.RLock()
+	defer colormapMutex.RUnlock()
+	stored, found := d.Colormaps[name]
+	if !found {
+		if name == voxels.DefaultColormap {
+			return voxels.Colormap{}, nil
+		}
+		return nil, fmt.Errorf("Data '%s' has no colormap %q", d.DataName(), name)
+	}
+	cm := make(voxels.Colormap, len(stored))
+	for label, c := range stored {
+		cm[label] = c
+	}
+	return cm, nil
+}
+
+// ColormapNames returns the sorted names of stored colormaps.
+func (d *Data) ColormapNames() []string {
+	colormapMutex.RLock()
+	defer colormapMutex.RUnlock()
+	names := make([]string, 0, len(d.Colormaps))
+	for name := range d.Colormaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EditColormap changes the colors of labels in a named colormap, creating it if necessary.
+// If replace is true, the colormap only has the given colors afterwards.
+func (d *Data) EditColormap(uuid dvid.UUID, name string, edits map[string]*string, replace bool) error {
+	colormapMutex.Lock()
+	defer colormapMutex.Unlock()
+	cm := voxels.Colormap{}
+	if stored, found := d.Colormaps[name]; found && !replace {
+		for label, c := range stored {
+			cm[label] = c
+		}
+	}
+	if err := cm.Edit(edits); err != nil {
+		return err
+	}
+	if d.Colormaps == nil {
+		d.Colormaps = make(map[string]voxels.Colormap)
+	}
+	d.Colormaps[name] = cm
+	return server.DatastoreService().SaveDataset(uuid)
+}
+
+// DeleteColormap removes a named colormap.
+func (d *Data) DeleteColormap(uuid dvid.UUID, name string) error {
+	colormapMutex.Lock()
+	defer colormapMutex.Unlock()
+	if _, found := d.Colormaps[name]; !found {
+		return fmt.Errorf("Data '%s' has no colormap %q", d.DataName(), name)
+	}
+	delete(d.Colormaps, name)
+	return server.DatastoreService().SaveDataset(uuid)
+}
+
+// serveColormap handles requests for the names of colormaps in the form
+// GET <api URL>/node/<UUID>/<data name>/colormaps and requests for a colormap in the form
+// GET|POST|DELETE <api URL>/node/<UUID>/<data name>/colormap/<name>.
+func (d *Data) serveColormap(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) error {
+	action := strings.ToLower(r.Method)
+	if parts[3] == "colormaps" {
+		if action != "get" {
+			return fmt.Errorf("Colormap names can only be retrieved with GET")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(d.ColormapNames())
+	}
+	if len(parts) < 5 || parts[4] == "" {
+		return fmt.Errorf("'colormap' must be followed by a colormap name")
+	}
+	name := parts[4]
+	switch action {
+	case "get":
+		cm, err := d.Colormap(name)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(cm)
+	case "post", "put":
+		var edits map[string]*string
+		if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+			return fmt.Errorf("Bad colormap JSON: %s", err.Error())
+		}
+		return d.EditColormap(uuid, name, edits, r.URL.Query().Get("replace") == "true")
+	case "delete":
+		return d.DeleteColormap(uuid, name)
+	default:
+		return fmt.Errorf("Colormaps can only be handled with GET, POST, PUT, or DELETE")
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/janelia-flyem/dvid/datastore"
 	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/roi"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
 	"github.com/janelia-flyem/dvid/storage"
@@ -37,7 +38,7 @@ func (d *Data) computeSurface(surfaceCh chan *storage.Chunk, db storage.OrderedK
 
 	defer func() {
 		wg.Done()
-		server.HandlerToken <- 1
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 	}()
 
 	// Sequentially process all the sparse volume data for each label
@@ -127,6 +128,9 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 		return 0, fmt.Errorf("Error getting '%s' block for index %s\n",
 			d.DataName(), blockCoord)
 	}
+	if serialization == nil {
+		return 0, nil
+	}
 	labelData, _, err := dvid.DeserializeData(serialization, true)
 	if err != nil {
 		return 0, fmt.Errorf("Unable to deserialize block %s in '%s': %s\n",
@@ -168,6 +172,9 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
 		return nil, err
 	}
+	if err := d.checkBlockIndex(versionID); err != nil {
+		return nil, err
+	}
 
 	db, err := server.OrderedKeyValueGetter()
 	if err != nil {
@@ -190,7 +197,7 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	// Process all the b+s keys and their values, which contain RLE runs for that label.
 	wg := new(sync.WaitGroup)
 	op := &sparseOp{versionID: versionID, encoding: buf.Bytes()}
-	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg}, func(chunk *storage.Chunk) {
+	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg, nil}, func(chunk *storage.Chunk) {
 		op := chunk.Op.(*sparseOp)
 		op.numBlocks++
 		op.encoding = append(op.encoding, chunk.V...)
@@ -209,6 +216,113 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	return op.encoding, nil
 }
 
+// GetCoarseVol returns an encoded sparse volume of the blocks that contain a label, where
+// runs are in block coordinates.  The encoding is the same as GetSparseVol.
+func (d *Data) GetCoarseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
+	service := server.DatastoreService()
+	_, versionID, err := service.LocalIDFromUUID(uuid)
+	if err != nil {
+		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
+		return nil, err
+	}
+	if err := d.checkBlockIndex(versionID); err != nil {
+		return nil, err
+	}
+
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the sparse volume header
+	buf := new(bytes.Buffer)
+	buf.WriteByte(dvid.EncodingBinary)
+	binary.Write(buf, binary.LittleEndian, uint8(3))
+	binary.Write(buf, binary.LittleEndian, byte(0))
+	buf.WriteByte(byte(0))
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # voxels
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # spans
+
+	// The b+s keys are ordered by block index in ZYX order, so runs along X are
+	// consecutive keys.
+	firstKey := labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MinIndexZYX)
+	lastKey := labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MaxIndexZYX)
+	keys, err := db.KeysInRange(firstKey, lastKey)
+	if err != nil {
+		return nil, err
+	}
+	var rles dvid.RLEs
+	var curStart dvid.Point3d
+	var curRun int32
+	for _, key := range keys {
+		indexBytes := key.(*datastore.DataKey).Index.Bytes()
+		index, err := dvid.IndexZYX{}.IndexFromBytes(indexBytes[9 : 9+dvid.IndexZYXSize])
+		if err != nil {
+			return nil, err
+		}
+		block := dvid.Point3d(*(index.(*dvid.IndexZYX)))
+		if curRun > 0 && block[1] == curStart[1] && block[2] == curStart[2] && block[0] == curStart[0]+curRun {
+			curRun++
+			continue
+		}
+		if curRun > 0 {
+			rles = append(rles, dvid.NewRLE(curStart, curRun))
+		}
+		curStart = block
+		curRun = 1
+	}
+	if curRun > 0 {
+		rles = append(rles, dvid.NewRLE(curStart, curRun))
+	}
+	runsBytes, err := rles.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	encoding := append(buf.Bytes(), runsBytes...)
+	binary.LittleEndian.PutUint32(encoding[8:12], uint32(len(rles)))
+
+	dvid.Log(dvid.Debug, "For data '%s' label %d: found %d blocks, %d runs\n",
+		d.DataName(), label, len(keys), len(rles))
+	return encoding, nil
+}
+
+// LabelSpans returns the spans of blocks, in block coordinates, that contain a label.
+func (d *Data) LabelSpans(uuid dvid.UUID, label uint64) ([]roi.Span, error) {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkBlockIndex(versionID); err != nil {
+		return nil, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	firstKey := labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MinIndexZYX)
+	lastKey := labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MaxIndexZYX)
+	keys, err := db.KeysInRange(firstKey, lastKey)
+	if err != nil {
+		return nil, err
+	}
+	spans := []roi.Span{}
+	for _, key := range keys {
+		indexBytes := key.(*datastore.DataKey).Index.Bytes()
+		index, err := dvid.IndexZYX{}.IndexFromBytes(indexBytes[9 : 9+dvid.IndexZYXSize])
+		if err != nil {
+			return nil, err
+		}
+		block := dvid.Point3d(*(index.(*dvid.IndexZYX)))
+		last := len(spans) - 1
+		if last >= 0 && spans[last][0] == block[2] && spans[last][1] == block[1] && spans[last][3] == block[0]-1 {
+			spans[last][3] = block[0]
+			continue
+		}
+		spans = append(spans, roi.Span{block[2], block[1], block[0], block[0]})
+	}
+	return spans, nil
+}
+
 // GetSurface returns a gzipped byte array with # voxels and float32 arrays for vertices and
 // normals.
 func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, err error) {
@@ -290,7 +404,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		maxIndex := dvid.IndexZYX(maxChunkPt)
 		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
 		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
-		chunkOp := &storage.ChunkOp{op, wg}
+		chunkOp := &storage.ChunkOp{op, wg, nil}
 		err = db.ProcessRange(startKey, endKey, chunkOp, d.DenormalizeChunk)
 		wg.Wait()
 
@@ -313,7 +427,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	numSurfCalculators := dvid.EstimateGoroutines(0.5, goroutineMB)
 	surfaceCh := make([]chan *storage.Chunk, numSurfCalculators, numSurfCalculators)
 	for i := 0; i < numSurfCalculators; i++ {
-		<-server.HandlerToken
+		server.HandlerPoolFor(d.DatatypeName()).Acquire()
 		surfaceCh[i] = make(chan *storage.Chunk, 10000)
 		wg.Add(1)
 		go d.computeSurface(surfaceCh[i], db, versionID, wg)
@@ -324,6 +438,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		wg.Wait()
 		dvid.ElapsedTime(dvid.Debug, startTime, "Finished processing all RLEs for labels '%s'", d.DataName())
 		d.Ready = true
+		d.setBlocksIndexed(versionID, true)
 		if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 			dvid.Log(dvid.Normal, "Could not save READY state to data '%s', uuid %s: %s",
 				d.DataName(), uuid, err.Error())
@@ -335,7 +450,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		dataKey := chunk.K.(*datastore.DataKey)
 		indexBytes := dataKey.Index.Bytes()
 		label := binary.BigEndian.Uint64(indexBytes[1:9])
-		chunk.ChunkOp = &storage.ChunkOp{label, nil}
+		chunk.ChunkOp = &storage.ChunkOp{label, nil, nil}
 
 		// Send RLE of label to size indexer and surface calculator.
 		sizeCh <- chunk
@@ -354,16 +469,16 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 
 // DenormalizeChunk processes a chunk of data as part of a mapped operation.
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) DenormalizeChunk(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.denormalizeChunk(chunk)
 }
 
 func (d *Data) denormalizeChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
@@ -410,46 +525,7 @@ func (d *Data) denormalizeChunk(chunk *storage.Chunk) {
 		dvid.Log(dvid.Normal, "Retrieved, deserialized block is wrong size: %d bytes\n", blockBytes)
 		return
 	}
-	labelRLEs := make(map[uint64]dvid.RLEs, 10)
-	firstPt := zyx.MinPoint(op.source.BlockSize()).(dvid.Point3d)
-	lastPt := zyx.MaxPoint(op.source.BlockSize()).(dvid.Point3d)
-
-	var curStart dvid.Point3d
-	var voxelLabel, curLabel uint64
-	var z, y, x, curRun int32
-	start := 0
-	for z = firstPt.Value(2); z <= lastPt.Value(2); z++ {
-		for y = firstPt.Value(1); y <= lastPt.Value(1); y++ {
-			for x = firstPt.Value(0); x <= lastPt.Value(0); x++ {
-				voxelLabel = d.Properties.ByteOrder.Uint64(blockData[start : start+8])
-				start += 8
-
-				// If we hit background or have switched label, save old run and start new one.
-				if voxelLabel == 0 || voxelLabel != curLabel {
-					// Save old run
-					if curRun > 0 {
-						labelRLEs[curLabel] = append(labelRLEs[curLabel], dvid.NewRLE(curStart, curRun))
-					}
-					// Start new one if not zero label.
-					if voxelLabel != 0 {
-						curStart = dvid.Point3d{x, y, z}
-						curRun = 1
-					} else {
-						curRun = 0
-					}
-					curLabel = voxelLabel
-				} else {
-					curRun++
-				}
-			}
-			// Force break of any runs when we finish x scan.
-			if curRun > 0 {
-				labelRLEs[curLabel] = append(labelRLEs[curLabel], dvid.NewRLE(curStart, curRun))
-				curLabel = 0
-				curRun = 0
-			}
-		}
-	}
+	labelRLEs := d.blockRLEs(zyx, blockData)
 
 	// Store the KeyLabelSpatialMap keys (index = b + s) with slice of runs for value.
 	labels.StoreKeyLabelSpatialMap(d, batcher, op.versionID, zyxBytes, labelRLEs)
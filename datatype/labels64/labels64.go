@@ -7,12 +7,12 @@ package labels64
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"image"
-	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -21,6 +21,7 @@ import (
 
 	"github.com/janelia-flyem/dvid/datastore"
 	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/roi"
 	"github.com/janelia-flyem/dvid/datatype/voxels"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
@@ -64,6 +65,14 @@ $ dvid dataset <UUID> new labels64 <data name> <settings...>
     BlockSize      Size in pixels  (default: %s)
     VoxelSize      Resolution of voxels (default: 8.0, 8.0, 8.0)
     VoxelUnits     Resolution units (default: "nanometers")
+    MaxSliceArea   Maximum voxels in a GET of a 2d slice; larger requests get a 413 (default: no limit)
+    MaxSubvolumeVoxels
+                   Maximum voxels in a GET of a 3d subvolume or precomputed chunk; larger requests
+                     get a 413 (default: no limit)
+    MaxListKeys    Maximum labels returned by "labels/top" and "labels/stats"; larger requests get
+                     a 413 (default: no limit)
+    TTL            Time to live, e.g., "72h", after which the data and all its keys are deleted.
+                     POSTing a new TTL restarts it and "none" removes it (default: none)
 
 $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
 
@@ -79,6 +88,21 @@ $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
 
     $ dvid node 3f8c superpixels load 0,0,100 "data/*.png" proc=noindex
 
+$ dvid node <UUID> <data name> mesh <label> <keyvalue data name> <settings...>
+
+    Starts a job that computes a surface mesh of the label using marching cubes and
+    stores it in Wavefront OBJ format under the key "<label>.obj" in the given keyvalue
+    data.  Vertex coordinates are in voxels at full resolution.  Use "dvid jobs <job ID>"
+    to get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c superpixels mesh 23 meshes scale=2
+
+    Configuration Settings (case-insensitive keys)
+
+    scale          Mesh is computed on voxels downsampled by 2^scale (default: 0).
+
     Arguments:
 
     UUID          Hexidecimal string with enough characters to uniquely identify a version node.
@@ -93,6 +117,91 @@ $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
     				 for data that will evaluated using labelmap data, e.g., Raveler superpixels,
     				 and is automatically set if LabelType is "Raveler".
 
+$ dvid node <UUID> <data name> copyregion <src UUID> <src data name> <offset> <size>
+
+    Starts a job that copies a subvolume of labels from labels64 data at the source version
+    into this data, entirely within the server, e.g., to patch a bad region with labels from
+    an earlier version.  Offset and size are given as "x,y,z".  Use "dvid jobs <job ID>" to
+    get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c bodies copyregion 1a2b bodies 0,0,100 512,512,64
+
+$ dvid node <UUID> <data name> roi <label> <roi name>
+
+    Creates roi data holding every block that contains the label, using the block size of
+    this data.  Requires the label block index of the version.
+
+    Example: 
+
+    $ dvid node 3f8c bodies roi 23 body23-blocks
+
+$ dvid node <UUID> <data name> stats
+
+    Starts a job that recomputes the voxel count, bounding box, and centroid of every label
+    from the stored blocks.  Statistics are kept up to date as blocks are written, but
+    bounding boxes only grow, so recomputing tightens them after labels are overwritten.
+    Data created by older versions of DVID must be recomputed before statistics are
+    available.  Use "dvid jobs <job ID>" to get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c superpixels stats
+
+$ dvid node <UUID> <data name> blockindex
+
+    Starts a job that rebuilds the label block index of the version, which gives the blocks
+    containing each label and is used by sparsevol, coarsevol, and roi queries, from the
+    stored blocks.  The index is kept up to date as blocks are written, so it only needs to
+    be rebuilt if it was damaged.  Sparse volume queries at the version return errors until
+    the job finishes.  Use "dvid jobs <job ID>" to get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c superpixels blockindex
+
+$ dvid node <UUID> <data name> pyramid <settings...>
+
+    Starts a job that builds a multiresolution pyramid of the labels, where each level is
+    new labels64 data downsampled 2x from the previous level, named "<data name>-s1",
+    "<data name>-s2", ... with voxel sizes scaled to match.  Labels are never averaged:
+    each voxel of a level takes the most frequent label of the 2x2x2 voxels it covers, or
+    the voxel at offset 1,1,1 within them, so levels can be viewed as scales in Neuroglancer
+    without labels bleeding into each other.  Use "dvid jobs <job ID>" to get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c bodies pyramid levels=4 method=mode
+
+    Configuration Settings (case-insensitive keys)
+
+    levels        Number of levels, at most 7 (default: enough that the last level fits
+                    in one block)
+    method        "mode" (default) for the most frequent label of each 2x2x2 cell, or
+                    "center" for the voxel at offset 1,1,1 of each cell, i.e., the one
+                    just past the cell's center, which is faster
+
+$ dvid node <UUID> <data name> import precomputed <source> <settings...>
+
+    Starts a job that ingests a Neuroglancer precomputed segmentation, e.g., a published
+    dataset, fetching and decoding chunks in parallel.  The first selected scale is written
+    into the labels and each other selected scale, which must be a 2^n downsampling of the
+    first, into labels64 data named "<data name>-s<n>".  uint32 labels are widened, and
+    "raw" and "compressed_segmentation" chunks can be read, but sharded scales cannot.
+    Chunks are verified against the source's "dvid-checksums.json" if it has one.
+    Sources are a local directory, "http://" or "https://" URLs, "s3://bucket/prefix", or
+    "gs://bucket/prefix"; see the voxels help for details.
+
+    Example: 
+
+    $ dvid node 3f8c bodies import precomputed gs://neuroglancer-public-data/flyem_fib-25/ground_truth
+
+    Configuration Settings (case-insensitive keys)
+
+    scales        Comma-separated scale keys or indices into the info's scales (default: 0)
+    fetches       Number of concurrent chunk fetches (default: 8)
+
 $ dvid node <UUID> <data name> composite <grayscale8 data name> <new rgba8 data name>
 
     Creates a RGBA8 image where the RGB is a hash of the labels and the A is the
@@ -127,7 +236,22 @@ POST <api URL>/node/<UUID>/<data name>/info
     GET <api URL>/node/3f8c/grayscale/info
 
     Returns JSON with configuration settings that include location in DVID space and
-    min/max block indices.
+    min/max block indices.  A "Multiscale" object describes each scale served by
+    precomputed requests, full resolution first:
+
+    "Multiscale": {
+        "Axes": ["X", "Y", "Z"],
+        "Scales": [
+            {"Key": "s0", "Level": 0, "Resolution": [8, 8, 8], "Units": ["nm", "nm", "nm"],
+             "Offset": [0, 0, 100], "Size": [1024, 1024, 200]},
+            {"Key": "s1", "Level": 1, "Data": "grayscale-s1", "Resolution": [16, 16, 16],
+             "Units": ["nm", "nm", "nm"], "Offset": [0, 0, 50], "Size": [512, 512, 100]}
+        ]
+    }
+
+    Each scale spans voxel coordinates from Offset up to, but not including, Offset + Size
+    at its resolution.  "Data" names data holding the scale if it was built by the
+    "pyramid" command.
 
     Arguments:
 
@@ -165,6 +289,104 @@ POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
                     Slice strings ("xy", "xz", or "yz") are also accepted.
     size          Size in voxels along each dimension specified in <dims>.
     offset        Gives coordinate of first voxel using dimensionality of data.
+    format        3D requests default to "raw" but can use any array format listed in the
+                    'voxels' API, e.g., "npy", "nrrd:gzip", or "nii".  POSTed subvolumes
+                    can use "nrrd" or "nii" if given as the format or "Content-Type".
+
+    Query-string Options (raw GET only):
+
+    axes          Order of the request's axes in the response, e.g., "yx" or "zyx".
+    flip          Comma-separated response axes to reverse, e.g., "y" or "x,z".
+                    See the 'voxels' API for details.
+    colormap      Name of a colormap, e.g., "default", to return a 2D slice as an RGBA image
+                    with each label colored by the colormap.  Label 0 is transparent unless
+                    it's in the colormap.
+
+GET    <api URL>/node/<UUID>/<data name>/colormaps
+GET    <api URL>/node/<UUID>/<data name>/colormap/<name>
+POST   <api URL>/node/<UUID>/<data name>/colormap/<name>[?replace=true]
+DELETE <api URL>/node/<UUID>/<data name>/colormap/<name>
+
+    Lists, retrieves, edits, or deletes named colormaps used to color label slices and the
+    label overlays of 'voxels' data.  Colormaps are kept with the data, so renderings are
+    consistent across sessions and tools.  Labels not in a colormap get a fixed color from
+    a hash of the label, and the "default" colormap colors every label this way unless a
+    colormap named "default" is stored.
+
+    A colormap is JSON mapping decimal labels to "#rrggbb" or "#rrggbbaa" colors:
+
+    { "23": "#ff0000", "1024": "#00ff0080" }
+
+    POST merges the given colors into the colormap, creating it if necessary, and labels
+    given a null color are removed.  With "replace=true", the colormap is replaced.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/superpixels/colormap/proofreading
+
+POST <api URL>/node/<UUID>/<data name>/exists
+
+    Checks which of a JSON list of block coordinates have blocks written at the version,
+    so an interrupted load can be resumed by only writing the missing blocks.  Blocks of
+    ancestor versions don't count.  Returns a bitmask where bit i, counting from the least
+    significant bit of the first byte, is set if the i-th block exists.  The number of
+    blocks checked and found are given in the X-Dvid-Keys and X-Dvid-Found headers.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/superpixels/exists
+
+    [[0, 0, 0], [1, 0, 0], [2, 0, 0]]
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+
+GET  <api URL>/node/<UUID>/<data name>/missing[/<size>/<offset>][?roi=<roi name>]
+
+    Returns JSON describing the blocks within a subvolume, an ROI, or their intersection
+    that have no data written at the version, e.g., to track the progress of a long
+    ingest or find holes left by failed pipeline shards.  Blocks of ancestor versions
+    don't count.  The reply gives the number of blocks checked and missing, and the
+    missing blocks as spans [z, y, x0, x1] in block coordinates:
+
+    { "Blocks": 3, "Missing": 1, "Spans": [[0, 0, 1, 1]] }
+
+    Example: 
+
+    GET <api URL>/node/3f8c/superpixels/missing/1024_1024_256/0_0_0?roi=neuropil
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    size          Size in voxels of the subvolume in the format "dx_dy_dz".
+    offset        Coordinate of the first voxel of the subvolume in the format "x_y_z".
+
+    Query-string Options:
+
+    roi           Name of roi data in the same version whose blocks are checked.
+
+GET  <api URL>/node/<UUID>/<data name>/precomputed/info
+GET  <api URL>/node/<UUID>/<data name>/precomputed/<scale key>/<chunk name>
+
+    Serves labels as segmentation in the Neuroglancer "precomputed" layout so Neuroglancer can use a
+    source of "precomputed://<api URL>/node/<UUID>/<data name>/precomputed".  The info
+    JSON lists scales "s0", "s1", ... where each scale is downsampled 2x from the previous
+    one by taking the most frequent label.  Chunks are generated on the fly from stored
+    blocks using "raw" encoding.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/superpixels/precomputed/s1/0-32_0-32_64-96
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    scale key     Scale key given in the info JSON, e.g., "s0" for full resolution.
+    chunk name    Voxel range at that scale in the form "<xBeg>-<xEnd>_<yBeg>-<yEnd>_<zBeg>-<zEnd>".
 
 (Assumes labels were loaded using without "proc=noindex")
 
@@ -193,6 +415,21 @@ GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>
 	        bytes   Optional payload dependent on first byte descriptor
 
 
+GET <api URL>/node/<UUID>/<data name>/label/<label>/coarsevol
+
+	Returns the blocks that contain voxels of the given label as a sparse volume in
+	block coordinates, which is much smaller than the sparse volume and is useful for
+	quickly locating a label.  The encoding is described in the "sparsevol" request
+	above, where runs are of blocks instead of voxels.  Block size is given in the
+	"info" request.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         Label to query.
+
+
 GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
 
 	Returns a sparse volume with voxels that pass through a given voxel.
@@ -228,6 +465,56 @@ GET <api URL>/node/<UUID>/<data name>/surface-by-point/<coord>
     coord     	  Coordinate of voxel with underscore as separator, e.g., 10_20_30
 
 
+POST <api URL>/node/<UUID>/<data name>/mesh/<label>?meshes=<keyvalue name>[&scale=<scale>]
+
+    Starts a job that computes a surface mesh of the label using marching cubes and
+    stores it in Wavefront OBJ format under the key "<label>.obj" in the given keyvalue
+    data.  Returns JSON with the job ID, e.g., {"Job": 3, "Key": "23.obj"}.  Progress is
+    available via GET <api URL>/jobs/<job ID>.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         Label to mesh.
+    meshes        Name of keyvalue data that stores the mesh.
+    scale         Mesh is computed on voxels downsampled by 2^scale (default: 0).
+
+
+GET  <api URL>/node/<UUID>/<data name>/label/<label>/stats
+
+    Returns JSON with the number of voxels, bounding box, and centroid of a label in voxel
+    coordinates, e.g., {"Label": 23, "Voxels": 1200, "MinPoint": [0,10,20],
+    "MaxPoint": [9,29,39], "Centroid": [4.5,19.5,29.5]}.  Bounding boxes cover all voxels
+    of the label but can be larger than needed until statistics are recomputed.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         Label to query.
+
+
+GET  <api URL>/node/<UUID>/<data name>/labels/top?n=<number>
+
+    Returns a JSON list of the statistics, as given for a single label above, of the largest
+    n labels in order of decreasing size.  If n is not given, 100 labels are returned.
+
+
+GET  <api URL>/node/<UUID>/<data name>/labels/stats
+
+    Returns a JSON list of the statistics of all labels in order of increasing label.  With
+    an "Accept: application/x-ndjson" header or "format=ndjson", statistics are streamed
+    one label per line as they're read and MaxListKeys doesn't apply.  An error after
+    streaming starts ends the stream with a line {"Error": "<message>"}.
+
+
+POST <api URL>/node/<UUID>/<data name>/labels/stats
+
+    Starts a job that recomputes the statistics of all labels.  Returns JSON with the job
+    ID, e.g., {"Job": 3}.  Progress is available via GET <api URL>/jobs/<job ID>.
+
+
 GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<optional max size>
 
     Returns JSON list of labels that have # voxels that fall within the given range
@@ -354,6 +641,9 @@ func NewData(id *datastore.DataID, config dvid.Config) (*Data, error) {
 	if err != nil {
 		return nil, err
 	}
+	if voxelData.Indexing != dvid.ZYXIndexing {
+		return nil, fmt.Errorf("labels64 currently requires zyx indexing, not %s", voxelData.Indexing)
+	}
 	var labelType LabelType = Standard64bit
 	s, found, err := config.GetString("LabelType")
 	if found {
@@ -367,8 +657,9 @@ func NewData(id *datastore.DataID, config dvid.Config) (*Data, error) {
 	}
 	dvid.Log(dvid.Normal, "Creating labels64 '%s' with %s", voxelData.DataName(), labelType)
 	data := &Data{
-		Data:     *voxelData,
-		Labeling: labelType,
+		Data:         *voxelData,
+		Labeling:     labelType,
+		StatsIndexed: true,
 	}
 	return data, nil
 }
@@ -388,6 +679,31 @@ type Data struct {
 	voxels.Data
 	Labeling LabelType
 	Ready    bool
+
+	// StatsIndexed is true if label statistics are kept up to date as blocks are written.
+	StatsIndexed bool
+
+	// statsMu guards StatsIndexed.
+	statsMu sync.RWMutex
+
+	// BlocksUnindexed holds the versions whose label block index, which gives the blocks
+	// containing each label, is being rebuilt or was left incomplete by an interrupted
+	// rebuild.  The index of every other version is kept up to date as blocks are written,
+	// including for data saved before this field existed.
+	BlocksUnindexed map[dvid.VersionLocalID]bool
+
+	// blockIndexMu guards BlocksUnindexed.
+	blockIndexMu sync.RWMutex
+
+	// Viewed holds the locked versions whose labels were copied into flattened views of a
+	// labelmap.  Labels at these versions can't be written so the views stay current.
+	Viewed map[dvid.VersionLocalID]bool
+
+	// viewedMu guards Viewed.
+	viewedMu sync.RWMutex
+
+	// Colormaps are named colormaps for rendering labels.
+	Colormaps map[string]voxels.Colormap `json:"-"`
 }
 
 // JSONString returns the JSON for this Data's configuration
@@ -399,6 +715,36 @@ func (d *Data) JSONString() (string, error) {
 	return string(m), nil
 }
 
+// MarkViewed records that the labels of a locked version were copied into a view, so
+// they can no longer be written.  Callers should hold the version's mutex so no write
+// is in progress.
+func (d *Data) MarkViewed(versionID dvid.VersionLocalID) {
+	d.viewedMu.Lock()
+	defer d.viewedMu.Unlock()
+	viewed := make(map[dvid.VersionLocalID]bool, len(d.Viewed)+1)
+	for v := range d.Viewed {
+		viewed[v] = true
+	}
+	viewed[versionID] = true
+	d.Viewed = viewed
+}
+
+// CheckWrite fulfills the voxels.WriteChecker interface, refusing writes of labels at
+// versions copied into views.
+func (d *Data) CheckWrite(uuid dvid.UUID) error {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return err
+	}
+	d.viewedMu.RLock()
+	defer d.viewedMu.RUnlock()
+	if d.Viewed[versionID] {
+		return fmt.Errorf("Labels '%s' at node %s are copied into flattened views and can't be written",
+			d.DataName(), uuid)
+	}
+	return nil
+}
+
 // --- voxels.IntHandler interface -------------
 
 // NewExtHandler returns a labels64 ExtHandler given some geometry and optional image data.
@@ -574,6 +920,12 @@ func RavelerSuperpixelBytes(slice, superpixel32 uint32) []byte {
 	return b
 }
 
+// Mirror copies labels of a remote instance into this data at a version.
+func (d *Data) Mirror(ctx context.Context, remote *server.MirrorSource, uuid dvid.UUID,
+	settings dvid.Config, progress func(float32)) error {
+	return voxels.MirrorVoxels(ctx, remote, uuid, d, &(d.Properties), settings, progress)
+}
+
 // --- datastore.DataService interface ---------
 
 // DoRPC acts as a switchboard for RPC commands.
@@ -613,7 +965,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		if err != nil {
 			return err
 		}
-		err = voxels.LoadImages(d, uuid, offset, filenames)
+		err = voxels.LoadImages(request.Context(), d, uuid, offset, filenames, request.Settings())
 		if err != nil {
 			return err
 		}
@@ -639,6 +991,111 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		}
 		return d.CreateComposite(request, reply)
 
+	case "mesh":
+		var uuidStr, dataName, cmdStr, labelStr, meshName string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &labelStr, &meshName)
+		if meshName == "" {
+			return fmt.Errorf("Poorly formatted mesh command.  See command-line help.")
+		}
+		uuid, err := server.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad label %q: %s", labelStr, err.Error())
+		}
+		scaleStr, _, err := request.Command.Settings().GetString("scale")
+		if err != nil {
+			return err
+		}
+		scale, err := parseMeshScale(scaleStr)
+		if err != nil {
+			return err
+		}
+		job, err := d.StartMeshJob(uuid, label, scale, dvid.DataString(meshName))
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Started job %d to mesh label %d.  Use 'dvid jobs %d' for progress.\n",
+			job.ID, label, job.ID)
+		return nil
+
+	case "copyregion":
+		return voxels.CopyRegionCommand(request, reply, d)
+
+	case "pyramid":
+		return d.Data.PyramidCommand(request, reply, d)
+
+	case "import":
+		return d.Data.ImportCommand(request, reply, d)
+
+	case "roi":
+		var uuidStr, dataName, cmdStr, labelStr, roiName string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &labelStr, &roiName)
+		if roiName == "" {
+			return fmt.Errorf("Poorly formatted roi command.  See command-line help.")
+		}
+		uuid, err := server.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad label %q: %s", labelStr, err.Error())
+		}
+		blockSize, ok := d.BlockSize().(dvid.Point3d)
+		if !ok {
+			return fmt.Errorf("Data %q must have 3d blocks", d.DataName())
+		}
+		spans, err := d.LabelSpans(uuid, label)
+		if err != nil {
+			return err
+		}
+		dest, err := roi.NewData(uuid, dvid.DataString(roiName), blockSize, d.IsVersioned())
+		if err != nil {
+			return err
+		}
+		if err := dest.PutSpans(uuid, spans); err != nil {
+			return err
+		}
+		var numBlocks int32
+		for _, span := range spans {
+			numBlocks += span[3] - span[2] + 1
+		}
+		reply.Text = fmt.Sprintf("Stored %d blocks of label %d into ROI %q.\n", numBlocks, label, roiName)
+		return nil
+
+	case "stats":
+		var uuidStr, dataName, cmdStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		uuid, err := server.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		job, err := d.StartStatsJob(uuid)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Started job %d to compute label statistics.  Use 'dvid jobs %d' for progress.\n",
+			job.ID, job.ID)
+		return nil
+
+	case "blockindex":
+		var uuidStr, dataName, cmdStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		uuid, err := server.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		job, err := d.StartBlockIndexJob(uuid)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Started job %d to rebuild the label block index.  Use 'dvid jobs %d' for progress.\n",
+			job.ID, job.ID)
+		return nil
+
 	default:
 		return d.UnknownCommand(request)
 	}
@@ -652,6 +1109,20 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 	// Allow cross-origin resource sharing.
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 
+	// Break URL request into arguments
+	url := r.URL.Path[len(server.WebAPIPath):]
+	parts := strings.Split(url, "/")
+
+	// Colormaps can also be deleted, so handle them before other verbs are refused.
+	if len(parts) >= 4 && (parts[3] == "colormap" || parts[3] == "colormaps") {
+		if err := d.serveColormap(w, r, uuid, parts); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: colormap (%s)", r.Method, r.URL)
+		return nil
+	}
+
 	// Get the action (GET, POST)
 	action := strings.ToLower(r.Method)
 	var op voxels.OpType
@@ -664,10 +1135,6 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		return fmt.Errorf("Can only handle GET or POST HTTP verbs")
 	}
 
-	// Break URL request into arguments
-	url := r.URL.Path[len(server.WebAPIPath):]
-	parts := strings.Split(url, "/")
-
 	// Handle POST on data -> setting of configuration
 	if len(parts) == 3 && op == voxels.PutOp {
 		config, err := server.DecodeJSON(r)
@@ -708,7 +1175,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		return nil
 
 	case "info":
-		jsonStr, err := d.JSONString()
+		jsonStr, err := d.Data.InfoJSON(uuid, d)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -717,6 +1184,27 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		fmt.Fprintf(w, jsonStr)
 		return nil
 
+	case "exists":
+		err := voxels.ServeExists(w, r, uuid, d, &(d.Properties))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: exists (%s)", r.Method, r.URL)
+	case "missing":
+		err := voxels.ServeMissing(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: missing blocks (%s)", r.Method, r.URL)
+	case "precomputed":
+		err := voxels.ServePrecomputed(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: precomputed (%s)", r.Method, r.URL)
 	case "raw", "isotropic":
 		if len(parts) < 7 {
 			return fmt.Errorf("'%s' must be followed by shape/size/offset", parts[3])
@@ -728,12 +1216,48 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		if err != nil {
 			return err
 		}
+		var orient *voxels.Orientation
+		var colormap voxels.Colormap
+		if op == voxels.GetOp {
+			if orient, err = voxels.ParseOrientation(r.URL.Query(), int(plane.ShapeDimensions())); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if orient != nil && isotropic {
+				err := fmt.Errorf("axes and flip can only be used with 'raw' requests")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if name := r.URL.Query().Get("colormap"); name != "" {
+				if plane.ShapeDimensions() != 2 {
+					err := fmt.Errorf("colormap can only be used with 2d slices")
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				if colormap, err = d.Colormap(name); err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+			}
+		}
 		switch plane.ShapeDimensions() {
 		case 2:
 			slice, err := dvid.NewSliceFromStrings(planeStr, offsetStr, sizeStr, "_")
 			if err != nil {
 				return err
 			}
+			if op == voxels.GetOp {
+				if err := d.CheckSlice(slice); err != nil {
+					server.TooLarge(w, r, err.Error())
+					return err
+				}
+			}
+			release, err := d.AdmitRequest(r.Context(), slice)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer release()
 			if op == voxels.PutOp {
 				if isotropic {
 					return fmt.Errorf("can only PUT 'raw' not 'isotropic' images")
@@ -747,7 +1271,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				if err != nil {
 					return err
 				}
-				err = voxels.PutVoxels(uuid, d, e)
+				err = voxels.PutVoxels(r.Context(), uuid, d, e)
 				if err != nil {
 					return err
 				}
@@ -758,7 +1282,22 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				img, err := voxels.GetImage(uuid, d, e)
+				if err = voxels.GetVoxels(r.Context(), uuid, d, e); err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				if orient != nil {
+					if err = orient.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				var img *dvid.Image
+				if colormap != nil {
+					img, err = colormap.Render(e)
+				} else {
+					img, err = e.GetImage2d()
+				}
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -789,27 +1328,51 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			if op == voxels.GetOp {
+				if err := d.CheckSubvolume(subvol); err != nil {
+					server.TooLarge(w, r, err.Error())
+					return err
+				}
+			}
+			release, err := d.AdmitRequest(r.Context(), subvol)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer release()
 			if op == voxels.GetOp {
 				e, err := d.NewExtHandler(subvol, nil)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				data, err := voxels.GetVolume(uuid, d, e)
-				if err != nil {
+				if _, err = voxels.GetVolume(r.Context(), uuid, d, e); err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				w.Header().Set("Content-type", "application/octet-stream")
-				_, err = w.Write(data)
-				if err != nil {
+				if orient != nil {
+					if err = orient.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				formatStr := "raw"
+				if len(parts) >= 8 && parts[7] != "" {
+					formatStr = parts[7]
+				}
+				if err = d.WriteArrayHttp(w, e, formatStr); err != nil {
+					server.BadRequest(w, r, err.Error())
 					return err
 				}
 			} else {
 				if isotropic {
 					return fmt.Errorf("can only PUT 'raw' not 'isotropic' images")
 				}
-				data, err := ioutil.ReadAll(r.Body)
+				var formatStr string
+				if len(parts) >= 8 {
+					formatStr = parts[7]
+				}
+				data, err := d.ReadArrayHttp(r, subvol, formatStr)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -819,7 +1382,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = voxels.PutVoxels(uuid, d, e)
+				err = voxels.PutVoxels(r.Context(), uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -983,6 +1546,176 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		fmt.Fprintf(w, jsonStr)
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: get labels with volume > %d and < %d (%s)",
 			r.Method, minSize, maxSize, r.URL)
+
+	case "mesh":
+		// POST <api URL>/node/<UUID>/<data name>/mesh/<label>?meshes=<keyvalue name>&scale=<scale>
+		if op != voxels.PutOp {
+			err := fmt.Errorf("Mesh generation must be started with POST")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 5 {
+			err := fmt.Errorf("ERROR: DVID requires label ID to follow 'mesh' command")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		query := r.URL.Query()
+		meshName := query.Get("meshes")
+		if meshName == "" {
+			err := fmt.Errorf("Mesh generation requires a keyvalue data name in the 'meshes' query string")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		scale, err := parseMeshScale(query.Get("scale"))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		job, err := d.StartMeshJob(uuid, label, scale, dvid.DataString(meshName))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, `{"Job": %d, "Key": %q}`, job.ID, MeshKey(label))
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: started mesh job %d for label %d (%s)",
+			r.Method, job.ID, label, r.URL)
+
+	case "label":
+		// GET <api URL>/node/<UUID>/<data name>/label/<label>/stats
+		// GET <api URL>/node/<UUID>/<data name>/label/<label>/coarsevol
+		if len(parts) < 6 {
+			err := fmt.Errorf("ERROR: DVID requires label ID and 'stats' or 'coarsevol' to follow 'label' command")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		switch parts[5] {
+		case "stats":
+			stats, found, err := d.GetLabelStats(uuid, label)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("Label '%d' not found", label), http.StatusNotFound)
+				return nil
+			}
+			w.Header().Set("Content-type", "application/json")
+			if err := json.NewEncoder(w).Encode(stats); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		case "coarsevol":
+			data, err := d.GetCoarseVol(uuid, label)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-type", "application/octet-stream")
+			if _, err = w.Write(data); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		default:
+			err := fmt.Errorf("Unrecognized label query '%s'.  Use 'stats' or 'coarsevol'.", parts[5])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: %s on label %d (%s)", r.Method, parts[5], label, r.URL)
+
+	case "labels":
+		// GET  <api URL>/node/<UUID>/<data name>/labels/top?n=<number>
+		// GET  <api URL>/node/<UUID>/<data name>/labels/stats
+		// POST <api URL>/node/<UUID>/<data name>/labels/stats
+		if len(parts) < 5 {
+			err := fmt.Errorf("ERROR: DVID requires 'top' or 'stats' to follow 'labels' command")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		switch {
+		case parts[4] == "top" && op == voxels.GetOp:
+			n := DefaultTopLabels
+			if nStr := r.URL.Query().Get("n"); nStr != "" {
+				var err error
+				if n, err = strconv.Atoi(nStr); err != nil || n < 0 {
+					err = fmt.Errorf("Bad number of labels %q", nStr)
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+			}
+			if err := d.CheckListKeys(n); err != nil {
+				server.TooLarge(w, r, err.Error())
+				return err
+			}
+			top, err := d.GetTopLabels(uuid, n)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-type", "application/json")
+			if err := json.NewEncoder(w).Encode(top); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: top %d labels (%s)", r.Method, n, r.URL)
+		case parts[4] == "stats" && op == voxels.GetOp && server.WantsNDJSON(r):
+			stream := server.NewNDJSONWriter(w)
+			err := d.ProcessLabelStats(r.Context(), uuid, func(stats LabelStats) error {
+				return stream.Encode(stats)
+			})
+			if err = stream.Close(err); err != nil {
+				if !stream.Started() {
+					server.BadRequest(w, r, err.Error())
+				}
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: stream of %d label stats (%s)", r.Method,
+				stream.Lines(), r.URL)
+		case parts[4] == "stats" && op == voxels.GetOp:
+			all := []LabelStats{}
+			err := d.ProcessLabelStats(r.Context(), uuid, func(stats LabelStats) error {
+				all = append(all, stats)
+				return d.CheckListKeys(len(all))
+			})
+			if err != nil {
+				if _, ok := err.(*datastore.LimitError); ok {
+					server.TooLarge(w, r, err.Error())
+				} else {
+					server.BadRequest(w, r, err.Error())
+				}
+				return err
+			}
+			w.Header().Set("Content-type", "application/json")
+			if err := json.NewEncoder(w).Encode(all); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: stats of %d labels (%s)", r.Method, len(all), r.URL)
+		case parts[4] == "stats" && op == voxels.PutOp:
+			job, err := d.StartStatsJob(uuid)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-type", "application/json")
+			fmt.Fprintf(w, `{"Job": %d}`, job.ID)
+			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: started stats job %d (%s)", r.Method, job.ID, r.URL)
+		default:
+			err := fmt.Errorf("Use GET with 'labels/top' or 'labels/stats', or POST with 'labels/stats'")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+
 	default:
 		return fmt.Errorf("Unrecognized API call '%s' for labels64 data '%s'.  See API help.", parts[3], d.DataName())
 	}
@@ -1058,7 +1791,7 @@ func (d *Data) CreateComposite(request datastore.Request, reply *datastore.Respo
 	startKey := d.DataKey(versionID, extents.MinIndex)
 	endKey := d.DataKey(versionID, extents.MaxIndex)
 
-	chunkOp := &storage.ChunkOp{op, wg}
+	chunkOp := &storage.ChunkOp{op, wg, nil}
 	err = db.ProcessRange(startKey, endKey, chunkOp, d.CreateCompositeChunk)
 	wg.Wait()
 
@@ -1077,9 +1810,9 @@ func (d *Data) CreateComposite(request datastore.Request, reply *datastore.Respo
 // CreateCompositeChunk processes each chunk of labels and grayscale data,
 // saving the composited result into an rgba8.
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) CreateCompositeChunk(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.createCompositeChunk(chunk)
 }
 
@@ -1088,8 +1821,8 @@ var curZMutex sync.Mutex
 
 func (d *Data) createCompositeChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
@@ -0,0 +1,194 @@
+package labels64
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type DataSuite struct {
+	dir     string
+	service *server.Service
+}
+
+var _ = Suite(&DataSuite{})
+
+// This will setup a new datastore and open it up, keeping the service pointer in the
+// DataSuite.
+func (suite *DataSuite) SetUpSuite(c *C) {
+	// Make a temporary testing directory that will be auto-deleted after testing.
+	suite.dir = c.MkDir()
+
+	// Create a new datastore.
+	err := datastore.Init(suite.dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+
+	// Open the datastore
+	suite.service, err = server.OpenDatastore(suite.dir)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TearDownSuite(c *C) {
+	suite.service.Shutdown()
+}
+
+func (suite *DataSuite) TestBlockIndex(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "labels64", "indexlabels", dvid.NewConfig()), IsNil)
+	d, err := GetByUUID(root, "indexlabels")
+	c.Assert(err, IsNil)
+	_, versionID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+
+	// Data saved before versions were tracked has every version indexed.
+	c.Assert((&Data{}).blocksIndexed(versionID), Equals, true)
+
+	// Labels 7 and 8 fill one block each, and the index is updated as they're written.
+	size := dvid.Point3d{64, 32, 32}
+	data := make([]byte, size.Prod()*8)
+	for i := int32(0); i < int32(size.Prod()); i++ {
+		label := uint64(7)
+		if i%64 >= 32 {
+			label = 8
+		}
+		binary.BigEndian.PutUint64(data[i*8:], label)
+	}
+	e, err := d.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, d, e), IsNil)
+
+	db, err := server.OrderedKeyValueDB()
+	c.Assert(err, IsNil)
+	labelKeys := func(label uint64) int {
+		keys, err := db.KeysInRange(labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MinIndexZYX),
+			labels.NewLabelSpatialMapKey(d, versionID, label, dvid.MaxIndexZYX))
+		c.Assert(err, IsNil)
+		return len(keys)
+	}
+	c.Assert(labelKeys(7), Equals, 1)
+	c.Assert(labelKeys(8), Equals, 1)
+
+	// A rebuild deletes stale keys, more than fit in one batch, and reindexes the blocks.
+	numStale := storage.RangeBatchSize + 10
+	for x := 0; x < numStale; x++ {
+		key := labels.NewLabelSpatialMapKey(d, versionID, 9, dvid.IndexZYX{int32(x), 5, 5})
+		c.Assert(db.Put(key, dvid.EmptyValue()), IsNil)
+	}
+	c.Assert(labelKeys(9), Equals, numStale)
+	job, err := d.StartBlockIndexJob(root)
+	c.Assert(err, IsNil)
+	for {
+		job.RLock()
+		status := job.Status
+		job.RUnlock()
+		if status != server.JobRunning {
+			c.Assert(status, Equals, server.JobDone)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(labelKeys(7), Equals, 1)
+	c.Assert(labelKeys(8), Equals, 1)
+	c.Assert(labelKeys(9), Equals, 0)
+	c.Assert(d.blocksIndexed(versionID), Equals, true)
+	_, err = d.GetSparseVol(root, 7)
+	c.Assert(err, IsNil)
+
+	// An incomplete index only blocks queries at its version.
+	d.setBlocksIndexed(versionID, false)
+	_, err = d.GetSparseVol(root, 7)
+	c.Assert(err, NotNil)
+	c.Assert(d.blocksIndexed(versionID+1), Equals, true)
+	d.setBlocksIndexed(versionID, true)
+	c.Assert(d.BlocksUnindexed, HasLen, 0)
+}
+
+func (suite *DataSuite) TestLabelStatsVersions(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "labels64", "statslabels", dvid.NewConfig()), IsNil)
+	d, err := GetByUUID(root, "statslabels")
+	c.Assert(err, IsNil)
+
+	// Label 7 fills the first block and label 8 the second.
+	putLabels := func(uuid dvid.UUID, offset dvid.Point3d, size dvid.Point3d, label func(x int32) uint64) {
+		data := make([]byte, size.Prod()*8)
+		for i := int32(0); i < int32(size.Prod()); i++ {
+			binary.BigEndian.PutUint64(data[i*8:], label(i%size[0]))
+		}
+		e, err := d.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+		c.Assert(err, IsNil)
+		c.Assert(voxels.PutVoxels(context.Background(), uuid, d, e), IsNil)
+	}
+	putLabels(root, dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 32, 32}, func(x int32) uint64 {
+		if x < 32 {
+			return 7
+		}
+		return 8
+	})
+	topLabels := func(uuid dvid.UUID, n int) []uint64 {
+		top, err := d.GetTopLabels(uuid, n)
+		c.Assert(err, IsNil)
+		var labels []uint64
+		for _, stats := range top {
+			labels = append(labels, stats.Label)
+		}
+		return labels
+	}
+	stats, found, err := d.GetLabelStats(root, 7)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(stats.Voxels, Equals, uint64(32*32*32))
+	c.Assert(topLabels(root, 10), DeepEquals, []uint64{7, 8})
+	c.Assert(topLabels(root, 1), DeepEquals, []uint64{7})
+
+	// Relabeling the first block in a child version moves its voxels to label 8 there
+	// without changing the parent.
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	putLabels(child, dvid.Point3d{0, 0, 0}, dvid.Point3d{32, 32, 32}, func(x int32) uint64 { return 8 })
+	_, found, err = d.GetLabelStats(child, 7)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+	stats, found, err = d.GetLabelStats(child, 8)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(stats.Voxels, Equals, uint64(64*32*32))
+	c.Assert(topLabels(child, 10), DeepEquals, []uint64{8})
+	stats, _, err = d.GetLabelStats(root, 8)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Voxels, Equals, uint64(32*32*32))
+	c.Assert(topLabels(root, 10), DeepEquals, []uint64{7, 8})
+
+	// Recomputing the child's statistics gives the same result.
+	job, err := d.StartStatsJob(child)
+	c.Assert(err, IsNil)
+	for {
+		job.RLock()
+		status := job.Status
+		job.RUnlock()
+		if status != server.JobRunning {
+			c.Assert(status, Equals, server.JobDone)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(topLabels(child, 10), DeepEquals, []uint64{8})
+	stats, _, err = d.GetLabelStats(child, 8)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Voxels, Equals, uint64(64*32*32))
+}
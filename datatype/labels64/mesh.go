@@ -0,0 +1,86 @@
+/*
+	This file supports generation of surface meshes for labels, which are stored in a
+	keyvalue instance so clients don't have to download voxels to mesh them locally.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datatype/keyvalue"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Length of the header preceding the RLEs in a sparse volume encoding.
+const sparseVolHeaderSize = 12
+
+// MeshKey returns the key of a label's mesh in a keyvalue instance.
+func MeshKey(label uint64) string {
+	return fmt.Sprintf("%d.obj", label)
+}
+
+// parseMeshScale returns the mesh scale given as a string, where an empty string
+// means full resolution.
+func parseMeshScale(scaleStr string) (uint8, error) {
+	if scaleStr == "" {
+		return 0, nil
+	}
+	scale, err := strconv.ParseUint(scaleStr, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("Bad mesh scale %q: %s", scaleStr, err.Error())
+	}
+	return uint8(scale), nil
+}
+
+// StartMeshJob starts a job that computes the surface mesh of a label at the given
+// scale and stores it in Wavefront OBJ format under MeshKey(label) in the named
+// keyvalue data.
+func (d *Data) StartMeshJob(uuid dvid.UUID, label uint64, scale uint8, meshName dvid.DataString) (*server.Job, error) {
+	meshes, err := keyvalue.GetByUUID(uuid, meshName)
+	if err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("Mesh label %d of %q at scale %d into %q", label, d.DataName(), scale, meshName)
+	job := server.NewJob(description)
+	go func() {
+		err := d.computeMesh(uuid, label, scale, meshes, job)
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	return job, nil
+}
+
+func (d *Data) computeMesh(uuid dvid.UUID, label uint64, scale uint8, meshes *keyvalue.Data, job *server.Job) error {
+	encoding, err := d.GetSparseVol(uuid, label)
+	if err != nil {
+		return err
+	}
+	if len(encoding) <= sparseVolHeaderSize {
+		return fmt.Errorf("Label %d has no voxels", label)
+	}
+	var vol dvid.SparseVol
+	if err := vol.AddRLEs(encoding[sparseVolHeaderSize:]); err != nil {
+		return err
+	}
+
+	// Meshing dominates the time, so it gets most of the progress.
+	mesh, err := vol.MarchingCubes(scale, func(fraction float32) {
+		job.SetProgress(0.9 * fraction)
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := mesh.WriteOBJ(&buf); err != nil {
+		return err
+	}
+	dvid.Log(dvid.Debug, "Mesh of label %d has %d vertices and %d triangles\n",
+		label, mesh.NumVertices(), mesh.NumTriangles())
+	return meshes.PutData(uuid, MeshKey(label), buf.Bytes())
+}
@@ -0,0 +1,600 @@
+/*
+	This file maintains an index of per-label statistics, i.e., voxel counts, bounding boxes,
+	and centroids, along with an index of labels by decreasing size.  The indices are updated
+	incrementally after blocks are written and can be recomputed with a job.  Statistics are
+	read as visible at a version, so versions only store the statistics of labels that
+	changed, with tombstones for labels that lost all their voxels.
+*/
+
+package labels64
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultTopLabels is the number of labels returned by a top labels query if none is given.
+const DefaultTopLabels = 100
+
+// Size of a stored labelStats.
+const labelStatsSize = 8 + 12 + 12 + 24
+
+// statsMutex serializes read-modify-write updates of label statistics.
+var statsMutex sync.Mutex
+
+// LabelStats gives the size, bounding box, and centroid of a label in voxel coordinates.
+type LabelStats struct {
+	Label    uint64
+	Voxels   uint64
+	MinPoint dvid.Point3d
+	MaxPoint dvid.Point3d
+	Centroid [3]float64
+}
+
+// labelStats holds the stored statistics for a label.  Coordinate sums instead of
+// centroids are kept so statistics can be added and subtracted.
+type labelStats struct {
+	voxels   int64
+	min, max dvid.Point3d
+	sum      [3]float64
+}
+
+func newLabelStats() *labelStats {
+	return &labelStats{
+		min: dvid.Point3d{math.MaxInt32, math.MaxInt32, math.MaxInt32},
+		max: dvid.Point3d{math.MinInt32, math.MinInt32, math.MinInt32},
+	}
+}
+
+func (s *labelStats) addVoxel(x, y, z int32) {
+	s.voxels++
+	s.sum[0] += float64(x)
+	s.sum[1] += float64(y)
+	s.sum[2] += float64(z)
+	s.extend(dvid.Point3d{x, y, z}, dvid.Point3d{x, y, z})
+}
+
+// extend grows the bounding box to include the given box.
+func (s *labelStats) extend(min, max dvid.Point3d) {
+	for dim := 0; dim < 3; dim++ {
+		if min[dim] < s.min[dim] {
+			s.min[dim] = min[dim]
+		}
+		if max[dim] > s.max[dim] {
+			s.max[dim] = max[dim]
+		}
+	}
+}
+
+// merge adds the voxels of another set of statistics.
+func (s *labelStats) merge(other *labelStats) {
+	s.voxels += other.voxels
+	for dim := 0; dim < 3; dim++ {
+		s.sum[dim] += other.sum[dim]
+	}
+	s.extend(other.min, other.max)
+}
+
+func (s *labelStats) export(label uint64) LabelStats {
+	stats := LabelStats{
+		Label:    label,
+		Voxels:   uint64(s.voxels),
+		MinPoint: s.min,
+		MaxPoint: s.max,
+	}
+	for dim := 0; dim < 3; dim++ {
+		stats.Centroid[dim] = s.sum[dim] / float64(s.voxels)
+	}
+	return stats
+}
+
+func (s *labelStats) MarshalBinary() ([]byte, error) {
+	data := make([]byte, labelStatsSize)
+	binary.LittleEndian.PutUint64(data[0:8], uint64(s.voxels))
+	for dim := 0; dim < 3; dim++ {
+		binary.LittleEndian.PutUint32(data[8+dim*4:], uint32(s.min[dim]))
+		binary.LittleEndian.PutUint32(data[20+dim*4:], uint32(s.max[dim]))
+		binary.LittleEndian.PutUint64(data[32+dim*8:], math.Float64bits(s.sum[dim]))
+	}
+	return data, nil
+}
+
+func (s *labelStats) UnmarshalBinary(data []byte) error {
+	if len(data) != labelStatsSize {
+		return fmt.Errorf("Label statistics should be %d bytes, not %d bytes", labelStatsSize, len(data))
+	}
+	s.voxels = int64(binary.LittleEndian.Uint64(data[0:8]))
+	for dim := 0; dim < 3; dim++ {
+		s.min[dim] = int32(binary.LittleEndian.Uint32(data[8+dim*4:]))
+		s.max[dim] = int32(binary.LittleEndian.Uint32(data[20+dim*4:]))
+		s.sum[dim] = math.Float64frombits(binary.LittleEndian.Uint64(data[32+dim*8:]))
+	}
+	return nil
+}
+
+// blockStats returns the statistics of each nonzero label in a block of labels.
+func (d *Data) blockStats(index dvid.ChunkIndexer, blockData []byte) map[uint64]*labelStats {
+	stats := make(map[uint64]*labelStats)
+	firstPt := index.MinPoint(d.BlockSize()).(dvid.Point3d)
+	lastPt := index.MaxPoint(d.BlockSize()).(dvid.Point3d)
+	n := 0
+	for z := firstPt[2]; z <= lastPt[2]; z++ {
+		for y := firstPt[1]; y <= lastPt[1]; y++ {
+			for x := firstPt[0]; x <= lastPt[0]; x++ {
+				label := d.Properties.ByteOrder.Uint64(blockData[n : n+8])
+				n += 8
+				if label == 0 {
+					continue
+				}
+				s, found := stats[label]
+				if !found {
+					s = newLabelStats()
+					stats[label] = s
+				}
+				s.addVoxel(x, y, z)
+			}
+		}
+	}
+	return stats
+}
+
+// ProcessChunk writes blocks and then applies the change in labels to the label
+// statistics and label block index and notes the modified labels, so a block that fails
+// to be written changes nothing.
+func (d *Data) ProcessChunk(chunk *storage.Chunk) {
+	op, ok := chunk.Op.(*voxels.Operation)
+	if !ok || op.OpType != voxels.PutOp {
+		d.Data.ProcessChunk(chunk)
+		return
+	}
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
+	go func() {
+		defer func() {
+			server.HandlerPoolFor(d.DatatypeName()).Release()
+			if chunk.Wg != nil {
+				chunk.Wg.Done()
+			}
+		}()
+		// The old block is read before the write, which can reuse the stored value.
+		oldData, newData, err := d.blockChange(chunk, op)
+		if err != nil {
+			dvid.Log(dvid.Normal, "Unable to update label indices in '%s': %s\n", d.DataName(), err.Error())
+		}
+		if err := d.ApplyChunk(chunk); err != nil {
+			dvid.Log(dvid.Normal, "%s\n", err.Error())
+			return
+		}
+		if oldData != nil {
+			if err := d.updateIndices(chunk.K, oldData, newData); err != nil {
+				dvid.Log(dvid.Normal, "Unable to update label indices in '%s': %s\n", d.DataName(), err.Error())
+			}
+		}
+		labels.MarkModified(d.DsetID)
+	}()
+}
+
+// blockChange returns the labels of a block before and after writing a chunk.
+func (d *Data) blockChange(chunk *storage.Chunk, op *voxels.Operation) (oldData, newData []byte, err error) {
+	blockBytes := int(d.BlockSize().Prod() * 8)
+	if chunk.V == nil {
+		oldData = make([]byte, blockBytes)
+	} else {
+		var data []byte
+		if data, _, err = dvid.DeserializeData(chunk.V, true); err != nil {
+			return nil, nil, err
+		}
+		oldData = make([]byte, len(data))
+		copy(oldData, data)
+	}
+	if len(oldData) != blockBytes {
+		return nil, nil, fmt.Errorf("Retrieved block is %d bytes, expected %d bytes", len(oldData), blockBytes)
+	}
+	newData = make([]byte, blockBytes)
+	copy(newData, oldData)
+	if err := voxels.WriteToBlock(op.ExtHandler, &voxels.Block{K: chunk.K, V: newData}, d.BlockSize()); err != nil {
+		return nil, nil, err
+	}
+	return oldData, newData, nil
+}
+
+// updateIndices applies the change in labels from writing a block to the label statistics
+// and label block index.
+func (d *Data) updateIndices(key storage.Key, oldData, newData []byte) error {
+	dataKey, ok := key.(*datastore.DataKey)
+	if !ok {
+		return fmt.Errorf("Can't convert Key (%s) to DataKey", key)
+	}
+	index, err := datastore.KeyToChunkIndexer(key)
+	if err != nil {
+		return err
+	}
+	if d.LabelStatsIndexed() {
+		if err := d.updateStats(dataKey.Version, index, oldData, newData); err != nil {
+			return err
+		}
+	}
+	return d.updateBlockIndex(dataKey.Version, index, oldData, newData)
+}
+
+// LabelStatsIndexed returns true if label statistics are kept up to date.
+func (d *Data) LabelStatsIndexed() bool {
+	d.statsMu.RLock()
+	defer d.statsMu.RUnlock()
+	return d.StatsIndexed
+}
+
+// setStatsIndexed records whether label statistics are kept up to date.
+func (d *Data) setStatsIndexed(indexed bool) {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	d.StatsIndexed = indexed
+}
+
+// checkStatsIndexed returns an error if label statistics aren't kept up to date.
+func (d *Data) checkStatsIndexed() error {
+	if !d.LabelStatsIndexed() {
+		return fmt.Errorf("Label statistics for '%s' are not indexed.  Use the 'stats' command to compute them.", d.DataName())
+	}
+	return nil
+}
+
+// updateStats applies the change in label statistics from writing a block to the index.
+// Statistics are read as visible at the block's version, so the first write of a label
+// in a child version starts from the statistics of its parent.
+func (d *Data) updateStats(versionID dvid.VersionLocalID, index dvid.ChunkIndexer, oldData, newData []byte) error {
+	oldStats := d.blockStats(index, oldData)
+	newStats := d.blockStats(index, newData)
+	changed := make(map[uint64]bool)
+	for label, s := range newStats {
+		if old, found := oldStats[label]; !found || *old != *s {
+			changed[label] = true
+		}
+	}
+	for label := range oldStats {
+		if _, found := newStats[label]; !found {
+			changed[label] = true
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	service := server.DatastoreService()
+	uuid, err := service.UUIDFromLocalID(d.DsetID, versionID)
+	if err != nil {
+		return err
+	}
+	tombstones, err := service.HasParents(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.updateStats()", d.DataName())
+	}
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	batch := batcher.NewBatch()
+	for label := range changed {
+		visible, err := d.visibleStats(uuid, label)
+		if err != nil {
+			return err
+		}
+		s := newLabelStats()
+		if visible != nil {
+			*s = *visible
+		}
+		if added, found := newStats[label]; found {
+			s.merge(added)
+		}
+		if removed, found := oldStats[label]; found {
+			s.voxels -= removed.voxels
+			for dim := 0; dim < 3; dim++ {
+				s.sum[dim] -= removed.sum[dim]
+			}
+		}
+		if err := d.putStats(batch, versionID, tombstones, label, s, visible); err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
+// putStats replaces the visible statistics of a label, which can be nil, and keeps the
+// size index in step.  Bounding boxes only grow, since removing voxels would require a
+// scan of the label to shrink them.  Statistics without voxels are removed or, if the
+// version has parents, replaced by tombstones without voxels, so the statistics of an
+// ancestor don't become visible.
+func (d *Data) putStats(batch storage.Batch, versionID dvid.VersionLocalID, tombstones bool,
+	label uint64, s, visible *labelStats) error {
+
+	key := labels.NewLabelStatsKey(d, versionID, label)
+	if visible != nil {
+		sizeKey := labels.NewLabelStatsSizeKey(d, versionID, uint64(visible.voxels), label)
+		if tombstones {
+			batch.Put(sizeKey, sizeTombstone)
+		} else {
+			batch.Delete(sizeKey)
+		}
+	}
+	if s.voxels <= 0 {
+		if !tombstones {
+			batch.Delete(key)
+			return nil
+		}
+		s = newLabelStats()
+	} else {
+		batch.Put(labels.NewLabelStatsSizeKey(d, versionID, uint64(s.voxels), label), dvid.EmptyValue())
+	}
+	value, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	batch.Put(key, value)
+	return nil
+}
+
+// sizeTombstone is the value of a size index key that hides the same key of an ancestor.
+var sizeTombstone = []byte{0}
+
+// visibleStats returns the statistics of a label visible at a version, i.e., written at
+// the version or else at its nearest ancestor, or nil if the label has no voxels.
+func (d *Data) visibleStats(uuid dvid.UUID, label uint64) (*labelStats, error) {
+	index := labels.NewLabelStatsKey(d, 0, label).Index
+	var value []byte
+	err := server.DatastoreService().ProcessVisible(context.Background(), uuid, d.ID, index, index,
+		func(kv *storage.KeyValue) {
+			value = kv.V
+		})
+	if err != nil || value == nil {
+		return nil, err
+	}
+	s := newLabelStats()
+	if err := s.UnmarshalBinary(value); err != nil {
+		return nil, err
+	}
+	if s.voxels <= 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// GetLabelStats returns the statistics of a label visible at a version, i.e., written at
+// the version or else at its nearest ancestor, and whether the label has any voxels.
+func (d *Data) GetLabelStats(uuid dvid.UUID, label uint64) (stats LabelStats, found bool, err error) {
+	if err = d.checkStatsIndexed(); err != nil {
+		return
+	}
+	s, err := d.visibleStats(uuid, label)
+	if err != nil || s == nil {
+		return
+	}
+	return s.export(label), true, nil
+}
+
+// errTopLabelsFound stops the scan of the size index once enough labels are found.
+var errTopLabelsFound = errors.New("top labels found")
+
+// GetTopLabels returns the statistics of the n largest labels in order of decreasing size,
+// then increasing label.  Only the first n labels of the size index are read.
+func (d *Data) GetTopLabels(uuid dvid.UUID, n int) ([]LabelStats, error) {
+	if err := d.checkStatsIndexed(); err != nil {
+		return nil, err
+	}
+	top := []LabelStats{}
+	if n <= 0 {
+		return top, nil
+	}
+	begIndex := labels.NewLabelStatsSizeKey(d, 0, math.MaxUint64, 0).Index
+	endIndex := labels.NewLabelStatsSizeKey(d, 0, 0, math.MaxUint64).Index
+	batchSize := n
+	if batchSize > storage.RangeBatchSize {
+		batchSize = storage.RangeBatchSize
+	}
+	err := server.DatastoreService().ProcessVisibleBatches(context.Background(), uuid, d.ID, begIndex, endIndex,
+		batchSize, func(kv *storage.KeyValue) error {
+			indexBytes := kv.K.(*datastore.DataKey).Index.Bytes()
+			if len(indexBytes) != 17 || len(kv.V) != 0 {
+				return nil
+			}
+			label := binary.BigEndian.Uint64(indexBytes[9:17])
+			s, err := d.visibleStats(uuid, label)
+			if err != nil {
+				return err
+			}
+			if s == nil {
+				return nil
+			}
+			top = append(top, s.export(label))
+			if len(top) == n {
+				return errTopLabelsFound
+			}
+			return nil
+		})
+	if err != nil && err != errTopLabelsFound {
+		return nil, err
+	}
+	return top, nil
+}
+
+// ProcessLabelStats calls f on the statistics of each label visible at a version in order
+// of increasing label, stopping at the first error or once ctx is done.  Statistics are
+// read in batches, so f may be slow without holding the database open.
+func (d *Data) ProcessLabelStats(ctx context.Context, uuid dvid.UUID, f func(LabelStats) error) error {
+	if err := d.checkStatsIndexed(); err != nil {
+		return err
+	}
+	return d.processVisibleStats(ctx, uuid, func(label uint64, s *labelStats) error {
+		return f(s.export(label))
+	})
+}
+
+// processVisibleStats calls f on the statistics of each label with voxels visible at a
+// version in order of increasing label.
+func (d *Data) processVisibleStats(ctx context.Context, uuid dvid.UUID, f func(uint64, *labelStats) error) error {
+	begIndex := labels.NewLabelStatsKey(d, 0, 0).Index
+	endIndex := labels.NewLabelStatsKey(d, 0, math.MaxUint64).Index
+	return server.DatastoreService().ProcessVisibleBatches(ctx, uuid, d.ID, begIndex, endIndex,
+		storage.RangeBatchSize, func(kv *storage.KeyValue) error {
+			indexBytes := kv.K.(*datastore.DataKey).Index.Bytes()
+			if len(indexBytes) != 9 {
+				return nil
+			}
+			s := newLabelStats()
+			if err := s.UnmarshalBinary(kv.V); err != nil {
+				return err
+			}
+			if s.voxels <= 0 {
+				return nil
+			}
+			return f(binary.BigEndian.Uint64(indexBytes[1:9]), s)
+		})
+}
+
+// StartStatsJob starts a job that recomputes the label statistics visible at a version
+// from its blocks.  Incremental updates are suspended during the job, so blocks written
+// while it runs may not be reflected.
+func (d *Data) StartStatsJob(uuid dvid.UUID) (*server.Job, error) {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	description := fmt.Sprintf("Compute label statistics of %q", d.DataName())
+	job := server.NewJob(description)
+	go func() {
+		d.setStatsIndexed(false)
+		err := d.computeStats(uuid, versionID, job)
+		if err == nil {
+			d.setStatsIndexed(true)
+			err = server.DatastoreService().SaveDataset(uuid)
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	return job, nil
+}
+
+func (d *Data) computeStats(uuid dvid.UUID, versionID dvid.VersionLocalID, job *server.Job) error {
+	service := server.DatastoreService()
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.computeStats()", d.DataName())
+	}
+	tombstones, err := service.HasParents(uuid)
+	if err != nil {
+		return err
+	}
+
+	// Accumulate statistics of the visible blocks a layer of blocks at a time.
+	ctx := context.Background()
+	stats := make(map[uint64]*labelStats)
+	extents := d.Extents()
+	if extents.MinIndex != nil && extents.MaxIndex != nil {
+		minIndexZ := extents.MinIndex.Value(2)
+		maxIndexZ := extents.MaxIndex.Value(2)
+		for z := minIndexZ; z <= maxIndexZ; z++ {
+			minIndex := dvid.IndexZYX{dvid.MinChunkPoint3d[0], dvid.MinChunkPoint3d[1], z}
+			maxIndex := dvid.IndexZYX{dvid.MaxChunkPoint3d[0], dvid.MaxChunkPoint3d[1], z}
+			err := service.ProcessVisibleBatches(ctx, uuid, d.ID, minIndex, maxIndex, storage.RangeBatchSize,
+				func(kv *storage.KeyValue) error {
+					index, err := datastore.KeyToChunkIndexer(kv.K)
+					if err != nil {
+						return err
+					}
+					blockData, _, err := dvid.DeserializeData(kv.V, true)
+					if err != nil {
+						return err
+					}
+					for label, s := range d.blockStats(index, blockData) {
+						if total, found := stats[label]; found {
+							total.merge(s)
+						} else {
+							stats[label] = s
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+			job.SetProgress(0.9 * float32(z-minIndexZ+1) / float32(maxIndexZ-minIndexZ+1))
+		}
+	}
+
+	// Replace the stored statistics.  Without parents, all statistics and size keys of the
+	// version are deleted first.  Otherwise the visible statistics are replaced, leaving
+	// tombstones for labels without voxels.
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	batch := batcher.NewBatch()
+	visible := make(map[uint64]*labelStats)
+	if tombstones {
+		err := d.processVisibleStats(ctx, uuid, func(label uint64, s *labelStats) error {
+			visible[label] = s
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		ranges := []struct {
+			first, last *datastore.DataKey
+			size        int
+		}{
+			{labels.NewLabelStatsKey(d, versionID, 0), labels.NewLabelStatsKey(d, versionID, math.MaxUint64), 9},
+			{labels.NewLabelStatsSizeKey(d, versionID, math.MaxUint64, 0),
+				labels.NewLabelStatsSizeKey(d, versionID, 0, math.MaxUint64), 17},
+		}
+		for _, r := range ranges {
+			oldKeys, err := db.KeysInRange(r.first, r.last)
+			if err != nil {
+				return err
+			}
+			for _, key := range oldKeys {
+				if len(key.(*datastore.DataKey).Index.Bytes()) == r.size {
+					batch.Delete(key)
+				}
+			}
+		}
+	}
+	for label, old := range visible {
+		if _, found := stats[label]; !found {
+			if err := d.putStats(batch, versionID, tombstones, label, newLabelStats(), old); err != nil {
+				return err
+			}
+		}
+	}
+	for label, s := range stats {
+		if err := d.putStats(batch, versionID, tombstones, label, s, visible[label]); err != nil {
+			return err
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	dvid.Log(dvid.Debug, "Computed statistics for %d labels in %q\n", len(stats), d.DataName())
+	return nil
+}
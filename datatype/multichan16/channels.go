@@ -0,0 +1,146 @@
+/*
+	This file returns many channels of a slice in one response, so viewers showing channel
+	overlays don't need a separate request per channel.
+*/
+
+package multichan16
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxRequestChannels is the most channels that can be returned in one response.
+var MaxRequestChannels = 16
+
+// parseChannels returns the channel numbers given by the "channels" query string, which
+// is "all" or a comma-separated list of distinct channel numbers, or nil if it's absent.
+func (d *Data) parseChannels(query url.Values) ([]int32, error) {
+	channelsStr := query.Get("channels")
+	if channelsStr == "" {
+		return nil, nil
+	}
+	if d.NumChannels == 0 || len(d.Data.Values()) < d.NumChannels {
+		return nil, fmt.Errorf("Cannot retrieve absent data '%s'.  Please load data.", d.DataName())
+	}
+	var channels []int32
+	if channelsStr == "all" {
+		for c := 1; c <= d.NumChannels; c++ {
+			channels = append(channels, int32(c))
+		}
+	} else {
+		requested := strings.Split(channelsStr, ",")
+		if len(requested) > MaxRequestChannels {
+			return nil, fmt.Errorf("At most %d channels can be requested at once, not %d",
+				MaxRequestChannels, len(requested))
+		}
+		seen := make(map[int]bool, len(requested))
+		for _, s := range requested {
+			c, err := strconv.Atoi(s)
+			if err != nil || c < 1 || c > d.NumChannels {
+				return nil, fmt.Errorf("Bad channel %q: data '%s' has channels 1 to %d", s,
+					d.DataName(), d.NumChannels)
+			}
+			if seen[c] {
+				return nil, fmt.Errorf("Channel %d is requested more than once", c)
+			}
+			seen[c] = true
+			channels = append(channels, int32(c))
+		}
+	}
+	if len(channels) > MaxRequestChannels {
+		return nil, fmt.Errorf("At most %d channels can be requested at once, not %d",
+			MaxRequestChannels, len(channels))
+	}
+	return channels, nil
+}
+
+// getChannel returns the voxels of one channel within a geometry.
+func (d *Data) getChannel(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry,
+	channelNum int32) (*Channel, error) {
+
+	dataValues := dvid.DataValues{d.Data.Values()[channelNum-1]}
+	bytesPerVoxel := dataValues.BytesPerElement()
+	stride := geom.Size().Value(0) * bytesPerVoxel
+	data := make([]uint8, geom.NumVoxels()*int64(bytesPerVoxel))
+	channel := &Channel{
+		Voxels:     voxels.NewVoxels(geom, dataValues, data, stride, d.ByteOrder),
+		channelNum: channelNum,
+	}
+	if err := voxels.GetVoxels(ctx, uuid, d, channel); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// serveChannels writes the given channels of a slice in one response.  The "npy" format,
+// which is the default, stacks the channels into an array of shape (C, Y, X).  Image
+// formats return a multipart/mixed response with one image part per channel in order.
+func (d *Data) serveChannels(w http.ResponseWriter, r *http.Request, uuid dvid.UUID,
+	slice dvid.Geometry, channels []int32, formatStr string) error {
+
+	if formatStr == "" {
+		formatStr = "npy"
+	}
+	t, option, err := dvid.GetTranscoder(formatStr)
+	if err != nil {
+		return err
+	}
+	if t.Name != "npy" && t.EncodeImage == nil {
+		return fmt.Errorf("Multi-channel slices must use 'npy' or an image format, not %q", formatStr)
+	}
+
+	retrieved := make([]*Channel, len(channels))
+	for n, channelNum := range channels {
+		if retrieved[n], err = d.getChannel(r.Context(), uuid, slice, channelNum); err != nil {
+			return err
+		}
+	}
+
+	if t.Name == "npy" {
+		var data []byte
+		for _, channel := range retrieved {
+			data = append(data, channel.Data()...)
+		}
+		size := slice.Size()
+		shape := []int32{int32(len(channels)), size.Value(1), size.Value(0)}
+		w.Header().Set("Content-type", dvid.NpyContentType)
+		return dvid.WriteNpy(w, retrieved[0].Values(), d.ByteOrder, shape, data)
+	}
+
+	// Encode all parts before writing so errors can still be returned as a bad request.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, channel := range retrieved {
+		img, err := channel.GetImage2d()
+		if err != nil {
+			return err
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", t.ContentType)
+		header.Set("Content-Disposition", fmt.Sprintf("inline; name=\"%s%d\"", d.DataName(), channel.channelNum))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if err := t.EncodeImage(part, img.Get(), option); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-type", "multipart/mixed; boundary="+mw.Boundary())
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -15,6 +15,7 @@
 package multichan16
 
 import (
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -105,6 +106,20 @@ POST <api URL>/node/<UUID>/<data name>/<dims>/<size>/<offset>[/<format>]
                   2D: "png", "jpg" (default: "png")
                     jpg allows lossy quality setting, e.g., "jpg:80"
 
+    Query-string Options:
+
+    channels      "all" or a comma-separated list of distinct channel numbers, e.g., "1,3",
+                    to return up to 16 channels of a slice in one response.  Use the data name without a
+                    channel suffix.  The default "npy" format returns a NumPy array of shape
+                    (C, Y, X).  Image formats return a multipart/mixed response with one
+                    image part per channel in the requested order, each named by its channel
+                    data name, e.g., "mydata2".
+
+    Example:
+
+    GET <api URL>/node/3f8c/mydata/xy/200_200/0_0_100/npy?channels=all
+    GET <api URL>/node/3f8c/mydata/xy/200_200/0_0_100/png?channels=1,2
+
 `
 
 // DefaultBlockMax specifies the default size for each block of this data type.
@@ -284,7 +299,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		fmt.Fprintln(w, d.Help())
 		return nil
 	case "info":
-		jsonStr, err := d.JSONString()
+		jsonStr, err := d.Data.InfoJSON(uuid, d)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -331,6 +346,30 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		}
 		if op == voxels.PutOp {
 			return fmt.Errorf("DVID does not yet support POST of slices into multichannel data")
+		}
+		if err := d.CheckSlice(slice); err != nil {
+			server.TooLarge(w, r, err.Error())
+			return err
+		}
+		channels, err := d.parseChannels(r.URL.Query())
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if channels != nil {
+			if channelNum != 0 {
+				err := fmt.Errorf("Use the data name '%s' without a channel suffix to get many channels", d.DataName())
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			var formatStr string
+			if len(parts) >= 7 {
+				formatStr = parts[6]
+			}
+			if err := d.serveChannels(w, r, uuid, slice, channels, formatStr); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
 		} else {
 			if d.NumChannels == 0 || d.Data.Values() == nil {
 				return fmt.Errorf("Cannot retrieve absent data '%d'.  Please load data.", d.DataName())
@@ -347,11 +386,12 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				Voxels:     v,
 				channelNum: channelNum,
 			}
-			img, err := voxels.GetImage(uuid, d, channel)
+			img, err := voxels.GetImage(r.Context(), uuid, d, channel)
 			var formatStr string
 			if len(parts) >= 7 {
 				formatStr = parts[6]
 			}
+			formatStr = dvid.NegotiateImageFormat(w, r, formatStr)
 			//dvid.ElapsedTime(dvid.Normal, startTime, "%s %s upto image formatting", op, slice)
 			err = dvid.WriteImageHttp(w, img.Get(), formatStr)
 			if err != nil {
@@ -442,7 +482,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 	// PUT each channel of the file into the datastore using a separate data name.
 	for _, channel := range channels {
 		dvid.Fmt(dvid.Debug, "Processing channel %d... \n", channel.channelNum)
-		err = voxels.PutVoxels(uuid, d, channel)
+		err = voxels.PutVoxels(request.Context(), uuid, d, channel)
 		if err != nil {
 			return err
 		}
@@ -451,7 +491,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 	// Create a RGB composite from the first 3 channels.  This is considered to be channel 0
 	// or can be accessed with the base data name.
 	dvid.Fmt(dvid.Debug, "Creating composite image from channels...\n")
-	err = d.storeComposite(uuid, channels)
+	err = d.storeComposite(request.Context(), uuid, channels)
 	if err != nil {
 		return err
 	}
@@ -461,7 +501,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 }
 
 // Create a RGB interleaved volume.
-func (d *Data) storeComposite(uuid dvid.UUID, channels []*Channel) error {
+func (d *Data) storeComposite(ctx context.Context, uuid dvid.UUID, channels []*Channel) error {
 	// Setup the composite Channel
 	geom := channels[0].Geometry
 	pixels := int(geom.NumVoxels())
@@ -527,5 +567,5 @@ func (d *Data) storeComposite(uuid dvid.UUID, channels []*Channel) error {
 	}
 
 	// Store the result
-	return voxels.PutVoxels(uuid, d, composite)
+	return voxels.PutVoxels(ctx, uuid, d, composite)
 }
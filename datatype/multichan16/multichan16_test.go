@@ -1,9 +1,20 @@
 package multichan16
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
 	. "github.com/janelia-flyem/go/gocheck"
 
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+
 	"github.com/janelia-flyem/dvid/datastore"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
@@ -97,3 +108,77 @@ func (s *DataSuite) TestDatasetPersistence(c *C) {
 
 	c.Assert(newJSON, DeepEquals, oldJSON)
 }
+
+func (s *DataSuite) TestAllChannelSlice(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(s.service.NewData(root, "multichan16", "mchan", config), IsNil)
+	dataservice, err := s.service.DataServiceByUUID(root, dvid.DataString("mchan"))
+	c.Assert(err, IsNil)
+	mchan := dataservice.(*Data)
+
+	// Store two 16-bit channels with different values.
+	mchan.NumChannels = 2
+	mchan.ByteOrder = binary.LittleEndian
+	mchan.Properties.Values = dvid.DataValues{
+		{T: dvid.T_uint16, Label: "channel1"},
+		{T: dvid.T_uint16, Label: "channel2"},
+	}
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{32, 32, 32})
+	for n := int32(1); n <= 2; n++ {
+		data := make([]byte, 32*32*32*2)
+		for i := 0; i < len(data); i += 2 {
+			binary.LittleEndian.PutUint16(data[i:], uint16(1000*n))
+		}
+		channel := &Channel{
+			Voxels:     voxels.NewVoxels(subvol, dvid.DataValues{mchan.Properties.Values[n-1]}, data, 64, binary.LittleEndian),
+			channelNum: n,
+		}
+		c.Assert(voxels.PutVoxels(context.Background(), root, mchan, channel), IsNil)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/"+url, nil)
+		w := httptest.NewRecorder()
+		mchan.DoHTTP(root, w, r)
+		return w
+	}
+
+	// Stacked npy of shape (C, Y, X).
+	w := get("mchan/xy/8_4/0_0_3/npy?channels=all")
+	c.Assert(w.Code, Equals, 200)
+	body := w.Body.Bytes()
+	c.Assert(bytes.Contains(body, []byte("'shape': (2, 4, 8)")), Equals, true)
+	pixels := body[len(body)-2*8*4*2:]
+	c.Assert(binary.LittleEndian.Uint16(pixels[0:]), Equals, uint16(1000))
+	c.Assert(binary.LittleEndian.Uint16(pixels[len(pixels)-2:]), Equals, uint16(2000))
+
+	// Multipart images in requested order.
+	w = get("mchan/xy/8_4/0_0_3/png?channels=2,1")
+	c.Assert(w.Code, Equals, 200)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	c.Assert(err, IsNil)
+	c.Assert(mediaType, Equals, "multipart/mixed")
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, name := range []string{"mchan2", "mchan1"} {
+		part, err := mr.NextPart()
+		c.Assert(err, IsNil)
+		_, disposition, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		c.Assert(err, IsNil)
+		c.Assert(disposition["name"], Equals, name)
+		c.Assert(part.Header.Get("Content-Type"), Equals, "image/png")
+		img, err := ioutil.ReadAll(part)
+		c.Assert(err, IsNil)
+		c.Assert(len(img) > 0, Equals, true)
+	}
+	_, err = mr.NextPart()
+	c.Assert(err, NotNil)
+
+	// Bad channels and channel suffixes are rejected.
+	c.Assert(get("mchan/xy/8_4/0_0_3/npy?channels=3").Code, Equals, 400)
+	c.Assert(get("mchan/xy/8_4/0_0_3/npy?channels=1,1").Code, Equals, 400)
+	c.Assert(get("mchan/xy/8_4/0_0_3/npy?channels="+strings.Repeat("1,", MaxRequestChannels)+"2").Code, Equals, 400)
+	c.Assert(get("mchan1/xy/8_4/0_0_3/npy?channels=all").Code, Equals, 400)
+}
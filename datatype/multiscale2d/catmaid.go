@@ -0,0 +1,147 @@
+/*
+	This file serves tiles using the URL conventions of CATMAID tile sources so CATMAID
+	front-ends can browse multiscale2d data directly.
+*/
+
+package multiscale2d
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// parseCatmaidTile parses the path components following the plane in a CATMAID tile
+// request.  Three tile source types are supported:
+//
+//    Type 1:  <slice>/<row>_<col>_<zoom>.<ext>
+//    Type 4:  <slice>/<zoom>/<row>_<col>.<ext>
+//    Type 5:  <zoom>/<slice>/<row>/<col>.<ext>
+//
+// The returned extension is lower case without the leading period.
+func parseCatmaidTile(parts []string) (scaling Scaling, col, row, slice int32, ext string, err error) {
+	if len(parts) == 0 {
+		err = fmt.Errorf("CATMAID tile request requires a tile path")
+		return
+	}
+	last := parts[len(parts)-1]
+	ext = strings.ToLower(strings.TrimPrefix(path.Ext(last), "."))
+	if ext == "" {
+		err = fmt.Errorf("CATMAID tile request %q requires a file extension", last)
+		return
+	}
+	parts = append(append([]string{}, parts[:len(parts)-1]...), strings.TrimSuffix(last, path.Ext(last)))
+
+	var fields []string
+	switch len(parts) {
+	case 2:
+		coords := strings.Split(parts[1], "_")
+		if len(coords) != 3 {
+			err = fmt.Errorf("CATMAID tile %q should be in <row>_<col>_<zoom> form", parts[1])
+			return
+		}
+		fields = []string{coords[2], parts[0], coords[0], coords[1]}
+	case 3:
+		coords := strings.Split(parts[2], "_")
+		if len(coords) != 2 {
+			err = fmt.Errorf("CATMAID tile %q should be in <row>_<col> form", parts[2])
+			return
+		}
+		fields = []string{parts[1], parts[0], coords[0], coords[1]}
+	case 4:
+		fields = parts
+	default:
+		err = fmt.Errorf("Unrecognized CATMAID tile path: %s", strings.Join(parts, "/"))
+		return
+	}
+
+	// fields are zoom, slice, row, col
+	var values [4]int64
+	for i, field := range fields {
+		values[i], err = strconv.ParseInt(field, 10, 32)
+		if err != nil {
+			err = fmt.Errorf("Bad number %q in CATMAID tile path", field)
+			return
+		}
+	}
+	if values[0] < 0 || values[0] > 255 {
+		err = fmt.Errorf("CATMAID zoom level %d is not available", values[0])
+		return
+	}
+	scaling = Scaling(values[0])
+	slice, row, col = int32(values[1]), int32(values[2]), int32(values[3])
+	return
+}
+
+// catmaidIndex returns the tile index for a CATMAID column and row within a slice of
+// the given plane.  Columns and rows are tile coordinates along the first and second
+// axes of the plane, and the slice is a voxel coordinate along the remaining axis.
+func catmaidIndex(plane dvid.DataShape, col, row, slice int32) (dvid.IndexZYX, error) {
+	switch {
+	case plane.Equals(dvid.XY):
+		return dvid.IndexZYX{col, row, slice}, nil
+	case plane.Equals(dvid.XZ):
+		return dvid.IndexZYX{col, slice, row}, nil
+	case plane.Equals(dvid.YZ):
+		return dvid.IndexZYX{slice, col, row}, nil
+	}
+	return dvid.IndexZYX{}, fmt.Errorf("CATMAID tiles are only available for xy, xz, and yz planes, not %s", plane)
+}
+
+// ServeCatmaidTile returns the tile for a CATMAID tile source request.  Stored tiles are
+// returned without re-encoding if the requested extension matches the tile encoding.
+func (d *Data) ServeCatmaidTile(uuid dvid.UUID, w http.ResponseWriter, r *http.Request, planeStr string,
+	tileParts []string) error {
+
+	plane, err := dvid.DataShapeString(planeStr).DataShape()
+	if err != nil {
+		err = fmt.Errorf("Illegal tile plane: %s (%s)", planeStr, err.Error())
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	scaling, col, row, slice, ext, err := parseCatmaidTile(tileParts)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	index, err := catmaidIndex(plane, col, row, slice)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	data, err := d.getTileData(r.Context(), uuid, plane, scaling, index)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+
+	switch {
+	case data != nil && d.Encoding == PNG && ext == "png":
+		w.Header().Set("Content-type", "image/png")
+		_, err = w.Write(data)
+		return err
+	case data != nil && d.Encoding == JPG && (ext == "jpg" || ext == "jpeg"):
+		w.Header().Set("Content-type", "image/jpeg")
+		_, err = w.Write(data)
+		return err
+	}
+	img, err := d.getTileImage(data, plane, &IndexTile{index, plane, scaling})
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	if img == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err = dvid.WriteImageHttp(w, img, ext); err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ package multiscale2d
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -90,6 +91,13 @@ $ dvid -stdin node <UUID> <data name> generate <settings...> < config.json
                        designated using either axis number ("0,1") or xyz nomenclature ("xy").
                        Example:  planes="0,1;yz"
 
+    Once tiles are generated, they're kept up to date as the source is written.  Writes are
+    coalesced for a few seconds, then only the tiles over written regions are regenerated.
+    Until then, the tiles over written regions are stale, and requests for them regenerate
+    their region before replying so outdated tiles are never returned.
+    GETs with "consistency=strong" in the query string wait for pending writes of the source
+    and regenerate queued tiles first.
+
     ------------------
 
 HTTP API (Level 2 REST):
@@ -132,6 +140,34 @@ GET  <api URL>/node/<UUID>/<data name>/tile/<dims>/<scaling>/<tile coord>
     tile coord    The tile coordinate in "x_y_z" format.  See discussion of scaling above.
 
 
+GET  <api URL>/node/<UUID>/<data name>/catmaid/<dims>/<CATMAID tile path>
+
+    Retrieves a tile using the URL conventions of CATMAID tile sources so CATMAID front-ends
+    can browse the data without a proxy.  Set the stack's image base to
+    "<api URL>/node/<UUID>/<data name>/catmaid/<dims>/" and its tile size to the tile size
+    at scale 0.  The CATMAID zoom level is the multiscale2d scaling.  Stored tiles are returned
+    as-is when the file extension matches the tile format, and are converted otherwise.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/mymultiscale2d/catmaid/xy/100/3_2_0.jpg
+
+    Returns the JPG tile at column 2 and row 3 of the full-resolution XY slice at Z = 100.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of multiscale2d data.
+    dims          Slice string ("xy", "xz", or "yz") or axes in form "i_j".  Columns and rows
+                    are tile coordinates along the first and second axes, e.g., X and Z for "xz",
+                    and the slice is the voxel coordinate along the remaining axis.
+    tile path     One of the following CATMAID tile source types:
+                    Type 1:  <slice>/<row>_<col>_<zoom>.<ext>
+                    Type 4:  <slice>/<zoom>/<row>_<col>.<ext>
+                    Type 5:  <zoom>/<slice>/<row>/<col>.<ext>
+                    where <ext> is "png" or "jpg".
+
+
 GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
 
     Retrieves raw image of named data within a version node using the precomputed multiscale2d.
@@ -153,8 +189,11 @@ GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
                     Note that only 2d images are returned for multiscale2ds.
     size          Size in voxels along each dimension specified in <dims>.
     offset        Gives coordinate of first voxel using dimensionality of data.
-    format        "png", "jpg" (default: "png")
-                    jpg allows lossy quality setting, e.g., "jpg:80"
+    format        "png", "jpg", and if built with libwebp/libavif, "webp" and "avif"
+                    (default: "png")
+                    jpg, webp, and avif allow lossy quality setting, e.g., "jpg:80" or
+                    "webp:75", and webp can be lossless with "webp:lossless".  If no format
+                    is given, webp or avif is returned when listed in the Accept header.
 
 GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format>]
 
@@ -177,8 +216,11 @@ GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format
                     Note that only 2d images are returned for multiscale2ds.
     size          Size in voxels along each dimension specified in <dims>.
     offset        Gives coordinate of first voxel using dimensionality of data.
-    format        "png", "jpg" (default: "png")
-                    jpg allows lossy quality setting, e.g., "jpg:80"
+    format        "png", "jpg", and if built with libwebp/libavif, "webp" and "avif"
+                    (default: "png")
+                    jpg, webp, and avif allow lossy quality setting, e.g., "jpg:80" or
+                    "webp:75", and webp can be lossless with "webp:lossless".  If no format
+                    is given, webp or avif is returned when listed in the Accept header.
 
 `
 
@@ -195,6 +237,9 @@ func init() {
 	gob.Register(&Datatype{})
 	gob.Register(&Data{})
 	gob.Register(&IndexTile{})
+
+	// Keep generated tiles up to date as their source is written.
+	voxels.AddWriteObserver(queuePyramidUpdates)
 }
 
 // Scaling describes the scale level where 0 = original data resolution and
@@ -449,6 +494,9 @@ type Data struct {
 	// Levels describe the resolution and tile sizes at each level of resolution.
 	Levels TileSpec
 
+	// Planes are the planes tiled, e.g., "xy", or all orthogonal planes if empty.
+	Planes []string
+
 	// Placeholder, when true (false by default), will generate fake tile images if a tile cannot
 	// be found.  This is useful in testing clients.
 	Placeholder bool
@@ -497,7 +545,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 	if err != nil {
 		return err
 	}
-	return d.ConstructTiles(uuidStr, tileSpec, request.Settings())
+	return d.ConstructTiles(request.Context(), uuidStr, tileSpec, request.Settings())
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
@@ -520,6 +568,14 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 	url := r.URL.Path[len(server.WebAPIPath):]
 	parts := strings.Split(url, "/")
 
+	// Strongly consistent reads see tiles over all writes acknowledged before them.
+	if action == "get" && server.IsStrongRead(r.Context()) {
+		if err := d.awaitTiles(r.Context(), uuid); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+	}
+
 	switch parts[3] {
 	case "help":
 		w.Header().Set("Content-Type", "text/plain")
@@ -552,6 +608,22 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: tile %s (%s)", r.Method, planeStr, r.URL)
 		}
 
+	case "catmaid":
+		if len(parts) < 7 {
+			err := fmt.Errorf("'catmaid' request must be followed by plane and CATMAID tile path")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if action == "post" {
+			err := fmt.Errorf("DVID does not support POST of CATMAID tiles")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := d.ServeCatmaidTile(uuid, w, r, parts[4], parts[5:]); err != nil {
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: catmaid tile %s (%s)", r.Method, parts[4], r.URL)
+
 	case "raw", "isotropic":
 		if action == "post" {
 			return fmt.Errorf("multiscale2d '%s' can only PUT tiles not images", d.DataName())
@@ -576,7 +648,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
-		img, err := d.GetImage(uuid, slice, parts[3] == "isotropic")
+		img, err := d.GetImage(r.Context(), uuid, slice, parts[3] == "isotropic")
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -585,6 +657,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		if len(parts) >= 8 {
 			formatStr = parts[7]
 		}
+		formatStr = dvid.NegotiateImageFormat(w, r, formatStr)
 		err = dvid.WriteImageHttp(w, img.Get(), formatStr)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
@@ -603,7 +676,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 // GetImage returns an image given a 2d orthogonal image description.  Since multiscale2d tiles
 // have precomputed XY, XZ, and YZ orientations, reconstruction of the desired image should
 // be much faster than computing the image from voxel blocks.
-func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dvid.Image, error) {
+func (d *Data) GetImage(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dvid.Image, error) {
 	// Iterate through tiles that intersect our geometry.
 	levelSpec, found := d.Levels[0]
 	if !found {
@@ -651,9 +724,11 @@ func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dv
 		for x0 < dstW {
 			wg.Add(1)
 			go func(x0, y0, x1, y1 int32) {
+				defer wg.Done()
+
 				// Get this tile from datastore
 				tileCoord, err := slice.PlaneToChunkPoint3d(x0, y0, minSlice.StartPoint(), levelSpec.TileSize)
-				goImg, err := d.GetTile(uuid, slice, Scaling(0), dvid.IndexZYX(tileCoord))
+				goImg, err := d.GetTile(ctx, uuid, slice, Scaling(0), dvid.IndexZYX(tileCoord))
 				if err != nil || goImg == nil {
 					return
 				}
@@ -666,7 +741,6 @@ func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dv
 				// Paste the pertinent rectangle from this tile into our destination.
 				r := image.Rect(int(x0), int(y0), int(x1), int(y1))
 				draw.Draw(dst.GetDrawable(), r, goImg, ptInTile, draw.Src)
-				wg.Done()
 			}(x0, y0, x1, y1)
 			x0 = x1
 			x1 += tileW
@@ -710,7 +784,7 @@ func (d *Data) ServeTile(uuid dvid.UUID, w http.ResponseWriter, r *http.Request,
 		return err
 	}
 	indexZYX := dvid.IndexZYX{tileCoord.Value(0), tileCoord.Value(1), tileCoord.Value(2)}
-	data, err := d.getTileData(uuid, shape, Scaling(scaling), indexZYX)
+	data, err := d.getTileData(r.Context(), uuid, shape, Scaling(scaling), indexZYX)
 
 	switch d.Encoding {
 	case LZ4:
@@ -740,8 +814,10 @@ func (d *Data) ServeTile(uuid dvid.UUID, w http.ResponseWriter, r *http.Request,
 }
 
 // GetTile returns an 2d tile image
-func (d *Data) GetTile(uuid dvid.UUID, shape dvid.DataShape, scaling Scaling, index dvid.IndexZYX) (image.Image, error) {
-	data, err := d.getTileData(uuid, shape, scaling, index)
+func (d *Data) GetTile(ctx context.Context, uuid dvid.UUID, shape dvid.DataShape, scaling Scaling,
+	index dvid.IndexZYX) (image.Image, error) {
+
+	data, err := d.getTileData(ctx, uuid, shape, scaling, index)
 	if err != nil {
 		return nil, err
 	}
@@ -750,7 +826,9 @@ func (d *Data) GetTile(uuid dvid.UUID, shape dvid.DataShape, scaling Scaling, in
 }
 
 // getTileData returns 2d tile data straight from storage without decoding.
-func (d *Data) getTileData(uuid dvid.UUID, shape dvid.DataShape, scaling Scaling, index dvid.IndexZYX) ([]byte, error) {
+func (d *Data) getTileData(ctx context.Context, uuid dvid.UUID, shape dvid.DataShape, scaling Scaling,
+	index dvid.IndexZYX) ([]byte, error) {
+
 	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
 	if err != nil {
 		return nil, err
@@ -758,6 +836,9 @@ func (d *Data) getTileData(uuid dvid.UUID, shape dvid.DataShape, scaling Scaling
 	if d.Levels == nil {
 		return nil, fmt.Errorf("Tiles have not been generated.")
 	}
+	if err := d.freshenTile(ctx, uuid, shape, scaling, index); err != nil {
+		return nil, err
+	}
 	db, err := server.OrderedKeyValueGetter()
 	if err != nil {
 		return nil, err
@@ -908,7 +989,7 @@ func (d *Data) putTileFunc(versionID dvid.VersionLocalID) (outFunc, error) {
 	}, nil
 }
 
-func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Config) error {
+func (d *Data) ConstructTiles(ctx context.Context, uuidStr string, tileSpec TileSpec, config dvid.Config) error {
 
 	// Save the current tile specification
 	service := server.DatastoreService()
@@ -916,7 +997,14 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 	if err != nil {
 		return err
 	}
+	// Get the planes we should tile.
+	planes, err := config.GetShapes("planes", ";")
+	if planes == nil {
+		// If no planes are specified, construct multiscale2d for 3 orthogonal planes.
+		planes = []dvid.DataShape{dvid.XY, dvid.XZ, dvid.YZ}
+	}
 	d.Levels = tileSpec
+	d.Planes = planeNames(planes)
 	if err := service.SaveDataset(uuid); err != nil {
 		return err
 	}
@@ -939,13 +1027,6 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 	var sliceBuffers [2]voxels.ExtHandler
 	var bufferNum int
 
-	// Get the planes we should tile.
-	planes, err := config.GetShapes("planes", ";")
-	if planes == nil {
-		// If no planes are specified, construct multiscale2d for 3 orthogonal planes.
-		planes = []dvid.DataShape{dvid.XY, dvid.XZ, dvid.YZ}
-	}
-
 	for _, plane := range planes {
 		startTime := time.Now()
 		offset := minPt.Duplicate()
@@ -970,7 +1051,7 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 				if err != nil {
 					return err
 				}
-				if err = voxels.GetVoxels(uuid, src, sliceBuffers[bufferNum]); err != nil {
+				if err = voxels.GetVoxels(ctx, uuid, src, sliceBuffers[bufferNum]); err != nil {
 					return err
 				}
 				// Iterate through the different scales, extracting tiles at each resolution.
@@ -1020,7 +1101,7 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 				if err != nil {
 					return err
 				}
-				if err = voxels.GetVoxels(uuid, src, sliceBuffers[bufferNum]); err != nil {
+				if err = voxels.GetVoxels(ctx, uuid, src, sliceBuffers[bufferNum]); err != nil {
 					return err
 				}
 				// Iterate through the different scales, extracting tiles at each resolution.
@@ -1070,7 +1151,7 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 				if err != nil {
 					return err
 				}
-				if err = voxels.GetVoxels(uuid, src, sliceBuffers[bufferNum]); err != nil {
+				if err = voxels.GetVoxels(ctx, uuid, src, sliceBuffers[bufferNum]); err != nil {
 					return err
 				}
 				// Iterate through the different scales, extracting tiles at each resolution.
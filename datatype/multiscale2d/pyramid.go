@@ -0,0 +1,506 @@
+/*
+	This file keeps generated tile pyramids up to date as their source voxels are written.
+	Each write of source voxels queues the regions it touches, where a region is one slice
+	through the footprint of a tile at the coarsest scale.  Queued regions are coalesced for
+	PyramidUpdateDelay so an editing session regenerates each region once, and then the
+	tiles of each region are regenerated at all scales.
+
+	Tiles of queued regions are stale until regenerated.  A request for a stale tile
+	regenerates its region first, so outdated tiles are never served, and concurrent
+	requests for tiles of the same region wait for one regeneration.
+*/
+
+package multiscale2d
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// PyramidUpdateDelay is how long writes are coalesced before the tiles they affect are
+// regenerated.  A negative delay turns off automatic pyramid maintenance.
+var PyramidUpdateDelay = 5 * time.Second
+
+// tiledPlanes are the planes that can be tiled, in the order of pyramidRegion.plane,
+// and tiledPlaneNames are their names in Data.Planes.
+var (
+	tiledPlanes     = []dvid.DataShape{dvid.XY, dvid.XZ, dvid.YZ}
+	tiledPlaneNames = []string{"xy", "xz", "yz"}
+)
+
+// pyramidRegion is a slice through the footprint of a coarsest tile that needs its
+// tiles regenerated.
+type pyramidRegion struct {
+	data  *Data
+	uuid  dvid.UUID
+	plane int // index into tiledPlanes
+
+	// cell gives the footprint along the plane's axes and the slice coordinate along
+	// the remaining axis.
+	cell dvid.Point3d
+}
+
+var pyramidUpdates struct {
+	sync.Mutex
+	pending   map[pyramidRegion]struct{}
+	scheduled bool
+
+	// stale holds the pending regions and those being regenerated.
+	stale map[pyramidRegion]struct{}
+
+	// freshening holds the regions being regenerated for tile requests.
+	freshening map[pyramidRegion]*regionUpdate
+
+	// updating is held while a region is regenerated.
+	updating sync.Mutex
+}
+
+// regionUpdate is the regeneration of a region for a tile request, which is closed
+// once done with its error.
+type regionUpdate struct {
+	done chan struct{}
+	err  error
+}
+
+// queuePyramidUpdates is a voxels.WriteObserver that queues the regions of all tile
+// pyramids with the written data as source.
+func queuePyramidUpdates(uuid dvid.UUID, source datastore.DataID, minPt, maxPt dvid.Point) {
+	if PyramidUpdateDelay < 0 {
+		return
+	}
+	service := server.DatastoreService()
+	if service == nil {
+		return
+	}
+	dataset, err := service.DatasetFromUUID(uuid)
+	if err != nil {
+		return
+	}
+	for _, name := range dataset.DataNames() {
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			continue
+		}
+		d, ok := dataservice.(*Data)
+		if !ok || d.Source != source.DataName() || d.Levels == nil {
+			continue
+		}
+		if err := d.queueRegions(uuid, minPt, maxPt); err != nil {
+			dvid.Error("Unable to queue tile updates for '%s': %s\n", d.DataName(), err.Error())
+		}
+	}
+}
+
+// queueRegions queues the regions of the pyramid covering written voxel bounds.
+func (d *Data) queueRegions(uuid dvid.UUID, minPt, maxPt dvid.Point) error {
+	src, err := getSourceVoxels(uuid, d.Source)
+	if err != nil {
+		return err
+	}
+	origin, footprint, err := d.pyramidGrid(src)
+	if err != nil {
+		return err
+	}
+	planes, err := d.tiledPlaneIndices()
+	if err != nil {
+		return err
+	}
+	var minCell, maxCell dvid.Point3d
+	for dim := uint8(0); dim < 3; dim++ {
+		minCell[dim] = floorDiv(minPt.Value(dim)-origin[dim], footprint[dim])
+		maxCell[dim] = floorDiv(maxPt.Value(dim)-origin[dim], footprint[dim])
+	}
+
+	pyramidUpdates.Lock()
+	defer pyramidUpdates.Unlock()
+	if pyramidUpdates.pending == nil {
+		pyramidUpdates.pending = make(map[pyramidRegion]struct{})
+	}
+	if pyramidUpdates.stale == nil {
+		pyramidUpdates.stale = make(map[pyramidRegion]struct{})
+	}
+	for _, plane := range planes {
+		// The slice axis is the one not in the plane.
+		shape := tiledPlanes[plane]
+		begCell, endCell := minCell, maxCell
+		for dim := uint8(0); dim < 3; dim++ {
+			if !inPlane(shape, dim) {
+				begCell[dim], endCell[dim] = minPt.Value(dim), maxPt.Value(dim)
+			}
+		}
+		for z := begCell[2]; z <= endCell[2]; z++ {
+			for y := begCell[1]; y <= endCell[1]; y++ {
+				for x := begCell[0]; x <= endCell[0]; x++ {
+					region := pyramidRegion{d, uuid, plane, dvid.Point3d{x, y, z}}
+					pyramidUpdates.pending[region] = struct{}{}
+					pyramidUpdates.stale[region] = struct{}{}
+				}
+			}
+		}
+	}
+	if !pyramidUpdates.scheduled {
+		pyramidUpdates.scheduled = true
+		time.AfterFunc(PyramidUpdateDelay, func() { UpdatePyramids(context.Background()) })
+	}
+	return nil
+}
+
+// UpdatePyramids regenerates the tiles of all queued regions.  It's called automatically
+// after PyramidUpdateDelay but can be called to bring pyramids up to date immediately.
+func UpdatePyramids(ctx context.Context) error {
+	pyramidUpdates.Lock()
+	pending := pyramidUpdates.pending
+	pyramidUpdates.pending = nil
+	pyramidUpdates.scheduled = false
+	pyramidUpdates.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	startTime := time.Now()
+	var firstErr error
+	for region := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := regenerateRegion(ctx, region); err != nil {
+			dvid.Error("Unable to update tiles of '%s': %s\n", region.data.DataName(), err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	dvid.ElapsedTime(dvid.Debug, startTime, "Updated tiles of %d pyramid regions", len(pending))
+	return firstErr
+}
+
+// regenerateRegion regenerates the tiles of a region while holding
+// pyramidUpdates.updating unless the region was regenerated while waiting.
+func regenerateRegion(ctx context.Context, region pyramidRegion) error {
+	pyramidUpdates.updating.Lock()
+	defer pyramidUpdates.updating.Unlock()
+	pyramidUpdates.Lock()
+	_, stale := pyramidUpdates.stale[region]
+	pyramidUpdates.Unlock()
+	if !stale {
+		return nil
+	}
+	if err := region.data.updateRegion(ctx, region); err != nil {
+		return err
+	}
+	markFresh(region)
+	return nil
+}
+
+// markFresh notes that a region's tiles were regenerated unless it was queued again.
+func markFresh(region pyramidRegion) {
+	pyramidUpdates.Lock()
+	defer pyramidUpdates.Unlock()
+	if _, queued := pyramidUpdates.pending[region]; !queued {
+		delete(pyramidUpdates.stale, region)
+	}
+}
+
+// tileRegion returns the region holding a tile, or false if the tile's plane or scale
+// isn't one that's kept up to date.
+func (d *Data) tileRegion(uuid dvid.UUID, shape dvid.DataShape, scaling Scaling,
+	index dvid.IndexZYX) (region pyramidRegion, found bool, err error) {
+
+	plane := -1
+	for i, tiled := range tiledPlanes {
+		if shape.Equals(tiled) {
+			plane = i
+		}
+	}
+	if plane < 0 {
+		return
+	}
+	src, err := getSourceVoxels(uuid, d.Source)
+	if err != nil {
+		return
+	}
+	levels, err := d.levelSpecs()
+	if err != nil {
+		return
+	}
+	levelSpec, ok := levels[scaling]
+	if !ok {
+		return
+	}
+	origin, footprint, err := d.pyramidGrid(src)
+	if err != nil {
+		return
+	}
+	mag := dvid.Point3d{1, 1, 1}
+	for s := Scaling(0); s < scaling; s++ {
+		for dim := uint8(0); dim < 3; dim++ {
+			mag[dim] *= levels[s].levelMag[dim]
+		}
+	}
+
+	// Tile indices are in the coordinates of the tile's level along the plane's axes,
+	// relative to the origin, and at the full resolution slice coordinate otherwise.
+	region = pyramidRegion{data: d, uuid: uuid, plane: plane}
+	for dim := uint8(0); dim < 3; dim++ {
+		if inPlane(shape, dim) {
+			levelPos := index[dim] * levelSpec.TileSize[dim]
+			fullPos := origin[dim] + (levelPos-origin[dim])*mag[dim]
+			region.cell[dim] = floorDiv(fullPos-origin[dim], footprint[dim])
+		} else {
+			region.cell[dim] = index[dim]
+		}
+	}
+	return region, true, nil
+}
+
+// freshenTile regenerates the region of a tile if its tiles are stale.
+func (d *Data) freshenTile(ctx context.Context, uuid dvid.UUID, shape dvid.DataShape, scaling Scaling,
+	index dvid.IndexZYX) error {
+
+	pyramidUpdates.Lock()
+	numStale := len(pyramidUpdates.stale)
+	pyramidUpdates.Unlock()
+	if numStale == 0 || d.Levels == nil {
+		return nil
+	}
+	region, found, err := d.tileRegion(uuid, shape, scaling, index)
+	if err != nil || !found {
+		return err
+	}
+	return freshenRegion(ctx, region, regenerateRegion)
+}
+
+// freshenRegion regenerates a region with regenerate if it's stale.  Only one request
+// regenerates a region at a time, and other requests wait for it.  If the regenerating
+// request is canceled, a waiting request takes over.
+func freshenRegion(ctx context.Context, region pyramidRegion,
+	regenerate func(context.Context, pyramidRegion) error) error {
+
+	for {
+		pyramidUpdates.Lock()
+		if _, stale := pyramidUpdates.stale[region]; !stale {
+			pyramidUpdates.Unlock()
+			return nil
+		}
+		update, running := pyramidUpdates.freshening[region]
+		if !running {
+			if pyramidUpdates.freshening == nil {
+				pyramidUpdates.freshening = make(map[pyramidRegion]*regionUpdate)
+			}
+			update = &regionUpdate{done: make(chan struct{})}
+			pyramidUpdates.freshening[region] = update
+			delete(pyramidUpdates.pending, region)
+		}
+		pyramidUpdates.Unlock()
+
+		if running {
+			select {
+			case <-update.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if update.err == context.Canceled || update.err == context.DeadlineExceeded {
+				continue
+			}
+			return update.err
+		}
+		update.err = regenerate(ctx, region)
+		pyramidUpdates.Lock()
+		delete(pyramidUpdates.freshening, region)
+		pyramidUpdates.Unlock()
+		close(update.done)
+		return update.err
+	}
+}
+
+// updateRegion regenerates the tiles of a region at all scales from the source voxels.
+func (d *Data) updateRegion(ctx context.Context, region pyramidRegion) error {
+	_, versionID, err := server.DatastoreService().LocalIDFromUUID(region.uuid)
+	if err != nil {
+		return err
+	}
+	src, err := getSourceVoxels(region.uuid, d.Source)
+	if err != nil {
+		return err
+	}
+	levels, err := d.levelSpecs()
+	if err != nil {
+		return err
+	}
+	origin, footprint, err := d.pyramidGrid(src)
+	if err != nil {
+		return err
+	}
+	shape := tiledPlanes[region.plane]
+	offset := region.cell
+	for dim := uint8(0); dim < 3; dim++ {
+		if inPlane(shape, dim) {
+			offset[dim] = origin[dim] + region.cell[dim]*footprint[dim]
+		}
+	}
+	width, height, err := shape.GetSize2D(footprint)
+	if err != nil {
+		return err
+	}
+	slice, err := dvid.NewOrthogSlice(shape, offset, dvid.Point2d{width, height})
+	if err != nil {
+		return err
+	}
+	e, err := src.NewExtHandler(slice, nil)
+	if err != nil {
+		return err
+	}
+	if err = voxels.GetVoxels(ctx, region.uuid, src, e); err != nil {
+		return err
+	}
+	outF, err := d.putTileFunc(versionID)
+	if err != nil {
+		return err
+	}
+
+	// Tiles are indexed as ConstructTiles does, relative to the origin in the coordinates
+	// of each level and at the full resolution slice coordinate.
+	mag := dvid.Point3d{1, 1, 1}
+	for scaling := Scaling(0); int(scaling) < len(levels); scaling++ {
+		levelOffset := offset
+		for dim := uint8(0); dim < 3; dim++ {
+			if inPlane(shape, dim) {
+				levelOffset[dim] = origin[dim] + (offset[dim]-origin[dim])/mag[dim]
+			}
+		}
+		if err := d.extractTiles(e, levelOffset, scaling, outF); err != nil {
+			return err
+		}
+		if int(scaling) < len(levels)-1 {
+			levelMag := levels[scaling].levelMag
+			if err := e.DownRes(levelMag); err != nil {
+				return err
+			}
+			for dim := uint8(0); dim < 3; dim++ {
+				mag[dim] *= levelMag[dim]
+			}
+		}
+	}
+	return nil
+}
+
+// levelSpecs returns the tile specification with the magnifications between levels,
+// which aren't stored with the data.
+func (d *Data) levelSpecs() (TileSpec, error) {
+	levels := make(TileSpec, len(d.Levels))
+	for scaling, levelSpec := range d.Levels {
+		if int(scaling) < len(d.Levels)-1 {
+			nextSpec, found := d.Levels[scaling+1]
+			if !found {
+				return nil, fmt.Errorf("Tiles of '%s' are missing scale level %d", d.DataName(), scaling+1)
+			}
+			for i, curRes := range levelSpec.Resolution {
+				levelSpec.levelMag[i] = int32(nextSpec.Resolution[i]/curRes + 0.5)
+			}
+		}
+		levels[scaling] = levelSpec
+	}
+	return levels, nil
+}
+
+// pyramidGrid returns the origin of the tiles, as computed by ConstructTiles, and the
+// footprint in full resolution voxels of a tile at the coarsest scale.
+func (d *Data) pyramidGrid(src *voxels.Data) (origin, footprint dvid.Point3d, err error) {
+	levels, err := d.levelSpecs()
+	if err != nil {
+		return
+	}
+	hiresSpec, found := levels[Scaling(0)]
+	if !found {
+		err = fmt.Errorf("Tiles of '%s' have no full resolution level", d.DataName())
+		return
+	}
+	minPt, ok := src.MinPoint.(dvid.Chunkable)
+	if !ok {
+		err = fmt.Errorf("Source '%s' of tiles has no stored voxels", d.Source)
+		return
+	}
+	originPt, ok := minPt.Chunk(hiresSpec.TileSize).MinPoint(hiresSpec.TileSize).(dvid.Point3d)
+	if !ok {
+		err = fmt.Errorf("Tiles of '%s' require 3d source data", d.DataName())
+		return
+	}
+	origin = originPt
+	mag := dvid.Point3d{1, 1, 1}
+	for scaling := Scaling(0); int(scaling) < len(levels)-1; scaling++ {
+		for dim := uint8(0); dim < 3; dim++ {
+			mag[dim] *= levels[scaling].levelMag[dim]
+		}
+	}
+	top := levels[Scaling(len(levels)-1)]
+	for dim := uint8(0); dim < 3; dim++ {
+		footprint[dim] = top.TileSize[dim] * mag[dim]
+	}
+	return
+}
+
+// tiledPlaneIndices returns the indices into tiledPlanes of the planes that were tiled.
+func (d *Data) tiledPlaneIndices() ([]int, error) {
+	if len(d.Planes) == 0 {
+		return []int{0, 1, 2}, nil
+	}
+	var indices []int
+	for _, name := range d.Planes {
+		for i, tiledName := range tiledPlaneNames {
+			if name == tiledName {
+				indices = append(indices, i)
+			}
+		}
+	}
+	return indices, nil
+}
+
+// planeNames returns the names stored in Data.Planes for the given planes.
+func planeNames(planes []dvid.DataShape) []string {
+	var names []string
+	for _, plane := range planes {
+		for i, tiled := range tiledPlanes {
+			if plane.Equals(tiled) {
+				names = append(names, tiledPlaneNames[i])
+			}
+		}
+	}
+	return names
+}
+
+// inPlane returns true if the dimension is one of the plane's axes.
+func inPlane(shape dvid.DataShape, dim uint8) bool {
+	for i := uint8(0); i < 2; i++ {
+		if axis, err := shape.ShapeDimension(i); err == nil && axis == dim {
+			return true
+		}
+	}
+	return false
+}
+
+// floorDiv returns a / b rounded toward negative infinity.
+func floorDiv(a, b int32) int32 {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// awaitTiles waits for pending writes of the source so a strongly consistent read
+// observes all acknowledged writes.  Finished writes have queued their regions, so the
+// read then regenerates only the region of its own tile if stale rather than all queued
+// regions.
+func (d *Data) awaitTiles(ctx context.Context, uuid dvid.UUID) error {
+	src, err := getSourceVoxels(uuid, d.Source)
+	if err != nil {
+		return err
+	}
+	return server.AwaitWrites(ctx, uuid, src.DataID(), nil, nil)
+}
@@ -0,0 +1,99 @@
+package multiscale2d
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type PyramidSuite struct{}
+
+var _ = Suite(&PyramidSuite{})
+
+// markStale queues a region as if its source voxels were written.
+func markStale(region pyramidRegion) {
+	pyramidUpdates.Lock()
+	defer pyramidUpdates.Unlock()
+	if pyramidUpdates.pending == nil {
+		pyramidUpdates.pending = make(map[pyramidRegion]struct{})
+	}
+	if pyramidUpdates.stale == nil {
+		pyramidUpdates.stale = make(map[pyramidRegion]struct{})
+	}
+	pyramidUpdates.pending[region] = struct{}{}
+	pyramidUpdates.stale[region] = struct{}{}
+}
+
+func (s *PyramidSuite) TestFreshenRegion(c *C) {
+	region := pyramidRegion{uuid: dvid.UUID("freshen"), cell: dvid.Point3d{1, 2, 3}}
+	markStale(region)
+
+	// Concurrent requests for a stale region wait for one regeneration.
+	var regenerations int32
+	release := make(chan struct{})
+	regenerate := func(ctx context.Context, region pyramidRegion) error {
+		atomic.AddInt32(&regenerations, 1)
+		<-release
+		markFresh(region)
+		return nil
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = freshenRegion(context.Background(), region, regenerate)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		c.Assert(err, IsNil)
+	}
+	c.Assert(atomic.LoadInt32(&regenerations), Equals, int32(1))
+	pyramidUpdates.Lock()
+	_, stale := pyramidUpdates.stale[region]
+	_, pending := pyramidUpdates.pending[region]
+	pyramidUpdates.Unlock()
+	c.Assert(stale, Equals, false)
+	c.Assert(pending, Equals, false)
+
+	// Fresh regions aren't regenerated.
+	c.Assert(freshenRegion(context.Background(), region, regenerate), IsNil)
+	c.Assert(atomic.LoadInt32(&regenerations), Equals, int32(1))
+
+	// A waiting request takes over if the regenerating request is canceled.
+	markStale(region)
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	canceled := func(ctx context.Context, region pyramidRegion) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	done := make(chan error)
+	go func() { done <- freshenRegion(ctx, region, canceled) }()
+	<-started
+	waiting := make(chan error)
+	go func() {
+		waiting <- freshenRegion(context.Background(), region, func(ctx context.Context, region pyramidRegion) error {
+			markFresh(region)
+			return nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	c.Assert(<-done, Equals, context.Canceled)
+	c.Assert(<-waiting, IsNil)
+}
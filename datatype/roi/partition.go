@@ -0,0 +1,131 @@
+/*
+	This file partitions an ROI into subvolumes of blocks so cluster jobs can shard work.
+*/
+
+package roi
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Subvolume is a box of voxels with inclusive bounds and the number of ROI blocks within it.
+type Subvolume struct {
+	MinPoint     dvid.Point3d
+	MaxPoint     dvid.Point3d
+	ActiveBlocks int
+}
+
+// Partition divides an ROI into subvolumes.
+type Partition struct {
+	NumActiveBlocks int
+	NumSubvolumes   int
+	Subvolumes      []Subvolume
+}
+
+// subvolumeBlocks tracks the ROI blocks within one subvolume of a partition.
+type subvolumeBlocks struct {
+	coord    dvid.Point3d
+	active   int
+	min, max dvid.Point3d
+}
+
+func floorDiv(a, b int32) int32 {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// Partition divides the ROI into subvolumes of batchsize blocks along each edge, aligned
+// to block coordinates that are multiples of batchsize, keeping those with ROI blocks in
+// z, y, x order.  If optimized is true, each subvolume is shrunk to the bounding box of
+// its ROI blocks.
+func (d *Data) Partition(uuid dvid.UUID, batchsize int32, optimized bool) (*Partition, error) {
+	if batchsize < 1 {
+		return nil, fmt.Errorf("ROI partition batch size must be at least 1, not %d", batchsize)
+	}
+	spans, err := d.GetSpans(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Spans are sorted by z then y, so only the subvolumes of the current layer of
+	// subvolumes need to be kept, and they can be emitted when the layer is done.
+	partition := &Partition{Subvolumes: []Subvolume{}}
+	var layer []*subvolumeBlocks
+	layerZ := int32(0)
+	flush := func() {
+		sort.Sort(subvolumesByYX(layer))
+		for _, s := range layer {
+			subvol := Subvolume{ActiveBlocks: s.active}
+			minBlock, maxBlock := s.min, s.max
+			if !optimized {
+				for dim := 0; dim < 3; dim++ {
+					minBlock[dim] = s.coord[dim] * batchsize
+					maxBlock[dim] = minBlock[dim] + batchsize - 1
+				}
+			}
+			for dim := 0; dim < 3; dim++ {
+				subvol.MinPoint[dim] = minBlock[dim] * d.BlockSize[dim]
+				subvol.MaxPoint[dim] = (maxBlock[dim]+1)*d.BlockSize[dim] - 1
+			}
+			partition.Subvolumes = append(partition.Subvolumes, subvol)
+		}
+		layer = nil
+	}
+	index := make(map[dvid.Point3d]*subvolumeBlocks)
+	for _, span := range spans {
+		z, y := span[0], span[1]
+		if subZ := floorDiv(z, batchsize); len(layer) == 0 || subZ != layerZ {
+			flush()
+			layerZ = subZ
+			index = make(map[dvid.Point3d]*subvolumeBlocks)
+		}
+		subY := floorDiv(y, batchsize)
+		for x0 := span[2]; x0 <= span[3]; {
+			subX := floorDiv(x0, batchsize)
+			x1 := (subX+1)*batchsize - 1
+			if x1 > span[3] {
+				x1 = span[3]
+			}
+			coord := dvid.Point3d{subX, subY, layerZ}
+			s, found := index[coord]
+			if !found {
+				s = &subvolumeBlocks{coord: coord, min: dvid.Point3d{x0, y, z}, max: dvid.Point3d{x1, y, z}}
+				index[coord] = s
+				layer = append(layer, s)
+			}
+			s.active += int(x1 - x0 + 1)
+			for dim, v := range [3][2]int32{{x0, x1}, {y, y}, {z, z}} {
+				if v[0] < s.min[dim] {
+					s.min[dim] = v[0]
+				}
+				if v[1] > s.max[dim] {
+					s.max[dim] = v[1]
+				}
+			}
+			partition.NumActiveBlocks += int(x1 - x0 + 1)
+			if x1 == span[3] {
+				break
+			}
+			x0 = x1 + 1
+		}
+	}
+	flush()
+	partition.NumSubvolumes = len(partition.Subvolumes)
+	return partition, nil
+}
+
+type subvolumesByYX []*subvolumeBlocks
+
+func (s subvolumesByYX) Len() int      { return len(s) }
+func (s subvolumesByYX) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s subvolumesByYX) Less(i, j int) bool {
+	if s[i].coord[1] != s[j].coord[1] {
+		return s[i].coord[1] < s[j].coord[1]
+	}
+	return s[i].coord[0] < s[j].coord[0]
+}
@@ -0,0 +1,459 @@
+/*
+	Package roi implements DVID support for regions of interest, which are sets of blocks
+	stored as runs of blocks along x.
+*/
+package roi
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	Version = "0.1"
+	RepoUrl = "github.com/janelia-flyem/dvid/datatype/roi"
+)
+
+const HelpMessage = `
+API for 'roi' datatype (github.com/janelia-flyem/dvid/datatype/roi)
+===================================================================
+
+Command-line:
+
+$ dvid dataset <UUID> new roi <data name> <settings...>
+
+	Adds newly named roi data to dataset with specified UUID.
+
+	Example:
+
+	$ dvid dataset 3f8c new roi medulla BlockSize=32,32,32
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of data to create, e.g., "medulla"
+    settings       Configuration settings in "key=value" format separated by spaces.
+
+    Configuration Settings (case-insensitive keys)
+
+    Versioned      "true" or "false" (default)
+    BlockSize      Size in voxels of the blocks making up the ROI (default: 32,32,32)
+
+    ------------------
+
+HTTP API (Level 2 REST):
+
+GET  <api URL>/node/<UUID>/<data name>/help
+
+	Returns data-specific help message.
+
+
+GET  <api URL>/node/<UUID>/<data name>/info
+
+    Retrieves data properties.
+
+    Example:
+
+    GET <api URL>/node/3f8c/medulla/info
+
+    Returns JSON with configuration settings.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of roi data.
+
+
+GET  <api URL>/node/<UUID>/<data name>/roi
+POST <api URL>/node/<UUID>/<data name>/roi
+
+    Retrieves or replaces the blocks of the ROI as a JSON list of spans in block
+    coordinates, where each span is [z, y, x0, x1] and includes blocks x0 through x1:
+
+    [[0, 0, 0, 5], [0, 1, 2, 4], [1, 0, 0, 5]]
+
+    Spans are sorted and merged when stored.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of roi data.
+
+
+GET  <api URL>/node/<UUID>/<data name>/partition?batchsize=<n>[&optimized=true]
+
+    Divides the ROI into subvolumes of n x n x n blocks aligned to block coordinates that
+    are multiples of n, returning those that contain ROI blocks in z, y, x order.  If
+    optimized is true, each subvolume is shrunk to the bounding box of its ROI blocks.
+    Since the partition only depends on the ROI and batch size, cluster jobs can use it to
+    shard work deterministically.  Returns JSON of the form:
+
+    {
+        "NumActiveBlocks": 1400,
+        "NumSubvolumes": 3,
+        "Subvolumes": [
+            {"MinPoint": [0, 0, 0], "MaxPoint": [255, 255, 255], "ActiveBlocks": 512},
+            ...
+        ]
+    }
+
+    where points are voxel coordinates with inclusive maximums.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of roi data.
+    n             Number of blocks along each edge of a subvolume.
+`
+
+func init() {
+	roitype := NewDatatype()
+	roitype.DatatypeID = &datastore.DatatypeID{
+		Name:    "roi",
+		Url:     RepoUrl,
+		Version: Version,
+	}
+	datastore.RegisterDatatype(roitype)
+
+	// Need to register types that will be used to fulfill interfaces.
+	gob.Register(&Datatype{})
+	gob.Register(&Data{})
+	gob.Register(&binary.LittleEndian)
+	gob.Register(&binary.BigEndian)
+}
+
+// DefaultBlockSize is the size in voxels of ROI blocks unless configured otherwise.
+var DefaultBlockSize = dvid.Point3d{32, 32, 32}
+
+// Span is a run of blocks along x given as z, y, x0, x1 in block coordinates,
+// including blocks x0 through x1.
+type Span [4]int32
+
+type spansByZYX []Span
+
+func (s spansByZYX) Len() int      { return len(s) }
+func (s spansByZYX) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s spansByZYX) Less(i, j int) bool {
+	for n := 0; n < 3; n++ {
+		if s[i][n] != s[j][n] {
+			return s[i][n] < s[j][n]
+		}
+	}
+	return s[i][3] < s[j][3]
+}
+
+// NormalizeSpans sorts spans and merges those that overlap or touch.
+func NormalizeSpans(spans []Span) ([]Span, error) {
+	sorted := make([]Span, len(spans))
+	copy(sorted, spans)
+	for _, span := range sorted {
+		if span[3] < span[2] {
+			return nil, fmt.Errorf("Bad span %v: x1 must be at least x0", span)
+		}
+	}
+	sort.Sort(spansByZYX(sorted))
+	normalized := []Span{}
+	for _, span := range sorted {
+		last := len(normalized) - 1
+		if last >= 0 && normalized[last][0] == span[0] && normalized[last][1] == span[1] &&
+			int64(span[2]) <= int64(normalized[last][3])+1 {
+			if span[3] > normalized[last][3] {
+				normalized[last][3] = span[3]
+			}
+			continue
+		}
+		normalized = append(normalized, span)
+	}
+	return normalized, nil
+}
+
+// Datatype embeds the datastore's Datatype to create a unique type for roi functions.
+type Datatype struct {
+	datastore.Datatype
+}
+
+// NewDatatype returns a pointer to a new roi Datatype with default values set.
+func NewDatatype() (dtype *Datatype) {
+	dtype = new(Datatype)
+	dtype.Requirements = &storage.Requirements{
+		BulkIniter: false,
+		BulkWriter: false,
+		Batcher:    true,
+	}
+	return
+}
+
+// --- TypeService interface ---
+
+// NewData returns a pointer to new roi data with default values.
+func (dtype *Datatype) NewDataService(id *datastore.DataID, c dvid.Config) (datastore.DataService, error) {
+	basedata, err := datastore.NewDataService(id, dtype, c)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{Data: basedata, BlockSize: DefaultBlockSize}
+	s, found, err := c.GetString("BlockSize")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		pt, err := dvid.StringToPoint(s, ",")
+		if err != nil {
+			return nil, err
+		}
+		blockSize, ok := pt.(dvid.Point3d)
+		if !ok || blockSize[0] <= 0 || blockSize[1] <= 0 || blockSize[2] <= 0 {
+			return nil, fmt.Errorf("Bad ROI block size %q", s)
+		}
+		data.BlockSize = blockSize
+	}
+	return data, nil
+}
+
+func (dtype *Datatype) Help() string {
+	return fmt.Sprintf(HelpMessage)
+}
+
+// Data embeds the datastore's Data and extends it with roi properties.
+type Data struct {
+	*datastore.Data
+
+	// BlockSize is the size in voxels of the blocks making up the ROI.
+	BlockSize dvid.Point3d
+}
+
+// GetByUUID returns a pointer to roi data given a version (UUID) and data name.
+func GetByUUID(uuid dvid.UUID, name dvid.DataString) (*Data, error) {
+	service := server.DatastoreService()
+	if service == nil {
+		return nil, fmt.Errorf("No datastore service established yet!")
+	}
+	source, err := service.DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := source.(*Data)
+	if !ok {
+		return nil, fmt.Errorf("Instance '%s' is not a roi datatype!", name)
+	}
+	return data, nil
+}
+
+// NewData creates new roi data with the given block size in the dataset of the given
+// version, which is how other data derive ROIs.
+func NewData(uuid dvid.UUID, name dvid.DataString, blockSize dvid.Point3d, versioned bool) (*Data, error) {
+	config := dvid.NewConfig()
+	config.SetVersioned(versioned)
+	config.Set("BlockSize", fmt.Sprintf("%d,%d,%d", blockSize[0], blockSize[1], blockSize[2]))
+	if err := server.DatastoreService().NewData(uuid, "roi", name, config); err != nil {
+		return nil, err
+	}
+	return GetByUUID(uuid, name)
+}
+
+// NewSpanKey returns a DataKey for the span starting at a block.  The value of the key is
+// the last x of the span.
+func (d *Data) NewSpanKey(versionID dvid.VersionLocalID, z, y, x0 int32) *datastore.DataKey {
+	return d.DataKey(versionID, dvid.IndexZYX{x0, y, z})
+}
+
+// GetSpans returns the sorted spans of the ROI.
+func (d *Data) GetSpans(uuid dvid.UUID) ([]Span, error) {
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	keyvalues, err := db.GetRange(d.NewSpanKey(versionID, math.MinInt32, math.MinInt32, math.MinInt32),
+		d.NewSpanKey(versionID, math.MaxInt32, math.MaxInt32, math.MaxInt32))
+	if err != nil {
+		return nil, err
+	}
+	spans := make([]Span, 0, len(keyvalues))
+	for _, kv := range keyvalues {
+		index, err := dvid.IndexZYX{}.IndexFromBytes(kv.K.(*datastore.DataKey).Index.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		start := *(index.(*dvid.IndexZYX))
+		if len(kv.V) != 4 {
+			return nil, fmt.Errorf("Bad span value for ROI '%s' at block %s", d.DataName(), start)
+		}
+		spans = append(spans, Span{start[2], start[1], start[0], int32(binary.BigEndian.Uint32(kv.V))})
+	}
+	return spans, nil
+}
+
+// PutSpans replaces the blocks of the ROI with the given spans.
+func (d *Data) PutSpans(uuid dvid.UUID, spans []Span) error {
+	normalized, err := NormalizeSpans(spans)
+	if err != nil {
+		return err
+	}
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return err
+	}
+	mu := d.VersionMutex(versionID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	old, err := d.GetSpans(uuid)
+	if err != nil {
+		return err
+	}
+	db, err := server.OrderedKeyValueDB()
+	if err != nil {
+		return err
+	}
+	batcher, ok := db.(storage.Batcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in %s.PutSpans()", d.DataName())
+	}
+	batch := batcher.NewBatch()
+	for _, span := range old {
+		batch.Delete(d.NewSpanKey(versionID, span[0], span[1], span[2]))
+	}
+	for _, span := range normalized {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(span[3]))
+		batch.Put(d.NewSpanKey(versionID, span[0], span[1], span[2]), value)
+	}
+	return batch.Commit()
+}
+
+// JSONString returns the JSON for this Data's configuration
+func (d *Data) JSONString() (jsonStr string, err error) {
+	m, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// --- DataService interface ---
+
+// DoRPC acts as a switchboard for RPC commands.
+func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+	return d.UnknownCommand(request)
+}
+
+// DoHTTP handles all incoming HTTP requests for this data.
+func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	startTime := time.Now()
+
+	// Allow cross-origin resource sharing.
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	// Break URL request into arguments
+	url := r.URL.Path[len(server.WebAPIPath):]
+	parts := strings.Split(url, "/")
+	if len(parts) < 4 {
+		err := fmt.Errorf("Incomplete API request")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	method := strings.ToLower(r.Method)
+
+	var comment string
+	switch parts[3] {
+	case "help":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, d.Help())
+		return nil
+
+	case "info":
+		jsonStr, err := d.JSONString()
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
+		return nil
+
+	case "roi":
+		switch method {
+		case "get":
+			spans, err := d.GetSpans(uuid)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			m, err := json.Marshal(spans)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(m)
+			comment = fmt.Sprintf("HTTP GET %d spans of ROI '%s'", len(spans), d.DataName())
+		case "post":
+			var spans []Span
+			if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+				server.BadRequest(w, r, fmt.Sprintf("Bad ROI JSON: %s", err.Error()))
+				return err
+			}
+			if err := d.PutSpans(uuid, spans); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			comment = fmt.Sprintf("HTTP POST %d spans to ROI '%s'", len(spans), d.DataName())
+		default:
+			err := fmt.Errorf("Can only handle GET or POST HTTP verbs for 'roi'")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+
+	case "partition":
+		if method != "get" {
+			err := fmt.Errorf("ROI partitions can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		query := r.URL.Query()
+		batchsize, err := strconv.Atoi(query.Get("batchsize"))
+		if err != nil {
+			server.BadRequest(w, r, fmt.Sprintf("Bad batchsize %q", query.Get("batchsize")))
+			return err
+		}
+		partition, err := d.Partition(uuid, int32(batchsize), query.Get("optimized") == "true")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(partition)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		comment = fmt.Sprintf("HTTP GET partition of ROI '%s' into %d subvolumes", d.DataName(), partition.NumSubvolumes)
+
+	default:
+		err := fmt.Errorf("Unrecognized API call '%s' for roi data '%s'.  See API help.",
+			parts[3], d.DataName())
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+
+	dvid.ElapsedTime(dvid.Debug, startTime, comment)
+	return nil
+}
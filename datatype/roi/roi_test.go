@@ -0,0 +1,90 @@
+package roi
+
+import (
+	"testing"
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type DataSuite struct {
+	dir     string
+	service *server.Service
+}
+
+var _ = Suite(&DataSuite{})
+
+// This will setup a new datastore and open it up, keeping the service pointer in
+// the DataSuite.
+func (suite *DataSuite) SetUpSuite(c *C) {
+	// Make a temporary testing directory that will be auto-deleted after testing.
+	suite.dir = c.MkDir()
+
+	// Create a new datastore.
+	err := datastore.Init(suite.dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+
+	// Open the datastore
+	suite.service, err = server.OpenDatastore(suite.dir)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TearDownSuite(c *C) {
+	suite.service.Shutdown()
+}
+
+func (suite *DataSuite) TestSpans(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(suite.service.NewData(root, "roi", "region", dvid.NewConfig()), IsNil)
+	region, err := GetByUUID(root, "region")
+	c.Assert(err, IsNil)
+
+	c.Assert(region.PutSpans(root, []Span{{1, 0, 0, 3}, {0, 0, 4, 6}, {0, 0, 0, 3}, {0, -1, 2, 2}}), IsNil)
+	spans, err := region.GetSpans(root)
+	c.Assert(err, IsNil)
+	c.Assert(spans, DeepEquals, []Span{{0, -1, 2, 2}, {0, 0, 0, 6}, {1, 0, 0, 3}})
+
+	// Spans are replaced, not added.
+	c.Assert(region.PutSpans(root, []Span{{2, 2, 2, 2}}), IsNil)
+	spans, err = region.GetSpans(root)
+	c.Assert(err, IsNil)
+	c.Assert(spans, DeepEquals, []Span{{2, 2, 2, 2}})
+
+	c.Assert(region.PutSpans(root, []Span{{0, 0, 3, 2}}), NotNil)
+}
+
+func (suite *DataSuite) TestPartition(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "10,10,10")
+	c.Assert(suite.service.NewData(root, "roi", "region", config), IsNil)
+	region, err := GetByUUID(root, "region")
+	c.Assert(err, IsNil)
+
+	// A 6 block span crossing a batch boundary in one row, plus one block in a higher layer.
+	c.Assert(region.PutSpans(root, []Span{{0, 1, 2, 7}, {5, 0, 0, 0}}), IsNil)
+	partition, err := region.Partition(root, 4, false)
+	c.Assert(err, IsNil)
+	c.Assert(partition.NumActiveBlocks, Equals, 7)
+	c.Assert(partition.NumSubvolumes, Equals, 3)
+	c.Assert(partition.Subvolumes, DeepEquals, []Subvolume{
+		{dvid.Point3d{0, 0, 0}, dvid.Point3d{39, 39, 39}, 2},
+		{dvid.Point3d{40, 0, 0}, dvid.Point3d{79, 39, 39}, 4},
+		{dvid.Point3d{0, 0, 40}, dvid.Point3d{39, 39, 79}, 1},
+	})
+
+	partition, err = region.Partition(root, 4, true)
+	c.Assert(err, IsNil)
+	c.Assert(partition.Subvolumes[0], Equals, Subvolume{dvid.Point3d{20, 10, 0}, dvid.Point3d{39, 19, 9}, 2})
+	c.Assert(partition.Subvolumes[2], Equals, Subvolume{dvid.Point3d{0, 0, 50}, dvid.Point3d{9, 9, 59}, 1})
+
+	_, err = region.Partition(root, 0, false)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,259 @@
+/*
+	This file samples cutouts warped by an affine transform, e.g., for alignment QC and
+	registration pipelines that need transformed regions without the source blocks.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Affine is a 3x4 affine matrix in row-major order mapping a point (x, y, z) to
+// (m[0]x + m[1]y + m[2]z + m[3], m[4]x + m[5]y + m[6]z + m[7], m[8]x + m[9]y + m[10]z + m[11]).
+type Affine [12]float64
+
+// Transform returns the affine transform of a point.
+func (m Affine) Transform(x, y, z float64) (float64, float64, float64) {
+	return m[0]*x + m[1]*y + m[2]*z + m[3],
+		m[4]*x + m[5]*y + m[6]*z + m[7],
+		m[8]*x + m[9]*y + m[10]*z + m[11]
+}
+
+// ParseAffine parses 12 numbers separated by sep in row-major order.
+func ParseAffine(s, sep string) (Affine, error) {
+	var m Affine
+	elems := strings.Split(s, sep)
+	if len(elems) != len(m) {
+		return m, fmt.Errorf("Affine matrix must have 12 elements, not %d", len(elems))
+	}
+	for n, elem := range elems {
+		v, err := strconv.ParseFloat(elem, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return m, fmt.Errorf("Bad affine matrix element %q", elem)
+		}
+		m[n] = v
+	}
+	return m, nil
+}
+
+// check returns an error if the matrix has non-finite elements or can't be inverted,
+// since a singular transform collapses the output onto a plane or line of the data.
+func (m Affine) check() error {
+	for _, v := range m {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("Affine matrix has non-finite element %g", v)
+		}
+	}
+	det := m[0]*(m[5]*m[10]-m[6]*m[9]) - m[1]*(m[4]*m[10]-m[6]*m[8]) + m[2]*(m[4]*m[9]-m[5]*m[8])
+	if math.Abs(det) < 1e-9 || math.IsInf(det, 0) {
+		return fmt.Errorf("Affine matrix is singular")
+	}
+	return nil
+}
+
+// sourceBox returns the smallest subvolume holding every voxel used to sample an
+// output of the given size, or an error if that subvolume exceeds MaxVoxelsRequest.
+func (m Affine) sourceBox(size dvid.Point3d) (*dvid.Subvolume, error) {
+	min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for corner := 0; corner < 8; corner++ {
+		var pt [3]float64
+		for dim := uint(0); dim < 3; dim++ {
+			if corner&(1<<dim) != 0 {
+				pt[dim] = float64(size[dim] - 1)
+			}
+		}
+		x, y, z := m.Transform(pt[0], pt[1], pt[2])
+		for dim, v := range [3]float64{x, y, z} {
+			min[dim] = math.Min(min[dim], v)
+			max[dim] = math.Max(max[dim], v)
+		}
+	}
+	var offset, boxSize dvid.Point3d
+	numVoxels := 1.0
+	for dim := 0; dim < 3; dim++ {
+		lo, hi := math.Floor(min[dim]), math.Floor(max[dim])+2
+		numVoxels *= hi - lo
+		if lo < math.MinInt32 || hi > math.MaxInt32 || numVoxels > MaxVoxelsRequest {
+			return nil, fmt.Errorf("Affine transform samples more than %d voxels", MaxVoxelsRequest)
+		}
+		offset[dim] = int32(lo)
+		boxSize[dim] = int32(hi - lo)
+	}
+	return dvid.NewSubvolume(offset, boxSize), nil
+}
+
+// GetAffine returns voxels of the given size where voxel (x, y, z) is sampled from the
+// data at the affine transform of (x, y, z).  Sampling uses trilinear interpolation
+// unless nearest is true, in which case the nearest voxel is used, as required for
+// labels.  Samples outside the data are 0.
+func GetAffine(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, m Affine,
+	size dvid.Point3d, nearest bool) ([]byte, error) {
+
+	numVoxels := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		if size[dim] <= 0 {
+			return nil, fmt.Errorf("Affine cutout size must be positive, not %s", size)
+		}
+		numVoxels *= int64(size[dim])
+		if numVoxels > MaxVoxelsRequest {
+			return nil, fmt.Errorf("Affine cutout size %s exceeds %d voxels", size, MaxVoxelsRequest)
+		}
+	}
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	box, err := m.sourceBox(size)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerVoxel := int64(props.Values.BytesPerElement())
+
+	// Admit the source box and the output together so concurrent cutouts can't each
+	// hold half of what they need.
+	release, err := server.AdmitMemory(ctx, (box.NumVoxels()*RequestMemoryFactor+numVoxels)*bytesPerVoxel)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	e, err := i.NewExtHandler(box, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dvid.PutBuffer(e.Data())
+	src, err := GetVolume(ctx, uuid, i, e)
+	if err != nil {
+		return nil, err
+	}
+
+	start := box.StartPoint().(dvid.Point3d)
+	boxSize := box.Size().(dvid.Point3d)
+	valueOffsets := make([]int64, len(props.Values))
+	for n := 1; n < len(props.Values); n++ {
+		valueOffsets[n] = valueOffsets[n-1] + int64(props.Values.ValueBytes(n-1))
+	}
+	// voxelIndex returns the byte offset of a voxel in src or -1 if it's outside.
+	voxelIndex := func(x, y, z int64) int64 {
+		x, y, z = x-int64(start[0]), y-int64(start[1]), z-int64(start[2])
+		if x < 0 || y < 0 || z < 0 || x >= int64(boxSize[0]) || y >= int64(boxSize[1]) || z >= int64(boxSize[2]) {
+			return -1
+		}
+		return ((z*int64(boxSize[1])+y)*int64(boxSize[0]) + x) * bytesPerVoxel
+	}
+
+	out := make([]byte, numVoxels*bytesPerVoxel)
+	var pos int64
+	for z := int32(0); z < size[2]; z++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for y := int32(0); y < size[1]; y++ {
+			for x := int32(0); x < size[0]; x++ {
+				sx, sy, sz := m.Transform(float64(x), float64(y), float64(z))
+				if nearest {
+					n := voxelIndex(int64(math.Floor(sx+0.5)), int64(math.Floor(sy+0.5)), int64(math.Floor(sz+0.5)))
+					if n >= 0 {
+						copy(out[pos:pos+bytesPerVoxel], src[n:n+bytesPerVoxel])
+					}
+					pos += bytesPerVoxel
+					continue
+				}
+				fx, fy, fz := math.Floor(sx), math.Floor(sy), math.Floor(sz)
+				x0, y0, z0 := int64(fx), int64(fy), int64(fz)
+				wx, wy, wz := sx-fx, sy-fy, sz-fz
+				for v, value := range props.Values {
+					var sum float64
+					for corner := 0; corner < 8; corner++ {
+						weight := 1.0
+						cx, cy, cz := x0, y0, z0
+						if corner&1 != 0 {
+							cx, weight = cx+1, weight*wx
+						} else {
+							weight *= 1 - wx
+						}
+						if corner&2 != 0 {
+							cy, weight = cy+1, weight*wy
+						} else {
+							weight *= 1 - wy
+						}
+						if corner&4 != 0 {
+							cz, weight = cz+1, weight*wz
+						} else {
+							weight *= 1 - wz
+						}
+						if weight == 0 {
+							continue
+						}
+						if n := voxelIndex(cx, cy, cz); n >= 0 {
+							sum += weight * ReadValue(src[n+valueOffsets[v]:], value.T, props.ByteOrder)
+						}
+					}
+					WriteValue(out[pos+valueOffsets[v]:], value.T, props.ByteOrder, sum)
+				}
+				pos += bytesPerVoxel
+			}
+		}
+	}
+	return out, nil
+}
+
+// ServeAffine handles requests for affine-warped cutouts in the form
+// GET <api URL>/node/<UUID>/<data name>/affine/<size>/<matrix>[/<format>].
+func ServeAffine(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Affine cutouts can only be retrieved with GET")
+	}
+	if len(parts) < 6 {
+		return fmt.Errorf("'affine' must be followed by size/matrix")
+	}
+	sizePt, err := dvid.StringToPoint(parts[4], "_")
+	if err != nil {
+		return err
+	}
+	size, ok := sizePt.(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Affine cutouts require a 3d size")
+	}
+	m, err := ParseAffine(parts[5], "_")
+	if err != nil {
+		return err
+	}
+	var nearest bool
+	switch interp := r.URL.Query().Get("interpolation"); interp {
+	case "", "linear":
+	case "nearest":
+		nearest = true
+	default:
+		return fmt.Errorf("Unknown interpolation %q.  Use 'linear' or 'nearest'.", interp)
+	}
+	formatStr := "raw"
+	if len(parts) >= 7 && parts[6] != "" {
+		formatStr = parts[6]
+	}
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size)
+	if err := CheckLimits(i, subvol); err != nil {
+		return err
+	}
+
+	data, err := GetAffine(r.Context(), uuid, i, props, m, size, nearest)
+	if err != nil {
+		return err
+	}
+	e, err := i.NewExtHandler(subvol, data)
+	if err != nil {
+		return err
+	}
+	return props.WriteArrayHttp(w, e, formatStr)
+}
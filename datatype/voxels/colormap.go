@@ -0,0 +1,146 @@
+/*
+	This file maps labels to colors for rendering label slices and overlays, so renderings
+	are consistent across sessions and tools.
+*/
+
+package voxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultColormap is the name of the colormap that uses only hashed LabelColor colors
+// unless a colormap with that name has been stored.
+const DefaultColormap = "default"
+
+// Colormap maps labels to colors.  Labels not in the map get their LabelColor.
+type Colormap map[uint64]color.NRGBA
+
+// colormapValues are the values of images rendered with a colormap.
+var colormapValues = dvid.DataValues{
+	{T: dvid.T_uint8, Label: "red"},
+	{T: dvid.T_uint8, Label: "green"},
+	{T: dvid.T_uint8, Label: "blue"},
+	{T: dvid.T_uint8, Label: "alpha"},
+}
+
+// colormapper is implemented by label data with named colormaps, e.g., labels64.
+type colormapper interface {
+	Colormap(name string) (Colormap, error)
+}
+
+// GetColormap returns the named colormap of label data, where DefaultColormap is
+// available for any data.
+func GetColormap(labels IntHandler, name string) (Colormap, error) {
+	if cm, ok := labels.(colormapper); ok {
+		return cm.Colormap(name)
+	}
+	if name == DefaultColormap {
+		return Colormap{}, nil
+	}
+	return nil, fmt.Errorf("Data '%s' has no colormap %q", labels.DataID().DataName(), name)
+}
+
+// Color returns the color of a label.
+func (cm Colormap) Color(label uint64) color.NRGBA {
+	if c, found := cm[label]; found {
+		return c
+	}
+	return LabelColor(label)
+}
+
+// parseColor parses colors of the form "#rrggbb" or "#rrggbbaa".
+func parseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 || !strings.HasPrefix(s, "#") {
+		return color.NRGBA{}, fmt.Errorf("Bad color %q: must be \"#rrggbb\" or \"#rrggbbaa\"", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// Edit sets the colors of labels given as a JSON object of decimal labels to colors
+// "#rrggbb" or "#rrggbbaa".  Labels with null colors are removed from the colormap.
+func (cm Colormap) Edit(edits map[string]*string) error {
+	for labelStr, colorStr := range edits {
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad label %q in colormap", labelStr)
+		}
+		if colorStr == nil {
+			delete(cm, label)
+			continue
+		}
+		c, err := parseColor(*colorStr)
+		if err != nil {
+			return err
+		}
+		cm[label] = c
+	}
+	return nil
+}
+
+// MarshalJSON returns the colormap as a JSON object of decimal labels to "#rrggbbaa".
+func (cm Colormap) MarshalJSON() ([]byte, error) {
+	m := make(map[string]string, len(cm))
+	for label, c := range cm {
+		m[strconv.FormatUint(label, 10)] = fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON sets the colormap from a JSON object of decimal labels to colors.
+func (cm *Colormap) UnmarshalJSON(b []byte) error {
+	var edits map[string]*string
+	if err := json.Unmarshal(b, &edits); err != nil {
+		return err
+	}
+	*cm = Colormap{}
+	return cm.Edit(edits)
+}
+
+// Render returns an image of a 2d slice of labels colored by the colormap.  Label 0 is
+// transparent unless it's in the colormap.
+func (cm Colormap) Render(e ExtHandler) (*dvid.Image, error) {
+	values := e.Values()
+	if len(values) != 1 {
+		return nil, fmt.Errorf("Only data with a single label per voxel can be colored")
+	}
+	switch values[0].T {
+	case dvid.T_uint8, dvid.T_uint16, dvid.T_uint32, dvid.T_uint64:
+	default:
+		return nil, fmt.Errorf("Only unsigned integer labels can be colored")
+	}
+	size := e.Size()
+	if size.NumDims() != 2 {
+		return nil, fmt.Errorf("Only 2d slices of labels can be colored")
+	}
+	width, height := size.Value(0), size.Value(1)
+	bytesPerVoxel := int32(values.BytesPerElement())
+	data, stride, byteOrder := e.Data(), e.Stride(), e.ByteOrder()
+	if int64(len(data)) < int64(height-1)*int64(stride)+int64(width*bytesPerVoxel) {
+		return nil, fmt.Errorf("Voxels %s has insufficient data to color", e)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			label := readLabel(data[y*stride+x*bytesPerVoxel:], values[0].T, byteOrder)
+			img.SetNRGBA(int(x), int(y), cm.Color(label))
+		}
+	}
+	rendered := new(dvid.Image)
+	if err := rendered.Set(img, colormapValues, false); err != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
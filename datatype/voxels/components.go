@@ -0,0 +1,353 @@
+/*
+	This file labels the 6-connected components of thresholded voxels.  Blocks are labeled
+	one at a time and components touching across block faces are merged with a global
+	union-find, so memory use is bounded by a layer of blocks rather than the volume.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// unionFind is a disjoint set forest over labels, where each entry is the parent of a
+// label.  Label 0 is reserved for background.
+type unionFind []uint64
+
+func newUnionFind() unionFind {
+	return unionFind{0}
+}
+
+// add adds n labels, returning the label preceding the first new one.
+func (uf *unionFind) add(n uint64) (base uint64) {
+	base = uint64(len(*uf)) - 1
+	for i := uint64(1); i <= n; i++ {
+		*uf = append(*uf, base+i)
+	}
+	return base
+}
+
+func (uf unionFind) find(label uint64) uint64 {
+	for uf[label] != label {
+		uf[label] = uf[uf[label]]
+		label = uf[label]
+	}
+	return label
+}
+
+// union merges the sets of two labels, keeping the smaller root.
+func (uf unionFind) union(a, b uint64) {
+	ra, rb := uf.find(a), uf.find(b)
+	switch {
+	case ra < rb:
+		uf[rb] = ra
+	case rb < ra:
+		uf[ra] = rb
+	}
+}
+
+// labelBlock labels the 6-connected components of a mask with x varying fastest.
+// Labels run from 1 to count in order of first appearance, so the result only depends
+// on the mask.
+func labelBlock(mask []bool, size dvid.Point3d) (labels []uint64, count uint64) {
+	nx, nxy := int(size[0]), int(size[0]*size[1])
+	labels = make([]uint64, len(mask))
+	uf := newUnionFind()
+	for i, inside := range mask {
+		if !inside {
+			continue
+		}
+		neighbors := [3]int{-1, -1, -1}
+		if i%nx > 0 {
+			neighbors[0] = i - 1
+		}
+		if (i%nxy)/nx > 0 {
+			neighbors[1] = i - nx
+		}
+		if i >= nxy {
+			neighbors[2] = i - nxy
+		}
+		var label uint64
+		for _, neighbor := range neighbors {
+			if neighbor < 0 || labels[neighbor] == 0 {
+				continue
+			}
+			if label == 0 {
+				label = labels[neighbor]
+			} else {
+				uf.union(label, labels[neighbor])
+			}
+		}
+		if label == 0 {
+			label = uf.add(1) + 1
+		}
+		labels[i] = label
+	}
+	compact := make(map[uint64]uint64)
+	for i, label := range labels {
+		if label == 0 {
+			continue
+		}
+		root := uf.find(label)
+		final, found := compact[root]
+		if !found {
+			count++
+			final = count
+			compact[root] = final
+		}
+		labels[i] = final
+	}
+	return labels, count
+}
+
+// blockFaces holds the labels on the high x, y, and z faces of a block, which are
+// compared with the low faces of the next blocks.
+type blockFaces struct {
+	x, y, z []uint64
+}
+
+// ComponentsWriter receives the labels of a block-aligned subvolume with x varying fastest.
+type ComponentsWriter func(subvol *dvid.Subvolume, labels []uint64) error
+
+// ConnectedComponents labels the 6-connected components of voxels within the data
+// extents whose values are at or above threshold.  Labels start at 1, background is 0,
+// and the labels of each block containing a component are passed to write.  If progress
+// is not nil, it is called with the fraction of work done.  The number of components is
+// returned.
+func ConnectedComponents(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	threshold float64, write ComponentsWriter, progress func(float32)) (uint64, error) {
+
+	if len(props.Values) != 1 {
+		return 0, fmt.Errorf("Connected components require single channel voxels")
+	}
+	blockSize, ok := props.BlockSize.(dvid.Point3d)
+	if !ok {
+		return 0, fmt.Errorf("Connected components require 3d blocks")
+	}
+	if props.MinPoint == nil || props.MaxPoint == nil {
+		return 0, nil
+	}
+	var minBlock, maxBlock dvid.Point3d
+	for dim := uint8(0); dim < 3; dim++ {
+		minBlock[dim] = floorDiv(props.MinPoint.Value(dim), blockSize[dim])
+		maxBlock[dim] = floorDiv(props.MaxPoint.Value(dim), blockSize[dim])
+	}
+	numBlocks := maxBlock.Sub(minBlock).AddScalar(1).Prod()
+	bytesPerVoxel := int(props.Values.BytesPerElement())
+	t := props.Values[0].T
+
+	// labelAt returns the local labels of the block at the given block coordinate.
+	labelAt := func(block dvid.Point3d) ([]uint64, uint64, *dvid.Subvolume, error) {
+		offset := dvid.Point3d{block[0] * blockSize[0], block[1] * blockSize[1], block[2] * blockSize[2]}
+		subvol := dvid.NewSubvolume(offset, blockSize)
+		e, err := i.NewExtHandler(subvol, nil)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		defer dvid.PutBuffer(e.Data())
+		data, err := GetVolume(ctx, uuid, i, e)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		mask := make([]bool, blockSize.Prod())
+		for n := range mask {
+			mask[n] = ReadValue(data[n*bytesPerVoxel:], t, props.ByteOrder) >= threshold
+		}
+		labels, count := labelBlock(mask, blockSize)
+		return labels, count, subvol, nil
+	}
+
+	// Label each block and merge components across faces with preceding blocks.
+	nx, ny, nz := int(blockSize[0]), int(blockSize[1]), int(blockSize[2])
+	uf := newUnionFind()
+	bases := make(map[dvid.Point3d]uint64)
+	faces := make(map[dvid.Point3d]*blockFaces)
+	merge := func(face []uint64, labels []uint64, base uint64, index func(a, b int) int, na, nb int) {
+		for b := 0; b < nb; b++ {
+			for a := 0; a < na; a++ {
+				local := labels[index(a, b)]
+				if local != 0 && face[b*na+a] != 0 {
+					uf.union(base+local, face[b*na+a])
+				}
+			}
+		}
+	}
+	var done int64
+	var block dvid.Point3d
+	for block[2] = minBlock[2]; block[2] <= maxBlock[2]; block[2]++ {
+		for block[1] = minBlock[1]; block[1] <= maxBlock[1]; block[1]++ {
+			for block[0] = minBlock[0]; block[0] <= maxBlock[0]; block[0]++ {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				labels, count, _, err := labelAt(block)
+				if err != nil {
+					return 0, err
+				}
+				base := uf.add(count)
+				bases[block] = base
+				global := func(n int) uint64 {
+					if labels[n] == 0 {
+						return 0
+					}
+					return base + labels[n]
+				}
+
+				// Merge with the high faces of the preceding x, y, and z blocks.
+				if f, found := faces[block.Sub(dvid.Point3d{1, 0, 0}).(dvid.Point3d)]; found {
+					merge(f.x, labels, base, func(y, z int) int { return (z*ny + y) * nx }, ny, nz)
+					f.x = nil
+				}
+				if f, found := faces[block.Sub(dvid.Point3d{0, 1, 0}).(dvid.Point3d)]; found {
+					merge(f.y, labels, base, func(x, z int) int { return z*ny*nx + x }, nx, nz)
+					f.y = nil
+				}
+				if f, found := faces[block.Sub(dvid.Point3d{0, 0, 1}).(dvid.Point3d)]; found {
+					merge(f.z, labels, base, func(x, y int) int { return y*nx + x }, nx, ny)
+					delete(faces, block.Sub(dvid.Point3d{0, 0, 1}).(dvid.Point3d))
+				}
+
+				f := &blockFaces{
+					x: make([]uint64, ny*nz),
+					y: make([]uint64, nx*nz),
+					z: make([]uint64, nx*ny),
+				}
+				for z := 0; z < nz; z++ {
+					for y := 0; y < ny; y++ {
+						f.x[z*ny+y] = global((z*ny+y)*nx + nx - 1)
+					}
+					for x := 0; x < nx; x++ {
+						f.y[z*nx+x] = global((z*ny+ny-1)*nx + x)
+					}
+				}
+				for y := 0; y < ny; y++ {
+					for x := 0; x < nx; x++ {
+						f.z[y*nx+x] = global(((nz-1)*ny+y)*nx + x)
+					}
+				}
+				faces[block] = f
+
+				done++
+				if progress != nil {
+					progress(0.5 * float32(done) / float32(numBlocks))
+				}
+			}
+		}
+	}
+
+	// Relabel each block with the merged components, numbered in order of appearance.
+	final := make(map[uint64]uint64)
+	var numComponents uint64
+	done = 0
+	for block[2] = minBlock[2]; block[2] <= maxBlock[2]; block[2]++ {
+		for block[1] = minBlock[1]; block[1] <= maxBlock[1]; block[1]++ {
+			for block[0] = minBlock[0]; block[0] <= maxBlock[0]; block[0]++ {
+				if err := ctx.Err(); err != nil {
+					return 0, err
+				}
+				done++
+				if progress != nil {
+					progress(0.5 + 0.5*float32(done)/float32(numBlocks))
+				}
+				labels, count, subvol, err := labelAt(block)
+				if err != nil {
+					return 0, err
+				}
+				if count == 0 {
+					continue
+				}
+				base := bases[block]
+				for n, local := range labels {
+					if local == 0 {
+						continue
+					}
+					root := uf.find(base + local)
+					label, found := final[root]
+					if !found {
+						numComponents++
+						label = numComponents
+						final[root] = label
+					}
+					labels[n] = label
+				}
+				if err := write(subvol, labels); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return numComponents, nil
+}
+
+// componentsCommand handles the "components <labels64 name>" RPC command, which starts a
+// job that writes the connected components of this data into new labels64 data.
+func (d *Data) componentsCommand(request datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataName, cmdStr, destName string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &destName)
+	if destName == "" {
+		return fmt.Errorf("Poorly formatted components command.  See command-line help.")
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	threshold := 1.0
+	thresholdStr, found, err := request.Settings().GetString("threshold")
+	if err != nil {
+		return err
+	}
+	if found {
+		if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil {
+			return fmt.Errorf("Bad threshold %q: %s", thresholdStr, err.Error())
+		}
+	}
+	if len(d.Properties.Values) != 1 {
+		return fmt.Errorf("Connected components require single channel voxels")
+	}
+	dest, err := d.newDerivedData(uuid, "labels64", destName)
+	if err != nil {
+		return err
+	}
+
+	ctx := request.Context()
+	description := fmt.Sprintf("Connected components of %q at threshold %g into %q", d.DataName(), threshold, destName)
+	job := server.NewJob(description)
+	go func() {
+		write := func(subvol *dvid.Subvolume, labels []uint64) error {
+			e, err := dest.NewExtHandler(subvol, nil)
+			if err != nil {
+				return err
+			}
+			defer dvid.PutBuffer(e.Data())
+			data, byteOrder := e.Data(), e.ByteOrder()
+			for n, label := range labels {
+				byteOrder.PutUint64(data[n*8:], label)
+			}
+			return PutVoxels(ctx, uuid, dest, e)
+		}
+		numComponents, err := ConnectedComponents(ctx, uuid, d, &(d.Properties), threshold, write, job.SetProgress)
+		if err == nil {
+			dvid.Log(dvid.Normal, "Found %d connected components of %q in %q\n", numComponents, d.DataName(), destName)
+			if indexer, ok := dest.(interface {
+				ProcessSpatially(dvid.UUID)
+			}); ok {
+				indexer.ProcessSpatially(uuid)
+			} else {
+				err = server.DatastoreService().SaveDataset(uuid)
+			}
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to write connected components into %q.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, destName, job.ID)
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+	This file enhances the contrast of 2d slices on read, so viewers of raw EM with poor
+	contrast get usable images without a preprocessing pass.
+*/
+
+package voxels
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Contrast enhancement modes for 2d slices.
+const (
+	// ContrastEqualize equalizes the histogram of the whole slice.
+	ContrastEqualize = "equalize"
+
+	// ContrastCLAHE applies contrast limited adaptive histogram equalization, which
+	// equalizes tiles of the slice separately and blends them.
+	ContrastCLAHE = "clahe"
+)
+
+const (
+	// DefaultCLAHETileSize is the default width and height in voxels of CLAHE tiles.
+	DefaultCLAHETileSize = 64
+
+	// DefaultCLAHEClipLimit is the default CLAHE clip limit as a multiple of the mean
+	// histogram bin count of a tile.
+	DefaultCLAHEClipLimit = 2.0
+)
+
+// Contrast describes the contrast enhancement of a 2d slice.
+type Contrast struct {
+	Mode      string
+	TileSize  int32
+	ClipLimit float64
+}
+
+// ParseContrast returns the contrast enhancement given by the "contrast", "tilesize",
+// and "cliplimit" query strings, or nil if no enhancement is requested.
+func ParseContrast(query url.Values) (*Contrast, error) {
+	c := &Contrast{
+		Mode:      query.Get("contrast"),
+		TileSize:  DefaultCLAHETileSize,
+		ClipLimit: DefaultCLAHEClipLimit,
+	}
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case ContrastEqualize, ContrastCLAHE:
+	default:
+		return nil, fmt.Errorf("Unknown contrast %q.  Use %q or %q.", c.Mode, ContrastEqualize, ContrastCLAHE)
+	}
+	if s := query.Get("tilesize"); s != "" {
+		tileSize, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || tileSize < 2 {
+			return nil, fmt.Errorf("Bad tilesize %q: must be an integer of at least 2", s)
+		}
+		c.TileSize = int32(tileSize)
+	}
+	if s := query.Get("cliplimit"); s != "" {
+		clipLimit, err := strconv.ParseFloat(s, 64)
+		if err != nil || clipLimit < 1 {
+			return nil, fmt.Errorf("Bad cliplimit %q: must be a number of at least 1", s)
+		}
+		c.ClipLimit = clipLimit
+	}
+	return c, nil
+}
+
+// Apply enhances the contrast of a 2d slice of uint8 voxels in place.
+func (c *Contrast) Apply(e ExtHandler) error {
+	values := e.Values()
+	if len(values) != 1 || values[0].T != dvid.T_uint8 {
+		return fmt.Errorf("Contrast enhancement is only available for uint8 voxels")
+	}
+	size := e.Size()
+	if size.NumDims() != 2 {
+		return fmt.Errorf("Contrast enhancement is only available for 2d slices")
+	}
+	width, height := size.Value(0), size.Value(1)
+	stride := e.Stride()
+	data := e.Data()
+	if int64(len(data)) < int64(height-1)*int64(stride)+int64(width) {
+		return fmt.Errorf("Voxels %s has insufficient data for contrast enhancement", e)
+	}
+
+	switch c.Mode {
+	case ContrastEqualize:
+		lut := equalizeLUT(data, stride, 0, 0, width, height, 0)
+		for y := int32(0); y < height; y++ {
+			row := data[y*stride : y*stride+width]
+			for x, v := range row {
+				row[x] = lut[v]
+			}
+		}
+	case ContrastCLAHE:
+		c.clahe(data, stride, width, height)
+	default:
+		return fmt.Errorf("Unknown contrast %q", c.Mode)
+	}
+	return nil
+}
+
+// equalizeLUT returns the mapping of values that equalizes the histogram of a region of
+// a slice.  If clip is positive, histogram bins are limited to clip counts and the
+// excess is spread over all bins.
+func equalizeLUT(data []byte, stride, x0, y0, width, height int32, clip float64) [256]byte {
+	var hist [256]float64
+	for y := y0; y < y0+height; y++ {
+		for _, v := range data[y*stride+x0 : y*stride+x0+width] {
+			hist[v]++
+		}
+	}
+	if clip > 0 {
+		var excess float64
+		for v := range hist {
+			if hist[v] > clip {
+				excess += hist[v] - clip
+				hist[v] = clip
+			}
+		}
+		for v := range hist {
+			hist[v] += excess / 256
+		}
+	}
+	var lut [256]byte
+	var cdf, cdfMin float64
+	total := float64(width) * float64(height)
+	for v := range hist {
+		if cdf == 0 && hist[v] > 0 {
+			cdfMin = hist[v]
+		}
+		cdf += hist[v]
+		if total > cdfMin {
+			lut[v] = byte(math.Floor(math.Max(0, cdf-cdfMin)/(total-cdfMin)*255 + 0.5))
+		} else {
+			lut[v] = byte(v)
+		}
+	}
+	return lut
+}
+
+// clahe equalizes tiles of the slice, limiting contrast by clipping tile histograms,
+// then maps each voxel by bilinear interpolation of the mappings of the nearest tiles.
+func (c *Contrast) clahe(data []byte, stride, width, height int32) {
+	tilesX := (width + c.TileSize - 1) / c.TileSize
+	tilesY := (height + c.TileSize - 1) / c.TileSize
+	luts := make([][256]byte, tilesX*tilesY)
+	for ty := int32(0); ty < tilesY; ty++ {
+		for tx := int32(0); tx < tilesX; tx++ {
+			x0, y0 := tx*c.TileSize, ty*c.TileSize
+			w, h := c.TileSize, c.TileSize
+			if x0+w > width {
+				w = width - x0
+			}
+			if y0+h > height {
+				h = height - y0
+			}
+			clip := c.ClipLimit * float64(w) * float64(h) / 256
+			luts[ty*tilesX+tx] = equalizeLUT(data, stride, x0, y0, w, h, clip)
+		}
+	}
+
+	// tilePos returns the tiles on either side of a coordinate and the weight of the
+	// second tile, measured from tile centers.
+	tilePos := func(v, numTiles int32) (int32, int32, float64) {
+		f := (float64(v)+0.5)/float64(c.TileSize) - 0.5
+		if f <= 0 {
+			return 0, 0, 0
+		}
+		t0 := int32(f)
+		if t0 >= numTiles-1 {
+			return numTiles - 1, numTiles - 1, 0
+		}
+		return t0, t0 + 1, f - float64(t0)
+	}
+	for y := int32(0); y < height; y++ {
+		ty0, ty1, wy := tilePos(y, tilesY)
+		row := data[y*stride : y*stride+width]
+		for x, v := range row {
+			tx0, tx1, wx := tilePos(int32(x), tilesX)
+			top := (1-wx)*float64(luts[ty0*tilesX+tx0][v]) + wx*float64(luts[ty0*tilesX+tx1][v])
+			bottom := (1-wx)*float64(luts[ty1*tilesX+tx0][v]) + wx*float64(luts[ty1*tilesX+tx1][v])
+			row[x] = byte(math.Floor((1-wy)*top + wy*bottom + 0.5))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+	This file copies regions of voxels between data instances and versions within the
+	server, e.g., to patch a bad region with voxels from an earlier version.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// copyable returns an error if voxels of src can't be stored in dst.
+func copyable(src, dst IntHandler) error {
+	if src.DatatypeName() != dst.DatatypeName() {
+		return fmt.Errorf("Can't copy %s data '%s' into %s data '%s'", src.DatatypeName(),
+			src.DataID().DataName(), dst.DatatypeName(), dst.DataID().DataName())
+	}
+	srcValues, dstValues := src.Values(), dst.Values()
+	if len(srcValues) != len(dstValues) {
+		return fmt.Errorf("Can't copy %d-channel data into %d-channel data", len(srcValues), len(dstValues))
+	}
+	for n := range srcValues {
+		if srcValues[n].T != dstValues[n].T {
+			return fmt.Errorf("Can't copy data '%s' into data '%s' with different voxel values",
+				src.DataID().DataName(), dst.DataID().DataName())
+		}
+	}
+	return nil
+}
+
+// CopyRegion copies the subvolume of src at srcUUID into dst at uuid.  The subvolume is
+// copied in rows of blocks aligned to the blocks of dst, so only blocks on the faces of
+// the subvolume need to be merged with voxels already in dst.  If progress is not nil, it
+// is called with the fraction of rows copied.
+func CopyRegion(ctx context.Context, uuid dvid.UUID, dst IntHandler, srcUUID dvid.UUID, src IntHandler,
+	subvol *dvid.Subvolume, progress func(float32)) error {
+
+	if err := copyable(src, dst); err != nil {
+		return err
+	}
+	blockSize, ok := dst.BlockSize().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Data '%s' must have 3d blocks", dst.DataID().DataName())
+	}
+	start, ok1 := subvol.StartPoint().(dvid.Point3d)
+	end, ok2 := subvol.EndPoint().(dvid.Point3d)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("Copied regions must be 3d")
+	}
+
+	// Rows span the full x extent and are cut at block boundaries along y and z.
+	type row struct{ y0, y1, z0, z1 int32 }
+	var rows []row
+	for z0 := start[2]; z0 <= end[2]; {
+		z1 := (floorDiv(z0, blockSize[2])+1)*blockSize[2] - 1
+		if z1 > end[2] {
+			z1 = end[2]
+		}
+		for y0 := start[1]; y0 <= end[1]; {
+			y1 := (floorDiv(y0, blockSize[1])+1)*blockSize[1] - 1
+			if y1 > end[1] {
+				y1 = end[1]
+			}
+			rows = append(rows, row{y0, y1, z0, z1})
+			y0 = y1 + 1
+		}
+		z0 = z1 + 1
+	}
+
+	for n, r := range rows {
+		offset := dvid.Point3d{start[0], r.y0, r.z0}
+		size := dvid.Point3d{end[0] - start[0] + 1, r.y1 - r.y0 + 1, r.z1 - r.z0 + 1}
+		rowVol := dvid.NewSubvolume(offset, size)
+		srcExt, err := src.NewExtHandler(rowVol, nil)
+		if err != nil {
+			return err
+		}
+		data, err := GetVolume(ctx, srcUUID, src, srcExt)
+		if err != nil {
+			dvid.PutBuffer(srcExt.Data())
+			return err
+		}
+		dstExt, err := dst.NewExtHandler(rowVol, data)
+		if err == nil {
+			err = PutVoxels(ctx, uuid, dst, dstExt)
+		}
+		dvid.PutBuffer(data)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(float32(n+1) / float32(len(rows)))
+		}
+	}
+	return nil
+}
+
+// CopyRegionCommand handles the "copyregion <src UUID> <src data> <offset> <size>" RPC
+// command, which starts a job that copies a subvolume into the destination data.
+func CopyRegionCommand(request datastore.Request, reply *datastore.Response, dst IntHandler) error {
+	var uuidStr, dataName, cmdStr, srcUUIDStr, srcName, offsetStr, sizeStr string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &srcUUIDStr, &srcName, &offsetStr, &sizeStr)
+	if sizeStr == "" {
+		return fmt.Errorf("Poorly formatted copyregion command.  See command-line help.")
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	srcUUID, err := server.MatchingUUID(srcUUIDStr)
+	if err != nil {
+		return err
+	}
+	dataservice, err := server.DatastoreService().DataServiceByUUID(srcUUID, dvid.DataString(srcName))
+	if err != nil {
+		return err
+	}
+	src, ok := dataservice.(IntHandler)
+	if !ok {
+		return fmt.Errorf("Data '%s' doesn't hold voxels", srcName)
+	}
+	if err := copyable(src, dst); err != nil {
+		return err
+	}
+	subvol, err := dvid.NewSubvolumeFromStrings(offsetStr, sizeStr, ",")
+	if err != nil {
+		return err
+	}
+
+	ctx := request.Context()
+	description := fmt.Sprintf("Copy of %s from '%s' in %s into '%s'", subvol, srcName, srcUUID, dataName)
+	job := server.NewJob(description)
+	go func() {
+		err := CopyRegion(ctx, uuid, dst, srcUUID, src, subvol, job.SetProgress)
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to copy %s from '%s'.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, subvol, srcName, job.ID)
+	return nil
+}
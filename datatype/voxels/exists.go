@@ -0,0 +1,54 @@
+/*
+	This file checks which of many blocks have been written at a version, so ingest
+	clients can resume interrupted loads by only writing the missing blocks.
+*/
+
+package voxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// BlockIndex returns the index of a block given its block coordinate.
+func (props *Properties) BlockIndex(coord []int32) (dvid.Index, error) {
+	dims := int(props.BlockSize.NumDims())
+	if len(coord) != dims {
+		return nil, fmt.Errorf("Block coordinate %v should have %d dimensions", coord, dims)
+	}
+	if dims == 3 {
+		return props.Indexing.Index(dvid.ChunkPoint3d{coord[0], coord[1], coord[2]}), nil
+	}
+	return dvid.IndexNd(append(dvid.ChunkPointNd(nil), coord...)), nil
+}
+
+// ServeExists handles POST <api URL>/node/<UUID>/<data name>/exists, replying with a
+// bitmask of which of the block coordinates in the JSON request body have been written.
+func ServeExists(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler, props *Properties) error {
+	if strings.ToLower(r.Method) != "post" {
+		return fmt.Errorf("Existence checks must be sent with HTTP POST")
+	}
+	var coords [][]int32
+	if err := json.NewDecoder(r.Body).Decode(&coords); err != nil {
+		return fmt.Errorf("Expected JSON list of block coordinates: %s", err.Error())
+	}
+	indices := make([]dvid.Index, len(coords))
+	for n, coord := range coords {
+		index, err := props.BlockIndex(coord)
+		if err != nil {
+			return err
+		}
+		indices[n] = index
+	}
+	found, err := server.KeysExist(uuid, i.DataID(), indices)
+	if err != nil {
+		return err
+	}
+	server.WriteExists(w, found)
+	return nil
+}
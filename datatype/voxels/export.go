@@ -0,0 +1,488 @@
+/*
+	This file streams exports of 3d voxels in chunked layouts (N5, Zarr, and Neuroglancer
+	precomputed) to an object store, e.g., an S3 or GCS bucket, without staging on local disk.
+	Uploads run in parallel and completed keys are recorded in a manifest so an interrupted
+	export can be resumed if requested.  The manifest is saved in segments, each holding
+	the keys completed since the previous save, so saving doesn't rewrite every key.  Exports can also write a checksum manifest,
+	dvid.ChecksumManifestName, so copies of the export can be verified.  Checksums of
+	completed keys are kept in the export manifest, so a resumed export needn't read back
+	the objects uploaded before it.
+*/
+
+package voxels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// ExportManifestKey is the key of the manifest object written alongside exported objects.
+const ExportManifestKey = "dvid-export-manifest.json"
+
+// DefaultExportUploads is the default number of concurrent uploads during an export.
+const DefaultExportUploads = 8
+
+// exportManifestInterval is the number of uploads between manifest saves.
+var exportManifestInterval = 100
+
+// exportManifest describes an export whose completed keys are saved in Segments objects
+// named by manifestSegmentKey.
+type exportManifest struct {
+	Format   string
+	UUID     string
+	Data     string
+	Segments int
+	Finished bool
+}
+
+// manifestSegment holds the keys completed by an export between two manifest saves.
+type manifestSegment struct {
+	Completed []string
+
+	// Checksums of completed keys if the export writes a checksum manifest.
+	Checksums []dvid.ManifestFile `json:",omitempty"`
+}
+
+// manifestSegmentKey returns the key of a segment of the export manifest.
+func manifestSegmentKey(n int) string {
+	return fmt.Sprintf("%s.%d", ExportManifestKey, n)
+}
+
+// readExportManifest returns the export manifest in a store, or nil if there's none,
+// with the keys and checksums of its segments.
+func readExportManifest(store storage.ObjectStore) (*exportManifest, []manifestSegment, error) {
+	m, err := store.GetObject(ExportManifestKey)
+	if err != nil || m == nil {
+		return nil, nil, err
+	}
+	manifest := new(exportManifest)
+	if err := json.Unmarshal(m, manifest); err != nil {
+		return nil, nil, fmt.Errorf("Bad export manifest in %s: %s", store, err.Error())
+	}
+	segments := make([]manifestSegment, manifest.Segments)
+	for n := range segments {
+		key := manifestSegmentKey(n)
+		m, err := store.GetObject(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m == nil {
+			return nil, nil, fmt.Errorf("Export manifest segment %q is missing from %s", key, store)
+		}
+		if err := json.Unmarshal(m, &segments[n]); err != nil {
+			return nil, nil, fmt.Errorf("Bad export manifest segment %q in %s: %s", key, store, err.Error())
+		}
+	}
+	return manifest, segments, nil
+}
+
+type exportObject struct {
+	key  string
+	data []byte
+}
+
+// ExportWriter uploads objects to an object store in parallel, recording completed keys
+// in a manifest so a later export of the same data and version can skip them.
+type ExportWriter struct {
+	store    storage.ObjectStore
+	manifest exportManifest
+
+	mu        sync.Mutex
+	completed map[string]bool
+	unsaved   []string // keys completed since the last manifest save
+	err       error
+
+	saveMu  sync.Mutex
+	objects chan exportObject
+	wg      sync.WaitGroup
+
+	checksums *dvid.ChecksumManifest
+	resumed   []dvid.ManifestFile // checksums of keys completed by a resumed export
+}
+
+// NewExportWriter returns an ExportWriter with the given number of concurrent uploads.
+// If resume is true and the store holds a manifest from an export of the same format,
+// version, and data, its completed keys are skipped.
+func NewExportWriter(store storage.ObjectStore, format string, uuid dvid.UUID, name dvid.DataString,
+	numUploads int, resume bool) (*ExportWriter, error) {
+
+	if numUploads < 1 {
+		numUploads = DefaultExportUploads
+	}
+	w := &ExportWriter{
+		store:     store,
+		manifest:  exportManifest{Format: format, UUID: string(uuid), Data: string(name)},
+		completed: make(map[string]bool),
+		objects:   make(chan exportObject, numUploads),
+	}
+	if resume {
+		prev, segments, err := readExportManifest(store)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && prev.Format == format && prev.UUID == string(uuid) && prev.Data == string(name) {
+			for _, segment := range segments {
+				for _, key := range segment.Completed {
+					w.completed[key] = true
+				}
+				w.resumed = append(w.resumed, segment.Checksums...)
+			}
+			w.manifest.Segments = prev.Segments
+			dvid.Log(dvid.Normal, "Resuming export to %s with %d objects already uploaded\n",
+				store, len(w.completed))
+		}
+	}
+	if w.manifest.Segments == 0 {
+		// Replace any manifest of an earlier export so its segments aren't resumed.
+		if err := w.saveManifest(false); err != nil {
+			return nil, err
+		}
+	}
+	for n := 0; n < numUploads; n++ {
+		w.wg.Add(1)
+		go w.upload()
+	}
+	return w, nil
+}
+
+// AddChecksums makes the export write a checksum manifest of its objects when closed.
+// It must be called before any objects are put.
+func (w *ExportWriter) AddChecksums(source string) {
+	w.checksums = dvid.NewChecksumManifest(source)
+	for _, file := range w.resumed {
+		if w.completed[file.Name] {
+			w.checksums.AddFile(file)
+		}
+	}
+}
+
+func (w *ExportWriter) upload() {
+	defer w.wg.Done()
+	for obj := range w.objects {
+		if w.Err() != nil {
+			continue
+		}
+		if err := w.store.PutObject(obj.key, obj.data); err != nil {
+			w.setErr(err)
+			continue
+		}
+		if w.checksums != nil {
+			w.checksums.Add(obj.key, obj.data)
+		}
+		w.mu.Lock()
+		w.completed[obj.key] = true
+		w.unsaved = append(w.unsaved, obj.key)
+		save := len(w.unsaved) >= exportManifestInterval
+		w.mu.Unlock()
+		if save {
+			if err := w.saveManifest(false); err != nil {
+				w.setErr(err)
+			}
+		}
+	}
+}
+
+func (w *ExportWriter) setErr(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// Err returns the first upload error, if any.
+func (w *ExportWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// saveManifest writes a segment with the keys completed since the last save and then
+// the manifest counting it.
+func (w *ExportWriter) saveManifest(finished bool) error {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+	w.mu.Lock()
+	segment := manifestSegment{Completed: w.unsaved}
+	w.unsaved = nil
+	w.mu.Unlock()
+	if len(segment.Completed) != 0 {
+		sort.Strings(segment.Completed)
+		if w.checksums != nil {
+			for _, key := range segment.Completed {
+				if file, found := w.checksums.File(key); found {
+					segment.Checksums = append(segment.Checksums, file)
+				}
+			}
+		}
+		m, err := json.Marshal(segment)
+		if err == nil {
+			err = w.store.PutObject(manifestSegmentKey(w.manifest.Segments), m)
+		}
+		if err != nil {
+			// Keep the keys for the next save.
+			w.mu.Lock()
+			w.unsaved = append(w.unsaved, segment.Completed...)
+			w.mu.Unlock()
+			return err
+		}
+		w.manifest.Segments++
+	}
+	manifest := w.manifest
+	manifest.Finished = finished
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return w.store.PutObject(ExportManifestKey, m)
+}
+
+// Completed returns true if the key was uploaded by this or a resumed export.
+func (w *ExportWriter) Completed(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.completed[key]
+}
+
+// Put queues data for upload under the key.  It returns the first upload error, if any,
+// so exports can stop early.
+func (w *ExportWriter) Put(key string, data []byte) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	w.objects <- exportObject{key, data}
+	return nil
+}
+
+// PutJSON queues the JSON encoding of v for upload under the key.
+func (w *ExportWriter) PutJSON(key string, v interface{}) error {
+	m, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.Put(key, m)
+}
+
+// Close waits for queued uploads and writes the final manifest.
+func (w *ExportWriter) Close() error {
+	close(w.objects)
+	w.wg.Wait()
+	if err := w.Err(); err != nil {
+		if saveErr := w.saveManifest(false); saveErr != nil {
+			dvid.Error("Unable to save export manifest to %s: %s\n", w.store, saveErr.Error())
+		}
+		return err
+	}
+	if err := w.saveChecksums(); err != nil {
+		return err
+	}
+	return w.saveManifest(true)
+}
+
+// saveChecksums writes the checksum manifest, reading back objects uploaded by an
+// earlier, resumed export whose manifest has no checksums for them.
+func (w *ExportWriter) saveChecksums() error {
+	if w.checksums == nil {
+		return nil
+	}
+	for key := range w.completed {
+		if w.checksums.Has(key) {
+			continue
+		}
+		data, err := w.store.GetObject(key)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("Object %q of resumed export is missing from %s", key, w.store)
+		}
+		w.checksums.Add(key, data)
+	}
+	m, err := w.checksums.JSON()
+	if err != nil {
+		return err
+	}
+	return w.store.PutObject(dvid.ChecksumManifestName, m)
+}
+
+// ExportZarr writes the data extents as a Zarr v2 array with one uncompressed chunk
+// per block and "." separated chunk keys.
+func ExportZarr(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, w *ExportWriter) error {
+	if props.MinPoint == nil || props.MaxPoint == nil {
+		return fmt.Errorf("No stored voxels to export")
+	}
+	layout, err := props.zarrLayout()
+	if err != nil {
+		return err
+	}
+	zarray, err := props.ZarrArrayV2()
+	if err != nil {
+		return err
+	}
+	attrs, err := props.ZarrAttributes()
+	if err != nil {
+		return err
+	}
+	if err := w.PutJSON(".zarray", zarray); err != nil {
+		return err
+	}
+	if err := w.PutJSON(".zattrs", attrs); err != nil {
+		return err
+	}
+	var numChunks [3]int32 // in C order
+	for n := 0; n < 3; n++ {
+		numChunks[n] = (layout.shape[n] + layout.chunks[n] - 1) / layout.chunks[n]
+	}
+	for cz := int32(0); cz < numChunks[0]; cz++ {
+		for cy := int32(0); cy < numChunks[1]; cy++ {
+			for cx := int32(0); cx < numChunks[2]; cx++ {
+				coords := []string{strconv.Itoa(int(cz)), strconv.Itoa(int(cy)), strconv.Itoa(int(cx))}
+				key := strings.Join(coords, ".")
+				if len(props.Values) > 1 && len(zarray.Shape) == 4 {
+					key += ".0"
+				}
+				if w.Completed(key) {
+					continue
+				}
+				subvol, err := layout.chunkSubvolume(coords)
+				if err != nil {
+					return err
+				}
+				e, err := i.NewExtHandler(subvol, nil)
+				if err != nil {
+					return err
+				}
+				data, err := GetVolume(ctx, uuid, i, e)
+				if err != nil {
+					return err
+				}
+				if err := w.Put(key, data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ExportPrecomputed writes the data extents in the Neuroglancer precomputed layout with
+// an "info" object and raw chunks at every scale.
+func ExportPrecomputed(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, w *ExportWriter) error {
+	if props.MinPoint == nil || props.MaxPoint == nil {
+		return fmt.Errorf("No stored voxels to export")
+	}
+	info, err := props.PrecomputedInfo()
+	if err != nil {
+		return err
+	}
+	if err := w.PutJSON("info", info); err != nil {
+		return err
+	}
+	for level, scale := range info.Scales {
+		startTime := time.Now()
+		chunkSize := scale.ChunkSizes[0]
+		var beg, end [3]int32
+		for beg[2] = scale.VoxelOffset[2]; beg[2] < scale.VoxelOffset[2]+scale.Size[2]; beg[2] += chunkSize[2] {
+			for beg[1] = scale.VoxelOffset[1]; beg[1] < scale.VoxelOffset[1]+scale.Size[1]; beg[1] += chunkSize[1] {
+				for beg[0] = scale.VoxelOffset[0]; beg[0] < scale.VoxelOffset[0]+scale.Size[0]; beg[0] += chunkSize[0] {
+					for dim := 0; dim < 3; dim++ {
+						end[dim] = beg[dim] + chunkSize[dim]
+						if limit := scale.VoxelOffset[dim] + scale.Size[dim]; end[dim] > limit {
+							end[dim] = limit
+						}
+					}
+					key := fmt.Sprintf("%s/%d-%d_%d-%d_%d-%d", scale.Key,
+						beg[0], end[0], beg[1], end[1], beg[2], end[2])
+					if w.Completed(key) {
+						continue
+					}
+					data, err := precomputedChunk(ctx, uuid, i, props, level, beg, end)
+					if err != nil {
+						return err
+					}
+					if err := w.Put(key, data); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "Exported precomputed scale %s", scale.Key)
+	}
+	return nil
+}
+
+// checksumsSetting returns the "checksums" setting of an export, which is false by default.
+func checksumsSetting(request datastore.Request) (bool, error) {
+	s, found := request.Setting("checksums")
+	if !found {
+		return false, nil
+	}
+	checksums, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("Bad checksums setting '%s': %s", s, err.Error())
+	}
+	return checksums, nil
+}
+
+// exportChunkedCommand handles "export <format> <target>" for the chunked formats,
+// which can be written to local directories or object stores.
+func (d *Data) exportChunkedCommand(request datastore.Request, uuid dvid.UUID, format, target string) error {
+	config := request.Settings()
+	store, err := storage.NewObjectStore(target, config)
+	if err != nil {
+		return err
+	}
+	numUploads, _, err := config.GetInt("uploads")
+	if err != nil {
+		return err
+	}
+	var resume bool
+	if resumeStr, found, err := config.GetString("resume"); err != nil {
+		return err
+	} else if found {
+		if resume, err = strconv.ParseBool(resumeStr); err != nil {
+			return fmt.Errorf("Bad resume setting '%s': %s", resumeStr, err.Error())
+		}
+	}
+	w, err := NewExportWriter(store, format, uuid, d.DataName(), numUploads, resume)
+	if err != nil {
+		return err
+	}
+	if checksums, err := checksumsSetting(request); err != nil {
+		return err
+	} else if checksums {
+		w.AddChecksums(fmt.Sprintf("%s of %q at version %s", format, d.DataName(), uuid))
+	}
+	startTime := time.Now()
+	switch format {
+	case "n5":
+		var export N5Export
+		if export, err = n5ExportSettings(request); err == nil {
+			err = ExportN5(request.Context(), uuid, d, &(d.Properties), string(d.DataName()), export, w)
+		}
+	case "zarr":
+		err = ExportZarr(request.Context(), uuid, d, &(d.Properties), w)
+	case "precomputed":
+		err = ExportPrecomputed(request.Context(), uuid, d, &(d.Properties), w)
+	default:
+		err = fmt.Errorf("Unsupported chunked export format '%s'", format)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Export of '%s' to %s failed: %s", d.DataName(), store, err.Error())
+	}
+	dvid.ElapsedTime(dvid.Normal, startTime, "Exported '%s' as %s to %s", d.DataName(), format, store)
+	return nil
+}
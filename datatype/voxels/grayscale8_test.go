@@ -1,12 +1,30 @@
 package voxels
 
 import (
-	"testing"
 	. "github.com/janelia-flyem/go/gocheck"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -129,13 +147,51 @@ func (suite *TestSuite) makeGrayscale(c *C, root dvid.UUID, name dvid.DataString
 	return grayscale
 }
 
+// newGrayscale makes a new dataset with grayscale8 data of the given name.
+func (suite *TestSuite) newGrayscale(c *C, name dvid.DataString) (dvid.UUID, *Data) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	return root, suite.makeGrayscale(c, root, name)
+}
+
+// putVolume stores MakeVolume voxels for a subvolume and returns them.
+func putVolume(c *C, uuid dvid.UUID, d *Data, offset, size dvid.Point3d) []byte {
+	data := MakeVolume(offset, size)
+	v, err := d.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), uuid, d, v), IsNil)
+	return data
+}
+
 func (suite *TestSuite) TestSubvolGrayscale8(c *C) {
+	suite.subvolTest(c, "")
+}
+
+func (suite *TestSuite) TestSubvolGrayscale8Morton(c *C) {
+	suite.subvolTest(c, "morton")
+}
+
+func (suite *TestSuite) TestSubvolGrayscale8Hilbert(c *C) {
+	suite.subvolTest(c, "hilbert")
+}
+
+func (suite *TestSuite) subvolTest(c *C, indexing string) {
 	// Create a new dataset
 	root, _, err := suite.service.NewDataset()
 	c.Assert(err, IsNil)
 
 	// Add grayscale data
-	grayscale := suite.makeGrayscale(c, root, "grayscale")
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	if indexing != "" {
+		config.Set("Indexing", indexing)
+	}
+	err = suite.service.NewData(root, "grayscale8", "grayscale", config)
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "grayscale")
+	c.Assert(err, IsNil)
+	grayscale, ok := dataservice.(*Data)
+	c.Assert(ok, Equals, true)
 
 	// Create a fake 100x100x100 8-bit grayscale image
 	offset := dvid.Point3d{5, 35, 61}
@@ -149,14 +205,14 @@ func (suite *TestSuite) TestSubvolGrayscale8(c *C) {
 	v, err := grayscale.NewExtHandler(subvol, data)
 	c.Assert(err, IsNil)
 
-	err = PutVoxels(root, grayscale, v)
+	err = PutVoxels(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 	c.Assert(v.NumVoxels(), Equals, int64(len(origData)))
 
 	// Read the stored image
 	v2, err := grayscale.NewExtHandler(subvol, nil)
 	c.Assert(err, IsNil)
-	err = GetVoxels(root, grayscale, v2)
+	err = GetVoxels(context.Background(), root, grayscale, v2)
 	c.Assert(err, IsNil)
 
 	// Make sure the retrieved image matches the original
@@ -194,11 +250,11 @@ func (suite *TestSuite) sliceTest(c *C, slice dvid.Geometry) {
 	v, err := grayscale.NewExtHandler(slice, img)
 	c.Assert(err, IsNil)
 
-	err = PutVoxels(root, grayscale, v)
+	err = PutVoxels(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 
 	// Read the stored image
-	retrieved, err := GetImage(root, grayscale, v)
+	retrieved, err := GetImage(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 
 	// Make sure the retrieved image matches the original
@@ -233,3 +289,1607 @@ func (suite *TestSuite) TestYZSliceGrayscale8(c *C) {
 	c.Assert(err, IsNil)
 	suite.sliceTest(c, slice)
 }
+
+func (suite *TestSuite) TestCanceledRequest(c *C) {
+	root, grayscale := suite.newGrayscale(c, "canceled")
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 64, 64}
+	putVolume(c, root, grayscale, offset, size)
+
+	subvol := dvid.NewSubvolume(offset, size)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v2, err := grayscale.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(ctx, root, grayscale, v2), Equals, context.Canceled)
+
+	// Canceled PUTs store nothing new.
+	other := dvid.Point3d{128, 0, 0}
+	v3, err := grayscale.NewExtHandler(dvid.NewSubvolume(other, size), MakeVolume(other, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(ctx, root, grayscale, v3), Equals, context.Canceled)
+	v4, err := grayscale.NewExtHandler(dvid.NewSubvolume(other, size), nil)
+	c.Assert(err, IsNil)
+	data, err := GetVolume(context.Background(), root, grayscale, v4)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Count(data, []byte{0}), Equals, len(data))
+
+	// HTTP requests use the request context.
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/canceled/raw/0_1_2/64_64_64/0_0_0", nil)
+	r = r.WithContext(ctx)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), NotNil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (suite *TestSuite) TestMemoryBudget(c *C) {
+	root, grayscale := suite.newGrayscale(c, "budget")
+
+	server.MemoryBudget = 1000
+	defer func() { server.MemoryBudget = 0 }()
+
+	// Requests that can never fit are rejected.
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/budget/raw/0_1_2/64_64_64/0_0_0", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), NotNil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	// Requests reserve their estimated voxel bytes.
+	slice, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{0, 0, 0}, dvid.Point2d{20, 15})
+	c.Assert(err, IsNil)
+	release, err := grayscale.AdmitRequest(context.Background(), slice)
+	c.Assert(err, IsNil)
+	c.Assert(server.MemoryReserved(), Equals, int64(600))
+	release()
+	c.Assert(server.MemoryReserved(), Equals, int64(0))
+}
+func (suite *TestSuite) TestQueryLimits(c *C) {
+	root, grayscale := suite.newGrayscale(c, "limits")
+
+	config := `{"MaxSliceArea": "100", "MaxSubvolumeVoxels": "1000"}`
+	r := httptest.NewRequest("POST", "/api/node/"+string(root)+"/limits", strings.NewReader(config))
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+	c.Assert(grayscale.Limits.MaxSliceArea, Equals, int64(100))
+	c.Assert(grayscale.Limits.MaxSubvolumeVoxels, Equals, int64(1000))
+
+	get := func(shape, size string) int {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/limits/raw/"+shape+"/"+size+"/0_0_0", nil)
+		w := httptest.NewRecorder()
+		grayscale.DoHTTP(root, w, r)
+		return w.Code
+	}
+	c.Assert(get("0_1", "10_10"), Equals, http.StatusOK)
+	c.Assert(get("0_1", "20_15"), Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(get("0_1_2", "10_10_10"), Equals, http.StatusOK)
+	c.Assert(get("0_1_2", "16_16_16"), Equals, http.StatusRequestEntityTooLarge)
+
+	// Other endpoints that read voxels have the same limits.
+	for _, endpoint := range []string{"overlay/0_1/20_15/0_0_0", "isosurface/10/16_16_16/0_0_0", "zarr/0.0.0"} {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/limits/"+endpoint, nil)
+		w := httptest.NewRecorder()
+		grayscale.DoHTTP(root, w, r)
+		c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge, Commentf("GET %s", endpoint))
+	}
+
+	// Zero removes a limit.
+	config = `{"MaxSliceArea": "0"}`
+	r = httptest.NewRequest("POST", "/api/node/"+string(root)+"/limits", strings.NewReader(config))
+	c.Assert(grayscale.DoHTTP(root, httptest.NewRecorder(), r), IsNil)
+	c.Assert(get("0_1", "20_15"), Equals, http.StatusOK)
+}
+
+func (suite *TestSuite) TestReadOnlyCommand(c *C) {
+	uuid, grayscale := suite.newGrayscale(c, "readonly")
+
+	// Exports can run at published nodes but loads can't.
+	export := datastore.Request{Command: dvid.Command{"node", string(uuid), "readonly", "export", "zarr", "/tmp/x"}}
+	c.Assert(grayscale.ReadOnlyCommand(export), Equals, true)
+	load := datastore.Request{Command: dvid.Command{"node", string(uuid), "readonly", "load", "0,0,0", "*.png"}}
+	c.Assert(grayscale.ReadOnlyCommand(load), Equals, false)
+}
+func (suite *TestSuite) TestThumbnail(c *C) {
+	root, grayscale := suite.newGrayscale(c, "previewed")
+	_, err := grayscale.Thumbnail(context.Background(), root, 32)
+	c.Assert(err, ErrorMatches, ".*no stored voxels.*")
+
+	// Voxels are 1 below z = 32 and 2 at or above it.
+	data := make([]byte, 64*64*64)
+	for i := 64 * 64 * 32; i < len(data); i++ {
+		data[i] = 2
+	}
+	for i := 0; i < 64*64*32; i++ {
+		data[i] = 1
+	}
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64})
+	v, err := grayscale.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	c.Assert(suite.service.Lock(root), IsNil)
+	dataset, err := suite.service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	c.Assert(dataset.LatestLocked(), Equals, root)
+
+	img, err := grayscale.Thumbnail(context.Background(), root, 32)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 96)
+	c.Assert(img.Bounds().Dy(), Equals, 32)
+	gray := func(x, y int) uint8 {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return uint8(r >> 8)
+	}
+	// The XY slice is at the middle z, and the XZ and YZ slices span z.
+	c.Assert(gray(16, 16), Equals, uint8(1))
+	c.Assert(gray(48, 2), Equals, uint8(1))
+	c.Assert(gray(48, 30), Equals, uint8(2))
+	c.Assert(gray(80, 30), Equals, uint8(2))
+
+	// The gallery is stored apart from the dataset, which gets no new data.
+	gallery, err := server.GenerateGallery(context.Background(), root)
+	c.Assert(err, IsNil)
+	c.Assert(gallery.Thumbnails, HasLen, 1)
+	c.Assert(gallery.Thumbnails[0].URL, Equals, server.WebAPIPath+"dataset/"+string(root)+"/gallery/previewed.png")
+	c.Assert(dataset.DataNames(), DeepEquals, []dvid.DataString{"previewed"})
+	stored, err := suite.service.GetThumbnail(root, "previewed.png")
+	c.Assert(err, IsNil)
+	_, err = png.Decode(bytes.NewReader(stored))
+	c.Assert(err, IsNil)
+}
+
+func (suite *TestSuite) TestChildVersionReads(c *C) {
+	root, grayscale := suite.newGrayscale(c, "inherited")
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 32, 32}
+	get := func(uuid dvid.UUID) []byte {
+		v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+		c.Assert(err, IsNil)
+		stored, err := GetVolume(context.Background(), uuid, grayscale, v)
+		c.Assert(err, IsNil)
+		return stored
+	}
+	original := putVolume(c, root, grayscale, offset, size)
+	c.Assert(suite.service.Lock(root), IsNil)
+
+	// A child version reads the blocks it hasn't written from its parent.
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(get(child), DeepEquals, original)
+
+	// A partial write to a child block keeps the rest of the inherited block and leaves
+	// the parent unchanged.
+	v, err = grayscale.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{8, 8, 8}),
+		make([]byte, 8*8*8))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), child, grayscale, v), IsNil)
+	c.Assert(get(root), DeepEquals, original)
+	expected := append([]byte(nil), original...)
+	for z := 0; z < 8; z++ {
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				expected[(z*32+y)*64+x] = 0
+			}
+		}
+	}
+	c.Assert(get(child), DeepEquals, expected)
+}
+
+func (suite *TestSuite) TestWriteObserver(c *C) {
+	root, grayscale := suite.newGrayscale(c, "observed")
+
+	var written []dvid.Point
+	AddWriteObserver(func(uuid dvid.UUID, dataID datastore.DataID, minPt, maxPt dvid.Point) {
+		if uuid == root && dataID.DataName() == "observed" {
+			written = append(written, minPt, maxPt)
+		}
+	})
+	offset := dvid.Point3d{10, 20, 30}
+	size := dvid.Point3d{40, 30, 20}
+	putVolume(c, root, grayscale, offset, size)
+	c.Assert(written, DeepEquals, []dvid.Point{dvid.Point3d{10, 20, 30}, dvid.Point3d{49, 49, 49}})
+}
+
+func (suite *TestSuite) TestPrecomputed(c *C) {
+	root, grayscale := suite.newGrayscale(c, "precomputed")
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 64, 64}
+	data := putVolume(c, root, grayscale, offset, size)
+
+	info, err := grayscale.PrecomputedInfo()
+	c.Assert(err, IsNil)
+	c.Assert(info.VolumeType, Equals, "image")
+	c.Assert(info.DataType, Equals, "uint8")
+	c.Assert(info.Scales, HasLen, 2)
+	c.Assert(info.Scales[0].Size, Equals, [3]int32{64, 64, 64})
+	c.Assert(info.Scales[1].Size, Equals, [3]int32{32, 32, 32})
+
+	get := func(chunk ...string) []byte {
+		parts := append([]string{"api", "node", string(root), "precomputed"}, chunk...)
+		r := httptest.NewRequest("GET", "/"+strings.Join(parts, "/"), nil)
+		w := httptest.NewRecorder()
+		err := ServePrecomputed(w, r, root, grayscale, &(grayscale.Properties), parts)
+		c.Assert(err, IsNil)
+		return w.Body.Bytes()
+	}
+	var decoded PrecomputedInfo
+	c.Assert(json.Unmarshal(get("info"), &decoded), IsNil)
+	c.Assert(decoded.Type, Equals, "neuroglancer_multiscale_volume")
+
+	full := get("s0", "0-32_0-32_32-64")
+	c.Assert(full, DeepEquals, MakeVolume(dvid.Point3d{0, 0, 32}, dvid.Point3d{32, 32, 32}))
+
+	half := get("s1", "0-32_0-32_0-32")
+	c.Assert(half, HasLen, 32*32*32)
+	var sum int
+	for _, z := range []int{0, 1} {
+		for _, y := range []int{0, 1} {
+			for _, x := range []int{0, 1} {
+				sum += int(data[z*64*64+y*64+x])
+			}
+		}
+	}
+	c.Assert(half[0], Equals, byte((sum+4)/8))
+
+	// Only chunks of a scale's grid within its bounds are served.
+	for _, chunk := range []string{"5-37_0-32_0-32", "0-64_0-32_0-32", "64-96_0-32_0-32", "0-2147483647_0-32_0-32"} {
+		parts := []string{"api", "node", string(root), "precomputed", "s0", chunk}
+		r := httptest.NewRequest("GET", "/"+strings.Join(parts, "/"), nil)
+		err := ServePrecomputed(httptest.NewRecorder(), r, root, grayscale, &(grayscale.Properties), parts)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (suite *TestSuite) TestZarr(c *C) {
+	root, grayscale := suite.newGrayscale(c, "zarr")
+
+	offset := dvid.Point3d{32, 32, 32}
+	size := dvid.Point3d{64, 64, 64}
+	putVolume(c, root, grayscale, offset, size)
+
+	do := func(method string, body []byte, keys ...string) []byte {
+		parts := append([]string{"node", string(root), "zarr", "zarr"}, keys...)
+		r := httptest.NewRequest(method, "/"+strings.Join(parts, "/"), bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		err := ServeZarr(w, r, root, grayscale, &(grayscale.Properties), parts)
+		c.Assert(err, IsNil)
+		return w.Body.Bytes()
+	}
+
+	var zarray ZarrArrayV2
+	c.Assert(json.Unmarshal(do("GET", nil, ".zarray"), &zarray), IsNil)
+	c.Assert(zarray.Shape, DeepEquals, []int32{64, 64, 64})
+	c.Assert(zarray.Chunks, DeepEquals, []int32{32, 32, 32})
+	c.Assert(zarray.DType, Equals, "|u1")
+
+	var zarrJSON ZarrArrayV3
+	c.Assert(json.Unmarshal(do("GET", nil, "zarr.json"), &zarrJSON), IsNil)
+	c.Assert(zarrJSON.DataType, Equals, "uint8")
+	c.Assert(zarrJSON.DimensionNames, DeepEquals, []string{"z", "y", "x"})
+
+	// Chunk keys are in (Z, Y, X) order relative to the block-aligned origin.
+	chunk := do("GET", nil, "1.0.1")
+	c.Assert(chunk, DeepEquals, MakeVolume(dvid.Point3d{64, 32, 64}, dvid.Point3d{32, 32, 32}))
+	c.Assert(do("GET", nil, "c", "1", "0", "1"), DeepEquals, chunk)
+
+	// Write a chunk and read it back through DVID.
+	written := bytes.Repeat([]byte{7}, 32*32*32)
+	do("PUT", written, "c", "0", "1", "0")
+	v2, err := grayscale.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{32, 64, 32}, dvid.Point3d{32, 32, 32}), nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v2), IsNil)
+	c.Assert(v2.Data(), DeepEquals, written)
+
+	// Bodies longer than a chunk are too large.
+	parts := []string{"node", string(root), "zarr", "zarr", "c", "0", "1", "0"}
+	r := httptest.NewRequest("PUT", "/"+strings.Join(parts, "/"), bytes.NewReader(append(written, 7)))
+	err = ServeZarr(httptest.NewRecorder(), r, root, grayscale, &(grayscale.Properties), parts)
+	c.Assert(err, Equals, server.ErrBodyTooLarge)
+}
+
+func (suite *TestSuite) TestExportN5(c *C) {
+	root, grayscale := suite.newGrayscale(c, "n5export")
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{40, 40, 40}
+	data := putVolume(c, root, grayscale, offset, size)
+
+	dir := c.MkDir()
+	w, err := NewExportWriter(storage.NewDirStore(dir), "n5", root, "n5export", 4, true)
+	c.Assert(err, IsNil)
+	err = ExportN5(context.Background(), root, grayscale, &(grayscale.Properties), "gray", N5Export{}, w)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	_, err = os.Stat(filepath.Join(dir, "gray.xml"))
+	c.Assert(err, IsNil)
+	m, err := ioutil.ReadFile(filepath.Join(dir, "gray.n5", "setup0", "timepoint0", "s1", "attributes.json"))
+	c.Assert(err, IsNil)
+	var attrs struct {
+		Dimensions []int32
+	}
+	c.Assert(json.Unmarshal(m, &attrs), IsNil)
+	c.Assert(attrs.Dimensions, DeepEquals, []int32{20, 20, 20})
+
+	// Edge blocks are truncated to the volume and voxels are in x, y, z order.
+	block, err := ioutil.ReadFile(filepath.Join(dir, "gray.n5", "setup0", "timepoint0", "s0", "1", "0", "0"))
+	c.Assert(err, IsNil)
+	c.Assert(binary.BigEndian.Uint16(block[2:4]), Equals, uint16(3))
+	c.Assert(binary.BigEndian.Uint32(block[4:8]), Equals, uint32(8))
+	c.Assert(binary.BigEndian.Uint32(block[8:12]), Equals, uint32(32))
+	c.Assert(binary.BigEndian.Uint32(block[12:16]), Equals, uint32(32))
+	c.Assert(block[16:], HasLen, 8*32*32)
+	c.Assert(block[16:24], DeepEquals, data[32:40])
+	c.Assert(block[24:32], DeepEquals, data[40+32:40+40])
+}
+
+func (suite *TestSuite) TestParseHyperslab(c *C) {
+	offset, size, err := parseHyperslab("0,10,100/512,256,64")
+	c.Assert(err, IsNil)
+	c.Assert(offset, DeepEquals, dvid.Point3d{0, 10, 100})
+	c.Assert(size, DeepEquals, dvid.Point3d{512, 256, 64})
+
+	_, _, err = parseHyperslab("0,10,100")
+	c.Assert(err, NotNil)
+	_, _, err = parseHyperslab("0,10/512,256,64")
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestLoadSections(c *C) {
+	root, grayscale := suite.newGrayscale(c, "sections")
+
+	// Write two small sections with different translations.
+	dir := c.MkDir()
+	for n, value := range []byte{50, 100} {
+		img := image.NewGray(image.Rect(0, 0, 10, 8))
+		for i := range img.Pix {
+			img.Pix[i] = value
+		}
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("section%d.png", n)))
+		c.Assert(err, IsNil)
+		c.Assert(png.Encode(f, img), IsNil)
+		f.Close()
+	}
+	manifest := "# filename z x y\nsection1.png, 41, 5, 3\nsection0.png 40\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "manifest.txt"), []byte(manifest), 0644), IsNil)
+
+	sections, err := ReadSectionManifest(strings.NewReader(manifest), dir)
+	c.Assert(err, IsNil)
+	c.Assert(sections, HasLen, 2)
+	c.Assert(sections[0].Z, Equals, int32(40))
+	c.Assert(sections[1].Offset, Equals, dvid.Point2d{5, 3})
+
+	_, err = ReadSectionManifest(strings.NewReader("a.png 1\nb.png 1\n"), dir)
+	c.Assert(err, NotNil)
+
+	err = LoadSectionManifest(context.Background(), grayscale, root, filepath.Join(dir, "manifest.txt"), "")
+	c.Assert(err, IsNil)
+
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 40}, dvid.Point3d{16, 12, 2})
+	v, err := grayscale.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v), IsNil)
+	data := v.Data()
+	c.Assert(data[0], Equals, byte(50))
+	c.Assert(data[9], Equals, byte(50))
+	c.Assert(data[10], Equals, byte(0))
+	c.Assert(data[16*12], Equals, byte(0))
+	c.Assert(data[16*12+3*16+5], Equals, byte(100))
+	c.Assert(data[16*12+10*16+14], Equals, byte(100))
+}
+
+func (suite *TestSuite) TestNifti(c *C) {
+	root, grayscale := suite.newGrayscale(c, "niftidata")
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{20, 10, 5}
+	data := putVolume(c, root, grayscale, offset, size)
+
+	dir := c.MkDir()
+	filename := filepath.Join(dir, "gray.nii.gz")
+	request := datastore.Request{Command: dvid.Command{"node", string(root), "niftidata", "export", "nifti", filename}}
+	c.Assert(grayscale.exportNiftiCommand(request, root, filename), IsNil)
+
+	vol, err := readNiftiFile(filename)
+	c.Assert(err, IsNil)
+	c.Assert(vol.Size, Equals, size)
+	c.Assert(vol.Data, DeepEquals, data)
+
+	// Loading stacks the volume at the offset and sets the resolution.
+	grayscale2 := suite.makeGrayscale(c, root, "niftiload")
+	c.Assert(LoadImages(context.Background(), grayscale2, root, dvid.Point3d{0, 0, 10}, []string{filename}, dvid.NewConfig()), IsNil)
+	v, err := grayscale2.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 10}, size), nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale2, v), IsNil)
+	c.Assert(v.Data(), DeepEquals, data)
+	c.Assert(grayscale2.VoxelUnits[0], Equals, "micrometers")
+}
+
+func (suite *TestSuite) TestExportChecksums(c *C) {
+	root, grayscale := suite.newGrayscale(c, "checksummed")
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{40, 10, 5}
+	data := putVolume(c, root, grayscale, offset, size)
+
+	// A NIfTI export with checksums can be verified on load.
+	dir := c.MkDir()
+	filename := filepath.Join(dir, "gray.nii")
+	request := datastore.Request{Command: dvid.Command{"node", string(root), "checksummed", "export", "nifti",
+		filename, "checksums=true"}}
+	c.Assert(grayscale.exportNiftiCommand(request, root, filename), IsNil)
+	config := dvid.NewConfig()
+	config.Set("checksums", filename+".checksums.json")
+	loaded := suite.makeGrayscale(c, root, "checksumload")
+	c.Assert(LoadImages(context.Background(), loaded, root, offset, []string{filename}, config), IsNil)
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0644)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte{1}, 400)
+	c.Assert(err, IsNil)
+	f.Close()
+	err = LoadImages(context.Background(), loaded, root, offset, []string{filename}, config)
+	c.Assert(err, ErrorMatches, ".*checksum.*")
+
+	// Chunked exports list every object.
+	zarrDir := c.MkDir()
+	request = datastore.Request{Command: dvid.Command{"node", string(root), "checksummed", "export", "zarr",
+		zarrDir, "checksums=true"}}
+	c.Assert(grayscale.exportCommand(request, &datastore.Response{}), IsNil)
+	m, err := ioutil.ReadFile(filepath.Join(zarrDir, dvid.ChecksumManifestName))
+	c.Assert(err, IsNil)
+	manifest, err := dvid.ReadChecksumManifest(m)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Has(".zarray"), Equals, true)
+	c.Assert(manifest.Has("0.0.0"), Equals, true)
+	chunk, err := ioutil.ReadFile(filepath.Join(zarrDir, "0.0.1"))
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Verify("0.0.1", chunk), IsNil)
+}
+
+func (suite *TestSuite) TestTranscodeVoxels(c *C) {
+	root, grayscale := suite.newGrayscale(c, "nrrddata")
+
+	offset := dvid.Point3d{10, 20, 30}
+	size := dvid.Point3d{20, 10, 5}
+	data := MakeVolume(offset, size)
+	subvol := dvid.NewSubvolume(offset, size)
+	v, err := grayscale.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(grayscale.EncodeArray(&buf, v, "nrrd:gzip"), IsNil)
+	r, err := http.NewRequest("POST", "/", bytes.NewReader(buf.Bytes()))
+	c.Assert(err, IsNil)
+	r.Header.Set("Content-Type", dvid.NrrdContentType)
+	read, err := grayscale.ReadArrayHttp(r, subvol, "")
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, data)
+
+	// An XZ slice has voxel sizes from the X and Z resolution.
+	slice, err := dvid.NewOrthogSlice(dvid.XZ, offset, dvid.Point2d{20, 5})
+	c.Assert(err, IsNil)
+	e, err := grayscale.NewExtHandler(slice, nil)
+	c.Assert(err, IsNil)
+	a, err := grayscale.NewArray(e)
+	c.Assert(err, IsNil)
+	c.Assert(a.VoxelSize, HasLen, 2)
+
+	// Sizes must match the requested geometry.
+	buf.Reset()
+	c.Assert(grayscale.EncodeArray(&buf, v, "nrrd"), IsNil)
+	r, err = http.NewRequest("POST", "/", bytes.NewReader(buf.Bytes()))
+	c.Assert(err, IsNil)
+	_, err = grayscale.ReadArrayHttp(r, dvid.NewSubvolume(offset, dvid.Point3d{20, 10, 4}), "nrrd")
+	c.Assert(err, NotNil)
+
+	// Images are POSTed as octet-stream by many clients, so raw slices need a format.
+	r.Header.Set("Content-Type", "application/octet-stream")
+	c.Assert(isArrayPost(r, ""), Equals, false)
+	c.Assert(isArrayPost(r, "raw"), Equals, true)
+	c.Assert(isArrayPost(r, "png"), Equals, false)
+	r.Header.Set("Content-Type", dvid.NrrdContentType)
+	c.Assert(isArrayPost(r, ""), Equals, true)
+}
+
+func (suite *TestSuite) TestExportChunked(c *C) {
+	root, grayscale := suite.newGrayscale(c, "chunkexport")
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{40, 40, 40}
+	data := putVolume(c, root, grayscale, offset, size)
+
+	dir := c.MkDir()
+	store := storage.NewDirStore(dir)
+	w, err := NewExportWriter(store, "precomputed", root, "chunkexport", 3, true)
+	c.Assert(err, IsNil)
+	c.Assert(ExportPrecomputed(context.Background(), root, grayscale, &(grayscale.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	// Chunks are clipped to the volume and match the served layout.
+	chunk, err := store.GetObject("s0/32-40_0-32_0-32")
+	c.Assert(err, IsNil)
+	c.Assert(chunk, HasLen, 8*32*32)
+	c.Assert(chunk[0:8], DeepEquals, data[32:40])
+	info, err := store.GetObject("info")
+	c.Assert(err, IsNil)
+	c.Assert(string(info), Matches, `(?s).*"voxel_offset".*`)
+
+	manifest, segments, err := readExportManifest(store)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Finished, Equals, true)
+	var completed int
+	for _, segment := range segments {
+		completed += len(segment.Completed)
+	}
+	c.Assert(completed, Equals, 1+8+1)
+
+	// Segments only hold the keys completed since the previous save.
+	defer func(interval int) { exportManifestInterval = interval }(exportManifestInterval)
+	exportManifestInterval = 2
+	w, err = NewExportWriter(store, "precomputed", root, "chunkexport", 1, false)
+	c.Assert(err, IsNil)
+	c.Assert(ExportPrecomputed(context.Background(), root, grayscale, &(grayscale.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+	manifest, segments, err = readExportManifest(store)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Segments, Equals, 5)
+	for _, segment := range segments {
+		c.Assert(segment.Completed, HasLen, 2)
+	}
+
+	// Resuming skips completed chunks.
+	c.Assert(store.PutObject("s0/32-40_0-32_0-32", []byte("kept")), IsNil)
+	w, err = NewExportWriter(store, "precomputed", root, "chunkexport", 3, true)
+	c.Assert(err, IsNil)
+	c.Assert(w.Completed("s0/32-40_0-32_0-32"), Equals, true)
+	c.Assert(ExportPrecomputed(context.Background(), root, grayscale, &(grayscale.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+	chunk, err = store.GetObject("s0/32-40_0-32_0-32")
+	c.Assert(err, IsNil)
+	c.Assert(string(chunk), Equals, "kept")
+
+	// Checksums of chunks uploaded before resuming come from the export manifest rather
+	// than reading the chunks back.
+	w, err = NewExportWriter(store, "precomputed", root, "chunkexport", 3, false)
+	c.Assert(err, IsNil)
+	w.AddChecksums("resume test")
+	c.Assert(ExportPrecomputed(context.Background(), root, grayscale, &(grayscale.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+	original, err := store.GetObject("s0/32-40_0-32_0-32")
+	c.Assert(err, IsNil)
+	c.Assert(store.PutObject("s0/32-40_0-32_0-32", []byte("kept")), IsNil)
+	w, err = NewExportWriter(store, "precomputed", root, "chunkexport", 3, true)
+	c.Assert(err, IsNil)
+	w.AddChecksums("resume test")
+	c.Assert(ExportPrecomputed(context.Background(), root, grayscale, &(grayscale.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+	m, err := store.GetObject(dvid.ChecksumManifestName)
+	c.Assert(err, IsNil)
+	checksums, err := dvid.ReadChecksumManifest(m)
+	c.Assert(err, IsNil)
+	c.Assert(checksums.Verify("s0/32-40_0-32_0-32", original), IsNil)
+
+	// Zarr chunks are whole blocks in (z, y, x) key order.
+	zarrDir := c.MkDir()
+	request := datastore.Request{Command: dvid.Command{"node", string(root), "chunkexport", "export", "zarr",
+		zarrDir, "uploads=2"}}
+	c.Assert(grayscale.exportCommand(request, &datastore.Response{}), IsNil)
+	zarrStore := storage.NewDirStore(zarrDir)
+	chunk, err = zarrStore.GetObject("0.0.1")
+	c.Assert(err, IsNil)
+	c.Assert(chunk, HasLen, 32*32*32)
+	c.Assert(chunk[0:8], DeepEquals, data[32:40])
+	c.Assert(chunk[8:32], DeepEquals, make([]byte, 24))
+	zarray, err := zarrStore.GetObject(".zarray")
+	c.Assert(err, IsNil)
+	c.Assert(zarray, NotNil)
+}
+
+func (suite *TestSuite) TestIsosurface(c *C) {
+	root, grayscale := suite.newGrayscale(c, "isosurface")
+
+	// A bright 8x8x8 cube within a dark 32x32x32 subvolume.
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{32, 32, 32}
+	data := make([]byte, size.Prod())
+	for z := 8; z < 16; z++ {
+		for y := 8; y < 16; y++ {
+			for x := 8; x < 16; x++ {
+				data[z*32*32+y*32+x] = 200
+			}
+		}
+	}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	get := func(args ...string) (*httptest.ResponseRecorder, error) {
+		parts := append([]string{"api", "node", string(root), "isosurface"}, args...)
+		r := httptest.NewRequest("GET", "/"+strings.Join(parts, "/"), nil)
+		w := httptest.NewRecorder()
+		return w, ServeIsosurface(w, r, root, grayscale, &(grayscale.Properties), parts)
+	}
+
+	w, err := get("100", "32_32_32", "0_0_0", "binary")
+	c.Assert(err, IsNil)
+	var header [2]uint32
+	c.Assert(binary.Read(w.Body, binary.LittleEndian, &header), IsNil)
+	c.Assert(header[1] > 0, Equals, true)
+	vertices := make([]float32, 3*header[0])
+	c.Assert(binary.Read(w.Body, binary.LittleEndian, vertices), IsNil)
+	for _, coord := range vertices {
+		c.Assert(coord >= 7.5 && coord <= 15.5, Equals, true)
+	}
+
+	w, err = get("100", "32_32_32", "0_0_0")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(w.Body.String(), "v "), Equals, true)
+
+	w, err = get("201", "32_32_32", "0_0_0", "obj")
+	c.Assert(err, IsNil)
+	c.Assert(w.Body.Len(), Equals, 0)
+
+	_, err = get("100", "32_32_32", "0_0_0", "stl")
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestConnectedComponents(c *C) {
+	root, grayscale := suite.newGrayscale(c, "components")
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 64, 64}
+	data := make([]byte, size.Prod())
+	set := func(x, y, z int32) dvid.Point3d {
+		data[z*64*64+y*64+x] = 200
+		return dvid.Point3d{x, y, z}
+	}
+
+	// An L-shaped path crossing blocks, a small cube, and a U whose arms are in
+	// different blocks and only join in a later block.
+	var path, cube, u []dvid.Point3d
+	for n := int32(0); n <= 40; n++ {
+		path = append(path, set(n, 5, 5), set(40, 5+n, 5))
+	}
+	for z := int32(50); z < 56; z++ {
+		for y := int32(50); y < 56; y++ {
+			for x := int32(50); x < 56; x++ {
+				cube = append(cube, set(x, y, z))
+			}
+		}
+	}
+	for y := int32(10); y <= 60; y++ {
+		u = append(u, set(20, y, 40), set(44, y, 40))
+	}
+	for x := int32(20); x <= 44; x++ {
+		u = append(u, set(x, 60, 40))
+	}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	labels := make(map[dvid.Point3d]uint64)
+	write := func(subvol *dvid.Subvolume, blockLabels []uint64) error {
+		start := subvol.StartPoint().(dvid.Point3d)
+		size := subvol.Size().(dvid.Point3d)
+		for n, label := range blockLabels {
+			if label != 0 {
+				x, y, z := int32(n)%size[0], (int32(n)/size[0])%size[1], int32(n)/(size[0]*size[1])
+				labels[dvid.Point3d{start[0] + x, start[1] + y, start[2] + z}] = label
+			}
+		}
+		return nil
+	}
+	var lastProgress float32
+	numComponents, err := ConnectedComponents(context.Background(), root, grayscale, &(grayscale.Properties),
+		100, write, func(f float32) { lastProgress = f })
+	c.Assert(err, IsNil)
+	c.Assert(numComponents, Equals, uint64(3))
+	c.Assert(lastProgress, Equals, float32(1))
+	c.Assert(labels, HasLen, len(path)-1+len(cube)+len(u)-2)
+
+	componentLabel := func(pts []dvid.Point3d) uint64 {
+		label := labels[pts[0]]
+		c.Assert(label, Not(Equals), uint64(0))
+		for _, pt := range pts {
+			c.Assert(labels[pt], Equals, label, Commentf("voxel %s", pt))
+		}
+		return label
+	}
+	found := map[uint64]bool{componentLabel(path): true, componentLabel(cube): true, componentLabel(u): true}
+	c.Assert(found, HasLen, 3)
+
+	numComponents, err = ConnectedComponents(context.Background(), root, grayscale, &(grayscale.Properties),
+		201, write, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numComponents, Equals, uint64(0))
+}
+
+func (suite *TestSuite) TestAsyncPost(c *C) {
+	root, grayscale := suite.newGrayscale(c, "asyncpost")
+
+	offset := dvid.Point3d{10, 20, 30}
+	size := dvid.Point3d{40, 30, 20}
+	data := MakeVolume(offset, size)
+	r := httptest.NewRequest("POST", "/api/node/"+string(root)+"/asyncpost/raw/0_1_2/40_30_20/10_20_30?async=true",
+		bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	var reply struct{ Job int }
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &reply), IsNil)
+
+	job, err := server.GetJob(reply.Job)
+	c.Assert(err, IsNil)
+	for {
+		job.RLock()
+		status := job.Status
+		job.RUnlock()
+		if status != server.JobRunning {
+			c.Assert(status, Equals, server.JobDone)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(server.MemoryReserved(), Equals, int64(0))
+
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+	c.Assert(err, IsNil)
+	stored, err := GetVolume(context.Background(), root, grayscale, v)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, data)
+}
+
+func (suite *TestSuite) TestStrongConsistency(c *C) {
+	root, grayscale := suite.newGrayscale(c, "consistent")
+
+	// A strong read observes an async write acknowledged before it in its session.
+	offset := dvid.Point3d{10, 20, 30}
+	size := dvid.Point3d{40, 30, 20}
+	data := MakeVolume(offset, size)
+	url := "/api/node/" + string(root) + "/consistent/raw/0_1_2/40_30_20/10_20_30"
+	r := httptest.NewRequest("POST", url+"?async=true&session=ingest", bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	r, err := server.UseConsistency(httptest.NewRequest("GET", url+"?consistency=strong&session=ingest", nil))
+	c.Assert(err, IsNil)
+	w = httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Body.Bytes(), DeepEquals, data)
+}
+func (suite *TestSuite) TestMultipartUpload(c *C) {
+	root, grayscale := suite.newGrayscale(c, "upload")
+
+	server.UploadDir = c.MkDir()
+	defer func() { server.UploadDir = "" }()
+
+	// A POST with an upload stores the concatenated parts.
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{32, 32, 32}
+	data := MakeVolume(offset, size)
+	upload, err := server.NewUpload("")
+	c.Assert(err, IsNil)
+	half := len(data) / 2
+	_, err = upload.PutPart(2, bytes.NewReader(data[half:]))
+	c.Assert(err, IsNil)
+	_, err = upload.PutPart(1, bytes.NewReader(data[:half]))
+	c.Assert(err, IsNil)
+
+	r := httptest.NewRequest("POST", "/api/node/"+string(root)+"/upload/raw/0_1_2/32_32_32/0_0_0?upload="+upload.ID, nil)
+	done, err := server.UseUpload(r)
+	c.Assert(err, IsNil)
+	err = grayscale.DoHTTP(root, httptest.NewRecorder(), r)
+	done(err == nil)
+	c.Assert(err, IsNil)
+
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+	c.Assert(err, IsNil)
+	stored, err := GetVolume(context.Background(), root, grayscale, v)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, data)
+}
+func (suite *TestSuite) TestCopyRegion(c *C) {
+	root, src := suite.newGrayscale(c, "copysrc")
+	dst := suite.makeGrayscale(c, root, "copydst")
+
+	ctx := context.Background()
+	volume := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64})
+	srcData := MakeVolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64})
+	v, err := src.NewExtHandler(volume, srcData)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(ctx, root, src, v), IsNil)
+	dstData := bytes.Repeat([]byte{7}, 64*64*64)
+	v, err = dst.NewExtHandler(volume, append([]byte{}, dstData...))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(ctx, root, dst, v), IsNil)
+
+	// The region crosses block boundaries without being aligned to them.
+	region := dvid.NewSubvolume(dvid.Point3d{10, 20, 30}, dvid.Point3d{40, 30, 25})
+	var lastProgress float32
+	c.Assert(CopyRegion(ctx, root, dst, root, src, region, func(f float32) { lastProgress = f }), IsNil)
+	c.Assert(lastProgress, Equals, float32(1))
+
+	v, err = dst.NewExtHandler(volume, nil)
+	c.Assert(err, IsNil)
+	copied, err := GetVolume(ctx, root, dst, v)
+	c.Assert(err, IsNil)
+	for z := int32(0); z < 64; z++ {
+		for y := int32(0); y < 64; y++ {
+			for x := int32(0); x < 64; x++ {
+				i := z*64*64 + y*64 + x
+				expected := dstData[i]
+				if x >= 10 && x < 50 && y >= 20 && y < 50 && z >= 30 && z < 55 {
+					expected = srcData[i]
+				}
+				if copied[i] != expected {
+					c.Fatalf("Voxel (%d,%d,%d) is %d, expected %d", x, y, z, copied[i], expected)
+				}
+			}
+		}
+	}
+}
+
+func (suite *TestSuite) TestOrientation(c *C) {
+	root, grayscale := suite.newGrayscale(c, "orient")
+
+	volume := MakeVolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64})
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64}), volume)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	voxel := func(x, y, z int) byte { return volume[z*64*64+y*64+x] }
+
+	get := func(endpoint string) []byte {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/orient/raw/"+endpoint, nil)
+		w := httptest.NewRecorder()
+		c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+		return w.Body.Bytes()
+	}
+
+	// Subvolume of 4 x 3 x 2 at (1,2,3) returned as 2 x 3 x 4 with x and z swapped and
+	// the new x (old z) reversed.
+	data := get("0_1_2/4_3_2/1_2_3/raw?axes=zyx&flip=x")
+	c.Assert(data, HasLen, 24)
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 3; y++ {
+			for z := 0; z < 2; z++ {
+				c.Assert(data[x*2*3+y*2+(1-z)], Equals, voxel(1+x, 2+y, 3+z))
+			}
+		}
+	}
+
+	// Transposed and flipped XY slice.
+	data = get("0_1/5_3/10_20_30/raw?axes=yx&flip=y")
+	c.Assert(data, HasLen, 15)
+	for x := 0; x < 5; x++ {
+		for y := 0; y < 3; y++ {
+			c.Assert(data[(4-x)*3+y], Equals, voxel(10+x, 20+y, 30))
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/orient/raw/0_1/5_3/10_20_30/raw?axes=zx", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), NotNil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (suite *TestSuite) TestAffineCutout(c *C) {
+	root, grayscale := suite.newGrayscale(c, "affine")
+
+	volume := make([]byte, 64*64*64)
+	for n := range volume {
+		volume[n] = byte(2 * (n % 64)) // Increases along x.
+	}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64}), volume)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	get := func(endpoint string) []byte {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/affine/affine/"+endpoint, nil)
+		w := httptest.NewRecorder()
+		c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+		return w.Body.Bytes()
+	}
+
+	// A translation returns the same voxels as a raw request.
+	data := get("8_4_2/1_0_0_10_0_1_0_20_0_0_1_30")
+	c.Assert(data, HasLen, 64)
+	for n, value := range data {
+		c.Assert(value, Equals, byte(2*(10+n%8)))
+	}
+
+	// Half-voxel shifts interpolate, unless the nearest voxel is requested.
+	data = get("4_1_1/1_0_0_10.5_0_1_0_20_0_0_1_30")
+	c.Assert(data, DeepEquals, []byte{21, 23, 25, 27})
+	data = get("4_1_1/1_0_0_10.4_0_1_0_20_0_0_1_30?interpolation=nearest")
+	c.Assert(data, DeepEquals, []byte{20, 22, 24, 26})
+
+	// Swapping x and y samples the constant y direction, and voxels outside are 0.
+	data = get("3_1_1/0_1_0_5_1_0_0_0_0_0_1_0")
+	c.Assert(data, DeepEquals, []byte{10, 10, 10})
+	data = get("2_1_1/1_0_0_63_0_1_0_0_0_0_1_0")
+	c.Assert(data, DeepEquals, []byte{126, 0})
+
+	// Bad sizes and matrices are rejected before anything is allocated.
+	for _, endpoint := range []string{
+		"-4_1_1/1_0_0_0_0_1_0_0_0_0_1_0",
+		"2000_2000_2000/1_0_0_0_0_1_0_0_0_0_1_0",
+		"4_1_1/1_0_0_NaN_0_1_0_0_0_0_1_0",
+		"4_1_1/1_0_0_0_1_0_0_0_0_0_1_0",
+		"4_4_4/1e9_0_0_0_0_1e9_0_0_0_0_1e9_0",
+	} {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/affine/affine/"+endpoint, nil)
+		w := httptest.NewRecorder()
+		c.Assert(grayscale.DoHTTP(root, w, r), NotNil, Commentf("endpoint %s", endpoint))
+	}
+}
+
+func (suite *TestSuite) TestContrast(c *C) {
+	root, grayscale := suite.newGrayscale(c, "contrast")
+
+	// A dim slice with four equally common values.
+	slice := make([]byte, 32*32)
+	for n := range slice {
+		slice[n] = byte(100 + n%4)
+	}
+	geom, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{0, 0, 5}, dvid.Point2d{32, 32})
+	c.Assert(err, IsNil)
+	v, err := grayscale.NewExtHandler(geom, slice)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	get := func(query string) []byte {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/contrast/raw/0_1/32_32/0_0_5/raw?"+query, nil)
+		w := httptest.NewRecorder()
+		c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+		return w.Body.Bytes()
+	}
+	equalized := get("contrast=equalize")
+	c.Assert(equalized, HasLen, len(slice))
+	for n, value := range equalized {
+		c.Assert(value, Equals, []byte{0, 85, 170, 255}[n%4])
+	}
+
+	// CLAHE with one unclipped tile is global equalization.
+	c.Assert(get("contrast=clahe&tilesize=32&cliplimit=100"), DeepEquals, equalized)
+
+	// Clipping limits the stretch.
+	clipped := get("contrast=clahe&tilesize=8&cliplimit=1")
+	c.Assert(clipped[3]-clipped[0] < 255, Equals, true)
+	c.Assert(clipped[3] > clipped[0], Equals, true)
+
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/contrast/raw/0_1_2/8_8_8/0_0_0?contrast=equalize", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), NotNil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	// Tile sizes beyond int32 are rejected rather than wrapping to 0.
+	r = httptest.NewRequest("GET", "/api/node/"+string(root)+"/contrast/raw/0_1/32_32/0_0_5/raw?contrast=clahe&tilesize=4294967296", nil)
+	c.Assert(grayscale.DoHTTP(root, httptest.NewRecorder(), r), NotNil)
+}
+
+type testPoints []dvid.Point3d
+
+func (pts testPoints) AnnotationPoints(uuid dvid.UUID, minPt, maxPt dvid.Point3d) ([]dvid.Point3d, error) {
+	return pts, nil
+}
+
+func (suite *TestSuite) TestOverlay(c *C) {
+	root, grayscale := suite.newGrayscale(c, "overlaygray")
+	labels := suite.makeGrayscale(c, root, "overlaylabels")
+
+	// Gray slice with label 7 on its right half.
+	geom, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{0, 0, 5}, dvid.Point2d{16, 16})
+	c.Assert(err, IsNil)
+	graySlice := make([]byte, 16*16)
+	labelSlice := make([]byte, 16*16)
+	for n := range graySlice {
+		graySlice[n] = 100
+		if n%16 >= 8 {
+			labelSlice[n] = 7
+		}
+	}
+	for _, put := range []struct {
+		data  *Data
+		slice []byte
+	}{{grayscale, graySlice}, {labels, labelSlice}} {
+		v, err := put.data.NewExtHandler(geom, put.slice)
+		c.Assert(err, IsNil)
+		c.Assert(PutVoxels(context.Background(), root, put.data, v), IsNil)
+	}
+
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/overlaygray/overlay/xy/16_16/0_0_5/png?labels=overlaylabels&alpha=0.5", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+	c.Assert(w.Header().Get("Content-type"), Equals, "image/png")
+	img, err := png.Decode(w.Body)
+	c.Assert(err, IsNil)
+	c.Assert(color.NRGBAModel.Convert(img.At(2, 2)), Equals, color.NRGBA{100, 100, 100, 255})
+	labelColor := LabelColor(7)
+	blend := func(c uint8) uint8 { return uint8(0.5*100 + 0.5*float64(c) + 0.5) }
+	c.Assert(color.NRGBAModel.Convert(img.At(12, 2)), Equals,
+		color.NRGBA{blend(labelColor.R), blend(labelColor.G), blend(labelColor.B), 255})
+
+	// Points on the slice are drawn with the full radius, ones farther than it are hidden.
+	pts := testPoints{{4, 4, 5}, {12, 12, 9}}
+	rendered, err := RenderOverlay(context.Background(), root, grayscale, &(grayscale.Properties),
+		geom, nil, nil, pts, 0.5, 2)
+	c.Assert(err, IsNil)
+	c.Assert(rendered.NRGBAAt(4, 6), Equals, annotationColor)
+	c.Assert(rendered.NRGBAAt(4, 7), Equals, color.NRGBA{100, 100, 100, 255})
+	c.Assert(rendered.NRGBAAt(12, 12), Equals, color.NRGBA{100, 100, 100, 255})
+
+	// Annotations must come from data holding points.
+	r = httptest.NewRequest("GET", "/api/node/"+string(root)+"/overlaygray/overlay/xy/16_16/0_0_5?annotations=overlaylabels", nil)
+	c.Assert(grayscale.DoHTTP(root, httptest.NewRecorder(), r), NotNil)
+
+	// The radius is capped.
+	r = httptest.NewRequest("GET", "/api/node/"+string(root)+"/overlaygray/overlay/xy/16_16/0_0_5?radius=65536", nil)
+	c.Assert(grayscale.DoHTTP(root, httptest.NewRecorder(), r), NotNil)
+}
+
+func (suite *TestSuite) TestColormap(c *C) {
+	var cm Colormap
+	c.Assert(json.Unmarshal([]byte(`{"1": "#ff0000", "2": "#00ff0080", "3": "#0000ff"}`), &cm), IsNil)
+	c.Assert(cm.Color(1), Equals, color.NRGBA{255, 0, 0, 255})
+	c.Assert(cm.Color(2), Equals, color.NRGBA{0, 255, 0, 128})
+	c.Assert(cm.Color(4), Equals, LabelColor(4))
+	c.Assert(cm.Color(0), Equals, color.NRGBA{})
+
+	// Edits merge colors and remove labels with null colors.
+	red := "#ff0000ff"
+	c.Assert(cm.Edit(map[string]*string{"3": nil, "5": &red}), IsNil)
+	b, err := json.Marshal(cm)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `{"1":"#ff0000ff","2":"#00ff0080","5":"#ff0000ff"}`)
+	bad := "red"
+	c.Assert(cm.Edit(map[string]*string{"6": &bad}), NotNil)
+	c.Assert(cm.Edit(map[string]*string{"x": &red}), NotNil)
+
+	// Render a slice of labels.
+	root, labels := suite.newGrayscale(c, "colormaplabels")
+	geom, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{0, 0, 0}, dvid.Point2d{4, 1})
+	c.Assert(err, IsNil)
+	e, err := labels.NewExtHandler(geom, []byte{0, 1, 2, 7})
+	c.Assert(err, IsNil)
+	img, err := cm.Render(e)
+	c.Assert(err, IsNil)
+	rendered := img.Get()
+	for x, expected := range []color.NRGBA{{}, cm[1], cm[2], LabelColor(7)} {
+		c.Assert(color.NRGBAModel.Convert(rendered.At(x, 0)), Equals, expected)
+	}
+
+	// Data without stored colormaps only has the default one.
+	_, err = GetColormap(labels, DefaultColormap)
+	c.Assert(err, IsNil)
+	_, err = GetColormap(labels, "proofreading")
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestThresholdSpans(c *C) {
+	root, grayscale := suite.newGrayscale(c, "thresholdroi")
+
+	// Two bright voxels in adjacent blocks along x and a dim voxel in a far block.
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 64, 64}
+	data := make([]byte, size.Prod())
+	data[5*64*64+5*64+5] = 200
+	data[5*64*64+5*64+40] = 200
+	data[50*64*64+50*64+50] = 50
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	var lastProgress float32
+	spans, err := ThresholdSpans(context.Background(), root, grayscale, &(grayscale.Properties),
+		100, func(f float32) { lastProgress = f })
+	c.Assert(err, IsNil)
+	c.Assert(lastProgress, Equals, float32(1))
+	c.Assert(spans, DeepEquals, []roi.Span{{0, 0, 0, 1}})
+
+	spans, err = ThresholdSpans(context.Background(), root, grayscale, &(grayscale.Properties), 1, nil)
+	c.Assert(err, IsNil)
+	c.Assert(spans, DeepEquals, []roi.Span{{0, 0, 0, 1}, {1, 1, 1, 1}})
+}
+
+func (suite *TestSuite) TestMorphology(c *C) {
+	root, grayscale := suite.newGrayscale(c, "morphology")
+
+	// A 10x10x10 cube crossing block boundaries.
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{64, 64, 64}
+	data := make([]byte, size.Prod())
+	for z := 28; z < 38; z++ {
+		for y := 28; y < 38; y++ {
+			for x := 28; x < 38; x++ {
+				data[z*64*64+y*64+x] = 1
+			}
+		}
+	}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	morph := func(op string, radius float64) []byte {
+		result := make([]byte, size.Prod())
+		write := func(subvol *dvid.Subvolume, tile []byte) error {
+			start := subvol.StartPoint().(dvid.Point3d)
+			tileSize := subvol.Size().(dvid.Point3d)
+			var n int32
+			for z := start[2]; z < start[2]+tileSize[2]; z++ {
+				for y := start[1]; y < start[1]+tileSize[1]; y++ {
+					for x := start[0]; x < start[0]+tileSize[0]; x++ {
+						result[(z*64+y)*64+x] = tile[n]
+						n++
+					}
+				}
+			}
+			return nil
+		}
+		err := Morphology(context.Background(), root, grayscale, &(grayscale.Properties), op,
+			offset, size, 1, radius, write, nil)
+		c.Assert(err, IsNil)
+		return result
+	}
+	count := func(result []byte) (n int) {
+		for _, value := range result {
+			if value != 0 {
+				c.Assert(value, Equals, byte(255))
+				n++
+			}
+		}
+		return
+	}
+
+	c.Assert(count(morph("erode", 1)), Equals, 8*8*8)
+	c.Assert(count(morph("dilate", 1)), Equals, 10*10*10+6*10*10)
+	c.Assert(count(morph("open", 1)), Equals, 8*8*8+6*8*8)
+	c.Assert(count(morph("close", 1)), Equals, 10*10*10)
+	c.Assert(count(morph("erode", 5)), Equals, 0)
+
+	dist := morph("distance", 3)
+	c.Assert(dist[(28*64+28)*64+28], Equals, byte(1))
+	c.Assert(dist[(29*64+30)*64+31], Equals, byte(2))
+	c.Assert(dist[(33*64+33)*64+33], Equals, byte(3))
+	c.Assert(dist[(27*64+33)*64+33], Equals, byte(0))
+
+	err = Morphology(context.Background(), root, grayscale, &(grayscale.Properties), "skeletonize",
+		offset, size, 1, 1, nil, nil)
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestSliceStack(c *C) {
+	root, grayscale := suite.newGrayscale(c, "slicedata")
+
+	// Each voxel's value is its z coordinate.
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{20, 10, 6}
+	data := make([]byte, size.Prod())
+	for i := range data {
+		data[i] = uint8(int32(i) / (size[0] * size[1]))
+	}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	stack := SliceStack{Format: "png", Offset: offset, Size: size}
+	files := make(map[string]image.Image)
+	write := func(filename string, encoded []byte) error {
+		img, err := png.Decode(bytes.NewReader(encoded))
+		files[filename] = img
+		return err
+	}
+	c.Assert(WriteSliceStack(context.Background(), root, grayscale, &(grayscale.Properties),
+		"slicedata", stack, write, nil), IsNil)
+	c.Assert(files, HasLen, 6)
+	img := files["slicedata-z000004.png"]
+	c.Assert(img, NotNil)
+	c.Assert(img.Bounds().Dx(), Equals, 20)
+	c.Assert(img.Bounds().Dy(), Equals, 10)
+	r, _, _, _ := img.At(5, 5).RGBA()
+	c.Assert(uint8(r>>8), Equals, uint8(4))
+
+	// At scale 1 there are half as many slices, each averaging two z.
+	stack.Scale = 1
+	files = make(map[string]image.Image)
+	c.Assert(WriteSliceStack(context.Background(), root, grayscale, &(grayscale.Properties),
+		"slicedata", stack, write, nil), IsNil)
+	c.Assert(files, HasLen, 3)
+	img = files["slicedata-z000002.png"]
+	c.Assert(img, NotNil)
+	c.Assert(img.Bounds().Dx(), Equals, 10)
+	c.Assert(img.Bounds().Dy(), Equals, 5)
+	r, _, _, _ = img.At(1, 1).RGBA()
+	c.Assert(uint8(r>>8) >= 4 && uint8(r>>8) <= 5, Equals, true)
+
+	// Stacks past 32-bit coordinates or with too many voxels per slice are rejected.
+	huge := SliceStack{Format: "png", Scale: 4, Offset: dvid.Point3d{math.MaxInt32 - 4, 0, 0}, Size: size}
+	c.Assert(huge.check(), NotNil)
+	huge = SliceStack{Format: "png", Offset: offset, Size: dvid.Point3d{1 << 20, 1 << 20, 1}}
+	c.Assert(huge.check(), NotNil)
+	huge = SliceStack{Format: "png", Scale: 16, Offset: offset, Size: dvid.Point3d{1 << 20, 1, 1}}
+	c.Assert(huge.check(), NotNil)
+
+	// An interrupted export job resumes after its last written slice.
+	dir := c.MkDir()
+	args := sliceExportArgs{root, "slicedata", dir, SliceStack{Format: "png", Offset: offset, Size: size}, true}
+	job, err := server.NewResumableJob(sliceExportJobKind, "Export slicedata", args)
+	c.Assert(err, IsNil)
+	for n := int32(0); n < 4; n++ {
+		filename := args.Stack.sliceFilename("slicedata", "png", n)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, filename), []byte{byte(n)}, 0644), IsNil)
+	}
+	m, err := json.Marshal(args)
+	c.Assert(err, IsNil)
+	c.Assert(resumeSliceExport(context.Background(), job, m, []byte(`{"Slices": 4}`)), IsNil)
+	written, err := ioutil.ReadFile(filepath.Join(dir, "slicedata-z000000.png"))
+	c.Assert(err, IsNil)
+	c.Assert(written, DeepEquals, []byte{0})
+	encoded, err := ioutil.ReadFile(filepath.Join(dir, "slicedata-z000005.png"))
+	c.Assert(err, IsNil)
+	img, err = png.Decode(bytes.NewReader(encoded))
+	c.Assert(err, IsNil)
+	r, _, _, _ = img.At(5, 5).RGBA()
+	c.Assert(uint8(r>>8), Equals, uint8(5))
+	checksums, err := ioutil.ReadFile(filepath.Join(dir, dvid.ChecksumManifestName))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(checksums, []byte("slicedata-z000000.png")), Equals, true)
+}
+
+func (suite *TestSuite) TestMirror(c *C) {
+	root, source := suite.newGrayscale(c, "mirrorsrc")
+	offset := dvid.Point3d{5, 3, 2}
+	size := dvid.Point3d{40, 36, 20}
+	data := putVolume(c, root, source, offset, size)
+
+	// The remote server serves the source data.
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/node/"+string(root)+"/mirrorsrc/") {
+			http.NotFound(w, r)
+			return
+		}
+		source.DoHTTP(root, w, r)
+	}))
+	defer remoteServer.Close()
+	remote, err := server.NewMirrorSource(remoteServer.URL, root, "mirrorsrc", 3)
+	c.Assert(err, IsNil)
+
+	// Mirror the extents of the remote data.
+	dest := suite.makeGrayscale(c, root, "mirrordst")
+	var fractions []float32
+	progress := func(f float32) { fractions = append(fractions, f) }
+	c.Assert(dest.Mirror(context.Background(), remote, root, dvid.NewConfig(), progress), IsNil)
+	c.Assert(len(fractions) > 0, Equals, true)
+	c.Assert(fractions[len(fractions)-1], Equals, float32(1))
+	v, err := dest.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, dest, v), IsNil)
+	c.Assert(v.Data(), DeepEquals, data)
+
+	// Mirror a region given by settings.
+	dest2 := suite.makeGrayscale(c, root, "mirrordst2")
+	settings := dvid.NewConfig()
+	settings.Set("offset", "10,10,10")
+	settings.Set("size", "8,8,4")
+	c.Assert(dest2.Mirror(context.Background(), remote, root, settings, nil), IsNil)
+	minPt, maxPt := dest2.VoxelExtents()
+	c.Assert(minPt, DeepEquals, dvid.Point(dvid.Point3d{10, 10, 10}))
+	c.Assert(maxPt, DeepEquals, dvid.Point(dvid.Point3d{17, 17, 13}))
+
+	missing, err := server.NewMirrorSource(remoteServer.URL, root, "nonexistent", 0)
+	c.Assert(err, IsNil)
+	c.Assert(dest2.Mirror(context.Background(), missing, root, dvid.NewConfig(), nil), NotNil)
+}
+
+func (suite *TestSuite) TestLabelPyramid(c *C) {
+	// The mode of a cell goes to the value counted most, with ties to the first value seen.
+	cell := []byte{1, 1, 2, 2, 2, 3, 3, 3}
+	down, err := downsampleLabels(cell, 1, dvid.Point3d{2, 2, 2}, 2, DownsampleMode)
+	c.Assert(err, IsNil)
+	c.Assert(down, DeepEquals, []byte{2})
+	down, err = downsampleLabels(cell, 1, dvid.Point3d{2, 2, 2}, 2, DownsampleCenter)
+	c.Assert(err, IsNil)
+	c.Assert(down, DeepEquals, []byte{3})
+	_, err = downsampleLabels(cell, 1, dvid.Point3d{2, 2, 2}, 2, "average")
+	c.Assert(err, NotNil)
+
+	// Every 2x2x2 cell has 200 at its first voxel and 10 elsewhere, so only the mode
+	// gives 10 at each level.
+	root, src := suite.newGrayscale(c, "pyramid")
+	size := dvid.Point3d{64, 64, 64}
+	data := bytes.Repeat([]byte{10}, int(size.Prod()))
+	for z := int32(0); z < size[2]; z += 2 {
+		for y := int32(0); y < size[1]; y += 2 {
+			for x := int32(0); x < size[0]; x += 2 {
+				data[(z*size[1]+y)*size[0]+x] = 200
+			}
+		}
+	}
+	v, err := src.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, src, v), IsNil)
+	c.Assert(NumPyramidLevels(src.Extents(), src.BlockSize()), Equals, 1)
+
+	var levels []IntHandler
+	for level := 1; level <= 2; level++ {
+		name := PyramidLevelName("pyramid", level)
+		c.Assert(name, Equals, dvid.DataString(fmt.Sprintf("pyramid-s%d", level)))
+		dest, err := src.newScaledData(root, "grayscale8", string(name), float32(int32(1)<<uint(level)))
+		c.Assert(err, IsNil)
+		c.Assert(dest.(*Data).VoxelSize[0], Equals, src.VoxelSize[0]*float32(int32(1)<<uint(level)))
+		levels = append(levels, dest)
+	}
+	c.Assert(BuildLabelPyramid(context.Background(), root, src, levels, DownsampleMode, nil), IsNil)
+	for n, level := range levels {
+		levelSize := dvid.Point3d{size[0] >> uint(n+1), size[1] >> uint(n+1), size[2] >> uint(n+1)}
+		c.Assert(level.Extents().MaxPoint, DeepEquals, dvid.Point3d{levelSize[0] - 1, levelSize[1] - 1, levelSize[2] - 1})
+		e, err := level.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, levelSize), nil)
+		c.Assert(err, IsNil)
+		c.Assert(GetVoxels(context.Background(), root, level, e), IsNil)
+		c.Assert(e.Data(), DeepEquals, bytes.Repeat([]byte{10}, int(levelSize.Prod())))
+	}
+
+	// Rebuilding after the source is cleared overwrites the old levels with background.
+	v, err = src.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, size), make([]byte, size.Prod()))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, src, v), IsNil)
+	c.Assert(BuildLabelPyramid(context.Background(), root, src, levels, DownsampleMode, nil), IsNil)
+	for n, level := range levels {
+		levelSize := dvid.Point3d{size[0] >> uint(n+1), size[1] >> uint(n+1), size[2] >> uint(n+1)}
+		e, err := level.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, levelSize), nil)
+		c.Assert(err, IsNil)
+		c.Assert(GetVoxels(context.Background(), root, level, e), IsNil)
+		c.Assert(e.Data(), DeepEquals, make([]byte, levelSize.Prod()))
+	}
+}
+
+func (suite *TestSuite) TestMultiscaleInfo(c *C) {
+	root, d := suite.newGrayscale(c, "scaled")
+	offset, size := dvid.Point3d{0, 0, 32}, dvid.Point3d{64, 64, 64}
+	putVolume(c, root, d, offset, size)
+	_, err := d.newScaledData(root, "grayscale8", "scaled-s1", 2)
+	c.Assert(err, IsNil)
+
+	jsonStr, err := d.InfoJSON(root, d)
+	c.Assert(err, IsNil)
+	var info struct {
+		Extents    Extents
+		Multiscale MultiscaleInfo
+	}
+	c.Assert(json.Unmarshal([]byte(jsonStr), &info), IsNil)
+	c.Assert(info.Multiscale.Axes, DeepEquals, []string{"X", "Y", "Z"})
+	c.Assert(info.Multiscale.Scales, DeepEquals, []ScaleInfo{
+		{Key: "s0", Level: 0, Resolution: []float32{8, 8, 8}, Units: []string{"nm", "nm", "nm"},
+			Offset: []int32{0, 0, 32}, Size: []int32{64, 64, 64}},
+		{Key: "s1", Level: 1, Data: "scaled-s1", Resolution: []float32{16, 16, 16}, Units: []string{"nm", "nm", "nm"},
+			Offset: []int32{0, 0, 16}, Size: []int32{32, 32, 32}},
+	})
+}
+
+func (suite *TestSuite) TestImportPrecomputed(c *C) {
+	root, source := suite.newGrayscale(c, "importsrc")
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{40, 40, 40}
+	data := putVolume(c, root, source, offset, size)
+
+	dir := c.MkDir()
+	store := storage.NewDirStore(dir)
+	w, err := NewExportWriter(store, "precomputed", root, "importsrc", 2, false)
+	c.Assert(err, IsNil)
+	w.AddChecksums("import test")
+	c.Assert(ExportPrecomputed(context.Background(), root, source, &(source.Properties), w), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	info, err := ReadPrecomputedInfo(store)
+	c.Assert(err, IsNil)
+	scales, err := importScales(info, "s0,1")
+	c.Assert(err, IsNil)
+	c.Assert(scales, HasLen, 2)
+	level, err := scaleLevel(scales[0], scales[1])
+	c.Assert(err, IsNil)
+	c.Assert(level, Equals, 1)
+	_, err = importScales(info, "s9")
+	c.Assert(err, NotNil)
+
+	dest := suite.makeGrayscale(c, root, "imported")
+	var fractions []float32
+	progress := func(f float32) { fractions = append(fractions, f) }
+	c.Assert(ImportPrecomputedScale(context.Background(), root, dest, &(dest.Properties), store, info,
+		scales[0], 3, progress), IsNil)
+	c.Assert(fractions[len(fractions)-1], Equals, float32(1))
+	v, err := dest.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, dest, v), IsNil)
+	c.Assert(v.Data(), DeepEquals, data)
+
+	// Chunks that don't match the checksum manifest are rejected.
+	chunkKey := fmt.Sprintf("%s/0-32_0-32_0-32", scales[0].Key)
+	chunk, err := store.GetObject(chunkKey)
+	c.Assert(err, IsNil)
+	c.Assert(chunk, NotNil)
+	chunk[0]++
+	c.Assert(store.PutObject(chunkKey, chunk), IsNil)
+	c.Assert(ImportPrecomputedScale(context.Background(), root, dest, &(dest.Properties), store, info,
+		scales[0], 3, nil), ErrorMatches, ".*checksum.*")
+
+	// Chunks must have positive sizes.
+	scale := *scales[0]
+	scale.ChunkSizes = [][3]int32{{0, 32, 32}}
+	c.Assert(ImportPrecomputedScale(context.Background(), root, dest, &(dest.Properties), store, info,
+		&scale, 3, nil), NotNil)
+
+	// Labels can't be imported into grayscale.
+	info.DataType = "uint64"
+	c.Assert(ImportPrecomputedScale(context.Background(), root, dest, &(dest.Properties), store, info,
+		scales[0], 3, nil), NotNil)
+}
+
+func (suite *TestSuite) TestCompressedSegmentation(c *C) {
+	// A 2x2x1 chunk in one 2x2x1 block with labels 7 and 9 indexed by 1 bit each.  Offsets
+	// in the block header are relative to the channel's start at word 1.
+	words := []uint32{
+		1,          // channel 0 offset
+		3 | 1<<24,  // lookup table offset and bits per index
+		2,          // encoded indices offset
+		0x6,        // indices 0, 1, 1, 0
+		7, 0, 9, 0, // uint64 lookup table
+	}
+	encoded := make([]byte, len(words)*4)
+	for n, w := range words {
+		binary.LittleEndian.PutUint32(encoded[n*4:], w)
+	}
+	raw, err := decodeCompressedSegmentation(encoded, dvid.T_uint64, 1, dvid.Point3d{2, 2, 1}, dvid.Point3d{2, 2, 1})
+	c.Assert(err, IsNil)
+	var labels []uint64
+	for n := 0; n < 4; n++ {
+		labels = append(labels, binary.LittleEndian.Uint64(raw[n*8:]))
+	}
+	c.Assert(labels, DeepEquals, []uint64{7, 9, 9, 7})
+
+	_, err = decodeCompressedSegmentation(encoded[:12], dvid.T_uint64, 1, dvid.Point3d{2, 2, 1}, dvid.Point3d{2, 2, 1})
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestWatchDirectory(c *C) {
+	z, err := SectionZ("/acquisition/run2_section_00123.png")
+	c.Assert(err, IsNil)
+	c.Assert(z, Equals, int32(123))
+	_, err = SectionZ("overview.png")
+	c.Assert(err, NotNil)
+
+	root, grayscale := suite.newGrayscale(c, "watched")
+	dir := c.MkDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = WatchDirectory(ctx, grayscale, root, dir, "s*.png", dvid.Point2d{}, 10, 10*time.Millisecond)
+	c.Assert(err, IsNil)
+	err = WatchDirectory(ctx, grayscale, root, dir, "*", dvid.Point2d{}, 0, time.Second)
+	c.Assert(err, NotNil)
+
+	// The same image deposited twice at a z is only ingested once, the same image at
+	// another z is ingested, and other names are ignored.  Bad files are retried a few
+	// times.
+	img := image.NewGray(image.Rect(0, 0, 10, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 77
+	}
+	for _, name := range []string{"s_002.png", "s_003.png", "s_retake_002.png", "notes_004.png"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		c.Assert(err, IsNil)
+		c.Assert(png.Encode(f, img), IsNil)
+		f.Close()
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "s_005.png"), []byte("not a png"), 0644), IsNil)
+	var statuses []WatchStatus
+	for tries := 0; tries < 200; tries++ {
+		statuses = WatchStatuses("watched")
+		if len(statuses) == 1 && statuses[0].Ingested+statuses[0].Duplicates == 3 &&
+			len(statuses[0].Errors) == maxIngestAttempts {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(statuses, HasLen, 1)
+	c.Assert(statuses[0].Ingested, Equals, 2)
+	c.Assert(statuses[0].Duplicates, Equals, 1)
+	c.Assert(statuses[0].LastFile, Equals, "s_003.png")
+	c.Assert(statuses[0].Errors, HasLen, maxIngestAttempts)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(WatchStatuses("watched")[0].Errors, HasLen, maxIngestAttempts)
+
+	slice, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{0, 0, 12}, dvid.Point2d{10, 8})
+	c.Assert(err, IsNil)
+	v, err := grayscale.NewExtHandler(slice, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v), IsNil)
+	c.Assert(v.Data()[0], Equals, byte(77))
+
+	c.Assert(StopWatching(root, "watched", dir), IsNil)
+	for tries := 0; tries < 100 && len(WatchStatuses("watched")) != 0; tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(WatchStatuses("watched"), HasLen, 0)
+}
+
+func (suite *TestSuite) TestMissingBlocks(c *C) {
+	root, grayscale := suite.newGrayscale(c, "missing")
+
+	// Write blocks (0, 0, 0) and (2, 0, 0), leaving a hole at (1, 0, 0).
+	size := dvid.Point3d{32, 32, 32}
+	for _, offset := range []dvid.Point3d{{0, 0, 0}, {64, 0, 0}} {
+		putVolume(c, root, grayscale, offset, size)
+	}
+
+	get := func(query string, args ...string) *MissingBlocks {
+		parts := append([]string{"api", "node", string(root), "missing", "missing"}, args...)
+		r := httptest.NewRequest("GET", "/"+strings.Join(parts, "/")+query, nil)
+		w := httptest.NewRecorder()
+		c.Assert(ServeMissing(w, r, root, grayscale, &(grayscale.Properties), parts), IsNil)
+		var missing MissingBlocks
+		c.Assert(json.NewDecoder(w.Body).Decode(&missing), IsNil)
+		return &missing
+	}
+	missing := get("", "96_32_32", "0_0_0")
+	c.Assert(missing.Blocks, Equals, int64(3))
+	c.Assert(missing.Missing, Equals, int64(1))
+	c.Assert(missing.Spans, DeepEquals, []roi.Span{{0, 0, 1, 1}})
+
+	// ROI blocks of 64 voxels cover two data blocks along each axis.
+	area, err := roi.NewData(root, "area", dvid.Point3d{64, 64, 64}, true)
+	c.Assert(err, IsNil)
+	c.Assert(area.PutSpans(root, []roi.Span{{0, 0, 0, 0}}), IsNil)
+	missing = get("?roi=area")
+	c.Assert(missing.Blocks, Equals, int64(8))
+	c.Assert(missing.Missing, Equals, int64(7))
+	missing = get("?roi=area", "128_32_32", "0_0_0")
+	c.Assert(missing.Blocks, Equals, int64(2))
+	c.Assert(missing.Spans, DeepEquals, []roi.Span{{0, 0, 1, 1}})
+
+	// Huge regions are refused unless an ROI limits them.
+	parts := []string{"api", "node", string(root), "missing", "missing", "2000000000_2000000000_2000000000", "0_0_0"}
+	r := httptest.NewRequest("GET", "/"+strings.Join(parts, "/"), nil)
+	c.Assert(ServeMissing(httptest.NewRecorder(), r, root, grayscale, &(grayscale.Properties), parts), NotNil)
+	missing = get("?roi=area", "2000000000_2000000000_2000000000", "0_0_0")
+	c.Assert(missing.Blocks, Equals, int64(8))
+}
+
+func (suite *TestSuite) TestUsageHeatmap(c *C) {
+	root, grayscale := suite.newGrayscale(c, "heat")
+
+	// A client read straddling the x boundary of the first cell counts in both cells.
+	get := func(offset string) {
+		r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/heat/raw/0_1_2/64_32_32/"+offset, nil)
+		w := httptest.NewRecorder()
+		c.Assert(grayscale.DoHTTP(root, w, r), IsNil)
+		c.Assert(w.Code, Equals, http.StatusOK)
+	}
+	get(fmt.Sprintf("%d_0_0", server.UsageCellSize-32))
+	get("0_0_0")
+
+	// Reads by the server, e.g., for exports, aren't counted.
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 32, 32}), nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	heatmap, err := server.UsageHeatmap(root, "heat", 0)
+	c.Assert(err, IsNil)
+	c.Assert(heatmap.Root, Equals, root)
+	c.Assert(heatmap.Cells, DeepEquals, []server.CellReads{
+		{dvid.Point3d{0, 0, 0}, 2},
+		{dvid.Point3d{1, 0, 0}, 1},
+	})
+
+	// Reads of a child version count toward the dataset root.
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	server.RecordDataRead(child, "heat")
+	server.RecordDataRead(root, "heat")
+	var found bool
+	for _, data := range server.Usage(0).Data {
+		if data.Root == root && data.Name == "heat" {
+			found = true
+			c.Assert(data.Reads, Equals, int64(2))
+			c.Assert(data.Hourly, HasLen, 1)
+		}
+	}
+	c.Assert(found, Equals, true)
+}
@@ -0,0 +1,682 @@
+/*
+	This file ingests existing Neuroglancer "precomputed" volumes, e.g., published datasets
+	in public buckets, into voxels data so they can be versioned.  Chunks of the selected
+	scales are fetched and decoded in parallel from a local directory, an HTTP server, or an
+	S3 or GCS bucket.  Raw, jpeg, and compressed_segmentation encodings are supported, but
+	sharded scales are not.  If the volume has a checksum manifest, dvid.ChecksumManifestName,
+	e.g., because it was exported by DVID, the info and chunks are verified against it.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultImportFetches is the default number of concurrent chunk fetches during an import.
+const DefaultImportFetches = 8
+
+// ReadPrecomputedInfo returns the info of the precomputed volume in a store, verifying it
+// against the store's checksum manifest if there is one.
+func ReadPrecomputedInfo(store storage.ObjectStore) (*PrecomputedInfo, error) {
+	checksums, err := readImportChecksums(store)
+	if err != nil {
+		return nil, err
+	}
+	m, err := store.GetObject("info")
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("No precomputed info found at %s", store)
+	}
+	if checksums != nil {
+		if err := checksums.Verify("info", m); err != nil {
+			return nil, err
+		}
+	}
+	info := new(PrecomputedInfo)
+	if err := json.Unmarshal(m, info); err != nil {
+		return nil, fmt.Errorf("Bad precomputed info at %s: %s", store, err.Error())
+	}
+	if info.NumChannels == 0 {
+		info.NumChannels = 1
+	}
+	return info, nil
+}
+
+// readImportChecksums returns the checksum manifest of a store or nil if it has none.
+func readImportChecksums(store storage.ObjectStore) (*dvid.ChecksumManifest, error) {
+	m, err := store.GetObject(dvid.ChecksumManifestName)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	checksums, err := dvid.ReadChecksumManifest(m)
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s at %s: %s", dvid.ChecksumManifestName, store, err.Error())
+	}
+	return checksums, nil
+}
+
+// precomputedDataType returns the DVID data type of a precomputed "data_type".
+func precomputedDataType(typeName string) (dvid.DataType, error) {
+	for t, name := range precomputedDataTypes {
+		if name == typeName {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("Unsupported precomputed data type %q", typeName)
+}
+
+// checkPrecomputedImport returns the source data type of a precomputed volume if its
+// scale can be imported into data with these properties.  Values must have the same type,
+// except uint32 labels can be widened to uint64.
+func (props *Properties) checkPrecomputedImport(info *PrecomputedInfo, scale *PrecomputedScale) (dvid.DataType, error) {
+	srcType, err := precomputedDataType(info.DataType)
+	if err != nil {
+		return 0, err
+	}
+	if props.BlockSize.NumDims() != 3 {
+		return 0, fmt.Errorf("Precomputed volumes can only be imported into 3d data")
+	}
+	if info.NumChannels != len(props.Values) {
+		return 0, fmt.Errorf("Precomputed volume has %d channels but data has %d values per voxel",
+			info.NumChannels, len(props.Values))
+	}
+	dstType, err := props.Values.ValueDataType()
+	if err != nil {
+		return 0, err
+	}
+	if srcType != dstType && !(srcType == dvid.T_uint32 && dstType == dvid.T_uint64) {
+		return 0, fmt.Errorf("Precomputed %s values can't be imported into data with values %v",
+			info.DataType, props.Values)
+	}
+	if len(scale.Sharding) != 0 {
+		return 0, fmt.Errorf("Sharded precomputed scale %q is not supported", scale.Key)
+	}
+	if len(scale.ChunkSizes) == 0 {
+		return 0, fmt.Errorf("Precomputed scale %q has no chunk sizes", scale.Key)
+	}
+	chunkVoxels := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		if scale.ChunkSizes[0][dim] <= 0 {
+			return 0, fmt.Errorf("Precomputed scale %q has bad chunk size %v", scale.Key, scale.ChunkSizes[0])
+		}
+		chunkVoxels *= int64(scale.ChunkSizes[0][dim])
+	}
+	if chunkVoxels > MaxVoxelsRequest {
+		return 0, fmt.Errorf("Precomputed scale %q chunks of %v voxels exceed %d voxels", scale.Key,
+			scale.ChunkSizes[0], MaxVoxelsRequest)
+	}
+	switch scale.Encoding {
+	case "raw":
+	case "jpeg":
+		if srcType != dvid.T_uint8 || (info.NumChannels != 1 && info.NumChannels != 3) {
+			return 0, fmt.Errorf("jpeg chunks must be uint8 with 1 or 3 channels")
+		}
+	case "compressed_segmentation":
+		if srcType != dvid.T_uint32 && srcType != dvid.T_uint64 {
+			return 0, fmt.Errorf("compressed_segmentation chunks must be uint32 or uint64")
+		}
+		if len(scale.CompressedSegmentationBlockSize) != 3 {
+			return 0, fmt.Errorf("Precomputed scale %q has no compressed_segmentation_block_size", scale.Key)
+		}
+	default:
+		return 0, fmt.Errorf("Unsupported precomputed encoding %q of scale %q", scale.Encoding, scale.Key)
+	}
+	return srcType, nil
+}
+
+// ImportPrecomputedScale writes the chunks of a scale of the precomputed volume in a store
+// into data i, with properties props, at a version.  Up to fetches chunks are read and
+// decoded at once, and missing chunks are skipped.  Chunks are verified against the
+// store's checksum manifest if there is one.  If progress is not nil, it's called with
+// the fraction of chunks done.
+func ImportPrecomputedScale(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	store storage.ObjectStore, info *PrecomputedInfo, scale *PrecomputedScale, fetches int,
+	progress func(float32)) error {
+
+	checksums, err := readImportChecksums(store)
+	if err != nil {
+		return err
+	}
+	return importPrecomputedChunks(ctx, uuid, i, props, store, checksums, info, scale, fetches, 0, progress, nil)
+}
+
+// importPrecomputedChunks imports the chunks of a scale in z, y, x order starting with
+// the given chunk number, verifying them against checksums if it's not nil.  If done is
+// not nil, it's called with the number of chunks imported without gaps, so an
+// interrupted import can be resumed from that chunk.
+func importPrecomputedChunks(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	store storage.ObjectStore, checksums *dvid.ChecksumManifest, info *PrecomputedInfo,
+	scale *PrecomputedScale, fetches int, start int, progress func(float32), done func(chunks int)) error {
+
+	srcType, err := props.checkPrecomputedImport(info, scale)
+	if err != nil {
+		return err
+	}
+	if fetches < 1 {
+		fetches = DefaultImportFetches
+	}
+	chunkSize := scale.ChunkSizes[0]
+	var chunks [][2][3]int32
+	var beg, end [3]int32
+	for beg[2] = scale.VoxelOffset[2]; beg[2] < scale.VoxelOffset[2]+scale.Size[2]; beg[2] += chunkSize[2] {
+		for beg[1] = scale.VoxelOffset[1]; beg[1] < scale.VoxelOffset[1]+scale.Size[1]; beg[1] += chunkSize[1] {
+			for beg[0] = scale.VoxelOffset[0]; beg[0] < scale.VoxelOffset[0]+scale.Size[0]; beg[0] += chunkSize[0] {
+				for dim := 0; dim < 3; dim++ {
+					end[dim] = beg[dim] + chunkSize[dim]
+					if limit := scale.VoxelOffset[dim] + scale.Size[dim]; end[dim] > limit {
+						end[dim] = limit
+					}
+				}
+				chunks = append(chunks, [2][3]int32{beg, end})
+			}
+		}
+	}
+
+	if start > len(chunks) {
+		start = len(chunks)
+	}
+	var mu sync.Mutex
+	imported := make([]bool, len(chunks))
+	next := start
+	chunkDone := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		imported[n] = true
+		for next < len(chunks) && imported[next] {
+			next++
+		}
+		if done != nil {
+			done(next)
+		}
+	}
+	remaining := chunks[start:]
+	var scaledProgress func(float32)
+	if progress != nil {
+		scaledProgress = func(f float32) {
+			progress((float32(start) + f*float32(len(remaining))) / float32(len(chunks)))
+		}
+	}
+
+	startTime := time.Now()
+	err = server.ForEachParallel(ctx, len(remaining), fetches, func(ctx context.Context, n int) error {
+		beg, end := remaining[n][0], remaining[n][1]
+		key := fmt.Sprintf("%s/%d-%d_%d-%d_%d-%d", scale.Key, beg[0], end[0], beg[1], end[1], beg[2], end[2])
+		encoded, err := storage.GetObjectContext(ctx, store, key)
+		if err != nil {
+			return err
+		}
+		if encoded == nil {
+			chunkDone(start + n)
+			return nil
+		}
+		if checksums != nil {
+			if err := checksums.Verify(key, encoded); err != nil {
+				return err
+			}
+		}
+		size := dvid.Point3d{end[0] - beg[0], end[1] - beg[1], end[2] - beg[2]}
+		raw, err := decodePrecomputedChunk(encoded, srcType, info.NumChannels, scale, size)
+		if err != nil {
+			return fmt.Errorf("Bad precomputed chunk %q: %s", key, err.Error())
+		}
+		data, err := fromPrecomputedRaw(raw, srcType, props.Values, props.ByteOrder, size)
+		if err != nil {
+			return err
+		}
+		e, err := i.NewExtHandler(dvid.NewSubvolume(dvid.Point3d(beg), size), data)
+		if err != nil {
+			return err
+		}
+		if err := PutVoxels(ctx, uuid, i, e); err != nil {
+			return err
+		}
+		chunkDone(start + n)
+		return nil
+	}, scaledProgress)
+	if err != nil {
+		return err
+	}
+	dvid.ElapsedTime(dvid.Debug, startTime, "Imported %d chunks of precomputed scale %s", len(remaining), scale.Key)
+	return nil
+}
+
+// decodePrecomputedChunk returns the raw encoding, i.e., little endian values with x
+// fastest and channel slowest, of a chunk with the given size.
+func decodePrecomputedChunk(encoded []byte, t dvid.DataType, numChannels int, scale *PrecomputedScale,
+	size dvid.Point3d) ([]byte, error) {
+
+	numBytes := size.Prod() * int64(numChannels) * int64(dvid.DataTypeBytes(t))
+	switch scale.Encoding {
+	case "raw":
+		if int64(len(encoded)) != numBytes {
+			return nil, fmt.Errorf("expected %d bytes for %s chunk, got %d", numBytes, size, len(encoded))
+		}
+		return encoded, nil
+	case "jpeg":
+		return decodePrecomputedJPEG(encoded, numChannels, size)
+	case "compressed_segmentation":
+		var blockSize dvid.Point3d
+		copy(blockSize[:], scale.CompressedSegmentationBlockSize)
+		return decodeCompressedSegmentation(encoded, t, numChannels, size, blockSize)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", scale.Encoding)
+}
+
+// decodePrecomputedJPEG decodes a jpeg chunk, which stacks the xy slices of the chunk
+// vertically, into planes of uint8 values.  The jpeg's dimensions are checked before
+// it's decoded so a bad chunk can't allocate more than the chunk size.
+func decodePrecomputedJPEG(encoded []byte, numChannels int, size dvid.Point3d) ([]byte, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if int32(config.Width) != size[0] || int64(config.Height) != int64(size[1])*int64(size[2]) {
+		return nil, fmt.Errorf("expected %d x %d jpeg for %s chunk, got %d x %d", size[0],
+			int64(size[1])*int64(size[2]), size, config.Width, config.Height)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	numVoxels := size.Prod()
+	raw := make([]byte, numVoxels*int64(numChannels))
+	var n int64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if numChannels == 1 {
+				raw[n] = color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+			} else {
+				r, g, b, _ := img.At(x, y).RGBA()
+				raw[n] = uint8(r >> 8)
+				raw[numVoxels+n] = uint8(g >> 8)
+				raw[2*numVoxels+n] = uint8(b >> 8)
+			}
+			n++
+		}
+	}
+	return raw, nil
+}
+
+// decodeCompressedSegmentation decodes a chunk in the Neuroglancer compressed_segmentation
+// format of uint32 or uint64 labels.  Each channel starts at a word offset given by the
+// chunk header and holds, for each block of the chunk's block grid, a two word header
+// giving the lookup table offset and bits per encoded value in the first word and the
+// offset of the bit-packed lookup table indices in the second.
+func decodeCompressedSegmentation(encoded []byte, t dvid.DataType, numChannels int, size, blockSize dvid.Point3d) ([]byte, error) {
+	if len(encoded)%4 != 0 {
+		return nil, fmt.Errorf("compressed_segmentation length %d is not a multiple of 4", len(encoded))
+	}
+	for dim := 0; dim < 3; dim++ {
+		if blockSize[dim] <= 0 {
+			return nil, fmt.Errorf("bad compressed_segmentation block size %s", blockSize)
+		}
+	}
+	words := make([]uint32, len(encoded)/4)
+	for n := range words {
+		words[n] = binary.LittleEndian.Uint32(encoded[n*4:])
+	}
+	wordsPerValue := int(dvid.DataTypeBytes(t) / 4)
+	bytesPerValue := int64(dvid.DataTypeBytes(t))
+	numVoxels := size.Prod()
+	raw := make([]byte, numVoxels*int64(numChannels)*bytesPerValue)
+	var grid dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		grid[dim] = (size[dim] + blockSize[dim] - 1) / blockSize[dim]
+	}
+	errCorrupt := fmt.Errorf("compressed_segmentation data is truncated or corrupt")
+	for ch := 0; ch < numChannels; ch++ {
+		if ch >= len(words) {
+			return nil, errCorrupt
+		}
+		base := int(words[ch])
+		plane := raw[int64(ch)*numVoxels*bytesPerValue:]
+		for gz := int32(0); gz < grid[2]; gz++ {
+			for gy := int32(0); gy < grid[1]; gy++ {
+				for gx := int32(0); gx < grid[0]; gx++ {
+					header := base + 2*int((gz*grid[1]+gy)*grid[0]+gx)
+					if header+1 >= len(words) {
+						return nil, errCorrupt
+					}
+					tableOffset := base + int(words[header]&0xffffff)
+					bits := uint(words[header] >> 24)
+					valuesOffset := base + int(words[header+1])
+					mask := uint32(uint64(1)<<bits - 1)
+					for z := int32(0); z < blockSize[2] && gz*blockSize[2]+z < size[2]; z++ {
+						for y := int32(0); y < blockSize[1] && gy*blockSize[1]+y < size[1]; y++ {
+							for x := int32(0); x < blockSize[0] && gx*blockSize[0]+x < size[0]; x++ {
+								var index int
+								if bits > 0 {
+									bitPos := uint(((z*blockSize[1])+y)*blockSize[0]+x) * bits
+									w := valuesOffset + int(bitPos/32)
+									if w >= len(words) {
+										return nil, errCorrupt
+									}
+									index = int((words[w] >> (bitPos % 32)) & mask)
+								}
+								entry := tableOffset + index*wordsPerValue
+								if entry+wordsPerValue > len(words) {
+									return nil, errCorrupt
+								}
+								vx, vy, vz := gx*blockSize[0]+x, gy*blockSize[1]+y, gz*blockSize[2]+z
+								n := (int64(vz)*int64(size[1])+int64(vy))*int64(size[0]) + int64(vx)
+								for w := 0; w < wordsPerValue; w++ {
+									binary.LittleEndian.PutUint32(plane[n*bytesPerValue+int64(w)*4:], words[entry+w])
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return raw, nil
+}
+
+// fromPrecomputedRaw converts raw precomputed planes of srcType values into interleaved
+// voxel values in the given byte order, widening values if needed.  It is the inverse of
+// toPrecomputedRaw.
+func fromPrecomputedRaw(raw []byte, srcType dvid.DataType, values dvid.DataValues, byteOrder binary.ByteOrder,
+	size dvid.Point3d) ([]byte, error) {
+
+	bytesPerValue, err := values.BytesPerValue()
+	if err != nil {
+		return nil, err
+	}
+	if byteOrder == nil {
+		byteOrder = binary.LittleEndian
+	}
+	srcBytes := int64(dvid.DataTypeBytes(srcType))
+	dstBytes := int64(bytesPerValue)
+	if srcBytes == dstBytes && len(values) == 1 && byteOrder == binary.LittleEndian {
+		return raw, nil
+	}
+	numVoxels := size.Prod()
+	numValues := int64(len(values))
+	data := make([]byte, numVoxels*numValues*dstBytes)
+	for v := int64(0); v < numValues; v++ {
+		for n := int64(0); n < numVoxels; n++ {
+			src := raw[(v*numVoxels+n)*srcBytes : (v*numVoxels+n+1)*srcBytes]
+			dst := data[(n*numValues+v)*dstBytes : (n*numValues+v+1)*dstBytes]
+			switch {
+			case srcBytes != dstBytes:
+				// Only uint32 to uint64 widening is allowed by checkPrecomputedImport.
+				byteOrder.PutUint64(dst, uint64(binary.LittleEndian.Uint32(src)))
+			case byteOrder == binary.LittleEndian:
+				copy(dst, src)
+			default:
+				for b := int64(0); b < dstBytes; b++ {
+					dst[b] = src[dstBytes-1-b]
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// importScales returns the scales of a precomputed volume selected by a comma-separated
+// list of scale keys or indices, which defaults to the first scale.
+func importScales(info *PrecomputedInfo, scalesStr string) ([]*PrecomputedScale, error) {
+	if len(info.Scales) == 0 {
+		return nil, fmt.Errorf("Precomputed volume has no scales")
+	}
+	if scalesStr == "" {
+		return []*PrecomputedScale{&info.Scales[0]}, nil
+	}
+	var scales []*PrecomputedScale
+	for _, s := range strings.Split(scalesStr, ",") {
+		var found *PrecomputedScale
+		for n := range info.Scales {
+			if info.Scales[n].Key == s {
+				found = &info.Scales[n]
+			}
+		}
+		if found == nil {
+			if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(info.Scales) {
+				found = &info.Scales[n]
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("Precomputed volume has no scale %q", s)
+		}
+		scales = append(scales, found)
+	}
+	return scales, nil
+}
+
+// scaleLevel returns the pyramid level of a scale relative to a base scale, which must be
+// an isotropic power of two downsampling.
+func scaleLevel(base, scale *PrecomputedScale) (int, error) {
+	ratio := scale.Resolution[0] / base.Resolution[0]
+	level := int(math.Log2(float64(ratio)) + 0.5)
+	for dim := 0; dim < 3; dim++ {
+		if scale.Resolution[dim] != base.Resolution[dim]*float32(int32(1)<<uint(level)) || level < 1 {
+			return 0, fmt.Errorf("Scale %q at resolution %v is not a 2^n downsampling of scale %q at %v.  "+
+				"Import it into separate data.", scale.Key, scale.Resolution, base.Key, base.Resolution)
+		}
+	}
+	return level, nil
+}
+
+// importJobKind is the kind of resumable import jobs.
+const importJobKind = "voxels-import"
+
+// precomputedImport is a planned import of scales of a precomputed volume.
+type precomputedImport struct {
+	uuid      dvid.UUID
+	props     *Properties
+	store     storage.ObjectStore
+	checksums *dvid.ChecksumManifest
+	info      *PrecomputedInfo
+	scales    []*PrecomputedScale
+	dests     []IntHandler
+	fetches   int
+}
+
+// importArgs are the arguments of an import job, which are kept so the job can be
+// resumed after a restart.
+type importArgs struct {
+	Command dvid.Command
+}
+
+// importCheckpoint records the progress of an import job: the index of the selected
+// scale being imported and the number of its chunks already imported.
+type importCheckpoint struct {
+	Scale int
+	Chunk int
+}
+
+// embedsData is implemented by Data and the data types embedding it, e.g., labels64,
+// so jobs can be resumed with the data that started them.
+type embedsData interface {
+	IntHandler
+	voxelsData() *Data
+}
+
+func (d *Data) voxelsData() *Data { return d }
+
+// planImport checks an "import precomputed <source>" command and returns the import,
+// whose first selected scale is written into the data i, which embeds d, and each other
+// selected scale into data named by PyramidLevelName.
+func (d *Data) planImport(request datastore.Request, i IntHandler) (*precomputedImport, error) {
+	var uuidStr, dataName, cmdStr, formatStr, source string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &formatStr, &source)
+	if formatStr != "precomputed" {
+		return nil, fmt.Errorf("Unsupported import format %q.  Use 'precomputed'.", formatStr)
+	}
+	if source == "" {
+		return nil, fmt.Errorf("Import requires a source.  See command-line help.")
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return nil, err
+	}
+	settings := request.Settings()
+	store, err := storage.NewSourceObjectStore(source, settings)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := readImportChecksums(store)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ReadPrecomputedInfo(store)
+	if err != nil {
+		return nil, err
+	}
+	scalesStr, _, err := settings.GetString("scales")
+	if err != nil {
+		return nil, err
+	}
+	scales, err := importScales(info, scalesStr)
+	if err != nil {
+		return nil, err
+	}
+	fetches, _, err := settings.GetInt("fetches")
+	if err != nil {
+		return nil, err
+	}
+
+	// Check all scales before changing any data.  Precomputed resolutions are in nanometers.
+	props := &(d.Properties)
+	for dim := 0; dim < 3; dim++ {
+		res := scales[0].Resolution[dim]
+		if dim >= len(props.VoxelSize) || props.VoxelSize[dim] != res ||
+			dim >= len(props.VoxelUnits) || props.VoxelUnits[dim] != "nanometers" {
+			return nil, fmt.Errorf("Data %q has voxel size %v %v but precomputed scale %q has resolution %v nanometers",
+				d.DataName(), props.VoxelSize, props.VoxelUnits, scales[0].Key, scales[0].Resolution)
+		}
+	}
+	levels := make([]int, len(scales))
+	for n, scale := range scales {
+		if _, err := props.checkPrecomputedImport(info, scale); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			if levels[n], err = scaleLevel(scales[0], scale); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	dests := make([]IntHandler, len(scales))
+	dests[0] = i
+	for n := 1; n < len(scales); n++ {
+		name := PyramidLevelName(d.DataName(), levels[n])
+		dataservice, err := server.DatastoreService().DataServiceByUUID(uuid, name)
+		if err != nil {
+			dests[n], err = d.newScaledData(uuid, d.DatatypeName(), string(name), float32(int32(1)<<uint(levels[n])))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var ok bool
+		if dests[n], ok = dataservice.(IntHandler); !ok {
+			return nil, fmt.Errorf("Unable to write voxels to %q", name)
+		}
+	}
+	return &precomputedImport{uuid, props, store, checksums, info, scales, dests, fetches}, nil
+}
+
+// run imports the selected scales, continuing from a checkpoint, and records the
+// job's progress and checkpoints.
+func (imp *precomputedImport) run(ctx context.Context, job *server.Job, cp importCheckpoint) error {
+	for n := cp.Scale; n < len(imp.scales); n++ {
+		var start int
+		if n == cp.Scale {
+			start = cp.Chunk
+		}
+		scale := n
+		progress := func(f float32) { job.SetProgress((float32(scale) + f) / float32(len(imp.scales))) }
+		done := func(chunks int) { job.Checkpoint(importCheckpoint{scale, chunks}) }
+		err := importPrecomputedChunks(ctx, imp.uuid, imp.dests[n], imp.props, imp.store, imp.checksums,
+			imp.info, imp.scales[n], imp.fetches, start, progress, done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeImport resumes an import job interrupted by a shutdown.
+func resumeImport(ctx context.Context, job *server.Job, args, checkpoint json.RawMessage) error {
+	var a importArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return err
+	}
+	var cp importCheckpoint
+	if checkpoint != nil {
+		if err := json.Unmarshal(checkpoint, &cp); err != nil {
+			return err
+		}
+	}
+	var uuidStr, dataName string
+	a.Command.CommandArgs(1, &uuidStr, &dataName)
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	dataservice, err := server.DatastoreService().DataServiceByUUID(uuid, dvid.DataString(dataName))
+	if err != nil {
+		return err
+	}
+	data, ok := dataservice.(embedsData)
+	if !ok {
+		return fmt.Errorf("Data %q can't import voxels", dataName)
+	}
+	imp, err := data.voxelsData().planImport(datastore.Request{Command: a.Command}, data)
+	if err != nil {
+		return err
+	}
+	return imp.run(ctx, job, cp)
+}
+
+// ImportCommand handles the "import precomputed <source>" RPC command, which starts a job
+// that writes the first selected scale of a precomputed volume into the data i, which
+// embeds d, and each other selected scale into data named by PyramidLevelName.  The job
+// is resumed from its last imported chunk if the server is restarted.
+func (d *Data) ImportCommand(request datastore.Request, reply *datastore.Response, i IntHandler) error {
+	imp, err := d.planImport(request, i)
+	if err != nil {
+		return err
+	}
+	description := fmt.Sprintf("Import %d scales of precomputed %s into %q", len(imp.scales), imp.store, d.DataName())
+	job, err := server.NewResumableJob(importJobKind, description, importArgs{request.Command})
+	if err != nil {
+		return err
+	}
+	ctx := request.Context()
+	go func() {
+		startTime := time.Now()
+		err := imp.run(ctx, job, importCheckpoint{})
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		} else {
+			dvid.ElapsedTime(dvid.Normal, startTime, description)
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to import %d scales of %s.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, len(imp.scales), imp.store, job.ID)
+	return nil
+}
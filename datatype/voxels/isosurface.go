@@ -0,0 +1,95 @@
+/*
+	This file extracts isosurfaces of thresholded voxels on the fly for quick 3d previews.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// requestAdmitter is implemented by data that limits the memory used by requests.
+type requestAdmitter interface {
+	AdmitRequest(ctx context.Context, geom dvid.Geometry) (release func(), err error)
+}
+
+// ServeIsosurface handles requests for isosurface meshes in the form
+//
+//	GET <api URL>/node/<UUID>/<data name>/isosurface/<threshold>/<size>/<offset>[/<format>]
+//
+// The parts are the URL path components starting with the API prefix, so parts[3]
+// is "isosurface".
+func ServeIsosurface(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Isosurfaces can only be retrieved with GET")
+	}
+	if len(parts) < 7 {
+		return fmt.Errorf("'isosurface' must be followed by threshold/size/offset")
+	}
+	if len(props.Values) != 1 || (props.Values[0].T != dvid.T_uint8 && props.Values[0].T != dvid.T_uint16) {
+		return fmt.Errorf("Isosurfaces require single channel uint8 or uint16 voxels")
+	}
+	threshold, err := strconv.ParseFloat(parts[4], 64)
+	if err != nil {
+		return fmt.Errorf("Bad isosurface threshold %q", parts[4])
+	}
+	subvol, err := dvid.NewSubvolumeFromStrings(parts[6], parts[5], "_")
+	if err != nil {
+		return err
+	}
+	offset, ok1 := subvol.StartPoint().(dvid.Point3d)
+	size, ok2 := subvol.Size().(dvid.Point3d)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("Isosurfaces require 3d size and offset")
+	}
+	if err := CheckLimits(i, subvol); err != nil {
+		return err
+	}
+	formatStr := "obj"
+	if len(parts) >= 8 && parts[7] != "" {
+		formatStr = strings.ToLower(parts[7])
+	}
+	if formatStr != "obj" && formatStr != "binary" {
+		return fmt.Errorf("Unsupported isosurface format %q.  Use 'obj' or 'binary'.", formatStr)
+	}
+
+	// Meshes can take more memory than the voxels, so respect the memory budget.
+	if admitter, ok := i.(requestAdmitter); ok {
+		release, err := admitter.AdmitRequest(r.Context(), subvol)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	e, err := i.NewExtHandler(subvol, nil)
+	if err != nil {
+		return err
+	}
+	defer dvid.PutBuffer(e.Data())
+	data, err := GetVolume(r.Context(), uuid, i, e)
+	if err != nil {
+		return err
+	}
+
+	bytesPerVoxel := props.Values.BytesPerElement()
+	t := props.Values[0].T
+	mesh := dvid.IsosurfaceMesh(offset, size, func(x, y, z int32) bool {
+		n := (((z-offset[2])*size[1]+y-offset[1])*size[0] + x - offset[0]) * bytesPerVoxel
+		return ReadValue(data[n:], t, props.ByteOrder) >= threshold
+	})
+
+	if formatStr == "binary" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		return mesh.WriteBinary(w)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	return mesh.WriteOBJ(w)
+}
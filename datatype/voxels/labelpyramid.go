@@ -0,0 +1,316 @@
+/*
+	This file builds multiresolution pyramids of label volumes.  Labels can't be averaged,
+	since averaging two neighboring labels gives an unrelated label, so each 2x downsampling
+	takes either the most frequent label (mode) or the center voxel of each 2x2x2 cell.
+	Each level is stored as separate data so Neuroglancer and other clients can read it as
+	a scale of the original volume.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Label downsampling methods.
+const (
+	// DownsampleMode takes the most frequent value of each cell, with ties going to the
+	// value seen first with x varying fastest.
+	DownsampleMode = "mode"
+
+	// DownsampleCenter takes the value at the center of each cell, i.e., the voxel with
+	// offset factor/2 along each axis.
+	DownsampleCenter = "center"
+)
+
+// PyramidChunkBlocks is the number of output blocks along each dimension written by each
+// step of a pyramid build.
+const PyramidChunkBlocks = 4
+
+// downsampleLabels reduces a 3d volume of labels or other values that can't be averaged by
+// an integer factor along each dimension.  Voxels are compared by their bytes, so any
+// value type can be downsampled.
+func downsampleLabels(data []byte, bytesPerVoxel int32, size dvid.Point3d, factor int32,
+	method string) ([]byte, error) {
+
+	var dstSize dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		if size[dim]%factor != 0 {
+			return nil, fmt.Errorf("Size %s is not a multiple of downsampling factor %d", size, factor)
+		}
+		dstSize[dim] = size[dim] / factor
+	}
+	if int64(len(data)) != size.Prod()*int64(bytesPerVoxel) {
+		return nil, fmt.Errorf("Expected %d bytes for %s volume, got %d bytes", size.Prod()*int64(bytesPerVoxel),
+			size, len(data))
+	}
+	bpv := int64(bytesPerVoxel)
+	srcIndex := func(x, y, z int32) int64 {
+		return ((int64(z)*int64(size[1])+int64(y))*int64(size[0]) + int64(x)) * bpv
+	}
+	dst := make([]byte, dstSize.Prod()*bpv)
+	var dstI int64
+	switch method {
+	case DownsampleCenter:
+		c := factor / 2
+		for z := int32(0); z < dstSize[2]; z++ {
+			for y := int32(0); y < dstSize[1]; y++ {
+				for x := int32(0); x < dstSize[0]; x++ {
+					i := srcIndex(x*factor+c, y*factor+c, z*factor+c)
+					copy(dst[dstI:dstI+bpv], data[i:i+bpv])
+					dstI += bpv
+				}
+			}
+		}
+	case DownsampleMode:
+		// A cell has few distinct values, so they're counted in slices reused for every
+		// cell rather than a map keyed by each voxel's bytes.
+		cellVoxels := int(factor) * int(factor) * int(factor)
+		values := make([][]byte, 0, cellVoxels)
+		counts := make([]int, 0, cellVoxels)
+		for z := int32(0); z < dstSize[2]; z++ {
+			for y := int32(0); y < dstSize[1]; y++ {
+				for x := int32(0); x < dstSize[0]; x++ {
+					values, counts = values[:0], counts[:0]
+					var mode []byte
+					var modeCount int
+					for dz := int32(0); dz < factor; dz++ {
+						for dy := int32(0); dy < factor; dy++ {
+							for dx := int32(0); dx < factor; dx++ {
+								i := srcIndex(x*factor+dx, y*factor+dy, z*factor+dz)
+								value := data[i : i+bpv]
+								n := 0
+								for n < len(values) && !bytes.Equal(values[n], value) {
+									n++
+								}
+								if n == len(values) {
+									values = append(values, value)
+									counts = append(counts, 0)
+								}
+								counts[n]++
+								if counts[n] > modeCount {
+									mode, modeCount = value, counts[n]
+								}
+							}
+						}
+					}
+					copy(dst[dstI:dstI+bpv], mode)
+					dstI += bpv
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown label downsampling method %q: use %q or %q", method,
+			DownsampleMode, DownsampleCenter)
+	}
+	return dst, nil
+}
+
+// BuildLabelPyramid writes successive 2x downsamplings of src into levels, where the first
+// level is downsampled from src and each following level from the level before it.  Chunks
+// of all background voxels are only written where the level already holds voxels, so
+// earlier builds are overwritten without filling empty space.  If progress is not nil, it's called with the
+// fraction of levels done.
+func BuildLabelPyramid(ctx context.Context, uuid dvid.UUID, src IntHandler, levels []IntHandler,
+	method string, progress func(float32)) error {
+
+	bytesPerVoxel := src.Values().BytesPerElement()
+	for n, level := range levels {
+		prev := src
+		if n > 0 {
+			prev = levels[n-1]
+		}
+		extents := prev.Extents()
+		if extents.MinPoint == nil || extents.MaxPoint == nil {
+			return nil
+		}
+		blockSize, ok := level.BlockSize().(dvid.Point3d)
+		if !ok {
+			return fmt.Errorf("Pyramids require 3d blocks, not block size %s", level.BlockSize())
+		}
+		stored := level.Extents()
+		storedMin, storedMax := stored.MinPoint, stored.MaxPoint
+		// Split the downsampled extents into block-aligned chunks.
+		var minPt, beg, end, chunkSize dvid.Point3d
+		for dim := uint8(0); dim < 3; dim++ {
+			chunkSize[dim] = blockSize[dim] * PyramidChunkBlocks
+			minPt[dim] = floorDiv(extents.MinPoint.Value(dim), 2)
+			beg[dim] = floorDiv(minPt[dim], chunkSize[dim]) * chunkSize[dim]
+			end[dim] = floorDiv(extents.MaxPoint.Value(dim), 2) + 1
+		}
+		numChunks := ((end[0] - beg[0] + chunkSize[0] - 1) / chunkSize[0]) *
+			((end[1] - beg[1] + chunkSize[1] - 1) / chunkSize[1]) * ((end[2] - beg[2] + chunkSize[2] - 1) / chunkSize[2])
+		var done int32
+		for z := beg[2]; z < end[2]; z += chunkSize[2] {
+			for y := beg[1]; y < end[1]; y += chunkSize[1] {
+				for x := beg[0]; x < end[0]; x += chunkSize[0] {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					var chunkBeg, chunkEnd dvid.Point3d
+					for dim, v := range [3]int32{x, y, z} {
+						chunkBeg[dim] = v
+						if chunkBeg[dim] < minPt[dim] {
+							chunkBeg[dim] = minPt[dim]
+						}
+						chunkEnd[dim] = v + chunkSize[dim]
+						if chunkEnd[dim] > end[dim] {
+							chunkEnd[dim] = end[dim]
+						}
+					}
+					outSize := chunkEnd.Sub(chunkBeg).(dvid.Point3d)
+					srcSubvol := dvid.NewSubvolume(dvid.Point3d{2 * chunkBeg[0], 2 * chunkBeg[1], 2 * chunkBeg[2]},
+						dvid.Point3d{2 * outSize[0], 2 * outSize[1], 2 * outSize[2]})
+					e, err := prev.NewExtHandler(srcSubvol, nil)
+					if err != nil {
+						return err
+					}
+					data, err := GetVolume(ctx, uuid, prev, e)
+					if err != nil {
+						return err
+					}
+					down, err := downsampleLabels(data, bytesPerVoxel, srcSubvol.Size().(dvid.Point3d), 2, method)
+					if err != nil {
+						return err
+					}
+					done++
+					if progress != nil {
+						progress((float32(n) + float32(done)/float32(numChunks)) / float32(len(levels)))
+					}
+					if allZero(down) && !overlaps(storedMin, storedMax, chunkBeg, chunkEnd) {
+						continue
+					}
+					out, err := level.NewExtHandler(dvid.NewSubvolume(chunkBeg, outSize), down)
+					if err != nil {
+						return err
+					}
+					if err := PutVoxels(ctx, uuid, level, out); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps returns true if the voxels from minPt to maxPt, which are nil if there are no
+// voxels, overlap the voxels from beg up to but not including end.
+func overlaps(minPt, maxPt dvid.Point, beg, end dvid.Point3d) bool {
+	if minPt == nil || maxPt == nil {
+		return false
+	}
+	for dim := uint8(0); dim < 3; dim++ {
+		if maxPt.Value(dim) < beg[dim] || minPt.Value(dim) >= end[dim] {
+			return false
+		}
+	}
+	return true
+}
+
+// NumPyramidLevels returns the number of 2x downsamplings needed before the extents fit
+// within one block, at most MaxPrecomputedScales-1.
+func NumPyramidLevels(extents *Extents, blockSize dvid.Point) int {
+	if extents.MinPoint == nil || extents.MaxPoint == nil {
+		return 0
+	}
+	for level := 0; level < MaxPrecomputedScales-1; level++ {
+		factor := int32(1) << uint(level)
+		fits := true
+		for dim := uint8(0); dim < 3; dim++ {
+			size := floorDiv(extents.MaxPoint.Value(dim), factor) - floorDiv(extents.MinPoint.Value(dim), factor) + 1
+			if size > blockSize.Value(dim) {
+				fits = false
+			}
+		}
+		if fits {
+			return level
+		}
+	}
+	return MaxPrecomputedScales - 1
+}
+
+// PyramidLevelName returns the name of the data holding a pyramid level, e.g.,
+// "segmentation-s2" for level 2 of "segmentation".
+func PyramidLevelName(name dvid.DataString, level int) dvid.DataString {
+	return dvid.DataString(fmt.Sprintf("%s-%s", name, scaleKey(level)))
+}
+
+// PyramidCommand handles the "pyramid" RPC command, which starts a job that writes 2x
+// downsamplings of the data i, which embeds d, into new data named by PyramidLevelName.
+func (d *Data) PyramidCommand(request datastore.Request, reply *datastore.Response, i IntHandler) error {
+	var uuidStr, dataName, cmdStr string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	settings := request.Settings()
+	method, found, err := settings.GetString("method")
+	if err != nil {
+		return err
+	}
+	if !found {
+		method = DownsampleMode
+	}
+	if method != DownsampleMode && method != DownsampleCenter {
+		return fmt.Errorf("Unknown label downsampling method %q: use %q or %q", method,
+			DownsampleMode, DownsampleCenter)
+	}
+	numLevels := NumPyramidLevels(d.Extents(), d.BlockSize())
+	levelsStr, found, err := settings.GetString("levels")
+	if err != nil {
+		return err
+	}
+	if found {
+		if numLevels, err = strconv.Atoi(levelsStr); err != nil || numLevels < 1 {
+			return fmt.Errorf("Bad number of pyramid levels %q", levelsStr)
+		}
+		if numLevels > MaxPrecomputedScales-1 {
+			return fmt.Errorf("At most %d pyramid levels can be built, not %d", MaxPrecomputedScales-1, numLevels)
+		}
+	}
+	if numLevels == 0 {
+		return fmt.Errorf("Data %q already fits within one block, so no pyramid levels are needed", d.DataName())
+	}
+	levels := make([]IntHandler, numLevels)
+	for n := range levels {
+		name := PyramidLevelName(d.DataName(), n+1)
+		if levels[n], err = d.newScaledData(uuid, d.DatatypeName(), string(name), float32(int32(1)<<uint(n+1))); err != nil {
+			return err
+		}
+	}
+
+	ctx := request.Context()
+	description := fmt.Sprintf("Build %d-level %s pyramid of %q", numLevels, method, d.DataName())
+	job := server.NewJob(description)
+	go func() {
+		err := BuildLabelPyramid(ctx, uuid, i, levels, method, job.SetProgress)
+		if err == nil {
+			err = server.DatastoreService().SaveDataset(uuid)
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to build %d pyramid levels %q to %q.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, numLevels, PyramidLevelName(d.DataName(), 1), PyramidLevelName(d.DataName(), numLevels), job.ID)
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+	This file mirrors voxels from another DVID server by reading subvolumes through its
+	HTTP API.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MirrorChunkBlocks is the number of blocks along each dimension read by each request
+// to a remote server while mirroring.
+const MirrorChunkBlocks = 4
+
+// Mirror copies voxels of a remote instance into this data at a version.
+func (d *Data) Mirror(ctx context.Context, remote *server.MirrorSource, uuid dvid.UUID,
+	settings dvid.Config, progress func(float32)) error {
+	return MirrorVoxels(ctx, remote, uuid, d, &(d.Properties), settings, progress)
+}
+
+// MirrorVoxels copies voxels of a remote instance into local data, reading block-aligned
+// subvolumes in parallel.  The region is given by "offset" and "size" settings, which
+// default to the extents of the remote data.
+func MirrorVoxels(ctx context.Context, remote *server.MirrorSource, uuid dvid.UUID, i IntHandler,
+	props *Properties, settings dvid.Config, progress func(float32)) error {
+
+	offset, size, err := mirrorRegion(ctx, remote, settings)
+	if err != nil {
+		return err
+	}
+	blockSize, ok := props.BlockSize.(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Only 3d voxels can be mirrored, not block size %s", props.BlockSize)
+	}
+
+	// Split the region into block-aligned chunks.
+	var chunkSize, beg, end dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		chunkSize[dim] = blockSize[dim] * MirrorChunkBlocks
+		beg[dim] = floorDiv(offset[dim], chunkSize[dim]) * chunkSize[dim]
+		end[dim] = offset[dim] + size[dim]
+	}
+	var chunks []*dvid.Subvolume
+	for z := beg[2]; z < end[2]; z += chunkSize[2] {
+		for y := beg[1]; y < end[1]; y += chunkSize[1] {
+			for x := beg[0]; x < end[0]; x += chunkSize[0] {
+				var chunkBeg, chunkEnd dvid.Point3d
+				for dim, v := range [3]int32{x, y, z} {
+					chunkBeg[dim] = v
+					if chunkBeg[dim] < offset[dim] {
+						chunkBeg[dim] = offset[dim]
+					}
+					chunkEnd[dim] = v + chunkSize[dim]
+					if chunkEnd[dim] > end[dim] {
+						chunkEnd[dim] = end[dim]
+					}
+				}
+				chunks = append(chunks, dvid.NewSubvolume(chunkBeg, chunkEnd.Sub(chunkBeg)))
+			}
+		}
+	}
+
+	return remote.ForEach(ctx, len(chunks), func(ctx context.Context, n int) error {
+		subvol := chunks[n]
+		chunkBeg := subvol.StartPoint().(dvid.Point3d)
+		chunkSize := subvol.Size().(dvid.Point3d)
+		endpoint := fmt.Sprintf("raw/0_1_2/%d_%d_%d/%d_%d_%d", chunkSize[0], chunkSize[1], chunkSize[2],
+			chunkBeg[0], chunkBeg[1], chunkBeg[2])
+		data, found, err := remote.Get(ctx, endpoint)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("Subvolume %s not found at %s", subvol, remote)
+		}
+		e, err := i.NewExtHandler(subvol, data)
+		if err != nil {
+			return err
+		}
+		// The version may have been published since the mirror started.
+		if err := server.DatastoreService().WritesBlocked(uuid); err != nil {
+			return err
+		}
+		return PutVoxels(ctx, uuid, i, e)
+	}, progress)
+}
+
+// mirrorRegion returns the region to mirror from "offset" and "size" settings or the
+// extents of the remote data.
+func mirrorRegion(ctx context.Context, remote *server.MirrorSource, settings dvid.Config) (offset, size dvid.Point3d, err error) {
+	offsetStr, offsetFound, err := settings.GetString("offset")
+	if err != nil {
+		return
+	}
+	sizeStr, sizeFound, err := settings.GetString("size")
+	if err != nil {
+		return
+	}
+	if !offsetFound || !sizeFound {
+		var info struct {
+			MinPoint []int32
+			MaxPoint []int32
+		}
+		if err = remote.Info(ctx, &info); err != nil {
+			return
+		}
+		if len(info.MinPoint) != 3 || len(info.MaxPoint) != 3 {
+			err = fmt.Errorf("No 3d voxels stored at %s.  Specify offset and size settings.", remote)
+			return
+		}
+		for dim := 0; dim < 3; dim++ {
+			offset[dim] = info.MinPoint[dim]
+			size[dim] = info.MaxPoint[dim] - info.MinPoint[dim] + 1
+		}
+	}
+	for _, p := range []struct {
+		s     string
+		found bool
+		pt    *dvid.Point3d
+	}{{offsetStr, offsetFound, &offset}, {sizeStr, sizeFound, &size}} {
+		if !p.found {
+			continue
+		}
+		var pt dvid.Point
+		if pt, err = dvid.StringToPoint(p.s, ","); err != nil {
+			return
+		}
+		pt3d, ok := pt.(dvid.Point3d)
+		if !ok {
+			err = fmt.Errorf("Mirror offset and size must be 3d, not %q", p.s)
+			return
+		}
+		*p.pt = pt3d
+	}
+	if size[0] <= 0 || size[1] <= 0 || size[2] <= 0 {
+		err = fmt.Errorf("Bad size %s of region to mirror", size)
+	}
+	return
+}
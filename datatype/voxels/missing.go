@@ -0,0 +1,234 @@
+/*
+	This file finds the blocks within a bounding box or ROI that have no data at a version,
+	e.g., to track the progress of a long ingest or find holes left by failed pipeline
+	shards.
+*/
+
+package voxels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MissingBlocks describes the blocks of a region without data at a version.
+type MissingBlocks struct {
+	// Blocks is the number of blocks checked.
+	Blocks int64
+
+	// Missing is the number of blocks without data.
+	Missing int64
+
+	// Spans are runs of blocks without data as z, y, x0, x1 in block coordinates.
+	Spans []roi.Span
+}
+
+// MaxMissingBlocks is the maximum number of blocks checked by one request for missing
+// blocks, which bounds the memory of the region's spans and the reply.
+const MaxMissingBlocks = 1 << 22
+
+// regionSpans returns the spans of blocks of data with the given block size that hold
+// voxels of a subvolume, an ROI, or, if both are given, their intersection.  Regions of
+// more than MaxMissingBlocks blocks are refused before their spans are allocated.
+func regionSpans(uuid dvid.UUID, blockSize dvid.Point3d, subvol *dvid.Subvolume, roiName dvid.DataString) ([]roi.Span, error) {
+	tooLarge := fmt.Errorf("Region has more than %d blocks; split it into smaller requests", MaxMissingBlocks)
+	var boxBeg, boxEnd dvid.Point3d
+	if subvol != nil {
+		start, ok1 := subvol.StartPoint().(dvid.Point3d)
+		end, ok2 := subvol.EndPoint().(dvid.Point3d)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("Regions must be 3d")
+		}
+		numBlocks := int64(1)
+		for dim := 0; dim < 3; dim++ {
+			boxBeg[dim] = floorDiv(start[dim], blockSize[dim])
+			boxEnd[dim] = floorDiv(end[dim], blockSize[dim])
+			numBlocks *= int64(boxEnd[dim]) - int64(boxBeg[dim]) + 1
+			if numBlocks > MaxMissingBlocks {
+				if roiName == "" {
+					return nil, tooLarge
+				}
+				numBlocks = MaxMissingBlocks
+			}
+		}
+		if roiName == "" {
+			var box []roi.Span
+			for z := boxBeg[2]; z <= boxEnd[2]; z++ {
+				for y := boxBeg[1]; y <= boxEnd[1]; y++ {
+					box = append(box, roi.Span{z, y, boxBeg[0], boxEnd[0]})
+				}
+			}
+			return box, nil
+		}
+	}
+	roiData, err := roi.GetByUUID(uuid, roiName)
+	if err != nil {
+		return nil, err
+	}
+	roiSpans, err := roiData.GetSpans(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	// ROI blocks can be a different size than data blocks, so find the data blocks
+	// holding the voxels of each ROI span, clipped to the subvolume if given.
+	var spans []roi.Span
+	var numBlocks int64
+	rb := roiData.BlockSize
+	for _, s := range roiSpans {
+		x0 := floorDiv(s[2]*rb[0], blockSize[0])
+		x1 := floorDiv((s[3]+1)*rb[0]-1, blockSize[0])
+		z0 := floorDiv(s[0]*rb[2], blockSize[2])
+		z1 := floorDiv((s[0]+1)*rb[2]-1, blockSize[2])
+		y0 := floorDiv(s[1]*rb[1], blockSize[1])
+		y1 := floorDiv((s[1]+1)*rb[1]-1, blockSize[1])
+		if subvol != nil {
+			x0, x1 = clipRange(x0, x1, boxBeg[0], boxEnd[0])
+			y0, y1 = clipRange(y0, y1, boxBeg[1], boxEnd[1])
+			z0, z1 = clipRange(z0, z1, boxBeg[2], boxEnd[2])
+		}
+		if x0 > x1 {
+			continue
+		}
+		for z := z0; z <= z1; z++ {
+			for y := y0; y <= y1; y++ {
+				if numBlocks += int64(x1-x0) + 1; numBlocks > MaxMissingBlocks {
+					return nil, tooLarge
+				}
+				spans = append(spans, roi.Span{z, y, x0, x1})
+			}
+		}
+	}
+	spans, err = roi.NormalizeSpans(spans)
+	if err != nil {
+		return nil, err
+	}
+	if spans == nil {
+		spans = []roi.Span{}
+	}
+	return spans, nil
+}
+
+// clipRange returns the part of the range [a0, a1] within [b0, b1], which is empty,
+// i.e., a0 > a1, if they don't overlap.
+func clipRange(a0, a1, b0, b1 int32) (int32, int32) {
+	if a0 < b0 {
+		a0 = b0
+	}
+	if a1 > b1 {
+		a1 = b1
+	}
+	return a0, a1
+}
+
+// FindMissingBlocks returns the blocks within the spans that have no data written at the
+// version.  Blocks of ancestor versions don't count.
+func FindMissingBlocks(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	spans []roi.Span) (*MissingBlocks, error) {
+
+	versionID, err := server.VersionLocalID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := server.OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	dataID := i.DataID()
+	missing := &MissingBlocks{Spans: []roi.Span{}}
+	addMissing := func(z, y, x int32) {
+		missing.Missing++
+		last := len(missing.Spans) - 1
+		if last >= 0 && missing.Spans[last][0] == z && missing.Spans[last][1] == y && missing.Spans[last][3] == x-1 {
+			missing.Spans[last][3] = x
+		} else {
+			missing.Spans = append(missing.Spans, roi.Span{z, y, x, x})
+		}
+	}
+	for _, s := range spans {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		z, y, x0, x1 := s[0], s[1], s[2], s[3]
+		missing.Blocks += int64(x1-x0) + 1
+
+		// Blocks of a span are contiguous keys with ZYX indexing, so one range query
+		// finds them.  Other indexings check each block.
+		if props.Indexing == dvid.ZYXIndexing {
+			begKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, dvid.IndexZYX{x0, y, z}}
+			endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, dvid.IndexZYX{x1, y, z}}
+			keys, err := db.KeysInRange(begKey, endKey)
+			if err != nil {
+				return nil, err
+			}
+			written := make(map[string]bool, len(keys))
+			for _, key := range keys {
+				written[string(datastore.DataKeyIndexBytes(key.Bytes()))] = true
+			}
+			for x := x0; x <= x1; x++ {
+				if !written[string(dvid.IndexZYX{x, y, z}.Bytes())] {
+					addMissing(z, y, x)
+				}
+			}
+			continue
+		}
+		indices := make([]dvid.Index, 0, x1-x0+1)
+		for x := x0; x <= x1; x++ {
+			indices = append(indices, props.Indexing.Index(dvid.ChunkPoint3d{x, y, z}))
+		}
+		found, err := server.KeysExist(uuid, dataID, indices)
+		if err != nil {
+			return nil, err
+		}
+		for n, exists := range found {
+			if !exists {
+				addMissing(z, y, x0+int32(n))
+			}
+		}
+	}
+	return missing, nil
+}
+
+// ServeMissing handles GET <api URL>/node/<UUID>/<data name>/missing[/<size>/<offset>],
+// replying with the JSON of the blocks within the subvolume and/or the ROI given by the
+// "roi" query string option that have no data.  At most MaxMissingBlocks are checked.
+func ServeMissing(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Missing blocks can only be listed with HTTP GET")
+	}
+	blockSize, ok := props.BlockSize.(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Missing blocks can only be listed for data with 3d blocks")
+	}
+	var subvol *dvid.Subvolume
+	if len(parts) >= 6 {
+		var err error
+		if subvol, err = dvid.NewSubvolumeFromStrings(parts[5], parts[4], "_"); err != nil {
+			return err
+		}
+	}
+	roiName := dvid.DataString(r.URL.Query().Get("roi"))
+	if subvol == nil && roiName == "" {
+		return fmt.Errorf("'missing' requires a size and offset, an 'roi' query string option, or both")
+	}
+	spans, err := regionSpans(uuid, blockSize, subvol, roiName)
+	if err != nil {
+		return err
+	}
+	missing, err := FindMissingBlocks(r.Context(), uuid, i, props, spans)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(missing)
+}
@@ -0,0 +1,376 @@
+/*
+	This file implements binary morphology (erode, dilate, open, and close) with ball
+	structuring elements and the Euclidean distance transform on thresholded voxels.
+	All operations are computed with exact squared distance transforms (Felzenszwalb and
+	Huttenlocher) over tiles padded by a halo large enough to give the same result as
+	processing the whole volume at once.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// DefaultMaxDistance is the default distance at which distance transforms are clamped.
+const DefaultMaxDistance = 32
+
+// farDistance stands in for an infinite squared distance.
+const farDistance = 1e20
+
+// MorphologyOps lists the supported morphology operations.
+var MorphologyOps = []string{"erode", "dilate", "open", "close", "distance"}
+
+// distanceTransform1d computes the squared distance transform of n samples of f into d.
+// The v and z slices are scratch space of at least n and n+1 elements.
+func distanceTransform1d(f, d []float64, v []int, z []float64, n int) {
+	k := 0
+	v[0] = 0
+	z[0], z[1] = -farDistance, farDistance
+	for q := 1; q < n; q++ {
+		fq := f[q] + float64(q*q)
+		s := (fq - (f[v[k]] + float64(v[k]*v[k]))) / float64(2*q-2*v[k])
+		for s <= z[k] {
+			k--
+			s = (fq - (f[v[k]] + float64(v[k]*v[k]))) / float64(2*q-2*v[k])
+		}
+		k++
+		v[k] = q
+		z[k], z[k+1] = s, farDistance
+	}
+	k = 0
+	for q := 0; q < n; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		d[q] = float64((q-v[k])*(q-v[k])) + f[v[k]]
+	}
+}
+
+// squaredDistances returns the squared Euclidean distance from each voxel to the nearest
+// voxel whose mask value equals target, or farDistance if there is none.
+func squaredDistances(mask []bool, size dvid.Point3d, target bool) []float64 {
+	dist := make([]float64, len(mask))
+	for n, m := range mask {
+		if m != target {
+			dist[n] = farDistance
+		}
+	}
+	nx, ny, nz := int(size[0]), int(size[1]), int(size[2])
+	maxLen := nx
+	if ny > maxLen {
+		maxLen = ny
+	}
+	if nz > maxLen {
+		maxLen = nz
+	}
+	f := make([]float64, maxLen)
+	d := make([]float64, maxLen)
+	v := make([]int, maxLen)
+	z := make([]float64, maxLen+1)
+
+	// Transform along each axis in turn: start and stride of lines along the axis.
+	axes := []struct{ n, stride, lines int }{
+		{nx, 1, ny * nz},
+		{ny, nx, nx * nz},
+		{nz, nx * ny, nx * ny},
+	}
+	for axis, a := range axes {
+		for line := 0; line < a.lines; line++ {
+			var start int
+			switch axis {
+			case 0:
+				start = line * nx
+			case 1:
+				start = (line/nx)*nx*ny + line%nx
+			case 2:
+				start = line
+			}
+			for q := 0; q < a.n; q++ {
+				f[q] = dist[start+q*a.stride]
+			}
+			distanceTransform1d(f, d, v, z, a.n)
+			for q := 0; q < a.n; q++ {
+				dist[start+q*a.stride] = math.Min(d[q], farDistance)
+			}
+		}
+	}
+	return dist
+}
+
+// dilateMask returns the voxels within radius of the mask.
+func dilateMask(mask []bool, size dvid.Point3d, radius float64) []bool {
+	dist := squaredDistances(mask, size, true)
+	dilated := make([]bool, len(mask))
+	for n, d := range dist {
+		dilated[n] = d <= radius*radius
+	}
+	return dilated
+}
+
+// erodeMask returns the mask voxels farther than radius from any voxel outside the mask.
+func erodeMask(mask []bool, size dvid.Point3d, radius float64) []bool {
+	dist := squaredDistances(mask, size, false)
+	eroded := make([]bool, len(mask))
+	for n, d := range dist {
+		eroded[n] = d > radius*radius
+	}
+	return eroded
+}
+
+// MorphologyWriter receives the result for a subvolume in the layout of the source data.
+type MorphologyWriter func(subvol *dvid.Subvolume, data []byte) error
+
+// Morphology computes an operation on voxels with values at or above threshold within a
+// subvolume, passing the result to write one tile at a time.  The operations are "erode",
+// "dilate", "open", and "close" using a ball of the given radius, which write the
+// maximum voxel value inside and 0 outside, and "distance", which writes the Euclidean
+// distance in voxels from each voxel inside to the nearest voxel outside, clamped at
+// radius.  If progress is not nil, it is called with the fraction of work done.
+func Morphology(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, op string,
+	offset, size dvid.Point3d, threshold, radius float64, write MorphologyWriter, progress func(float32)) error {
+
+	if len(props.Values) != 1 || (props.Values[0].T != dvid.T_uint8 && props.Values[0].T != dvid.T_uint16) {
+		return fmt.Errorf("Morphology requires single channel uint8 or uint16 voxels")
+	}
+	if radius <= 0 {
+		return fmt.Errorf("Morphology radius must be positive, not %g", radius)
+	}
+	tileSize, ok := props.BlockSize.(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Morphology requires 3d blocks")
+	}
+	t := props.Values[0].T
+	maxValue := float64(255)
+	if t == dvid.T_uint16 {
+		maxValue = 65535
+	}
+
+	// The halo is how far the result at a voxel can depend on other voxels.
+	var halo int32
+	switch op {
+	case "erode", "dilate", "distance":
+		halo = int32(math.Ceil(radius))
+	case "open", "close":
+		halo = 2 * int32(math.Ceil(radius))
+	default:
+		return fmt.Errorf("Unknown morphology operation %q", op)
+	}
+
+	bytesPerVoxel := int32(props.Values.BytesPerElement())
+	numTiles := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		numTiles *= int64((size[dim] + tileSize[dim] - 1) / tileSize[dim])
+	}
+	var done int64
+	var tile dvid.Point3d
+	for tile[2] = offset[2]; tile[2] < offset[2]+size[2]; tile[2] += tileSize[2] {
+		for tile[1] = offset[1]; tile[1] < offset[1]+size[1]; tile[1] += tileSize[1] {
+			for tile[0] = offset[0]; tile[0] < offset[0]+size[0]; tile[0] += tileSize[0] {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				var outSize dvid.Point3d
+				for dim := 0; dim < 3; dim++ {
+					outSize[dim] = tileSize[dim]
+					if end := offset[dim] + size[dim]; tile[dim]+outSize[dim] > end {
+						outSize[dim] = end - tile[dim]
+					}
+				}
+
+				// Read the tile with its halo and threshold it.
+				inOffset := tile.AddScalar(-halo).(dvid.Point3d)
+				inSize := outSize.AddScalar(2 * halo).(dvid.Point3d)
+				e, err := i.NewExtHandler(dvid.NewSubvolume(inOffset, inSize), nil)
+				if err != nil {
+					return err
+				}
+				data, err := GetVolume(ctx, uuid, i, e)
+				if err != nil {
+					dvid.PutBuffer(e.Data())
+					return err
+				}
+				mask := make([]bool, inSize.Prod())
+				for n := range mask {
+					mask[n] = ReadValue(data[int32(n)*bytesPerVoxel:], t, props.ByteOrder) >= threshold
+				}
+				dvid.PutBuffer(e.Data())
+
+				var result []bool
+				var dist []float64
+				switch op {
+				case "erode":
+					result = erodeMask(mask, inSize, radius)
+				case "dilate":
+					result = dilateMask(mask, inSize, radius)
+				case "open":
+					result = dilateMask(erodeMask(mask, inSize, radius), inSize, radius)
+				case "close":
+					result = erodeMask(dilateMask(mask, inSize, radius), inSize, radius)
+				case "distance":
+					dist = squaredDistances(mask, inSize, false)
+				}
+
+				// Write the tile without its halo.
+				out := make([]byte, outSize.Prod()*int64(bytesPerVoxel))
+				var n int32
+				for z := halo; z < halo+outSize[2]; z++ {
+					for y := halo; y < halo+outSize[1]; y++ {
+						for x := halo; x < halo+outSize[0]; x++ {
+							in := (z*inSize[1]+y)*inSize[0] + x
+							var value float64
+							if dist != nil {
+								value = math.Min(math.Sqrt(dist[in]), math.Min(radius, maxValue))
+							} else if result[in] {
+								value = maxValue
+							}
+							WriteValue(out[n*bytesPerVoxel:], t, props.ByteOrder, value)
+							n++
+						}
+					}
+				}
+				if err := write(dvid.NewSubvolume(tile, outSize), out); err != nil {
+					return err
+				}
+				done++
+				if progress != nil {
+					progress(float32(done) / float32(numTiles))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// newDerivedData creates data of the given type that has the same blocks and voxel
+// size as this data and returns it as an IntHandler.
+func (d *Data) newDerivedData(uuid dvid.UUID, typename dvid.TypeString, name string) (IntHandler, error) {
+	return d.newScaledData(uuid, typename, name, 1)
+}
+
+// newScaledData creates data of the given type that has the same blocks as this data and
+// voxels scaled by the given factor, e.g., 2 for a 2x downsampling.
+func (d *Data) newScaledData(uuid dvid.UUID, typename dvid.TypeString, name string, scale float32) (IntHandler, error) {
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Data %q must have 3d blocks", d.DataName())
+	}
+	config := dvid.NewConfig()
+	config.SetVersioned(d.IsVersioned())
+	config.Set("BlockSize", fmt.Sprintf("%d,%d,%d", blockSize[0], blockSize[1], blockSize[2]))
+	voxelSize := make([]string, len(d.VoxelSize))
+	for n, size := range d.VoxelSize {
+		voxelSize[n] = strconv.FormatFloat(float64(size*scale), 'g', -1, 32)
+	}
+	config.Set("VoxelSize", strings.Join(voxelSize, ","))
+	service := server.DatastoreService()
+	if err := service.NewData(uuid, typename, dvid.DataString(name), config); err != nil {
+		return nil, err
+	}
+	dataservice, err := service.DataServiceByUUID(uuid, dvid.DataString(name))
+	if err != nil {
+		return nil, err
+	}
+	dest, ok := dataservice.(IntHandler)
+	if !ok {
+		return nil, fmt.Errorf("Unable to write voxels to %q", name)
+	}
+	return dest, nil
+}
+
+// morphCommand handles the "morph <operation> <new data name>" RPC command, which starts
+// a job that writes the result of a morphology operation into new data of this type.
+func (d *Data) morphCommand(request datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataName, cmdStr, op, destName string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &op, &destName)
+	if destName == "" {
+		return fmt.Errorf("Poorly formatted morph command.  See command-line help.")
+	}
+	valid := false
+	for _, name := range MorphologyOps {
+		valid = valid || op == name
+	}
+	if !valid {
+		return fmt.Errorf("Unknown morphology operation %q", op)
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+
+	threshold, radius := 1.0, 1.0
+	radiusKey := "radius"
+	if op == "distance" {
+		radius, radiusKey = DefaultMaxDistance, "maxdistance"
+	}
+	if s, found := request.Setting("threshold"); found {
+		if threshold, err = strconv.ParseFloat(s, 64); err != nil {
+			return fmt.Errorf("Bad threshold %q: %s", s, err.Error())
+		}
+	}
+	if s, found := request.Setting(radiusKey); found {
+		if radius, err = strconv.ParseFloat(s, 64); err != nil {
+			return fmt.Errorf("Bad %s %q: %s", radiusKey, s, err.Error())
+		}
+	}
+
+	// The operation covers the data extents unless a subvolume is given.
+	var offset, size dvid.Point
+	if d.MinPoint != nil && d.MaxPoint != nil {
+		offset = d.MinPoint
+		size = d.MaxPoint.Sub(d.MinPoint).AddScalar(1)
+	}
+	if offsetStr, found := request.Setting("offset"); found {
+		if offset, err = dvid.StringToPoint(offsetStr, ","); err != nil {
+			return err
+		}
+	}
+	if sizeStr, found := request.Setting("size"); found {
+		if size, err = dvid.StringToPoint(sizeStr, ","); err != nil {
+			return err
+		}
+	}
+	offset3d, ok1 := offset.(dvid.Point3d)
+	size3d, ok2 := size.(dvid.Point3d)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("No stored voxels to process.  Specify 3d offset and size settings.")
+	}
+
+	dest, err := d.newDerivedData(uuid, d.DatatypeName(), destName)
+	if err != nil {
+		return err
+	}
+	ctx := request.Context()
+	description := fmt.Sprintf("Morphology %s of %q within %s into %q", op, d.DataName(),
+		dvid.NewSubvolume(offset3d, size3d), destName)
+	job := server.NewJob(description)
+	go func() {
+		write := func(subvol *dvid.Subvolume, data []byte) error {
+			e, err := dest.NewExtHandler(subvol, data)
+			if err != nil {
+				return err
+			}
+			return PutVoxels(ctx, uuid, dest, e)
+		}
+		err := Morphology(ctx, uuid, d, &(d.Properties), op, offset3d, size3d,
+			threshold, radius, write, job.SetProgress)
+		if err == nil {
+			err = server.DatastoreService().SaveDataset(uuid)
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to write %s of %q into %q.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, op, d.DataName(), destName, job.ID)
+	return nil
+}
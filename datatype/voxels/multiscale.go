@@ -0,0 +1,128 @@
+/*
+	This file describes the scales of voxels data in its /info JSON so viewers can configure
+	themselves from a single GET.  Every voxels-derived datatype adds a "Multiscale" section
+	giving, for each 2x downsampling served by precomputed requests, the voxel resolution in
+	abbreviated physical units and the offset and size of the stored extents at that scale.
+	Scales stored as separate data by the "pyramid" command are named.
+*/
+
+package voxels
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// ScaleInfo describes one scale of voxels data.  The extents at the scale span voxel
+// coordinates from Offset up to, but not including, Offset + Size.
+type ScaleInfo struct {
+	// Key is the precomputed scale key, e.g., "s1".
+	Key string
+
+	// Level is the number of 2x downsamplings from the stored voxels.
+	Level int
+
+	// Data names the data holding this scale if it was stored by the "pyramid" command.
+	Data dvid.DataString `json:",omitempty"`
+
+	// Resolution is the physical size of a voxel along each axis in Units.
+	Resolution []float32
+	Units      []string
+
+	Offset []int32
+	Size   []int32
+}
+
+// MultiscaleInfo describes all scales of voxels data, full resolution first.
+type MultiscaleInfo struct {
+	Axes   []string
+	Scales []ScaleInfo
+}
+
+// abbreviateUnits returns the standard abbreviation of length units, e.g., "nm" for
+// "nanometers", or the units unchanged if they're not known.
+func abbreviateUnits(units string) string {
+	switch strings.ToLower(units) {
+	case "nanometers", "nanometer", "nm":
+		return "nm"
+	case "micrometers", "micrometer", "microns", "micron", "um", "µm":
+		return "µm"
+	case "millimeters", "millimeter", "mm":
+		return "mm"
+	case "meters", "meter", "m":
+		return "m"
+	}
+	return units
+}
+
+// MultiscaleInfo returns the scales of data with these properties.  Only 3d data has
+// more than one scale.
+func (props *Properties) MultiscaleInfo() MultiscaleInfo {
+	dims := int(props.BlockSize.NumDims())
+	var info MultiscaleInfo
+	for _, axis := range props.Axes() {
+		info.Axes = append(info.Axes, axis.Name)
+	}
+	numLevels := 0
+	if dims == 3 {
+		numLevels = NumPyramidLevels(&props.Extents, props.BlockSize)
+	}
+	for level := 0; level <= numLevels; level++ {
+		factor := int32(1) << uint(level)
+		scale := ScaleInfo{
+			Key:        scaleKey(level),
+			Level:      level,
+			Resolution: make([]float32, dims),
+			Units:      make([]string, dims),
+			Offset:     make([]int32, dims),
+			Size:       make([]int32, dims),
+		}
+		for dim := 0; dim < dims; dim++ {
+			if dim < len(props.VoxelSize) {
+				scale.Resolution[dim] = props.VoxelSize[dim] * float32(factor)
+			}
+			if dim < len(props.VoxelUnits) {
+				scale.Units[dim] = abbreviateUnits(props.VoxelUnits[dim])
+			}
+			if props.MinPoint != nil && props.MaxPoint != nil {
+				scale.Offset[dim] = floorDiv(props.MinPoint.Value(uint8(dim)), factor)
+				scale.Size[dim] = floorDiv(props.MaxPoint.Value(uint8(dim)), factor) + 1 - scale.Offset[dim]
+			}
+		}
+		info.Scales = append(info.Scales, scale)
+	}
+	return info
+}
+
+// InfoJSON returns the /info JSON of voxels-derived data, i.e., the JSON of the full
+// data, which embeds d, with a "Multiscale" section describing its scales at a version.
+func (d *Data) InfoJSON(uuid dvid.UUID, data interface{}) (string, error) {
+	m, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(m, &fields); err != nil {
+		return "", err
+	}
+	multiscale := d.Properties.MultiscaleInfo()
+	if service := server.DatastoreService(); service != nil {
+		for n := range multiscale.Scales[1:] {
+			scale := &multiscale.Scales[n+1]
+			name := PyramidLevelName(d.DataName(), scale.Level)
+			if _, err := service.DataServiceByUUID(uuid, name); err == nil {
+				scale.Data = name
+			}
+		}
+	}
+	if fields["Multiscale"], err = json.Marshal(multiscale); err != nil {
+		return "", err
+	}
+	if m, err = json.Marshal(fields); err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
@@ -0,0 +1,361 @@
+/*
+	This file exports 3d voxels into an N5 container with BigDataViewer (BDV) XML so the data
+	and its downsampled pyramid can be opened directly in Fiji/BigStitcher.  Exports are
+	written through an ExportWriter to a local directory or an object store.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var n5DataTypes = map[dvid.DataType]string{
+	dvid.T_uint8:   "uint8",
+	dvid.T_int8:    "int8",
+	dvid.T_uint16:  "uint16",
+	dvid.T_int16:   "int16",
+	dvid.T_uint32:  "uint32",
+	dvid.T_int32:   "int32",
+	dvid.T_uint64:  "uint64",
+	dvid.T_int64:   "int64",
+	dvid.T_float32: "float32",
+	dvid.T_float64: "float64",
+}
+
+// N5Export describes the export of 3d voxels into an N5/BDV layout.
+type N5Export struct {
+	// NumScales is the number of pyramid levels including full resolution.  If zero,
+	// levels are added until a whole level fits within one block.
+	NumScales int
+
+	// Compress blocks with gzip.
+	Compress bool
+}
+
+// n5Scales returns the number of scales needed until a level fits within one block.
+func n5Scales(size, blockSize dvid.Point3d) int {
+	numScales := 1
+	for factor := int32(1); numScales < MaxPrecomputedScales; factor *= 2 {
+		fits := true
+		for dim := 0; dim < 3; dim++ {
+			if (size[dim]+factor-1)/factor > blockSize[dim] {
+				fits = false
+			}
+		}
+		if fits {
+			break
+		}
+		numScales++
+	}
+	return numScales
+}
+
+// ExportN5 writes the voxels within the data extents for a version into an N5 container,
+// "<name>.n5", using the BDV layout "setup0/timepoint0/s<level>" and a BDV XML file,
+// "<name>.xml", referencing it.
+func ExportN5(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, name string, export N5Export,
+	w *ExportWriter) error {
+
+	if props.BlockSize.NumDims() != 3 {
+		return fmt.Errorf("N5 export requires 3d data, not %d-d", props.BlockSize.NumDims())
+	}
+	if len(props.Values) != 1 {
+		return fmt.Errorf("N5 export only handles single-channel voxels, not %d values/voxel", len(props.Values))
+	}
+	typeName, found := n5DataTypes[props.Values[0].T]
+	if !found {
+		return fmt.Errorf("Data values %v have no N5 equivalent", props.Values)
+	}
+	if props.MinPoint == nil || props.MaxPoint == nil {
+		return fmt.Errorf("Data '%s' has no stored voxels to export", name)
+	}
+
+	var origin, size, blockSize dvid.Point3d
+	var resolution [3]float32
+	units := "nanometers"
+	for dim := uint8(0); dim < 3; dim++ {
+		origin[dim] = props.MinPoint.Value(dim)
+		size[dim] = props.MaxPoint.Value(dim) - origin[dim] + 1
+		blockSize[dim] = props.BlockSize.Value(dim)
+		resolution[dim] = 1
+		if int(dim) < len(props.VoxelSize) && props.VoxelSize[dim] > 0 {
+			resolution[dim] = props.VoxelSize[dim]
+		}
+	}
+	if len(props.VoxelUnits) > 0 && props.VoxelUnits[0] != "" {
+		units = props.VoxelUnits[0]
+	}
+	numScales := export.NumScales
+	if numScales <= 0 {
+		numScales = n5Scales(size, blockSize)
+	}
+	compression := map[string]interface{}{"type": "raw"}
+	if export.Compress {
+		compression = map[string]interface{}{"type": "gzip", "level": -1}
+	}
+
+	// Write container and BDV setup/timepoint attributes.
+	n5Dir := name + ".n5"
+	factors := make([][3]int32, numScales)
+	for level := range factors {
+		f := int32(1) << uint(level)
+		factors[level] = [3]int32{f, f, f}
+	}
+	if err := w.PutJSON(n5Dir+"/attributes.json", map[string]interface{}{"n5": "2.0.0"}); err != nil {
+		return err
+	}
+	setupDir := n5Dir + "/setup0"
+	err := w.PutJSON(setupDir+"/attributes.json", map[string]interface{}{
+		"downsamplingFactors": factors,
+		"dataType":            typeName,
+	})
+	if err != nil {
+		return err
+	}
+	timepointDir := setupDir + "/timepoint0"
+	err = w.PutJSON(timepointDir+"/attributes.json", map[string]interface{}{
+		"resolution":       resolution,
+		"units":            units,
+		"offset":           origin,
+		"saved_completely": true,
+		"multiScale":       true,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write each level, reading full resolution data for each block and downsampling.
+	for level := 0; level < numScales; level++ {
+		startTime := time.Now()
+		factor := int32(1) << uint(level)
+		var dims, numBlocks dvid.Point3d
+		for dim := 0; dim < 3; dim++ {
+			dims[dim] = (size[dim] + factor - 1) / factor
+			numBlocks[dim] = (dims[dim] + blockSize[dim] - 1) / blockSize[dim]
+		}
+		levelDir := fmt.Sprintf("%s/s%d", timepointDir, level)
+		err := w.PutJSON(levelDir+"/attributes.json", map[string]interface{}{
+			"dimensions":          dims,
+			"blockSize":           blockSize,
+			"dataType":            typeName,
+			"compression":         compression,
+			"downsamplingFactors": factors[level],
+			"pixelResolution": map[string]interface{}{
+				"dimensions": [3]float32{resolution[0] * float32(factor),
+					resolution[1] * float32(factor), resolution[2] * float32(factor)},
+				"unit": units,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for bz := int32(0); bz < numBlocks[2]; bz++ {
+			for by := int32(0); by < numBlocks[1]; by++ {
+				for bx := int32(0); bx < numBlocks[0]; bx++ {
+					key := fmt.Sprintf("%s/%d/%d/%d", levelDir, bx, by, bz)
+					if w.Completed(key) {
+						continue
+					}
+					block, err := exportN5Block(ctx, uuid, i, props, export, origin, dims,
+						blockSize, dvid.Point3d{bx, by, bz}, factor)
+					if err != nil {
+						return err
+					}
+					if err := w.Put(key, block); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "Exported level %d of '%s' to N5", level, name)
+	}
+
+	bdvXML, err := bdvXML(name, size, origin, resolution, units)
+	if err != nil {
+		return err
+	}
+	return w.Put(name+".xml", bdvXML)
+}
+
+// exportN5Block returns one encoded N5 block of a level, truncated at the level dimensions.
+func exportN5Block(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, export N5Export,
+	origin, dims, blockSize, blockCoord dvid.Point3d, factor int32) ([]byte, error) {
+
+	var offset, readSize, blockDims dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		beg := blockCoord[dim] * blockSize[dim]
+		offset[dim] = origin[dim] + beg*factor
+		readSize[dim] = blockSize[dim] * factor
+		blockDims[dim] = blockSize[dim]
+		if beg+blockDims[dim] > dims[dim] {
+			blockDims[dim] = dims[dim] - beg
+		}
+	}
+	e, err := i.NewExtHandler(dvid.NewSubvolume(offset, readSize), nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := GetVolume(ctx, uuid, i, e)
+	if err != nil {
+		return nil, err
+	}
+	if factor > 1 {
+		data, err = downsample3d(data, props.Values, props.ByteOrder, readSize, factor, props.Interpolable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Crop to the block dimensions and convert to the big endian N5 layout.
+	bytesPerVoxel := int64(props.Values.BytesPerElement())
+	rowBytes := int64(blockDims[0]) * bytesPerVoxel
+	cropped := make([]byte, int64(blockDims[2])*int64(blockDims[1])*rowBytes)
+	var dst int64
+	for z := int64(0); z < int64(blockDims[2]); z++ {
+		for y := int64(0); y < int64(blockDims[1]); y++ {
+			src := ((z*int64(blockSize[1]) + y) * int64(blockSize[0])) * bytesPerVoxel
+			copy(cropped[dst:dst+rowBytes], data[src:src+rowBytes])
+			dst += rowBytes
+		}
+	}
+	bigendian, err := littleToBigEndian(e, cropped)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(0)) // default block mode
+	binary.Write(&buf, binary.BigEndian, uint16(3))
+	for dim := 0; dim < 3; dim++ {
+		binary.Write(&buf, binary.BigEndian, uint32(blockDims[dim]))
+	}
+	if export.Compress {
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(bigendian); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	} else {
+		buf.Write(bigendian)
+	}
+	return buf.Bytes(), nil
+}
+
+type bdvSpimData struct {
+	XMLName             xml.Name `xml:"SpimData"`
+	Version             string   `xml:"version,attr"`
+	BasePath            bdvPath  `xml:"BasePath"`
+	SequenceDescription struct {
+		ImageLoader struct {
+			Format  string  `xml:"format,attr"`
+			Version string  `xml:"version,attr"`
+			N5      bdvPath `xml:"n5"`
+		}
+		ViewSetups struct {
+			ViewSetup struct {
+				ID        int    `xml:"id"`
+				Name      string `xml:"name"`
+				Size      string `xml:"size"`
+				VoxelSize struct {
+					Unit string `xml:"unit"`
+					Size string `xml:"size"`
+				} `xml:"voxelSize"`
+			}
+		}
+		Timepoints struct {
+			Type  string `xml:"type,attr"`
+			First int    `xml:"first"`
+			Last  int    `xml:"last"`
+		}
+	}
+	ViewRegistrations struct {
+		ViewRegistration struct {
+			Timepoint     int `xml:"timepoint,attr"`
+			Setup         int `xml:"setup,attr"`
+			ViewTransform struct {
+				Type   string `xml:"type,attr"`
+				Affine string `xml:"affine"`
+			}
+		}
+	}
+}
+
+type bdvPath struct {
+	Type string `xml:"type,attr"`
+	Path string `xml:",chardata"`
+}
+
+// bdvXML returns the BDV XML describing a single setup and timepoint N5 container.
+func bdvXML(name string, size, origin dvid.Point3d, resolution [3]float32, units string) ([]byte, error) {
+	var spim bdvSpimData
+	spim.Version = "0.2"
+	spim.BasePath = bdvPath{"relative", "."}
+	loader := &spim.SequenceDescription.ImageLoader
+	loader.Format = "bdv.n5"
+	loader.Version = "1.0"
+	loader.N5 = bdvPath{"relative", name + ".n5"}
+	setup := &spim.SequenceDescription.ViewSetups.ViewSetup
+	setup.Name = name
+	setup.Size = fmt.Sprintf("%d %d %d", size[0], size[1], size[2])
+	setup.VoxelSize.Unit = units
+	setup.VoxelSize.Size = fmt.Sprintf("%g %g %g", resolution[0], resolution[1], resolution[2])
+	spim.SequenceDescription.Timepoints.Type = "range"
+
+	// The affine transform scales voxels to physical units and places the export origin.
+	var affine []string
+	for dim := 0; dim < 3; dim++ {
+		for col := 0; col < 3; col++ {
+			value := float32(0)
+			if col == dim {
+				value = resolution[dim]
+			}
+			affine = append(affine, fmt.Sprintf("%g", value))
+		}
+		affine = append(affine, fmt.Sprintf("%g", float32(origin[dim])*resolution[dim]))
+	}
+	transform := &spim.ViewRegistrations.ViewRegistration.ViewTransform
+	transform.Type = "affine"
+	transform.Affine = strings.Join(affine, " ")
+
+	m, err := xml.MarshalIndent(spim, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), m...), nil
+}
+
+// n5ExportSettings returns the N5 export options given by "scales" and "compression"
+// settings of an export command.
+func n5ExportSettings(request datastore.Request) (N5Export, error) {
+	export := N5Export{Compress: true}
+	if scalesStr, found := request.Setting("scales"); found {
+		var err error
+		if export.NumScales, err = strconv.Atoi(scalesStr); err != nil {
+			return export, fmt.Errorf("Bad scales setting '%s': %s", scalesStr, err.Error())
+		}
+	}
+	if compressStr, found := request.Setting("compression"); found {
+		switch strings.ToLower(compressStr) {
+		case "gzip":
+		case "raw", "none":
+			export.Compress = false
+		default:
+			return export, fmt.Errorf("Unknown N5 compression '%s'", compressStr)
+		}
+	}
+	return export, nil
+}
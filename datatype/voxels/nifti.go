@@ -0,0 +1,165 @@
+/*
+	This file handles NIfTI-1 import and export of 3d voxels, mapping NIfTI spacing and
+	units onto the voxel resolution properties.
+*/
+
+package voxels
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// isNiftiFile returns true if the filename has a NIfTI-1 extension, ".nii" or ".nii.gz".
+func isNiftiFile(filename string) bool {
+	lower := strings.ToLower(filename)
+	return strings.HasSuffix(lower, ".nii") || strings.HasSuffix(lower, ".nii.gz")
+}
+
+// readNiftiFile reads a possibly gzipped NIfTI-1 file.
+func readNiftiFile(filename string) (*dvid.NiftiVolume, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open NIfTI file (%s).  Is this visible to server process?", filename)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return dvid.ReadNifti(r)
+}
+
+// loadNifti stores each NIfTI volume at the offset, stacking successive files along Z.
+// If the data can be reconfigured, the voxel size and units of the first file become the
+// resolution properties of the data.
+func loadNifti(ctx context.Context, i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []string) error {
+	values := i.Values()
+	if len(values) != 1 {
+		return fmt.Errorf("NIfTI loads only handle single-channel voxels, not %d values/voxel", len(values))
+	}
+	for n, filename := range filenames {
+		vol, err := readNiftiFile(filename)
+		if err != nil {
+			return err
+		}
+		if vol.DataType != values[0].T {
+			return fmt.Errorf("NIfTI file %s has a data type that differs from %v", filename, values)
+		}
+		subvol := dvid.NewSubvolume(offset, vol.Size)
+		e, err := i.NewExtHandler(subvol, vol.Data)
+		if err != nil {
+			return err
+		}
+		if err = PutVoxels(ctx, uuid, i, e); err != nil {
+			return err
+		}
+		if n == 0 && vol.Units != "" {
+			if modifier, ok := i.(interface {
+				ModifyConfig(dvid.Config) error
+			}); ok {
+				config := dvid.NewConfig()
+				config.Set("VoxelSize", fmt.Sprintf("%g,%g,%g", vol.VoxelSize[0], vol.VoxelSize[1], vol.VoxelSize[2]))
+				config.Set("VoxelUnits", strings.Repeat(vol.Units+",", 2)+vol.Units)
+				if err := modifier.ModifyConfig(config); err != nil {
+					return err
+				}
+				if err := server.DatastoreService().SaveDataset(uuid); err != nil {
+					return err
+				}
+			}
+		}
+		offset = offset.Add(dvid.Point3d{0, 0, vol.Size[2]})
+	}
+	return nil
+}
+
+// exportNiftiCommand handles the "export nifti <filename>" RPC command.  The optional
+// "offset" and "size" settings give the subvolume, which defaults to the data extents,
+// and "checksums=true" writes a checksum manifest named "<filename>.checksums.json".
+func (d *Data) exportNiftiCommand(request datastore.Request, uuid dvid.UUID, filename string) error {
+	checksums, err := checksumsSetting(request)
+	if err != nil {
+		return err
+	}
+	if err := d.writeNifti(request, uuid, filename); err != nil {
+		return err
+	}
+	if !checksums {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	manifest := dvid.NewChecksumManifest(fmt.Sprintf("nifti of %q at version %s", d.DataName(), uuid))
+	manifest.Add(filepath.Base(filename), data)
+	m, err := manifest.JSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename+".checksums.json", m, 0644)
+}
+
+func (d *Data) writeNifti(request datastore.Request, uuid dvid.UUID, filename string) error {
+	var offset, size dvid.Point
+	var err error
+	if d.MinPoint != nil && d.MaxPoint != nil {
+		offset = d.MinPoint
+		size = d.MaxPoint.Sub(d.MinPoint).AddScalar(1)
+	}
+	if offsetStr, found := request.Setting("offset"); found {
+		if offset, err = dvid.StringToPoint(offsetStr, ","); err != nil {
+			return err
+		}
+	}
+	if sizeStr, found := request.Setting("size"); found {
+		if size, err = dvid.StringToPoint(sizeStr, ","); err != nil {
+			return err
+		}
+	}
+	if offset == nil || size == nil {
+		return fmt.Errorf("No stored voxels to export.  Specify offset and size settings.")
+	}
+	e, err := d.NewExtHandler(dvid.NewSubvolume(offset, size), nil)
+	if err != nil {
+		return err
+	}
+	if err = GetVoxels(request.Context(), uuid, d, e); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser = f
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		w = gzip.NewWriter(f)
+	}
+	if err = d.EncodeArray(w, e, "nii"); err != nil {
+		f.Close()
+		return err
+	}
+	if w != f {
+		if err = w.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
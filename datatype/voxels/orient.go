@@ -0,0 +1,137 @@
+/*
+	This file reorients retrieved voxels with flips and axis permutations so clients of
+	differently-oriented acquisitions don't have to reorient every response.
+*/
+
+package voxels
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// axisLetters name the axes of a request in order, so for an XZ slice "x" is the
+// request's X axis and "y" is its Z axis.
+const axisLetters = "xyz"
+
+// Orientation reorients voxels read for a request.  Axis i of the result is axis Axes[i]
+// of the request, reversed if Flip[i] is true.
+type Orientation struct {
+	Axes []int
+	Flip []bool
+}
+
+// ParseOrientation returns the orientation given by the "axes" and "flip" query strings
+// for a request with numDims axes, or nil if neither is given.  Axes is a permutation of
+// the request's axes, e.g., "yx" to transpose a slice or "zyx" to swap x and z of a
+// subvolume.  Flip lists axes of the result to reverse, e.g., "y" or "x,z".
+func ParseOrientation(query url.Values, numDims int) (*Orientation, error) {
+	axesStr, flipStr := strings.ToLower(query.Get("axes")), strings.ToLower(query.Get("flip"))
+	if axesStr == "" && flipStr == "" {
+		return nil, nil
+	}
+	letters := axisLetters[:numDims]
+	o := &Orientation{Axes: make([]int, numDims), Flip: make([]bool, numDims)}
+	if axesStr == "" {
+		for i := range o.Axes {
+			o.Axes[i] = i
+		}
+	} else {
+		if len(axesStr) != numDims {
+			return nil, fmt.Errorf("Bad axes %q: must order all %d axes %q", axesStr, numDims, letters)
+		}
+		used := make([]bool, numDims)
+		for i, c := range axesStr {
+			axis := strings.IndexRune(letters, c)
+			if axis < 0 || used[axis] {
+				return nil, fmt.Errorf("Bad axes %q: must order all %d axes %q", axesStr, numDims, letters)
+			}
+			used[axis] = true
+			o.Axes[i] = axis
+		}
+	}
+	if flipStr != "" {
+		for _, name := range strings.Split(flipStr, ",") {
+			axis := strings.Index(letters, name)
+			if len(name) != 1 || axis < 0 {
+				return nil, fmt.Errorf("Bad flip %q: must list axes from %q", flipStr, letters)
+			}
+			o.Flip[axis] = true
+		}
+	}
+	return o, nil
+}
+
+// Apply reorients the voxels in place, changing the size of the ExtHandler's geometry
+// to that of the result.  Its offset is unchanged.
+func (o *Orientation) Apply(e ExtHandler) error {
+	size := e.Size()
+	numDims := int(size.NumDims())
+	if numDims != len(o.Axes) {
+		return fmt.Errorf("Orientation of %d axes can't be applied to %d-d voxels", len(o.Axes), numDims)
+	}
+	bytesPerVoxel := int64(e.Values().BytesPerElement())
+	inSize := make([]int64, numDims)
+	inStride := make([]int64, numDims)
+	stride := bytesPerVoxel
+	for dim := 0; dim < numDims; dim++ {
+		inSize[dim] = int64(size.Value(uint8(dim)))
+		inStride[dim] = stride
+		stride *= inSize[dim]
+	}
+	data := e.Data()
+	if int64(len(data)) < stride || int64(e.Stride()) != inSize[0]*bytesPerVoxel {
+		return fmt.Errorf("Voxels %s can't be reoriented", e)
+	}
+
+	// For each axis of the result, get its size and the step in the input data as the
+	// result's coordinate increases.
+	outSize := make([]int64, numDims)
+	step := make([]int64, numDims)
+	var start int64
+	for i, axis := range o.Axes {
+		outSize[i] = inSize[axis]
+		step[i] = inStride[axis]
+		if o.Flip[i] {
+			start += (outSize[i] - 1) * step[i]
+			step[i] = -step[i]
+		}
+	}
+
+	result := make([]byte, stride)
+	coord := make([]int64, numDims)
+	pos := start
+	for out := int64(0); out < stride; out += bytesPerVoxel {
+		copy(result[out:out+bytesPerVoxel], data[pos:pos+bytesPerVoxel])
+		for dim := 0; dim < numDims; dim++ {
+			coord[dim]++
+			pos += step[dim]
+			if coord[dim] < outSize[dim] {
+				break
+			}
+			pos -= coord[dim] * step[dim]
+			coord[dim] = 0
+		}
+	}
+	copy(data, result)
+
+	switch numDims {
+	case 2:
+		geom, err := dvid.NewOrthogSlice(e.DataShape(), e.StartPoint(),
+			dvid.Point2d{int32(outSize[0]), int32(outSize[1])})
+		if err != nil {
+			return err
+		}
+		e.SetGeometry(geom)
+	case 3:
+		e.SetGeometry(dvid.NewSubvolume(e.StartPoint(),
+			dvid.Point3d{int32(outSize[0]), int32(outSize[1]), int32(outSize[2])}))
+	default:
+		return fmt.Errorf("Only 2d and 3d voxels can be reoriented")
+	}
+	e.SetStride(int32(outSize[0] * bytesPerVoxel))
+	return nil
+}
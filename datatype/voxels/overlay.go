@@ -0,0 +1,263 @@
+/*
+	This file renders slices of grayscale data with label and point annotation overlays
+	into a single image, for reports and lightweight viewers without client-side compositing.
+*/
+
+package voxels
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// DefaultOverlayAlpha is the default opacity of label colors on overlays.
+	DefaultOverlayAlpha = 0.5
+
+	// DefaultOverlayRadius is the default radius in voxels of drawn point annotations.
+	DefaultOverlayRadius = 3
+
+	// MaxOverlayRadius is the largest radius in voxels of drawn point annotations.
+	MaxOverlayRadius = 256
+)
+
+// pointAnnotator is implemented by data holding point annotations, e.g., annotation data,
+// so their points can be drawn on overlays.
+type pointAnnotator interface {
+	AnnotationPoints(uuid dvid.UUID, minPt, maxPt dvid.Point3d) ([]dvid.Point3d, error)
+}
+
+// annotationColor is the color of drawn point annotations.
+var annotationColor = color.NRGBA{255, 255, 0, 255}
+
+// LabelColor returns the color of a label in the fixed hash colormap used for overlays,
+// so a label has the same color in every rendering.  Label 0 is background and has no color.
+func LabelColor(label uint64) color.NRGBA {
+	if label == 0 {
+		return color.NRGBA{}
+	}
+	// splitmix64 finalizer so neighboring labels get unrelated colors.
+	h := label + 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	h ^= h >> 31
+	// Keep every channel above 64 so colors stand out on dark EM.
+	return color.NRGBA{byte(h)>>1 | 0x40, byte(h>>8)>>1 | 0x40, byte(h>>16)>>1 | 0x40, 255}
+}
+
+// readLabel returns the unsigned integer at the start of b.
+func readLabel(b []byte, t dvid.DataType, byteOrder binary.ByteOrder) uint64 {
+	switch t {
+	case dvid.T_uint8:
+		return uint64(b[0])
+	case dvid.T_uint16:
+		return uint64(byteOrder.Uint16(b))
+	case dvid.T_uint32:
+		return uint64(byteOrder.Uint32(b))
+	default:
+		return byteOrder.Uint64(b)
+	}
+}
+
+// RenderOverlay returns an image of a slice of uint8 data blended with the colormap colors
+// of any labels at each voxel and with any point annotations within radius of the slice
+// drawn as discs.  Either of labels and points can be nil.
+func RenderOverlay(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	slice dvid.Geometry, labels IntHandler, cm Colormap, points pointAnnotator, alpha float64,
+	radius int32) (*image.NRGBA, error) {
+
+	if len(props.Values) != 1 || props.Values[0].T != dvid.T_uint8 {
+		return nil, fmt.Errorf("Overlays can only be rendered on uint8 data")
+	}
+	if admitter, ok := i.(requestAdmitter); ok {
+		release, err := admitter.AdmitRequest(ctx, slice)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	e, err := i.NewExtHandler(slice, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dvid.PutBuffer(e.Data())
+	if err := GetVoxels(ctx, uuid, i, e); err != nil {
+		return nil, err
+	}
+	width, height := slice.Size().Value(0), slice.Size().Value(1)
+	gray, grayStride := e.Data(), e.Stride()
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	for y := int32(0); y < height; y++ {
+		for x := int32(0); x < width; x++ {
+			v := gray[y*grayStride+x]
+			img.SetNRGBA(int(x), int(y), color.NRGBA{v, v, v, 255})
+		}
+	}
+
+	if labels != nil {
+		values := labels.Values()
+		le, err := labels.NewExtHandler(slice, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dvid.PutBuffer(le.Data())
+		if err := GetVoxels(ctx, uuid, labels, le); err != nil {
+			return nil, err
+		}
+		data, stride := le.Data(), le.Stride()
+		bytesPerVoxel := int32(values.BytesPerElement())
+		byteOrder := le.ByteOrder()
+		for y := int32(0); y < height; y++ {
+			for x := int32(0); x < width; x++ {
+				c := cm.Color(readLabel(data[y*stride+x*bytesPerVoxel:], values[0].T, byteOrder))
+				if c.A == 0 {
+					continue
+				}
+				a := alpha * float64(c.A) / 255
+				base := img.NRGBAAt(int(x), int(y))
+				blend := func(b, c uint8) uint8 {
+					return uint8((1-a)*float64(b) + a*float64(c) + 0.5)
+				}
+				img.SetNRGBA(int(x), int(y), color.NRGBA{blend(base.R, c.R), blend(base.G, c.G), blend(base.B, c.B), 255})
+			}
+		}
+	}
+
+	if points != nil {
+		shape := slice.DataShape()
+		xDim, err := shape.ShapeDimension(0)
+		if err != nil {
+			return nil, err
+		}
+		yDim, err := shape.ShapeDimension(1)
+		if err != nil {
+			return nil, err
+		}
+		start, ok := slice.StartPoint().(dvid.Point3d)
+		if !ok {
+			return nil, fmt.Errorf("Overlays require slices of 3d data")
+		}
+		zDim := 3 - xDim - yDim
+		minPt, maxPt := start, slice.EndPoint().(dvid.Point3d)
+		minPt[xDim], maxPt[xDim] = minPt[xDim]-radius, maxPt[xDim]+radius
+		minPt[yDim], maxPt[yDim] = minPt[yDim]-radius, maxPt[yDim]+radius
+		minPt[zDim], maxPt[zDim] = minPt[zDim]-radius, maxPt[zDim]+radius
+		pts, err := points.AnnotationPoints(uuid, minPt, maxPt)
+		if err != nil {
+			return nil, err
+		}
+		for _, pt := range pts {
+			// Points off the slice are drawn smaller so they fade in and out while paging.
+			dz := pt[zDim] - start[zDim]
+			r2 := radius*radius - dz*dz
+			if r2 < 0 {
+				continue
+			}
+			px, py := pt[xDim]-start[xDim], pt[yDim]-start[yDim]
+			for y := py - radius; y <= py+radius; y++ {
+				for x := px - radius; x <= px+radius; x++ {
+					if (x-px)*(x-px)+(y-py)*(y-py) <= r2 {
+						img.SetNRGBA(int(x), int(y), annotationColor)
+					}
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+// ServeOverlay handles requests for overlay renderings in the form
+// GET <api URL>/node/<UUID>/<data name>/overlay/<dims>/<size>/<offset>[/<format>].
+func ServeOverlay(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Overlays can only be retrieved with GET")
+	}
+	if len(parts) < 7 {
+		return fmt.Errorf("'overlay' must be followed by shape/size/offset")
+	}
+	slice, err := dvid.NewSliceFromStrings(dvid.DataShapeString(parts[4]), parts[6], parts[5], "_")
+	if err != nil {
+		return err
+	}
+	if err := CheckLimits(i, slice); err != nil {
+		return err
+	}
+	var formatStr string
+	if len(parts) >= 8 {
+		formatStr = parts[7]
+	}
+
+	query := r.URL.Query()
+	service := server.DatastoreService()
+	var labels IntHandler
+	var cm Colormap
+	if name := query.Get("labels"); name != "" {
+		dataservice, err := service.DataServiceByUUID(uuid, dvid.DataString(name))
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if labels, ok = dataservice.(IntHandler); !ok {
+			return fmt.Errorf("Data '%s' doesn't hold voxels", name)
+		}
+		values := labels.Values()
+		if len(values) != 1 {
+			return fmt.Errorf("Data '%s' must have a single label value per voxel", name)
+		}
+		switch values[0].T {
+		case dvid.T_uint8, dvid.T_uint16, dvid.T_uint32, dvid.T_uint64:
+		default:
+			return fmt.Errorf("Data '%s' must have unsigned integer labels", name)
+		}
+		colormapName := query.Get("colormap")
+		if colormapName == "" {
+			colormapName = DefaultColormap
+		}
+		if cm, err = GetColormap(labels, colormapName); err != nil {
+			return err
+		}
+	}
+	var points pointAnnotator
+	if name := query.Get("annotations"); name != "" {
+		dataservice, err := service.DataServiceByUUID(uuid, dvid.DataString(name))
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if points, ok = dataservice.(pointAnnotator); !ok {
+			return fmt.Errorf("Data '%s' doesn't hold point annotations", name)
+		}
+	}
+	alpha := DefaultOverlayAlpha
+	if s := query.Get("alpha"); s != "" {
+		if alpha, err = strconv.ParseFloat(s, 64); err != nil || alpha < 0 || alpha > 1 {
+			return fmt.Errorf("Bad alpha %q: must be a number from 0 to 1", s)
+		}
+	}
+	radius := int32(DefaultOverlayRadius)
+	if s := query.Get("radius"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > MaxOverlayRadius {
+			return fmt.Errorf("Bad radius %q: must be an integer from 0 to %d", s, MaxOverlayRadius)
+		}
+		radius = int32(n)
+	}
+
+	img, err := RenderOverlay(r.Context(), uuid, i, props, slice, labels, cm, points, alpha, radius)
+	if err != nil {
+		return err
+	}
+	return dvid.WriteImageHttp(w, img, formatStr)
+}
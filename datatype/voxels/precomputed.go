@@ -0,0 +1,428 @@
+/*
+	This file serves 3d voxels in the Neuroglancer "precomputed" layout, generating an info
+	JSON and raw-encoded chunks at multiple scales on the fly from stored blocks.
+*/
+
+package voxels
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxPrecomputedScales is the maximum number of scales, each a 2x downsampling of the
+// previous one, advertised in precomputed info.
+const MaxPrecomputedScales = 8
+
+var precomputedDataTypes = map[dvid.DataType]string{
+	dvid.T_uint8:   "uint8",
+	dvid.T_int8:    "int8",
+	dvid.T_uint16:  "uint16",
+	dvid.T_int16:   "int16",
+	dvid.T_uint32:  "uint32",
+	dvid.T_int32:   "int32",
+	dvid.T_uint64:  "uint64",
+	dvid.T_float32: "float32",
+}
+
+// PrecomputedScale describes one resolution level of a precomputed volume.
+type PrecomputedScale struct {
+	Key         string     `json:"key"`
+	Size        [3]int32   `json:"size"`
+	Resolution  [3]float32 `json:"resolution"`
+	VoxelOffset [3]int32   `json:"voxel_offset"`
+	ChunkSizes  [][3]int32 `json:"chunk_sizes"`
+	Encoding    string     `json:"encoding"`
+
+	// Fields only read when importing volumes written by other tools.
+	CompressedSegmentationBlockSize []int32         `json:"compressed_segmentation_block_size,omitempty"`
+	Sharding                        json.RawMessage `json:"sharding,omitempty"`
+}
+
+// PrecomputedInfo is the "info" JSON describing a Neuroglancer precomputed volume.
+type PrecomputedInfo struct {
+	Type        string             `json:"@type"`
+	VolumeType  string             `json:"type"`
+	DataType    string             `json:"data_type"`
+	NumChannels int                `json:"num_channels"`
+	Scales      []PrecomputedScale `json:"scales"`
+}
+
+// scaleKey returns the key for the scale downsampled by 2^level.
+func scaleKey(level int) string {
+	return fmt.Sprintf("s%d", level)
+}
+
+// PrecomputedInfo returns the precomputed info for 3d data with these properties.
+func (props *Properties) PrecomputedInfo() (*PrecomputedInfo, error) {
+	if props.BlockSize.NumDims() != 3 {
+		return nil, fmt.Errorf("Precomputed volumes require 3d data, not %d-d", props.BlockSize.NumDims())
+	}
+	dataType, err := props.Values.ValueDataType()
+	if err != nil {
+		return nil, err
+	}
+	typeName, found := precomputedDataTypes[dataType]
+	if !found {
+		return nil, fmt.Errorf("Data values %v have no Neuroglancer precomputed equivalent", props.Values)
+	}
+	info := &PrecomputedInfo{
+		Type:        "neuroglancer_multiscale_volume",
+		VolumeType:  "image",
+		DataType:    typeName,
+		NumChannels: len(props.Values),
+	}
+	if !props.Interpolable && len(props.Values) == 1 &&
+		(dataType == dvid.T_uint32 || dataType == dvid.T_uint64) {
+		info.VolumeType = "segmentation"
+	}
+
+	var minPt, maxPt [3]int32
+	if props.MinPoint != nil && props.MaxPoint != nil {
+		for dim := uint8(0); dim < 3; dim++ {
+			minPt[dim] = props.MinPoint.Value(dim)
+			maxPt[dim] = props.MaxPoint.Value(dim)
+		}
+	} else {
+		maxPt = [3]int32{-1, -1, -1}
+	}
+	var chunkSize [3]int32
+	var resolution [3]float32
+	for dim := uint8(0); dim < 3; dim++ {
+		chunkSize[dim] = props.BlockSize.Value(dim)
+		resolution[dim] = 1
+		if int(dim) < len(props.VoxelSize) && props.VoxelSize[dim] > 0 {
+			resolution[dim] = props.VoxelSize[dim]
+		}
+	}
+
+	for level := 0; level < MaxPrecomputedScales; level++ {
+		factor := int32(1) << uint(level)
+		scale := PrecomputedScale{
+			Key:        scaleKey(level),
+			ChunkSizes: [][3]int32{chunkSize},
+			Encoding:   "raw",
+		}
+		fits := true
+		for dim := 0; dim < 3; dim++ {
+			beg := floorDiv(minPt[dim], factor)
+			end := floorDiv(maxPt[dim], factor) + 1
+			scale.VoxelOffset[dim] = beg
+			scale.Size[dim] = end - beg
+			scale.Resolution[dim] = resolution[dim] * float32(factor)
+			if scale.Size[dim] > chunkSize[dim] {
+				fits = false
+			}
+		}
+		info.Scales = append(info.Scales, scale)
+		if fits {
+			break
+		}
+	}
+	return info, nil
+}
+
+func floorDiv(a, b int32) int32 {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// parsePrecomputedChunk parses chunk names of the form "<xBeg>-<xEnd>_<yBeg>-<yEnd>_<zBeg>-<zEnd>".
+func parsePrecomputedChunk(name string) (beg, end [3]int32, err error) {
+	ranges := strings.Split(name, "_")
+	if len(ranges) != 3 {
+		err = fmt.Errorf("Bad precomputed chunk name %q", name)
+		return
+	}
+	for dim, r := range ranges {
+		bounds := strings.Split(r, "-")
+		if len(bounds) != 2 {
+			err = fmt.Errorf("Bad range %q in precomputed chunk name %q", r, name)
+			return
+		}
+		var b, e int64
+		if b, err = strconv.ParseInt(bounds[0], 10, 32); err != nil {
+			return
+		}
+		if e, err = strconv.ParseInt(bounds[1], 10, 32); err != nil {
+			return
+		}
+		if e <= b {
+			err = fmt.Errorf("Empty range %q in precomputed chunk name %q", r, name)
+			return
+		}
+		beg[dim], end[dim] = int32(b), int32(e)
+	}
+	return
+}
+
+// checkChunk returns an error unless beg and end bound a chunk of the scale, i.e., one
+// aligned to the scale's chunk grid and clipped to the scale's bounds.
+func (scale PrecomputedScale) checkChunk(beg, end [3]int32) error {
+	if len(scale.ChunkSizes) == 0 {
+		return fmt.Errorf("Precomputed scale %q has no chunk size", scale.Key)
+	}
+	for dim := 0; dim < 3; dim++ {
+		chunkSize := int64(scale.ChunkSizes[0][dim])
+		offset := int64(scale.VoxelOffset[dim])
+		chunkEnd := int64(beg[dim]) + chunkSize
+		if limit := offset + int64(scale.Size[dim]); chunkEnd > limit {
+			chunkEnd = limit
+		}
+		pos := int64(beg[dim]) - offset
+		if chunkSize <= 0 || pos < 0 || pos%chunkSize != 0 || int64(end[dim]) != chunkEnd {
+			return fmt.Errorf("Range %d-%d is not a chunk of precomputed scale %q", beg[dim], end[dim], scale.Key)
+		}
+	}
+	return nil
+}
+
+// ServePrecomputed handles requests for the precomputed info and chunks:
+//
+//    GET <api URL>/node/<UUID>/<data name>/precomputed/info
+//    GET <api URL>/node/<UUID>/<data name>/precomputed/<scale key>/<chunk name>
+//
+// The parts are the URL path components starting with the API prefix, so parts[3]
+// is "precomputed".
+func ServePrecomputed(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Precomputed volumes are read-only")
+	}
+	info, err := props.PrecomputedInfo()
+	if err != nil {
+		return err
+	}
+	if len(parts) == 5 && parts[4] == "info" {
+		m, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(m)
+		return err
+	}
+	if len(parts) != 6 {
+		return fmt.Errorf("Precomputed requests must be for 'info' or '<scale key>/<chunk name>'")
+	}
+	level := -1
+	for n, scale := range info.Scales {
+		if scale.Key == parts[4] {
+			level = n
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("Unknown precomputed scale %q", parts[4])
+	}
+	beg, end, err := parsePrecomputedChunk(parts[5])
+	if err != nil {
+		return err
+	}
+	if err := info.Scales[level].checkChunk(beg, end); err != nil {
+		return err
+	}
+	size := dvid.Point3d{end[0] - beg[0], end[1] - beg[1], end[2] - beg[2]}
+	if err := CheckLimits(i, dvid.NewSubvolume(dvid.Point3d(beg), size)); err != nil {
+		return err
+	}
+	data, err := precomputedChunk(r.Context(), uuid, i, props, level, beg, end)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = w.Write(data)
+	return err
+}
+
+// precomputedChunk returns the raw-encoded chunk spanning [beg, end) at a scale level by
+// reading the corresponding full resolution subvolume and downsampling it.  The subvolume
+// must be within 32-bit coordinates and at most MaxVoxelsRequest voxels.
+func precomputedChunk(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties, level int,
+	beg, end [3]int32) ([]byte, error) {
+
+	factor := int64(1) << uint(level)
+	var offset, size, scaledSize dvid.Point3d
+	numVoxels := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		b, e := int64(beg[dim])*factor, int64(end[dim])*factor
+		if b < math.MinInt32 || e-1 > math.MaxInt32 || e-b > MaxVoxelsRequest {
+			return nil, fmt.Errorf("Precomputed chunk %d-%d at scale %d is out of range", beg[dim], end[dim], level)
+		}
+		offset[dim] = int32(b)
+		size[dim] = int32(e - b)
+		scaledSize[dim] = end[dim] - beg[dim]
+		if numVoxels *= e - b; numVoxels > MaxVoxelsRequest {
+			return nil, fmt.Errorf("Precomputed chunk at scale %d exceeds %d voxels", level, MaxVoxelsRequest)
+		}
+	}
+	subvol := dvid.NewSubvolume(offset, size)
+	if admitter, ok := i.(requestAdmitter); ok {
+		release, err := admitter.AdmitRequest(ctx, subvol)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	e, err := i.NewExtHandler(subvol, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := GetVolume(ctx, uuid, i, e)
+	if err != nil {
+		return nil, err
+	}
+	if factor > 1 {
+		data, err = downsample3d(data, props.Values, props.ByteOrder, size, int32(factor), props.Interpolable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Precomputed raw chunks are little endian with x fastest and channel slowest.
+	return toPrecomputedRaw(data, props.Values, props.ByteOrder, scaledSize)
+}
+
+// ReadValue returns the value of the given type stored in b as a float64.
+func ReadValue(b []byte, t dvid.DataType, byteOrder binary.ByteOrder) float64 {
+	switch t {
+	case dvid.T_uint8:
+		return float64(b[0])
+	case dvid.T_int8:
+		return float64(int8(b[0]))
+	case dvid.T_uint16:
+		return float64(byteOrder.Uint16(b))
+	case dvid.T_int16:
+		return float64(int16(byteOrder.Uint16(b)))
+	case dvid.T_uint32:
+		return float64(byteOrder.Uint32(b))
+	case dvid.T_int32:
+		return float64(int32(byteOrder.Uint32(b)))
+	case dvid.T_uint64:
+		return float64(byteOrder.Uint64(b))
+	case dvid.T_int64:
+		return float64(int64(byteOrder.Uint64(b)))
+	case dvid.T_float32:
+		return float64(math.Float32frombits(byteOrder.Uint32(b)))
+	case dvid.T_float64:
+		return math.Float64frombits(byteOrder.Uint64(b))
+	}
+	return 0
+}
+
+// WriteValue stores a float64 into b as the given type, rounding integer types.
+func WriteValue(b []byte, t dvid.DataType, byteOrder binary.ByteOrder, v float64) {
+	switch t {
+	case dvid.T_float32:
+		byteOrder.PutUint32(b, math.Float32bits(float32(v)))
+		return
+	case dvid.T_float64:
+		byteOrder.PutUint64(b, math.Float64bits(v))
+		return
+	}
+	v = math.Floor(v + 0.5)
+	switch t {
+	case dvid.T_uint8, dvid.T_int8:
+		b[0] = uint8(int64(v))
+	case dvid.T_uint16, dvid.T_int16:
+		byteOrder.PutUint16(b, uint16(int64(v)))
+	case dvid.T_uint32, dvid.T_int32:
+		byteOrder.PutUint32(b, uint32(int64(v)))
+	case dvid.T_uint64:
+		byteOrder.PutUint64(b, uint64(v))
+	case dvid.T_int64:
+		byteOrder.PutUint64(b, uint64(int64(v)))
+	}
+}
+
+// downsample3d reduces a 3d volume by an integer factor along each dimension.  Interpolable
+// data is averaged, while other data like labels uses the most frequent value of each cell.
+func downsample3d(data []byte, values dvid.DataValues, byteOrder binary.ByteOrder,
+	size dvid.Point3d, factor int32, interpolable bool) ([]byte, error) {
+
+	if !interpolable {
+		return downsampleLabels(data, values.BytesPerElement(), size, factor, DownsampleMode)
+	}
+	if byteOrder == nil {
+		byteOrder = binary.LittleEndian
+	}
+	bytesPerVoxel := values.BytesPerElement()
+	var dstSize dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		if size[dim]%factor != 0 {
+			return nil, fmt.Errorf("Size %s is not a multiple of downsampling factor %d", size, factor)
+		}
+		dstSize[dim] = size[dim] / factor
+	}
+	dst := make([]byte, int64(dstSize[0])*int64(dstSize[1])*int64(dstSize[2])*int64(bytesPerVoxel))
+	srcIndex := func(x, y, z int32) int64 {
+		return ((int64(z)*int64(size[1])+int64(y))*int64(size[0]) + int64(x)) * int64(bytesPerVoxel)
+	}
+	cellVoxels := float64(factor) * float64(factor) * float64(factor)
+	var dstI int64
+	for z := int32(0); z < dstSize[2]; z++ {
+		for y := int32(0); y < dstSize[1]; y++ {
+			for x := int32(0); x < dstSize[0]; x++ {
+				var valueOffset int64
+				for _, value := range values {
+					var sum float64
+					for dz := int32(0); dz < factor; dz++ {
+						for dy := int32(0); dy < factor; dy++ {
+							for dx := int32(0); dx < factor; dx++ {
+								i := srcIndex(x*factor+dx, y*factor+dy, z*factor+dz) + valueOffset
+								sum += ReadValue(data[i:], value.T, byteOrder)
+							}
+						}
+					}
+					WriteValue(dst[dstI+valueOffset:], value.T, byteOrder, sum/cellVoxels)
+					valueOffset += int64(dvid.DataTypeBytes(value.T))
+				}
+				dstI += int64(bytesPerVoxel)
+			}
+		}
+	}
+	return dst, nil
+}
+
+// toPrecomputedRaw converts interleaved voxel values into little endian planes, one per
+// channel, as expected by the precomputed "raw" encoding.
+func toPrecomputedRaw(data []byte, values dvid.DataValues, byteOrder binary.ByteOrder,
+	size dvid.Point3d) ([]byte, error) {
+
+	bytesPerValue, err := values.BytesPerValue()
+	if err != nil {
+		return nil, err
+	}
+	swap := byteOrder == binary.BigEndian && bytesPerValue > 1
+	if len(values) == 1 && !swap {
+		return data, nil
+	}
+	numVoxels := int64(size[0]) * int64(size[1]) * int64(size[2])
+	numValues := int64(len(values))
+	bpv := int64(bytesPerValue)
+	raw := make([]byte, len(data))
+	for v := int64(0); v < numValues; v++ {
+		for n := int64(0); n < numVoxels; n++ {
+			src := data[(n*numValues+v)*bpv : (n*numValues+v+1)*bpv]
+			dst := raw[(v*numVoxels+n)*bpv : (v*numVoxels+n+1)*bpv]
+			for b := int64(0); b < bpv; b++ {
+				if swap {
+					dst[b] = src[bpv-1-b]
+				} else {
+					dst[b] = src[b]
+				}
+			}
+		}
+	}
+	return raw, nil
+}
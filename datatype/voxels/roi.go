@@ -0,0 +1,136 @@
+/*
+	This file derives regions of interest from the blocks of voxels data that exceed a
+	threshold, e.g., to process only the blocks within neuropil.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// ThresholdSpans returns the spans of blocks within the data extents that have at least
+// one voxel at or above threshold.  If progress is not nil, it is called with the
+// fraction of blocks examined.
+func ThresholdSpans(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	threshold float64, progress func(float32)) ([]roi.Span, error) {
+
+	if len(props.Values) != 1 {
+		return nil, fmt.Errorf("Thresholded ROIs require single channel voxels")
+	}
+	blockSize, ok := props.BlockSize.(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Thresholded ROIs require 3d blocks")
+	}
+	if props.MinPoint == nil || props.MaxPoint == nil {
+		return []roi.Span{}, nil
+	}
+	var minBlock, maxBlock dvid.Point3d
+	for dim := uint8(0); dim < 3; dim++ {
+		minBlock[dim] = floorDiv(props.MinPoint.Value(dim), blockSize[dim])
+		maxBlock[dim] = floorDiv(props.MaxPoint.Value(dim), blockSize[dim])
+	}
+	numBlocks := maxBlock.Sub(minBlock).AddScalar(1).Prod()
+	bytesPerVoxel := int(props.Values.BytesPerElement())
+	t := props.Values[0].T
+
+	spans := []roi.Span{}
+	var done int64
+	var block dvid.Point3d
+	for block[2] = minBlock[2]; block[2] <= maxBlock[2]; block[2]++ {
+		for block[1] = minBlock[1]; block[1] <= maxBlock[1]; block[1]++ {
+			for block[0] = minBlock[0]; block[0] <= maxBlock[0]; block[0]++ {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				offset := dvid.Point3d{block[0] * blockSize[0], block[1] * blockSize[1], block[2] * blockSize[2]}
+				e, err := i.NewExtHandler(dvid.NewSubvolume(offset, blockSize), nil)
+				if err != nil {
+					return nil, err
+				}
+				data, err := GetVolume(ctx, uuid, i, e)
+				if err != nil {
+					dvid.PutBuffer(e.Data())
+					return nil, err
+				}
+				inside := false
+				for n := 0; n < len(data) && !inside; n += bytesPerVoxel {
+					inside = ReadValue(data[n:], t, props.ByteOrder) >= threshold
+				}
+				dvid.PutBuffer(e.Data())
+				if inside {
+					last := len(spans) - 1
+					if last >= 0 && spans[last][0] == block[2] && spans[last][1] == block[1] && spans[last][3] == block[0]-1 {
+						spans[last][3] = block[0]
+					} else {
+						spans = append(spans, roi.Span{block[2], block[1], block[0], block[0]})
+					}
+				}
+				done++
+				if progress != nil {
+					progress(float32(done) / float32(numBlocks))
+				}
+			}
+		}
+	}
+	return spans, nil
+}
+
+// roiCommand handles the "roi <new roi name>" RPC command, which starts a job that stores
+// the blocks of this data at or above a threshold into new roi data.
+func (d *Data) roiCommand(request datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataName, cmdStr, roiName string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &roiName)
+	if roiName == "" {
+		return fmt.Errorf("Poorly formatted roi command.  See command-line help.")
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	threshold := 1.0
+	thresholdStr, found, err := request.Settings().GetString("threshold")
+	if err != nil {
+		return err
+	}
+	if found {
+		if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil {
+			return fmt.Errorf("Bad threshold %q: %s", thresholdStr, err.Error())
+		}
+	}
+	if len(d.Properties.Values) != 1 {
+		return fmt.Errorf("Thresholded ROIs require single channel voxels")
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Data %q must have 3d blocks", d.DataName())
+	}
+	dest, err := roi.NewData(uuid, dvid.DataString(roiName), blockSize, d.IsVersioned())
+	if err != nil {
+		return err
+	}
+
+	ctx := request.Context()
+	description := fmt.Sprintf("ROI of %q at threshold %g into %q", d.DataName(), threshold, roiName)
+	job := server.NewJob(description)
+	go func() {
+		spans, err := ThresholdSpans(ctx, uuid, d, &(d.Properties), threshold, job.SetProgress)
+		if err == nil {
+			err = dest.PutSpans(uuid, spans)
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to write thresholded blocks into ROI %q.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, roiName, job.ID)
+	return nil
+}
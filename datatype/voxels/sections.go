@@ -0,0 +1,137 @@
+/*
+	This file supports bulk loading of aligned 2d section series, e.g., PNG or TIFF output of
+	section-based EM pipelines, using a manifest that gives each section's z and translation.
+*/
+
+package voxels
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Section is a 2d image file placed at a z-index with an optional XY translation.
+type Section struct {
+	Filename string
+	Z        int32
+	Offset   dvid.Point2d
+}
+
+type sectionsByZ []Section
+
+func (s sectionsByZ) Len() int           { return len(s) }
+func (s sectionsByZ) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sectionsByZ) Less(i, j int) bool { return s[i].Z < s[j].Z }
+
+// ReadSectionManifest parses a manifest with one section per line in the form
+// "<filename> <z> [<x offset> <y offset>]" where fields are separated by whitespace
+// or commas.  Blank lines and lines starting with "#" are ignored.  Relative filenames
+// are resolved against baseDir.  Sections are returned sorted by z.
+func ReadSectionManifest(r io.Reader, baseDir string) ([]Section, error) {
+	var sections []Section
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})
+		if len(fields) != 2 && len(fields) != 4 {
+			return nil, fmt.Errorf("Manifest line %d should have filename, z, and optional x and y offsets: %q",
+				lineNum, line)
+		}
+		var coords [3]int32
+		for n, field := range fields[1:] {
+			value, err := strconv.ParseInt(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Manifest line %d has bad number %q", lineNum, field)
+			}
+			coords[n] = int32(value)
+		}
+		filename := fields[0]
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(baseDir, filename)
+		}
+		sections = append(sections, Section{filename, coords[0], dvid.Point2d{coords[1], coords[2]}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Stable(sectionsByZ(sections))
+	for n := 1; n < len(sections); n++ {
+		if sections[n].Z == sections[n-1].Z {
+			return nil, fmt.Errorf("Manifest has more than one section at z %d", sections[n].Z)
+		}
+	}
+	return sections, nil
+}
+
+// LoadSections loads each section image into the data, translating it by the section
+// offset.  Each section is written through PutVoxels so existing voxels outside the
+// translated image are preserved.
+func LoadSections(ctx context.Context, i IntHandler, uuid dvid.UUID, sections []Section) error {
+	startTime := time.Now()
+	for n, section := range sections {
+		sectionTime := time.Now()
+		img, _, err := dvid.ImageFromFile(section.Filename)
+		if err != nil {
+			return fmt.Errorf("Error after %d sections successfully added: %s", n, err.Error())
+		}
+		offset := dvid.Point3d{section.Offset[0], section.Offset[1], section.Z}
+		slice, err := dvid.NewOrthogSlice(dvid.XY, offset, dvid.RectSize(img.Bounds()))
+		if err != nil {
+			return fmt.Errorf("Unable to determine slice: %s", err.Error())
+		}
+		e, err := i.NewExtHandler(slice, img)
+		if err != nil {
+			return err
+		}
+		storage.FileBytesRead <- len(e.Data())
+		if err = PutVoxels(ctx, uuid, i, e); err != nil {
+			return fmt.Errorf("Error after %d sections successfully added: %s", n, err.Error())
+		}
+		dvid.ElapsedTime(dvid.Debug, sectionTime, "Loaded section %s", slice)
+	}
+	dvid.ElapsedTime(dvid.Debug, startTime, "Loaded %d sections", len(sections))
+	return nil
+}
+
+// LoadSectionManifest reads a manifest file and loads its sections.  If checksums is not
+// empty, it's the filename of a checksum manifest that section files are verified against
+// before any are loaded.
+func LoadSectionManifest(ctx context.Context, i IntHandler, uuid dvid.UUID, manifest, checksums string) error {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return fmt.Errorf("Unable to open manifest (%s).  Is this visible to server process?", manifest)
+	}
+	sections, err := ReadSectionManifest(f, filepath.Dir(manifest))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if checksums != "" {
+		filenames := make([]string, len(sections))
+		for n, section := range sections {
+			filenames[n] = section.Filename
+		}
+		if err := dvid.VerifyFiles(checksums, filenames); err != nil {
+			return err
+		}
+	}
+	return LoadSections(ctx, i, uuid, sections)
+}
@@ -0,0 +1,441 @@
+/*
+	This file exports a version of 3d voxels as a flat stack of 2d images, one per Z slice,
+	for collaborators whose tools only read image stacks.  Stacks can be written to a
+	directory on the server by a job or streamed over HTTP as a zip or tar archive.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// SliceStripBytes is the approximate size of the voxels read at once while rendering a
+// slice, so slices of large volumes are rendered in strips.
+const SliceStripBytes = 64 * dvid.Mega
+
+// SliceStack describes an export of Z slices as images.
+type SliceStack struct {
+	// Scale is the number of 2x downsamplings along each axis, so there are fewer slices
+	// at coarser scales.
+	Scale int
+
+	// Format is the image format and option, e.g., "png" or "tiff:lzw".
+	Format string
+
+	// Offset and Size give the exported region at full resolution.
+	Offset dvid.Point3d
+	Size   dvid.Point3d
+
+	// Start is the number of slices to skip, e.g., those written before an export
+	// was interrupted.
+	Start int32
+}
+
+// sliceStackSettings returns a SliceStack from "scale", "format", "offset", and "size"
+// settings, defaulting to PNG images of the data extents at full resolution.
+func (d *Data) sliceStackSettings(setting func(key string) (string, bool)) (SliceStack, error) {
+	stack := SliceStack{Format: "png"}
+	if scaleStr, found := setting("scale"); found {
+		scale, err := strconv.Atoi(scaleStr)
+		if err != nil || scale < 0 || scale > 16 {
+			return stack, fmt.Errorf("Bad scale %q: must be an integer from 0 to 16", scaleStr)
+		}
+		stack.Scale = scale
+	}
+	if format, found := setting("format"); found {
+		stack.Format = format
+	}
+	if t, _, err := dvid.GetTranscoder(stack.Format); err != nil || t.EncodeImage == nil {
+		return stack, fmt.Errorf("Illegal image format requested: %s", stack.Format)
+	}
+	if d.MinPoint != nil && d.MaxPoint != nil && d.MinPoint.NumDims() == 3 {
+		for dim := uint8(0); dim < 3; dim++ {
+			stack.Offset[dim] = d.MinPoint.Value(dim)
+			stack.Size[dim] = d.MaxPoint.Value(dim) - d.MinPoint.Value(dim) + 1
+		}
+	}
+	for _, p := range []struct {
+		key string
+		pt  *dvid.Point3d
+	}{{"offset", &stack.Offset}, {"size", &stack.Size}} {
+		if s, found := setting(p.key); found {
+			pt, err := dvid.StringToPoint(s, ",")
+			if err != nil {
+				return stack, err
+			}
+			pt3d, ok := pt.(dvid.Point3d)
+			if !ok {
+				return stack, fmt.Errorf("Setting %s must be a 3d point, not %q", p.key, s)
+			}
+			*p.pt = pt3d
+		}
+	}
+	if stack.Size[0] <= 0 || stack.Size[1] <= 0 || stack.Size[2] <= 0 {
+		return stack, fmt.Errorf("No stored voxels to export.  Specify offset and size settings.")
+	}
+	return stack, stack.check()
+}
+
+// check returns an error if the bounds of a stack don't fit in int32 coordinates, or if
+// a slice or the full resolution voxels read for a row of a slice exceed MaxVoxelsRequest.
+func (stack SliceStack) check() error {
+	factor := int64(1) << uint(stack.Scale)
+	var extent [3]int64
+	for dim := 0; dim < 3; dim++ {
+		offset := int64(stack.Offset[dim])
+		beg := floorDiv64(offset, factor) * factor
+		end := (floorDiv64(offset+int64(stack.Size[dim])-1, factor) + 1) * factor
+		if beg < math.MinInt32 || end > math.MaxInt32 || end-beg > math.MaxInt32 {
+			return fmt.Errorf("Slices at offset %s and size %s exceed 32-bit coordinates", stack.Offset, stack.Size)
+		}
+		extent[dim] = end - beg
+	}
+	width, height := extent[0]/factor, extent[1]/factor
+	if width > MaxVoxelsRequest || height > MaxVoxelsRequest || width*height > MaxVoxelsRequest {
+		return fmt.Errorf("Slices of %d x %d voxels exceed %d voxels", width, height, MaxVoxelsRequest)
+	}
+	if extent[0] > MaxVoxelsRequest/(factor*factor) {
+		return fmt.Errorf("Rendering slices %d voxels wide at scale %d reads more than %d voxels at once",
+			width, stack.Scale, MaxVoxelsRequest)
+	}
+	return nil
+}
+
+// floorDiv64 returns a / b rounded toward negative infinity for positive b.
+func floorDiv64(a, b int64) int64 {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// bounds returns the full resolution bounds of a stack, expanded to multiples
+// of the downsampling factor.
+func (stack SliceStack) bounds() (beg, end dvid.Point3d, factor int32) {
+	factor = int32(1) << uint(stack.Scale)
+	for dim := 0; dim < 3; dim++ {
+		beg[dim] = floorDiv(stack.Offset[dim], factor) * factor
+		end[dim] = (floorDiv(stack.Offset[dim]+stack.Size[dim]-1, factor) + 1) * factor
+	}
+	return
+}
+
+// NumSlices returns the number of images in the stack.
+func (stack SliceStack) NumSlices() int32 {
+	beg, end, factor := stack.bounds()
+	return (end[2] - beg[2]) / factor
+}
+
+// sliceFilename returns the file name of the nth slice of a stack, e.g.,
+// "grayscale-z000100.png" where 100 is the Z coordinate at the stack's scale.
+func (stack SliceStack) sliceFilename(name dvid.DataString, ext string, n int32) string {
+	beg, _, factor := stack.bounds()
+	return fmt.Sprintf("%s-z%06d.%s", name, beg[2]/factor+n, ext)
+}
+
+// WriteSliceStack renders each Z slice of a stack, after any skipped slices, as an image
+// and passes its file name, given by sliceFilename, and encoding to write.  If progress is
+// not nil, it's called with the fraction of slices done.
+func WriteSliceStack(ctx context.Context, uuid dvid.UUID, i IntHandler, props *Properties,
+	name dvid.DataString, stack SliceStack, write func(filename string, data []byte) error,
+	progress func(float32)) error {
+
+	t, option, err := dvid.GetTranscoder(stack.Format)
+	if err != nil || t.EncodeImage == nil {
+		return fmt.Errorf("Illegal image format requested: %s", stack.Format)
+	}
+	if err := stack.check(); err != nil {
+		return err
+	}
+	beg, end, factor := stack.bounds()
+	bytesPerVoxel := props.Values.BytesPerElement()
+	nx, ny := end[0]-beg[0], end[1]-beg[1]
+	width, height := nx/factor, ny/factor
+	if int64(width)*int64(bytesPerVoxel) > math.MaxInt32 {
+		return fmt.Errorf("Slices %d voxels wide are too wide to render", width)
+	}
+	sliceBytes := int64(width) * int64(height) * int64(bytesPerVoxel)
+
+	// Read strips of rows whose heights are multiples of the factor.
+	stripRows := ny
+	rowBytes := int64(nx) * int64(factor) * int64(bytesPerVoxel)
+	if rows := SliceStripBytes / rowBytes / int64(factor) * int64(factor); rows < int64(ny) {
+		stripRows = int32(rows)
+	}
+	if stripRows < factor {
+		stripRows = factor
+	}
+
+	// Reserve memory for reading and downsampling a strip, the slice, and its encoding.
+	release, err := server.AdmitMemory(ctx, int64(stripRows)*rowBytes*RequestMemoryFactor+2*sliceBytes)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	numSlices := (end[2] - beg[2]) / factor
+	var buf bytes.Buffer
+	for n := stack.Start; n < numSlices; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		z := beg[2] + n*factor
+		slice := make([]byte, sliceBytes)
+		for row := int64(0); row < int64(ny); row += int64(stripRows) {
+			y := beg[1] + int32(row)
+			rows := stripRows
+			if int64(rows) > int64(ny)-row {
+				rows = int32(int64(ny) - row)
+			}
+			size := dvid.Point3d{nx, rows, factor}
+			e, err := i.NewExtHandler(dvid.NewSubvolume(dvid.Point3d{beg[0], y, z}, size), nil)
+			if err != nil {
+				return err
+			}
+			data, err := GetVolume(ctx, uuid, i, e)
+			if err != nil {
+				return err
+			}
+			if factor > 1 {
+				if data, err = downsample3d(data, props.Values, props.ByteOrder, size, factor, props.Interpolable); err != nil {
+					return err
+				}
+			}
+			copy(slice[row/int64(factor)*int64(width)*int64(bytesPerVoxel):], data)
+		}
+		zScaled := z / factor
+		geom, err := dvid.NewOrthogSlice(dvid.XY, dvid.Point3d{beg[0] / factor, beg[1] / factor, zScaled},
+			dvid.Point2d{width, height})
+		if err != nil {
+			return err
+		}
+		img, err := NewVoxels(geom, props.Values, slice, width*bytesPerVoxel, props.ByteOrder).GetImage2d()
+		if err != nil {
+			return err
+		}
+		buf.Reset()
+		if err := t.EncodeImage(&buf, img.Get(), option); err != nil {
+			return err
+		}
+		filename := stack.sliceFilename(name, t.Name, n)
+		if err := write(filename, buf.Bytes()); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(float32(n+1) / float32(numSlices))
+		}
+	}
+	return nil
+}
+
+// sliceExportJobKind is the kind of resumable slice export jobs.
+const sliceExportJobKind = "voxels-export-slices"
+
+// sliceExportArgs are the arguments of a slice export job, which are kept so the job
+// can be resumed after a restart.
+type sliceExportArgs struct {
+	UUID      dvid.UUID
+	Data      dvid.DataString
+	Dir       string
+	Stack     SliceStack
+	Checksums bool
+}
+
+// sliceExportCheckpoint records the number of slices written by a slice export job.
+type sliceExportCheckpoint struct {
+	Slices int32
+}
+
+// exportSlices writes the slice images of an export job into its directory, skipping
+// the slices written before the job was interrupted.
+func (d *Data) exportSlices(ctx context.Context, job *server.Job, args sliceExportArgs) error {
+	stack := args.Stack
+	var manifest *dvid.ChecksumManifest
+	if args.Checksums {
+		manifest = dvid.NewChecksumManifest(fmt.Sprintf("%s slices of %q at version %s, scale %d",
+			stack.Format, args.Data, args.UUID, stack.Scale))
+		t, _, err := dvid.GetTranscoder(stack.Format)
+		if err != nil {
+			return err
+		}
+		for n := int32(0); n < stack.Start; n++ {
+			filename := stack.sliceFilename(args.Data, t.Name, n)
+			data, err := ioutil.ReadFile(filepath.Join(args.Dir, filename))
+			if err != nil {
+				return err
+			}
+			manifest.Add(filename, data)
+		}
+	}
+	written := stack.Start
+	write := func(filename string, data []byte) error {
+		if manifest != nil {
+			manifest.Add(filename, data)
+		}
+		if err := ioutil.WriteFile(filepath.Join(args.Dir, filename), data, 0644); err != nil {
+			return err
+		}
+		written++
+		return job.Checkpoint(sliceExportCheckpoint{written})
+	}
+	err := WriteSliceStack(ctx, args.UUID, d, &(d.Properties), args.Data, stack, write, job.SetProgress)
+	if err != nil || manifest == nil {
+		return err
+	}
+	m, err := manifest.JSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(args.Dir, dvid.ChecksumManifestName), m, 0644)
+}
+
+// resumeSliceExport resumes a slice export job interrupted by a shutdown.
+func resumeSliceExport(ctx context.Context, job *server.Job, args, checkpoint json.RawMessage) error {
+	var a sliceExportArgs
+	if err := json.Unmarshal(args, &a); err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		var cp sliceExportCheckpoint
+		if err := json.Unmarshal(checkpoint, &cp); err != nil {
+			return err
+		}
+		a.Stack.Start = cp.Slices
+	}
+	dataservice, err := server.DatastoreService().DataServiceByUUID(a.UUID, a.Data)
+	if err != nil {
+		return err
+	}
+	data, ok := dataservice.(embedsData)
+	if !ok {
+		return fmt.Errorf("Data %q can't export slices", a.Data)
+	}
+	return data.voxelsData().exportSlices(ctx, job, a)
+}
+
+// exportSlicesCommand handles "export slices <directory>" by starting a job that writes
+// the slice images into the directory.  The job is resumed from its last written slice
+// if the server is restarted.
+func (d *Data) exportSlicesCommand(request datastore.Request, reply *datastore.Response, uuid dvid.UUID,
+	dir string) error {
+
+	stack, err := d.sliceStackSettings(request.Setting)
+	if err != nil {
+		return err
+	}
+	checksums, err := checksumsSetting(request)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	description := fmt.Sprintf("Export of %d %s slices of %q at scale %d to %s", stack.NumSlices(),
+		stack.Format, d.DataName(), stack.Scale, dir)
+	args := sliceExportArgs{uuid, d.DataName(), dir, stack, checksums}
+	job, err := server.NewResumableJob(sliceExportJobKind, description, args)
+	if err != nil {
+		return err
+	}
+	ctx := request.Context()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("%s panicked: %v", description, r)
+				dvid.Error("%s\n%s", err.Error(), debug.Stack())
+				job.Finish(err)
+			}
+		}()
+		startTime := time.Now()
+		err := d.exportSlices(ctx, job, args)
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		} else {
+			dvid.ElapsedTime(dvid.Normal, startTime, description)
+		}
+		job.Finish(err)
+	}()
+	reply.Text = fmt.Sprintf("Started job %d to export %d slices of %q to %s.  Use 'dvid jobs %d' for progress.\n",
+		job.ID, stack.NumSlices(), d.DataName(), dir, job.ID)
+	return nil
+}
+
+// ServeSlices handles GET of a stack of slice images as a zip or tar archive.
+func ServeSlices(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, d *Data, parts []string) error {
+	if strings.ToLower(r.Method) != "get" {
+		return fmt.Errorf("Slices can only be retrieved with GET")
+	}
+	if len(parts) < 5 {
+		return fmt.Errorf("'slices' must be followed by a scale")
+	}
+	query := r.URL.Query()
+	setting := func(key string) (string, bool) {
+		value := query.Get(key)
+		return value, value != ""
+	}
+	stack, err := d.sliceStackSettings(func(key string) (string, bool) {
+		switch key {
+		case "scale":
+			return parts[4], true
+		case "format":
+			if len(parts) > 5 && parts[5] != "" {
+				return parts[5], true
+			}
+			return "", false
+		}
+		return setting(key)
+	})
+	if err != nil {
+		return err
+	}
+	if err := CheckLimits(d, dvid.NewSubvolume(stack.Offset, stack.Size)); err != nil {
+		return err
+	}
+	format := query.Get("archive")
+	if format == "" {
+		format = dvid.ArchiveZip
+	}
+	archive, err := dvid.NewArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if query.Get("checksums") == "true" {
+		archive.AddChecksums(fmt.Sprintf("%s slices of %q at version %s, scale %d",
+			stack.Format, d.DataName(), uuid, stack.Scale))
+	}
+	w.Header().Set("Content-Type", archive.ContentType())
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s-s%d.%s\"", d.DataName(), stack.Scale, archive.Format()))
+
+	// Errors after the archive has started can't be returned as a bad request.
+	var started bool
+	writeFile := func(filename string, data []byte) error {
+		started = true
+		return archive.WriteFile(filename, data)
+	}
+	if err := WriteSliceStack(r.Context(), uuid, d, &(d.Properties), d.DataName(), stack, writeFile, nil); err != nil {
+		if !started {
+			return err
+		}
+		dvid.Error("Streaming slices of %q to %s stopped: %s\n", d.DataName(), r.RemoteAddr, err.Error())
+		return nil
+	}
+	return archive.Close()
+}
@@ -0,0 +1,111 @@
+/*
+	This file renders thumbnails of voxel data for the server's dataset gallery.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxThumbnailSlice is the maximum width and height in voxels of the slices read for a
+// thumbnail.  Larger slices are cropped around their center.
+var MaxThumbnailSlice int32 = 2048
+
+// Thumbnail returns a composite of the XY, XZ, and YZ slices through the middle of the
+// data's extents at a version, side by side and each scaled to fit within size pixels.
+func (d *Data) Thumbnail(ctx context.Context, uuid dvid.UUID, size int) (image.Image, error) {
+	minPt, maxPt := d.VoxelExtents()
+	minPt3d, ok1 := minPt.(dvid.Point3d)
+	maxPt3d, ok2 := maxPt.(dvid.Point3d)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("Data '%s' has no stored voxels for a thumbnail", d.DataName())
+	}
+	var mid dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		mid[dim] = (minPt3d[dim] + maxPt3d[dim]) / 2
+	}
+
+	var slices []image.Image
+	var width, height int
+	for _, shape := range []dvid.DataShape{dvid.XY, dvid.XZ, dvid.YZ} {
+		img, err := d.thumbnailSlice(ctx, uuid, shape, minPt3d, maxPt3d, mid, size)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, img)
+		width += img.Bounds().Dx()
+		if img.Bounds().Dy() > height {
+			height = img.Bounds().Dy()
+		}
+	}
+	composite := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var x int
+	for _, img := range slices {
+		bounds := img.Bounds()
+		draw.Draw(composite, image.Rect(x, 0, x+bounds.Dx(), bounds.Dy()), img, bounds.Min, draw.Src)
+		x += bounds.Dx()
+	}
+	return composite, nil
+}
+
+// thumbnailSlice returns the slice of the given shape through the mid point, cropped to
+// MaxThumbnailSlice and scaled to fit within size pixels.
+func (d *Data) thumbnailSlice(ctx context.Context, uuid dvid.UUID, shape dvid.DataShape,
+	minPt, maxPt, mid dvid.Point3d, size int) (image.Image, error) {
+
+	offset := mid
+	var sliceSize dvid.Point2d
+	for i := uint8(0); i < 2; i++ {
+		dim, err := shape.ShapeDimension(i)
+		if err != nil {
+			return nil, err
+		}
+		extent := maxPt[dim] - minPt[dim] + 1
+		offset[dim] = minPt[dim]
+		if extent > MaxThumbnailSlice {
+			offset[dim] = mid[dim] - MaxThumbnailSlice/2
+			extent = MaxThumbnailSlice
+		}
+		sliceSize[i] = extent
+	}
+	slice, err := dvid.NewOrthogSlice(shape, offset, sliceSize)
+	if err != nil {
+		return nil, err
+	}
+	e, err := d.NewExtHandler(slice, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dvid.PutBuffer(e.Data())
+	if err = GetVoxels(ctx, uuid, d, e); err != nil {
+		return nil, err
+	}
+	img, err := e.GetImage2d()
+	if err != nil {
+		return nil, err
+	}
+	dstW, dstH := int(sliceSize[0]), int(sliceSize[1])
+	if dstW > size || dstH > size {
+		if dstW >= dstH {
+			dstW, dstH = size, dstH*size/dstW
+		} else {
+			dstW, dstH = dstW*size/dstH, size
+		}
+		if dstW < 1 {
+			dstW = 1
+		}
+		if dstH < 1 {
+			dstH = 1
+		}
+		if img, err = img.ScaleImage(dstW, dstH); err != nil {
+			return nil, err
+		}
+	}
+	return img.Get(), nil
+}
@@ -0,0 +1,88 @@
+/*
+	This file connects voxel data to the format transcoders registered in the dvid package
+	so slices and subvolumes can be returned or POSTed in formats like NRRD or NIfTI.
+*/
+
+package voxels
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// NewArray returns the voxels held by e as an array for transcoding, with the voxel
+// size along each of its dimensions.
+func (props *Properties) NewArray(e ExtHandler) (*dvid.Array, error) {
+	a := &dvid.Array{
+		Values:     e.Values(),
+		ByteOrder:  e.ByteOrder(),
+		Size:       e.Size(),
+		VoxelUnits: props.VoxelUnits,
+		Data:       e.Data(),
+	}
+	switch e.DataShape().ShapeDimensions() {
+	case 2:
+		x, y, err := e.DataShape().GetFloat2D(props.VoxelSize)
+		if err != nil {
+			return nil, err
+		}
+		a.VoxelSize = dvid.NdFloat32{x, y}
+	case 3:
+		a.Offset = e.StartPoint()
+		a.VoxelSize = props.VoxelSize
+	}
+	return a, nil
+}
+
+// EncodeArray writes the voxels held by e using a format string, e.g., "nrrd:gzip".
+func (props *Properties) EncodeArray(w io.Writer, e ExtHandler, formatStr string) error {
+	a, err := props.NewArray(e)
+	if err != nil {
+		return err
+	}
+	_, err = dvid.EncodeArray(w, a, formatStr)
+	return err
+}
+
+// WriteArrayHttp writes the voxels held by e to a HTTP response using a format string.
+func (props *Properties) WriteArrayHttp(w http.ResponseWriter, e ExtHandler, formatStr string) error {
+	a, err := props.NewArray(e)
+	if err != nil {
+		return err
+	}
+	return dvid.WriteArrayHttp(w, a, formatStr)
+}
+
+// ReadArrayHttp reads POSTed voxels for the geometry using a format string or, if it is
+// empty, the Content-Type of the request.  The returned data is in the byte order of the
+// properties.
+func (props *Properties) ReadArrayHttp(r *http.Request, geom dvid.Geometry, formatStr string) ([]byte, error) {
+	a := &dvid.Array{Values: props.Values, ByteOrder: props.ByteOrder, Size: geom.Size()}
+	if err := dvid.ReadArrayHttp(r, a, formatStr); err != nil {
+		return nil, err
+	}
+	return a.Data, nil
+}
+
+// isArrayPost returns true if a POSTed slice should be decoded as voxel data rather than
+// an image, i.e., the format or Content-Type names a transcoder that only handles arrays.
+// Since images are often POSTed as "application/octet-stream", raw slices must be
+// requested via the format.
+func isArrayPost(r *http.Request, formatStr string) bool {
+	var t *dvid.Transcoder
+	if formatStr != "" {
+		t, _, _ = dvid.GetTranscoder(formatStr)
+	} else if t = dvid.TranscoderForContentType(r.Header.Get("Content-Type")); t != nil && t.Name == "raw" {
+		return false
+	}
+	return t != nil && t.DecodeArray != nil && t.DecodeImage == nil
+}
+
+// isArrayFormat returns true if the format names a transcoder without an image encoder,
+// e.g., "raw" or "nrrd".
+func isArrayFormat(formatStr string) bool {
+	t, _, err := dvid.GetTranscoder(formatStr)
+	return err == nil && t.EncodeImage == nil
+}
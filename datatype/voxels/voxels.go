@@ -4,12 +4,13 @@
 package voxels
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"image"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -30,6 +31,10 @@ const (
 	// Don't allow requests for more than this many voxels, which is larger than
 	// 1000 x 1000 x 1000 volume, or 30000 x 30000 image.
 	MaxVoxelsRequest = dvid.Giga
+
+	// RequestMemoryFactor scales the bytes of requested voxels to estimate the memory
+	// used by a request, which holds the voxels and an encoded copy.
+	RequestMemoryFactor = 2
 )
 
 const HelpMessage = `
@@ -59,22 +64,103 @@ $ dvid dataset <UUID> new <type name> <data name> <settings...>
     BlockSize      Size in pixels  (default: %s)
     VoxelSize      Resolution of voxels (default: 8.0, 8.0, 8.0)
     VoxelUnits     Resolution units (default: "nanometers")
-
-$ dvid node <UUID> <data name> load <offset> <image glob>
+    AxisNames      Comma-separated label for each dimension (default: "X,Y,Z" for 3d)
+    Indexing       Block key ordering: "zyx" (default), "morton", or "hilbert".  Morton and
+                     Hilbert curves keep 3d-local blocks close in key space, which speeds
+                     subvolume reads at some cost to single-slice reads.
+    MaxSliceArea   Maximum voxels in a GET of a 2d slice or overlay; larger requests get a 413
+                     (default: no limit)
+    MaxSubvolumeVoxels
+                   Maximum voxels in a GET of a 3d subvolume, precomputed or zarr chunk,
+                     isosurface, affine cutout, or slice stack; larger requests get a 413
+                     (default: no limit)
+    TTL            Time to live, e.g., "72h", after which the data and all its keys are deleted.
+                     POSTing a new TTL restarts it and "none" removes it (default: none)
+
+$ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
 
     Initializes version node to a set of XY images described by glob of filenames.  The
-    DVID server must have access to the named files.  Currently, XY images are required.
+    DVID server must have access to the named files.  Files can be XY images, NIfTI-1
+    volumes (.nii or .nii.gz) stacked along Z, or, if DVID was built with the "hdf5" tag,
+    HDF5 files holding 3d datasets in (Z, Y, X) order.  The voxel size and units of the
+    first NIfTI volume become the data's resolution properties.
 
     Example: 
 
     $ dvid node 3f8c mygrayscale load 0,0,100 data/*.png
+    $ dvid node 3f8c mygrayscale load 0,0,0 brain.nii.gz
+    $ dvid node 3f8c mygrayscale load 0,0,0 pred.h5 dataset=/volumes/raw hyperslab=0,0,100/512,512,64
 
     Arguments:
 
     UUID          Hexidecimal string with enough characters to uniquely identify a version node.
     data name     Name of data to add.
     offset        3d coordinate in the format "x,y,z".  Gives coordinate of top upper left voxel.
-    image glob    Filenames of images, e.g., foo-xy-*.png
+    image glob    Filenames of images, e.g., foo-xy-*.png, NIfTI files, or HDF5 files, e.g., *.h5
+
+    Configuration Settings for HDF5 files (case-insensitive keys)
+
+    dataset       Path of the dataset within each HDF5 file (required).
+    hyperslab     Subvolume of the dataset to load as "x0,y0,z0/nx,ny,nz" (default: all).
+
+    Configuration Settings for all files (case-insensitive keys)
+
+    checksums     Filename of a checksum manifest written by an export, e.g.,
+                    "dvid-checksums.json".  Files are verified against their sizes and
+                    SHA-256 checksums before any are loaded.
+
+$ dvid node <UUID> <data name> loadsections <manifest>
+
+    Loads a series of aligned 2d section images (e.g., PNG or TIFF) into a version node
+    using a manifest file visible to the DVID server.  Each manifest line gives a section
+    as "<filename> <z> [<x offset> <y offset>]", separated by whitespace or commas, and
+    each image is translated by its offset when written.  Relative filenames are relative
+    to the manifest's directory and lines starting with "#" are ignored.
+
+    Example: 
+
+    $ dvid node 3f8c mygrayscale loadsections /data/aligned/manifest.txt
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to add.
+    manifest      Filename of section manifest.
+
+    Configuration Settings (case-insensitive keys)
+
+    checksums     Filename of a checksum manifest that section files are verified against
+                    before any are loaded.
+
+$ dvid node <UUID> <data name> watch <directory> <settings...>
+$ dvid node <UUID> <data name> watch status
+$ dvid node <UUID> <data name> unwatch <directory>
+
+    Watches a directory visible to the DVID server and ingests XY section images (PNG,
+    JPEG, TIFF, or BMP) as they appear, e.g., while a microscope deposits data during
+    acquisition.  Each file's z is the last number in its name, so "section_00123.png"
+    is z 123.  Files are ingested once they stop changing between checks, and files with
+    the same contents and z as one already ingested are skipped as duplicates.  Files that
+    fail to load are retried up to 3 times, and the watch stops if the version can no longer
+    be written, e.g., after the dataset is published.  "watch status" returns JSON with the
+    files ingested, duplicates, and recent errors of each watch.
+
+    Example: 
+
+    $ dvid node 3f8c mygrayscale watch /data/acquisition pattern=*.tif zoffset=1000
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to add.
+    directory     Directory of section images.
+
+    Configuration Settings (case-insensitive keys)
+
+    pattern       Glob that filenames must match (default: "*").
+    offset        XY translation of each section as "x,y" (default: 0,0).
+    zoffset       Amount added to each file's z (default: 0).
+    interval      Time between checks of the directory, e.g., "10s" (default: 5s).
 
 $ dvid node <UUID> <data name> put local  <plane> <offset> <image glob>
 $ dvid node <UUID> <data name> put remote <plane> <offset> <image glob>
@@ -95,6 +181,249 @@ $ dvid node <UUID> <data name> put remote <plane> <offset> <image glob>
                     Slice strings ("xy", "xz", or "yz") are also accepted.
     offset        3d coordinate in the format "x,y,z".  Gives coordinate of top upper left voxel.
     image glob    Filenames of images, e.g., foo-xy-*.png
+
+$ dvid node <UUID> <data name> import precomputed <source> <settings...>
+
+    Starts a job that ingests a Neuroglancer precomputed volume, e.g., a published dataset,
+    into a version node, fetching and decoding chunks in parallel.  The first selected scale
+    is written into the data at the same voxel coordinates, and its resolution must match
+    the data's voxel size in nanometers, which can be set with VoxelSize when the data is
+    created.  Each other selected scale must be a 2^n downsampling of the first and is
+    written into data named "<data name>-s<n>", which is created if needed.  Chunks with
+    "raw", "jpeg", or "compressed_segmentation" encodings can be read, but sharded scales
+    cannot.  If the source has a "dvid-checksums.json" manifest, e.g., from an export with
+    checksums=true, the info and each chunk are verified against it and the job fails on
+    a mismatch.  If the server is stopped with SIGTERM or SIGINT, the job resumes from its
+    last imported chunk when the server restarts.
+
+    Sources are a local directory, "file:///path", "http://" or "https://" URLs,
+    "s3://bucket/prefix", or "gs://bucket/prefix".  Buckets are read with the credentials
+    used for exports if they're set in the server's environment and read anonymously
+    otherwise.
+
+    Example: 
+
+    $ dvid node 3f8c grayscale import precomputed gs://neuroglancer-public-data/flyem_fib-25/image scales=0,1
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to import into.
+    source        Location of the precomputed volume's "info" file and scale directories.
+
+    Configuration Settings (case-insensitive keys)
+
+    scales        Comma-separated scale keys or indices into the info's scales (default: 0)
+    fetches       Number of concurrent chunk fetches (default: %d)
+    endpoint      URL of an S3-compatible server for "s3://" sources.
+    region        S3 region for "s3://" sources.
+
+$ dvid mirror <remote URL> <UUID> <data name> <settings...>
+
+    Starts a job copying voxels from data of another DVID server into existing local data
+    of the same type through the remote's HTTP API, reading block-aligned subvolumes in
+    parallel.  This works with remote servers that don't support push/pull replication.
+    By default the local data has the same UUID and name; see "dvid help".
+
+    Example: 
+
+    $ dvid mirror http://emdata2:8000 3f8c grayscale offset=0,0,100 size=1024,1024,256
+
+    Configuration Settings (case-insensitive keys)
+
+    offset        Coordinate of the first voxel as "x,y,z" (default: remote data extents)
+    size          Size of the region as "nx,ny,nz" (default: remote data extents)
+
+$ dvid node <UUID> <data name> export <format> <target> <settings...>
+
+    Streams 3d voxels within the data extents in a chunked format to a local directory or
+    directly to cloud object storage without staging on local disk.  Chunks are uploaded
+    in parallel and a manifest, "dvid-export-manifest.json" with segments named
+    "dvid-export-manifest.json.<n>", records completed uploads so an interrupted export of
+    the same data and version can resume where it left off with resume=true.
+
+    Formats:
+
+    n5            N5 container "<data name>.n5" with a downsampled pyramid, plus a
+                    BigDataViewer XML file "<data name>.xml", for use in Fiji/BigStitcher.
+                    Only single-channel data is supported.
+    zarr          Zarr v2 array with one uncompressed chunk per block.
+    precomputed   Neuroglancer precomputed volume with raw chunks at all scales.
+
+    Targets are a local directory, "file:///path", "s3://bucket/prefix", or
+    "gs://bucket/prefix".  Credentials are read from the server's environment:
+    AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and optionally AWS_SESSION_TOKEN for S3, or
+    GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY (HMAC interoperability keys) for GCS.
+
+    Example: 
+
+    $ dvid node 3f8c mygrayscale export n5 /exports/mygrayscale scales=4
+    $ dvid node 3f8c mygrayscale export precomputed s3://mybucket/fib25/grayscale uploads=32
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to export.
+    format        "n5", "zarr", or "precomputed"
+    target        Directory or object store location visible to the DVID server.
+
+    Configuration Settings (case-insensitive keys)
+
+    uploads       Number of concurrent uploads (default: %d)
+    resume        "true" skips objects recorded in an existing manifest of the same data
+                    and version, "false" (default) rewrites everything.
+    endpoint      URL of an S3-compatible server, e.g., "http://localhost:9000" for MinIO.
+    region        S3 region (default: AWS_REGION or "us-east-1")
+    scales        N5 only: number of pyramid levels including full resolution (default: add
+                    2x downsampled levels until a level fits within one block)
+    compression   N5 only: "gzip" (default) or "raw"
+    checksums     "true" writes "dvid-checksums.json" listing the size and SHA-256 checksum
+                    of every object so copies of the export can be verified (default: false)
+
+$ dvid node <UUID> <data name> export nifti <filename> <settings...>
+
+    Exports a 3d subvolume, by default the data extents, into a NIfTI-1 file visible to
+    the DVID server.  The file is gzipped if its name ends in ".gz".  Voxel size and units
+    are written to the header and the offset sets the translation of the affine.
+
+    Example: 
+
+    $ dvid node 3f8c mygrayscale export nifti /exports/roi.nii.gz offset=0,0,100 size=256,256,64
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to export.
+    filename      Target file on the DVID server.
+
+    Configuration Settings (case-insensitive keys)
+
+    offset        Coordinate of the first voxel as "x,y,z" (default: data extents)
+    size          Size of the subvolume as "nx,ny,nz" (default: data extents)
+    checksums     "true" writes "<filename>.checksums.json" with the file's size and SHA-256
+                    checksum (default: false)
+
+$ dvid node <UUID> <data name> export slices <directory> <settings...>
+
+    Starts a job that renders every Z slice of a version, by default the data extents, as
+    an image in a directory visible to the DVID server.  Files are named by data and the
+    Z coordinate at the chosen scale, e.g., "grayscale-z000100.png".  Use "dvid jobs
+    <job ID>" to get the progress of the job.  If the server is stopped with SIGTERM or
+    SIGINT, the job resumes from its last written slice when the server restarts.
+
+    Example: 
+
+    $ dvid node 3f8c mygrayscale export slices /exports/mygrayscale-s1 scale=1 format=tiff
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to export.
+    directory     Target directory on the DVID server, created if necessary.
+
+    Configuration Settings (case-insensitive keys)
+
+    scale         Number of 2x downsamplings along each axis (default: 0, full resolution)
+    format        Image format, e.g., "png" (default) or "tiff"
+    offset        Coordinate of the first voxel at full resolution as "x,y,z" (default: data extents)
+    size          Size of the exported region at full resolution as "nx,ny,nz" (default: data extents)
+    checksums     "true" writes "dvid-checksums.json" with the size and SHA-256 checksum
+                    of every image (default: false)
+
+$ dvid node <UUID> <data name> components <labels64 name> <settings...>
+
+    Starts a job that labels the 6-connected components of voxels at or above a threshold
+    within the data extents and writes them into new labels64 data with the same block
+    and voxel size.  Background voxels get label 0.  Blocks are labeled independently and
+    then merged across block faces, so the volume doesn't need to fit in memory.  Use
+    "dvid jobs <job ID>" to get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c mymask components mymask-cc threshold=128
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of single channel data to label.
+    labels64 name  Name of new labels64 data.
+
+    Configuration Settings (case-insensitive keys)
+
+    threshold     Minimum voxel value in a component (default: 1, i.e., nonzero voxels)
+
+$ dvid node <UUID> <data name> copyregion <src UUID> <src data name> <offset> <size>
+
+    Starts a job that copies a subvolume from the source data at the source version into
+    this data, entirely within the server, e.g., to patch a bad region with voxels from an
+    earlier version.  The source must be data of the same type and voxel values.  The copy
+    is done in rows of blocks aligned to this data's blocks, so only blocks on the faces of
+    the subvolume are merged with existing voxels.  Use "dvid jobs <job ID>" to get the
+    progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c grayscale copyregion 1a2b grayscale 0,0,100 512,512,64
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of data receiving the voxels.
+    src UUID       Version node of the source data.
+    src data name  Name of the source data.
+    offset         3d coordinate of the first voxel in the format "x,y,z".
+    size           Size of the subvolume in the format "nx,ny,nz".
+
+$ dvid node <UUID> <data name> roi <roi name> <settings...>
+
+    Starts a job that creates roi data holding every block within the data extents that
+    has a voxel at or above a threshold, e.g., to restrict processing to a tissue mask.
+    The ROI uses the block size of this data.  Use "dvid jobs <job ID>" to get the
+    progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c mymask roi neuropil threshold=128
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of single channel data to threshold.
+    roi name       Name of new roi data.
+
+    Configuration Settings (case-insensitive keys)
+
+    threshold     Minimum voxel value in an ROI block (default: 1, i.e., nonzero voxels)
+
+$ dvid node <UUID> <data name> morph <operation> <new data name> <settings...>
+
+    Starts a job that applies a binary morphology operation or Euclidean distance transform
+    to the mask of voxels at or above a threshold and writes the result into new data of the
+    same type.  Operations are "erode", "dilate", "open", "close", and "distance".  Morphology
+    operations use a ball of the given radius and write the maximum voxel value inside the
+    result and 0 outside.  The "distance" operation writes the distance in voxels from each
+    mask voxel to the nearest voxel outside the mask, clamped to maxdistance.  Only the ROI
+    given by offset and size is processed, a block at a time.  Use "dvid jobs <job ID>" to
+    get the progress of the job.
+
+    Example: 
+
+    $ dvid node 3f8c mymask morph close mymask-closed radius=2 offset=0,0,100 size=512,512,64
+
+    Arguments:
+
+    UUID           Hexidecimal string with enough characters to uniquely identify a version node.
+    data name      Name of single channel uint8 or uint16 data.
+    operation      One of "erode", "dilate", "open", "close", or "distance".
+    new data name  Name of new data holding the result.
+
+    Configuration Settings (case-insensitive keys)
+
+    threshold     Minimum voxel value in the mask (default: 1, i.e., nonzero voxels)
+    radius        Radius in voxels of the structuring ball (default: 1)
+    maxdistance   Maximum distance written by the "distance" operation (default: 32)
+    offset        Coordinate of the first voxel of the ROI as "x,y,z" (default: data extents)
+    size          Size of the ROI as "nx,ny,nz" (default: data extents)
 	
     ------------------
 
@@ -115,7 +444,22 @@ POST <api URL>/node/<UUID>/<data name>/info
     GET <api URL>/node/3f8c/grayscale/info
 
     Returns JSON with configuration settings that include location in DVID space and
-    min/max block indices.
+    min/max block indices.  A "Multiscale" object describes each scale served by
+    precomputed requests, full resolution first:
+
+    "Multiscale": {
+        "Axes": ["X", "Y", "Z"],
+        "Scales": [
+            {"Key": "s0", "Level": 0, "Resolution": [8, 8, 8], "Units": ["nm", "nm", "nm"],
+             "Offset": [0, 0, 100], "Size": [1024, 1024, 200]},
+            {"Key": "s1", "Level": 1, "Data": "grayscale-s1", "Resolution": [16, 16, 16],
+             "Units": ["nm", "nm", "nm"], "Offset": [0, 0, 50], "Size": [512, 512, 100]}
+        ]
+    }
+
+    Each scale spans voxel coordinates from Offset up to, but not including, Offset + Size
+    at its resolution.  "Data" names data holding the scale if it was built by the
+    "pyramid" command.
 
     Arguments:
 
@@ -142,6 +486,8 @@ POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
     height (y) of 256 voxels with offset (0,0,100) in JPG format with quality 80.
     By "raw", we mean that no additional processing is applied based on voxel
     resolutions to make sure the retrieved image has isotropic pixels.
+    If the server was started with a memory budget (-membudget), requests wait until
+    enough memory is free and are rejected if they could never fit.
     The example offset assumes the "grayscale" data in version node "3f8c" is 3d.
     The "Content-type" of the HTTP response should agree with the requested format.
     For example, returned PNGs will have "Content-type" of "image/png", and returned
@@ -157,9 +503,54 @@ POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
     offset        Gives coordinate of first voxel using dimensionality of data.
     format        Valid formats depend on the dimensionality of the request and formats
                     available in server implementation.
-                  2D: "png", "jpg" (default: "png")
-                    jpg allows lossy quality setting, e.g., "jpg:80"
-                  nD: uses default "octet-stream".
+                  2D: "png", "jpg", "tiff", "bmp", and if built with libwebp/libavif,
+                    "webp" and "avif" (default: "png")
+                    jpg, webp, and avif allow lossy quality setting, e.g., "jpg:80" or
+                    "webp:75", and webp can be lossless with "webp:lossless".  If no format
+                    is given, webp or avif is returned when listed in the Accept header.
+                    tiff compression can be set with "tiff:lzw", "tiff:deflate" (default),
+                    or "tiff:none".
+                  nD: uses default "raw" (also "octet-stream").  3D requests can instead use
+                    "tiff" to get a multi-page TIFF with one XY page per Z, e.g., "tiff:lzw",
+                    or "npy" to get a NumPy .npy file of shape (Z, Y, X) suitable for np.load().
+                  2D and 3D: "raw" gives packed voxels, "nrrd" or "nrrd:gzip" gives NRRD with
+                    the voxel size as spacings for tools like 3D Slicer, and "nii" gives a NIfTI-1 volume
+                    carrying the voxel size and offset.  POSTed data can be in these formats
+                    if given as the format or the "Content-Type", e.g., "application/x-nrrd".
+
+    Query-string Options (GET):
+
+    consistency   "strong" waits for buffered writes ("async=true") acknowledged before the
+                    GET that overlap the requested voxels, or "eventual" (default).
+    session       With "consistency=strong", only waits for writes of this client session.
+
+    Query-string Options (raw GET only):
+
+    axes          Order of the request's axes in the response, e.g., "yx" transposes a slice
+                    and "zyx" swaps the x and z axes of a subvolume.  Letters name the axes of
+                    the request in order, so for an XZ slice, "y" is its Z axis.
+    flip          Comma-separated response axes to reverse, e.g., "y" or "x,z".  Flips are
+                    applied after reordering by "axes".
+
+    Query-string Options (2D GET of uint8 voxels, including "isotropic"):
+
+    contrast      "equalize" equalizes the histogram of the slice.  "clahe" applies contrast
+                    limited adaptive histogram equalization, which equalizes tiles of the
+                    slice separately and blends them, bringing out local detail.
+    tilesize      Width and height in voxels of "clahe" tiles (default: 64).
+    cliplimit     Maximum "clahe" histogram bin count as a multiple of the mean count
+                    (default: 2).  Lower values limit noise amplification.
+
+    Query-string Options (3D POST only):
+
+    async         If "true", the POSTed data is buffered and the server immediately replies
+                    with "202 Accepted" and JSON {"Job": <job ID>}, writing the data in the
+                    background.  Poll "<api URL>/jobs/<job ID>" to learn when the write is done
+                    or failed.  Buffered writes count against the memory budget until written,
+                    so heavy pipelined ingest waits rather than exhausting memory.
+    session       Client session of the write.  GETs with "consistency=strong" wait for
+                    overlapping buffered writes of their session, or of any session if
+                    they don't give one.
 
 GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format>]
 
@@ -190,9 +581,205 @@ GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format
     offset        Gives coordinate of first voxel using dimensionality of data.
     format        Valid formats depend on the dimensionality of the request and formats
                     available in server implementation.
-                  2D: "png", "jpg" (default: "png")
-                    jpg allows lossy quality setting, e.g., "jpg:80"
-                  nD: uses default "octet-stream".
+                  2D: "png", "jpg", "tiff", "bmp", and if built with libwebp/libavif,
+                    "webp" and "avif" (default: "png")
+                    jpg, webp, and avif allow lossy quality setting, e.g., "jpg:80" or
+                    "webp:75", and webp can be lossless with "webp:lossless".  If no format
+                    is given, webp or avif is returned when listed in the Accept header.
+                    tiff compression can be set with "tiff:lzw", "tiff:deflate" (default),
+                    or "tiff:none".
+                  nD: uses default "raw" (also "octet-stream").  3D requests can instead use
+                    "tiff" to get a multi-page TIFF with one XY page per Z, e.g., "tiff:lzw",
+                    "npy", "nrrd", or "nii".
+
+GET  <api URL>/node/<UUID>/<data name>/zarr/<key>
+POST <api URL>/node/<UUID>/<data name>/zarr/<key>
+
+    Exposes 3d voxels as a Zarr array so Zarr clients can use a store URL of
+    "<api URL>/node/<UUID>/<data name>/zarr".  Zarr v2 metadata is at ".zarray" and ".zattrs"
+    with chunk keys like "2.0.1", and Zarr v3 metadata is at "zarr.json" with chunk keys
+    like "c/2/0/1".  Chunk coordinates are in (Z, Y, X) order and each chunk is exactly one
+    uncompressed block.  The array origin is the block containing the smallest stored voxel
+    and is given as "dvid_offset" in the attributes.  Chunks can be written via POST or PUT.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/zarr/.zarray
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    key           Zarr metadata or chunk key.
+
+POST <api URL>/node/<UUID>/<data name>/exists
+
+    Checks which of a JSON list of block coordinates have blocks written at the version,
+    so an interrupted load can be resumed by only writing the missing blocks.  Blocks of
+    ancestor versions don't count.  Returns a bitmask where bit i, counting from the least
+    significant bit of the first byte, is set if the i-th block exists.  The number of
+    blocks checked and found are given in the X-Dvid-Keys and X-Dvid-Found headers.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/grayscale/exists
+
+    [[0, 0, 0], [1, 0, 0], [2, 0, 0]]
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+
+GET  <api URL>/node/<UUID>/<data name>/missing[/<size>/<offset>][?roi=<roi name>]
+
+    Returns JSON describing the blocks within a subvolume, an ROI, or their intersection
+    that have no data written at the version, e.g., to track the progress of a long
+    ingest or find holes left by failed pipeline shards.  Blocks of ancestor versions
+    don't count.  The reply gives the number of blocks checked and missing, and the
+    missing blocks as spans [z, y, x0, x1] in block coordinates:
+
+    { "Blocks": 3, "Missing": 1, "Spans": [[0, 0, 1, 1]] }
+
+    Regions of more than 4,194,304 blocks are refused and should be checked in parts.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/missing/1024_1024_256/0_0_0?roi=neuropil
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    size          Size in voxels of the subvolume in the format "dx_dy_dz".
+    offset        Coordinate of the first voxel of the subvolume in the format "x_y_z".
+
+    Query-string Options:
+
+    roi           Name of roi data in the same version whose blocks are checked.
+
+GET  <api URL>/node/<UUID>/<data name>/precomputed/info
+GET  <api URL>/node/<UUID>/<data name>/precomputed/<scale key>/<chunk name>
+
+    Serves 3d voxels in the Neuroglancer "precomputed" layout so Neuroglancer can use a
+    source of "precomputed://<api URL>/node/<UUID>/<data name>/precomputed".  The info
+    JSON lists scales "s0", "s1", ... where each scale is downsampled 2x from the previous
+    one.  Chunks are generated on the fly from stored blocks using "raw" encoding.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/precomputed/s1/0-32_0-32_64-96
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    scale key     Scale key given in the info JSON, e.g., "s0" for full resolution.
+    chunk name    Voxel range at that scale in the form "<xBeg>-<xEnd>_<yBeg>-<yEnd>_<zBeg>-<zEnd>".
+
+GET  <api URL>/node/<UUID>/<data name>/isosurface/<threshold>/<size>/<offset>[/<format>]
+
+    Returns a triangle mesh of the surface of voxels with values at or above the threshold
+    within a subvolume, computed on the fly using marching cubes.  This is meant for quick
+    3d previews and is only available for data with uint8 or uint16 voxels.  Vertex
+    coordinates are in voxels.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/isosurface/128/256_256_256/0_0_100/obj
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    threshold     Minimum voxel value inside the surface.
+    size          Size in voxels of the subvolume in the format "dx_dy_dz".
+    offset        Coordinate of the first voxel of the subvolume in the format "x_y_z".
+    format        "obj" (default) gives Wavefront OBJ text.  "binary" gives little-endian
+                    uint32 # vertices (N), uint32 # triangles (M), 3N float32 vertex
+                    coordinates, and 3M uint32 vertex indices.
+
+GET  <api URL>/node/<UUID>/<data name>/affine/<size>/<matrix>[/<format>]
+
+    Returns a cutout warped by an affine transform, sampled on the fly from stored blocks,
+    e.g., to check an alignment.  Voxel (x, y, z) of the cutout is sampled at the point
+    M (x, y, z, 1) of the data, where M is the 3x4 matrix.  Samples between voxels use
+    trilinear interpolation and samples outside the data are 0.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/affine/256_256_64/0.98_-0.17_0_1200_0.17_0.98_0_800_0_0_1_3000/npy
+
+    Returns a 256 x 256 x 64 cutout rotated about z by 10 degrees with its first voxel at
+    (1200, 800, 3000) in the data.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    size          Size in voxels of the cutout in the format "dx_dy_dz".
+    matrix        12 numbers of the 3x4 matrix in row-major order separated by "_".
+    format        "raw" (default) or any 3D array format of "raw" requests, e.g., "npy".
+
+    Query-string Options:
+
+    interpolation  "linear" (default) or "nearest", which returns the nearest voxel and
+                     is appropriate for labels.
+
+GET  <api URL>/node/<UUID>/<data name>/overlay/<dims>/<size>/<offset>[/<format>]
+
+    Returns an image of a slice of uint8 data with label colors blended over it and point
+    annotations drawn as discs, rendered server-side for reports and simple viewers.  Each
+    label has the color of the chosen colormap of the label data or, if it's not in the
+    colormap, a fixed color from a hash, and label 0 is left uncolored by default.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/overlay/xy/512_512/0_0_100?labels=bodies&annotations=synapses
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of uint8 data, e.g., grayscale8.
+    dims          The axes of data extraction in form "i_j".  Example: "0_2" is XZ.
+                    Slice strings ("xy", "xz", or "yz") are also accepted.
+    size          Size in pixels in the format "dx_dy".
+    offset        3d coordinate in the format "x_y_z".  Gives coordinate of top upper left voxel.
+    format        Any image format, e.g., "png" (default) or "jpg:80".
+
+    Query-string Options:
+
+    labels        Name of label data in the same version, e.g., labels64, to color.
+    colormap      Name of a colormap of the label data (default "default").  See the
+                    labels64 colormap API.
+    annotations   Name of annotation data in the same version whose points are drawn.
+    alpha         Opacity of label colors from 0 to 1 (default 0.5).
+    radius        Radius in voxels of drawn points, at most 256 (default 3).  Points off
+                    the slice are drawn smaller with distance and hidden beyond the radius.
+
+GET  <api URL>/node/<UUID>/<data name>/slices/<scale>[/<format>]
+
+    Returns a zip or tar archive with an image of every Z slice at the given scale, named
+    as in the "export slices" command.  Slices are rendered and streamed one at a time.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/slices/2/png?archive=tar
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to export.
+    scale         Number of 2x downsamplings along each axis, 0 for full resolution.
+    format        Image format, e.g., "png" (default) or "tiff".
+
+    Query-string Options:
+
+    archive       "zip" (default) or "tar".
+    checksums     "true" ends the archive with "dvid-checksums.json" listing the size and
+                    SHA-256 checksum of every image.
+    offset        Coordinate of the first voxel at full resolution as "x,y,z" (default: data extents)
+    size          Size of the exported region at full resolution as "nx,ny,nz" (default: data extents)
 
 (TO DO)
 
@@ -231,6 +818,10 @@ func init() {
 	gob.Register(&Data{})
 	gob.Register(&binary.LittleEndian)
 	gob.Register(&binary.BigEndian)
+
+	// Resume ingests and exports interrupted by a server shutdown.
+	server.RegisterJobResumer(importJobKind, resumeImport)
+	server.RegisterJobResumer(sliceExportJobKind, resumeSliceExport)
 }
 
 // Operation holds Voxel-specific data for processing chunks.
@@ -272,6 +863,8 @@ type IntHandler interface {
 
 	DataID() datastore.DataID
 
+	DatatypeName() dvid.TypeString
+
 	UseCompression() dvid.Compression
 
 	UseChecksum() dvid.Checksum
@@ -287,6 +880,20 @@ type IntHandler interface {
 	ProcessChunk(*storage.Chunk)
 }
 
+// WriteChecker is implemented by IntHandlers whose voxels can't be written at some
+// versions, e.g., labels copied into views that must stay current.
+type WriteChecker interface {
+	CheckWrite(uuid dvid.UUID) error
+}
+
+// checkWrite returns an error if the voxels of an IntHandler can't be written at a version.
+func checkWrite(i IntHandler, uuid dvid.UUID) error {
+	if checker, ok := i.(WriteChecker); ok {
+		return checker.CheckWrite(uuid)
+	}
+	return nil
+}
+
 // ExtHandler provides the shape, location (indexing), and data of a set of voxels
 // connected with external usage. It is the type used for I/O from DVID to clients,
 // e.g., 2d images, 3d subvolumes, etc.  These user-facing data must be converted to
@@ -347,63 +954,109 @@ type VoxelSetter interface {
 	SetData(data []byte)
 }
 
+// getRequestedVoxels copies voxels like GetVoxels for a client request and counts the read
+// toward the data's usage.  Reads on behalf of the server, e.g., by exports, pyramids, or
+// validation, use GetVoxels so they don't count as user reads.
+func getRequestedVoxels(r *http.Request, uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+	if err := GetVoxels(r.Context(), uuid, i, e); err != nil {
+		return err
+	}
+	server.RecordRegionRead(uuid, i.DataID(), e.StartPoint(), e.EndPoint())
+	return nil
+}
+
 // GetImage retrieves a 2d image from a version node given a geometry of voxels.
-func GetImage(uuid dvid.UUID, i IntHandler, e ExtHandler) (*dvid.Image, error) {
-	if err := GetVoxels(uuid, i, e); err != nil {
+func GetImage(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) (*dvid.Image, error) {
+	if err := GetVoxels(ctx, uuid, i, e); err != nil {
 		return nil, err
 	}
 	return e.GetImage2d()
 }
 
 // GetVolume retrieves a n-d volume from a version node given a geometry of voxels.
-func GetVolume(uuid dvid.UUID, i IntHandler, e ExtHandler) ([]byte, error) {
-	if err := GetVoxels(uuid, i, e); err != nil {
+func GetVolume(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) ([]byte, error) {
+	if err := GetVoxels(ctx, uuid, i, e); err != nil {
 		return nil, err
 	}
 	return e.Data(), nil
 }
 
 // GetVoxels copies voxels from an IntHandler for a version to an ExtHandler, e.g.,
-// a requested subvolume or 2d image.
-func GetVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
-	db, err := server.OrderedKeyValueGetter()
-	if err != nil {
+// a requested subvolume or 2d image.  Block iteration stops early if the context is
+// canceled, e.g., by a client disconnect or request timeout, and the context's error
+// is returned.
+func GetVoxels(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+	if err := server.AwaitWrites(ctx, uuid, i.DataID(), e.StartPoint(), e.EndPoint()); err != nil {
 		return err
 	}
 
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
-	if err != nil {
-		return err
-	}
+	dataID := i.DataID()
+	ctx, span := dvid.StartSpan(ctx, "voxels.GetVoxels")
+	span.SetAttribute("dvid.data", string(dataID.DataName()))
+	span.SetAttribute("dvid.geometry", e.String())
+	defer span.Finish()
 
 	wg := new(sync.WaitGroup)
-	chunkOp := &storage.ChunkOp{&Operation{e, GetOp}, wg}
-	dataID := i.DataID()
+	chunkOp := &storage.ChunkOp{&Operation{e, GetOp}, wg, ctx}
 	server.SpawnGoroutineMutex.Lock()
 	for it, err := e.IndexIterator(i.BlockSize()); err == nil && it.Valid(); it.NextSpan() {
+		if err := ctx.Err(); err != nil {
+			server.SpawnGoroutineMutex.Unlock()
+			wg.Wait()
+			return err
+		}
 		indexBeg, indexEnd, err := it.IndexSpan()
 		if err != nil {
 			server.SpawnGoroutineMutex.Unlock()
 			return err
 		}
-		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg}
-		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd}
 
-		// Send the entire range of key/value pairs to ProcessChunk()
-		err = db.ProcessRange(startKey, endKey, chunkOp, i.ProcessChunk)
+		// Send the blocks of the range visible at this version to ProcessChunk()
+		_, rangeSpan := dvid.StartSpan(ctx, "storage.ProcessRange")
+		readStart := time.Now()
+		err = service.ProcessVisible(ctx, uuid, dataID.ID, indexBeg, indexEnd, func(kv *storage.KeyValue) {
+			wg.Add(1)
+			i.ProcessChunk(&storage.Chunk{chunkOp, *kv})
+		})
+		dvid.AddTiming(ctx, dvid.StorageTime, readStart)
+		rangeSpan.SetError(err)
+		rangeSpan.Finish()
 		if err != nil {
 			server.SpawnGoroutineMutex.Unlock()
+			wg.Wait()
+			if err == ctx.Err() {
+				return err
+			}
 			return fmt.Errorf("Unable to GET data %s: %s", dataID.DataName(), err.Error())
 		}
 	}
 	server.SpawnGoroutineMutex.Unlock()
-	if err != nil {
-		return err
-	}
 
 	wg.Wait()
-	return nil
+	return ctx.Err()
+}
+
+// PutVoxelsAsync starts a job that stores the voxels of e, calling release, if not nil,
+// once the write is done.  The write doesn't depend on the context of the request that
+// supplied the voxels, so it completes even if the client disconnects.  Strongly consistent
+// reads of the client session wait for the write.
+func PutVoxelsAsync(session string, uuid dvid.UUID, i IntHandler, e ExtHandler, release func()) *server.Job {
+	description := fmt.Sprintf("Write of %s into data '%s'", e, i.DataID().DataName())
+	job := server.NewJob(description)
+	written := server.TrackWrite(session, uuid, i.DataID(), e.StartPoint(), e.EndPoint())
+	go func() {
+		err := PutVoxels(context.Background(), uuid, i, e)
+		written()
+		if release != nil {
+			release()
+		}
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	return job
 }
 
 // PutVoxels copies voxels from an ExtHander (e.g., subvolume or 2d image) into an IntHandler
@@ -411,27 +1064,32 @@ func GetVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 // integrating the PUT data into current chunks before writing the result.  There are two passes:
 //   Pass one: Retrieve all available key/values within the PUT space.
 //   Pass two: Merge PUT data into those key/values and store them.
-func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
-	db, err := server.OrderedKeyValueGetter()
-	if err != nil {
-		return err
-	}
-
+// If the context is canceled, no further spans are stored but blocks already written
+// are kept.
+func PutVoxels(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 	service := server.DatastoreService()
 	_, versionID, err := service.LocalIDFromUUID(uuid)
 	if err != nil {
 		return err
 	}
 
-	wg := new(sync.WaitGroup)
-	chunkOp := &storage.ChunkOp{&Operation{e, PutOp}, wg}
 	dataID := i.DataID()
+	ctx, span := dvid.StartSpan(ctx, "voxels.PutVoxels")
+	span.SetAttribute("dvid.data", string(dataID.DataName()))
+	span.SetAttribute("dvid.geometry", e.String())
+	defer span.Finish()
+
+	wg := new(sync.WaitGroup)
+	chunkOp := &storage.ChunkOp{&Operation{e, PutOp}, wg, ctx}
 
 	// We only want one PUT on given version for given data to prevent interleaved
 	// chunk PUTs that could potentially overwrite slice modifications.
 	versionMutex := i.VersionMutex(versionID)
 	versionMutex.Lock()
 	defer versionMutex.Unlock()
+	if err := checkWrite(i, uuid); err != nil {
+		return err
+	}
 
 	// Keep track of changing extents and mark dataset as dirty if changed.
 	var extentChanged bool
@@ -452,25 +1110,26 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 
 	// Iterate through index space for this data.
 	for it, err := e.IndexIterator(i.BlockSize()); err == nil && it.Valid(); it.NextSpan() {
+		if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return err
+		}
 		i0, i1, err := it.IndexSpan()
 		if err != nil {
 			return err
 		}
-		ptBeg := i0.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := i1.Duplicate().(dvid.ChunkIndexer)
-
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-
-		if extents.AdjustIndices(ptBeg, ptEnd) {
+		indices := spanIndices(e, it, i0, i1)
+		if adjustSpanExtents(extents, indices) {
 			extentChanged = true
 		}
 
-		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, ptBeg}
-		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, ptEnd}
-
 		// GET all the key/value pairs for this range.
-		keyvalues, err := db.GetRange(startKey, endKey)
+		_, rangeSpan := dvid.StartSpan(ctx, "storage.GetRange")
+		readStart := time.Now()
+		keyvalues, err := getVisibleRange(ctx, uuid, dataID, versionID, i0, i1)
+		dvid.AddTiming(ctx, dvid.StorageTime, readStart)
+		rangeSpan.SetError(err)
+		rangeSpan.Finish()
 		if err != nil {
 			return fmt.Errorf("Error in reading data during PUT %s: %s", dataID.DataName(), err.Error())
 		}
@@ -482,11 +1141,9 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 		if numOldkv > 0 {
 			oldkv = keyvalues[oldI]
 		}
-		wg.Add(int(endX-begX) + 1)
-		c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-		for x := begX; x <= endX; x++ {
-			c[0] = x
-			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+		wg.Add(len(indices))
+		for _, index := range indices {
+			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, index}
 			// Check for this key among old key-value pairs and if so,
 			// send the old value into chunk handler.
 			if oldkv.K != nil {
@@ -494,7 +1151,7 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 				if err != nil {
 					return err
 				}
-				if indexer.Value(0) == x {
+				if bytes.Equal(indexer.Bytes(), index.Bytes()) {
 					kv = oldkv
 					oldI++
 					if oldI < numOldkv {
@@ -516,62 +1173,178 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 	}
 
 	wg.Wait()
+	notifyWrite(uuid, i, e.StartPoint(), e.EndPoint())
 	return nil
 }
 
+// spanIndices returns the block indices, in key order, for the current span of an
+// iterator.  Iterators over space-filling curves enumerate their own spans, while
+// the default ZYX spans are runs along X from beg to end.
+func spanIndices(e ExtHandler, it dvid.IndexIterator, beg, end dvid.Index) []dvid.ChunkIndexer {
+	if spanner, ok := it.(dvid.SpanIterator); ok {
+		return spanner.SpanIndices()
+	}
+	ptBeg := beg.(dvid.ChunkIndexer)
+	ptEnd := end.(dvid.ChunkIndexer)
+	begX := ptBeg.Value(0)
+	endX := ptEnd.Value(0)
+	indices := make([]dvid.ChunkIndexer, 0, endX-begX+1)
+	c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
+	for x := begX; x <= endX; x++ {
+		c[0] = x
+		indices = append(indices, e.Index(c).(dvid.ChunkIndexer))
+	}
+	return indices
+}
+
+// adjustSpanExtents modifies extents to include the bounding box of the given indices.
+func adjustSpanExtents(extents *Extents, indices []dvid.ChunkIndexer) bool {
+	if len(indices) == 0 {
+		return false
+	}
+	var min, max dvid.ChunkIndexer = indices[0], indices[0]
+	for _, index := range indices[1:] {
+		min, _ = min.Min(index)
+		max, _ = max.Max(index)
+	}
+	return extents.AdjustIndices(min, max)
+}
+
 type bulkLoadInfo struct {
 	filenames     []string
+	uuid          dvid.UUID
 	versionID     dvid.VersionLocalID
 	offset        dvid.Point
 	extentChanged dvid.Bool
+
+	// Bounds of the loaded voxels.
+	minPt, maxPt dvid.Point
 }
 
-func loadHDF(i IntHandler, load *bulkLoadInfo) error {
-	return fmt.Errorf("DVID currently does not support HDF5 image import.")
-	// TODO: Use a DVID-specific HDF5 loader that works off HDF5 C library.
-	/*
-			for _, filename := range load.filenames {
-				f, err := hdf5.OpenFile(filename, hdf5.F_ACC_RDONLY)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
+// parseHyperslab parses a "x0,y0,z0/nx,ny,nz" hyperslab setting into an offset and size.
+func parseHyperslab(hyperslab string) (offset, size dvid.Point, err error) {
+	parts := strings.Split(hyperslab, "/")
+	if len(parts) != 2 {
+		err = fmt.Errorf("Hyperslab should be specified as 'x0,y0,z0/nx,ny,nz', not '%s'", hyperslab)
+		return
+	}
+	if offset, err = dvid.StringToPoint(parts[0], ","); err != nil {
+		return
+	}
+	if size, err = dvid.StringToPoint(parts[1], ","); err != nil {
+		return
+	}
+	if offset.NumDims() != size.NumDims() {
+		err = fmt.Errorf("Hyperslab offset and size have different dimensions: %s", hyperslab)
+	}
+	return
+}
 
-				fmt.Printf("Opened HDF5 file: %s\n", filename)
-				numobj, err := f.NumObjects()
-				fmt.Printf("Number of objects: %d\n", numobj)
-				for n := uint(0); n < numobj; n++ {
-					name, err := f.ObjectNameByIndex(n)
-					if err != nil {
-						return err
-					}
-					fmt.Printf("Object name %d: %s\n", n, name)
-					dataset, err := f.OpenDataset(name)
-					if err != nil {
-						return err
-					}
-					dtype, err := dataset.Datatype()
-					if err != nil {
-						return err
-					}
-					fmt.Printf("Type size: %d\n", dtype.Size())
-					dataspace := dataset.Space()
-					dims, maxdims, err := dataspace.SimpleExtentDims()
-					if err != nil {
-						return err
-					}
-					fmt.Printf("Dims: %s\n", dims)
-					fmt.Printf("Maxdims: %s\n", maxdims)
-					data := make([]uint8, dims[0]*dims[1]*dims[2])
-					err = dataset.Read(&data)
-					if err != nil {
-						return err
-					}
-					fmt.Printf("Read %d bytes\n", len(data))
+// loadHDF loads a hyperslab, or by default all, of a 3d HDF5 dataset from each file into
+// the data at the given offset.  The "dataset" setting gives the path of the dataset within
+// the file and the optional "hyperslab" setting gives a "x0,y0,z0/nx,ny,nz" subvolume.
+// HDF5 datasets are in C order, so (Z, Y, X) dimensions map to DVID (X, Y, Z).
+// Volumes are read and stored in slabs one block thick to limit memory use.
+func loadHDF(ctx context.Context, i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []string, settings dvid.Config) error {
+	path, found, err := settings.GetString("dataset")
+	if err != nil {
+		return err
+	}
+	if !found || path == "" {
+		return fmt.Errorf("HDF5 loads require a 'dataset' setting giving the dataset path, e.g., dataset=/volumes/raw")
+	}
+	dataType, err := i.Values().ValueDataType()
+	if err != nil {
+		return err
+	}
+	if len(i.Values()) != 1 {
+		return fmt.Errorf("HDF5 loads only handle single-channel voxels, not %d values/voxel", len(i.Values()))
+	}
+	hyperslab, _, err := settings.GetString("hyperslab")
+	if err != nil {
+		return err
+	}
+	blockSize := i.BlockSize()
+
+	for _, filename := range filenames {
+		startTime := time.Now()
+		dataset, err := dvid.OpenHDF5Dataset(filename, path)
+		if err != nil {
+			return err
+		}
+		dims, err := dataset.Dims()
+		if err != nil {
+			dataset.Close()
+			return err
+		}
+		if len(dims) != 3 {
+			dataset.Close()
+			return fmt.Errorf("Can only load 3d HDF5 datasets, not %d-d dataset '%s'", len(dims), path)
+		}
+
+		// Determine the hyperslab in DVID (X, Y, Z) order.
+		var slabStart, slabSize dvid.Point3d
+		for dim := 0; dim < 3; dim++ {
+			slabSize[dim] = int32(dims[2-dim])
+		}
+		if hyperslab != "" {
+			start, size, err := parseHyperslab(hyperslab)
+			if err != nil {
+				dataset.Close()
+				return err
+			}
+			if start.NumDims() != 3 {
+				dataset.Close()
+				return fmt.Errorf("Hyperslab must be 3d, got '%s'", hyperslab)
+			}
+			for dim := uint8(0); dim < 3; dim++ {
+				slabStart[dim] = start.Value(dim)
+				slabSize[dim] = size.Value(dim)
+				if slabStart[dim] < 0 || slabSize[dim] <= 0 ||
+					uint64(slabStart[dim]+slabSize[dim]) > dims[2-dim] {
+					dataset.Close()
+					return fmt.Errorf("Hyperslab '%s' is outside dataset dimensions %v", hyperslab, dims)
 				}
 			}
-		return nil
-	*/
+		}
+
+		// Read and store slabs, aligning them with blocks in DVID space when possible.
+		beginZ := offset.Value(2)
+		endZ := beginZ + slabSize[2]
+		for z := beginZ; z < endZ; {
+			nextZ := (floorDiv(z, blockSize.Value(2)) + 1) * blockSize.Value(2)
+			if nextZ > endZ {
+				nextZ = endZ
+			}
+			slabZ := uint64(slabStart[2] + z - beginZ)
+			start := []uint64{slabZ, uint64(slabStart[1]), uint64(slabStart[0])}
+			count := []uint64{uint64(nextZ - z), uint64(slabSize[1]), uint64(slabSize[0])}
+			data, err := dataset.ReadHyperslab(dataType, start, count)
+			if err != nil {
+				dataset.Close()
+				return err
+			}
+			storage.FileBytesRead <- len(data)
+			subvol := dvid.NewSubvolume(dvid.Point3d{offset.Value(0), offset.Value(1), z},
+				dvid.Point3d{slabSize[0], slabSize[1], nextZ - z})
+			e, err := i.NewExtHandler(subvol, data)
+			if err != nil {
+				dataset.Close()
+				return err
+			}
+			if err = PutVoxels(ctx, uuid, i, e); err != nil {
+				dataset.Close()
+				return err
+			}
+			z = nextZ
+		}
+		if err := dataset.Close(); err != nil {
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "Loaded HDF5 dataset '%s' from %s", path, filename)
+		offset = offset.Add(dvid.Point3d{0, 0, slabSize[2]})
+	}
+	return nil
 }
 
 // Optimized bulk loading of XY images by loading all slices for a block before processing.
@@ -609,6 +1382,10 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 		if err != nil {
 			return err
 		}
+		if firstSlice {
+			load.minPt = e.StartPoint()
+		}
+		load.maxPt = e.EndPoint()
 
 		// Allocate blocks and/or load old block data if first/last XY blocks.
 		// Note: Slices are only zeroed out on first and last slice with assumption
@@ -631,7 +1408,7 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 					blocks[curBlocks][i].V = make([]byte, blockBytes, blockBytes)
 				}
 			}
-			err = loadOldBlocks(i, e, blocks[curBlocks], load.versionID)
+			err = loadOldBlocks(load.uuid, i, e, blocks[curBlocks], load.versionID)
 			if err != nil {
 				return err
 			}
@@ -665,8 +1442,8 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 				layerTransferred[curBlocks].Wait()
 				dvid.Log(dvid.Debug, "Writing block buffer %d using %s and %s...\n",
 					curBlocks, i.UseCompression(), i.UseChecksum())
-				err := writeBlocks(i.UseCompression(), i.UseChecksum(), blocks[curBlocks],
-					&layerWritten[curBlocks], &waitForWrites)
+				err := writeBlocks(server.HandlerPoolFor(i.DatatypeName()), i.UseCompression(),
+					i.UseChecksum(), blocks[curBlocks], &layerWritten[curBlocks], &waitForWrites)
 				if err != nil {
 					dvid.Error("Error in async write of voxel blocks: %s", err.Error())
 				}
@@ -690,8 +1467,11 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 // KVWriteSize is the # of key/value pairs we will write as one atomic batch write.
 const KVWriteSize = 500
 
-// writeBlocks writes blocks of voxel data asynchronously using batch writes.
-func writeBlocks(compress dvid.Compression, checksum dvid.Checksum, blocks Blocks, wg1, wg2 *sync.WaitGroup) error {
+// writeBlocks writes blocks of voxel data asynchronously using batch writes, using a
+// handler from the given pool.
+func writeBlocks(pool *server.HandlerPool, compress dvid.Compression, checksum dvid.Checksum,
+	blocks Blocks, wg1, wg2 *sync.WaitGroup) error {
+
 	db, err := server.OrderedKeyValueSetter()
 	if err != nil {
 		return err
@@ -699,12 +1479,12 @@ func writeBlocks(compress dvid.Compression, checksum dvid.Checksum, blocks Block
 
 	preCompress, postCompress := 0, 0
 
-	<-server.HandlerToken
+	pool.Acquire()
 	go func() {
 		defer func() {
 			dvid.Log(dvid.Debug, "Wrote voxel blocks.  Before %s: %d bytes.  After: %d bytes\n",
 				compress, preCompress, postCompress)
-			server.HandlerToken <- 1
+			pool.Release()
 			wg1.Done()
 			wg2.Done()
 		}()
@@ -781,10 +1561,29 @@ func loadXYImage(i IntHandler, filename string, offset dvid.Point) (ExtHandler,
 
 // LoadImages bulk loads images using different techniques if it is a multidimensional
 // file like HDF5 or a sequence of PNG/JPG/TIF images.
-func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []string) error {
+func LoadImages(ctx context.Context, i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []string,
+	settings dvid.Config) error {
+
 	if len(filenames) == 0 {
 		return nil
 	}
+	checksums, _, err := settings.GetString("checksums")
+	if err != nil {
+		return err
+	}
+	if checksums != "" {
+		if err := dvid.VerifyFiles(checksums, filenames); err != nil {
+			return err
+		}
+	}
+
+	// HDF5 volumes are stored in slabs through PutVoxels, which handles its own locking.
+	if dvid.Filename(filenames[0]).HasExtensionPrefix("hdf", "h5") {
+		return loadHDF(ctx, i, uuid, offset, filenames, settings)
+	}
+	if isNiftiFile(filenames[0]) {
+		return loadNifti(ctx, i, uuid, offset, filenames)
+	}
 	startTime := time.Now()
 
 	service := server.DatastoreService()
@@ -797,12 +1596,19 @@ func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []str
 	// chunk PUTs that could potentially overwrite slice modifications.
 	versionMutex := i.VersionMutex(versionID)
 	versionMutex.Lock()
+	if err := checkWrite(i, uuid); err != nil {
+		versionMutex.Unlock()
+		return err
+	}
 
 	// Handle cleanup given multiple goroutines still writing data.
-	load := &bulkLoadInfo{filenames: filenames, versionID: versionID, offset: offset}
+	load := &bulkLoadInfo{filenames: filenames, uuid: uuid, versionID: versionID, offset: offset}
 	defer func() {
 		versionMutex.Unlock()
 
+		if load.minPt != nil {
+			notifyWrite(uuid, i, load.minPt, load.maxPt)
+		}
 		if load.extentChanged.Value() {
 			err := service.SaveDataset(uuid)
 			if err != nil {
@@ -811,25 +1617,30 @@ func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []str
 		}
 	}()
 
-	// Use different loading techniques if we have a potentially multidimensional HDF5 file
-	// or many 2d images.
-	if dvid.Filename(filenames[0]).HasExtensionPrefix("hdf", "h5") {
-		loadHDF(i, load)
-	} else {
-		loadXYImages(i, load)
-	}
+	loadXYImages(i, load)
 
 	dvid.ElapsedTime(dvid.Debug, startTime, "RPC load of %d files completed", len(filenames))
 	return nil
 }
 
-// Loads blocks with old data if they exist.
-func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.VersionLocalID) error {
-	db, err := server.OrderedKeyValueGetter()
-	if err != nil {
-		return err
-	}
+// getVisibleRange returns the blocks between two indices that are visible at a version,
+// i.e., written at the version or else at its nearest ancestor.  The returned keys are at
+// the version, so modified blocks are written to the version and not its ancestors.
+func getVisibleRange(ctx context.Context, uuid dvid.UUID, dataID datastore.DataID,
+	versionID dvid.VersionLocalID, indexBeg, indexEnd dvid.Index) ([]storage.KeyValue, error) {
+
+	var keyvalues []storage.KeyValue
+	err := server.DatastoreService().ProcessVisible(ctx, uuid, dataID.ID, indexBeg, indexEnd,
+		func(kv *storage.KeyValue) {
+			key := *(kv.K.(*datastore.DataKey))
+			key.Version = versionID
+			keyvalues = append(keyvalues, storage.KeyValue{&key, kv.V})
+		})
+	return keyvalues, err
+}
 
+// Loads blocks with old data, visible at the version, if they exist.
+func loadOldBlocks(uuid dvid.UUID, i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.VersionLocalID) error {
 	// Create a map of old blocks indexed by the index
 	oldBlocks := map[string]([]byte){}
 
@@ -844,9 +1655,7 @@ func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Ver
 		}
 
 		// Get previous data.
-		keyBeg := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg}
-		keyEnd := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd}
-		keyvalues, err := db.GetRange(keyBeg, keyEnd)
+		keyvalues, err := getVisibleRange(context.Background(), uuid, dataID, versionID, indexBeg, indexEnd)
 		if err != nil {
 			return err
 		}
@@ -864,14 +1673,8 @@ func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Ver
 			}
 		}
 
-		ptBeg := indexBeg.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := indexEnd.Duplicate().(dvid.ChunkIndexer)
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-		c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-		for x := begX; x <= endX; x++ {
-			c[0] = x
-			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+		for _, index := range spanIndices(e, it, indexBeg, indexEnd) {
+			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, index}
 			blocks[blockNum].K = key
 			block, ok := oldBlocks[key.Index.String()]
 			if ok {
@@ -897,6 +1700,7 @@ func writeXYImage(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Vers
 	// Iterate through index space for this data using ZYX ordering.
 	dataID := i.DataID()
 	blockSize := i.BlockSize()
+	pool := server.HandlerPoolFor(i.DatatypeName())
 	var startingBlock int32
 
 	for it, err := e.IndexIterator(blockSize); err == nil && it.Valid(); it.NextSpan() {
@@ -905,36 +1709,30 @@ func writeXYImage(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Vers
 			return extentChanged, err
 		}
 
-		ptBeg := indexBeg.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := indexEnd.Duplicate().(dvid.ChunkIndexer)
+		indices := spanIndices(e, it, indexBeg, indexEnd)
 
 		// Track point extents
-		if i.Extents().AdjustIndices(ptBeg, ptEnd) {
+		if adjustSpanExtents(i.Extents(), indices) {
 			extentChanged = true
 		}
 
 		// Do image -> block transfers in concurrent goroutines.
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-
-		<-server.HandlerToken
+		pool.Acquire()
 		wg.Add(1)
 		go func(blockNum int32) {
-			c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-			for x := begX; x <= endX; x++ {
-				c[0] = x
-				key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+			for _, index := range indices {
+				key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, index}
 				blocks[blockNum].K = key
 
 				// Write this slice data into the block.
 				WriteToBlock(e, &(blocks[blockNum]), blockSize)
 				blockNum++
 			}
-			server.HandlerToken <- 1
+			pool.Release()
 			wg.Done()
 		}(startingBlock)
 
-		startingBlock += (endX - begX + 1)
+		startingBlock += int32(len(indices))
 	}
 	return
 }
@@ -1117,12 +1915,15 @@ type Voxels struct {
 	stride int32
 
 	byteOrder binary.ByteOrder
+
+	// The spatial indexing used to map blocks into keys.
+	indexing dvid.IndexScheme
 }
 
 func NewVoxels(geom dvid.Geometry, values dvid.DataValues, data []byte, stride int32,
 	byteOrder binary.ByteOrder) *Voxels {
 
-	return &Voxels{geom, values, data, stride, byteOrder}
+	return &Voxels{geom, values, data, stride, byteOrder, dvid.ZYXIndexing}
 }
 
 func (v *Voxels) String() string {
@@ -1174,6 +1975,10 @@ func (v *Voxels) SetData(data []byte) {
 	v.data = data
 }
 
+func (v *Voxels) SetIndexing(indexing dvid.IndexScheme) {
+	v.indexing = indexing
+}
+
 // -------  ExtHandler interface implementation -------------
 
 func (v *Voxels) Interpolable() bool {
@@ -1221,7 +2026,10 @@ func (v *Voxels) DownRes(magnification dvid.Point) error {
 }
 
 func (v *Voxels) Index(c dvid.ChunkPoint) dvid.Index {
-	return dvid.IndexZYX(c.(dvid.ChunkPoint3d))
+	if nd, ok := c.(dvid.ChunkPointNd); ok {
+		return dvid.IndexNd(nd)
+	}
+	return v.indexing.Index(c.(dvid.ChunkPoint3d))
 }
 
 // IndexIterator returns an iterator that can move across the voxel geometry,
@@ -1236,10 +2044,22 @@ func (v *Voxels) IndexIterator(chunkSize dvid.Point) (dvid.IndexIterator, error)
 	if !ok {
 		return nil, fmt.Errorf("ExtHandler EndPoint() cannot handle Chunkable points.")
 	}
-	begBlock := begVoxel.Chunk(chunkSize).(dvid.ChunkPoint3d)
-	endBlock := endVoxel.Chunk(chunkSize).(dvid.ChunkPoint3d)
-
-	return dvid.NewIndexZYXIterator(begBlock, endBlock), nil
+	switch begBlock := begVoxel.Chunk(chunkSize).(type) {
+	case dvid.ChunkPoint3d:
+		endBlock := endVoxel.Chunk(chunkSize).(dvid.ChunkPoint3d)
+		return v.indexing.NewIterator(begBlock, endBlock), nil
+	case dvid.ChunkPointNd:
+		if v.indexing != dvid.ZYXIndexing {
+			return nil, fmt.Errorf("%s indexing is only available for 3d data", v.indexing)
+		}
+		endBlock, ok := endVoxel.Chunk(chunkSize).(dvid.ChunkPointNd)
+		if !ok {
+			return nil, fmt.Errorf("ExtHandler start and end points differ in dimensionality")
+		}
+		return dvid.NewIndexNdIterator(begBlock, endBlock)
+	default:
+		return nil, fmt.Errorf("Voxels cannot iterate over %d-d chunks", begBlock.NumDims())
+	}
 }
 
 // GetImage2d returns a 2d image suitable for use external to DVID.
@@ -1315,6 +2135,37 @@ func (v *Voxels) GetImage2d() (*dvid.Image, error) {
 	return ret, nil
 }
 
+// GetImageStack returns one XY image for each Z of the 3d voxels held by the ExtHandler,
+// e.g., for use as the pages of a multi-page TIFF.
+func GetImageStack(e ExtHandler) ([]*dvid.Image, error) {
+	size := e.Size()
+	if size.NumDims() != 3 {
+		return nil, fmt.Errorf("Image stacks require 3d voxels, not %d-d", size.NumDims())
+	}
+	start := e.StartPoint()
+	nx, ny, nz := size.Value(0), size.Value(1), size.Value(2)
+	bytesPerVoxel := e.Values().BytesPerElement()
+	sliceBytes := nx * ny * bytesPerVoxel
+	data := e.Data()
+	if int(sliceBytes*nz) > len(data) {
+		return nil, fmt.Errorf("Voxels %s has insufficient amount of data to return images.", e)
+	}
+	stack := make([]*dvid.Image, nz)
+	for z := int32(0); z < nz; z++ {
+		offset := dvid.Point3d{start.Value(0), start.Value(1), start.Value(2) + z}
+		slice, err := dvid.NewOrthogSlice(dvid.XY, offset, dvid.Point2d{nx, ny})
+		if err != nil {
+			return nil, err
+		}
+		v := NewVoxels(slice, e.Values(), data[z*sliceBytes:(z+1)*sliceBytes], nx*bytesPerVoxel,
+			e.ByteOrder())
+		if stack[z], err = v.GetImage2d(); err != nil {
+			return nil, err
+		}
+	}
+	return stack, nil
+}
+
 // Datatype embeds the datastore's Datatype to create a unique type
 // with voxel functions.  Refinements of general voxel types can be implemented
 // by embedding this type, choosing appropriate # of values and bytes/value,
@@ -1372,7 +2223,7 @@ func (dtype *Datatype) NewDataService(id *datastore.DataID, config dvid.Config)
 }
 
 func (dtype *Datatype) Help() string {
-	return fmt.Sprintf(HelpMessage, DefaultBlockSize)
+	return fmt.Sprintf(HelpMessage, DefaultBlockSize, DefaultImportFetches, DefaultExportUploads)
 }
 
 // Extents holds the extents of a volume in both absolute voxel coordinates
@@ -1451,6 +2302,12 @@ type Properties struct {
 	// The endianness of this loaded data.
 	ByteOrder binary.ByteOrder
 
+	// Indexing is the spatial indexing scheme used to map blocks into keys.
+	Indexing dvid.IndexScheme
+
+	// AxisNames labels each dimension.  If nil, dvid.DefaultAxisNames are used.
+	AxisNames dvid.NdString
+
 	Resolution
 	Extents
 }
@@ -1468,9 +2325,6 @@ type Axis struct {
 	Offset     int32
 }
 
-// TODO -- Allow explicit setting of axes labels.
-var axesName = []string{"X", "Y", "Z", "t", "c"}
-
 // SetDefault sets Voxels properties to default values.
 func (props *Properties) SetDefault(values dvid.DataValues, interpolable bool) error {
 	props.Values = make([]dvid.DataValue, len(values))
@@ -1514,6 +2368,33 @@ func (props *Properties) SetByConfig(config dvid.Config) error {
 			return err
 		}
 	}
+	s, found, err = config.GetString("Indexing")
+	if err != nil {
+		return err
+	}
+	if found {
+		props.Indexing, err = dvid.StringToIndexScheme(s)
+		if err != nil {
+			return err
+		}
+	}
+	s, found, err = config.GetString("AxisNames")
+	if err != nil {
+		return err
+	}
+	if found {
+		names, err := dvid.StringToNdString(s, ",")
+		if err != nil {
+			return err
+		}
+		if len(names) != int(props.BlockSize.NumDims()) {
+			return fmt.Errorf("Got %d axis names for %d-d data", len(names), props.BlockSize.NumDims())
+		}
+		if _, err := dvid.NewAxes(names); err != nil {
+			return err
+		}
+		props.AxisNames = names
+	}
 	s, found, err = config.GetString("VoxelSize")
 	if err != nil {
 		return err
@@ -1538,6 +2419,17 @@ func (props *Properties) SetByConfig(config dvid.Config) error {
 	return nil
 }
 
+// Axes returns the labeled dimensions of this data.
+func (props *Properties) Axes() dvid.Axes {
+	dims := props.BlockSize.NumDims()
+	if len(props.AxisNames) == int(dims) {
+		if axes, err := dvid.NewAxes(props.AxisNames); err == nil {
+			return axes
+		}
+	}
+	return dvid.DefaultAxes(dims)
+}
+
 // NdDataSchema returns the metadata in JSON for this Data
 func (props *Properties) NdDataMetadata() (string, error) {
 	var err error
@@ -1556,11 +2448,12 @@ func (props *Properties) NdDataMetadata() (string, error) {
 		offset = props.MinPoint
 	}
 
+	axes := props.Axes()
 	var metadata Metadata
 	metadata.Axes = []Axis{}
 	for dim := 0; dim < dims; dim++ {
 		metadata.Axes = append(metadata.Axes, Axis{
-			Label:      axesName[dim],
+			Label:      axes[dim].Name,
 			Resolution: props.Resolution.VoxelSize[dim],
 			Units:      props.Resolution.VoxelUnits[dim],
 			Size:       size.Value(uint8(dim)),
@@ -1762,7 +2655,7 @@ func (d *Data) PutLocal(request datastore.Request, reply *datastore.Response) er
 			return err
 		}
 		storage.FileBytesRead <- len(e.Data())
-		err = PutVoxels(uuid, d, e)
+		err = PutVoxels(request.Context(), uuid, d, e)
 		if err != nil {
 			return err
 		}
@@ -1774,8 +2667,32 @@ func (d *Data) PutLocal(request datastore.Request, reply *datastore.Response) er
 	return nil
 }
 
+// queryLimiter is implemented by data with limits on the size of requests.  See
+// datastore.QueryLimits.
+type queryLimiter interface {
+	CheckGeometry(geom dvid.Geometry) error
+}
+
+// CheckLimits returns a *datastore.LimitError if a GET of the voxels in the geometry
+// exceeds the query limits of the data.  Every HTTP endpoint that reads voxels for a
+// client-given geometry calls it before allocating the voxels.
+func CheckLimits(i IntHandler, geom dvid.Geometry) error {
+	if limiter, ok := i.(queryLimiter); ok {
+		return limiter.CheckGeometry(geom)
+	}
+	return nil
+}
+
 // ----- IntHandler interface implementation ----------
 
+// AdmitRequest reserves the estimated memory of a request for voxels in the geometry,
+// waiting if the server's memory budget is in use.  The returned function releases the
+// reservation.  See server.AdmitMemory.
+func (d *Data) AdmitRequest(ctx context.Context, geom dvid.Geometry) (release func(), err error) {
+	bytes := geom.NumVoxels() * int64(d.Properties.Values.BytesPerElement()) * RequestMemoryFactor
+	return server.AdmitMemory(ctx, bytes)
+}
+
 // NewExtHandler returns an ExtHandler given some geometry and optional image data.
 // If img is passed in, the function will initialize the ExtHandler with data from the image.
 // Otherwise, it will allocate a zero buffer of appropriate size.
@@ -1788,6 +2705,7 @@ func (d *Data) NewExtHandler(geom dvid.Geometry, img interface{}) (ExtHandler, e
 		values:    d.Properties.Values,
 		stride:    stride,
 		byteOrder: d.ByteOrder,
+		indexing:  d.Indexing,
 	}
 
 	if img == nil {
@@ -1799,7 +2717,7 @@ func (d *Data) NewExtHandler(geom dvid.Geometry, img interface{}) (ExtHandler, e
 			return nil, fmt.Errorf("Requested # voxels (%d) exceeds this DVID server's set limit (%d)",
 				geom.NumVoxels(), MaxVoxelsRequest)
 		}
-		voxels.data = make([]uint8, int64(bytesPerVoxel)*geom.NumVoxels())
+		voxels.data = dvid.GetZeroedBuffer(int(int64(bytesPerVoxel) * geom.NumVoxels()))
 	} else {
 		switch t := img.(type) {
 		case image.Image:
@@ -1844,6 +2762,15 @@ func (d *Data) Extents() *Extents {
 	return &(d.Properties.Extents)
 }
 
+// VoxelExtents returns the minimum and maximum voxel coordinates of stored data,
+// which are nil if no data has been stored.
+func (d *Data) VoxelExtents() (minPt, maxPt dvid.Point) {
+	ext := d.Extents()
+	ext.pointMu.Lock()
+	defer ext.pointMu.Unlock()
+	return ext.MinPoint, ext.MaxPoint
+}
+
 func (d *Data) String() string {
 	return string(d.DataName())
 }
@@ -1864,7 +2791,34 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 	if err := props.SetByConfig(config); err != nil {
 		return err
 	}
-	return nil
+	if err := d.SetTTL(config); err != nil {
+		return err
+	}
+	return d.SetLimits(config)
+}
+
+// exportCommand handles the "export <format> <target>" RPC command.
+func (d *Data) exportCommand(request datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataName, cmdStr, formatStr, target string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &formatStr, &target)
+	if target == "" {
+		return fmt.Errorf("Export requires a target.  See command-line help.")
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(formatStr) {
+	case "n5", "zarr", "precomputed":
+		return d.exportChunkedCommand(request, uuid, strings.ToLower(formatStr), target)
+	case "nifti", "nii":
+		return d.exportNiftiCommand(request, uuid, target)
+	case "slices":
+		return d.exportSlicesCommand(request, reply, uuid, target)
+	default:
+		return fmt.Errorf("Unsupported export format '%s'.  Use 'n5', 'zarr', 'precomputed', 'nifti', or 'slices'.",
+			formatStr)
+	}
 }
 
 // DoRPC acts as a switchboard for RPC commands.
@@ -1907,7 +2861,23 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 			return err
 		}
 
-		return LoadImages(d, uuid, offset, filenames)
+		return LoadImages(request.Context(), d, uuid, offset, filenames, request.Settings())
+
+	case "loadsections":
+		var uuidStr, dataName, cmdStr, manifest string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &manifest)
+		if manifest == "" {
+			return fmt.Errorf("Poorly formatted loadsections command.  See command-line help.")
+		}
+		uuid, err := server.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		checksums, _ := request.Setting("checksums")
+		return LoadSectionManifest(request.Context(), d, uuid, manifest, checksums)
+
+	case "watch", "unwatch":
+		return watchCommand(request, reply, d)
 
 	case "put":
 		if len(request.Command) < 7 {
@@ -1923,6 +2893,24 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 			return d.UnknownCommand(request)
 		}
 
+	case "export":
+		if len(request.Command) < 6 {
+			return fmt.Errorf("Poorly formatted export command.  See command-line help.")
+		}
+		return d.exportCommand(request, reply)
+
+	case "import":
+		return d.ImportCommand(request, reply, d)
+
+	case "components":
+		return d.componentsCommand(request, reply)
+	case "morph":
+		return d.morphCommand(request, reply)
+	case "roi":
+		return d.roiCommand(request, reply)
+	case "copyregion":
+		return CopyRegionCommand(request, reply, d)
+
 	default:
 		return d.UnknownCommand(request)
 	}
@@ -1943,6 +2931,22 @@ func debugData(img image.Image, message string) {
 	}
 }
 
+// ReadOnlyPost returns true for the POSTed existence checks, which only read.
+func (d *Data) ReadOnlyPost(endpoint string) bool {
+	return endpoint == "exists"
+}
+
+// ReadOnlyCommand returns true for exports and watch statuses, which only read.
+func (d *Data) ReadOnlyCommand(request datastore.Request) bool {
+	switch request.TypeCommand() {
+	case "export":
+		return true
+	case "watch":
+		return len(request.Command) > 4 && request.Command[4] == "status"
+	}
+	return false
+}
+
 // DoHTTP handles all incoming HTTP requests for this data.
 func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
@@ -1956,10 +2960,10 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 	switch action {
 	case "get":
 		op = GetOp
-	case "post":
+	case "post", "put":
 		op = PutOp
 	default:
-		return fmt.Errorf("Can only handle GET or POST HTTP verbs")
+		return fmt.Errorf("Can only handle GET, POST, or PUT HTTP verbs")
 	}
 
 	// Break URL request into arguments
@@ -2005,7 +3009,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		fmt.Fprintln(w, jsonStr)
 		return nil
 	case "info":
-		jsonStr, err := d.JSONString()
+		jsonStr, err := d.InfoJSON(uuid, d)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -2013,6 +3017,62 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "exists":
+		err := ServeExists(w, r, uuid, d, &(d.Properties))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: exists (%s)", r.Method, r.URL)
+	case "missing":
+		err := ServeMissing(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: missing blocks (%s)", r.Method, r.URL)
+	case "zarr":
+		err := ServeZarr(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: zarr (%s)", r.Method, r.URL)
+	case "precomputed":
+		err := ServePrecomputed(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: precomputed (%s)", r.Method, r.URL)
+	case "isosurface":
+		err := ServeIsosurface(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: isosurface (%s)", r.Method, r.URL)
+	case "affine":
+		err := ServeAffine(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: affine cutout (%s)", r.Method, r.URL)
+	case "overlay":
+		err := ServeOverlay(w, r, uuid, d, &(d.Properties), parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: overlay (%s)", r.Method, r.URL)
+	case "slices":
+		err := ServeSlices(w, r, uuid, d, parts)
+		if err != nil {
+			server.RequestError(w, r, err)
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: slices (%s)", r.Method, r.URL)
 	case "raw", "isotropic":
 		if len(parts) < 7 {
 			return fmt.Errorf("'%s' must be followed by shape/size/offset", parts[3])
@@ -2024,12 +3084,50 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		if err != nil {
 			return err
 		}
+		var orient *Orientation
+		var contrast *Contrast
+		if op == GetOp {
+			if orient, err = ParseOrientation(r.URL.Query(), int(plane.ShapeDimensions())); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if orient != nil && isotropic {
+				err := fmt.Errorf("axes and flip can only be used with 'raw' requests")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if contrast, err = ParseContrast(r.URL.Query()); err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			if contrast != nil && plane.ShapeDimensions() != 2 {
+				err := fmt.Errorf("contrast can only be used with 2d slices")
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		}
 		switch plane.ShapeDimensions() {
 		case 2:
 			slice, err := dvid.NewSliceFromStrings(planeStr, offsetStr, sizeStr, "_")
 			if err != nil {
 				return err
 			}
+			if op == GetOp {
+				if err := d.CheckSlice(slice); err != nil {
+					server.TooLarge(w, r, err.Error())
+					return err
+				}
+			}
+			release, err := d.AdmitRequest(r.Context(), slice)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer release()
+			var formatStr string
+			if len(parts) >= 8 {
+				formatStr = parts[7]
+			}
 			if op == PutOp {
 				if isotropic {
 					err := fmt.Errorf("can only PUT 'raw' not 'isotropic' images")
@@ -2037,17 +3135,59 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					return err
 				}
 				// TODO -- Put in format checks for POSTed image.
-				postedImg, _, err := dvid.ImageFromPOST(r)
+				var posted interface{}
+				decodeStart := time.Now()
+				if isArrayPost(r, formatStr) {
+					posted, err = d.ReadArrayHttp(r, slice, formatStr)
+				} else {
+					posted, _, err = dvid.ImageFromPOST(r)
+				}
+				dvid.AddTiming(r.Context(), dvid.DecodeTime, decodeStart)
+				if err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				e, err := d.NewExtHandler(slice, posted)
+				if err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				err = PutVoxels(r.Context(), uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				e, err := d.NewExtHandler(slice, postedImg)
+			} else if isArrayFormat(formatStr) {
+				if isotropic {
+					err := fmt.Errorf("%q slices are only available via 'raw' requests", formatStr)
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				e, err := d.NewExtHandler(slice, nil)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = PutVoxels(uuid, d, e)
+				defer dvid.PutBuffer(e.Data())
+				if err = getRequestedVoxels(r, uuid, d, e); err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				if orient != nil {
+					if err = orient.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				if contrast != nil {
+					if err = contrast.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				encodeStart := time.Now()
+				err = d.WriteArrayHttp(w, e, formatStr)
+				dvid.AddTiming(r.Context(), dvid.EncodeTime, encodeStart)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2063,7 +3203,24 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				img, err := GetImage(uuid, d, e)
+				defer dvid.PutBuffer(e.Data())
+				if err = getRequestedVoxels(r, uuid, d, e); err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				if orient != nil {
+					if err = orient.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				if contrast != nil {
+					if err = contrast.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				img, err := e.GetImage2d()
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2076,11 +3233,10 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 						return err
 					}
 				}
-				var formatStr string
-				if len(parts) >= 8 {
-					formatStr = parts[7]
-				}
+				formatStr = dvid.NegotiateImageFormat(w, r, formatStr)
+				encodeStart := time.Now()
 				err = dvid.WriteImageHttp(w, img.Get(), formatStr)
+				dvid.AddTiming(r.Context(), dvid.EncodeTime, encodeStart)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2092,19 +3248,47 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			if op == GetOp {
+				if err := d.CheckSubvolume(subvol); err != nil {
+					server.TooLarge(w, r, err.Error())
+					return err
+				}
+			}
+			release, err := d.AdmitRequest(r.Context(), subvol)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+			defer func() {
+				// Asynchronous writes take over the reservation.
+				if release != nil {
+					release()
+				}
+			}()
 			if op == GetOp {
 				e, err := d.NewExtHandler(subvol, nil)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				data, err := GetVolume(uuid, d, e)
-				if err != nil {
+				defer dvid.PutBuffer(e.Data())
+				if err = getRequestedVoxels(r, uuid, d, e); err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				w.Header().Set("Content-type", "application/octet-stream")
-				_, err = w.Write(data)
+				if orient != nil {
+					if err = orient.Apply(e); err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
+				}
+				formatStr := "raw"
+				if len(parts) >= 8 && parts[7] != "" {
+					formatStr = parts[7]
+				}
+				encodeStart := time.Now()
+				err = d.WriteArrayHttp(w, e, formatStr)
+				dvid.AddTiming(r.Context(), dvid.EncodeTime, encodeStart)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2115,7 +3299,13 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				data, err := ioutil.ReadAll(r.Body)
+				var formatStr string
+				if len(parts) >= 8 {
+					formatStr = parts[7]
+				}
+				decodeStart := time.Now()
+				data, err := d.ReadArrayHttp(r, subvol, formatStr)
+				dvid.AddTiming(r.Context(), dvid.DecodeTime, decodeStart)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2125,7 +3315,17 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = PutVoxels(uuid, d, e)
+				if r.URL.Query().Get("async") == "true" {
+					job := PutVoxelsAsync(server.RequestSession(r), uuid, d, e, release)
+					release = nil
+					w.Header().Set("Content-type", "application/json")
+					w.WriteHeader(http.StatusAccepted)
+					fmt.Fprintf(w, `{"Job": %d}`, job.ID)
+					dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: %s accepted as job %d (%s)",
+						r.Method, subvol, job.ID, r.URL)
+					return nil
+				}
+				err = PutVoxels(r.Context(), uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2144,16 +3344,16 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 // ProcessChunk processes a chunk of data as part of a mapped operation.  The data may be
 // thinner, wider, and longer than the chunk, depending on the data shape (XY, XZ, etc).
 // Only some multiple of the # of CPU cores can be used for chunk handling before
-// it waits for chunk processing to abate via the buffered server.HandlerToken channel.
+// it waits for chunk processing to abate via the datatype's server.HandlerPool.
 func (d *Data) ProcessChunk(chunk *storage.Chunk) {
-	<-server.HandlerToken
+	server.HandlerPoolFor(d.DatatypeName()).Acquire()
 	go d.processChunk(chunk)
 }
 
 func (d *Data) processChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+		// After processing a chunk, release the handler.
+		server.HandlerPoolFor(d.DatatypeName()).Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
@@ -2161,24 +3361,57 @@ func (d *Data) processChunk(chunk *storage.Chunk) {
 		}
 	}()
 
+	if _, ok := chunk.Op.(*Operation); !ok {
+		log.Fatalf("Illegal operation passed to ProcessChunk() for data %s\n", d.DataName())
+	}
+	if err := d.ApplyChunk(chunk); err != nil {
+		dvid.Log(dvid.Normal, "%s\n", err.Error())
+	}
+}
+
+// ApplyChunk performs the operation of a chunk in the calling goroutine, returning any
+// error, including a failed write of the block.  Unlike ProcessChunk, it neither uses a
+// handler nor notifies the requestor.
+func (d *Data) ApplyChunk(chunk *storage.Chunk) error {
 	op, ok := chunk.Op.(*Operation)
 	if !ok {
-		log.Fatalf("Illegal operation passed to ProcessChunk() for data %s\n", d.DataName())
+		return fmt.Errorf("Illegal operation passed to ApplyChunk() for data %s", d.DataName())
+	}
+
+	// Skip the work for GETs that have been canceled.
+	if op.OpType == GetOp && chunk.Err() != nil {
+		return nil
+	}
+	var ctx context.Context
+	if chunk.ChunkOp != nil {
+		ctx = chunk.Ctx
 	}
 
 	// Initialize the block buffer using the chunk of data.  For voxels, this chunk of
 	// data needs to be uncompressed and deserialized.
+	// Block buffers come from dvid's buffer pools and are returned when the operation
+	// is done, since both GETs and PUTs finish with the block within this function.
+	// Uncompressed blocks are used in place from the stored value.
 	var err error
 	var blockData []byte
+	blockBytes := int(d.BlockSize().Prod() * int64(op.Values().BytesPerElement()))
 	if chunk == nil || chunk.V == nil {
-		blockData = make([]byte, d.BlockSize().Prod()*int64(op.Values().BytesPerElement()))
+		blockData = dvid.GetZeroedBuffer(blockBytes)
+		defer dvid.PutBuffer(blockData)
 	} else {
-		blockData, _, err = dvid.DeserializeData(chunk.V, true)
+		buf := dvid.GetBuffer(blockBytes)
+		var compression dvid.CompressionFormat
+		decodeStart := time.Now()
+		blockData, compression, err = dvid.DeserializeDataTo(chunk.V, buf)
+		dvid.AddTiming(ctx, dvid.DecodeTime, decodeStart)
 		if err != nil {
-			dvid.Log(dvid.Normal, "Unable to deserialize block in '%s': %s\n",
-				d.DataID().DataName(), err.Error())
-			return
+			dvid.PutBuffer(buf)
+			return fmt.Errorf("Unable to deserialize block in '%s': %s", d.DataID().DataName(), err.Error())
+		}
+		if compression != dvid.Uncompressed {
+			buf = blockData
 		}
+		defer dvid.PutBuffer(buf)
 	}
 
 	// Perform the operation.
@@ -2186,30 +3419,31 @@ func (d *Data) processChunk(chunk *storage.Chunk) {
 	switch op.OpType {
 	case GetOp:
 		if err = ReadFromBlock(op.ExtHandler, block, d.BlockSize()); err != nil {
-			dvid.Log(dvid.Normal, "Unable to ReadFromBlock() in '%s': %s\n",
-				d.DataID().DataName(), err.Error())
-			return
+			return fmt.Errorf("Unable to ReadFromBlock() in '%s': %s", d.DataID().DataName(), err.Error())
 		}
 	case PutOp:
 		if err = WriteToBlock(op.ExtHandler, block, d.BlockSize()); err != nil {
-			dvid.Log(dvid.Normal, "Unable to WriteToBlock() in '%s': %s\n",
-				d.DataID().DataName(), err.Error())
-			return
+			return fmt.Errorf("Unable to WriteToBlock() in '%s': %s", d.DataID().DataName(), err.Error())
 		}
 		db, err := server.OrderedKeyValueSetter()
 		if err != nil {
-			dvid.Log(dvid.Normal, "Database doesn't support OrderedKeyValueSetter in '%s': %s\n",
+			return fmt.Errorf("Database doesn't support OrderedKeyValueSetter in '%s': %s",
 				d.DataID().DataName(), err.Error())
-			return
 		}
+		encodeStart := time.Now()
 		serialization, err := dvid.SerializeData(blockData, d.UseCompression(), d.UseChecksum())
+		dvid.AddTiming(ctx, dvid.EncodeTime, encodeStart)
 		if err != nil {
-			dvid.Log(dvid.Normal, "Unable to serialize block in '%s': %s\n",
-				d.DataID().DataName(), err.Error())
-			return
+			return fmt.Errorf("Unable to serialize block in '%s': %s", d.DataID().DataName(), err.Error())
+		}
+		writeStart := time.Now()
+		err = db.Put(chunk.K, serialization)
+		dvid.AddTiming(ctx, dvid.StorageTime, writeStart)
+		if err != nil {
+			return fmt.Errorf("Unable to write block in '%s': %s", d.DataID().DataName(), err.Error())
 		}
-		db.Put(chunk.K, serialization)
 	}
+	return nil
 }
 
 // Handler conversion of little to big endian for voxels larger than 1 byte.
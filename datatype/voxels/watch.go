@@ -0,0 +1,383 @@
+/*
+	This file supports watching a directory visible to the server and ingesting 2d section
+	images as a microscope deposits them during acquisition.  A file's z is given by the
+	last number in its name, e.g., "section_00123.png" is z 123, and files are ingested
+	once they stop changing.  Files with the same contents and z as one already ingested
+	are skipped as duplicates, and files that fail to load are retried a few times.
+*/
+
+package voxels
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// DefaultWatchInterval is how often watched directories are checked for new files.
+	DefaultWatchInterval = 5 * time.Second
+
+	// maxWatchErrors is the number of recent errors kept in a watch's status.
+	maxWatchErrors = 10
+
+	// maxIngestAttempts is the number of times a file is loaded before it's given up on.
+	maxIngestAttempts = 3
+)
+
+// watchedExts are the extensions of image files ingested from watched directories.
+var watchedExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true, ".bmp": true,
+}
+
+// sectionNumber matches the last number in a filename without its extension.
+var sectionNumber = regexp.MustCompile(`(\d+)\D*$`)
+
+// WatchStatus describes a directory watched for new section images.
+type WatchStatus struct {
+	Dir        string
+	UUID       dvid.UUID
+	Data       dvid.DataString
+	Started    time.Time
+	Ingested   int
+	Duplicates int
+	LastFile   string   `json:",omitempty"`
+	Errors     []string `json:",omitempty"`
+}
+
+// fileState identifies a version of a file so changed files can be told apart.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// sectionContents identifies the contents of a section image at a z, so identical
+// sections, e.g., blank ones, at different z aren't treated as duplicates.
+type sectionContents struct {
+	checksum [sha256.Size]byte
+	z        int32
+}
+
+// watcher polls a directory and ingests new section images into data.
+type watcher struct {
+	sync.Mutex
+	status   WatchStatus
+	cancel   context.CancelFunc
+	pattern  string
+	offset   dvid.Point2d
+	zOffset  int32
+	seen     map[string]fileState
+	pending  map[string]fileState
+	failures map[string]int
+	contents map[sectionContents]string
+}
+
+var watchers struct {
+	sync.Mutex
+	byKey map[string]*watcher
+}
+
+func watchKey(uuid dvid.UUID, name dvid.DataString, dir string) string {
+	return fmt.Sprintf("%s/%s/%s", uuid, name, dir)
+}
+
+// SectionZ returns the z of a section image given by the last number in its filename.
+func SectionZ(filename string) (int32, error) {
+	base := filepath.Base(filename)
+	match := sectionNumber.FindStringSubmatch(strings.TrimSuffix(base, filepath.Ext(base)))
+	if match == nil {
+		return 0, fmt.Errorf("No section number in filename %q", base)
+	}
+	z, err := strconv.ParseInt(match[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Bad section number in filename %q", base)
+	}
+	return int32(z), nil
+}
+
+// WatchDirectory starts ingesting section images that appear in a directory into the
+// data at a version until StopWatching is called or the context is done.  Only files
+// matching the glob pattern are ingested, with z shifted by zOffset and translated by
+// offset.
+func WatchDirectory(ctx context.Context, i IntHandler, uuid dvid.UUID, dir, pattern string,
+	offset dvid.Point2d, zOffset int32, interval time.Duration) error {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("Can't watch %q.  Is the directory visible to the server process?", dir)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Bad pattern %q: %s", pattern, err.Error())
+	}
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	name := i.DataID().DataName()
+	key := watchKey(uuid, name, dir)
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watcher{
+		status:   WatchStatus{Dir: dir, UUID: uuid, Data: name, Started: time.Now()},
+		cancel:   cancel,
+		pattern:  pattern,
+		offset:   offset,
+		zOffset:  zOffset,
+		seen:     make(map[string]fileState),
+		pending:  make(map[string]fileState),
+		failures: make(map[string]int),
+		contents: make(map[sectionContents]string),
+	}
+	watchers.Lock()
+	if watchers.byKey == nil {
+		watchers.byKey = make(map[string]*watcher)
+	}
+	if _, found := watchers.byKey[key]; found {
+		watchers.Unlock()
+		cancel()
+		return fmt.Errorf("Directory %q is already watched for data %q at %s", dir, name, uuid)
+	}
+	watchers.byKey[key] = w
+	watchers.Unlock()
+
+	go func() {
+		defer func() {
+			watchers.Lock()
+			if watchers.byKey[key] == w {
+				delete(watchers.byKey, key)
+			}
+			watchers.Unlock()
+		}()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			w.poll(ctx, i)
+			select {
+			case <-ctx.Done():
+				dvid.Log(dvid.Normal, "Stopped watching %s for data %q\n", dir, name)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	dvid.Log(dvid.Normal, "Watching %s for sections of data %q at %s\n", dir, name, uuid)
+	return nil
+}
+
+// StopWatching stops ingesting files from a watched directory.
+func StopWatching(uuid dvid.UUID, name dvid.DataString, dir string) error {
+	watchers.Lock()
+	w, found := watchers.byKey[watchKey(uuid, name, dir)]
+	watchers.Unlock()
+	if !found {
+		return fmt.Errorf("Directory %q isn't watched for data %q at %s", dir, name, uuid)
+	}
+	w.cancel()
+	return nil
+}
+
+// WatchStatuses returns the status of directories watched for the data, sorted by
+// directory.
+func WatchStatuses(name dvid.DataString) []WatchStatus {
+	watchers.Lock()
+	defer watchers.Unlock()
+	var statuses []WatchStatus
+	for _, w := range watchers.byKey {
+		w.Lock()
+		if w.status.Data == name {
+			status := w.status
+			status.Errors = append([]string(nil), w.status.Errors...)
+			statuses = append(statuses, status)
+		}
+		w.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Dir < statuses[j].Dir })
+	return statuses
+}
+
+// poll ingests files that haven't changed since the last poll.  New files are ingested
+// in name order, and files that fail are retried once they're unchanged for another poll.
+func (w *watcher) poll(ctx context.Context, i IntHandler) {
+	entries, err := ioutil.ReadDir(w.status.Dir)
+	if err != nil {
+		w.addError(err)
+		return
+	}
+	var ready []string
+	w.Lock()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !watchedExts[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		if matched, _ := filepath.Match(w.pattern, name); !matched {
+			continue
+		}
+		state := fileState{entry.Size(), entry.ModTime()}
+		if w.seen[name] == state {
+			continue
+		}
+		if w.pending[name] != state {
+			w.pending[name] = state
+			continue
+		}
+		delete(w.pending, name)
+		w.seen[name] = state
+		ready = append(ready, name)
+	}
+	w.Unlock()
+
+	sort.Strings(ready)
+	for _, name := range ready {
+		if ctx.Err() != nil {
+			return
+		}
+		err := w.ingest(ctx, i, filepath.Join(w.status.Dir, name))
+		if err == nil {
+			w.Lock()
+			delete(w.failures, name)
+			w.Unlock()
+			continue
+		}
+		w.addError(err)
+		w.Lock()
+		w.failures[name]++
+		if w.failures[name] < maxIngestAttempts {
+			delete(w.seen, name)
+		}
+		w.Unlock()
+	}
+}
+
+// ingest loads a section image unless its contents were already ingested at the same z.
+// The watch is stopped if the version can no longer be written, e.g., after publication.
+func (w *watcher) ingest(ctx context.Context, i IntHandler, filename string) error {
+	if err := server.DatastoreService().WritesBlocked(w.status.UUID); err != nil {
+		w.cancel()
+		return err
+	}
+	z, err := SectionZ(filename)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	contents := sectionContents{sha256.Sum256(data), z + w.zOffset}
+	w.Lock()
+	original, duplicate := w.contents[contents]
+	if duplicate {
+		w.status.Duplicates++
+	}
+	w.Unlock()
+	if duplicate {
+		dvid.Log(dvid.Debug, "Skipped %s with same contents as %s\n", filename, original)
+		return nil
+	}
+	section := Section{Filename: filename, Z: contents.z, Offset: w.offset}
+	if err := LoadSections(ctx, i, w.status.UUID, []Section{section}); err != nil {
+		return fmt.Errorf("%s: %s", filepath.Base(filename), err.Error())
+	}
+	w.Lock()
+	w.contents[contents] = filename
+	w.status.Ingested++
+	w.status.LastFile = filepath.Base(filename)
+	w.Unlock()
+	return nil
+}
+
+// addError records an error in the watch's status, keeping the most recent.
+func (w *watcher) addError(err error) {
+	dvid.Error("Watch of %s for data %q: %s\n", w.status.Dir, w.status.Data, err.Error())
+	w.Lock()
+	w.status.Errors = append(w.status.Errors, fmt.Sprintf("%s: %s", time.Now().Format(time.RFC3339), err))
+	if len(w.status.Errors) > maxWatchErrors {
+		w.status.Errors = w.status.Errors[len(w.status.Errors)-maxWatchErrors:]
+	}
+	w.Unlock()
+}
+
+// watchCommand handles the "watch" and "unwatch" commands.
+func watchCommand(request datastore.Request, reply *datastore.Response, i IntHandler) error {
+	var uuidStr, dataName, cmdStr, dir string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &dir)
+	if dir == "" {
+		return fmt.Errorf("Poorly formatted %s command.  See command-line help.", cmdStr)
+	}
+	if cmdStr == "watch" && dir == "status" {
+		m, err := json.MarshalIndent(WatchStatuses(i.DataID().DataName()), "", "  ")
+		if err != nil {
+			return err
+		}
+		reply.Text = string(m) + "\n"
+		return nil
+	}
+	uuid, err := server.MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if cmdStr == "unwatch" {
+		if err := StopWatching(uuid, i.DataID().DataName(), dir); err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Stopped watching %s\n", dir)
+		return nil
+	}
+
+	config := request.Settings()
+	pattern, found, err := config.GetString("pattern")
+	if err != nil {
+		return err
+	}
+	if !found {
+		pattern = "*"
+	}
+	var offset dvid.Point2d
+	if offsetStr, found, err := config.GetString("offset"); err != nil {
+		return err
+	} else if found {
+		pt, err := dvid.StringToPoint(offsetStr, ",")
+		if err != nil || pt.NumDims() != 2 {
+			return fmt.Errorf("Bad offset %q: expected x,y", offsetStr)
+		}
+		offset = dvid.Point2d{pt.Value(0), pt.Value(1)}
+	}
+	var zOffset int32
+	if zStr, found, err := config.GetString("zoffset"); err != nil {
+		return err
+	} else if found {
+		z, err := strconv.ParseInt(zStr, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Bad zoffset %q", zStr)
+		}
+		zOffset = int32(z)
+	}
+	interval := DefaultWatchInterval
+	if intervalStr, found, err := config.GetString("interval"); err != nil {
+		return err
+	} else if found {
+		if interval, err = time.ParseDuration(intervalStr); err != nil || interval <= 0 {
+			return fmt.Errorf("Bad interval %q", intervalStr)
+		}
+	}
+	if err := WatchDirectory(request.Context(), i, uuid, dir, pattern, offset, zOffset, interval); err != nil {
+		return err
+	}
+	reply.Text = fmt.Sprintf("Watching %s for sections of data %q.  Use \"watch status\" to check ingestion.\n",
+		dir, i.DataID().DataName())
+	return nil
+}
@@ -0,0 +1,39 @@
+/*
+	This file lets other packages observe writes of voxel data, e.g., to keep data derived
+	from voxels, like tile pyramids, up to date without regenerating it.
+*/
+
+package voxels
+
+import (
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// WriteObserver is called after voxels of data are written at a version with the
+// voxel bounds of the write.
+type WriteObserver func(uuid dvid.UUID, dataID datastore.DataID, minPt, maxPt dvid.Point)
+
+var writeObservers struct {
+	sync.RWMutex
+	list []WriteObserver
+}
+
+// AddWriteObserver registers a function called after each write of voxel data.  Observers
+// are called synchronously by the writer, so they should queue any lengthy work.
+func AddWriteObserver(observer WriteObserver) {
+	writeObservers.Lock()
+	writeObservers.list = append(writeObservers.list, observer)
+	writeObservers.Unlock()
+}
+
+// notifyWrite calls the write observers for voxels written to data at a version.
+func notifyWrite(uuid dvid.UUID, i IntHandler, minPt, maxPt dvid.Point) {
+	writeObservers.RLock()
+	defer writeObservers.RUnlock()
+	for _, observer := range writeObservers.list {
+		observer(uuid, i.DataID(), minPt, maxPt)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+	This file exposes 3d voxels as a Zarr array over HTTP so Zarr-aware tools like dask and
+	xarray can use DVID as a store.  Both Zarr v2 (.zarray/.zattrs with "." separated chunk
+	keys) and v3 (zarr.json with "c/" prefixed chunk keys) metadata are served, and each
+	Zarr chunk maps onto exactly one DVID block.
+*/
+
+package voxels
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// ZarrArrayV2 is the .zarray metadata for a Zarr v2 array.
+type ZarrArrayV2 struct {
+	ZarrFormat         int           `json:"zarr_format"`
+	Shape              []int32       `json:"shape"`
+	Chunks             []int32       `json:"chunks"`
+	DType              interface{}   `json:"dtype"`
+	Compressor         interface{}   `json:"compressor"`
+	FillValue          interface{}   `json:"fill_value"`
+	Order              string        `json:"order"`
+	Filters            []interface{} `json:"filters"`
+	DimensionSeparator string        `json:"dimension_separator"`
+}
+
+// ZarrArrayV3 is the zarr.json metadata for a Zarr v3 array.
+type ZarrArrayV3 struct {
+	ZarrFormat       int                    `json:"zarr_format"`
+	NodeType         string                 `json:"node_type"`
+	Shape            []int32                `json:"shape"`
+	DataType         string                 `json:"data_type"`
+	ChunkGrid        map[string]interface{} `json:"chunk_grid"`
+	ChunkKeyEncoding map[string]interface{} `json:"chunk_key_encoding"`
+	FillValue        interface{}            `json:"fill_value"`
+	Codecs           []interface{}          `json:"codecs"`
+	Attributes       map[string]interface{} `json:"attributes"`
+	DimensionNames   []string               `json:"dimension_names"`
+}
+
+// zarrLayout gives the block-aligned origin and C-order shape of the Zarr view of 3d data.
+type zarrLayout struct {
+	originBlock dvid.ChunkPoint3d
+	origin      dvid.Point3d
+	blockSize   dvid.Point3d
+	shape       []int32
+	chunks      []int32
+	dimNames    []string
+}
+
+func (props *Properties) zarrLayout() (*zarrLayout, error) {
+	if props.BlockSize.NumDims() != 3 {
+		return nil, fmt.Errorf("Zarr access requires 3d data, not %d-d", props.BlockSize.NumDims())
+	}
+	layout := new(zarrLayout)
+	for dim := uint8(0); dim < 3; dim++ {
+		layout.blockSize[dim] = props.BlockSize.Value(dim)
+	}
+	var end dvid.Point3d
+	if props.MinPoint != nil && props.MaxPoint != nil {
+		for dim := uint8(0); dim < 3; dim++ {
+			layout.originBlock[dim] = floorDiv(props.MinPoint.Value(dim), layout.blockSize[dim])
+			end[dim] = props.MaxPoint.Value(dim) + 1
+		}
+	}
+	for dim := 0; dim < 3; dim++ {
+		layout.origin[dim] = layout.originBlock[dim] * layout.blockSize[dim]
+		if end[dim] < layout.origin[dim] {
+			end[dim] = layout.origin[dim]
+		}
+	}
+	// Zarr uses C order so the slowest varying dimension comes first.
+	axes := props.Axes()
+	for dim := 2; dim >= 0; dim-- {
+		layout.shape = append(layout.shape, end[dim]-layout.origin[dim])
+		layout.chunks = append(layout.chunks, layout.blockSize[dim])
+		layout.dimNames = append(layout.dimNames, strings.ToLower(axes[dim].Name))
+	}
+	if len(props.Values) > 1 {
+		layout.shape = append(layout.shape, int32(len(props.Values)))
+		layout.chunks = append(layout.chunks, int32(len(props.Values)))
+		layout.dimNames = append(layout.dimNames, "c")
+	}
+	return layout, nil
+}
+
+// ZarrAttributes returns the user attributes for the Zarr array, including the DVID
+// voxel coordinate of the array origin.
+func (props *Properties) ZarrAttributes() (map[string]interface{}, error) {
+	layout, err := props.zarrLayout()
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]interface{}{
+		"dvid_offset": layout.origin,
+	}
+	if len(props.VoxelSize) >= 3 {
+		attrs["resolution"] = props.VoxelSize[:3]
+		attrs["units"] = props.VoxelUnits
+	}
+	return attrs, nil
+}
+
+// ZarrArrayV2 returns the .zarray metadata for the data.
+func (props *Properties) ZarrArrayV2() (*ZarrArrayV2, error) {
+	layout, err := props.zarrLayout()
+	if err != nil {
+		return nil, err
+	}
+	var dtype interface{}
+	var fillValue interface{} = 0
+	if dataType, err := props.Values.ValueDataType(); err == nil {
+		if dtype, err = dvid.NpyDescr(dataType, props.ByteOrder); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(props.Values) > 1 {
+			// Structured dtypes replace the trailing channel dimension.
+			layout.shape = layout.shape[:3]
+			layout.chunks = layout.chunks[:3]
+		}
+		var fields [][]string
+		for i, value := range props.Values {
+			descr, err := dvid.NpyDescr(value.T, props.ByteOrder)
+			if err != nil {
+				return nil, err
+			}
+			name := value.Label
+			if name == "" {
+				name = fmt.Sprintf("f%d", i)
+			}
+			fields = append(fields, []string{name, descr})
+		}
+		dtype = fields
+		fillValue = nil
+	}
+	return &ZarrArrayV2{
+		ZarrFormat:         2,
+		Shape:              layout.shape,
+		Chunks:             layout.chunks,
+		DType:              dtype,
+		FillValue:          fillValue,
+		Order:              "C",
+		DimensionSeparator: ".",
+	}, nil
+}
+
+// ZarrArrayV3 returns the zarr.json metadata for the data.
+func (props *Properties) ZarrArrayV3() (*ZarrArrayV3, error) {
+	layout, err := props.zarrLayout()
+	if err != nil {
+		return nil, err
+	}
+	dataType, err := props.Values.ValueDataType()
+	if err != nil {
+		return nil, fmt.Errorf("Zarr v3 requires all voxel values to have the same type: %s", err.Error())
+	}
+	typeName, found := precomputedDataTypes[dataType]
+	if !found {
+		return nil, fmt.Errorf("Data values %v have no Zarr v3 equivalent", props.Values)
+	}
+	endian := "little"
+	if props.ByteOrder == binary.BigEndian {
+		endian = "big"
+	}
+	attrs, err := props.ZarrAttributes()
+	if err != nil {
+		return nil, err
+	}
+	return &ZarrArrayV3{
+		ZarrFormat: 3,
+		NodeType:   "array",
+		Shape:      layout.shape,
+		DataType:   typeName,
+		ChunkGrid: map[string]interface{}{
+			"name":          "regular",
+			"configuration": map[string]interface{}{"chunk_shape": layout.chunks},
+		},
+		ChunkKeyEncoding: map[string]interface{}{
+			"name":          "default",
+			"configuration": map[string]interface{}{"separator": "/"},
+		},
+		FillValue:      0,
+		Codecs:         []interface{}{map[string]interface{}{"name": "bytes", "configuration": map[string]interface{}{"endian": endian}}},
+		Attributes:     attrs,
+		DimensionNames: layout.dimNames,
+	}, nil
+}
+
+// chunkSubvolume returns the DVID subvolume corresponding to a Zarr chunk key,
+// given as C-order chunk coordinates.
+func (layout *zarrLayout) chunkSubvolume(coords []string) (*dvid.Subvolume, error) {
+	if len(coords) == 4 && coords[3] == "0" {
+		coords = coords[:3]
+	}
+	if len(coords) != 3 {
+		return nil, fmt.Errorf("Zarr chunk key must have 3 spatial coordinates, got %v", coords)
+	}
+	var offset dvid.Point3d
+	for i, coord := range coords {
+		n, err := strconv.ParseInt(coord, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Zarr chunk coordinate %q", coord)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("Zarr chunk coordinates must be non-negative, got %d", n)
+		}
+		dim := 2 - i
+		offset[dim] = layout.origin[dim] + int32(n)*layout.blockSize[dim]
+	}
+	return dvid.NewSubvolume(offset, layout.blockSize), nil
+}
+
+// ServeZarr handles Zarr store requests where parts[3] is "zarr":
+//
+//    GET  <api URL>/node/<UUID>/<data name>/zarr/.zarray
+//    GET  <api URL>/node/<UUID>/<data name>/zarr/.zattrs
+//    GET  <api URL>/node/<UUID>/<data name>/zarr/zarr.json
+//    GET  <api URL>/node/<UUID>/<data name>/zarr/<z>.<y>.<x>
+//    GET  <api URL>/node/<UUID>/<data name>/zarr/c/<z>/<y>/<x>
+//    POST <api URL>/node/<UUID>/<data name>/zarr/<chunk key>
+//
+// Chunks are uncompressed and hold exactly one DVID block.
+func ServeZarr(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, i IntHandler,
+	props *Properties, parts []string) error {
+
+	if len(parts) < 5 {
+		return fmt.Errorf("Zarr requests must give a key after 'zarr'")
+	}
+	keys := parts[4:]
+	action := strings.ToLower(r.Method)
+	writeJSON := func(v interface{}) error {
+		if action != "get" {
+			return fmt.Errorf("Zarr metadata for DVID data is read-only")
+		}
+		m, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(m)
+		return err
+	}
+
+	switch keys[0] {
+	case ".zarray":
+		zarray, err := props.ZarrArrayV2()
+		if err != nil {
+			return err
+		}
+		return writeJSON(zarray)
+	case ".zattrs":
+		attrs, err := props.ZarrAttributes()
+		if err != nil {
+			return err
+		}
+		return writeJSON(attrs)
+	case "zarr.json":
+		zarray, err := props.ZarrArrayV3()
+		if err != nil {
+			return err
+		}
+		return writeJSON(zarray)
+	case ".zgroup", ".zmetadata":
+		http.NotFound(w, r)
+		return nil
+	}
+
+	layout, err := props.zarrLayout()
+	if err != nil {
+		return err
+	}
+	var coords []string
+	if keys[0] == "c" {
+		coords = keys[1:]
+	} else {
+		coords = strings.Split(keys[0], ".")
+	}
+	subvol, err := layout.chunkSubvolume(coords)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		if err := CheckLimits(i, subvol); err != nil {
+			return err
+		}
+		e, err := i.NewExtHandler(subvol, nil)
+		if err != nil {
+			return err
+		}
+		if err := getRequestedVoxels(r, uuid, i, e); err != nil {
+			return err
+		}
+		data := e.Data()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(data)
+		return err
+	case "post", "put":
+		// Chunks are read into a buffer of the expected size, so longer bodies are too large.
+		expected := subvol.NumVoxels() * int64(props.Values.BytesPerElement())
+		data := make([]byte, expected)
+		if n, err := io.ReadFull(r.Body, data); err != nil {
+			return fmt.Errorf("Zarr chunk should have %d bytes, got %d", expected, n)
+		}
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			return server.ErrBodyTooLarge
+		}
+		e, err := i.NewExtHandler(subvol, data)
+		if err != nil {
+			return err
+		}
+		return PutVoxels(r.Context(), uuid, i, e)
+	default:
+		return fmt.Errorf("Zarr chunks can only be read with GET or written with POST or PUT")
+	}
+}
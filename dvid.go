@@ -8,12 +8,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -24,11 +26,14 @@ import (
 	"github.com/janelia-flyem/dvid/storage"
 
 	// Declare the data types this DVID executable will support
+	_ "github.com/janelia-flyem/dvid/datatype/annotation"
+	_ "github.com/janelia-flyem/dvid/datatype/composite"
 	_ "github.com/janelia-flyem/dvid/datatype/keyvalue"
 	_ "github.com/janelia-flyem/dvid/datatype/labelmap"
 	_ "github.com/janelia-flyem/dvid/datatype/labels64"
 	_ "github.com/janelia-flyem/dvid/datatype/multichan16"
 	_ "github.com/janelia-flyem/dvid/datatype/multiscale2d"
+	_ "github.com/janelia-flyem/dvid/datatype/roi"
 	_ "github.com/janelia-flyem/dvid/datatype/voxels"
 )
 
@@ -50,6 +55,9 @@ var (
 	// Run in debug mode if true.
 	runDebug = flag.Bool("debug", false, "")
 
+	// Modules, e.g., "storage,server", run in debug mode regardless of the global mode.
+	debugModules = flag.String("debugmodules", "", "")
+
 	// Run in benchmark mode if true.
 	runBenchmark = flag.Bool("benchmark", false, "")
 
@@ -74,8 +82,88 @@ var (
 	// Number of seconds to wait trying to get exclusive access to DVID datastore.
 	timeout = flag.Int("timeout", 0, "")
 
+	// Number of seconds before HTTP API requests are canceled.
+	reqTimeout = flag.Int("reqtimeout", 0, "")
+
+	// Megabytes of memory that concurrent voxel requests may reserve.
+	memBudget = flag.Int("membudget", 0, "")
+
+	// Megabytes a request body may have when read whole or decompressed.
+	maxBody = flag.Int("maxbody", 0, "")
+
+	// Directory for the parts of multi-part uploads.
+	uploadDir = flag.String("uploaddir", "", "")
+
+	// Serve as a read replica of the primary at these addresses.
+	replicaOf    = flag.String("replicaof", "", "")
+	replicaOfRPC = flag.String("replicaofrpc", "", "")
+	rejectWrites = flag.Bool("rejectwrites", false, "")
+	replicaToken = flag.String("replicatoken", "", "")
+
+	// Join the cluster with this coordinator, or coordinate a cluster.
+	clusterOf    = flag.String("cluster", "", "")
+	coordinator  = flag.Bool("coordinator", false, "")
+	clusterToken = flag.String("clustertoken", "", "")
+
+	// JSON file with a federation table of UUID prefixes and remote DVID servers.
+	federation = flag.String("federation", "", "")
+
 	// Accept and send stdin to server for use in commands if true.
 	useStdin = flag.Bool("stdin", false, "")
+
+	// Stream local files named in commands and stdin to the server over parallel connections.
+	useUpload   = flag.Bool("upload", false, "")
+	connections = flag.Int("connections", server.DefaultTransferConnections, "")
+
+	// JSON file configuring authentication by an OpenID Connect provider.
+	oidcConfig = flag.String("oidc", "", "")
+
+	// Directory of Go plugins with additional data types.
+	pluginDir = flag.String("plugins", "", "")
+
+	// Key sent with a command so retries don't repeat its writes.
+	idempotencyKey = flag.String("idempotency", "", "")
+
+	// Record an audit log of writes, keeping entries for a number of days.
+	auditLog       = flag.Bool("audit", false, "")
+	auditRetention = flag.Int("auditretention", 0, "")
+
+	// Days deleted data is kept in the trash before it's purged.
+	trashRetention = flag.Int("trashretention", 7, "")
+
+	// Minutes a scratch node can go unused before it's deleted.
+	scratchIdle = flag.Int("scratchidle", 60, "")
+
+	// Generate thumbnails of datasets at startup and on commits.
+	thumbnails = flag.Bool("thumbnails", false, "")
+
+	// OTLP/HTTP collector receiving request traces.
+	otlpEndpoint = flag.String("otlp", "", "")
+
+	// Requests slower than this many milliseconds are logged with a reproducing command.
+	slowQuery = flag.Int("slowquery", 0, "")
+	slowLog   = flag.String("slowlog", "", "")
+
+	// Web server keep-alive and HTTP/2 settings, and TLS certificate and key files.
+	idleTimeout  = flag.Int("idletimeout", 120, "")
+	http2Streams = flag.Int("http2streams", server.HTTP2MaxStreams, "")
+	tlsCert      = flag.String("tlscert", "", "")
+	tlsKey       = flag.String("tlskey", "", "")
+
+	// Gigabytes of free disk space below which to warn and to refuse writes.
+	diskWarn   = flag.Int("diskwarn", 0, "")
+	diskRefuse = flag.Int("diskrefuse", 0, "")
+
+	// Object store receiving dataset metadata backups and seconds between backups.
+	metaBackup         = flag.String("metabackup", "", "")
+	metaBackupInterval = flag.Int("metabackupinterval", 60, "")
+
+	// Address of the admin RPC port and the token authenticating admin commands.
+	adminRPC   = flag.String("adminrpc", "", "")
+	adminToken = flag.String("admintoken", "", "")
+
+	// JSON file of rules allowing or denying clients by IP address.
+	accessRules = flag.String("access", "", "")
 )
 
 const helpMessage = `
@@ -90,10 +178,102 @@ Usage: dvid [options] <command>
       -memprofile =string   Write memory profile to this file on ctrl-C.
       -numcpu     =number   Number of logical CPUs to use for DVID.
       -timeout    =number   Seconds to wait trying to get exclusive access to datastore.
+      -reqtimeout =number   Seconds before HTTP API requests are canceled (default: none).
+                              A request can override this with a "timeout" query string.
+      -membudget  =number   Megabytes concurrent voxel requests may use (default: no limit).
+                              Requests beyond the budget wait for memory to be released.
+      -maxbody    =number   Megabytes a request body may decompress to or have when read
+                              whole (default: 4096).  Larger bodies get a 413 status.
+      -uploaddir  =string   Directory for parts of multi-part uploads (default: system temp).
+                              See /api/uploads for sending huge POST bodies in parallel parts.
+      -replicaof  =string   Serve as a read replica of the primary at this HTTP address.
+                              HTTP writes are forwarded to the primary.
+      -replicaofrpc =string Primary's RPC address for forwarding commands that modify data.
+      -rejectwrites (flag)  Make a replica reject HTTP writes instead of forwarding them.
+      -replicatoken =string Token replicas send when pulling deltas, which the primary
+                              requires of non-admin delta requests (default:
+                              $DVID_REPLICA_TOKEN).  Give it to the primary and replicas.
+      -cluster    =string   Join the cluster whose coordinator is at this HTTP address.
+                              Members need -http and -rpc addresses other members can reach.
+      -coordinator (flag)   Coordinate a cluster.  Members assigned datasets by consistent
+                              hashing proxy requests for other members' nodes.
+      -clustertoken =string Token members send when registering with the coordinator,
+                              which refuses registrations without it, and with requests
+                              proxied for authenticated users (default:
+                              $DVID_CLUSTER_TOKEN).  Without a token, registrations must
+                              be admin requests and proxied requests aren't authenticated.
+      -federation =string   JSON file mapping UUID prefixes to remote DVID servers, e.g.,
+                              [{"Prefix": "3f8c", "URL": "http://emdata2:8000"}].
+                              Requests for non-local nodes are proxied, or redirected
+                              if the entry has "Redirect": true.
       -stdin      (flag)    Accept and send stdin to server for use in commands.
+      -upload     (flag)    Stream local files and image globs read by "put", "load", and
+                              "generate" commands, and stdin if -stdin, to the server in
+                              checksummed chunks so the server needn't see the files.
+                              Copies are removed after the command.
+      -connections =number  RPC connections streaming files with -upload (default: 4).
+      -idempotency =string  Key sent with a command so a retry with the same key returns
+                              the original result instead of repeating writes.
+                              HTTP clients can send an "Idempotency-Key" header.
+      -access     =string   JSON file of rules allowing or denying clients by IP address
+                              per API path prefix, or "rpc" for the RPC port, e.g.,
+                              [{"Path": "/api/server", "Allow": ["10.0.0.0/8"]}].
+                              See /api/server/access for changing rules while running.
+      -oidc       =string   JSON file configuring authentication of HTTP requests by an
+                              OpenID Connect provider, e.g., {"Issuer": "https://accounts.google.com",
+                              "ClientID": "...", "ClientSecret": "...", "RedirectURL":
+                              "http://host:8000/api/login/callback", "GroupsClaim": "groups"}.
+                              See /api/login for browser login.
+      -plugins    =string   Directory of Go plugins (*.so) adding data types.  Plugins must
+                              be built with the same DVID source and Go version.
+      -audit      (flag)    Record who made each HTTP request or RPC command that modifies
+                              data.  See /api/audit for querying the audit log.
+      -auditretention =number  Days audit entries are kept (default: forever).
+      -trashretention =number  Days deleted data is kept in the trash before it's purged
+                              (default: 7).  Zero keeps it until explicitly purged.
+      -scratchidle =number  Minutes a scratch node can go unused before it's deleted
+                              (default: 60).  See "node <UUID> scratch".
+      -thumbnails (flag)    Generate thumbnails of all datasets at startup and of a dataset
+                              whenever a node is locked.  See /api/dataset/<UUID>/gallery.
+      -otlp       =string   Base URL of an OpenTelemetry collector receiving traces of HTTP
+                              requests via OTLP/HTTP, e.g., "http://otel:4318" (default:
+                              $OTEL_EXPORTER_OTLP_ENDPOINT, or no tracing if unset).
+                              $OTEL_SERVICE_NAME overrides the service name "dvid".
+      -slowquery  =number   Log requests taking longer than this many milliseconds with a
+                              command reproducing each one and a breakdown of its time.
+                              See /api/server/slowqueries.  Zero turns off logging (default).
+      -slowlog    =string   File of the slow query log, rotated at 64 MB (default:
+                              dvid-slow-queries.log in the datastore directory).
+      -diskwarn   =number   Warn in /api/server/info when a datastore or upload volume has
+                              less than this many gigabytes free (default: no warning).
+      -diskrefuse =number   Refuse requests adding data, while still serving reads and
+                              deletions, when a volume has less than this many gigabytes
+                              free.  See /api/server/disk.  (default: never refuse)
+      -metabackup =string   Object store continuously receiving commits of changed dataset
+                              metadata, e.g., "s3://bucket/dvid-metadata" or a directory.
+                              See /api/server/backup and "restore-metadata" below.
+      -metabackupinterval =number  Seconds between checks for changed metadata (default: 60).
+      -adminrpc   =string   Address of a separate RPC port for admin commands (shutdown,
+                              backup, gc, reload, keys, logging, handlers), e.g.,
+                              "localhost:8002".  The server then refuses them on the
+                              -rpc port.  Clients send admin commands to this address if
+                              given.
+      -admintoken =string   Token admin commands must carry on the admin RPC port
+                              (default: $DVID_ADMIN_TOKEN).  Required if -adminrpc isn't a
+                              localhost address.
+      -idletimeout =number  Seconds a keep-alive HTTP connection can wait for its next request
+                              before it's closed (default: 120).
+      -http2streams =number Concurrent requests a client can make over one HTTP/2 connection
+                              (default: 1000).  Browser viewers fetching many tiles benefit
+                              from HTTP/2, which they only use over TLS.
+      -tlscert    =string   Certificate file for serving HTTP over TLS.  Requires -tlskey.
+      -tlskey     =string   Private key file for serving HTTP over TLS.
       -crc32      (flag)    Use CRC32 checksum to detect corruption.
       -types      (flag)    Show compiled DVID data types
       -debug      (flag)    Run in debug mode.  Verbose.
+      -debugmodules =string Run only the comma-separated modules, e.g., storage,server, in
+                              debug mode.  Modes can be changed while running via
+                              /api/server/logging or the "logging" command.
       -benchmark  (flag)    Run in benchmarking mode. 
   -h, -help       (flag)    Show help message
 
@@ -107,6 +287,29 @@ Commands that can be performed without a running server:
 	init   <datastore path>
 	serve  <datastore path>
 	repair <datastore path>
+	fsck   <datastore path> [quick=true] [repair=true] [quarantine=<dir>]
+	migrate-keys <datastore path>
+	restore-metadata <datastore path> <backup> [commit=<hash>] [endpoint=<URL>] [region=<region>]
+
+	  fsck checks dataset metadata, version DAGs, and data types, then scans all
+	  data keys for orphans.  "quick" skips the key scan.  "repair" fixes what it
+	  can, deleting orphaned keys and unreadable metadata, which are first saved
+	  to a file in the "quarantine" directory if given.
+
+	  migrate-keys converts data keys written by older DVID versions, which put
+	  the version before the index, to the current layout.  It can be run again
+	  if interrupted.
+
+	  restore-metadata replaces the dataset metadata of a datastore with the latest
+	  commit, or the given commit, of a backup made with -metabackup.  The backup is
+	  an object store like "s3://bucket/dvid-metadata" or a directory.
+
+Commands for a running server can be entered interactively with history and
+tab-completion of UUIDs, data names, and datatype commands:
+
+	shell
+
+For tab-completion of dvid commands in bash, add "complete -C dvid dvid" to ~/.bashrc.
 
 `
 
@@ -135,6 +338,15 @@ func currentDir() string {
 }
 
 func main() {
+	// Bash runs commands registered with "complete -C" to get completions.
+	if line := os.Getenv("COMP_LINE"); line != "" {
+		if point, err := strconv.Atoi(os.Getenv("COMP_POINT")); err == nil && point <= len(line) {
+			line = line[:point]
+		}
+		DoBashCompletion(line)
+		return
+	}
+
 	flag.BoolVar(showHelp, "h", false, "Show help message")
 	flag.Usage = usage
 	flag.Parse()
@@ -149,13 +361,105 @@ func main() {
 	if *runBenchmark {
 		dvid.Mode = dvid.Benchmark
 	}
+	if *debugModules != "" {
+		for _, module := range strings.Split(*debugModules, ",") {
+			dvid.SetModuleMode(strings.TrimSpace(module), dvid.Debug, 0)
+		}
+	}
 	if *timeout != 0 {
 		server.TimeoutSecs = *timeout
 	}
+	if *reqTimeout != 0 {
+		server.RequestTimeoutSecs = *reqTimeout
+	}
+	if *memBudget != 0 {
+		server.MemoryBudget = int64(*memBudget) * dvid.Mega
+	}
+	if *maxBody != 0 {
+		server.MaxRequestBody = int64(*maxBody) * dvid.Mega
+	}
+	server.UploadDir = *uploadDir
+	if *replicaOf != "" {
+		server.PrimaryWebAddress = *replicaOf
+		server.PrimaryRPCAddress = *replicaOfRPC
+		server.RejectWrites = *rejectWrites
+	}
+	if *replicaToken == "" {
+		*replicaToken = os.Getenv("DVID_REPLICA_TOKEN")
+	}
+	server.ReplicaToken = *replicaToken
+	server.ClusterCoordinator = *clusterOf
+	server.CoordinatorMode = *coordinator
+	if *clusterToken == "" {
+		*clusterToken = os.Getenv("DVID_CLUSTER_TOKEN")
+	}
+	server.ClusterToken = *clusterToken
+	if *federation != "" {
+		if err := server.LoadFederation(*federation); err != nil {
+			log.Fatalln(err.Error())
+		}
+		server.FederationFile = *federation
+	}
+	if *accessRules != "" {
+		if err := server.LoadAccessRules(*accessRules); err != nil {
+			log.Fatalln(err.Error())
+		}
+		server.AccessRulesFile = *accessRules
+	}
+	server.AuditLog = *auditLog
+	server.TrashRetention = time.Duration(*trashRetention) * 24 * time.Hour
+	if *scratchIdle > 0 {
+		server.ScratchIdle = time.Duration(*scratchIdle) * time.Minute
+	}
+	server.Thumbnails = *thumbnails
+	server.TraceEndpoint = *otlpEndpoint
+	server.SlowQueryThreshold = time.Duration(*slowQuery) * time.Millisecond
+	server.SlowQueryLog = *slowLog
+	server.DiskWarnBytes = uint64(*diskWarn) * dvid.Giga
+	server.DiskRefuseBytes = uint64(*diskRefuse) * dvid.Giga
+	server.MetadataBackupTarget = *metaBackup
+	if *metaBackupInterval > 0 {
+		server.MetadataBackupInterval = time.Duration(*metaBackupInterval) * time.Second
+	}
+	server.AdminRPCAddress = *adminRPC
+	if *adminToken == "" {
+		*adminToken = os.Getenv("DVID_ADMIN_TOKEN")
+	}
+	server.AdminRPCToken = *adminToken
+	server.HTTPIdleTimeout = time.Duration(*idleTimeout) * time.Second
+	if *http2Streams > 0 {
+		server.HTTP2MaxStreams = *http2Streams
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalln("-tlscert and -tlskey must be given together")
+	}
+	server.TLSCertFile = *tlsCert
+	server.TLSKeyFile = *tlsKey
+	if server.TraceEndpoint == "" {
+		server.TraceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if serviceName := os.Getenv("OTEL_SERVICE_NAME"); serviceName != "" {
+		server.TraceServiceName = serviceName
+	}
+	if *auditRetention != 0 {
+		server.AuditRetention = time.Duration(*auditRetention) * 24 * time.Hour
+	}
+	if *oidcConfig != "" {
+		if err := server.LoadOIDC(*oidcConfig); err != nil {
+			log.Fatalln(err.Error())
+		}
+		server.OIDCConfigFile = *oidcConfig
+	}
 	if *useCRC32 {
 		dvid.DefaultChecksum = dvid.CRC32
 	}
 
+	if *pluginDir != "" {
+		if err := datastore.LoadPlugins(*pluginDir); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+
 	if *showHelp || flag.NArg() == 0 {
 		flag.Usage()
 		os.Exit(0)
@@ -226,19 +530,39 @@ func DoCommand(cmd dvid.Command) error {
 	}
 
 	switch cmd.Name() {
-	// Handle commands that don't require server connection
+	// Handle commands that don't require server connection.  See localCommands.
 	case "init":
 		return DoInit(cmd)
 	case "serve":
 		return DoServe(cmd)
 	case "repair":
 		return DoRepair(cmd)
+	case "fsck":
+		return DoFsck(cmd)
+	case "migrate-keys":
+		return DoMigrateKeys(cmd)
+	case "restore-metadata":
+		return DoRestoreMetadata(cmd)
+	case "shell":
+		return DoShell(cmd)
 	case "about":
 		fmt.Println(datastore.Versions())
 	// Send everything else to server via DVID terminal
 	default:
-		client := server.NewClient(*rpcAddress)
-		request := datastore.Request{Command: cmd}
+		address := *rpcAddress
+		request := datastore.Request{Command: cmd, IdempotencyKey: *idempotencyKey}
+		if *adminRPC != "" && server.IsAdminCommand(cmd.Name()) {
+			address = *adminRPC
+			request.AdminToken = *adminToken
+		}
+		client := server.NewClient(address)
+		if *useUpload {
+			var stdin io.Reader
+			if *useStdin {
+				stdin = os.Stdin
+			}
+			return client.SendWithUploads(request, stdin, *connections, server.DefaultTransferChunkSize)
+		}
 		if *useStdin {
 			var err error
 			request.Input, err = ioutil.ReadAll(os.Stdin)
@@ -274,6 +598,78 @@ func DoRepair(cmd dvid.Command) error {
 	return nil
 }
 
+// DoFsck performs the "fsck" command, checking the consistency of a datastore and
+// optionally repairing it.
+func DoFsck(cmd dvid.Command) error {
+	datastorePath := cmd.Argument(1)
+	if datastorePath == "" {
+		return fmt.Errorf("fsck command must be followed by the path to the datastore")
+	}
+	config := cmd.Settings()
+	var options datastore.FsckOptions
+	var err error
+	if options.Quick, _, err = config.GetBool("quick"); err != nil {
+		return err
+	}
+	if options.Repair, _, err = config.GetBool("repair"); err != nil {
+		return err
+	}
+	if options.QuarantineDir, _, err = config.GetString("quarantine"); err != nil {
+		return err
+	}
+	report, err := datastore.Fsck(datastorePath, options)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		return err
+	}
+	if n := report.Unrepaired(); n > 0 {
+		return fmt.Errorf("Found %d unrepaired problems in datastore at %s", n, datastorePath)
+	}
+	return nil
+}
+
+// DoMigrateKeys performs the "migrate-keys" command, converting the data keys of a
+// datastore to the current layout.
+func DoMigrateKeys(cmd dvid.Command) error {
+	datastorePath := cmd.Argument(1)
+	if datastorePath == "" {
+		return fmt.Errorf("migrate-keys command must be followed by the path to the datastore")
+	}
+	migration, err := datastore.MigrateKeys(datastorePath)
+	if migration != nil {
+		fmt.Printf("Converted %d keys (%d bytes) of datastore at %s.\n", migration.Keys, migration.Bytes,
+			datastorePath)
+	}
+	return err
+}
+
+// DoRestoreMetadata performs the "restore-metadata" command, replacing the dataset
+// metadata of a datastore with a commit of a metadata backup.
+func DoRestoreMetadata(cmd dvid.Command) error {
+	datastorePath := cmd.Argument(1)
+	target := cmd.Argument(2)
+	if datastorePath == "" || target == "" {
+		return fmt.Errorf("restore-metadata command must be followed by the paths to the datastore and backup")
+	}
+	config := cmd.Settings()
+	store, err := storage.NewObjectStore(target, config)
+	if err != nil {
+		return err
+	}
+	commit, _, err := config.GetString("commit")
+	if err != nil {
+		return err
+	}
+	restored, err := datastore.RestoreMetadata(datastorePath, store, commit)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored metadata of datastore at %s from commit %s of %s.\n", datastorePath, restored, store)
+	return nil
+}
+
 // DoServe opens a datastore then creates both web and rpc servers for the datastore
 func DoServe(cmd dvid.Command) error {
 	datastorePath := cmd.Argument(1)
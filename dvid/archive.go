@@ -0,0 +1,148 @@
+/*
+	This file supports streaming many small values as a single zip or tar archive.
+*/
+
+package dvid
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archive formats supported by ArchiveWriter.
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar"
+)
+
+// ArchiveWriter writes named files into a zip or tar stream as they're produced, so
+// archives of many values needn't be held in memory.
+type ArchiveWriter struct {
+	format   string
+	zw       *zip.Writer
+	tw       *tar.Writer
+	modified time.Time
+
+	checksums *ChecksumManifest
+}
+
+// NewArchiveWriter returns an ArchiveWriter for the "zip" or "tar" format.
+func NewArchiveWriter(w io.Writer, format string) (*ArchiveWriter, error) {
+	a := &ArchiveWriter{format: strings.ToLower(format), modified: time.Now()}
+	switch a.format {
+	case ArchiveZip:
+		a.zw = zip.NewWriter(w)
+	case ArchiveTar:
+		a.tw = tar.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("Bad archive format %q: use 'zip' or 'tar'", format)
+	}
+	return a, nil
+}
+
+// Format returns the archive format, "zip" or "tar".
+func (a *ArchiveWriter) Format() string {
+	return a.format
+}
+
+// ContentType returns the MIME type of the archive.
+func (a *ArchiveWriter) ContentType() string {
+	if a.format == ArchiveZip {
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// AddChecksums makes the archive end with a checksum manifest, ChecksumManifestName,
+// of the files written.  The source describes the archived data.
+func (a *ArchiveWriter) AddChecksums(source string) {
+	a.checksums = NewChecksumManifest(source)
+}
+
+// WriteFile adds a file to the archive.  Values are usually small or already compressed,
+// so zip files are stored without compression.
+func (a *ArchiveWriter) WriteFile(name string, data []byte) error {
+	if err := CheckArchiveName(name); err != nil {
+		return err
+	}
+	if a.checksums != nil {
+		a.checksums.Add(name, data)
+	}
+	return a.writeFile(name, data)
+}
+
+func (a *ArchiveWriter) writeFile(name string, data []byte) error {
+	if a.zw != nil {
+		header := &zip.FileHeader{Name: name, Method: zip.Store}
+		header.SetModTime(a.modified)
+		f, err := a.zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: a.modified}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(data)
+	return err
+}
+
+// Close finishes the archive, writing any checksum manifest, without closing the
+// underlying writer.
+func (a *ArchiveWriter) Close() error {
+	if a.checksums != nil {
+		m, err := a.checksums.JSON()
+		if err != nil {
+			return err
+		}
+		if err := a.writeFile(ChecksumManifestName, m); err != nil {
+			return err
+		}
+	}
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+	return a.tw.Close()
+}
+
+// CheckArchiveName returns an error if a name can't be used for a file in an archive
+// because it's empty, absolute, or would extract outside the target directory.
+func CheckArchiveName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Archive file names can't be empty")
+	}
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("Bad archive file name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return fmt.Errorf("Archive file name %q can't contain '..'", name)
+		}
+	}
+	if path.Clean(name) == "." {
+		return fmt.Errorf("Bad archive file name %q", name)
+	}
+	return nil
+}
+
+// ArchiveKeys returns the keys of a "keys" query string option, which may be repeated or
+// hold comma-separated keys.
+func ArchiveKeys(values []string) []string {
+	var keys []string
+	for _, value := range values {
+		for _, key := range strings.Split(value, ",") {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,86 @@
+package dvid
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestArchiveWriter(c *C) {
+	_, err := NewArchiveWriter(ioutil.Discard, "rar")
+	c.Assert(err, NotNil)
+
+	files := map[string]string{"a": "first", "dir/b.json": "{}"}
+	for _, format := range []string{"zip", "TAR"} {
+		var buf bytes.Buffer
+		a, err := NewArchiveWriter(&buf, format)
+		c.Assert(err, IsNil)
+		c.Assert(a.WriteFile("a", []byte(files["a"])), IsNil)
+		c.Assert(a.WriteFile("dir/b.json", []byte(files["dir/b.json"])), IsNil)
+		c.Assert(a.WriteFile("../escape", []byte("x")), NotNil)
+		c.Assert(a.Close(), IsNil)
+
+		read := make(map[string]string)
+		if a.Format() == ArchiveZip {
+			c.Assert(a.ContentType(), Equals, "application/zip")
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			c.Assert(err, IsNil)
+			for _, f := range zr.File {
+				rc, err := f.Open()
+				c.Assert(err, IsNil)
+				data, err := ioutil.ReadAll(rc)
+				c.Assert(err, IsNil)
+				rc.Close()
+				read[f.Name] = string(data)
+			}
+		} else {
+			c.Assert(a.ContentType(), Equals, "application/x-tar")
+			tr := tar.NewReader(&buf)
+			for {
+				header, err := tr.Next()
+				if err != nil {
+					break
+				}
+				data, err := ioutil.ReadAll(tr)
+				c.Assert(err, IsNil)
+				read[header.Name] = string(data)
+			}
+		}
+		c.Assert(read, DeepEquals, files)
+	}
+}
+
+func (suite *DataSuite) TestArchiveChecksums(c *C) {
+	var buf bytes.Buffer
+	a, err := NewArchiveWriter(&buf, "tar")
+	c.Assert(err, IsNil)
+	a.AddChecksums("test")
+	c.Assert(a.WriteFile("a", []byte("first")), IsNil)
+	c.Assert(a.Close(), IsNil)
+
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "a")
+	header, err = tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, ChecksumManifestName)
+	data, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	m, err := ReadChecksumManifest(data)
+	c.Assert(err, IsNil)
+	c.Assert(m.Verify("a", []byte("first")), IsNil)
+}
+
+func (suite *DataSuite) TestArchiveNames(c *C) {
+	for _, name := range []string{"key", "a/b", "1_2_3.json", "..hidden"} {
+		c.Assert(CheckArchiveName(name), IsNil)
+	}
+	for _, name := range []string{"", "/etc/passwd", "a/../../b", "..", ".", "a\\b"} {
+		c.Assert(CheckArchiveName(name), NotNil, Commentf("name %q", name))
+	}
+	c.Assert(ArchiveKeys([]string{"a,b", "c", ""}), DeepEquals, []string{"a", "b", "c"})
+}
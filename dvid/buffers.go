@@ -0,0 +1,122 @@
+/*
+	This file implements pools of byte buffers that are reused across requests so that
+	workloads with many small requests, e.g., tile serving, don't spend their time
+	allocating and garbage collecting block- and image-sized buffers.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxPooledBufferSize is the largest buffer, in bytes, that is recycled.  Larger
+// buffers are allocated and left for the garbage collector as usual.
+const MaxPooledBufferSize = 16 * Mega
+
+// Buffers are pooled by size class, each holding buffers with a capacity of a power
+// of two up to MaxPooledBufferSize.
+const numBufferClasses = 25
+
+var bufferPools [numBufferClasses]sync.Pool
+
+var bytesBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// BufferPoolStats gives counts of pooled buffer use since the server started.
+type BufferPoolStats struct {
+	Gets      uint64 // Requests for buffers.
+	Reused    uint64 // Requests satisfied by a recycled buffer.
+	Puts      uint64 // Buffers returned to a pool.
+	Discarded uint64 // Returned buffers that were too large or oddly sized to pool.
+}
+
+var bufferStats BufferPoolStats
+
+// BufferStats returns the current counts for the buffer pools.
+func BufferStats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:      atomic.LoadUint64(&bufferStats.Gets),
+		Reused:    atomic.LoadUint64(&bufferStats.Reused),
+		Puts:      atomic.LoadUint64(&bufferStats.Puts),
+		Discarded: atomic.LoadUint64(&bufferStats.Discarded),
+	}
+}
+
+// bufferClass returns the size class for a buffer of n bytes, i.e., the smallest power
+// of two holding n bytes, or -1 if the buffer is too large to pool.
+func bufferClass(n int) int {
+	if n > MaxPooledBufferSize {
+		return -1
+	}
+	class := 0
+	for (1 << uint(class)) < n {
+		class++
+	}
+	return class
+}
+
+// GetBuffer returns a byte slice of length n, reusing a previously returned buffer if
+// possible.  The contents of the slice are undefined, so callers that need zeroed
+// memory must clear it.  Return the buffer with PutBuffer when it's no longer used.
+func GetBuffer(n int) []byte {
+	atomic.AddUint64(&bufferStats.Gets, 1)
+	class := bufferClass(n)
+	if class < 0 {
+		return make([]byte, n)
+	}
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		atomic.AddUint64(&bufferStats.Reused, 1)
+		return (*buf)[:n]
+	}
+	return make([]byte, n, 1<<uint(class))
+}
+
+// GetZeroedBuffer returns a zeroed byte slice of length n from the buffer pools.
+func GetZeroedBuffer(n int) []byte {
+	buf := GetBuffer(n)
+	for i := range buf {
+		buf[i] = 0
+	}
+	return buf
+}
+
+// PutBuffer returns a buffer to the pools for reuse.  The buffer must not be used
+// after it is returned.  Buffers that weren't allocated by GetBuffer, e.g., those whose
+// capacity isn't a power of two, are ignored.
+func PutBuffer(buf []byte) {
+	c := cap(buf)
+	class := bufferClass(c)
+	if c == 0 || class < 0 || c != 1<<uint(class) {
+		atomic.AddUint64(&bufferStats.Discarded, 1)
+		return
+	}
+	atomic.AddUint64(&bufferStats.Puts, 1)
+	buf = buf[:0]
+	bufferPools[class].Put(&buf)
+}
+
+// GetBytesBuffer returns an empty bytes.Buffer for encoding, reusing the memory of
+// previously returned buffers.
+func GetBytesBuffer() *bytes.Buffer {
+	atomic.AddUint64(&bufferStats.Gets, 1)
+	buf := bytesBufferPool.Get().(*bytes.Buffer)
+	if buf.Cap() > 0 {
+		atomic.AddUint64(&bufferStats.Reused, 1)
+	}
+	return buf
+}
+
+// PutBytesBuffer returns a bytes.Buffer obtained from GetBytesBuffer for reuse.
+func PutBytesBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > MaxPooledBufferSize {
+		atomic.AddUint64(&bufferStats.Discarded, 1)
+		return
+	}
+	atomic.AddUint64(&bufferStats.Puts, 1)
+	buf.Reset()
+	bytesBufferPool.Put(buf)
+}
@@ -0,0 +1,40 @@
+package dvid
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestBufferPools(c *C) {
+	c.Assert(bufferClass(1), Equals, 0)
+	c.Assert(bufferClass(1000), Equals, 10)
+	c.Assert(bufferClass(1024), Equals, 10)
+	c.Assert(bufferClass(MaxPooledBufferSize), Equals, numBufferClasses-1)
+	c.Assert(bufferClass(MaxPooledBufferSize+1), Equals, -1)
+
+	buf := GetBuffer(1000)
+	c.Assert(buf, HasLen, 1000)
+	c.Assert(cap(buf), Equals, 1024)
+	for i := range buf {
+		buf[i] = 0xFF
+	}
+	before := BufferStats()
+	PutBuffer(buf)
+	zeroed := GetZeroedBuffer(900)
+	c.Assert(zeroed, HasLen, 900)
+	for _, b := range zeroed {
+		c.Assert(b, Equals, byte(0))
+	}
+	after := BufferStats()
+	c.Assert(after.Puts, Equals, before.Puts+1)
+	c.Assert(after.Gets, Equals, before.Gets+1)
+
+	// Buffers not from the pools are ignored.
+	PutBuffer(make([]byte, 1000))
+	c.Assert(BufferStats().Discarded, Equals, after.Discarded+1)
+	c.Assert(GetBuffer(MaxPooledBufferSize+1), HasLen, MaxPooledBufferSize+1)
+
+	b := GetBytesBuffer()
+	b.WriteString("tile")
+	PutBytesBuffer(b)
+	c.Assert(GetBytesBuffer().Len(), Equals, 0)
+}
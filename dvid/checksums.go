@@ -0,0 +1,193 @@
+/*
+	This file supports manifests of exported files with sizes and SHA-256 checksums, so
+	transfers of exports between institutions can be verified on import.
+*/
+
+package dvid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChecksumManifestName is the name of the checksum manifest written with exported files.
+const ChecksumManifestName = "dvid-checksums.json"
+
+// ManifestFile gives the size and SHA-256 checksum of an exported file.
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// ChecksumManifest lists exported files with their sizes and checksums.
+type ChecksumManifest struct {
+	// Source describes the exported data, e.g., "grayscale at version 3f8c...".
+	Source  string
+	Created time.Time
+
+	NumFiles   int
+	TotalBytes int64
+	Files      []ManifestFile
+
+	mu     sync.Mutex
+	byName map[string]int
+}
+
+// NewChecksumManifest returns an empty manifest for files exported from a source.
+func NewChecksumManifest(source string) *ChecksumManifest {
+	return &ChecksumManifest{Source: source, Created: time.Now(), Files: []ManifestFile{}}
+}
+
+// Add records the size and checksum of a file's data, replacing any earlier entry of the
+// same name.  It's safe for concurrent use.
+func (m *ChecksumManifest) Add(name string, data []byte) {
+	sum := sha256.Sum256(data)
+	m.AddFile(ManifestFile{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+}
+
+// AddFile records the size and checksum of a file computed earlier, e.g., by an
+// interrupted export, replacing any earlier entry of the same name.
+func (m *ChecksumManifest) AddFile(file ManifestFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.index()
+	}
+	if n, found := m.byName[file.Name]; found {
+		m.TotalBytes -= m.Files[n].Size
+		m.Files[n] = file
+	} else {
+		m.byName[file.Name] = len(m.Files)
+		m.Files = append(m.Files, file)
+		m.NumFiles++
+	}
+	m.TotalBytes += file.Size
+}
+
+func (m *ChecksumManifest) index() {
+	m.byName = make(map[string]int, len(m.Files))
+	for n, file := range m.Files {
+		m.byName[file.Name] = n
+	}
+}
+
+// Has returns true if the manifest lists the named file.
+func (m *ChecksumManifest) Has(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.index()
+	}
+	_, found := m.byName[name]
+	return found
+}
+
+// File returns the size and checksum listed for the named file, if any.
+func (m *ChecksumManifest) File(name string) (file ManifestFile, found bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.index()
+	}
+	n, found := m.byName[name]
+	if found {
+		file = m.Files[n]
+	}
+	return file, found
+}
+
+// Verify returns an error if data doesn't match the size and checksum listed for the
+// named file or the file isn't listed.
+func (m *ChecksumManifest) Verify(name string, data []byte) error {
+	m.mu.Lock()
+	if m.byName == nil {
+		m.index()
+	}
+	n, found := m.byName[name]
+	var file ManifestFile
+	if found {
+		file = m.Files[n]
+	}
+	m.mu.Unlock()
+	if !found {
+		return fmt.Errorf("File %q is not in the checksum manifest", name)
+	}
+	if int64(len(data)) != file.Size {
+		return fmt.Errorf("File %q has %d bytes but the manifest lists %d bytes", name, len(data), file.Size)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != file.SHA256 {
+		return fmt.Errorf("File %q doesn't match its SHA-256 checksum in the manifest", name)
+	}
+	return nil
+}
+
+// JSON returns the manifest as indented JSON with files sorted by name.
+func (m *ChecksumManifest) JSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	m.index()
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// ReadChecksumManifest decodes a manifest and checks that its counts agree with its files.
+func ReadChecksumManifest(data []byte) (*ChecksumManifest, error) {
+	m := new(ChecksumManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Bad checksum manifest: %s", err.Error())
+	}
+	var total int64
+	for _, file := range m.Files {
+		total += file.Size
+	}
+	if m.NumFiles != len(m.Files) || m.TotalBytes != total {
+		return nil, fmt.Errorf("Checksum manifest lists %d files of %d bytes but has %d files of %d bytes",
+			m.NumFiles, m.TotalBytes, len(m.Files), total)
+	}
+	m.index()
+	return m, nil
+}
+
+// VerifyFiles checks files against a manifest file.  Files are looked up by their paths
+// relative to the manifest's directory.
+func VerifyFiles(manifestFilename string, filenames []string) error {
+	data, err := ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		return err
+	}
+	m, err := ReadChecksumManifest(data)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(manifestFilename))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if err := m.Verify(filepath.ToSlash(rel), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package dvid
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestChecksumManifest(c *C) {
+	m := NewChecksumManifest("test")
+	m.Add("b", []byte("second"))
+	m.Add("a", []byte("first"))
+	m.Add("b", []byte("replaced"))
+	c.Assert(m.NumFiles, Equals, 2)
+	c.Assert(m.TotalBytes, Equals, int64(len("first")+len("replaced")))
+	c.Assert(m.Has("a"), Equals, true)
+
+	data, err := m.JSON()
+	c.Assert(err, IsNil)
+	read, err := ReadChecksumManifest(data)
+	c.Assert(err, IsNil)
+	c.Assert(read.Files, HasLen, 2)
+	c.Assert(read.Files[0].Name, Equals, "a")
+	c.Assert(read.Verify("a", []byte("first")), IsNil)
+	c.Assert(read.Verify("b", []byte("replaced")), IsNil)
+	c.Assert(read.Verify("b", []byte("second")), ErrorMatches, ".*bytes.*")
+	c.Assert(read.Verify("a", []byte("fIrst")), ErrorMatches, ".*checksum.*")
+	c.Assert(read.Verify("c", nil), ErrorMatches, ".*not in the checksum manifest.*")
+
+	read.NumFiles = 3
+	data, err = read.JSON()
+	c.Assert(err, IsNil)
+	_, err = ReadChecksumManifest(data)
+	c.Assert(err, NotNil)
+
+	// Files are found relative to the manifest's directory.
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a"), []byte("first"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", "c"), []byte("third"), 0644), IsNil)
+	m = NewChecksumManifest("test")
+	m.Add("a", []byte("first"))
+	m.Add("sub/c", []byte("third"))
+	data, err = m.JSON()
+	c.Assert(err, IsNil)
+	manifest := filepath.Join(dir, ChecksumManifestName)
+	c.Assert(ioutil.WriteFile(manifest, data, 0644), IsNil)
+	c.Assert(VerifyFiles(manifest, []string{filepath.Join(dir, "a"), filepath.Join(dir, "sub", "c")}), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "sub", "c"), []byte("thirD"), 0644), IsNil)
+	c.Assert(VerifyFiles(manifest, []string{filepath.Join(dir, "sub", "c")}), NotNil)
+}
@@ -146,6 +146,28 @@ func (c Config) GetBool(key string) (value, found bool, err error) {
 	return
 }
 
+// GetJSON decodes the setting of the given key into v.  The setting can be a JSON value
+// within a JSON configuration or a string holding JSON, e.g., from the command line.
+func (c Config) GetJSON(key string, v interface{}) (found bool, err error) {
+	if c.values == nil {
+		return
+	}
+	var param interface{}
+	if param, found = c.values[strings.ToLower(key)]; !found {
+		return
+	}
+	var b []byte
+	if s, ok := param.(string); ok {
+		b = []byte(s)
+	} else if b, err = json.Marshal(param); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		err = fmt.Errorf("Setting for '%s' was not valid JSON: %s", key, err.Error())
+	}
+	return
+}
+
 // Response provides a few string fields to pass information back from
 // a remote operation.
 type Response struct {
@@ -948,7 +948,7 @@ func (c ChunkPointNd) Value(dim uint8) int32 {
 	return c[dim]
 }
 
-// MinPoint returns the smallest voxel coordinate of the given 3d chunk.
+// MinPoint returns the smallest voxel coordinate of the given n-d chunk.
 func (c ChunkPointNd) MinPoint(size Point) Point {
 	min := make(PointNd, len(c))
 	for i, _ := range c {
@@ -957,15 +957,32 @@ func (c ChunkPointNd) MinPoint(size Point) Point {
 	return min
 }
 
-// MaxPoint returns the maximum voxel coordinate of the given 3d chunk.
+// MaxPoint returns the maximum voxel coordinate of the given n-d chunk.
 func (c ChunkPointNd) MaxPoint(size Point) Point {
 	max := make(PointNd, len(c))
 	for i, _ := range c {
-		max[i] = c[i] * size.Value(uint8(i))
+		max[i] = (c[i]+1)*size.Value(uint8(i)) - 1
 	}
 	return max
 }
 
+// NewChunkPoint returns an appropriate ChunkPoint implementation for the number of
+// dimensions passed in.
+func NewChunkPoint(values []int32) (ChunkPoint, error) {
+	switch len(values) {
+	case 0, 1:
+		return nil, fmt.Errorf("No ChunkPoint implementation for 0 or 1-d slice")
+	case 2:
+		return ChunkPoint2d{values[0], values[1]}, nil
+	case 3:
+		return ChunkPoint3d{values[0], values[1], values[2]}, nil
+	default:
+		c := make(ChunkPointNd, len(values))
+		copy(c, values)
+		return c, nil
+	}
+}
+
 // Convert a slice of int32 into an appropriate Point implementation.
 func SliceToPoint(coord []int32) (p Point, err error) {
 	switch len(coord) {
@@ -43,12 +43,71 @@ func GetNumBlocks(geom Geometry, blockSize Point) int {
 	return numBlocks
 }
 
+// Dimension describes one axis of an n-d space, e.g., "X" in "nanometers" or "t" in "seconds".
 type Dimension struct {
 	Name     string
 	Units    string
 	beg, end int32
 }
 
+// DefaultAxisNames are the labels used for each dimension unless otherwise specified.
+// The first three dimensions are spatial, followed by time and channel.
+var DefaultAxisNames = []string{"X", "Y", "Z", "t", "c"}
+
+// Axes describes the dimensions of an n-d space so that time series, channels, and
+// scale levels can be modeled uniformly as additional dimensions.
+type Axes []Dimension
+
+// DefaultAxes returns Axes for a space of the given dimensionality using DefaultAxisNames.
+func DefaultAxes(numDims uint8) Axes {
+	axes := make(Axes, numDims)
+	for dim := uint8(0); dim < numDims; dim++ {
+		if int(dim) < len(DefaultAxisNames) {
+			axes[dim].Name = DefaultAxisNames[dim]
+		} else {
+			axes[dim].Name = fmt.Sprintf("Dim %d", dim)
+		}
+	}
+	return axes
+}
+
+// NewAxes returns Axes with the given names, e.g., "X,Y,Z,t" parsed via StringToNdString.
+func NewAxes(names NdString) (Axes, error) {
+	axes := make(Axes, len(names))
+	for dim, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("Axis %d must have a non-empty name", dim)
+		}
+		for i := 0; i < dim; i++ {
+			if strings.EqualFold(axes[i].Name, name) {
+				return nil, fmt.Errorf("Axis name '%s' used more than once", name)
+			}
+		}
+		axes[dim].Name = name
+	}
+	return axes, nil
+}
+
+// Names returns the name of each dimension.
+func (a Axes) Names() NdString {
+	names := make(NdString, len(a))
+	for dim, axis := range a {
+		names[dim] = axis.Name
+	}
+	return names
+}
+
+// Dim returns the dimension index of the axis with the given case-insensitive name.
+func (a Axes) Dim(name string) (uint8, error) {
+	for dim, axis := range a {
+		if strings.EqualFold(axis.Name, name) {
+			return uint8(dim), nil
+		}
+	}
+	return 0, fmt.Errorf("No axis named '%s'", name)
+}
+
 var (
 	// XY describes a 2d rectangle of voxels that share a z-coord.
 	XY = DataShape{3, []uint8{0, 1}}
@@ -66,6 +125,18 @@ var (
 	Vol3d = DataShape{3, []uint8{0, 1, 2}}
 )
 
+// VolumeShape returns a DataShape for a n-d volume spanning all dimensions.
+func VolumeShape(numDims uint8) DataShape {
+	if numDims == 3 {
+		return Vol3d
+	}
+	shape := make([]uint8, numDims)
+	for dim := uint8(0); dim < numDims; dim++ {
+		shape[dim] = dim
+	}
+	return DataShape{numDims, shape}
+}
+
 // DataShape describes the number of dimensions and the ordering of the dimensions.
 type DataShape struct {
 	dims  uint8
@@ -98,16 +169,11 @@ func (s DataShape) AxisName(axis uint8) string {
 	if int(axis) >= len(s.shape) {
 		return "Unknown"
 	}
-	switch s.shape[axis] {
-	case 0:
-		return "X"
-	case 1:
-		return "Y"
-	case 2:
-		return "Z"
-	default:
-		return fmt.Sprintf("Dim %d", axis)
+	dim := s.shape[axis]
+	if int(dim) < len(DefaultAxisNames) {
+		return DefaultAxisNames[dim]
 	}
+	return fmt.Sprintf("Dim %d", axis)
 }
 
 // Bytes returns a fixed length byte representation that can be used for keys.
@@ -349,13 +415,14 @@ func NewSubvolumeFromStrings(offsetStr, sizeStr, sep string) (*Subvolume, error)
 	return NewSubvolume(offset, size), nil
 }
 
-// NewSubvolume returns a Subvolume given a subvolume's origin and size.
+// NewSubvolume returns a Subvolume given a subvolume's origin and size.  The dimensionality
+// of the subvolume is determined by the offset, so n-d (n > 3) volumes are allowed.
 func NewSubvolume(offset, size Point) *Subvolume {
-	return &Subvolume{Vol3d, offset, size}
+	return &Subvolume{VolumeShape(offset.NumDims()), offset, size}
 }
 
 func (s *Subvolume) DataShape() DataShape {
-	return Vol3d
+	return s.shape
 }
 
 func (s *Subvolume) Size() Point {
@@ -378,7 +445,7 @@ func (s *Subvolume) StartPoint() Point {
 }
 
 func (s *Subvolume) EndPoint() Point {
-	return s.offset.Add(s.size.Sub(Point3d{1, 1, 1}))
+	return s.offset.Add(s.size.AddScalar(-1))
 }
 
 func (s *Subvolume) String() string {
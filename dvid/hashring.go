@@ -0,0 +1,114 @@
+/*
+	This file implements consistent hashing of keys onto a set of members, e.g.,
+	datasets onto the servers of a DVID cluster.
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+)
+
+// DefaultRingReplicas is the default number of points on a HashRing per member.
+// More points spread keys more evenly across members.
+const DefaultRingReplicas = 100
+
+// HashRing assigns keys to members using consistent hashing, so adding or removing
+// a member only reassigns the keys of that member.  It is safe for concurrent use.
+type HashRing struct {
+	sync.RWMutex
+	replicas int
+	points   []uint32          // sorted hashes of all member points
+	owners   map[uint32]string // member for each point
+	members  map[string]bool
+}
+
+// NewHashRing returns an empty HashRing with the given number of points per member.
+func NewHashRing(replicas int) *HashRing {
+	if replicas < 1 {
+		replicas = DefaultRingReplicas
+	}
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		members:  make(map[string]bool),
+	}
+}
+
+func (ring *HashRing) pointHash(member string, i int) uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", member, i)))
+}
+
+// Add adds members to the ring.
+func (ring *HashRing) Add(members ...string) {
+	ring.Lock()
+	defer ring.Unlock()
+	for _, member := range members {
+		if ring.members[member] {
+			continue
+		}
+		ring.members[member] = true
+		for i := 0; i < ring.replicas; i++ {
+			ring.owners[ring.pointHash(member, i)] = member
+		}
+	}
+	ring.sortPoints()
+}
+
+// Remove removes members from the ring.
+func (ring *HashRing) Remove(members ...string) {
+	ring.Lock()
+	defer ring.Unlock()
+	for _, member := range members {
+		if !ring.members[member] {
+			continue
+		}
+		delete(ring.members, member)
+		for i := 0; i < ring.replicas; i++ {
+			h := ring.pointHash(member, i)
+			if ring.owners[h] == member {
+				delete(ring.owners, h)
+			}
+		}
+	}
+	ring.sortPoints()
+}
+
+func (ring *HashRing) sortPoints() {
+	ring.points = ring.points[:0]
+	for h := range ring.owners {
+		ring.points = append(ring.points, h)
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+}
+
+// Owner returns the member assigned to a key or an empty string if the ring has
+// no members.
+func (ring *HashRing) Owner(key string) string {
+	ring.RLock()
+	defer ring.RUnlock()
+	if len(ring.points) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// Members returns the sorted members of the ring.
+func (ring *HashRing) Members() []string {
+	ring.RLock()
+	defer ring.RUnlock()
+	members := make([]string, 0, len(ring.members))
+	for member := range ring.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,36 @@
+package dvid
+
+import (
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestHashRing(c *C) {
+	ring := NewHashRing(0)
+	c.Assert(ring.Owner("abc"), Equals, "")
+
+	ring.Add("server1:8000", "server2:8000", "server3:8000")
+	c.Assert(ring.Members(), DeepEquals, []string{"server1:8000", "server2:8000", "server3:8000"})
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("dataset-%d", i)
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, member := range ring.Members() {
+		c.Assert(counts[member] > 500, Equals, true, Commentf("member %s got %d keys", member, counts[member]))
+	}
+
+	// Removing a member only moves that member's keys.
+	ring.Remove("server2:8000")
+	for key, owner := range owners {
+		if owner != "server2:8000" {
+			c.Assert(ring.Owner(key), Equals, owner)
+		} else {
+			c.Assert(ring.Owner(key), Not(Equals), "server2:8000")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// +build hdf5
+
+/*
+	This file adds reading of HDF5 datasets using the HDF5 C library, which must be
+	installed to build DVID with the "hdf5" build tag.
+*/
+
+package dvid
+
+/*
+#cgo LDFLAGS: -lhdf5
+#include <stdlib.h>
+#include <hdf5.h>
+
+static hid_t dvid_native_type(int t) {
+	switch (t) {
+	case 0: return H5T_NATIVE_UINT8;
+	case 1: return H5T_NATIVE_INT8;
+	case 2: return H5T_NATIVE_UINT16;
+	case 3: return H5T_NATIVE_INT16;
+	case 4: return H5T_NATIVE_UINT32;
+	case 5: return H5T_NATIVE_INT32;
+	case 6: return H5T_NATIVE_UINT64;
+	case 7: return H5T_NATIVE_INT64;
+	case 8: return H5T_NATIVE_FLOAT;
+	case 9: return H5T_NATIVE_DOUBLE;
+	}
+	return -1;
+}
+
+static hid_t dvid_open_file(const char *filename) {
+	return H5Fopen(filename, H5F_ACC_RDONLY, H5P_DEFAULT);
+}
+
+static hid_t dvid_open_dataset(hid_t file, const char *path) {
+	return H5Dopen2(file, path, H5P_DEFAULT);
+}
+
+static int dvid_read_hyperslab(hid_t dataset, int t, int rank, hsize_t *start, hsize_t *count, void *buf) {
+	hid_t memtype = dvid_native_type(t);
+	if (memtype < 0) {
+		return -1;
+	}
+	hid_t filespace = H5Dget_space(dataset);
+	if (filespace < 0) {
+		return -1;
+	}
+	if (H5Sselect_hyperslab(filespace, H5S_SELECT_SET, start, NULL, count, NULL) < 0) {
+		H5Sclose(filespace);
+		return -1;
+	}
+	hid_t memspace = H5Screate_simple(rank, count, NULL);
+	if (memspace < 0) {
+		H5Sclose(filespace);
+		return -1;
+	}
+	herr_t status = H5Dread(dataset, memtype, memspace, filespace, H5P_DEFAULT, buf);
+	H5Sclose(memspace);
+	H5Sclose(filespace);
+	return status < 0 ? -1 : 0;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// HDF5Dataset is an open dataset within an HDF5 file.
+type HDF5Dataset struct {
+	file    C.hid_t
+	dataset C.hid_t
+	path    string
+}
+
+// OpenHDF5Dataset opens a dataset, e.g., "/volumes/raw", within an HDF5 file for reading.
+func OpenHDF5Dataset(filename, path string) (*HDF5Dataset, error) {
+	cFilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cFilename))
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	StartCgo()
+	defer StopCgo()
+	file := C.dvid_open_file(cFilename)
+	if file < 0 {
+		return nil, fmt.Errorf("Unable to open HDF5 file %s", filename)
+	}
+	dataset := C.dvid_open_dataset(file, cPath)
+	if dataset < 0 {
+		C.H5Fclose(file)
+		return nil, fmt.Errorf("Unable to open dataset '%s' in HDF5 file %s", path, filename)
+	}
+	return &HDF5Dataset{file, dataset, path}, nil
+}
+
+// Dims returns the dimensions of the dataset in HDF5 (C) order, i.e., slowest varying first.
+func (d *HDF5Dataset) Dims() ([]uint64, error) {
+	StartCgo()
+	defer StopCgo()
+	space := C.H5Dget_space(d.dataset)
+	if space < 0 {
+		return nil, fmt.Errorf("Unable to get dataspace of HDF5 dataset '%s'", d.path)
+	}
+	defer C.H5Sclose(space)
+	rank := C.H5Sget_simple_extent_ndims(space)
+	if rank <= 0 {
+		return nil, fmt.Errorf("HDF5 dataset '%s' is not a simple array", d.path)
+	}
+	cDims := make([]C.hsize_t, rank)
+	if C.H5Sget_simple_extent_dims(space, &cDims[0], nil) < 0 {
+		return nil, fmt.Errorf("Unable to get dimensions of HDF5 dataset '%s'", d.path)
+	}
+	dims := make([]uint64, rank)
+	for i, dim := range cDims {
+		dims[i] = uint64(dim)
+	}
+	return dims, nil
+}
+
+// ReadHyperslab reads a hyperslab given in HDF5 (C) order, converting values to the
+// given data type in native byte order.
+func (d *HDF5Dataset) ReadHyperslab(t DataType, start, count []uint64) ([]byte, error) {
+	if len(start) != len(count) || len(start) == 0 {
+		return nil, fmt.Errorf("Bad HDF5 hyperslab with start %v and count %v", start, count)
+	}
+	numValues := int64(1)
+	cStart := make([]C.hsize_t, len(start))
+	cCount := make([]C.hsize_t, len(count))
+	for i := range start {
+		cStart[i] = C.hsize_t(start[i])
+		cCount[i] = C.hsize_t(count[i])
+		numValues *= int64(count[i])
+	}
+	data := make([]byte, numValues*int64(DataTypeBytes(t)))
+	if len(data) == 0 {
+		return data, nil
+	}
+	StartCgo()
+	status := C.dvid_read_hyperslab(d.dataset, C.int(t), C.int(len(start)), &cStart[0], &cCount[0],
+		unsafe.Pointer(&data[0]))
+	StopCgo()
+	if status < 0 {
+		return nil, fmt.Errorf("Unable to read hyperslab %v + %v of HDF5 dataset '%s'", start, count, d.path)
+	}
+	return data, nil
+}
+
+// Close releases the dataset and its file.
+func (d *HDF5Dataset) Close() error {
+	StartCgo()
+	defer StopCgo()
+	C.H5Dclose(d.dataset)
+	if C.H5Fclose(d.file) < 0 {
+		return fmt.Errorf("Error closing HDF5 file for dataset '%s'", d.path)
+	}
+	return nil
+}
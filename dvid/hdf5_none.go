@@ -0,0 +1,32 @@
+// +build !hdf5
+
+package dvid
+
+import "fmt"
+
+// HDF5Dataset is an open dataset within an HDF5 file.  DVID must be built with the
+// "hdf5" build tag to read HDF5 files.
+type HDF5Dataset struct{}
+
+var errNoHDF5 = fmt.Errorf("DVID was not built with HDF5 support.  Rebuild with the 'hdf5' tag.")
+
+// OpenHDF5Dataset opens a dataset within an HDF5 file for reading.
+func OpenHDF5Dataset(filename, path string) (*HDF5Dataset, error) {
+	return nil, errNoHDF5
+}
+
+// Dims returns the dimensions of the dataset in HDF5 (C) order, i.e., slowest varying first.
+func (d *HDF5Dataset) Dims() ([]uint64, error) {
+	return nil, errNoHDF5
+}
+
+// ReadHyperslab reads a hyperslab given in HDF5 (C) order, converting values to the
+// given data type in native byte order.
+func (d *HDF5Dataset) ReadHyperslab(t DataType, start, count []uint64) ([]byte, error) {
+	return nil, errNoHDF5
+}
+
+// Close releases the dataset and its file.
+func (d *HDF5Dataset) Close() error {
+	return errNoHDF5
+}
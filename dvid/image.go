@@ -25,6 +25,7 @@ import (
 	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -32,8 +33,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/janelia-flyem/go/go.image/bmp"
-	"github.com/janelia-flyem/go/go.image/tiff"
+	_ "github.com/janelia-flyem/go/go.image/tiff" // registers TIFF decoding
 
 	"github.com/janelia-flyem/go/freetype-go/freetype"
 	"github.com/janelia-flyem/go/freetype-go/freetype/raster"
@@ -1181,43 +1181,121 @@ func ImageGrayFromData(data []uint8, nx, ny int) (img *image.Gray) {
 	return
 }
 
+// ImageEncoder writes an image in some format given an option string, e.g., the "75" in "webp:75".
+// An empty option string should result in default encoding settings.
+type ImageEncoder func(w io.Writer, img image.Image, option string) error
+
+// Formats that can be negotiated via the Accept header in order of preference.
+var negotiableFormats = []struct {
+	contentType string
+	format      string
+}{
+	{"image/avif", "avif"},
+	{"image/webp", "webp"},
+}
+
+// NegotiateImageFormat returns the image format to use for a response.  An explicit
+// format string, e.g., from the URL suffix, always takes precedence.  Otherwise, if the
+// client's Accept header lists a more compact format supported by this server, that
+// format is used.  An empty string denotes the default format (PNG).  Since the response
+// then depends on the Accept header, caches are notified via the Vary header.
+func NegotiateImageFormat(w http.ResponseWriter, r *http.Request, formatStr string) string {
+	if formatStr != "" || r == nil {
+		return formatStr
+	}
+	w.Header().Add("Vary", "Accept")
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return ""
+	}
+	for _, negotiable := range negotiableFormats {
+		if t, found := transcoders[negotiable.format]; !found || t.EncodeImage == nil {
+			continue
+		}
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			if strings.TrimSpace(params[0]) != negotiable.contentType {
+				continue
+			}
+			refused := false
+			for _, param := range params[1:] {
+				if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" {
+					refused = true
+				}
+			}
+			if !refused {
+				return negotiable.format
+			}
+		}
+	}
+	return ""
+}
+
 // WriteImageHttp writes an image to a HTTP response writer using a format and optional
-// compression strength specified in a string, e.g., "png", "jpg:80".
+// compression strength specified in a string, e.g., "png", "jpg:80", "tiff:lzw", or "webp:lossless".
+// Any registered transcoder that can encode images may be used.  The default is PNG.
 func WriteImageHttp(w http.ResponseWriter, img image.Image, formatStr string) error {
-	format := strings.Split(formatStr, ":")
-	var compression int = DefaultJPEGQuality
-	var err error
-	if len(format) > 1 {
-		compression, err = strconv.Atoi(format[1])
-		if err != nil {
-			return err
-		}
+	if formatStr == "" {
+		formatStr = "png"
 	}
-	switch format[0] {
-	case "", "png":
-		w.Header().Set("Content-type", "image/png")
-		if err = png.Encode(w, img); err != nil {
-			return err
-		}
-	case "jpg", "jpeg":
-		w.Header().Set("Content-type", "image/jpeg")
-		if err = jpeg.Encode(w, img, &jpeg.Options{Quality: compression}); err != nil {
-			return err
-		}
-	case "tiff", "tif":
-		w.Header().Set("Content-type", "image/tiff")
-		if err = tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
-			return err
-		}
-	case "bmp":
-		w.Header().Set("Content-type", "image/bmp")
-		if err = bmp.Encode(w, img); err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("Illegal image format requested: %s", format[0])
+	t, option, err := GetTranscoder(formatStr)
+	if err != nil || t.EncodeImage == nil {
+		return fmt.Errorf("Illegal image format requested: %s", formatStr)
 	}
-	return nil
+	// Encode into a buffer first so errors can still be returned as a bad request.
+	buf := GetBytesBuffer()
+	defer PutBytesBuffer(buf)
+	if err = t.EncodeImage(buf, img, option); err != nil {
+		return err
+	}
+	w.Header().Set("Content-type", t.ContentType)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// WriteTIFFHttp writes images as a (possibly multi-page) TIFF to a HTTP response writer.
+// The option string selects the compression: "lzw", "deflate" (default), or "none".
+func WriteTIFFHttp(w http.ResponseWriter, pages []image.Image, option string) error {
+	compression, err := StringToTIFFCompression(option)
+	if err != nil {
+		return err
+	}
+	buf := GetBytesBuffer()
+	defer PutBytesBuffer(buf)
+	if err = EncodeTIFF(buf, pages, compression); err != nil {
+		return err
+	}
+	w.Header().Set("Content-type", "image/tiff")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ParseImageQuality returns an integer quality in [0, 100] from an option string,
+// or the default value if the option is empty.
+func ParseImageQuality(option string, defaultQuality int) (int, error) {
+	if option == "" {
+		return defaultQuality, nil
+	}
+	quality, err := strconv.Atoi(option)
+	if err != nil {
+		return 0, fmt.Errorf("Bad image quality '%s': %s", option, err.Error())
+	}
+	if quality < 0 || quality > 100 {
+		return 0, fmt.Errorf("Image quality must be between 0 and 100, not %d", quality)
+	}
+	return quality, nil
+}
+
+// ImageToNRGBA returns the image as 8-bit non-premultiplied RGBA, converting if necessary.
+// Higher bit depths are truncated to 8 bits per channel.
+func ImageToNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == image.ZP {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	return nrgba
 }
 
 // PrintNonZero prints the number of non-zero bytes in a slice of bytes.
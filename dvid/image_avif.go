@@ -0,0 +1,90 @@
+// +build avif
+
+/*
+	This file adds AVIF image output using libavif (v1.0 or later), which must be installed
+	to build DVID with the "avif" build tag.
+*/
+
+package dvid
+
+/*
+#cgo LDFLAGS: -lavif
+#include <string.h>
+#include <avif/avif.h>
+
+// encodeAVIF encodes 8-bit RGBA pixels into an AVIF image.  The pixels are only
+// referenced during the call, so Go memory can be passed in.
+static avifResult encodeAVIF(uint8_t* pixels, int width, int height, int stride, int quality,
+		avifRWData* output) {
+	avifResult result;
+	avifRGBImage rgb;
+	avifEncoder* encoder = NULL;
+	avifImage* image = avifImageCreate(width, height, 8, AVIF_PIXEL_FORMAT_YUV444);
+	if (image == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	rgb.pixels = pixels;
+	rgb.rowBytes = stride;
+	result = avifImageRGBToYUV(image, &rgb);
+	if (result == AVIF_RESULT_OK) {
+		encoder = avifEncoderCreate();
+		if (encoder == NULL) {
+			result = AVIF_RESULT_OUT_OF_MEMORY;
+		} else {
+			encoder->quality = quality;
+			encoder->qualityAlpha = AVIF_QUALITY_LOSSLESS;
+			encoder->speed = AVIF_SPEED_FASTEST;
+			result = avifEncoderWrite(encoder, image, output);
+			avifEncoderDestroy(encoder);
+		}
+	}
+	avifImageDestroy(image);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+// DefaultAVIFQuality is the quality of AVIF images if not explicitly requested.
+const DefaultAVIFQuality = 60
+
+func init() {
+	RegisterImageFormat("avif", "image/avif", encodeAVIF)
+}
+
+// encodeAVIF writes an AVIF image where the option is a quality in [0, 100].
+func encodeAVIF(w io.Writer, img image.Image, option string) error {
+	quality, err := ParseImageQuality(option, DefaultAVIFQuality)
+	if err != nil {
+		return err
+	}
+	nrgba := ImageToNRGBA(img)
+	width := nrgba.Rect.Dx()
+	height := nrgba.Rect.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("Cannot encode empty image into AVIF")
+	}
+	pixels := (*C.uint8_t)(unsafe.Pointer(&nrgba.Pix[0]))
+
+	var output C.avifRWData
+	StartCgo()
+	result := C.encodeAVIF(pixels, C.int(width), C.int(height), C.int(nrgba.Stride), C.int(quality), &output)
+	StopCgo()
+	if result != C.AVIF_RESULT_OK {
+		return fmt.Errorf("Unable to encode %d x %d image into AVIF: %s", width, height,
+			C.GoString(C.avifResultToString(result)))
+	}
+	defer C.avifRWDataFree(&output)
+
+	_, err = w.Write(C.GoBytes(unsafe.Pointer(output.data), C.int(output.size)))
+	return err
+}
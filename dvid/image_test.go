@@ -2,6 +2,10 @@ package dvid
 
 import (
 	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
 	. "github.com/janelia-flyem/go/gocheck"
 )
 
@@ -166,3 +170,54 @@ func (suite *DataSuite) TestCompression(c *C) {
 	c.Assert(newImg.Which, Equals, uint8(0))
 	c.Assert(newImg.Gray, DeepEquals, goImg)
 }
+
+func (suite *DataSuite) TestImageFormatNegotiation(c *C) {
+	var gotOption string
+	RegisterImageFormat("testfmt", "image/x-test", func(w io.Writer, img image.Image, option string) error {
+		gotOption = option
+		_, err := w.Write([]byte("test"))
+		return err
+	})
+	defer delete(transcoders, "testfmt")
+
+	negotiableFormats = append(negotiableFormats, struct {
+		contentType string
+		format      string
+	}{"image/x-test", "testfmt"})
+	defer func() { negotiableFormats = negotiableFormats[:len(negotiableFormats)-1] }()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	c.Assert(NegotiateImageFormat(w, r, "jpg:50"), Equals, "jpg:50")
+	c.Assert(NegotiateImageFormat(w, r, ""), Equals, "")
+
+	r.Header.Set("Accept", "image/x-test;q=0, image/png")
+	c.Assert(NegotiateImageFormat(w, r, ""), Equals, "")
+
+	r.Header.Set("Accept", "text/html, image/x-test;q=0.8, */*")
+	c.Assert(NegotiateImageFormat(w, r, ""), Equals, "testfmt")
+	c.Assert(w.Header().Get("Vary"), Equals, "Accept")
+
+	goImg := ImageGrayFromData(makeSlice(Point3d{0, 0, 0}, Point2d{8, 8}), 8, 8)
+	err := WriteImageHttp(w, goImg, "testfmt:lossless")
+	c.Assert(err, IsNil)
+	c.Assert(gotOption, Equals, "lossless")
+	c.Assert(w.Header().Get("Content-type"), Equals, "image/x-test")
+	c.Assert(w.Body.String(), Equals, "test")
+
+	err = WriteImageHttp(httptest.NewRecorder(), goImg, "nosuchformat")
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestParseImageQuality(c *C) {
+	q, err := ParseImageQuality("", 75)
+	c.Assert(err, IsNil)
+	c.Assert(q, Equals, 75)
+	q, err = ParseImageQuality("40", 75)
+	c.Assert(err, IsNil)
+	c.Assert(q, Equals, 40)
+	_, err = ParseImageQuality("101", 75)
+	c.Assert(err, NotNil)
+	_, err = ParseImageQuality("high", 75)
+	c.Assert(err, NotNil)
+}
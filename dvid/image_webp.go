@@ -0,0 +1,68 @@
+// +build webp
+
+/*
+	This file adds WebP image output using libwebp, which must be installed to build
+	DVID with the "webp" build tag.
+*/
+
+package dvid
+
+/*
+#cgo LDFLAGS: -lwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+// DefaultWebPQuality is the quality of lossy WebP images if not explicitly requested.
+const DefaultWebPQuality = 75
+
+func init() {
+	RegisterImageFormat("webp", "image/webp", encodeWebP)
+}
+
+// encodeWebP writes a WebP image where the option is a quality in [0, 100] for lossy
+// compression or "lossless".
+func encodeWebP(w io.Writer, img image.Image, option string) error {
+	lossless := (option == "lossless")
+	var quality int
+	if !lossless {
+		var err error
+		quality, err = ParseImageQuality(option, DefaultWebPQuality)
+		if err != nil {
+			return err
+		}
+	}
+	nrgba := ImageToNRGBA(img)
+	width := nrgba.Rect.Dx()
+	height := nrgba.Rect.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("Cannot encode empty image into WebP")
+	}
+	pixels := (*C.uint8_t)(unsafe.Pointer(&nrgba.Pix[0]))
+
+	StartCgo()
+	var output *C.uint8_t
+	var size C.size_t
+	if lossless {
+		size = C.WebPEncodeLosslessRGBA(pixels, C.int(width), C.int(height), C.int(nrgba.Stride), &output)
+	} else {
+		size = C.WebPEncodeRGBA(pixels, C.int(width), C.int(height), C.int(nrgba.Stride),
+			C.float(quality), &output)
+	}
+	StopCgo()
+	if size == 0 || output == nil {
+		return fmt.Errorf("Unable to encode %d x %d image into WebP", width, height)
+	}
+	defer C.WebPFree(unsafe.Pointer(output))
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(output), C.int(size)))
+	return err
+}
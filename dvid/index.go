@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math"
+	"sort"
+	"strings"
 )
 
 func init() {
@@ -19,6 +21,9 @@ func init() {
 	gob.Register(IndexUint8(0))
 	gob.Register(IndexZYX{})
 	gob.Register(IndexCZYX{})
+	gob.Register(IndexNd{})
+	gob.Register(IndexMorton{})
+	gob.Register(IndexHilbert{})
 }
 
 // LocalID is a unique id for some data in a DVID instance.  This unique id is a much
@@ -403,12 +408,12 @@ func (i IndexCZYX) Scheme() string {
 // IndexFromBytes returns an index from bytes.  The passed Index is used just
 // to choose the appropriate byte decoding scheme.
 func (i IndexCZYX) IndexFromBytes(b []byte) (Index, error) {
-	c := int32(binary.BigEndian.Uint16(b[0:4]))
-	index, err := i.IndexFromBytes(b[4:])
+	c := int32(binary.BigEndian.Uint32(b[0:4]))
+	index, err := i.IndexZYX.IndexFromBytes(b[4:])
 	if err != nil {
 		return nil, err
 	}
-	return &IndexCZYX{c, index.(IndexZYX)}, nil
+	return &IndexCZYX{c, *index.(*IndexZYX)}, nil
 }
 
 // ----- IndexIterator implementation ------------
@@ -457,16 +462,628 @@ func (it *IndexCZYXIterator) NextSpan() {
 	}
 }
 
-// TODO -- Morton (Z-order) curve
-type IndexMorton []byte
+// IndexNd implements the Index interface for n-d chunk coordinates, ordering chunks
+// by the highest dimension first down to the first dimension (X).  For 4d data with
+// dimensions X, Y, Z, t, this gives keys sorted by t, then Z, Y, and X so that time
+// series, channels, or scale levels can be modeled as extra dimensions instead of
+// bespoke indices like IndexCZYX.
+type IndexNd ChunkPointNd
+
+func (i IndexNd) Duplicate() Index {
+	dup := make(IndexNd, len(i))
+	copy(dup, i)
+	return dup
+}
+
+func (i IndexNd) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a byte representation of the Index with each dimension converted
+// to unsigned integer space and written big endian, highest dimension first.
+func (i IndexNd) Bytes() []byte {
+	buf := make([]byte, 4*len(i))
+	for dim := len(i) - 1; dim >= 0; dim-- {
+		pos := 4 * (len(i) - 1 - dim)
+		binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(int64(i[dim])-math.MinInt32))
+	}
+	return buf
+}
+
+// Hash returns an integer [0, n).
+func (i IndexNd) Hash(n int) int {
+	var sum int64
+	for _, value := range i {
+		sum += int64(value)
+	}
+	h := int(sum % int64(n))
+	if h < 0 {
+		h += n
+	}
+	return h
+}
+
+func (i IndexNd) Scheme() string {
+	return "N-d Indexing"
+}
+
+// IndexFromBytes returns an index from bytes.  The dimensionality of the index is
+// determined by the number of bytes.
+func (i IndexNd) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < 8 || len(b)%4 != 0 {
+		return nil, fmt.Errorf("Cannot decode %d bytes into n-d index", len(b))
+	}
+	numDims := len(b) / 4
+	index := make(IndexNd, numDims)
+	for dim := 0; dim < numDims; dim++ {
+		pos := 4 * (numDims - 1 - dim)
+		index[dim] = int32(int64(binary.BigEndian.Uint32(b[pos:pos+4])) + math.MinInt32)
+	}
+	return index, nil
+}
+
+func (i IndexNd) NumDims() uint8 {
+	return uint8(len(i))
+}
+
+// Value returns the value at the specified dimension for this index.
+func (i IndexNd) Value(dim uint8) int32 {
+	return i[dim]
+}
+
+// MinPoint returns the minimum voxel coordinate for a chunk.
+func (i IndexNd) MinPoint(size Point) Point {
+	return ChunkPointNd(i).MinPoint(size)
+}
+
+// MaxPoint returns the maximum voxel coordinate for a chunk.
+func (i IndexNd) MaxPoint(size Point) Point {
+	return ChunkPointNd(i).MaxPoint(size)
+}
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexNd) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	var changed bool
+	min := i.Duplicate().(IndexNd)
+	for dim := range min {
+		if min[dim] > idx.Value(uint8(dim)) {
+			min[dim] = idx.Value(uint8(dim))
+			changed = true
+		}
+	}
+	return min, changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexNd) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	var changed bool
+	max := i.Duplicate().(IndexNd)
+	for dim := range max {
+		if max[dim] < idx.Value(uint8(dim)) {
+			max[dim] = idx.Value(uint8(dim))
+			changed = true
+		}
+	}
+	return max, changed
+}
+
+// ----- IndexIterator implementation ------------
+
+// IndexNdIterator iterates over runs along the first dimension of an n-d box of chunks.
+type IndexNdIterator struct {
+	cursor   ChunkPointNd
+	begBlock ChunkPointNd
+	endBlock ChunkPointNd
+}
+
+// NewIndexNdIterator returns an IndexIterator that iterates over n-d space.
+func NewIndexNdIterator(start, end ChunkPointNd) (*IndexNdIterator, error) {
+	if len(start) != len(end) || len(start) < 2 {
+		return nil, fmt.Errorf("Cannot iterate from %s to %s", start, end)
+	}
+	cursor := make(ChunkPointNd, len(start))
+	copy(cursor, start)
+	return &IndexNdIterator{cursor, start, end}, nil
+}
+
+func (it *IndexNdIterator) Valid() bool {
+	for dim := len(it.cursor) - 1; dim > 0; dim-- {
+		if it.cursor[dim] != it.endBlock[dim] {
+			return it.cursor[dim] < it.endBlock[dim]
+		}
+	}
+	return true
+}
+
+func (it *IndexNdIterator) IndexSpan() (beg, end Index, err error) {
+	begIndex := IndexNd(it.cursor).Duplicate().(IndexNd)
+	endIndex := IndexNd(it.cursor).Duplicate().(IndexNd)
+	begIndex[0] = it.begBlock[0]
+	endIndex[0] = it.endBlock[0]
+	return begIndex, endIndex, nil
+}
+
+func (it *IndexNdIterator) NextSpan() {
+	for dim := 1; dim < len(it.cursor); dim++ {
+		it.cursor[dim]++
+		if it.cursor[dim] <= it.endBlock[dim] || dim == len(it.cursor)-1 {
+			return
+		}
+		it.cursor[dim] = it.begBlock[dim]
+	}
+}
+
+// SpanIndices returns all indices in the current span.
+func (it *IndexNdIterator) SpanIndices() []ChunkIndexer {
+	beg, _, _ := it.IndexSpan()
+	begIndex := beg.(IndexNd)
+	indices := make([]ChunkIndexer, 0, it.endBlock[0]-it.begBlock[0]+1)
+	for x := it.begBlock[0]; x <= it.endBlock[0]; x++ {
+		index := begIndex.Duplicate().(IndexNd)
+		index[0] = x
+		indices = append(indices, index)
+	}
+	return indices
+}
+
+// IndexScheme enumerates the spatial indexing schemes that can be used to map
+// 3d chunk coordinates into keys.
+type IndexScheme uint8
+
+const (
+	// ZYXIndexing orders chunks by Z, then Y, then X.
+	ZYXIndexing IndexScheme = iota
+
+	// MortonIndexing orders chunks along a Morton (Z-order) curve.
+	MortonIndexing
+
+	// HilbertIndexing orders chunks along a Hilbert curve.
+	HilbertIndexing
+)
+
+func (s IndexScheme) String() string {
+	switch s {
+	case ZYXIndexing:
+		return "zyx"
+	case MortonIndexing:
+		return "morton"
+	case HilbertIndexing:
+		return "hilbert"
+	default:
+		return fmt.Sprintf("unknown index scheme %d", s)
+	}
+}
+
+// StringToIndexScheme returns an IndexScheme given a case-insensitive name:
+// "zyx", "morton" (or "zorder"), or "hilbert".
+func StringToIndexScheme(s string) (IndexScheme, error) {
+	switch strings.ToLower(s) {
+	case "zyx":
+		return ZYXIndexing, nil
+	case "morton", "zorder", "z-order":
+		return MortonIndexing, nil
+	case "hilbert":
+		return HilbertIndexing, nil
+	default:
+		return ZYXIndexing, fmt.Errorf("Unknown index scheme '%s'", s)
+	}
+}
+
+// Index returns the ChunkIndexer for the given chunk coordinate under this scheme.
+func (s IndexScheme) Index(c ChunkPoint3d) ChunkIndexer {
+	switch s {
+	case MortonIndexing:
+		return IndexMorton(c)
+	case HilbertIndexing:
+		return IndexHilbert(c)
+	default:
+		return IndexZYX(c)
+	}
+}
+
+// NewIterator returns an IndexIterator over the chunks from start to end, inclusive,
+// with spans that are contiguous in this scheme's key space.
+func (s IndexScheme) NewIterator(start, end ChunkPoint3d) IndexIterator {
+	switch s {
+	case MortonIndexing:
+		return NewIndexMortonIterator(start, end)
+	case HilbertIndexing:
+		return NewIndexHilbertIterator(start, end)
+	default:
+		return NewIndexZYXIterator(start, end)
+	}
+}
+
+// SpanIterator is an IndexIterator whose spans are not necessarily runs along the
+// X dimension, e.g., runs of consecutive indices along a space-filling curve.
+type SpanIterator interface {
+	IndexIterator
+
+	// SpanIndices returns all indices in the current span in key order.
+	SpanIndices() []ChunkIndexer
+}
+
+// toUnsigned3d converts a signed chunk coordinate into unsigned coordinate space
+// so that (MinInt32, MinInt32, MinInt32) maps to (0,0,0).  The returned array is
+// ordered Z, Y, X so the most significant bits of any curve come from Z.
+func toUnsigned3d(c ChunkPoint3d) [3]uint32 {
+	return [3]uint32{
+		uint32(int64(c[2]) - math.MinInt32),
+		uint32(int64(c[1]) - math.MinInt32),
+		uint32(int64(c[0]) - math.MinInt32),
+	}
+}
+
+func fromUnsigned3d(u [3]uint32) ChunkPoint3d {
+	return ChunkPoint3d{
+		int32(int64(u[2]) + math.MinInt32),
+		int32(int64(u[1]) + math.MinInt32),
+		int32(int64(u[0]) + math.MinInt32),
+	}
+}
+
+// interleave3d packs 3 x 32-bit values into a 96-bit big endian byte slice
+// with bits ordered u[0], u[1], u[2] from most to least significant at each level.
+func interleave3d(u [3]uint32) []byte {
+	buf := make([]byte, 12, 12)
+	bit := 0
+	for level := 31; level >= 0; level-- {
+		for dim := 0; dim < 3; dim++ {
+			if (u[dim]>>uint(level))&1 != 0 {
+				buf[bit>>3] |= 0x80 >> uint(bit&7)
+			}
+			bit++
+		}
+	}
+	return buf
+}
+
+func deinterleave3d(b []byte) (u [3]uint32) {
+	bit := 0
+	for level := 31; level >= 0; level-- {
+		for dim := 0; dim < 3; dim++ {
+			if b[bit>>3]&(0x80>>uint(bit&7)) != 0 {
+				u[dim] |= 1 << uint(level)
+			}
+			bit++
+		}
+	}
+	return
+}
+
+// hilbertTranspose converts coordinates in place into the "transposed" Hilbert index
+// using John Skilling's algorithm (AIP Conf. Proc. 707, 381 (2004)).
+func hilbertTranspose(x *[3]uint32) {
+	const n = 3
+	// Inverse undo excess work
+	for q := uint32(1) << 31; q > 1; q >>= 1 {
+		p := q - 1
+		for i := 0; i < n; i++ {
+			if x[i]&q != 0 {
+				x[0] ^= p
+			} else {
+				t := (x[0] ^ x[i]) & p
+				x[0] ^= t
+				x[i] ^= t
+			}
+		}
+	}
+	// Gray encode
+	for i := 1; i < n; i++ {
+		x[i] ^= x[i-1]
+	}
+	var t uint32
+	for q := uint32(1) << 31; q > 1; q >>= 1 {
+		if x[n-1]&q != 0 {
+			t ^= q - 1
+		}
+	}
+	for i := 0; i < n; i++ {
+		x[i] ^= t
+	}
+}
+
+// hilbertUntranspose is the inverse of hilbertTranspose.
+func hilbertUntranspose(x *[3]uint32) {
+	const n = 3
+	// Gray decode
+	t := x[n-1] >> 1
+	for i := n - 1; i > 0; i-- {
+		x[i] ^= x[i-1]
+	}
+	x[0] ^= t
+	// Undo excess work
+	for q := uint32(2); q != 0; q <<= 1 {
+		p := q - 1
+		for i := n - 1; i >= 0; i-- {
+			if x[i]&q != 0 {
+				x[0] ^= p
+			} else {
+				t := (x[0] ^ x[i]) & p
+				x[0] ^= t
+				x[i] ^= t
+			}
+		}
+	}
+}
+
+// minChunkPoint3d and maxChunkPoint3d return the per-dimension extremes of two chunk points.
+func minChunkPoint3d(a ChunkPoint3d, idx ChunkIndexer) (ChunkPoint3d, bool) {
+	var changed bool
+	for dim := uint8(0); dim < 3; dim++ {
+		if a[dim] > idx.Value(dim) {
+			a[dim] = idx.Value(dim)
+			changed = true
+		}
+	}
+	return a, changed
+}
+
+func maxChunkPoint3d(a ChunkPoint3d, idx ChunkIndexer) (ChunkPoint3d, bool) {
+	var changed bool
+	for dim := uint8(0); dim < 3; dim++ {
+		if a[dim] < idx.Value(dim) {
+			a[dim] = idx.Value(dim)
+			changed = true
+		}
+	}
+	return a, changed
+}
+
+// IndexMorton implements the Index interface using a Morton (Z-order) curve, which
+// interleaves the bits of the Z, Y, and X chunk coordinates.  Chunks that are close
+// in 3d tend to be close in key space, so subvolume requests touch fewer key ranges
+// than with IndexZYX.  As with IndexZYX, coordinates are shifted into unsigned space
+// before encoding.
+type IndexMorton ChunkPoint3d
+
+const IndexMortonSize = ChunkPoint3dSize
+
+func (i IndexMorton) Duplicate() Index {
+	dup := i
+	return dup
+}
+
+func (i IndexMorton) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a 96-bit big endian Morton code for the index.
+func (i IndexMorton) Bytes() []byte {
+	return interleave3d(toUnsigned3d(ChunkPoint3d(i)))
+}
+
+// Hash returns an integer [0, n).
+func (i IndexMorton) Hash(n int) int {
+	return IndexZYX(i).Hash(n)
+}
 
 func (i IndexMorton) Scheme() string {
 	return "Morton/Z-order Indexing"
 }
 
-// TODO -- Hilbert curve
-type IndexHilbert []byte
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexMorton) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexMortonSize {
+		return nil, fmt.Errorf("Cannot decode %d bytes into Morton index", len(b))
+	}
+	index := IndexMorton(fromUnsigned3d(deinterleave3d(b)))
+	return &index, nil
+}
+
+func (i IndexMorton) NumDims() uint8 {
+	return 3
+}
+
+// Value returns the value at the specified dimension for this index.
+func (i IndexMorton) Value(dim uint8) int32 {
+	return i[dim]
+}
+
+// MinPoint returns the minimum voxel coordinate for a chunk.
+func (i IndexMorton) MinPoint(size Point) Point {
+	return ChunkPoint3d(i).MinPoint(size)
+}
+
+// MaxPoint returns the maximum voxel coordinate for a chunk.
+func (i IndexMorton) MaxPoint(size Point) Point {
+	return ChunkPoint3d(i).MaxPoint(size)
+}
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexMorton) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	min, changed := minChunkPoint3d(ChunkPoint3d(i), idx)
+	return IndexMorton(min), changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexMorton) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	max, changed := maxChunkPoint3d(ChunkPoint3d(i), idx)
+	return IndexMorton(max), changed
+}
+
+// IndexHilbert implements the Index interface using a 3d Hilbert curve.  Unlike
+// the Morton curve, consecutive Hilbert indices are always adjacent chunks, so
+// locality is better preserved at the cost of more expensive encoding.
+type IndexHilbert ChunkPoint3d
+
+const IndexHilbertSize = ChunkPoint3dSize
+
+func (i IndexHilbert) Duplicate() Index {
+	dup := i
+	return dup
+}
+
+func (i IndexHilbert) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a 96-bit big endian Hilbert code for the index.
+func (i IndexHilbert) Bytes() []byte {
+	u := toUnsigned3d(ChunkPoint3d(i))
+	hilbertTranspose(&u)
+	return interleave3d(u)
+}
+
+// Hash returns an integer [0, n).
+func (i IndexHilbert) Hash(n int) int {
+	return IndexZYX(i).Hash(n)
+}
 
 func (i IndexHilbert) Scheme() string {
 	return "Hilbert Indexing"
 }
+
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexHilbert) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexHilbertSize {
+		return nil, fmt.Errorf("Cannot decode %d bytes into Hilbert index", len(b))
+	}
+	u := deinterleave3d(b)
+	hilbertUntranspose(&u)
+	index := IndexHilbert(fromUnsigned3d(u))
+	return &index, nil
+}
+
+func (i IndexHilbert) NumDims() uint8 {
+	return 3
+}
+
+// Value returns the value at the specified dimension for this index.
+func (i IndexHilbert) Value(dim uint8) int32 {
+	return i[dim]
+}
+
+// MinPoint returns the minimum voxel coordinate for a chunk.
+func (i IndexHilbert) MinPoint(size Point) Point {
+	return ChunkPoint3d(i).MinPoint(size)
+}
+
+// MaxPoint returns the maximum voxel coordinate for a chunk.
+func (i IndexHilbert) MaxPoint(size Point) Point {
+	return ChunkPoint3d(i).MaxPoint(size)
+}
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexHilbert) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	min, changed := minChunkPoint3d(ChunkPoint3d(i), idx)
+	return IndexHilbert(min), changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexHilbert) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	max, changed := maxChunkPoint3d(ChunkPoint3d(i), idx)
+	return IndexHilbert(max), changed
+}
+
+// ----- IndexIterator implementation for space-filling curves ------------
+
+// curveSpans holds the runs of consecutive curve indices that cover a box of chunks.
+type curveSpans struct {
+	spans [][]ChunkIndexer
+	cur   int
+}
+
+// byIndexBytes sorts indices lexicographically by their byte representation.
+type byIndexBytes struct {
+	indices []ChunkIndexer
+	keys    [][]byte
+}
+
+func (s byIndexBytes) Len() int { return len(s.indices) }
+
+func (s byIndexBytes) Less(i, j int) bool { return bytes.Compare(s.keys[i], s.keys[j]) < 0 }
+
+func (s byIndexBytes) Swap(i, j int) {
+	s.indices[i], s.indices[j] = s.indices[j], s.indices[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// isSuccessor returns true if b is the big endian integer a + 1.
+func isSuccessor(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	next := make([]byte, len(a))
+	copy(next, a)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return bytes.Equal(next, b)
+}
+
+func newCurveSpans(scheme IndexScheme, start, end ChunkPoint3d) curveSpans {
+	var sorted byIndexBytes
+	for z := start[2]; z <= end[2]; z++ {
+		for y := start[1]; y <= end[1]; y++ {
+			for x := start[0]; x <= end[0]; x++ {
+				index := scheme.Index(ChunkPoint3d{x, y, z})
+				sorted.indices = append(sorted.indices, index)
+				sorted.keys = append(sorted.keys, index.Bytes())
+			}
+		}
+	}
+	sort.Sort(sorted)
+
+	var spans [][]ChunkIndexer
+	for i, index := range sorted.indices {
+		if i == 0 || !isSuccessor(sorted.keys[i-1], sorted.keys[i]) {
+			spans = append(spans, []ChunkIndexer{index})
+		} else {
+			last := len(spans) - 1
+			spans[last] = append(spans[last], index)
+		}
+	}
+	return curveSpans{spans: spans}
+}
+
+func (c *curveSpans) Valid() bool {
+	return c.cur < len(c.spans)
+}
+
+func (c *curveSpans) IndexSpan() (beg, end Index, err error) {
+	if c.cur >= len(c.spans) {
+		err = fmt.Errorf("Index span requested on exhausted iterator")
+		return
+	}
+	span := c.spans[c.cur]
+	beg = span[0]
+	end = span[len(span)-1]
+	return
+}
+
+func (c *curveSpans) NextSpan() {
+	c.cur++
+}
+
+func (c *curveSpans) SpanIndices() []ChunkIndexer {
+	if c.cur >= len(c.spans) {
+		return nil
+	}
+	return c.spans[c.cur]
+}
+
+// IndexMortonIterator iterates over runs of consecutive Morton indices within a box.
+type IndexMortonIterator struct {
+	curveSpans
+}
+
+// NewIndexMortonIterator returns a SpanIterator over the chunks from start to end, inclusive.
+func NewIndexMortonIterator(start, end ChunkPoint3d) *IndexMortonIterator {
+	return &IndexMortonIterator{newCurveSpans(MortonIndexing, start, end)}
+}
+
+// IndexHilbertIterator iterates over runs of consecutive Hilbert indices within a box.
+type IndexHilbertIterator struct {
+	curveSpans
+}
+
+// NewIndexHilbertIterator returns a SpanIterator over the chunks from start to end, inclusive.
+func NewIndexHilbertIterator(start, end ChunkPoint3d) *IndexHilbertIterator {
+	return &IndexHilbertIterator{newCurveSpans(HilbertIndexing, start, end)}
+}
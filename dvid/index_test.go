@@ -26,3 +26,114 @@ func (suite *DataSuite) TestNegIndicesSequential(c *C) {
 		copy(lastBytes, ibytes)
 	}
 }
+
+func (suite *DataSuite) TestCurveIndexRoundTrip(c *C) {
+	points := []ChunkPoint3d{
+		{0, 0, 0},
+		{-1, 2, -3},
+		{MaxChunkPoint3d[0], 17, MinChunkPoint3d[2]},
+		{1023, -4096, 77},
+	}
+	for _, pt := range points {
+		morton := IndexMorton(pt)
+		decoded, err := morton.IndexFromBytes(morton.Bytes())
+		c.Assert(err, IsNil)
+		c.Assert(*(decoded.(*IndexMorton)), Equals, morton)
+
+		hilbert := IndexHilbert(pt)
+		decoded, err = hilbert.IndexFromBytes(hilbert.Bytes())
+		c.Assert(err, IsNil)
+		c.Assert(*(decoded.(*IndexHilbert)), Equals, hilbert)
+	}
+}
+
+// Consecutive Hilbert indices must always be face-adjacent chunks.  An aligned
+// cube of chunks should be a single span.
+func (suite *DataSuite) TestHilbertAdjacency(c *C) {
+	start := ChunkPoint3d{0, 0, 0}
+	end := ChunkPoint3d{3, 3, 3}
+	it := NewIndexHilbertIterator(start, end)
+	c.Assert(it.Valid(), Equals, true)
+	indices := it.SpanIndices()
+	c.Assert(len(indices), Equals, 64)
+	for n := 1; n < len(indices); n++ {
+		var dist int32
+		for dim := uint8(0); dim < 3; dim++ {
+			d := indices[n].Value(dim) - indices[n-1].Value(dim)
+			if d < 0 {
+				d = -d
+			}
+			dist += d
+		}
+		c.Assert(dist, Equals, int32(1))
+	}
+}
+
+// Spans from curve iterators must cover each chunk in the box exactly once in key order.
+func (suite *DataSuite) TestCurveIteratorCoverage(c *C) {
+	start := ChunkPoint3d{-3, 2, 5}
+	end := ChunkPoint3d{4, 6, 7}
+	for _, scheme := range []IndexScheme{MortonIndexing, HilbertIndexing} {
+		seen := make(map[ChunkPoint3d]bool)
+		var lastBytes []byte
+		for it := scheme.NewIterator(start, end); it.Valid(); it.NextSpan() {
+			beg, end, err := it.IndexSpan()
+			c.Assert(err, IsNil)
+			c.Assert(bytes.Compare(beg.Bytes(), end.Bytes()) <= 0, Equals, true)
+			for _, index := range it.(SpanIterator).SpanIndices() {
+				ibytes := index.Bytes()
+				if lastBytes != nil && bytes.Compare(lastBytes, ibytes) >= 0 {
+					c.Errorf("%s spans yield non-ascending binary: %x >= %x\n", scheme, lastBytes, ibytes)
+				}
+				lastBytes = ibytes
+				pt := ChunkPoint3d{index.Value(0), index.Value(1), index.Value(2)}
+				c.Assert(seen[pt], Equals, false)
+				seen[pt] = true
+			}
+		}
+		c.Assert(len(seen), Equals, 8*5*3)
+	}
+}
+
+func (suite *DataSuite) TestIndexNd(c *C) {
+	i := IndexNd{-7, 3, 1000, 2}
+	decoded, err := i.IndexFromBytes(i.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, i)
+
+	// Highest dimension should be most significant.
+	a := IndexNd{100, 100, 100, 1}
+	b := IndexNd{-100, -100, -100, 2}
+	c.Assert(bytes.Compare(a.Bytes(), b.Bytes()) < 0, Equals, true)
+
+	max := i.MaxPoint(PointNd{4, 4, 4, 4})
+	c.Assert(max, DeepEquals, PointNd{-25, 15, 4003, 11})
+	min := i.MinPoint(PointNd{4, 4, 4, 4})
+	c.Assert(min, DeepEquals, PointNd{-28, 12, 4000, 8})
+}
+
+func (suite *DataSuite) TestIndexNdIterator(c *C) {
+	start := ChunkPointNd{0, -1, 2, 5}
+	end := ChunkPointNd{2, 0, 3, 6}
+	it, err := NewIndexNdIterator(start, end)
+	c.Assert(err, IsNil)
+	var numSpans, numIndices int
+	var lastBytes []byte
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexNd)[0], Equals, int32(0))
+		c.Assert(end.(IndexNd)[0], Equals, int32(2))
+		for _, index := range it.SpanIndices() {
+			ibytes := index.Bytes()
+			if lastBytes != nil && bytes.Compare(lastBytes, ibytes) >= 0 {
+				c.Errorf("n-d iteration yields non-ascending binary: %x >= %x\n", lastBytes, ibytes)
+			}
+			lastBytes = ibytes
+			numIndices++
+		}
+		numSpans++
+	}
+	c.Assert(numSpans, Equals, 8)
+	c.Assert(numIndices, Equals, 24)
+}
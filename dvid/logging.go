@@ -0,0 +1,146 @@
+/*
+	This file supports run modes set per module at runtime, so debug logging can be turned
+	on for one part of DVID, e.g., the storage layer for ten minutes, without restarting
+	the server or flooding the log with messages from every other module.  A module is the
+	name of the package directory that logs, e.g., "storage", "server", or "voxels".
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AllModules is the module name whose mode applies to every module.
+const AllModules = "all"
+
+// String returns the name of the mode.
+func (mode ModeFlag) String() string {
+	switch mode {
+	case Normal:
+		return "normal"
+	case Debug:
+		return "debug"
+	case Benchmark:
+		return "benchmark"
+	default:
+		return fmt.Sprintf("mode %d", uint(mode))
+	}
+}
+
+// ParseModeFlag returns the mode with the given name.
+func ParseModeFlag(name string) (ModeFlag, error) {
+	switch strings.ToLower(name) {
+	case "normal":
+		return Normal, nil
+	case "debug":
+		return Debug, nil
+	case "benchmark":
+		return Benchmark, nil
+	default:
+		return Normal, fmt.Errorf("Unknown run mode %q: expected 'normal', 'debug', or 'benchmark'", name)
+	}
+}
+
+// ModuleMode is a run mode set for one module.  A zero Expires never expires.
+type ModuleMode struct {
+	Module  string
+	Mode    ModeFlag
+	Expires time.Time `json:",omitempty"`
+}
+
+var (
+	moduleModesMu sync.RWMutex
+	moduleModes   = make(map[string]ModuleMode)
+)
+
+// SetModuleMode sets the run mode of a module, replacing the global Mode for messages
+// logged by that module.  A positive duration returns the module to the global Mode once
+// it elapses.
+func SetModuleMode(module string, mode ModeFlag, duration time.Duration) {
+	setting := ModuleMode{Module: module, Mode: mode}
+	if duration > 0 {
+		setting.Expires = time.Now().Add(duration)
+	}
+	moduleModesMu.Lock()
+	moduleModes[module] = setting
+	moduleModesMu.Unlock()
+}
+
+// ResetModuleMode returns a module to the global Mode.
+func ResetModuleMode(module string) {
+	moduleModesMu.Lock()
+	delete(moduleModes, module)
+	moduleModesMu.Unlock()
+}
+
+// ModuleModes returns the unexpired run modes set for modules, sorted by module.
+func ModuleModes() []ModuleMode {
+	now := time.Now()
+	moduleModesMu.Lock()
+	defer moduleModesMu.Unlock()
+	modes := make([]ModuleMode, 0, len(moduleModes))
+	for module, setting := range moduleModes {
+		if !setting.Expires.IsZero() && now.After(setting.Expires) {
+			delete(moduleModes, module)
+			continue
+		}
+		modes = append(modes, setting)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i].Module < modes[j].Module })
+	return modes
+}
+
+// ModeOn returns true if messages of the given mode would be logged by the calling
+// module, e.g., to skip preparing debug output nobody will see.
+func ModeOn(mode ModeFlag) bool {
+	return modeOn(mode, 1)
+}
+
+// modeOn returns true if the given mode is on for the module of the function skip
+// frames above the caller of modeOn.
+func modeOn(mode ModeFlag, skip int) bool {
+	if mode == Normal {
+		return true
+	}
+	moduleModesMu.RLock()
+	overrides := len(moduleModes)
+	moduleModesMu.RUnlock()
+	if overrides == 0 {
+		return mode == Mode
+	}
+	if setting, found := moduleMode(callerModule(skip + 1)); found {
+		return mode == setting.Mode
+	}
+	if setting, found := moduleMode(AllModules); found {
+		return mode == setting.Mode
+	}
+	return mode == Mode
+}
+
+// moduleMode returns the unexpired run mode set for a module, if any.
+func moduleMode(module string) (ModuleMode, bool) {
+	moduleModesMu.RLock()
+	setting, found := moduleModes[module]
+	moduleModesMu.RUnlock()
+	if found && !setting.Expires.IsZero() && time.Now().After(setting.Expires) {
+		return setting, false
+	}
+	return setting, found
+}
+
+// callerModule returns the name of the package directory of the function skip frames
+// above the caller of callerModule.
+func callerModule(skip int) string {
+	_, file, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(file))
+}
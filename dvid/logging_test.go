@@ -0,0 +1,40 @@
+package dvid
+
+import (
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestModuleModes(c *C) {
+	mode, err := ParseModeFlag("Debug")
+	c.Assert(err, IsNil)
+	c.Assert(mode, Equals, Debug)
+	_, err = ParseModeFlag("verbose")
+	c.Assert(err, NotNil)
+
+	c.Assert(ModeOn(Normal), Equals, true)
+	c.Assert(ModeOn(Debug), Equals, Mode == Debug)
+
+	// Modes set for other modules don't apply to this one.
+	SetModuleMode("storage", Debug, 0)
+	defer ResetModuleMode("storage")
+	c.Assert(ModeOn(Debug), Equals, Mode == Debug)
+
+	SetModuleMode("dvid", Debug, 0)
+	c.Assert(ModeOn(Debug), Equals, true)
+	modes := ModuleModes()
+	c.Assert(modes, HasLen, 2)
+	c.Assert(modes[0].Module, Equals, "dvid")
+	c.Assert(modes[1].Module, Equals, "storage")
+
+	// Modes with a duration return to the global mode when it elapses.
+	SetModuleMode("dvid", Debug, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(ModeOn(Debug), Equals, Mode == Debug)
+	c.Assert(ModuleModes(), HasLen, 1)
+
+	SetModuleMode(AllModules, Benchmark, 0)
+	defer ResetModuleMode(AllModules)
+	c.Assert(ModeOn(Benchmark), Equals, true)
+}
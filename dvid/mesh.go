@@ -0,0 +1,349 @@
+/*
+	This file implements surface meshes of sparse and thresholded volumes using marching
+	cubes.
+
+	Rather than embedding the usual 256-case triangle table, the table is generated at
+	startup by walking the faces of the cube: each face's intersected edges are joined into
+	segments, the segments form closed loops around the inside corners, and each loop is
+	triangulated as a fan.  Faces with two diagonal inside corners always separate those
+	corners, and since that choice depends only on the face, adjacent cubes agree and the
+	resulting mesh is closed.
+*/
+
+package dvid
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// cubeEdges gives the two corners of each edge of a cube, where corner i is at
+// (i&1, (i>>1)&1, (i>>2)&1).
+var cubeEdges [12][2]int
+
+// mcTriangles gives the triangles, as triples of cube edges, for each configuration of
+// inside corners.
+var mcTriangles [256][][3]int
+
+func init() {
+	n := 0
+	for a := 0; a < 8; a++ {
+		for bit := uint(0); bit < 3; bit++ {
+			if a&(1<<bit) == 0 {
+				cubeEdges[n] = [2]int{a, a | (1 << bit)}
+				n++
+			}
+		}
+	}
+	for config := 1; config < 255; config++ {
+		mcTriangles[config] = cubeTriangles(config)
+	}
+}
+
+func cubeEdge(a, b int) int {
+	if a > b {
+		a, b = b, a
+	}
+	for e, corners := range cubeEdges {
+		if corners[0] == a && corners[1] == b {
+			return e
+		}
+	}
+	panic(fmt.Sprintf("no cube edge between corners %d and %d", a, b))
+}
+
+func cubeCorner(c int) [3]float64 {
+	return [3]float64{float64(c & 1), float64((c >> 1) & 1), float64((c >> 2) & 1)}
+}
+
+func edgeMidpoint(e int) [3]float64 {
+	p0, p1 := cubeCorner(cubeEdges[e][0]), cubeCorner(cubeEdges[e][1])
+	return [3]float64{(p0[0] + p1[0]) / 2, (p0[1] + p1[1]) / 2, (p0[2] + p1[2]) / 2}
+}
+
+// cubeTriangles returns outward-facing triangles separating the inside corners of a
+// configuration from the outside corners.
+func cubeTriangles(config int) [][3]int {
+	inside := func(c int) bool { return config&(1<<uint(c)) != 0 }
+
+	// Join the intersected edges of each face into segments.
+	neighbors := make(map[int][]int)
+	join := func(e0, e1 int) {
+		neighbors[e0] = append(neighbors[e0], e1)
+		neighbors[e1] = append(neighbors[e1], e0)
+	}
+	for axis := uint(0); axis < 3; axis++ {
+		u, v := (axis+1)%3, (axis+2)%3
+		for side := 0; side < 2; side++ {
+			base := side << axis
+			face := [4]int{base, base | 1<<u, base | 1<<u | 1<<v, base | 1<<v}
+			var cut []int
+			for k := 0; k < 4; k++ {
+				if inside(face[k]) != inside(face[(k+1)%4]) {
+					cut = append(cut, cubeEdge(face[k], face[(k+1)%4]))
+				}
+			}
+			switch len(cut) {
+			case 2:
+				join(cut[0], cut[1])
+			case 4:
+				// Diagonal inside corners are cut off separately.
+				for k := 0; k < 4; k++ {
+					if inside(face[k]) {
+						join(cubeEdge(face[(k+3)%4], face[k]), cubeEdge(face[k], face[(k+1)%4]))
+					}
+				}
+			}
+		}
+	}
+
+	// Walk the loops formed by the segments and triangulate each as a fan.
+	var edges []int
+	for e := range neighbors {
+		edges = append(edges, e)
+	}
+	sort.Ints(edges)
+	visited := make(map[int]bool)
+	var triangles [][3]int
+	for _, start := range edges {
+		if visited[start] {
+			continue
+		}
+		loop := []int{start}
+		visited[start] = true
+		prev, cur := -1, start
+		for {
+			next := neighbors[cur][0]
+			if next == prev || visited[next] {
+				next = neighbors[cur][1]
+			}
+			if visited[next] {
+				break
+			}
+			loop = append(loop, next)
+			visited[next] = true
+			prev, cur = cur, next
+		}
+
+		// Orient the loop so its normal points away from the inside corners.
+		var normal, outward [3]float64
+		for i := range loop {
+			p, q := edgeMidpoint(loop[i]), edgeMidpoint(loop[(i+1)%len(loop)])
+			normal[0] += (p[1] - q[1]) * (p[2] + q[2])
+			normal[1] += (p[2] - q[2]) * (p[0] + q[0])
+			normal[2] += (p[0] - q[0]) * (p[1] + q[1])
+			in := cubeEdges[loop[i]][0]
+			if !inside(in) {
+				in = cubeEdges[loop[i]][1]
+			}
+			c := cubeCorner(in)
+			for dim := 0; dim < 3; dim++ {
+				outward[dim] += p[dim] - c[dim]
+			}
+		}
+		if normal[0]*outward[0]+normal[1]*outward[1]+normal[2]*outward[2] < 0 {
+			for i, j := 0, len(loop)-1; i < j; i, j = i+1, j-1 {
+				loop[i], loop[j] = loop[j], loop[i]
+			}
+		}
+		for i := 1; i+1 < len(loop); i++ {
+			triangles = append(triangles, [3]int{loop[0], loop[i], loop[i+1]})
+		}
+	}
+	return triangles
+}
+
+// Mesh is an indexed triangle mesh.
+type Mesh struct {
+	// Vertices holds x, y, z coordinates of each vertex.
+	Vertices []float32
+
+	// Triangles holds the three vertex indices of each triangle, ordered so the
+	// triangle normal points outward by the right-hand rule.
+	Triangles []uint32
+}
+
+// NumVertices returns the number of vertices in the mesh.
+func (m *Mesh) NumVertices() int {
+	return len(m.Vertices) / 3
+}
+
+// NumTriangles returns the number of triangles in the mesh.
+func (m *Mesh) NumTriangles() int {
+	return len(m.Triangles) / 3
+}
+
+// WriteOBJ writes the mesh in Wavefront OBJ format.
+func (m *Mesh) WriteOBJ(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(m.Vertices); i += 3 {
+		fmt.Fprintf(bw, "v %g %g %g\n", m.Vertices[i], m.Vertices[i+1], m.Vertices[i+2])
+	}
+	for i := 0; i < len(m.Triangles); i += 3 {
+		fmt.Fprintf(bw, "f %d %d %d\n", m.Triangles[i]+1, m.Triangles[i+1]+1, m.Triangles[i+2]+1)
+	}
+	return bw.Flush()
+}
+
+// WriteBinary writes the mesh in a binary format where integers and floats are little
+// endian:
+//
+//	uint32        # vertices (N)
+//	uint32        # triangles (M)
+//	3N x float32  Vertex coordinates (x, y, z)
+//	3M x uint32   Vertex indices of triangles
+func (m *Mesh) WriteBinary(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := []uint32{uint32(m.NumVertices()), uint32(m.NumTriangles())}
+	if err := binary.Write(bw, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, m.Vertices); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, m.Triangles); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// MarchingCubes returns a surface mesh of the sparse volume computed at a scale where
+// each voxel covers 2^scale voxels along each axis.  A downsampled voxel is inside if
+// any of its voxels are in the sparse volume.  Vertex coordinates are in voxels at
+// scale 0.  If progress is not nil, it is called with the fraction of the volume
+// processed.
+func (vol *SparseVol) MarchingCubes(scale uint8, progress func(float32)) (*Mesh, error) {
+	if vol.pos == 0 {
+		return new(Mesh), nil
+	}
+	if scale > 16 {
+		return nil, fmt.Errorf("Mesh scale %d is too large", scale)
+	}
+
+	// Downsample the runs and group them by z.
+	type span struct{ y, x0, x1 int32 }
+	spans := make(map[int32][]span)
+	minPt := Point3d{vol.minPt[0] >> scale, vol.minPt[1] >> scale, vol.minPt[2] >> scale}
+	maxPt := Point3d{vol.maxPt[0] >> scale, vol.maxPt[1] >> scale, vol.maxPt[2] >> scale}
+	for _, rle := range vol.rles[:vol.pos] {
+		z := rle.start[2] >> scale
+		spans[z] = append(spans[z], span{
+			y:  rle.start[1] >> scale,
+			x0: rle.start[0] >> scale,
+			x1: (rle.start[0] + rle.length - 1) >> scale,
+		})
+	}
+
+	factor := float32(int32(1) << scale)
+	mesh := marchSlices(minPt, maxPt, factor, (factor-1)/2, func(z int32, set func(x, y int32)) {
+		for _, s := range spans[z] {
+			for x := s.x0; x <= s.x1; x++ {
+				set(x, s.y)
+			}
+		}
+	}, progress)
+	return mesh, nil
+}
+
+// IsosurfaceMesh returns the surface of the voxels within a subvolume for which
+// inside returns true.  The inside function is called with voxel coordinates, which
+// are also used for the mesh vertices.
+func IsosurfaceMesh(offset, size Point3d, inside func(x, y, z int32) bool) *Mesh {
+	if size[0] <= 0 || size[1] <= 0 || size[2] <= 0 {
+		return new(Mesh)
+	}
+	maxPt := Point3d{offset[0] + size[0] - 1, offset[1] + size[1] - 1, offset[2] + size[2] - 1}
+	return marchSlices(offset, maxPt, 1, 0, func(z int32, set func(x, y int32)) {
+		if z < offset[2] || z > maxPt[2] {
+			return
+		}
+		for y := offset[1]; y <= maxPt[1]; y++ {
+			for x := offset[0]; x <= maxPt[0]; x++ {
+				if inside(x, y, z) {
+					set(x, y)
+				}
+			}
+		}
+	}, nil)
+}
+
+// marchSlices runs marching cubes over a binary volume within minPt and maxPt, which
+// is given one XY slice at a time by calling fill, which sets the inside voxels of
+// slice z.  The volume is padded by a voxel on each side so the surface is closed.
+// Vertices are mapped to position * factor + offset.
+func marchSlices(minPt, maxPt Point3d, factor, offset float32, fill func(z int32, set func(x, y int32)),
+	progress func(float32)) *Mesh {
+
+	mesh := new(Mesh)
+	nx := maxPt[0] - minPt[0] + 3
+	ny := maxPt[1] - minPt[1] + 3
+	fillSlice := func(slice []bool, z int32) {
+		for i := range slice {
+			slice[i] = false
+		}
+		fill(z, func(x, y int32) {
+			slice[(y-minPt[1]+1)*nx+x-minPt[0]+1] = true
+		})
+	}
+
+	vertices := make(map[[4]int32]uint32)
+	vertexIndex := func(x, y, z int32, e int) uint32 {
+		c0, c1 := cubeEdges[e][0], cubeEdges[e][1]
+		gx, gy, gz := x+int32(c0&1), y+int32((c0>>1)&1), z+int32((c0>>2)&1)
+		axis := int32(0)
+		for c0^c1 != 1<<uint(axis) {
+			axis++
+		}
+		key := [4]int32{gx, gy, gz, axis}
+		if i, found := vertices[key]; found {
+			return i
+		}
+		i := uint32(len(vertices))
+		vertices[key] = i
+		pos := [3]float32{float32(gx), float32(gy), float32(gz)}
+		pos[axis] += 0.5
+		for dim := 0; dim < 3; dim++ {
+			mesh.Vertices = append(mesh.Vertices, pos[dim]*factor+offset)
+		}
+		return i
+	}
+
+	below := make([]bool, nx*ny)
+	above := make([]bool, nx*ny)
+	fillSlice(above, minPt[2]-1)
+	numZ := maxPt[2] - minPt[2] + 2
+	for z := minPt[2] - 1; z <= maxPt[2]; z++ {
+		below, above = above, below
+		fillSlice(above, z+1)
+		for j := int32(0); j < ny-1; j++ {
+			for i := int32(0); i < nx-1; i++ {
+				p := j*nx + i
+				corners := [8]bool{
+					below[p], below[p+1], below[p+nx], below[p+nx+1],
+					above[p], above[p+1], above[p+nx], above[p+nx+1],
+				}
+				config := 0
+				for c, in := range corners {
+					if in {
+						config |= 1 << uint(c)
+					}
+				}
+				if config == 0 || config == 255 {
+					continue
+				}
+				x, y := i+minPt[0]-1, j+minPt[1]-1
+				for _, tri := range mcTriangles[config] {
+					mesh.Triangles = append(mesh.Triangles,
+						vertexIndex(x, y, z, tri[0]), vertexIndex(x, y, z, tri[1]), vertexIndex(x, y, z, tri[2]))
+				}
+			}
+		}
+		if progress != nil {
+			progress(float32(z-minPt[2]+2) / float32(numZ))
+		}
+	}
+	return mesh
+}
@@ -0,0 +1,117 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+// checkClosedMesh makes sure every directed edge of the mesh is matched by the same
+// edge in the opposite direction, which holds for a closed, consistently oriented mesh.
+func checkClosedMesh(c *C, mesh *Mesh) {
+	edges := make(map[[2]uint32]int)
+	for i := 0; i < len(mesh.Triangles); i += 3 {
+		for k := 0; k < 3; k++ {
+			v0, v1 := mesh.Triangles[i+k], mesh.Triangles[i+(k+1)%3]
+			c.Assert(v0, Not(Equals), v1)
+			edges[[2]uint32{v0, v1}]++
+		}
+	}
+	for edge, count := range edges {
+		c.Assert(count, Equals, 1, Commentf("edge %v", edge))
+		c.Assert(edges[[2]uint32{edge[1], edge[0]}], Equals, 1, Commentf("edge %v", edge))
+	}
+}
+
+func sparseVolFromRLEs(c *C, rles RLEs) *SparseVol {
+	encoding, err := rles.MarshalBinary()
+	c.Assert(err, IsNil)
+	vol := new(SparseVol)
+	c.Assert(vol.AddRLEs(encoding), IsNil)
+	return vol
+}
+
+func (s *VolumeTest) TestMarchingCubes(c *C) {
+	// Every configuration gives a closed surface around its inside corners.
+	for config := 1; config < 255; config++ {
+		c.Assert(len(mcTriangles[config]) > 0, Equals, true, Commentf("config %d", config))
+	}
+
+	// A single voxel gives an octahedron around the voxel center.
+	vol := sparseVolFromRLEs(c, RLEs{{Point3d{10, 20, 30}, 1}})
+	mesh, err := vol.MarchingCubes(0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(mesh.NumVertices(), Equals, 6)
+	c.Assert(mesh.NumTriangles(), Equals, 8)
+	checkClosedMesh(c, mesh)
+	for i := 0; i < len(mesh.Vertices); i += 3 {
+		dist := (mesh.Vertices[i] - 10) + (mesh.Vertices[i+1] - 20) + (mesh.Vertices[i+2] - 30)
+		c.Assert(dist == 0.5 || dist == -0.5, Equals, true)
+	}
+
+	// A 4x4x4 cube with a second, diagonally touching voxel.
+	var rles RLEs
+	for z := int32(0); z < 4; z++ {
+		for y := int32(0); y < 4; y++ {
+			rles = append(rles, RLE{Point3d{0, y, z}, 4})
+		}
+	}
+	rles = append(rles, RLE{Point3d{4, 4, 4}, 1})
+	var progress []float32
+	mesh, err = sparseVolFromRLEs(c, rles).MarchingCubes(0, func(f float32) { progress = append(progress, f) })
+	c.Assert(err, IsNil)
+	checkClosedMesh(c, mesh)
+	c.Assert(progress[len(progress)-1], Equals, float32(1))
+
+	// At scale 1, the cube becomes 2x2x2 voxels with vertices in scale 0 coordinates.
+	mesh, err = sparseVolFromRLEs(c, rles[:16]).MarchingCubes(1, nil)
+	c.Assert(err, IsNil)
+	checkClosedMesh(c, mesh)
+	for i := 0; i < len(mesh.Vertices); i++ {
+		c.Assert(mesh.Vertices[i] >= -0.5 && mesh.Vertices[i] <= 3.5, Equals, true)
+	}
+
+	var buf bytes.Buffer
+	c.Assert(mesh.WriteOBJ(&buf), IsNil)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(len(lines), Equals, mesh.NumVertices()+mesh.NumTriangles())
+	c.Assert(strings.HasPrefix(lines[0], "v "), Equals, true)
+	c.Assert(strings.HasPrefix(lines[len(lines)-1], "f "), Equals, true)
+
+	empty, err := new(SparseVol).MarchingCubes(0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(empty.NumTriangles(), Equals, 0)
+}
+
+func (s *VolumeTest) TestIsosurfaceMesh(c *C) {
+	// A ball of radius 3 centered in a 10^3 subvolume at offset (100, 200, 300).
+	offset := Point3d{100, 200, 300}
+	size := Point3d{10, 10, 10}
+	inside := func(x, y, z int32) bool {
+		dx, dy, dz := x-105, y-205, z-305
+		return dx*dx+dy*dy+dz*dz <= 9
+	}
+	mesh := IsosurfaceMesh(offset, size, inside)
+	c.Assert(mesh.NumTriangles() > 0, Equals, true)
+	checkClosedMesh(c, mesh)
+	for i := 0; i < len(mesh.Vertices); i += 3 {
+		for dim := 0; dim < 3; dim++ {
+			c.Assert(mesh.Vertices[i+dim] > float32(offset[dim]), Equals, true)
+			c.Assert(mesh.Vertices[i+dim] < float32(offset[dim]+size[dim]), Equals, true)
+		}
+	}
+
+	// Voxels at the subvolume boundary still give a closed surface.
+	full := IsosurfaceMesh(offset, Point3d{2, 3, 4}, func(x, y, z int32) bool { return true })
+	checkClosedMesh(c, full)
+
+	var buf bytes.Buffer
+	c.Assert(mesh.WriteBinary(&buf), IsNil)
+	c.Assert(buf.Len(), Equals, 8+12*mesh.NumVertices()+12*mesh.NumTriangles())
+	var header [2]uint32
+	c.Assert(binary.Read(&buf, binary.LittleEndian, &header), IsNil)
+	c.Assert(int(header[0]), Equals, mesh.NumVertices())
+	c.Assert(int(header[1]), Equals, mesh.NumTriangles())
+}
@@ -0,0 +1,292 @@
+/*
+	This file supports reading and writing 3d volumes in the NIfTI-1 single file (.nii)
+	format used by neuroimaging tools.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// NiftiContentType is the MIME type used for NIfTI responses.
+const NiftiContentType = "application/x-nifti"
+
+// NIfTI-1 data type codes.
+var niftiDataTypes = map[DataType]int16{
+	T_uint8:   2,
+	T_int16:   4,
+	T_int32:   8,
+	T_float32: 16,
+	T_float64: 64,
+	T_int8:    256,
+	T_uint16:  512,
+	T_uint32:  768,
+	T_int64:   1024,
+	T_uint64:  1280,
+}
+
+// NIfTI-1 spatial unit codes.
+const (
+	niftiUnitsUnknown = 0
+	niftiUnitsMeter   = 1
+	niftiUnitsMM      = 2
+	niftiUnitsMicron  = 3
+)
+
+const niftiHeaderSize = 348
+
+// niftiHeader is the 348 byte NIfTI-1 header.
+type niftiHeader struct {
+	SizeofHdr     int32
+	DataTypeStr   [10]byte
+	DBName        [18]byte
+	Extents       int32
+	SessionError  int16
+	Regular       byte
+	DimInfo       byte
+	Dim           [8]int16
+	IntentP1      float32
+	IntentP2      float32
+	IntentP3      float32
+	IntentCode    int16
+	Datatype      int16
+	Bitpix        int16
+	SliceStart    int16
+	Pixdim        [8]float32
+	VoxOffset     float32
+	SclSlope      float32
+	SclInter      float32
+	SliceEnd      int16
+	SliceCode     byte
+	XYZTUnits     byte
+	CalMax        float32
+	CalMin        float32
+	SliceDuration float32
+	Toffset       float32
+	Glmax         int32
+	Glmin         int32
+	Descrip       [80]byte
+	AuxFile       [24]byte
+	QformCode     int16
+	SformCode     int16
+	QuaternB      float32
+	QuaternC      float32
+	QuaternD      float32
+	QoffsetX      float32
+	QoffsetY      float32
+	QoffsetZ      float32
+	SrowX         [4]float32
+	SrowY         [4]float32
+	SrowZ         [4]float32
+	IntentName    [16]byte
+	Magic         [4]byte
+}
+
+// NiftiVolume is a 3d volume with the spatial metadata carried by a NIfTI-1 file.
+type NiftiVolume struct {
+	Size      Point3d
+	DataType  DataType
+	VoxelSize [3]float32
+
+	// Units of VoxelSize and Translation, e.g., "millimeters".  Empty if unknown.
+	Units string
+
+	// Translation is the physical position of the first voxel.
+	Translation [3]float32
+
+	// Data is little endian with X varying fastest.
+	Data []byte
+}
+
+// niftiUnits returns the NIfTI unit code and scaling that converts DVID units to it.
+func niftiUnits(units string) (code byte, scale float32) {
+	switch strings.ToLower(units) {
+	case "nanometers", "nanometer", "nm":
+		return niftiUnitsMicron, 0.001
+	case "micrometers", "micrometer", "microns", "micron", "um":
+		return niftiUnitsMicron, 1
+	case "millimeters", "millimeter", "mm":
+		return niftiUnitsMM, 1
+	case "meters", "meter", "m":
+		return niftiUnitsMeter, 1
+	}
+	return niftiUnitsUnknown, 1
+}
+
+// WriteNifti writes 3d single-channel data as a NIfTI-1 file.  The voxel size is given in
+// DVID units, e.g., "nanometers", and is converted to NIfTI units where possible.  The
+// offset in voxels sets the translation of the scanner-independent (sform) affine.
+func WriteNifti(w io.Writer, values DataValues, byteOrder binary.ByteOrder, size Point3d,
+	voxelSize [3]float32, units string, offset Point3d, data []byte) error {
+
+	if len(values) != 1 {
+		return fmt.Errorf("NIfTI output requires single-channel voxels, not %d values/voxel", len(values))
+	}
+	code, found := niftiDataTypes[values[0].T]
+	if !found {
+		return fmt.Errorf("No NIfTI data type for %v", values)
+	}
+	bytesPerVoxel := DataTypeBytes(values[0].T)
+	if expected := int64(size.Prod()) * int64(bytesPerVoxel); expected != int64(len(data)) {
+		return fmt.Errorf("Expected %d bytes for NIfTI volume of size %s, got %d", expected, size, len(data))
+	}
+
+	var hdr niftiHeader
+	hdr.SizeofHdr = niftiHeaderSize
+	hdr.Regular = 'r'
+	hdr.Dim = [8]int16{3, 1, 1, 1, 1, 1, 1, 1}
+	for dim := 0; dim < 3; dim++ {
+		if size[dim] > 32767 {
+			return fmt.Errorf("NIfTI-1 dimensions are limited to 32767 voxels, got %s", size)
+		}
+		hdr.Dim[dim+1] = int16(size[dim])
+	}
+	hdr.Datatype = code
+	hdr.Bitpix = int16(8 * bytesPerVoxel)
+	unitCode, scale := niftiUnits(units)
+	hdr.XYZTUnits = unitCode
+	hdr.Pixdim = [8]float32{1, 1, 1, 1, 1, 1, 1, 1}
+	for dim := 0; dim < 3; dim++ {
+		hdr.Pixdim[dim+1] = voxelSize[dim] * scale
+	}
+	hdr.VoxOffset = niftiHeaderSize + 4
+	hdr.SclSlope = 1
+	hdr.SformCode = 2 // aligned anatomical
+	hdr.QformCode = 2
+	hdr.QoffsetX = float32(offset[0]) * hdr.Pixdim[1]
+	hdr.QoffsetY = float32(offset[1]) * hdr.Pixdim[2]
+	hdr.QoffsetZ = float32(offset[2]) * hdr.Pixdim[3]
+	hdr.SrowX = [4]float32{hdr.Pixdim[1], 0, 0, hdr.QoffsetX}
+	hdr.SrowY = [4]float32{0, hdr.Pixdim[2], 0, hdr.QoffsetY}
+	hdr.SrowZ = [4]float32{0, 0, hdr.Pixdim[3], hdr.QoffsetZ}
+	copy(hdr.Descrip[:], "DVID export")
+	copy(hdr.Magic[:], "n+1\x00")
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	buf.Write([]byte{0, 0, 0, 0}) // no extensions
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if byteOrder == binary.BigEndian && bytesPerVoxel > 1 {
+		data = swapBytes(data, int(bytesPerVoxel))
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadNifti reads a single file NIfTI-1 volume with at most 3 non-singleton dimensions.
+// Only axis-aligned volumes are supported; the sign of each axis in the affine is ignored
+// so data is returned in file order.
+func ReadNifti(r io.Reader) (*NiftiVolume, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < niftiHeaderSize {
+		return nil, fmt.Errorf("File is too small to be NIfTI-1")
+	}
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if int32(binary.LittleEndian.Uint32(raw[0:4])) != niftiHeaderSize {
+		byteOrder = binary.BigEndian
+		if int32(binary.BigEndian.Uint32(raw[0:4])) != niftiHeaderSize {
+			return nil, fmt.Errorf("File does not have a NIfTI-1 header")
+		}
+	}
+	var hdr niftiHeader
+	if err := binary.Read(bytes.NewReader(raw[:niftiHeaderSize]), byteOrder, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:3]) != "n+1" {
+		return nil, fmt.Errorf("Only single file NIfTI-1 (.nii) volumes are supported")
+	}
+	if hdr.SclSlope != 0 && (hdr.SclSlope != 1 || hdr.SclInter != 0) {
+		return nil, fmt.Errorf("NIfTI volumes with scaled values (slope %f, intercept %f) are not supported",
+			hdr.SclSlope, hdr.SclInter)
+	}
+	if hdr.Dim[0] < 1 || hdr.Dim[0] > 7 {
+		return nil, fmt.Errorf("Bad NIfTI dimensionality %d", hdr.Dim[0])
+	}
+	for dim := 4; dim <= int(hdr.Dim[0]); dim++ {
+		if hdr.Dim[dim] > 1 {
+			return nil, fmt.Errorf("Only 3d NIfTI volumes are supported, got dims %v", hdr.Dim[1:hdr.Dim[0]+1])
+		}
+	}
+	if hdr.SformCode > 0 {
+		if hdr.SrowX[1] != 0 || hdr.SrowX[2] != 0 || hdr.SrowY[0] != 0 || hdr.SrowY[2] != 0 ||
+			hdr.SrowZ[0] != 0 || hdr.SrowZ[1] != 0 {
+			return nil, fmt.Errorf("Only axis-aligned NIfTI volumes are supported")
+		}
+	}
+
+	vol := new(NiftiVolume)
+	found := false
+	for t, code := range niftiDataTypes {
+		if code == hdr.Datatype {
+			vol.DataType = t
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unsupported NIfTI data type %d", hdr.Datatype)
+	}
+	for dim := 0; dim < 3; dim++ {
+		vol.Size[dim] = 1
+		if dim < int(hdr.Dim[0]) {
+			vol.Size[dim] = int32(hdr.Dim[dim+1])
+		}
+		vol.VoxelSize[dim] = hdr.Pixdim[dim+1]
+		if vol.VoxelSize[dim] < 0 {
+			vol.VoxelSize[dim] = -vol.VoxelSize[dim]
+		}
+		if vol.VoxelSize[dim] == 0 {
+			vol.VoxelSize[dim] = 1
+		}
+	}
+	switch hdr.XYZTUnits & 7 {
+	case niftiUnitsMeter:
+		vol.Units = "meters"
+	case niftiUnitsMM:
+		vol.Units = "millimeters"
+	case niftiUnitsMicron:
+		vol.Units = "micrometers"
+	}
+	switch {
+	case hdr.SformCode > 0:
+		vol.Translation = [3]float32{hdr.SrowX[3], hdr.SrowY[3], hdr.SrowZ[3]}
+	case hdr.QformCode > 0:
+		vol.Translation = [3]float32{hdr.QoffsetX, hdr.QoffsetY, hdr.QoffsetZ}
+	}
+
+	bytesPerVoxel := DataTypeBytes(vol.DataType)
+	dataBytes := int64(vol.Size.Prod()) * int64(bytesPerVoxel)
+	start := int64(hdr.VoxOffset)
+	if start < niftiHeaderSize || start+dataBytes > int64(len(raw)) {
+		return nil, fmt.Errorf("NIfTI file has %d bytes, too few for %d bytes of data at offset %d",
+			len(raw), dataBytes, start)
+	}
+	vol.Data = raw[start : start+dataBytes]
+	if byteOrder == binary.BigEndian && bytesPerVoxel > 1 {
+		vol.Data = swapBytes(vol.Data, int(bytesPerVoxel))
+	}
+	return vol, nil
+}
+
+// swapBytes returns a copy of data with the byte order of each n-byte value reversed.
+func swapBytes(data []byte, n int) []byte {
+	swapped := make([]byte, len(data))
+	for i := 0; i+n <= len(data); i += n {
+		for b := 0; b < n; b++ {
+			swapped[i+b] = data[i+n-1-b]
+		}
+	}
+	return swapped
+}
@@ -0,0 +1,37 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestNiftiRoundTrip(c *C) {
+	values := DataValues{{T: T_uint16, Label: "intensity"}}
+	size := Point3d{4, 3, 2}
+	data := make([]byte, size.Prod()*2)
+	for i := 0; i < int(size.Prod()); i++ {
+		binary.BigEndian.PutUint16(data[i*2:], uint16(i*100))
+	}
+	var buf bytes.Buffer
+	err := WriteNifti(&buf, values, binary.BigEndian, size, [3]float32{8, 8, 40}, "nanometers",
+		Point3d{10, 20, 30}, data)
+	c.Assert(err, IsNil)
+	c.Assert(buf.Len(), Equals, niftiHeaderSize+4+len(data))
+
+	vol, err := ReadNifti(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(vol.Size, Equals, size)
+	c.Assert(vol.DataType, Equals, T_uint16)
+	c.Assert(vol.Units, Equals, "micrometers")
+	var nmToMicron float32 = 0.001
+	c.Assert(vol.VoxelSize, Equals, [3]float32{8 * nmToMicron, 8 * nmToMicron, 40 * nmToMicron})
+	c.Assert(vol.Translation[2], Equals, 30*vol.VoxelSize[2])
+	c.Assert(binary.LittleEndian.Uint16(vol.Data[2*5:]), Equals, uint16(500))
+
+	// Only single-channel data can be written.
+	rgba := DataValues{{T_uint8, "red"}, {T_uint8, "green"}, {T_uint8, "blue"}, {T_uint8, "alpha"}}
+	err = WriteNifti(&buf, rgba, nil, size, [3]float32{1, 1, 1}, "", Point3d{}, data)
+	c.Assert(err, NotNil)
+}
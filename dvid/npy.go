@@ -0,0 +1,123 @@
+/*
+	This file supports writing data in the NumPy .npy format so Python clients can
+	np.load() responses directly.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// NpyContentType is the MIME type used for .npy responses.
+const NpyContentType = "application/x-npy"
+
+var npyMagic = []byte("\x93NUMPY")
+
+var npyTypeCodes = map[DataType]string{
+	T_uint8:   "u1",
+	T_int8:    "i1",
+	T_uint16:  "u2",
+	T_int16:   "i2",
+	T_uint32:  "u4",
+	T_int32:   "i4",
+	T_uint64:  "u8",
+	T_int64:   "i8",
+	T_float32: "f4",
+	T_float64: "f8",
+}
+
+// NpyDescr returns the NumPy dtype string, e.g., "<u2", for a data type stored
+// with the given byte order.  A nil byte order is treated as little endian.
+func NpyDescr(t DataType, byteOrder binary.ByteOrder) (string, error) {
+	code, found := npyTypeCodes[t]
+	if !found {
+		return "", fmt.Errorf("No NumPy dtype for data type %d", t)
+	}
+	switch {
+	case DataTypeBytes(t) == 1:
+		return "|" + code, nil
+	case byteOrder == binary.BigEndian:
+		return ">" + code, nil
+	default:
+		return "<" + code, nil
+	}
+}
+
+// WriteNpy writes data as a version 1.0 .npy file.  The shape is given in C order,
+// i.e., slowest varying dimension first, so DVID volumes with X varying fastest have
+// shape (Z, Y, X).  Elements with multiple values of the same type add a trailing
+// dimension, while elements of mixed types use a structured dtype named by value labels.
+func WriteNpy(w io.Writer, values DataValues, byteOrder binary.ByteOrder, shape []int32, data []byte) error {
+	if len(values) == 0 {
+		return fmt.Errorf("Cannot write .npy data without data values")
+	}
+	numElements := int64(1)
+	for _, n := range shape {
+		numElements *= int64(n)
+	}
+	if expected := numElements * int64(values.BytesPerElement()); expected != int64(len(data)) {
+		return fmt.Errorf("Expected %d bytes for .npy of shape %v, got %d", expected, shape, len(data))
+	}
+
+	var descr string
+	if dataType, err := values.ValueDataType(); err == nil {
+		if descr, err = NpyDescr(dataType, byteOrder); err != nil {
+			return err
+		}
+		descr = "'" + descr + "'"
+		if len(values) > 1 {
+			shape = append(append([]int32{}, shape...), int32(len(values)))
+		}
+	} else {
+		fields := make([]string, len(values))
+		for i, value := range values {
+			fieldDescr, err := NpyDescr(value.T, byteOrder)
+			if err != nil {
+				return err
+			}
+			name := value.Label
+			if name == "" {
+				name = fmt.Sprintf("f%d", i)
+			}
+			fields[i] = fmt.Sprintf("('%s', '%s')", name, fieldDescr)
+		}
+		descr = "[" + strings.Join(fields, ", ") + "]"
+	}
+
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = fmt.Sprintf("%d", n)
+	}
+	shapeStr := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeStr += ","
+	}
+	header := fmt.Sprintf("{'descr': %s, 'fortran_order': False, 'shape': (%s), }", descr, shapeStr)
+
+	// Pad with spaces so the header, including magic, version and length, is 64-byte aligned.
+	preambleLen := len(npyMagic) + 2 + 2
+	padding := 64 - (preambleLen+len(header)+1)%64
+	if padding == 64 {
+		padding = 0
+	}
+	header += strings.Repeat(" ", padding) + "\n"
+	if len(header) > 65535 {
+		return fmt.Errorf("NumPy header of %d bytes is too large", len(header))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(npyMagic)
+	buf.Write([]byte{1, 0})
+	binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
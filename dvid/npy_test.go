@@ -0,0 +1,44 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestWriteNpy(c *C) {
+	values := DataValues{{T: T_uint16, Label: "intensity"}}
+	data := make([]byte, 2*3*4*2)
+	var buf bytes.Buffer
+	err := WriteNpy(&buf, values, binary.LittleEndian, []int32{2, 3, 4}, data)
+	c.Assert(err, IsNil)
+
+	out := buf.Bytes()
+	c.Assert(string(out[:6]), Equals, "\x93NUMPY")
+	c.Assert(out[6:8], DeepEquals, []byte{1, 0})
+	headerLen := int(binary.LittleEndian.Uint16(out[8:10]))
+	c.Assert((10+headerLen)%64, Equals, 0)
+	header := string(out[10 : 10+headerLen])
+	c.Assert(header[len(header)-1], Equals, byte('\n'))
+	c.Assert(header, Matches, `\{'descr': '<u2', 'fortran_order': False, 'shape': \(2, 3, 4\), \} *\n`)
+	c.Assert(len(out)-10-headerLen, Equals, len(data))
+
+	// Multiple values of the same type add a trailing dimension.
+	rgba := DataValues{{T_uint8, "red"}, {T_uint8, "green"}, {T_uint8, "blue"}, {T_uint8, "alpha"}}
+	buf.Reset()
+	err = WriteNpy(&buf, rgba, nil, []int32{5}, make([]byte, 20))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*'descr': '\|u1'.*'shape': \(5, 4\).*`)
+
+	// Mixed types use a structured dtype.
+	mixed := DataValues{{T_uint8, "mask"}, {T_float32, "prob"}}
+	buf.Reset()
+	err = WriteNpy(&buf, mixed, binary.BigEndian, []int32{3}, make([]byte, 15))
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*'descr': \[\('mask', '\|u1'\), \('prob', '>f4'\)\].*'shape': \(3,\).*`)
+
+	// Data size must match the shape.
+	err = WriteNpy(&buf, values, nil, []int32{2, 2}, make([]byte, 7))
+	c.Assert(err, NotNil)
+}
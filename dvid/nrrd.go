@@ -0,0 +1,288 @@
+/*
+	This file supports reading and writing 2d and 3d arrays in the NRRD format used by
+	visualization tools like 3D Slicer and teem.
+*/
+
+package dvid
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// NrrdContentType is the MIME type used for NRRD requests and responses.
+const NrrdContentType = "application/x-nrrd"
+
+// MaxNrrdValues is the most values, i.e., voxels times channels, read from a NRRD file.
+// Sizes in the header are checked against it before any data is allocated.
+const MaxNrrdValues = Giga
+
+// nrrdTypes gives the canonical NRRD type name for each data type.
+var nrrdTypes = map[DataType]string{
+	T_uint8:   "uint8",
+	T_int8:    "int8",
+	T_uint16:  "uint16",
+	T_int16:   "int16",
+	T_uint32:  "uint32",
+	T_int32:   "int32",
+	T_uint64:  "uint64",
+	T_int64:   "int64",
+	T_float32: "float",
+	T_float64: "double",
+}
+
+// nrrdTypeAliases maps the type names allowed by the NRRD spec to data types.
+var nrrdTypeAliases = map[string]DataType{
+	"uchar": T_uint8, "unsigned char": T_uint8, "uint8": T_uint8, "uint8_t": T_uint8,
+	"signed char": T_int8, "int8": T_int8, "int8_t": T_int8,
+	"short": T_int16, "short int": T_int16, "signed short": T_int16, "signed short int": T_int16,
+	"int16": T_int16, "int16_t": T_int16,
+	"ushort": T_uint16, "unsigned short": T_uint16, "unsigned short int": T_uint16,
+	"uint16": T_uint16, "uint16_t": T_uint16,
+	"int": T_int32, "signed int": T_int32, "int32": T_int32, "int32_t": T_int32,
+	"uint": T_uint32, "unsigned int": T_uint32, "uint32": T_uint32, "uint32_t": T_uint32,
+	"longlong": T_int64, "long long": T_int64, "long long int": T_int64, "signed long long": T_int64,
+	"signed long long int": T_int64, "int64": T_int64, "int64_t": T_int64,
+	"ulonglong": T_uint64, "unsigned long long": T_uint64, "unsigned long long int": T_uint64,
+	"uint64": T_uint64, "uint64_t": T_uint64,
+	"float": T_float32, "double": T_float64,
+}
+
+// NrrdVolume is an array read from a NRRD file.
+type NrrdVolume struct {
+	// Size of each spatial axis, fastest varying first.
+	Size []int32
+
+	DataType DataType
+
+	// Channels is the number of values per voxel, stored in a leading non-spatial axis
+	// when greater than 1.
+	Channels int32
+
+	// Spacings for each spatial axis.  Zero if not given.
+	Spacings []float32
+
+	// Data in little endian byte order.
+	Data []byte
+}
+
+// WriteNrrd writes data as an attached-header NRRD file.  Each voxel's values, which must
+// share a data type, form a leading "vector" axis if there is more than one.  Spacings are
+// optional but must match the number of dimensions in size if given.
+func WriteNrrd(w io.Writer, values DataValues, byteOrder binary.ByteOrder, size Point,
+	spacings []float32, compress bool, data []byte) error {
+
+	if len(values) == 0 {
+		return fmt.Errorf("Cannot write NRRD data without any values per voxel")
+	}
+	t := values[0].T
+	for _, value := range values[1:] {
+		if value.T != t {
+			return fmt.Errorf("NRRD output requires values of one type, not %v", values)
+		}
+	}
+	typeName, found := nrrdTypes[t]
+	if !found {
+		return fmt.Errorf("No NRRD type for %v", values)
+	}
+	numDims := int(size.NumDims())
+	if spacings != nil && len(spacings) != numDims {
+		return fmt.Errorf("Got %d NRRD spacings for %d-d data", len(spacings), numDims)
+	}
+	bytesPerVoxel := values.BytesPerElement()
+	if expected := size.Prod() * int64(bytesPerVoxel); expected != int64(len(data)) {
+		return fmt.Errorf("Expected %d bytes for NRRD data of size %s, got %d", expected, size, len(data))
+	}
+
+	var sizes, kinds, spaceStrs []string
+	if len(values) > 1 {
+		sizes = append(sizes, strconv.Itoa(len(values)))
+		kinds = append(kinds, "vector")
+		spaceStrs = append(spaceStrs, "nan")
+	}
+	for dim := 0; dim < numDims; dim++ {
+		sizes = append(sizes, strconv.Itoa(int(size.Value(uint8(dim)))))
+		kinds = append(kinds, "domain")
+		if spacings != nil {
+			spaceStrs = append(spaceStrs, strconv.FormatFloat(float64(spacings[dim]), 'g', -1, 32))
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "NRRD0004\n")
+	fmt.Fprintf(&buf, "# Written by DVID\n")
+	fmt.Fprintf(&buf, "type: %s\n", typeName)
+	fmt.Fprintf(&buf, "dimension: %d\n", len(sizes))
+	fmt.Fprintf(&buf, "sizes: %s\n", strings.Join(sizes, " "))
+	fmt.Fprintf(&buf, "kinds: %s\n", strings.Join(kinds, " "))
+	if spacings != nil {
+		fmt.Fprintf(&buf, "spacings: %s\n", strings.Join(spaceStrs, " "))
+	}
+	if DataTypeBytes(t) > 1 {
+		if byteOrder == binary.BigEndian {
+			fmt.Fprintf(&buf, "endian: big\n")
+		} else {
+			fmt.Fprintf(&buf, "endian: little\n")
+		}
+	}
+	if compress {
+		fmt.Fprintf(&buf, "encoding: gzip\n\n")
+	} else {
+		fmt.Fprintf(&buf, "encoding: raw\n\n")
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if !compress {
+		_, err := w.Write(data)
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadNrrd reads an attached-header NRRD file with raw or gzip encoding.  A leading axis
+// of a kind other than "domain" or "space", e.g., "vector" or "RGB-color", is read as
+// the values per voxel.
+func ReadNrrd(r io.Reader) (*NrrdVolume, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read NRRD magic: %s", err.Error())
+	}
+	if !strings.HasPrefix(magic, "NRRD000") {
+		return nil, fmt.Errorf("Data does not begin with NRRD magic")
+	}
+	fields := make(map[string]string)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read NRRD header: %s", err.Error())
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "#") || strings.Contains(line, ":=") {
+			continue
+		}
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			return nil, fmt.Errorf("Bad NRRD header line: %q", line)
+		}
+		fields[strings.ToLower(line[:colon])] = strings.TrimSpace(line[colon+2:])
+	}
+	if _, found := fields["data file"]; found {
+		return nil, fmt.Errorf("Detached NRRD data files are not supported")
+	}
+	if _, found := fields["datafile"]; found {
+		return nil, fmt.Errorf("Detached NRRD data files are not supported")
+	}
+	for _, skip := range []string{"line skip", "lineskip", "byte skip", "byteskip"} {
+		if value, found := fields[skip]; found && value != "0" {
+			return nil, fmt.Errorf("NRRD '%s' is not supported", skip)
+		}
+	}
+
+	vol := new(NrrdVolume)
+	var found bool
+	if vol.DataType, found = nrrdTypeAliases[strings.ToLower(fields["type"])]; !found {
+		return nil, fmt.Errorf("Unsupported NRRD type %q", fields["type"])
+	}
+	dimension, err := strconv.Atoi(fields["dimension"])
+	if err != nil || dimension < 1 {
+		return nil, fmt.Errorf("Bad NRRD dimension %q", fields["dimension"])
+	}
+	sizeStrs := strings.Fields(fields["sizes"])
+	if len(sizeStrs) != dimension {
+		return nil, fmt.Errorf("NRRD sizes %q don't match dimension %d", fields["sizes"], dimension)
+	}
+	sizes := make([]int32, dimension)
+	for n, s := range sizeStrs {
+		size, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("Bad NRRD size %q", s)
+		}
+		sizes[n] = int32(size)
+	}
+	var spacings []float32
+	if s, found := fields["spacings"]; found {
+		spaceStrs := strings.Fields(s)
+		if len(spaceStrs) != dimension {
+			return nil, fmt.Errorf("NRRD spacings %q don't match dimension %d", s, dimension)
+		}
+		for _, spaceStr := range spaceStrs {
+			spacing, err := strconv.ParseFloat(spaceStr, 32)
+			if err != nil || math.IsNaN(spacing) {
+				spacing = 0
+			}
+			spacings = append(spacings, float32(spacing))
+		}
+	}
+	vol.Channels = 1
+	if kinds := strings.Fields(fields["kinds"]); len(kinds) == dimension && dimension > 1 {
+		if kind := strings.ToLower(kinds[0]); kind != "domain" && kind != "space" {
+			vol.Channels = sizes[0]
+			sizes = sizes[1:]
+			if spacings != nil {
+				spacings = spacings[1:]
+			}
+		}
+	}
+	vol.Size = sizes
+	vol.Spacings = spacings
+	numValues := int64(vol.Channels)
+	for _, size := range sizes {
+		if numValues *= int64(size); numValues > MaxNrrdValues {
+			return nil, fmt.Errorf("NRRD sizes %q exceed %d values", fields["sizes"], MaxNrrdValues)
+		}
+	}
+	bytesPerValue := int(DataTypeBytes(vol.DataType))
+	var swap bool
+	if bytesPerValue > 1 {
+		switch strings.ToLower(fields["endian"]) {
+		case "little":
+		case "big":
+			swap = true
+		default:
+			return nil, fmt.Errorf("NRRD data of type %q requires an endian field", fields["type"])
+		}
+	}
+
+	var dataReader io.Reader = br
+	switch strings.ToLower(fields["encoding"]) {
+	case "raw":
+	case "gzip", "gz":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		dataReader = zr
+	default:
+		return nil, fmt.Errorf("Unsupported NRRD encoding %q", fields["encoding"])
+	}
+	numBytes := numValues * int64(bytesPerValue)
+	vol.Data = make([]byte, numBytes)
+	if _, err := io.ReadFull(dataReader, vol.Data); err != nil {
+		return nil, fmt.Errorf("Expected %d bytes of NRRD data: %s", numBytes, err.Error())
+	}
+	if _, err := io.Copy(ioutil.Discard, dataReader); err != nil {
+		return nil, err
+	}
+	if swap {
+		vol.Data = swapBytes(vol.Data, bytesPerValue)
+	}
+	return vol, nil
+}
@@ -0,0 +1,58 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestNrrdRoundTrip(c *C) {
+	values := DataValues{{T: T_uint16, Label: "intensity"}}
+	size := Point3d{4, 3, 2}
+	data := make([]byte, size.Prod()*2)
+	for i := 0; i < int(size.Prod()); i++ {
+		binary.BigEndian.PutUint16(data[i*2:], uint16(i*100))
+	}
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		err := WriteNrrd(&buf, values, binary.BigEndian, size, []float32{8, 8, 40}, compress, data)
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Matches, `(?s)NRRD0004\n.*sizes: 4 3 2\n.*spacings: 8 8 40\nendian: big\n.*`)
+
+		vol, err := ReadNrrd(&buf)
+		c.Assert(err, IsNil)
+		c.Assert(vol.Size, DeepEquals, []int32{4, 3, 2})
+		c.Assert(vol.DataType, Equals, T_uint16)
+		c.Assert(vol.Channels, Equals, int32(1))
+		c.Assert(vol.Spacings, DeepEquals, []float32{8, 8, 40})
+		c.Assert(binary.LittleEndian.Uint16(vol.Data[2*5:]), Equals, uint16(500))
+	}
+
+	// Multiple values per voxel form a leading vector axis.
+	rgba := DataValues{{T_uint8, "red"}, {T_uint8, "green"}, {T_uint8, "blue"}, {T_uint8, "alpha"}}
+	var buf bytes.Buffer
+	err := WriteNrrd(&buf, rgba, nil, Point2d{3, 2}, nil, false, make([]byte, 24))
+	c.Assert(err, IsNil)
+	vol, err := ReadNrrd(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(vol.Channels, Equals, int32(4))
+	c.Assert(vol.Size, DeepEquals, []int32{3, 2})
+}
+
+func (suite *DataSuite) TestReadNrrdHeader(c *C) {
+	nrrd := "NRRD0005\n# comment\ntype: unsigned char\ndimension: 2\nsizes: 2 2\nsource:=slicer\n" +
+		"encoding: raw\n\n\x01\x02\x03\x04"
+	vol, err := ReadNrrd(strings.NewReader(nrrd))
+	c.Assert(err, IsNil)
+	c.Assert(vol.DataType, Equals, T_uint8)
+	c.Assert(vol.Data, DeepEquals, []byte{1, 2, 3, 4})
+
+	_, err = ReadNrrd(strings.NewReader("NRRD0004\ntype: short\ndimension: 1\nsizes: 2\nencoding: raw\n\n1234"))
+	c.Assert(err, NotNil) // missing endian
+	_, err = ReadNrrd(strings.NewReader("NRRD0004\ntype: uint8\ndimension: 1\nsizes: 2\ndata file: a.raw\n\n"))
+	c.Assert(err, NotNil)
+	_, err = ReadNrrd(strings.NewReader("NRRD0004\ntype: uint8\ndimension: 3\nsizes: 2000 2000 2000\nencoding: raw\n\n"))
+	c.Assert(err, NotNil) // exceeds MaxNrrdValues
+}
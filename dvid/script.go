@@ -0,0 +1,135 @@
+/*
+	This file supports small scripts that transform values read from or written to data,
+	e.g., to redact a region or remap label IDs, without recompiling DVID.  Scripts are
+	written in Starlark, a Python dialect, and must define a function
+
+		def transform(value, request):
+
+	that's given the value as bytes and the request as a struct with "method", "uuid",
+	"data", "endpoint", "path" (the list of URL parts after the endpoint), and "query"
+	(a dict) fields, and returns the new value as bytes or a string.  Scripts can use the
+	"json" module and a "dvid" module with remap() and redact() functions that call
+	RemapValues and RedactSubvolume.
+
+	Scripts are sandboxed: they can't read files or use the network, each call is limited
+	to ScriptMaxSteps execution steps, ScriptTimeout, and ScriptMaxMemory of heap growth,
+	and the values they're given and return are limited to ScriptMaxBytes.  Running scripts requires building DVID with
+	the "starlark" build tag and the go.starlark.net packages.
+*/
+
+package dvid
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+var (
+	// ScriptMaxSteps is the most Starlark execution steps of one script call, limiting
+	// the CPU a script can use.  It doesn't limit memory, since one step, e.g., repeating
+	// or concatenating large strings, can allocate a large value.
+	ScriptMaxSteps uint64 = 10000000
+
+	// ScriptMaxMemory is how much the heap may grow while a script call runs before the
+	// call is canceled.  The heap is shared, so allocations of concurrent requests count
+	// against it, and a call can exceed it by what its last step allocates.
+	ScriptMaxMemory uint64 = 512 * Mega
+
+	// ScriptTimeout is the longest a script call can run.
+	ScriptTimeout = 5 * time.Second
+
+	// ScriptMaxBytes is the largest value a script can be given or return.
+	ScriptMaxBytes = 64 * Mega
+)
+
+// ScriptRequest describes the request whose value a script transforms.
+type ScriptRequest struct {
+	Method   string
+	UUID     UUID
+	Data     DataString
+	Endpoint string
+	Path     []string
+	Query    map[string]string
+}
+
+// RemapValues returns a copy of little-endian unsigned values, e.g., labels, where each
+// value found in the mapping is replaced by its mapped value.
+func RemapValues(data []byte, bytesPerValue int, mapping map[uint64]uint64) ([]byte, error) {
+	if bytesPerValue != 1 && bytesPerValue != 2 && bytesPerValue != 4 && bytesPerValue != 8 {
+		return nil, fmt.Errorf("Can't remap %d byte values", bytesPerValue)
+	}
+	if len(data)%bytesPerValue != 0 {
+		return nil, fmt.Errorf("Length %d isn't a multiple of the %d byte values", len(data), bytesPerValue)
+	}
+	remapped := make([]byte, len(data))
+	copy(remapped, data)
+	for pos := 0; pos < len(remapped); pos += bytesPerValue {
+		value := remapped[pos : pos+bytesPerValue]
+		var v uint64
+		switch bytesPerValue {
+		case 1:
+			v = uint64(value[0])
+		case 2:
+			v = uint64(binary.LittleEndian.Uint16(value))
+		case 4:
+			v = uint64(binary.LittleEndian.Uint32(value))
+		case 8:
+			v = binary.LittleEndian.Uint64(value)
+		}
+		mapped, found := mapping[v]
+		if !found {
+			continue
+		}
+		switch bytesPerValue {
+		case 1:
+			value[0] = uint8(mapped)
+		case 2:
+			binary.LittleEndian.PutUint16(value, uint16(mapped))
+		case 4:
+			binary.LittleEndian.PutUint32(value, uint32(mapped))
+		case 8:
+			binary.LittleEndian.PutUint64(value, mapped)
+		}
+	}
+	return remapped, nil
+}
+
+// RedactSubvolume returns a copy of the voxels of a subvolume with the given offset and
+// size, x fastest, where the voxels within the box from minPt to maxPt, inclusive, have
+// every byte set to fill.
+func RedactSubvolume(data []byte, bytesPerVoxel int, offset, size, minPt, maxPt Point3d, fill byte) ([]byte, error) {
+	if bytesPerVoxel < 1 {
+		return nil, fmt.Errorf("Bad number of bytes per voxel: %d", bytesPerVoxel)
+	}
+	if int64(len(data)) != size.Prod()*int64(bytesPerVoxel) {
+		return nil, fmt.Errorf("Expected %d bytes for %s subvolume of %d byte voxels, got %d",
+			size.Prod()*int64(bytesPerVoxel), size, bytesPerVoxel, len(data))
+	}
+	redacted := make([]byte, len(data))
+	copy(redacted, data)
+	var beg, end Point3d
+	for dim := 0; dim < 3; dim++ {
+		beg[dim], end[dim] = minPt[dim]-offset[dim], maxPt[dim]-offset[dim]+1
+		if beg[dim] < 0 {
+			beg[dim] = 0
+		}
+		if end[dim] > size[dim] {
+			end[dim] = size[dim]
+		}
+		if beg[dim] >= end[dim] {
+			return redacted, nil
+		}
+	}
+	rowBytes := int64(end[0]-beg[0]) * int64(bytesPerVoxel)
+	for z := beg[2]; z < end[2]; z++ {
+		for y := beg[1]; y < end[1]; y++ {
+			start := ((int64(z)*int64(size[1])+int64(y))*int64(size[0]) + int64(beg[0])) * int64(bytesPerVoxel)
+			row := redacted[start : start+rowBytes]
+			for i := range row {
+				row[i] = fill
+			}
+		}
+	}
+	return redacted, nil
+}
@@ -0,0 +1,24 @@
+// +build !starlark
+
+package dvid
+
+import (
+	"context"
+	"fmt"
+)
+
+// Script is a compiled script.  DVID must be built with the "starlark" build tag to
+// run scripts.
+type Script struct{}
+
+var errNoScripts = fmt.Errorf("DVID was not built with script support.  Rebuild with the 'starlark' tag.")
+
+// CompileScript runs the top level of a script's source and returns the script.
+func CompileScript(name, source string) (*Script, error) {
+	return nil, errNoScripts
+}
+
+// Transform calls the script's transform function with a value and its request.
+func (s *Script) Transform(ctx context.Context, value []byte, req ScriptRequest) ([]byte, error) {
+	return nil, errNoScripts
+}
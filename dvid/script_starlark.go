@@ -0,0 +1,208 @@
+// +build starlark
+
+/*
+	This file runs Starlark scripts using the go.starlark.net packages, which must be
+	installed to build DVID with the "starlark" build tag.
+*/
+
+package dvid
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Script is a compiled script whose transform function can be called concurrently.
+type Script struct {
+	name      string
+	transform starlark.Callable
+}
+
+var scriptModule = &starlarkstruct.Module{
+	Name: "dvid",
+	Members: starlark.StringDict{
+		"remap":  starlark.NewBuiltin("remap", scriptRemap),
+		"redact": starlark.NewBuiltin("redact", scriptRedact),
+	},
+}
+
+// scriptRemap implements dvid.remap(value, mapping, bytes=8).
+func scriptRemap(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+
+	var value starlark.Bytes
+	var mapping *starlark.Dict
+	bytesPerValue := 8
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "value", &value, "mapping", &mapping,
+		"bytes?", &bytesPerValue); err != nil {
+		return nil, err
+	}
+	m := make(map[uint64]uint64, mapping.Len())
+	for _, item := range mapping.Items() {
+		from, fromOK := item[0].(starlark.Int)
+		to, toOK := item[1].(starlark.Int)
+		if !fromOK || !toOK {
+			return nil, fmt.Errorf("%s: mapping must be from ints to ints", b.Name())
+		}
+		f, fOK := from.Uint64()
+		t, tOK := to.Uint64()
+		if !fOK || !tOK {
+			return nil, fmt.Errorf("%s: mapping values must be unsigned 64-bit ints", b.Name())
+		}
+		m[f] = t
+	}
+	remapped, err := RemapValues([]byte(value), bytesPerValue, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err.Error())
+	}
+	return starlark.Bytes(remapped), nil
+}
+
+// scriptPoint converts a sequence of three ints into a point.
+func scriptPoint(name string, v starlark.Value) (Point3d, error) {
+	var pt Point3d
+	seq, ok := v.(starlark.Indexable)
+	if !ok || seq.Len() != 3 {
+		return pt, fmt.Errorf("%s must be a sequence of 3 ints", name)
+	}
+	for dim := 0; dim < 3; dim++ {
+		n, err := starlark.AsInt32(seq.Index(dim))
+		if err != nil {
+			return pt, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		pt[dim] = int32(n)
+	}
+	return pt, nil
+}
+
+// scriptRedact implements dvid.redact(value, offset, size, min, max, bytes=1, fill=0).
+func scriptRedact(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
+	kwargs []starlark.Tuple) (starlark.Value, error) {
+
+	var value starlark.Bytes
+	var offsetV, sizeV, minV, maxV starlark.Value
+	bytesPerVoxel, fill := 1, 0
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "value", &value, "offset", &offsetV,
+		"size", &sizeV, "min", &minV, "max", &maxV, "bytes?", &bytesPerVoxel, "fill?", &fill); err != nil {
+		return nil, err
+	}
+	var pts [4]Point3d
+	for n, v := range []starlark.Value{offsetV, sizeV, minV, maxV} {
+		var err error
+		if pts[n], err = scriptPoint(b.Name(), v); err != nil {
+			return nil, err
+		}
+	}
+	if fill < 0 || fill > 255 {
+		return nil, fmt.Errorf("%s: fill must be a byte, not %d", b.Name(), fill)
+	}
+	redacted, err := RedactSubvolume([]byte(value), bytesPerVoxel, pts[0], pts[1], pts[2], pts[3], byte(fill))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err.Error())
+	}
+	return starlark.Bytes(redacted), nil
+}
+
+// newScriptThread returns a thread limited to ScriptMaxSteps.
+func newScriptThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{Name: name}
+	thread.SetMaxExecutionSteps(ScriptMaxSteps)
+	return thread
+}
+
+// scriptMemoryInterval is how often the heap is checked while a script call runs.
+const scriptMemoryInterval = 10 * time.Millisecond
+
+// heapAlloc returns the bytes of allocated heap objects.
+func heapAlloc() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// watchScript cancels a script call once its context is done or the heap has grown by
+// more than ScriptMaxMemory since it was the given size.
+func watchScript(ctx context.Context, thread *starlark.Thread, start uint64) {
+	ticker := time.NewTicker(scriptMemoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+			return
+		case <-ticker.C:
+			if heapAlloc() > start+ScriptMaxMemory {
+				thread.Cancel(fmt.Sprintf("script used more than %d bytes of memory", ScriptMaxMemory))
+				return
+			}
+		}
+	}
+}
+
+// CompileScript runs the top level of a script's source and returns the script.
+func CompileScript(name, source string) (*Script, error) {
+	predeclared := starlark.StringDict{"json": json.Module, "dvid": scriptModule}
+	globals, err := starlark.ExecFile(newScriptThread(name), name+".star", source, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("Bad script %q: %s", name, err.Error())
+	}
+	transform, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("Script %q must define a transform(value, request) function", name)
+	}
+	return &Script{name, transform}, nil
+}
+
+// Transform calls the script's transform function with a value and its request.  The
+// call is canceled if the context is done.
+func (s *Script) Transform(ctx context.Context, value []byte, req ScriptRequest) ([]byte, error) {
+	if len(value) > ScriptMaxBytes {
+		return nil, fmt.Errorf("Script %q can't transform %d bytes, more than the %d byte limit",
+			s.name, len(value), ScriptMaxBytes)
+	}
+	path := make([]starlark.Value, len(req.Path))
+	for i, part := range req.Path {
+		path[i] = starlark.String(part)
+	}
+	query := starlark.NewDict(len(req.Query))
+	for key, v := range req.Query {
+		query.SetKey(starlark.String(key), starlark.String(v))
+	}
+	request := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"method":   starlark.String(req.Method),
+		"uuid":     starlark.String(req.UUID),
+		"data":     starlark.String(req.Data),
+		"endpoint": starlark.String(req.Endpoint),
+		"path":     starlark.NewList(path),
+		"query":    query,
+	})
+
+	thread := newScriptThread(s.name)
+	ctx, cancel := context.WithTimeout(ctx, ScriptTimeout)
+	defer cancel()
+	go watchScript(ctx, thread, heapAlloc())
+	result, err := starlark.Call(thread, s.transform, starlark.Tuple{starlark.Bytes(value), request}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Script %q failed: %s", s.name, err.Error())
+	}
+	var transformed []byte
+	switch v := result.(type) {
+	case starlark.Bytes:
+		transformed = []byte(v)
+	case starlark.String:
+		transformed = []byte(v)
+	default:
+		return nil, fmt.Errorf("Script %q returned a %s instead of bytes or a string", s.name, result.Type())
+	}
+	if len(transformed) > ScriptMaxBytes {
+		return nil, fmt.Errorf("Script %q returned %d bytes, more than the %d byte limit",
+			s.name, len(transformed), ScriptMaxBytes)
+	}
+	return transformed, nil
+}
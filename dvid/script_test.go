@@ -0,0 +1,56 @@
+package dvid
+
+import (
+	"encoding/binary"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestRemapValues(c *C) {
+	data := make([]byte, 24)
+	for i, label := range []uint64{7, 9, 1 << 40} {
+		binary.LittleEndian.PutUint64(data[i*8:], label)
+	}
+	remapped, err := RemapValues(data, 8, map[uint64]uint64{7: 70, 1 << 40: 3})
+	c.Assert(err, IsNil)
+	c.Assert(binary.LittleEndian.Uint64(remapped), Equals, uint64(70))
+	c.Assert(binary.LittleEndian.Uint64(remapped[8:]), Equals, uint64(9))
+	c.Assert(binary.LittleEndian.Uint64(remapped[16:]), Equals, uint64(3))
+	c.Assert(binary.LittleEndian.Uint64(data), Equals, uint64(7))
+
+	remapped, err = RemapValues([]byte{1, 2, 1}, 1, map[uint64]uint64{1: 5})
+	c.Assert(err, IsNil)
+	c.Assert(remapped, DeepEquals, []byte{5, 2, 5})
+
+	_, err = RemapValues(data, 3, nil)
+	c.Assert(err, NotNil)
+	_, err = RemapValues(data[:20], 8, nil)
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestRedactSubvolume(c *C) {
+	// A 3x2x2 subvolume at (10, 20, 30) with the box clipped to x >= 11 and z = 31.
+	data := make([]byte, 12)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	redacted, err := RedactSubvolume(data, 1, Point3d{10, 20, 30}, Point3d{3, 2, 2},
+		Point3d{11, 0, 31}, Point3d{100, 100, 100}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(redacted, DeepEquals, []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 10, 0, 0})
+
+	// Boxes outside the subvolume leave it unchanged.
+	redacted, err = RedactSubvolume(data, 1, Point3d{10, 20, 30}, Point3d{3, 2, 2},
+		Point3d{0, 0, 0}, Point3d{9, 100, 100}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(redacted, DeepEquals, data)
+
+	// Multi-byte voxels are filled whole.
+	redacted, err = RedactSubvolume([]byte{1, 1, 2, 2}, 2, Point3d{0, 0, 0}, Point3d{2, 1, 1},
+		Point3d{1, 0, 0}, Point3d{1, 0, 0}, 0xff)
+	c.Assert(err, IsNil)
+	c.Assert(redacted, DeepEquals, []byte{1, 1, 0xff, 0xff})
+
+	_, err = RedactSubvolume(data, 2, Point3d{0, 0, 0}, Point3d{3, 2, 2}, Point3d{}, Point3d{}, 0)
+	c.Assert(err, NotNil)
+}
@@ -260,81 +260,93 @@ func Serialize(object interface{}, compress Compression, checksum Checksum) ([]b
 	return SerializeData(buffer.Bytes(), compress, checksum)
 }
 
-// DeserializeData deserializes a slice of bytes using stored compression, checksum.
-// If uncompress parameter is false, the data is not uncompressed.
-func DeserializeData(s []byte, uncompress bool) ([]byte, CompressionFormat, error) {
-	buffer := bytes.NewBuffer(s)
-
-	// Get the stored compression and checksum
-	var format SerializationFormat
-	if err := binary.Read(buffer, binary.LittleEndian, &format); err != nil {
-		return nil, 0, fmt.Errorf("Could not read serialization format info: %s", err.Error())
+// deserializeHeader returns the compression of serialized data and the possibly
+// compressed data following the header, verifying any stored checksum.  The returned
+// data is a sub-slice of s.
+func deserializeHeader(s []byte) (CompressionFormat, []byte, error) {
+	if len(s) < 1 {
+		return 0, nil, fmt.Errorf("Could not read serialization format info: no data")
 	}
-	compression, checksum := DecodeSerializationFormat(format)
+	compression, checksum := DecodeSerializationFormat(SerializationFormat(s[0]))
+	cdata := s[1:]
 
-	// Get any checksum.
-	var storedCrc32 uint32
 	switch checksum {
 	case NoChecksum:
 	case CRC32:
-		if err := binary.Read(buffer, binary.LittleEndian, &storedCrc32); err != nil {
-			return nil, 0, fmt.Errorf("Error reading checksum: %s", err.Error())
+		if len(cdata) < 4 {
+			return 0, nil, fmt.Errorf("Error reading checksum: only %d bytes of data", len(cdata))
+		}
+		storedCrc32 := binary.LittleEndian.Uint32(cdata)
+		cdata = cdata[4:]
+		if crcChecksum := crc32.ChecksumIEEE(cdata); crcChecksum != storedCrc32 {
+			return 0, nil, fmt.Errorf("Bad checksum.  Stored %x got %x", storedCrc32, crcChecksum)
 		}
 	default:
-		return nil, 0, fmt.Errorf("Illegal checksum in deserializing data")
+		return 0, nil, fmt.Errorf("Illegal checksum in deserializing data")
 	}
+	return compression, cdata, nil
+}
 
-	// Get the possibly compressed data.
-	cdata := buffer.Bytes()
-
-	// Perform any requested checksum
-	switch checksum {
-	case CRC32:
-		crcChecksum := crc32.ChecksumIEEE(cdata)
-		if crcChecksum != storedCrc32 {
-			return nil, 0, fmt.Errorf("Bad checksum.  Stored %x got %x", storedCrc32, crcChecksum)
-		}
+// DeserializeData deserializes a slice of bytes using stored compression, checksum.
+// If uncompress parameter is false, the data is not uncompressed.
+func DeserializeData(s []byte, uncompress bool) ([]byte, CompressionFormat, error) {
+	if uncompress {
+		return DeserializeDataTo(s, nil)
+	}
+	compression, cdata, err := deserializeHeader(s)
+	if err != nil {
+		return nil, 0, err
 	}
+	return cdata, compression, nil
+}
 
-	// Return data with optional compression
-	if !uncompress || compression == Uncompressed {
+// DeserializeDataTo deserializes and uncompresses a slice of bytes while avoiding
+// copies and allocations where possible.  Uncompressed data is returned as a sub-slice
+// of s, and Snappy or LZ4 data is decoded into dst if its capacity is large enough,
+// so the returned data may share memory with either.
+func DeserializeDataTo(s, dst []byte) ([]byte, CompressionFormat, error) {
+	compression, cdata, err := deserializeHeader(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch compression {
+	case Uncompressed:
 		return cdata, compression, nil
-	} else {
-		switch compression {
-		case Snappy:
-			if data, err := snappy.Decode(nil, cdata); err != nil {
-				return nil, 0, err
-			} else {
-				return data, compression, nil
-			}
-		case LZ4:
-			origSize := binary.LittleEndian.Uint32(cdata[0:4])
-			data := make([]byte, int(origSize))
-			if err := lz4.Uncompress(cdata[4:], data); err != nil {
-				return nil, 0, err
-			} else {
-				return data, compression, nil
-			}
-		case Gzip:
-			b := bytes.NewBuffer(cdata)
-			var err error
-			r, err := gzip.NewReader(b)
-			if err != nil {
-				return nil, 0, err
-			}
-			var buffer bytes.Buffer
-			_, err = io.Copy(&buffer, r)
-			if err != nil {
-				return nil, 0, err
-			}
-			err = r.Close()
-			if err != nil {
-				return nil, 0, err
-			}
-			return buffer.Bytes(), compression, nil
-		default:
-			return nil, 0, fmt.Errorf("Illegal compression format (%d) in deserialization", compression)
+	case Snappy:
+		data, err := snappy.Decode(dst[:cap(dst)], cdata)
+		if err != nil {
+			return nil, 0, err
+		}
+		return data, compression, nil
+	case LZ4:
+		if len(cdata) < 4 {
+			return nil, 0, fmt.Errorf("LZ4 data too short to hold its size")
+		}
+		origSize := int(binary.LittleEndian.Uint32(cdata[0:4]))
+		data := dst[:0]
+		if cap(data) < origSize {
+			data = make([]byte, origSize)
 		}
+		data = data[:origSize]
+		if err := lz4.Uncompress(cdata[4:], data); err != nil {
+			return nil, 0, err
+		}
+		return data, compression, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewBuffer(cdata))
+		if err != nil {
+			return nil, 0, err
+		}
+		buffer := bytes.NewBuffer(dst[:0])
+		if _, err = io.Copy(buffer, r); err != nil {
+			return nil, 0, err
+		}
+		if err = r.Close(); err != nil {
+			return nil, 0, err
+		}
+		return buffer.Bytes(), compression, nil
+	default:
+		return nil, 0, fmt.Errorf("Illegal compression format (%d) in deserialization", compression)
 	}
 }
 
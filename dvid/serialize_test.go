@@ -75,6 +75,32 @@ func (suite *DataSuite) TestSerialization(c *C) {
 	}
 }
 
+func (suite *DataSuite) TestDeserializeDataTo(c *C) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 7)
+	}
+	dst := make([]byte, 0, len(data))
+	for _, format := range []CompressionFormat{Uncompressed, Snappy, LZ4, Gzip} {
+		compression, err := NewCompression(format, DefaultCompression)
+		c.Assert(err, IsNil)
+		s, err := SerializeData(data, compression, CRC32)
+		c.Assert(err, IsNil)
+
+		decoded, actual, err := DeserializeDataTo(s, dst)
+		c.Assert(err, IsNil)
+		c.Assert(actual, Equals, format)
+		c.Assert(decoded, DeepEquals, data)
+		if format == Uncompressed {
+			// Uncompressed data should be read in place.
+			c.Assert(&decoded[0], Equals, &s[len(s)-len(data)])
+			s[len(s)-1] ^= 0x04
+			_, _, err = DeserializeDataTo(s, dst)
+			c.Assert(err, NotNil)
+		}
+	}
+}
+
 func (suite *DataSuite) testUncompressed(b *testing.B, checksum Checksum) {
 	stringObj := "Hi there!"
 	var returnObj string
@@ -0,0 +1,322 @@
+/*
+	This file implements a TIFF encoder that handles 8 and 16-bit grayscale as well as RGBA
+	images, optional LZW or Deflate compression, and multi-page TIFFs so stacks of slices
+	can be returned in one response.  Many analysis tools ingest TIFF stacks directly.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// TIFFCompression is the compression scheme used for TIFF image data.
+type TIFFCompression uint16
+
+const (
+	TIFFUncompressed TIFFCompression = 1
+	TIFFLZW          TIFFCompression = 5
+	TIFFDeflate      TIFFCompression = 8
+)
+
+// DefaultTIFFCompression is used when TIFF images are requested without a compression option.
+const DefaultTIFFCompression = TIFFDeflate
+
+func (c TIFFCompression) String() string {
+	switch c {
+	case TIFFUncompressed:
+		return "none"
+	case TIFFLZW:
+		return "lzw"
+	case TIFFDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("unknown TIFF compression %d", c)
+	}
+}
+
+// StringToTIFFCompression returns the TIFF compression for an option string, e.g.,
+// the "lzw" in "tiff:lzw".  An empty string returns the default compression.
+func StringToTIFFCompression(s string) (TIFFCompression, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return DefaultTIFFCompression, nil
+	case "none", "raw":
+		return TIFFUncompressed, nil
+	case "lzw":
+		return TIFFLZW, nil
+	case "deflate", "zip":
+		return TIFFDeflate, nil
+	default:
+		return 0, fmt.Errorf("Unknown TIFF compression '%s'", s)
+	}
+}
+
+// TIFF tags and field types used by the encoder.
+const (
+	tiffTagNewSubfileType   = 254
+	tiffTagImageWidth       = 256
+	tiffTagImageLength      = 257
+	tiffTagBitsPerSample    = 258
+	tiffTagCompression      = 259
+	tiffTagPhotometric      = 262
+	tiffTagStripOffsets     = 273
+	tiffTagSamplesPerPixel  = 277
+	tiffTagRowsPerStrip     = 278
+	tiffTagStripByteCounts  = 279
+	tiffTagPlanarConfig     = 284
+	tiffTagPageNumber       = 297
+	tiffTagExtraSamples     = 338
+	tiffTagSampleFormat     = 339
+	tiffTypeShort           = 3
+	tiffTypeLong            = 4
+	tiffPhotometricBlackIs0 = 1
+	tiffPhotometricRGB      = 2
+	tiffPageSubfile         = 2
+	tiffUnassociatedAlpha   = 2
+	tiffSampleUnsigned      = 1
+)
+
+type tiffEntry struct {
+	tag    uint16
+	typ    uint16
+	values []uint32
+}
+
+// tiffPage holds the encoded strip and layout information for one image.
+type tiffPage struct {
+	width, height   int
+	bitsPerSample   uint32
+	samplesPerPixel uint32
+	strip           []byte
+}
+
+// pixelsForTIFF returns big endian packed pixel data for an image along with its layout.
+func pixelsForTIFF(img image.Image) (page tiffPage, pixels []byte) {
+	bounds := img.Bounds()
+	page.width = bounds.Dx()
+	page.height = bounds.Dy()
+	var rowBytes, stride, offset int
+	var pix []byte
+	switch t := img.(type) {
+	case *image.Gray:
+		page.bitsPerSample, page.samplesPerPixel = 8, 1
+		rowBytes, stride, pix, offset = page.width, t.Stride, t.Pix, t.PixOffset(bounds.Min.X, bounds.Min.Y)
+	case *image.Gray16:
+		page.bitsPerSample, page.samplesPerPixel = 16, 1
+		rowBytes, stride, pix, offset = 2*page.width, t.Stride, t.Pix, t.PixOffset(bounds.Min.X, bounds.Min.Y)
+	case *image.NRGBA64:
+		page.bitsPerSample, page.samplesPerPixel = 16, 4
+		rowBytes, stride, pix, offset = 8*page.width, t.Stride, t.Pix, t.PixOffset(bounds.Min.X, bounds.Min.Y)
+	default:
+		nrgba := ImageToNRGBA(img)
+		page.bitsPerSample, page.samplesPerPixel = 8, 4
+		rowBytes, stride, pix, offset = 4*page.width, nrgba.Stride, nrgba.Pix, 0
+	}
+	pixels = make([]byte, rowBytes*page.height)
+	for y := 0; y < page.height; y++ {
+		copy(pixels[y*rowBytes:(y+1)*rowBytes], pix[offset+y*stride:offset+y*stride+rowBytes])
+	}
+	return
+}
+
+// EncodeTIFF writes one or more images as pages of a big endian TIFF file.
+func EncodeTIFF(w io.Writer, pages []image.Image, compression TIFFCompression) error {
+	if len(pages) == 0 {
+		return fmt.Errorf("Cannot encode TIFF without any images")
+	}
+	encoded := make([]tiffPage, len(pages))
+	for i, img := range pages {
+		page, pixels := pixelsForTIFF(img)
+		switch compression {
+		case TIFFUncompressed:
+			page.strip = pixels
+		case TIFFLZW:
+			page.strip = lzwEncodeTIFF(pixels)
+		case TIFFDeflate:
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			if _, err := zw.Write(pixels); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			page.strip = buf.Bytes()
+		default:
+			return fmt.Errorf("Unsupported TIFF compression: %s", compression)
+		}
+		encoded[i] = page
+	}
+
+	// Layout: header, then for each page its strip, out-of-line values, and IFD.
+	var buf bytes.Buffer
+	buf.Write([]byte{'M', 'M', 0, 42})
+	binary.Write(&buf, binary.BigEndian, uint32(8))
+	nextIFDPos := 4
+	for i, page := range encoded {
+		if buf.Len()%2 != 0 {
+			buf.WriteByte(0)
+		}
+		stripOffset := uint32(buf.Len())
+		buf.Write(page.strip)
+
+		bitsPerSample := make([]uint32, page.samplesPerPixel)
+		for s := range bitsPerSample {
+			bitsPerSample[s] = page.bitsPerSample
+		}
+		sampleFormat := make([]uint32, page.samplesPerPixel)
+		for s := range sampleFormat {
+			sampleFormat[s] = tiffSampleUnsigned
+		}
+		photometric := uint32(tiffPhotometricBlackIs0)
+		if page.samplesPerPixel == 4 {
+			photometric = tiffPhotometricRGB
+		}
+		entries := []tiffEntry{
+			{tiffTagNewSubfileType, tiffTypeLong, []uint32{0}},
+			{tiffTagImageWidth, tiffTypeLong, []uint32{uint32(page.width)}},
+			{tiffTagImageLength, tiffTypeLong, []uint32{uint32(page.height)}},
+			{tiffTagBitsPerSample, tiffTypeShort, bitsPerSample},
+			{tiffTagCompression, tiffTypeShort, []uint32{uint32(compression)}},
+			{tiffTagPhotometric, tiffTypeShort, []uint32{photometric}},
+			{tiffTagStripOffsets, tiffTypeLong, []uint32{stripOffset}},
+			{tiffTagSamplesPerPixel, tiffTypeShort, []uint32{page.samplesPerPixel}},
+			{tiffTagRowsPerStrip, tiffTypeLong, []uint32{uint32(page.height)}},
+			{tiffTagStripByteCounts, tiffTypeLong, []uint32{uint32(len(page.strip))}},
+			{tiffTagPlanarConfig, tiffTypeShort, []uint32{1}},
+		}
+		if len(encoded) > 1 {
+			entries[0].values[0] = tiffPageSubfile
+			entries = append(entries, tiffEntry{tiffTagPageNumber, tiffTypeShort,
+				[]uint32{uint32(i), uint32(len(encoded))}})
+		}
+		if page.samplesPerPixel == 4 {
+			entries = append(entries, tiffEntry{tiffTagExtraSamples, tiffTypeShort,
+				[]uint32{tiffUnassociatedAlpha}})
+		}
+		entries = append(entries, tiffEntry{tiffTagSampleFormat, tiffTypeShort, sampleFormat})
+
+		// Write values that don't fit in the 4-byte IFD entry before the IFD itself.
+		outOfLine := make([]uint32, len(entries))
+		for n, entry := range entries {
+			if entrySize(entry) > 4 {
+				if buf.Len()%2 != 0 {
+					buf.WriteByte(0)
+				}
+				outOfLine[n] = uint32(buf.Len())
+				writeTIFFValues(&buf, entry)
+			}
+		}
+		if buf.Len()%2 != 0 {
+			buf.WriteByte(0)
+		}
+
+		// Patch the header or the previous IFD's next offset to point to this IFD.
+		binary.BigEndian.PutUint32(buf.Bytes()[nextIFDPos:nextIFDPos+4], uint32(buf.Len()))
+		binary.Write(&buf, binary.BigEndian, uint16(len(entries)))
+		for n, entry := range entries {
+			binary.Write(&buf, binary.BigEndian, entry.tag)
+			binary.Write(&buf, binary.BigEndian, entry.typ)
+			binary.Write(&buf, binary.BigEndian, uint32(len(entry.values)))
+			if entrySize(entry) > 4 {
+				binary.Write(&buf, binary.BigEndian, outOfLine[n])
+			} else {
+				var inline bytes.Buffer
+				writeTIFFValues(&inline, entry)
+				for inline.Len() < 4 {
+					inline.WriteByte(0)
+				}
+				buf.Write(inline.Bytes())
+			}
+		}
+		nextIFDPos = buf.Len()
+		binary.Write(&buf, binary.BigEndian, uint32(0))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func entrySize(entry tiffEntry) int {
+	if entry.typ == tiffTypeShort {
+		return 2 * len(entry.values)
+	}
+	return 4 * len(entry.values)
+}
+
+func writeTIFFValues(buf *bytes.Buffer, entry tiffEntry) {
+	for _, value := range entry.values {
+		if entry.typ == tiffTypeShort {
+			binary.Write(buf, binary.BigEndian, uint16(value))
+		} else {
+			binary.Write(buf, binary.BigEndian, value)
+		}
+	}
+}
+
+// lzwEncodeTIFF compresses data using the TIFF variant of LZW: MSB-first codes
+// with the "early change" code width increase expected by TIFF readers.
+func lzwEncodeTIFF(data []byte) []byte {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		maxCode   = 4093
+	)
+	var out bytes.Buffer
+	var bitBuf uint32
+	var bitCount uint
+	width := uint(9)
+	emit := func(code int) {
+		bitBuf = (bitBuf << width) | uint32(code)
+		bitCount += width
+		for bitCount >= 8 {
+			out.WriteByte(byte(bitBuf >> (bitCount - 8)))
+			bitCount -= 8
+		}
+	}
+
+	table := make(map[uint32]int)
+	nextCode := 258
+	emit(clearCode)
+	if len(data) == 0 {
+		emit(eoiCode)
+	} else {
+		prefix := int(data[0])
+		for _, c := range data[1:] {
+			key := uint32(prefix)<<8 | uint32(c)
+			if code, found := table[key]; found {
+				prefix = code
+				continue
+			}
+			emit(prefix)
+			table[key] = nextCode
+			nextCode++
+			if nextCode+1 > 1<<width && width < 12 {
+				width++
+			}
+			if nextCode >= maxCode {
+				emit(clearCode)
+				table = make(map[uint32]int)
+				nextCode = 258
+				width = 9
+			}
+			prefix = int(c)
+		}
+		emit(prefix)
+		nextCode++
+		if nextCode+1 > 1<<width && width < 12 {
+			width++
+		}
+		emit(eoiCode)
+	}
+	if bitCount > 0 {
+		out.WriteByte(byte(bitBuf << (8 - bitCount)))
+	}
+	return out.Bytes()
+}
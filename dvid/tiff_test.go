@@ -0,0 +1,95 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math/rand"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/go/go.image/tiff"
+)
+
+// countTIFFPages follows the IFD chain of a big endian TIFF.
+func countTIFFPages(data []byte) int {
+	pages := 0
+	offset := binary.BigEndian.Uint32(data[4:8])
+	for offset != 0 {
+		pages++
+		numEntries := uint32(binary.BigEndian.Uint16(data[offset : offset+2]))
+		next := offset + 2 + 12*numEntries
+		offset = binary.BigEndian.Uint32(data[next : next+4])
+	}
+	return pages
+}
+
+func (suite *DataSuite) TestTIFFEncoding(c *C) {
+	rand.Seed(42)
+	gray := image.NewGray(image.Rect(0, 0, 300, 200))
+	for i := range gray.Pix {
+		// Mix of runs and noise to exercise LZW table growth and clearing.
+		if i%7 == 0 {
+			gray.Pix[i] = byte(rand.Intn(256))
+		} else {
+			gray.Pix[i] = byte(i / 50)
+		}
+	}
+	gray16 := image.NewGray16(image.Rect(0, 0, 33, 17))
+	for i := range gray16.Pix {
+		gray16.Pix[i] = byte(rand.Intn(256))
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 10, 12))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = byte(rand.Intn(256))
+	}
+
+	for _, compression := range []TIFFCompression{TIFFUncompressed, TIFFLZW, TIFFDeflate} {
+		for _, img := range []image.Image{gray, gray16, nrgba} {
+			var buf bytes.Buffer
+			err := EncodeTIFF(&buf, []image.Image{img}, compression)
+			c.Assert(err, IsNil)
+			decoded, err := tiff.Decode(&buf)
+			c.Assert(err, IsNil)
+			c.Assert(decoded.Bounds(), DeepEquals, img.Bounds())
+			bounds := img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					r0, g0, b0, a0 := img.At(x, y).RGBA()
+					r1, g1, b1, a1 := decoded.At(x, y).RGBA()
+					if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+						c.Fatalf("%s TIFF of %T differs at (%d,%d)", compression, img, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (suite *DataSuite) TestMultiPageTIFF(c *C) {
+	var pages []image.Image
+	for z := 0; z < 5; z++ {
+		img := image.NewGray(image.Rect(0, 0, 16, 16))
+		for i := range img.Pix {
+			img.Pix[i] = byte(z)
+		}
+		pages = append(pages, img)
+	}
+	var buf bytes.Buffer
+	err := EncodeTIFF(&buf, pages, TIFFLZW)
+	c.Assert(err, IsNil)
+	c.Assert(countTIFFPages(buf.Bytes()), Equals, 5)
+
+	decoded, err := tiff.Decode(bytes.NewReader(buf.Bytes()))
+	c.Assert(err, IsNil)
+	c.Assert(decoded.Bounds().Dx(), Equals, 16)
+
+	err = EncodeTIFF(&buf, nil, TIFFLZW)
+	c.Assert(err, NotNil)
+
+	_, err = StringToTIFFCompression("jpeg")
+	c.Assert(err, NotNil)
+	compression, err := StringToTIFFCompression("")
+	c.Assert(err, IsNil)
+	c.Assert(compression, Equals, DefaultTIFFCompression)
+}
@@ -0,0 +1,61 @@
+/*
+	This file accumulates where a request spends its time, e.g., reading storage versus
+	decoding blocks, so slow requests can be explained.  Time is added to phases of the
+	Timings held by a context, and adding time is a no-op for contexts without Timings.
+*/
+
+package dvid
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Phases of a request's time.  Phases done concurrently, like decoding blocks, sum the
+// time of each goroutine so they can exceed the request's latency.
+const (
+	StorageTime = "storage"
+	DecodeTime  = "decode"
+	EncodeTime  = "encode"
+)
+
+// Timings accumulates the time spent in phases of a request.  It is safe for concurrent use.
+type Timings struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+type timingsKey struct{}
+
+// WithTimings returns a context that accumulates timings of a request.
+func WithTimings(ctx context.Context) (context.Context, *Timings) {
+	timings := &Timings{phases: make(map[string]time.Duration)}
+	return context.WithValue(ctx, timingsKey{}, timings), timings
+}
+
+// AddTiming adds the time since start to a phase of the context's timings, if any.
+func AddTiming(ctx context.Context, phase string, start time.Time) {
+	if ctx == nil {
+		return
+	}
+	timings, ok := ctx.Value(timingsKey{}).(*Timings)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start)
+	timings.mu.Lock()
+	timings.phases[phase] += elapsed
+	timings.mu.Unlock()
+}
+
+// Milliseconds returns the accumulated time of each phase in milliseconds.
+func (timings *Timings) Milliseconds() map[string]float64 {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	ms := make(map[string]float64, len(timings.phases))
+	for phase, elapsed := range timings.phases {
+		ms[phase] = float64(elapsed) / float64(time.Millisecond)
+	}
+	return ms
+}
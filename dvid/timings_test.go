@@ -0,0 +1,35 @@
+package dvid
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestTimings(c *C) {
+	// Contexts without timings ignore added time.
+	AddTiming(context.Background(), StorageTime, time.Now())
+	AddTiming(nil, StorageTime, time.Now())
+
+	ctx, timings := WithTimings(context.Background())
+	c.Assert(timings.Milliseconds(), HasLen, 0)
+
+	start := time.Now().Add(-10 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			AddTiming(ctx, DecodeTime, start)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	AddTiming(ctx, StorageTime, start)
+
+	ms := timings.Milliseconds()
+	c.Assert(ms, HasLen, 2)
+	c.Assert(ms[StorageTime] >= 10, Equals, true)
+	c.Assert(ms[DecodeTime] >= 40, Equals, true)
+}
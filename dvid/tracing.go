@@ -0,0 +1,190 @@
+/*
+	This file implements request tracing compatible with OpenTelemetry.  Spans time
+	operations and nest through contexts, and trace context is propagated between
+	processes using the W3C "traceparent" header.  Finished spans are handed to an
+	exporter, e.g., one sending OTLP to a collector.  Without an exporter, StartSpan
+	returns a nil span whose methods do nothing, so tracing costs little when off.
+*/
+
+package dvid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, i.e., all the spans of a request across processes.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid returns true if the trace ID isn't all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid returns true if the span ID isn't all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// Span is a timed operation within a trace.
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID // zero for a root span
+	Name     string
+	Start    time.Time
+	End      time.Time
+
+	// Attributes describe the operation, e.g., "http.method".
+	Attributes map[string]interface{}
+
+	// Error is the error message if the operation failed.
+	Error string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SpanExporter receives finished spans.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+var tracing struct {
+	sync.RWMutex
+	exporter SpanExporter
+}
+
+// SetSpanExporter sets the exporter of finished spans, turning on tracing, or turns off
+// tracing if the exporter is nil.
+func SetSpanExporter(exporter SpanExporter) {
+	tracing.Lock()
+	tracing.exporter = exporter
+	tracing.Unlock()
+}
+
+// TracingEnabled returns true if spans are being exported.
+func TracingEnabled() bool {
+	tracing.RLock()
+	defer tracing.RUnlock()
+	return tracing.exporter != nil
+}
+
+type spanKey struct{}
+
+// remoteParent is the span context of a parent in another process.
+type remoteParent struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+// SpanFromContext returns the span of a context or nil if there's none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span that's a child of the context's span, or of a remote parent
+// set by ContextWithTraceParent, returning a context holding the new span.  If tracing
+// is off, the context is returned unchanged with a nil span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if !TracingEnabled() {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Start: time.Now()}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else if remote, ok := ctx.Value(remoteParent{}).(remoteParent); ok {
+		span.TraceID = remote.traceID
+		span.ParentID = remote.spanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute describes the span's operation with a key and a string, bool, or
+// numeric value.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]interface{})
+	}
+	span.Attributes[key] = value
+	span.mu.Unlock()
+}
+
+// SetError marks the span as failed if the error isn't nil.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mu.Lock()
+	span.Error = err.Error()
+	span.mu.Unlock()
+}
+
+// Finish ends the span and exports it.  Only the first call has an effect.
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.End = time.Now()
+	span.mu.Unlock()
+
+	tracing.RLock()
+	exporter := tracing.exporter
+	tracing.RUnlock()
+	if exporter != nil {
+		exporter.ExportSpan(span)
+	}
+}
+
+// TraceParent returns the W3C "traceparent" header value that makes the span the parent
+// of spans in another process, or an empty string for a nil span.
+func (span *Span) TraceParent() string {
+	if span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", span.TraceID, span.SpanID)
+}
+
+// ContextWithTraceParent returns a context whose spans continue the trace described by
+// a W3C "traceparent" header value.  Malformed values are ignored.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx
+	}
+	var remote remoteParent
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(traceID) != len(remote.traceID) || len(spanID) != len(remote.spanID) {
+		return ctx
+	}
+	copy(remote.traceID[:], traceID)
+	copy(remote.spanID[:], spanID)
+	if !remote.traceID.IsValid() || !remote.spanID.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParent{}, remote)
+}
@@ -0,0 +1,61 @@
+package dvid
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+type collectedSpans struct {
+	sync.Mutex
+	spans []*Span
+}
+
+func (collected *collectedSpans) ExportSpan(span *Span) {
+	collected.Lock()
+	collected.spans = append(collected.spans, span)
+	collected.Unlock()
+}
+
+func (suite *DataSuite) TestTracing(c *C) {
+	// Spans are nil and harmless when tracing is off.
+	ctx, span := StartSpan(context.Background(), "untraced")
+	c.Assert(span, IsNil)
+	c.Assert(SpanFromContext(ctx), IsNil)
+	span.SetAttribute("key", "value")
+	span.Finish()
+
+	collected := new(collectedSpans)
+	SetSpanExporter(collected)
+	defer SetSpanExporter(nil)
+
+	// A request continues the trace of its caller.
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx = ContextWithTraceParent(context.Background(), traceparent)
+	ctx, request := StartSpan(ctx, "HTTP GET")
+	c.Assert(request.TraceID.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(request.ParentID.String(), Equals, "00f067aa0ba902b7")
+	c.Assert(SpanFromContext(ctx), Equals, request)
+
+	_, child := StartSpan(ctx, "storage.ProcessRange")
+	c.Assert(child.TraceID, Equals, request.TraceID)
+	c.Assert(child.ParentID, Equals, request.SpanID)
+	child.SetAttribute("keys", 12)
+	child.Finish()
+	child.Finish()
+	request.Finish()
+	c.Assert(collected.spans, HasLen, 2)
+	c.Assert(collected.spans[0].Attributes["keys"], Equals, 12)
+	c.Assert(collected.spans[1].TraceParent(), Equals,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-"+request.SpanID.String()+"-01")
+
+	// Malformed trace context starts a new trace.
+	for _, bad := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01"} {
+		_, span := StartSpan(ContextWithTraceParent(context.Background(), bad), "new")
+		c.Assert(span.TraceID.IsValid(), Equals, true)
+		c.Assert(span.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736", Equals, true)
+		c.Assert(span.ParentID.IsValid(), Equals, false)
+	}
+}
@@ -0,0 +1,477 @@
+/*
+	This file implements a registry of transcoders so data formats like "png", "jpg:80",
+	"npy", or "nrrd:gzip" are encoded and decoded the same way across all datatypes.
+	A format string is a transcoder name optionally followed by ":" and an option that
+	is interpreted by the transcoder, e.g., a quality or compression setting.
+*/
+
+package dvid
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/janelia-flyem/go/go.image/bmp"
+)
+
+// Array is n-d voxel data with the metadata needed to transcode it.
+type Array struct {
+	Values    DataValues
+	ByteOrder binary.ByteOrder
+
+	// Size of the array, with the first dimension varying fastest.
+	Size Point
+
+	// Offset is the coordinate of the first voxel.  Optional.
+	Offset Point
+
+	// VoxelSize and VoxelUnits give the resolution along each dimension.  Optional.
+	VoxelSize  NdFloat32
+	VoxelUnits NdString
+
+	Data []byte
+}
+
+// ArrayEncoder writes an array in some format given an option string.
+type ArrayEncoder func(w io.Writer, a *Array, option string) error
+
+// ArrayDecoder reads data into an array whose Values, ByteOrder, and Size are already set
+// to the expected values.  The decoder sets Data in the array's byte order and returns
+// an error if the encoded data doesn't match.
+type ArrayDecoder func(r io.Reader, a *Array, option string) error
+
+// ImageDecoder reads a 2d image.
+type ImageDecoder func(r io.Reader, option string) (image.Image, error)
+
+// Transcoder converts data to and from a named format.  Functions that don't apply to
+// a format, e.g., EncodeImage for "npy", are nil.
+type Transcoder struct {
+	Name        string
+	ContentType string
+
+	EncodeImage ImageEncoder
+	DecodeImage ImageDecoder
+	EncodeArray ArrayEncoder
+	DecodeArray ArrayDecoder
+}
+
+var (
+	transcoders       = map[string]*Transcoder{}
+	transcoderAliases = map[string]string{}
+)
+
+// RegisterTranscoder makes a transcoder available by its name and any aliases.
+func RegisterTranscoder(t *Transcoder, aliases ...string) {
+	name := strings.ToLower(t.Name)
+	transcoders[name] = t
+	for _, alias := range aliases {
+		transcoderAliases[strings.ToLower(alias)] = name
+	}
+}
+
+// RegisterImageFormat adds an image format that can be requested by name as the
+// format suffix of slice and tile requests.
+func RegisterImageFormat(name, contentType string, encode ImageEncoder) {
+	RegisterTranscoder(&Transcoder{Name: name, ContentType: contentType, EncodeImage: encode})
+}
+
+// ParseFormat splits a format string like "jpg:80" into its lower case name and option.
+func ParseFormat(formatStr string) (name, option string) {
+	format := strings.SplitN(formatStr, ":", 2)
+	if len(format) > 1 {
+		option = format[1]
+	}
+	name = strings.ToLower(format[0])
+	if alias, found := transcoderAliases[name]; found {
+		name = alias
+	}
+	return
+}
+
+// GetTranscoder returns the transcoder and option for a format string.
+func GetTranscoder(formatStr string) (t *Transcoder, option string, err error) {
+	var name string
+	name, option = ParseFormat(formatStr)
+	t, found := transcoders[name]
+	if !found {
+		return nil, "", fmt.Errorf("Unknown data format requested: %s", name)
+	}
+	return t, option, nil
+}
+
+// TranscoderForContentType returns the transcoder for a MIME type or nil if there is none.
+func TranscoderForContentType(contentType string) *Transcoder {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if contentType == "" {
+		return nil
+	}
+	for _, t := range transcoders {
+		if t.ContentType == contentType {
+			return t
+		}
+	}
+	return nil
+}
+
+// TranscoderNames returns the sorted names of registered transcoders.
+func TranscoderNames() []string {
+	names := make([]string, 0, len(transcoders))
+	for name := range transcoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EncodeArray writes an array using a format string, e.g., "raw", "npy", or "nrrd:gzip".
+// 2d arrays can also be written by transcoders that only encode images.
+func EncodeArray(w io.Writer, a *Array, formatStr string) (*Transcoder, error) {
+	t, option, err := GetTranscoder(formatStr)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.EncodeArray != nil:
+		err = t.EncodeArray(w, a, option)
+	case t.EncodeImage != nil && a.Size.NumDims() == 2:
+		var images []image.Image
+		if images, err = a.Images(); err == nil {
+			err = t.EncodeImage(w, images[0], option)
+		}
+	default:
+		err = fmt.Errorf("Format '%s' can't hold %d-d data", t.Name, a.Size.NumDims())
+	}
+	return t, err
+}
+
+// WriteArrayHttp writes an array to a HTTP response writer using a format string.
+// Data is encoded before writing so errors can still be returned as a bad request.
+func WriteArrayHttp(w http.ResponseWriter, a *Array, formatStr string) error {
+	// Raw arrays can't fail to encode, so write them straight from the array data
+	// rather than copying large volumes into a buffer first.
+	if t, _, err := GetTranscoder(formatStr); err == nil && t.Name == "raw" {
+		w.Header().Set("Content-type", t.ContentType)
+		_, err = w.Write(a.Data)
+		return err
+	}
+	buf := GetBytesBuffer()
+	defer PutBytesBuffer(buf)
+	t, err := EncodeArray(buf, a, formatStr)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-type", t.ContentType)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ReadArrayHttp reads an array from a POST request using a format string or, if it is
+// empty, the Content-Type of the request.  Raw data is assumed if neither is given.
+func ReadArrayHttp(r *http.Request, a *Array, formatStr string) error {
+	var t *Transcoder
+	var option string
+	if formatStr != "" {
+		var err error
+		if t, option, err = GetTranscoder(formatStr); err != nil {
+			return err
+		}
+	} else if t = TranscoderForContentType(r.Header.Get("Content-Type")); t == nil || t.DecodeArray == nil {
+		t = transcoders["raw"]
+	}
+	if t.DecodeArray == nil {
+		return fmt.Errorf("Format '%s' can't be decoded into arrays", t.Name)
+	}
+	return t.DecodeArray(r.Body, a, option)
+}
+
+// Images returns the array as one 2d image per XY plane.  Arrays with a single uint8 or
+// uint16 value or 4 uint8 or uint16 values (RGBA) per voxel are supported.
+func (a *Array) Images() ([]image.Image, error) {
+	numDims := a.Size.NumDims()
+	if numDims != 2 && numDims != 3 {
+		return nil, fmt.Errorf("Can only make images from 2d or 3d arrays, not %d-d", numDims)
+	}
+	nx, ny := int(a.Size.Value(0)), int(a.Size.Value(1))
+	nz := 1
+	if numDims == 3 {
+		nz = int(a.Size.Value(2))
+	}
+	bytesPerVoxel := int(a.Values.BytesPerElement())
+	planeBytes := nx * ny * bytesPerVoxel
+	if len(a.Data) != planeBytes*nz {
+		return nil, fmt.Errorf("Array of size %s should have %d bytes, not %d", a.Size, planeBytes*nz, len(a.Data))
+	}
+	valueType, err := a.Values.ValueDataType()
+	if err != nil {
+		return nil, err
+	}
+	byteOrder := a.ByteOrder
+	if byteOrder == nil {
+		byteOrder = binary.LittleEndian
+	}
+	rect := image.Rect(0, 0, nx, ny)
+	images := make([]image.Image, nz)
+	for z := 0; z < nz; z++ {
+		plane := a.Data[z*planeBytes : (z+1)*planeBytes]
+		switch {
+		case len(a.Values) == 1 && valueType == T_uint8:
+			images[z] = &image.Gray{Pix: plane, Stride: nx, Rect: rect}
+		case len(a.Values) == 4 && valueType == T_uint8:
+			images[z] = &image.NRGBA{Pix: plane, Stride: nx * 4, Rect: rect}
+		case (len(a.Values) == 1 || len(a.Values) == 4) && valueType == T_uint16:
+			// Go 16-bit images are big endian.
+			pix := plane
+			if byteOrder != binary.BigEndian {
+				pix = swapBytes(plane, 2)
+			}
+			if len(a.Values) == 1 {
+				images[z] = &image.Gray16{Pix: pix, Stride: nx * 2, Rect: rect}
+			} else {
+				images[z] = &image.NRGBA64{Pix: pix, Stride: nx * 8, Rect: rect}
+			}
+		default:
+			return nil, fmt.Errorf("Can't make images from voxels with values %v", a.Values)
+		}
+	}
+	return images, nil
+}
+
+// SetDecoded checks decoded little endian data against the expected size and values of
+// the array and stores it in the array's byte order.  Trailing singleton dimensions are
+// ignored so a 2d slice can be given as a 3d array with one plane.
+func (a *Array) SetDecoded(size []int32, channels int32, t DataType, data []byte) error {
+	if int(channels) != len(a.Values) {
+		return fmt.Errorf("Data has %d values/voxel, expected %d", channels, len(a.Values))
+	}
+	for _, value := range a.Values {
+		if value.T != t {
+			return fmt.Errorf("Data type %v differs from expected %v", t, a.Values)
+		}
+	}
+	numDims := int(a.Size.NumDims())
+	for len(size) > numDims && size[len(size)-1] == 1 {
+		size = size[:len(size)-1]
+	}
+	if len(size) != numDims {
+		return fmt.Errorf("Data has %d dimensions, expected %d", len(size), numDims)
+	}
+	for dim := 0; dim < numDims; dim++ {
+		if size[dim] != a.Size.Value(uint8(dim)) {
+			return fmt.Errorf("Data size %v doesn't match expected %s", size, a.Size)
+		}
+	}
+	bytesPerValue := int(DataTypeBytes(t))
+	if a.ByteOrder == binary.BigEndian && bytesPerValue > 1 {
+		data = swapBytes(data, bytesPerValue)
+	}
+	a.Data = data
+	return nil
+}
+
+// spatialSize returns the first n dimensions of the array size, padding with 1.
+func (a *Array) spatialSize(n int) []int32 {
+	size := make([]int32, n)
+	for dim := 0; dim < n; dim++ {
+		size[dim] = 1
+		if dim < int(a.Size.NumDims()) {
+			size[dim] = a.Size.Value(uint8(dim))
+		}
+	}
+	return size
+}
+
+func decodeStdImage(r io.Reader, option string) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+func encodePNG(w io.Writer, img image.Image, option string) error {
+	return png.Encode(w, img)
+}
+
+func encodeJPEG(w io.Writer, img image.Image, option string) error {
+	quality, err := ParseImageQuality(option, DefaultJPEGQuality)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+func encodeBMP(w io.Writer, img image.Image, option string) error {
+	return bmp.Encode(w, img)
+}
+
+func encodeTIFFImage(w io.Writer, img image.Image, option string) error {
+	compression, err := StringToTIFFCompression(option)
+	if err != nil {
+		return err
+	}
+	return EncodeTIFF(w, []image.Image{img}, compression)
+}
+
+// encodeTIFFArray writes a multi-page TIFF with one page per XY plane.
+func encodeTIFFArray(w io.Writer, a *Array, option string) error {
+	compression, err := StringToTIFFCompression(option)
+	if err != nil {
+		return err
+	}
+	pages, err := a.Images()
+	if err != nil {
+		return err
+	}
+	return EncodeTIFF(w, pages, compression)
+}
+
+func encodeRaw(w io.Writer, a *Array, option string) error {
+	_, err := w.Write(a.Data)
+	return err
+}
+
+func decodeRaw(r io.Reader, a *Array, option string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	expected := a.Size.Prod() * int64(a.Values.BytesPerElement())
+	if int64(len(data)) != expected {
+		return fmt.Errorf("Raw data was %d bytes, expected %d bytes for size %s", len(data), expected, a.Size)
+	}
+	a.Data = data
+	return nil
+}
+
+// encodeNpyArray writes a .npy array with shape in C order, e.g., (Z, Y, X).
+func encodeNpyArray(w io.Writer, a *Array, option string) error {
+	numDims := int(a.Size.NumDims())
+	shape := make([]int32, numDims)
+	for dim := 0; dim < numDims; dim++ {
+		shape[numDims-1-dim] = a.Size.Value(uint8(dim))
+	}
+	return WriteNpy(w, a.Values, a.ByteOrder, shape, a.Data)
+}
+
+// encodeNrrdArray writes NRRD with spacings from the voxel size.  The "gzip" option
+// compresses the data.
+func encodeNrrdArray(w io.Writer, a *Array, option string) error {
+	var compress bool
+	switch option {
+	case "", "raw":
+	case "gzip", "gz":
+		compress = true
+	default:
+		return fmt.Errorf("Unknown NRRD encoding '%s'", option)
+	}
+	var spacings []float32
+	if int(a.Size.NumDims()) <= len(a.VoxelSize) {
+		spacings = a.VoxelSize[:a.Size.NumDims()]
+	}
+	return WriteNrrd(w, a.Values, a.ByteOrder, a.Size, spacings, compress, a.Data)
+}
+
+func decodeNrrdArray(r io.Reader, a *Array, option string) error {
+	vol, err := ReadNrrd(r)
+	if err != nil {
+		return err
+	}
+	if err := a.SetDecoded(vol.Size, vol.Channels, vol.DataType, vol.Data); err != nil {
+		return fmt.Errorf("Bad NRRD data: %s", err.Error())
+	}
+	if vol.Spacings != nil {
+		a.VoxelSize = vol.Spacings
+	}
+	return nil
+}
+
+// encodeNiftiArray writes a NIfTI-1 volume carrying the voxel size and offset.
+func encodeNiftiArray(w io.Writer, a *Array, option string) error {
+	if a.Size.NumDims() > 3 {
+		return fmt.Errorf("NIfTI output requires at most 3d data, not %d-d", a.Size.NumDims())
+	}
+	var size, offset Point3d
+	voxelSize := [3]float32{1, 1, 1}
+	copy(size[:], a.spatialSize(3))
+	for dim := 0; dim < 3; dim++ {
+		if a.Offset != nil && dim < int(a.Offset.NumDims()) {
+			offset[dim] = a.Offset.Value(uint8(dim))
+		}
+		if dim < len(a.VoxelSize) && a.VoxelSize[dim] > 0 {
+			voxelSize[dim] = a.VoxelSize[dim]
+		}
+	}
+	var units string
+	if len(a.VoxelUnits) > 0 {
+		units = a.VoxelUnits[0]
+	}
+	return WriteNifti(w, a.Values, a.ByteOrder, size, voxelSize, units, offset, a.Data)
+}
+
+func decodeNiftiArray(r io.Reader, a *Array, option string) error {
+	vol, err := ReadNifti(r)
+	if err != nil {
+		return err
+	}
+	if err := a.SetDecoded(vol.Size[:], 1, vol.DataType, vol.Data); err != nil {
+		return fmt.Errorf("Bad NIfTI data: %s", err.Error())
+	}
+	a.VoxelSize = NdFloat32(vol.VoxelSize[:])
+	return nil
+}
+
+func init() {
+	RegisterTranscoder(&Transcoder{
+		Name:        "png",
+		ContentType: "image/png",
+		EncodeImage: encodePNG,
+		DecodeImage: decodeStdImage,
+	})
+	RegisterTranscoder(&Transcoder{
+		Name:        "jpg",
+		ContentType: "image/jpeg",
+		EncodeImage: encodeJPEG,
+		DecodeImage: decodeStdImage,
+	}, "jpeg")
+	RegisterTranscoder(&Transcoder{
+		Name:        "bmp",
+		ContentType: "image/bmp",
+		EncodeImage: encodeBMP,
+		DecodeImage: decodeStdImage,
+	})
+	RegisterTranscoder(&Transcoder{
+		Name:        "tiff",
+		ContentType: "image/tiff",
+		EncodeImage: encodeTIFFImage,
+		DecodeImage: decodeStdImage,
+		EncodeArray: encodeTIFFArray,
+	}, "tif")
+	RegisterTranscoder(&Transcoder{
+		Name:        "raw",
+		ContentType: "application/octet-stream",
+		EncodeArray: encodeRaw,
+		DecodeArray: decodeRaw,
+	}, "octet-stream")
+	RegisterTranscoder(&Transcoder{
+		Name:        "npy",
+		ContentType: NpyContentType,
+		EncodeArray: encodeNpyArray,
+	})
+	RegisterTranscoder(&Transcoder{
+		Name:        "nrrd",
+		ContentType: NrrdContentType,
+		EncodeArray: encodeNrrdArray,
+		DecodeArray: decodeNrrdArray,
+	})
+	RegisterTranscoder(&Transcoder{
+		Name:        "nii",
+		ContentType: NiftiContentType,
+		EncodeArray: encodeNiftiArray,
+		DecodeArray: decodeNiftiArray,
+	}, "nifti")
+}
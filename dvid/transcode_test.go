@@ -0,0 +1,86 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestTranscoderRegistry(c *C) {
+	t, option, err := GetTranscoder("JPEG:75")
+	c.Assert(err, IsNil)
+	c.Assert(t.Name, Equals, "jpg")
+	c.Assert(option, Equals, "75")
+
+	t, option, err = GetTranscoder("nrrd:gzip")
+	c.Assert(err, IsNil)
+	c.Assert(t.ContentType, Equals, NrrdContentType)
+	c.Assert(option, Equals, "gzip")
+
+	_, _, err = GetTranscoder("foo")
+	c.Assert(err, NotNil)
+
+	c.Assert(TranscoderForContentType("application/x-nrrd; charset=binary").Name, Equals, "nrrd")
+	c.Assert(TranscoderForContentType("text/plain"), IsNil)
+
+	// Image-only formats can't hold 3d arrays.
+	a := &Array{Values: DataValues{{T_uint8, "gray"}}, Size: Point3d{2, 2, 2}, Data: make([]byte, 8)}
+	w := httptest.NewRecorder()
+	c.Assert(WriteArrayHttp(w, a, "png"), NotNil)
+	c.Assert(WriteImageHttp(w, image.NewGray(image.Rect(0, 0, 2, 2)), "npy"), NotNil)
+}
+
+func (suite *DataSuite) TestTranscodeArrays(c *C) {
+	values := DataValues{{T: T_uint16, Label: "intensity"}}
+	size := Point3d{4, 3, 2}
+	data := make([]byte, size.Prod()*2)
+	for i := 0; i < int(size.Prod()); i++ {
+		binary.BigEndian.PutUint16(data[i*2:], uint16(i*100))
+	}
+	a := &Array{
+		Values:     values,
+		ByteOrder:  binary.BigEndian,
+		Size:       size,
+		Offset:     Point3d{10, 20, 30},
+		VoxelSize:  NdFloat32{8, 8, 40},
+		VoxelUnits: NdString{"nanometers", "nanometers", "nanometers"},
+		Data:       data,
+	}
+	for _, format := range []string{"raw", "nrrd", "nrrd:gzip", "nii"} {
+		w := httptest.NewRecorder()
+		c.Assert(WriteArrayHttp(w, a, format), IsNil)
+		t, _, _ := GetTranscoder(format)
+		c.Assert(w.Header().Get("Content-type"), Equals, t.ContentType)
+
+		r, err := http.NewRequest("POST", "/", bytes.NewReader(w.Body.Bytes()))
+		c.Assert(err, IsNil)
+		r.Header.Set("Content-Type", t.ContentType)
+		decoded := &Array{Values: values, ByteOrder: binary.BigEndian, Size: size}
+		c.Assert(ReadArrayHttp(r, decoded, ""), IsNil)
+		c.Assert(decoded.Data, DeepEquals, data)
+	}
+
+	// Mismatched sizes are rejected.
+	var buf bytes.Buffer
+	c.Assert(encodeNrrdArray(&buf, a, ""), IsNil)
+	wrong := &Array{Values: values, ByteOrder: binary.BigEndian, Size: Point3d{4, 3, 3}}
+	c.Assert(decodeNrrdArray(&buf, wrong, ""), NotNil)
+
+	// Multi-page TIFF has one page per plane.
+	pages, err := a.Images()
+	c.Assert(err, IsNil)
+	c.Assert(pages, HasLen, 2)
+	c.Assert(pages[1].(*image.Gray16).Gray16At(1, 0).Y, Equals, uint16(1300))
+	w := httptest.NewRecorder()
+	c.Assert(WriteArrayHttp(w, a, "tiff"), IsNil)
+	c.Assert(w.Header().Get("Content-type"), Equals, "image/tiff")
+
+	// npy shape is in C order.
+	w = httptest.NewRecorder()
+	c.Assert(WriteArrayHttp(w, a, "npy"), IsNil)
+	c.Assert(w.Body.String(), Matches, `(?s).*'shape': \(2, 3, 4\).*`)
+}
@@ -112,9 +112,16 @@ func DataFromPost(r *http.Request, key string) ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
-// Log prints a message via log.Print() depending on the Mode of DVID.
+// Log prints a message via log.Print() depending on the Mode of DVID or, if set, the
+// mode of the calling module.
 func Log(mode ModeFlag, p ...interface{}) {
-	if mode == Normal || mode == Mode {
+	logMode(1, mode, p...)
+}
+
+// logMode prints a message via log.Print() if the mode is on for the function skip
+// frames above the caller of logMode.
+func logMode(skip int, mode ModeFlag, p ...interface{}) {
+	if modeOn(mode, skip+1) {
 		if len(p) == 0 {
 			log.Println("No message")
 		} else {
@@ -123,9 +130,10 @@ func Log(mode ModeFlag, p ...interface{}) {
 	}
 }
 
-// Fmt prints a message via fmt.Print() depending on the Mode of DVID.
+// Fmt prints a message via fmt.Print() depending on the Mode of DVID or, if set, the
+// mode of the calling module.
 func Fmt(mode ModeFlag, p ...interface{}) {
-	if mode == Normal || mode == Mode {
+	if modeOn(mode, 1) {
 		if len(p) == 0 {
 			fmt.Println("No message")
 		} else {
@@ -164,12 +172,18 @@ func SetErrorLoggingFile(out io.Writer) {
 // newline since one is added in this function.
 func WaitToComplete(wg *sync.WaitGroup, mode ModeFlag, startTime time.Time, p ...interface{}) {
 	wg.Wait()
-	ElapsedTime(mode, startTime, p...)
+	elapsedTime(1, mode, startTime, p...)
 }
 
 // ElapsedTime prints the time elapsed from the start time with Printf arguments afterwards.
 // Example:  ElapsedTime(dvid.Debug, startTime, "Time since launch of %s", funcName)
 func ElapsedTime(mode ModeFlag, startTime time.Time, p ...interface{}) {
+	elapsedTime(1, mode, startTime, p...)
+}
+
+// elapsedTime logs the time elapsed like ElapsedTime, using the mode of the function
+// skip frames above the caller of elapsedTime.
+func elapsedTime(skip int, mode ModeFlag, startTime time.Time, p ...interface{}) {
 	var args []interface{}
 	if len(p) == 0 {
 		args = append(args, "%s\n")
@@ -179,7 +193,7 @@ func ElapsedTime(mode ModeFlag, startTime time.Time, p ...interface{}) {
 		args = append(args, p[1:]...)
 	}
 	args = append(args, time.Since(startTime))
-	Log(mode, args...)
+	logMode(skip+1, mode, args...)
 }
 
 // WriteJSONFile writes an arbitrary but exportable Go object to a JSON file.
@@ -0,0 +1,217 @@
+/*
+	This file implements network access rules, which allow or deny clients by IP address
+	for the HTTP API and RPC ports.  They are a minimal protection layer for servers that
+	can't yet deploy authentication, not a replacement for it.  Each rule applies to
+	requests whose URL paths start with the rule's path, "rpc" for the client RPC port, or
+	"adminrpc" for the admin RPC port, and the rule with the longest matching path
+	decides.  A client is refused if its address is in one of the rule's Deny CIDRs or if
+	the rule has Allow CIDRs and its address is in none of them, e.g.:
+
+		[{"Path": "", "Deny": ["192.0.2.0/24"]},
+		 {"Path": "/api/server", "Allow": ["127.0.0.1/32", "10.1.0.0/16"]},
+		 {"Path": "rpc", "Allow": ["10.0.0.0/8"]}]
+
+	Addresses are those of the connecting peers, so behind a proxy rules see the proxy.
+
+	GET /api/server/access     Returns the access rules.
+	POST /api/server/access    Replaces the access rules with a JSON list like the above.
+
+	If authentication is configured, only members of the OIDC AdminGroups may use these
+	endpoints.  The "reload" admin command rereads the rules from AccessRulesFile.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// AccessRulesFile is the JSON file of access rules reread by the "reload" command.
+var AccessRulesFile string
+
+// AccessRule allows or denies clients by IP address for requests with a path prefix.
+type AccessRule struct {
+	// Path is the URL path prefix of requests, e.g., "/api/node", or "rpc" or "adminrpc"
+	// for the RPC ports.  An empty path applies to all requests.
+	Path string
+
+	// Allow lists the CIDRs, e.g., "10.0.0.0/8", of the only clients allowed, if any.
+	Allow []string `json:",omitempty"`
+
+	// Deny lists the CIDRs of clients that are refused.
+	Deny []string `json:",omitempty"`
+}
+
+type accessRule struct {
+	AccessRule
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+var accessRules struct {
+	sync.RWMutex
+	rules []accessRule
+}
+
+// parseCIDRs parses CIDRs, where a bare IP address is a network with only that address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Bad IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad CIDR %q", cidr)
+		}
+		nets[i] = ipnet
+	}
+	return nets, nil
+}
+
+// SetAccessRules replaces the access rules.
+func SetAccessRules(rules []AccessRule) error {
+	compiled := make([]accessRule, len(rules))
+	for i, rule := range rules {
+		allow, err := parseCIDRs(rule.Allow)
+		if err != nil {
+			return fmt.Errorf("Access rule for path %q: %s", rule.Path, err.Error())
+		}
+		deny, err := parseCIDRs(rule.Deny)
+		if err != nil {
+			return fmt.Errorf("Access rule for path %q: %s", rule.Path, err.Error())
+		}
+		compiled[i] = accessRule{rule, allow, deny}
+	}
+	accessRules.Lock()
+	accessRules.rules = compiled
+	accessRules.Unlock()
+	return nil
+}
+
+// AccessRules returns the access rules.
+func AccessRules() []AccessRule {
+	accessRules.RLock()
+	defer accessRules.RUnlock()
+	rules := make([]AccessRule, len(accessRules.rules))
+	for i, rule := range accessRules.rules {
+		rules[i] = rule.AccessRule
+	}
+	return rules
+}
+
+// LoadAccessRules sets the access rules from a JSON file holding a list of rules.
+func LoadAccessRules(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var rules []AccessRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("Bad access rules in %s: %s", filename, err.Error())
+	}
+	return SetAccessRules(rules)
+}
+
+// containsIP returns true if any of the networks contains the IP.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessAllowed returns true if the client at a remote address, given as "host:port",
+// may make a request with the path.
+func accessAllowed(path, remoteAddr string) bool {
+	accessRules.RLock()
+	defer accessRules.RUnlock()
+	var rule *accessRule
+	for i, r := range accessRules.rules {
+		if strings.HasPrefix(path, r.Path) && (rule == nil || len(r.Path) > len(rule.Path)) {
+			rule = &accessRules.rules[i]
+		}
+	}
+	if rule == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if containsIP(rule.deny, ip) {
+		return false
+	}
+	return len(rule.allow) == 0 || containsIP(rule.allow, ip)
+}
+
+// filterAccess refuses requests from clients the access rules don't allow.  The rules
+// are matched against the path if given, else the URL path of each request.
+func filterAccess(next http.Handler, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath := path
+		if requestPath == "" {
+			requestPath = r.URL.Path
+		}
+		if !accessAllowed(requestPath, r.RemoteAddr) {
+			dvid.Log(dvid.Debug, "Refused %s %s from %s by access rules\n", r.Method, requestPath, r.RemoteAddr)
+			http.Error(w, "Access from your address is not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessRequest handles the /api/server/access endpoint.
+func accessRequest(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r) {
+		return
+	}
+	switch strings.ToLower(r.Method) {
+	case "get":
+	case "post":
+		var rules []AccessRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+			return
+		}
+		if err := SetAccessRules(rules); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		dvid.Log(dvid.Normal, "Set %d access rules\n", len(rules))
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET or POST /api/server/access")
+		return
+	}
+	m, err := json.Marshal(AccessRules())
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
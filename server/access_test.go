@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestAccessRules(c *C) {
+	defer SetAccessRules(nil)
+	c.Assert(SetAccessRules([]AccessRule{{Path: "", Deny: []string{"bad"}}}), NotNil)
+	c.Assert(SetAccessRules([]AccessRule{{Path: "", Allow: []string{"10.0.0.0/33"}}}), NotNil)
+
+	rules := []AccessRule{
+		{Path: "", Deny: []string{"192.0.2.0/24"}},
+		{Path: "/api/server", Allow: []string{"127.0.0.1", "10.1.0.0/16", "2001:db8::/32"}},
+		{Path: "/api/server/info", Allow: []string{"192.0.2.9"}},
+		{Path: "rpc", Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.9.0.0/16"}},
+		{Path: "adminrpc", Allow: []string{"::1"}},
+	}
+	c.Assert(SetAccessRules(rules), IsNil)
+	c.Assert(AccessRules(), DeepEquals, rules)
+
+	tests := []struct {
+		path    string
+		remote  string
+		allowed bool
+	}{
+		// The rule with the longest matching path decides.
+		{"/api/node/abc/grayscale/info", "203.0.113.1:80", true},
+		{"/api/node/abc/grayscale/info", "192.0.2.9:80", false},
+		{"/api/server/types", "10.1.2.3:80", true},
+		{"/api/server/types", "10.2.2.3:80", false},
+		{"/api/server/types", "192.0.2.9:80", false},
+		{"/api/server/info", "192.0.2.9:80", true},
+		{"/api/server/info", "127.0.0.1:80", false},
+
+		// IPv6 addresses and networks.
+		{"/api/server/types", "[2001:db8::1]:80", true},
+		{"/api/server/types", "[2001:db9::1]:80", false},
+		{"/api/node/abc/grayscale/info", "[2001:db9::1]:80", true},
+
+		// Deny wins over allow within a rule.
+		{"rpc", "10.1.2.3:80", true},
+		{"rpc", "10.9.2.3:80", false},
+		{"rpc", "192.168.1.1:80", false},
+		{"adminrpc", "[::1]:80", true},
+		{"adminrpc", "127.0.0.1:80", false},
+
+		// Unparseable addresses are refused when a rule applies.
+		{"rpc", "somewhere", false},
+	}
+	for _, test := range tests {
+		if accessAllowed(test.path, test.remote) != test.allowed {
+			c.Errorf("Access to %q from %s: expected allowed %t", test.path, test.remote, test.allowed)
+		}
+	}
+
+	// Forwarded addresses are ignored, so clients can't claim an allowed address.
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest("GET", "/api/server/types", nil)
+	r.RemoteAddr = "192.0.2.1:5000"
+	r.Header.Set("X-Forwarded-For", "127.0.0.1")
+	w := httptest.NewRecorder()
+	filterAccess(ok, "").ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// The RPC ports are checked against their own rules, not request paths.
+	r = httptest.NewRequest("CONNECT", "/_goRPC_", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	w = httptest.NewRecorder()
+	filterAccess(ok, "rpc").ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = httptest.NewRecorder()
+	filterAccess(ok, "adminrpc").ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+}
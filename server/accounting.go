@@ -0,0 +1,55 @@
+/*
+	This file handles storage accounting of the version DAG, which reports for each node
+	how many blocks it wrote versus inherited from ancestors and its marginal storage cost,
+	e.g., to decide which branches to prune.  The accounting of each node is also part of
+	the node's description in /api/dataset/<UUID>/info.
+
+	GET  /api/dataset/<UUID>/accounting   Returns the last accounting of each node as JSON.
+	POST /api/dataset/<UUID>/accounting   Starts a job computing the dataset's accounting.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// StartAccountingJob starts a job computing the storage accounting of the dataset
+// holding the given UUID.
+func StartAccountingJob(uuid dvid.UUID) *Job {
+	description := fmt.Sprintf("Storage accounting of dataset with node %s", uuid)
+	job := NewJob(description)
+	go func() {
+		_, err := runningService.AccountStorage(serverCtx, uuid, job.SetProgress)
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		}
+		job.Finish(err)
+	}()
+	return job
+}
+
+// accountingRequest handles the /api/dataset/<UUID>/accounting endpoints.
+func accountingRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		accounting, err := runningService.StorageAccounting(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(accounting)
+	case "post":
+		job := StartAccountingJob(uuid)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	default:
+		BadRequest(w, r, "Accounting requests must be GET or POST")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+	This file handles the admin RPC port, a listener separate from the client RPC port for
+	commands that administer the server as a whole:
+
+		shutdown    Halts the server.
+		backup      Commits any changed dataset metadata to the -metabackup store now.
+		gc          Runs a garbage collection and returns freed memory to the OS.
+		reload      Rereads the OIDC, federation, and access rule configuration files.
+		keys        Lists, issues, limits, and revokes API keys.
+		logging     Lists and sets the run modes of logged messages.
+		handlers    Lists and resizes the chunk handler pools of datatypes.
+
+	If AdminRPCAddress is set, these commands are refused on the client RPC port, so the
+	client port can be exposed to users without exposing the server's administration.  The
+	admin port usually binds a local address, e.g., "localhost:8002", and requests to it
+	must carry AdminRPCToken if one is set.  A token is required if the admin port binds
+	an address reachable from other hosts.  The admin port also accepts all client
+	commands.  Without AdminRPCAddress, admin commands are accepted on the client port.
+*/
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// AdminRPCAddress is the address of the admin RPC port.  If empty, admin commands
+	// are accepted on the client RPC port.
+	AdminRPCAddress string
+
+	// AdminRPCToken is a shared secret that requests to the admin RPC port must carry.
+	AdminRPCToken string
+
+	// OIDCConfigFile and FederationFile are configuration files reread by the "reload"
+	// command.
+	OIDCConfigFile string
+	FederationFile string
+)
+
+// adminCommands are the commands served by the admin RPC port.
+var adminCommands = []string{"backup", "gc", "handlers", "keys", "logging", "reload", "shutdown"}
+
+// IsAdminCommand returns true if the named command administers the server as a whole.
+func IsAdminCommand(name string) bool {
+	for _, command := range adminCommands {
+		if name == command {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminRPCConnection serves the admin RPC port.  It's registered under the name
+// "RPCConnection" so clients call the admin port like the client port.
+type AdminRPCConnection struct{}
+
+// Do checks the admin token of a request and executes it.
+func (c *AdminRPCConnection) Do(cmd datastore.Request, reply *datastore.Response) error {
+	if reply == nil {
+		return nil
+	}
+	if AdminRPCToken != "" && subtle.ConstantTimeCompare([]byte(cmd.AdminToken), []byte(AdminRPCToken)) != 1 {
+		dvid.Error("Refused admin command %q with a bad admin token\n", cmd.Name())
+		return fmt.Errorf("Bad admin token.  Use -admintoken to give the server's token.")
+	}
+	if IsAdminCommand(cmd.Name()) {
+		return adminCommand(cmd, reply)
+	}
+	return new(RPCConnection).Do(cmd, reply)
+}
+
+// adminCommand executes an admin command.
+func adminCommand(cmd datastore.Request, reply *datastore.Response) error {
+	switch cmd.Name() {
+	case "shutdown":
+		Shutdown()
+		// Make this process shutdown in a second to allow time for RPC to finish.
+		// TODO -- Better way to do this?
+		log.Printf("DVID server halted due to 'shutdown' command.")
+		reply.Text = fmt.Sprintf("DVID server at %s has been halted.\n",
+			runningService.RPCAddress)
+		go func() {
+			time.Sleep(1 * time.Second)
+			os.Exit(0)
+		}()
+
+	case "backup":
+		if MetadataBackupTarget == "" {
+			return fmt.Errorf("Metadata backups are off.  Start the server with -metabackup to turn them on.")
+		}
+		backupMetadata()
+		metadataBackup.Lock()
+		status := metadataBackup.status
+		metadataBackup.Unlock()
+		if status.LastError != "" {
+			return fmt.Errorf("Unable to back up metadata: %s", status.LastError)
+		}
+		reply.Text = fmt.Sprintf("Metadata backed up to %s at commit %s\n", MetadataBackupTarget, status.Head)
+
+	case "gc":
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&after)
+		reply.Text = fmt.Sprintf("Heap in use went from %d to %d bytes; %d bytes returned to the OS\n",
+			before.HeapInuse, after.HeapInuse, int64(after.HeapReleased)-int64(before.HeapReleased))
+
+	case "reload":
+		var reloaded []string
+		if OIDCConfigFile != "" {
+			if err := LoadOIDC(OIDCConfigFile); err != nil {
+				return err
+			}
+			reloaded = append(reloaded, OIDCConfigFile)
+		}
+		if FederationFile != "" {
+			if err := LoadFederation(FederationFile); err != nil {
+				return err
+			}
+			reloaded = append(reloaded, FederationFile)
+		}
+		if AccessRulesFile != "" {
+			if err := LoadAccessRules(AccessRulesFile); err != nil {
+				return err
+			}
+			reloaded = append(reloaded, AccessRulesFile)
+		}
+		if len(reloaded) == 0 {
+			reply.Text = "No configuration files to reload\n"
+			return nil
+		}
+		dvid.Log(dvid.Normal, "Reloaded configuration from %s\n", strings.Join(reloaded, ", "))
+		reply.Text = fmt.Sprintf("Reloaded %s\n", strings.Join(reloaded, ", "))
+
+	case "handlers":
+		var typename, sizeStr string
+		cmd.CommandArgs(1, &typename, &sizeStr)
+		if typename != "" {
+			size, err := strconv.Atoi(sizeStr)
+			if err != nil {
+				return fmt.Errorf("Bad handler pool size %q for datatype %q", sizeStr, typename)
+			}
+			if err = SetHandlerPoolSize(dvid.TypeString(typename), size); err != nil {
+				return err
+			}
+		}
+		reply.Text = handlerPoolsText()
+
+	case "logging":
+		var module, modeName, durationStr string
+		cmd.CommandArgs(1, &module, &modeName, &durationStr)
+		switch {
+		case module == "":
+		case modeName == "reset":
+			dvid.ResetModuleMode(module)
+		default:
+			if err := setModuleMode(module, modeName, durationStr); err != nil {
+				return err
+			}
+		}
+		reply.Text = loggingText()
+
+	case "keys":
+		var subcommand, arg string
+		cmd.CommandArgs(1, &subcommand, &arg)
+		switch subcommand {
+		case "new":
+			settings := cmd.Settings()
+			datasets, _, err := settings.GetString("datasets")
+			if err != nil {
+				return err
+			}
+			var uuidStrs []string
+			if datasets != "" {
+				uuidStrs = strings.Split(datasets, ",")
+			}
+			writeStr, _, err := settings.GetString("write")
+			if err != nil {
+				return err
+			}
+			bandwidth, _, err := settings.GetInt("bandwidth")
+			if err != nil {
+				return err
+			}
+			key, apiKey, err := newAPIKey(arg, uuidStrs, writeStr == "true", int64(bandwidth))
+			if err != nil {
+				return err
+			}
+			access := "read-only"
+			if key.Write {
+				access = "read-write"
+			}
+			reply.Text = fmt.Sprintf("Issued %s API key %s to user %q:\n%s\n", access, key.ID, key.User, apiKey)
+		case "bandwidth":
+			var bandwidthStr string
+			cmd.CommandArgs(3, &bandwidthStr)
+			bandwidth, err := strconv.ParseInt(bandwidthStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Bad bandwidth %q: expected bytes/sec", bandwidthStr)
+			}
+			key, err := setAPIKeyBandwidth(arg, bandwidth)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Set bandwidth of API key %s of user %q to %d bytes/sec\n",
+				key.ID, key.User, key.Bandwidth)
+		case "revoke":
+			key, err := revokeAPIKey(arg)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Revoked API key %s of user %q\n", key.ID, key.User)
+		default:
+			// Without a subcommand, list the keys of a user or all users.
+			m, err := apiKeysJSON(subcommand)
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m)
+		}
+
+	default:
+		return fmt.Errorf("Unknown admin command: '%s'", cmd)
+	}
+	return nil
+}
+
+// isLoopback returns true if an address only accepts connections from this host.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServeAdminRpc listens and serves admin RPC requests at AdminRPCAddress.
+func (service *Service) ServeAdminRpc() error {
+	if AdminRPCAddress == "" {
+		return nil
+	}
+	if AdminRPCToken == "" && !isLoopback(AdminRPCAddress) {
+		return fmt.Errorf("Admin RPC address %s is reachable from other hosts and requires -admintoken",
+			AdminRPCAddress)
+	}
+	admin := rpc.NewServer()
+	if err := admin.RegisterName("RPCConnection", new(AdminRPCConnection)); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", AdminRPCAddress)
+	if err != nil {
+		return err
+	}
+	dvid.Log(dvid.Normal, "Admin rpc server listening at %s ...\n", AdminRPCAddress)
+	go http.Serve(listener, filterAccess(newRPCMux(admin), "adminrpc"))
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+	This file handles aliases of data instances, which let clients refer to data by a
+	stable name, e.g., "segmentation", while the data it refers to is replaced.  Aliases
+	are resolved in all HTTP and RPC requests for data, and every reassignment is
+	recorded in the audit log when AuditLog is set.
+
+	GET    /api/dataset/<UUID>/aliases                        Lists aliases as JSON.
+	POST   /api/dataset/<UUID>/alias/<alias>/<data name>      Makes the alias refer to the data.
+	DELETE /api/dataset/<UUID>/alias/<alias>                  Removes the alias.
+
+	Data named "alias" or "aliases" that predates these endpoints takes precedence over
+	them, as data names do over aliases.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// setAlias makes an alias refer to data, recording any reassignment in the audit log.
+func setAlias(r *http.Request, uuid dvid.UUID, alias, name dvid.DataString) (string, error) {
+	previous, err := runningService.SetAlias(uuid, alias, name)
+	if err != nil {
+		return "", err
+	}
+	auditAlias(r, uuid, alias, previous, name)
+	if previous == "" {
+		return fmt.Sprintf("Alias %q now refers to data %q", alias, name), nil
+	}
+	return fmt.Sprintf("Alias %q reassigned from data %q to %q", alias, previous, name), nil
+}
+
+// deleteAlias removes an alias, recording it in the audit log.
+func deleteAlias(r *http.Request, uuid dvid.UUID, alias dvid.DataString) (string, error) {
+	previous, err := runningService.DeleteAlias(uuid, alias)
+	if err != nil {
+		return "", err
+	}
+	auditAlias(r, uuid, alias, previous, "")
+	return fmt.Sprintf("Alias %q of data %q deleted", alias, previous), nil
+}
+
+// auditAlias records a change of the data an alias refers to.  The request is nil for
+// RPC commands.
+func auditAlias(r *http.Request, uuid dvid.UUID, alias, previous, name dvid.DataString) {
+	if !AuditLog {
+		return
+	}
+	entry := datastore.AuditEntry{
+		Time:      time.Now(),
+		User:      anonymousUser,
+		Operation: fmt.Sprintf("alias %s: %q -> %q", alias, previous, name),
+		UUID:      uuid,
+		Data:      name,
+		Status:    http.StatusOK,
+	}
+	if name == "" {
+		entry.Data = previous
+	}
+	if r != nil {
+		entry.Remote = r.RemoteAddr
+		if user := RequestUser(r); user != nil {
+			entry.User = user.Name
+		}
+		if key := RequestAPIKey(r); key != nil {
+			entry.Key = key.ID
+		}
+	}
+	appendAudit(entry)
+}
+
+// isDataName returns true if the dataset holding the UUID has data with exactly the
+// given name.
+func isDataName(uuid dvid.UUID, name dvid.DataString) bool {
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		return false
+	}
+	for _, dataname := range dataset.DataNames() {
+		if dataname == name {
+			return true
+		}
+	}
+	return false
+}
+
+// aliasRequest handles the /api/dataset/<UUID>/aliases and /api/dataset/<UUID>/alias
+// endpoints.
+func aliasRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	action := strings.ToLower(r.Method)
+	var text string
+	var err error
+	switch {
+	case parts[1] == "aliases" && len(parts) == 2 && action == "get":
+		aliases, err := runningService.Aliases(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(aliases)
+		return
+	case parts[1] == "alias" && len(parts) == 4 && action == "post":
+		text, err = setAlias(r, uuid, dvid.DataString(parts[2]), dvid.DataString(parts[3]))
+	case parts[1] == "alias" && len(parts) == 3 && action == "delete":
+		text, err = deleteAlias(r, uuid, dvid.DataString(parts[2]))
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET /api/dataset/<UUID>/aliases, "+
+			"POST /api/dataset/<UUID>/alias/<alias>/<data name>, or DELETE /api/dataset/<UUID>/alias/<alias>")
+		return
+	}
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{%q: %q}", "result", text)
+}
@@ -0,0 +1,200 @@
+/*
+	This file handles API keys, which administrators issue to users so pipelines can
+	authenticate without a user's ID token.  Requests send a key as a bearer token, i.e.,
+	"Authorization: Bearer <key>", and are limited to the key's datasets and, unless the
+	key allows writes, to reads.  Keys limited to datasets can't make requests outside
+	them, e.g., of the server, cluster, or federation.  Requests with keys are recorded in the audit log with
+	the key's ID.  Keys can't be used to administer the server.  Replies to requests with
+	a key can be capped at a bandwidth shared by all of the key's requests.
+
+	GET /api/keys[?user=<user>]   Returns the keys issued, including revoked keys.
+	POST /api/keys                Issues a key given a JSON object with "user" and optional
+	                              "datasets" (UUIDs), "write" (boolean), and "bandwidth"
+	                              (bytes/sec).  The reply holds the key, which can't be
+	                              recovered later.
+	POST /api/keys/<key ID>       Changes the bandwidth of a key given a JSON object with
+	                              "bandwidth" in bytes/sec, where 0 is unlimited.
+	DELETE /api/keys/<key ID>     Revokes a key.
+
+	If authentication is configured, only members of the OIDC AdminGroups may use these
+	endpoints.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+type apiKeyKey struct{}
+
+// RequestAPIKey returns the API key of a request or nil if it wasn't made with one.
+func RequestAPIKey(r *http.Request) *datastore.APIKey {
+	key, _ := r.Context().Value(apiKeyKey{}).(*datastore.APIKey)
+	return key
+}
+
+// authenticateAPIKey returns the request with the user of an API key, or replies with a
+// 401 or 403 and returns false if the key is bad or doesn't allow the request.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, parts []string, apiKey string) (*http.Request, bool) {
+	if runningService.Service == nil {
+		unauthorized(w, r, "Datastore not open to check API key")
+		return r, false
+	}
+	key, err := runningService.AuthenticateAPIKey(apiKey)
+	if err != nil {
+		unauthorized(w, r, err.Error())
+		return r, false
+	}
+	var uuid dvid.UUID
+	if (parts[0] == "node" || parts[0] == "dataset") && len(parts) > 1 {
+		uuid, _ = MatchingUUID(parts[1])
+	}
+	if err := runningService.APIKeyAllows(key, uuid, isWriteRequest(r)); err != nil {
+		errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusForbidden)
+		return r, false
+	}
+	ctx := context.WithValue(r.Context(), userKey{}, &User{Name: key.User})
+	ctx = context.WithValue(ctx, apiKeyKey{}, key)
+	return r.WithContext(ctx), true
+}
+
+// withoutHash returns a copy of a key without the hash of its secret for replies.
+func withoutHash(key *datastore.APIKey) *datastore.APIKey {
+	reply := *key
+	reply.Hash = ""
+	return &reply
+}
+
+// newAPIKey issues a key, matching partial UUIDs of its datasets.  A positive bandwidth
+// caps the bytes per second of replies to the key's requests.
+func newAPIKey(user string, uuidStrs []string, write bool, bandwidth int64) (*datastore.APIKey, string, error) {
+	var uuids []dvid.UUID
+	for _, uuidStr := range uuidStrs {
+		uuid, err := MatchingUUID(uuidStr)
+		if err != nil {
+			return nil, "", err
+		}
+		uuids = append(uuids, uuid)
+	}
+	key, apiKey, err := runningService.NewAPIKey(user, uuids, write)
+	if err != nil {
+		return nil, "", err
+	}
+	if bandwidth != 0 {
+		if key, err = runningService.SetAPIKeyBandwidth(key.ID, bandwidth); err != nil {
+			return nil, "", err
+		}
+	}
+	dvid.Log(dvid.Normal, "Issued API key %s to user %q\n", key.ID, user)
+	return withoutHash(key), apiKey, nil
+}
+
+// setAPIKeyBandwidth changes the bandwidth cap of a key, logging the change.
+func setAPIKeyBandwidth(id string, bandwidth int64) (*datastore.APIKey, error) {
+	key, err := runningService.SetAPIKeyBandwidth(id, bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	dvid.Log(dvid.Normal, "Set bandwidth of API key %s of user %q to %d bytes/sec\n", key.ID, key.User, bandwidth)
+	return withoutHash(key), nil
+}
+
+// revokeAPIKey revokes a key, logging the revocation.
+func revokeAPIKey(id string) (*datastore.APIKey, error) {
+	key, err := runningService.RevokeAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+	dvid.Log(dvid.Normal, "Revoked API key %s of user %q\n", key.ID, key.User)
+	return withoutHash(key), nil
+}
+
+// apiKeysJSON returns the keys issued to a user, or all keys if user is empty.
+func apiKeysJSON(user string) ([]byte, error) {
+	keys, err := runningService.APIKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = withoutHash(key)
+	}
+	return json.Marshal(keys)
+}
+
+// apiKeysRequest handles the /api/keys endpoints.
+func apiKeysRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !adminRequest(w, r) {
+		return
+	}
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 1 && action == "get":
+		m, err := apiKeysJSON(r.URL.Query().Get("user"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+
+	case len(parts) == 1 && action == "post":
+		var config struct {
+			User      string   `json:"user"`
+			Datasets  []string `json:"datasets"`
+			Write     bool     `json:"write"`
+			Bandwidth int64    `json:"bandwidth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad API key JSON: %s", err.Error()))
+			return
+		}
+		key, apiKey, err := newAPIKey(config.User, config.Datasets, config.Write, config.Bandwidth)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			*datastore.APIKey
+			Key string
+		}{key, apiKey})
+
+	case len(parts) == 2 && action == "post":
+		var config struct {
+			Bandwidth *int64 `json:"bandwidth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil || config.Bandwidth == nil {
+			BadRequest(w, r, "Expected JSON with the key's \"bandwidth\" in bytes/sec")
+			return
+		}
+		key, err := setAPIKeyBandwidth(parts[1], *config.Bandwidth)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+
+	case len(parts) == 2 && action == "delete":
+		key, err := revokeAPIKey(parts[1])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
+
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET or POST /api/keys or POST or DELETE /api/keys/<key ID>")
+	}
+}
@@ -0,0 +1,262 @@
+/*
+	This file records an audit log of all HTTP requests and RPC commands that modify data
+	when AuditLog is set, e.g., for servers shared by many labs.  Each entry has the user,
+	the API key if one was used, the endpoint or command, the UUID and data instance, and
+	the bytes received and sent.  Entries older than AuditRetention are deleted.
+
+	GET /api/audit    Returns audit entries as JSON, oldest first, with optional query strings:
+	                  "since" and "until" (RFC 3339 times), "user", "key" (API key ID),
+	                  "uuid", "data", and "limit".
+	                  If authentication is configured, only members of the OIDC AdminGroups
+	                  may query the audit log.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// AuditLog turns on recording of all requests and commands that modify data.
+	AuditLog bool
+
+	// AuditRetention is how long audit entries are kept.  Zero keeps them forever.
+	AuditRetention time.Duration
+
+	// AuditReapInterval is how often audit entries past their retention are deleted.
+	AuditReapInterval = time.Hour
+)
+
+// anonymousUser is recorded for requests without an authenticated user.
+const anonymousUser = "anonymous"
+
+// maxAuditError is the maximum number of bytes of an error reply recorded.
+const maxAuditError = 256
+
+// auditTarget returns the UUID and data instance, if any, of a request or command given
+// the UUID string and the following arguments, e.g., a data name or "lock".
+func auditTarget(uuidStr string, args ...string) (dvid.UUID, dvid.DataString) {
+	if uuidStr == "" {
+		return "", ""
+	}
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		uuid = dvid.UUID(uuidStr)
+	}
+	if len(args) == 0 {
+		return uuid, ""
+	}
+	switch args[0] {
+	case "", "lock", "branch", "publish", "delta", "manifest", "new", "gallery", "accounting":
+		return uuid, ""
+	case "delete", "trash", "restore", "purge":
+		if len(args) > 1 {
+			return uuid, dvid.DataString(args[1])
+		}
+		return uuid, ""
+	}
+	return uuid, dvid.DataString(args[0])
+}
+
+// appendAudit adds an entry to the audit log, logging any failure.
+func appendAudit(entry datastore.AuditEntry) {
+	if runningService.Service == nil {
+		return
+	}
+	if err := runningService.AppendAudit(entry); err != nil {
+		dvid.Error("Unable to record audit entry for %s: %s\n", entry.Operation, err.Error())
+	}
+}
+
+// auditReader counts the bytes read from a request body.
+type auditReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// auditWriter counts the bytes written in reply and keeps the start of error replies.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	errMsg []byte
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.errMsg) < maxAuditError {
+		end := maxAuditError - len(w.errMsg)
+		if end > len(b) {
+			end = len(b)
+		}
+		w.errMsg = append(w.errMsg, b[:end]...)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// auditHTTP wraps a HTTP request that modifies data so it's recorded once handled.
+// It returns the writer and request to use and a function that records the entry.
+func auditHTTP(w http.ResponseWriter, r *http.Request, parts []string) (http.ResponseWriter,
+	*http.Request, func()) {
+
+	if !AuditLog || !isWriteRequest(r) {
+		return w, r, func() {}
+	}
+	start := time.Now()
+	reader := &auditReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = reader
+	}
+	writer := &auditWriter{ResponseWriter: w}
+	return writer, r, func() {
+		entry := datastore.AuditEntry{
+			Time:      start,
+			User:      anonymousUser,
+			Remote:    r.RemoteAddr,
+			Operation: r.Method + " " + r.URL.Path,
+			Status:    writer.status,
+			BytesIn:   reader.n,
+			BytesOut:  writer.n,
+		}
+		if user := RequestUser(r); user != nil {
+			entry.User = user.Name
+		}
+		if key := RequestAPIKey(r); key != nil {
+			entry.Key = key.ID
+		}
+		if (parts[0] == "node" || parts[0] == "dataset") && len(parts) > 1 {
+			entry.UUID, entry.Data = auditTarget(parts[1], parts[2:]...)
+		}
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if entry.Status >= 400 {
+			entry.Error = strings.TrimSpace(string(writer.errMsg))
+		}
+		appendAudit(entry)
+	}
+}
+
+// auditCommand records a RPC command that modified data.
+func auditCommand(cmd datastore.Request, reply *datastore.Response, start time.Time, err error) {
+	var uuidStr, descriptor, dataname string
+	if cmd.Name() == "node" || cmd.Name() == "dataset" {
+		cmd.CommandArgs(1, &uuidStr, &descriptor, &dataname)
+	}
+	entry := datastore.AuditEntry{
+		Time:      start,
+		User:      anonymousUser,
+		Operation: "rpc " + cmd.String(),
+		Status:    http.StatusOK,
+		BytesIn:   int64(len(cmd.Input)),
+	}
+	entry.UUID, entry.Data = auditTarget(uuidStr, descriptor, dataname)
+	if reply != nil {
+		entry.BytesOut = int64(len(reply.Text) + len(reply.Output))
+	}
+	if err != nil {
+		entry.Status = http.StatusInternalServerError
+		entry.Error = err.Error()
+	}
+	appendAudit(entry)
+}
+
+// auditLogRequest handles GET /api/audit.
+func auditLogRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "The audit log can only be queried with HTTP GET method")
+		return
+	}
+	if !adminRequest(w, r) {
+		return
+	}
+	values := r.URL.Query()
+	query := datastore.AuditQuery{
+		User: values.Get("user"),
+		Key:  values.Get("key"),
+		UUID: dvid.UUID(values.Get("uuid")),
+		Data: dvid.DataString(values.Get("data")),
+	}
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad 'since' time %q: %s", since, err.Error()))
+			return
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad 'until' time %q: %s", until, err.Error()))
+			return
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			BadRequest(w, r, fmt.Sprintf("Bad 'limit' %q", limit))
+			return
+		}
+	}
+	if query.UUID != "" {
+		if uuid, err := MatchingUUID(string(query.UUID)); err == nil {
+			query.UUID = uuid
+		}
+	}
+	entries, err := runningService.QueryAudit(query)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// runAuditReaper deletes audit entries older than AuditRetention every AuditReapInterval
+// until the server shuts down.
+func runAuditReaper() {
+	if AuditRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(AuditReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		deleted, err := runningService.DeleteAuditBefore(time.Now().Add(-AuditRetention))
+		if deleted > 0 {
+			dvid.Log(dvid.Normal, "Deleted %d audit entries older than %s\n", deleted, AuditRetention)
+		}
+		if err != nil {
+			dvid.Error("Unable to delete old audit entries: %s\n", err.Error())
+		}
+	}
+}
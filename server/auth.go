@@ -0,0 +1,613 @@
+/*
+	This file delegates authentication of HTTP API requests to an OpenID Connect provider,
+	e.g., Google or Keycloak.  Requests carry an ID token from the provider, either as a
+	"Authorization: Bearer <token>" header or in a cookie set by the login helper:
+
+	GET /api/login[?return=<path>]   Redirects a browser to the provider's login page.
+	GET /api/login/callback          Receives the provider's redirect after login, sets
+	                                 the ID token cookie, and redirects to the return path.
+	GET /api/login/user              Returns the user and groups of the request.
+
+	The token's claims are mapped to a User with a name and groups that handlers can get
+	with RequestUser.  Requests can instead carry an API key issued by an administrator;
+	see apikeys.go.  RPC commands aren't authenticated, so the RPC address should only
+	be reachable by administrators.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// IDTokenCookie is the name of the cookie holding the ID token of a logged in browser.
+	IDTokenCookie = "dvid_id_token"
+
+	// loginStateCookie holds the state and return path of a login in progress.
+	loginStateCookie = "dvid_login_state"
+
+	// tokenLeeway is the allowed clock skew when checking token times.
+	tokenLeeway = time.Minute
+
+	// minKeyRefresh is the minimum time between fetches of the provider's keys.
+	minKeyRefresh = time.Minute
+)
+
+// OIDCTimeout limits requests to the OIDC provider, e.g., fetches of its signing keys.
+var OIDCTimeout = 10 * time.Second
+
+// oidcClient returns a client for requests to the OIDC provider.
+func oidcClient() *http.Client {
+	return &http.Client{Timeout: OIDCTimeout}
+}
+
+// OIDCConfig configures authentication by an OpenID Connect provider.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, e.g., "https://accounts.google.com".
+	Issuer string
+
+	// ClientID is the ID of DVID as a client of the provider, which tokens must be for.
+	ClientID string
+
+	// ClientSecret and RedirectURL are needed for the login helper.  The redirect URL
+	// is this server's callback, e.g., "http://emdata:8000/api/login/callback".  Login
+	// cookies are only sent over HTTPS if the redirect URL uses HTTPS, which also works
+	// behind a proxy terminating TLS.
+	ClientSecret string
+	RedirectURL  string
+
+	// UserClaim and GroupsClaim are the claims giving the user's name and groups.
+	// They default to "email" and "groups".
+	UserClaim   string
+	GroupsClaim string
+
+	// AnonymousReads allows requests that only read without a token, except those
+	// starting validation jobs.
+	AnonymousReads bool
+
+	// AdminGroups are the groups whose members may administer the server, e.g., query
+	// the audit log or restore trashed data.
+	AdminGroups []string
+}
+
+// User is an authenticated user.
+type User struct {
+	Name   string
+	Groups []string
+}
+
+type userKey struct{}
+
+// RequestUser returns the authenticated user of a request or nil if there's none.
+func RequestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey{}).(*User)
+	return user
+}
+
+var oidc struct {
+	sync.RWMutex
+	config        *OIDCConfig
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+	keys          map[string]*rsa.PublicKey
+	keysFetched   time.Time
+
+	// fetchMu allows one fetch of the provider's keys at a time without holding the
+	// lock needed to read the keys.
+	fetchMu sync.Mutex
+}
+
+// LoadOIDC reads an OIDCConfig from a JSON file and enables authentication.
+func LoadOIDC(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var config OIDCConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("Bad OIDC configuration in %s: %s", filename, err.Error())
+	}
+	return SetOIDC(config)
+}
+
+// SetOIDC enables authentication by the configured provider, getting the provider's
+// endpoints from its discovery document.
+func SetOIDC(config OIDCConfig) error {
+	if config.Issuer == "" || config.ClientID == "" {
+		return fmt.Errorf("OIDC configuration must give an Issuer and ClientID")
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "email"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(discoveryURL, &discovery); err != nil {
+		return fmt.Errorf("Unable to get OIDC discovery document of %s: %s", config.Issuer, err.Error())
+	}
+	if discovery.JwksURI == "" {
+		return fmt.Errorf("OIDC provider %s gives no jwks_uri", config.Issuer)
+	}
+	oidc.Lock()
+	defer oidc.Unlock()
+	oidc.config = &config
+	oidc.authEndpoint = discovery.AuthorizationEndpoint
+	oidc.tokenEndpoint = discovery.TokenEndpoint
+	oidc.jwksURI = discovery.JwksURI
+	oidc.keys = nil
+	oidc.keysFetched = time.Time{}
+	dvid.Log(dvid.Normal, "Authenticating HTTP requests with OIDC provider %s\n", config.Issuer)
+	return nil
+}
+
+// getJSON decodes the JSON at a URL.
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchKeys gets the provider's RSA signing keys by key ID from its JWKS URI.
+func fetchKeys(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("Unable to get OIDC provider keys: %s", err.Error())
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// signingKey returns the provider's key with the given ID, fetching keys if it's unknown
+// since providers rotate keys.  Keys are fetched without holding the oidc lock, so
+// requests with known keys aren't held up by a slow provider.
+func signingKey(kid string) (*rsa.PublicKey, error) {
+	oidc.RLock()
+	key, found := oidc.keys[kid]
+	oidc.RUnlock()
+	if found {
+		return key, nil
+	}
+	oidc.fetchMu.Lock()
+	defer oidc.fetchMu.Unlock()
+	oidc.RLock()
+	key, found = oidc.keys[kid]
+	jwksURI, fetched := oidc.jwksURI, oidc.keysFetched
+	oidc.RUnlock()
+	if found {
+		return key, nil
+	}
+	if time.Since(fetched) >= minKeyRefresh {
+		keys, err := fetchKeys(jwksURI)
+		oidc.Lock()
+		oidc.keysFetched = time.Now()
+		if err == nil && oidc.jwksURI == jwksURI {
+			oidc.keys = keys
+		}
+		key, found = oidc.keys[kid]
+		oidc.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("ID token signed with unknown key %q", kid)
+}
+
+// verifyIDToken checks the signature, issuer, audience, authorized party, and times of an
+// ID token and returns its claims.
+func verifyIDToken(config *OIDCConfig, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token uses unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ID token signature")
+	}
+	key, err := signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("ID token has a bad signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != config.Issuer {
+		return nil, fmt.Errorf("ID token is from issuer %q, not %q", iss, config.Issuer)
+	}
+	if !tokenHasAudience(claims["aud"], config.ClientID) {
+		return nil, fmt.Errorf("ID token is not for client %q", config.ClientID)
+	}
+	// Tokens for several audiences must name this client as the authorized party.
+	azp, hasAzp := claims["azp"].(string)
+	if auds, ok := claims["aud"].([]interface{}); ok && len(auds) > 1 && !hasAzp {
+		return nil, fmt.Errorf("ID token for several audiences has no authorized party")
+	}
+	if hasAzp && azp != config.ClientID {
+		return nil, fmt.Errorf("ID token is authorized for %q, not %q", azp, config.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(tokenLeeway)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("ID token is not valid yet")
+	}
+	return claims, nil
+}
+
+// decodeTokenPart decodes a base64url-encoded JSON part of a token.
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("Malformed ID token: %s", err.Error())
+	}
+	return nil
+}
+
+// tokenHasAudience returns true if an "aud" claim, a string or array, holds the client ID.
+func tokenHasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimsUser maps token claims to a user.
+func claimsUser(config *OIDCConfig, claims map[string]interface{}) (*User, error) {
+	name, _ := claims[config.UserClaim].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("ID token has no %q or \"sub\" claim", config.UserClaim)
+	}
+	user := &User{Name: name}
+	switch groups := claims[config.GroupsClaim].(type) {
+	case string:
+		user.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				user.Groups = append(user.Groups, s)
+			}
+		}
+	}
+	return user, nil
+}
+
+// requestToken returns the ID token of a request from its header or cookie.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if cookie, err := r.Cookie(IDTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authenticate returns the request with its authenticated user, or replies with a 401
+// and returns false if the request needs a valid token and doesn't have one.
+func authenticate(w http.ResponseWriter, r *http.Request, parts []string) (*http.Request, bool) {
+	if peer, ok := authenticatePeer(r); ok {
+		return peer, true
+	}
+	if replicaRequest(r, parts) {
+		return r, true
+	}
+	if token := requestToken(r); strings.HasPrefix(token, datastore.APIKeyPrefix) {
+		return authenticateAPIKey(w, r, parts, token)
+	}
+	oidc.RLock()
+	config := oidc.config
+	oidc.RUnlock()
+	if config == nil || parts[0] == "login" {
+		return r, true
+	}
+	token := requestToken(r)
+	if token == "" {
+		if config.AnonymousReads && !isWriteRequest(r) && !isValidationPost(r) {
+			return r, true
+		}
+		unauthorized(w, r, "Request requires an ID token")
+		return r, false
+	}
+	claims, err := verifyIDToken(config, token, time.Now())
+	if err != nil {
+		unauthorized(w, r, err.Error())
+		return r, false
+	}
+	user, err := claimsUser(config, claims)
+	if err != nil {
+		unauthorized(w, r, err.Error())
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user)), true
+}
+
+// adminRequest returns true if authentication isn't configured or the request is from a
+// member of an admin group, and otherwise replies with a 403 and returns false.  Requests
+// with API keys are never admin requests.
+func adminRequest(w http.ResponseWriter, r *http.Request) bool {
+	oidc.RLock()
+	config := oidc.config
+	oidc.RUnlock()
+	if config == nil && RequestAPIKey(r) == nil {
+		return true
+	}
+	if user := RequestUser(r); user != nil && config != nil {
+		for _, group := range user.Groups {
+			for _, admin := range config.AdminGroups {
+				if group == admin {
+					return true
+				}
+			}
+		}
+	}
+	errorMsg := fmt.Sprintf("ERROR using REST API: Request requires a member of the admin groups (%s).\n",
+		r.URL.Path)
+	dvid.Log(dvid.Normal, errorMsg)
+	http.Error(w, errorMsg, http.StatusForbidden)
+	return false
+}
+
+// unauthorized replies with a 401 for requests without valid authentication.
+func unauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", message, r.URL.Path)
+	dvid.Log(dvid.Normal, errorMsg)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, errorMsg, http.StatusUnauthorized)
+}
+
+// secureCookies returns true if login cookies should only be sent over HTTPS, i.e., if
+// the login redirect URL uses HTTPS or the request itself came over TLS.
+func secureCookies(config *OIDCConfig, r *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(config.RedirectURL), "https://") || r.TLS != nil
+}
+
+// randomHex returns a random hexadecimal string, e.g., for a login's state or nonce.
+func randomHex() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// localReturnPath returns the path to return to after login if it's a path on this
+// server, or else "/", so logins can't redirect to other sites.  Browsers treat a
+// backslash like a slash and drop tabs and newlines, so "/\evil.com" and "/\t/evil.com"
+// are rejected like "//evil.com".
+func localReturnPath(returnPath string) string {
+	if !strings.HasPrefix(returnPath, "/") || len(returnPath) > 1 && (returnPath[1] == '/' || returnPath[1] == '\\') {
+		return "/"
+	}
+	for _, c := range returnPath {
+		if c < 0x20 || c == 0x7f {
+			return "/"
+		}
+	}
+	u, err := url.Parse(returnPath)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return returnPath
+}
+
+// loginRequest handles the login helper for browser-based clients.
+func loginRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	oidc.RLock()
+	config := oidc.config
+	authEndpoint, tokenEndpoint := oidc.authEndpoint, oidc.tokenEndpoint
+	oidc.RUnlock()
+	if config == nil {
+		BadRequest(w, r, "This server doesn't use OIDC authentication")
+		return
+	}
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Login requests must use HTTP GET method")
+		return
+	}
+	subcommand := ""
+	if len(parts) > 1 {
+		subcommand = parts[1]
+	}
+	switch subcommand {
+	case "":
+		// The state ties the callback to this browser and the nonce ties the ID token
+		// to this login.
+		returnPath := localReturnPath(r.URL.Query().Get("return"))
+		state, err := randomHex()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		nonce, err := randomHex()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginStateCookie,
+			Value:    state + "|" + nonce + "|" + url.QueryEscape(returnPath),
+			Path:     WebAPIPath + "login",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   secureCookies(config, r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		query := url.Values{
+			"response_type": {"code"},
+			"client_id":     {config.ClientID},
+			"redirect_uri":  {config.RedirectURL},
+			"scope":         {"openid email profile"},
+			"state":         {state},
+			"nonce":         {nonce},
+		}
+		http.Redirect(w, r, authEndpoint+"?"+query.Encode(), http.StatusFound)
+
+	case "callback":
+		cookie, err := r.Cookie(loginStateCookie)
+		if err != nil {
+			BadRequest(w, r, "Login callback without a login in progress")
+			return
+		}
+		fields := strings.SplitN(cookie.Value, "|", 3)
+		query := r.URL.Query()
+		if len(fields) != 3 || query.Get("state") == "" || query.Get("state") != fields[0] {
+			BadRequest(w, r, "Login callback state doesn't match the login in progress")
+			return
+		}
+		if errStr := query.Get("error"); errStr != "" {
+			BadRequest(w, r, fmt.Sprintf("Login failed: %s", errStr))
+			return
+		}
+		resp, err := oidcClient().PostForm(tokenEndpoint, url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {query.Get("code")},
+			"redirect_uri":  {config.RedirectURL},
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+		})
+		if err != nil {
+			BadRequest(w, r, fmt.Sprintf("Unable to reach OIDC provider: %s", err.Error()))
+			return
+		}
+		defer resp.Body.Close()
+		var tokens struct {
+			IDToken string `json:"id_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+			BadRequest(w, r, fmt.Sprintf("OIDC provider returned no ID token (status %d)", resp.StatusCode))
+			return
+		}
+		claims, err := verifyIDToken(config, tokens.IDToken, time.Now())
+		if err != nil {
+			unauthorized(w, r, err.Error())
+			return
+		}
+		if nonce, _ := claims["nonce"].(string); nonce != fields[1] {
+			unauthorized(w, r, "ID token nonce doesn't match the login in progress")
+			return
+		}
+		exp, _ := claims["exp"].(float64)
+		http.SetCookie(w, &http.Cookie{
+			Name:     IDTokenCookie,
+			Value:    tokens.IDToken,
+			Path:     "/",
+			Expires:  time.Unix(int64(exp), 0),
+			HttpOnly: true,
+			Secure:   secureCookies(config, r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.SetCookie(w, &http.Cookie{Name: loginStateCookie, Path: WebAPIPath + "login", MaxAge: -1})
+		returnPath, err := url.QueryUnescape(fields[2])
+		if err != nil {
+			returnPath = "/"
+		}
+		http.Redirect(w, r, localReturnPath(returnPath), http.StatusFound)
+
+	case "user":
+		token := requestToken(r)
+		if token == "" {
+			unauthorized(w, r, "Request requires an ID token")
+			return
+		}
+		claims, err := verifyIDToken(config, token, time.Now())
+		if err != nil {
+			unauthorized(w, r, err.Error())
+			return
+		}
+		user, err := claimsUser(config, claims)
+		if err != nil {
+			unauthorized(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+
+	default:
+		BadRequest(w, r, fmt.Sprintf("Unknown login request %q", subcommand))
+	}
+}
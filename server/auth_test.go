@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestLocalReturnPath(c *C) {
+	tests := map[string]string{
+		"":                         "/",
+		"/":                        "/",
+		"/index.html":              "/index.html",
+		"/api/node/abc/info?x=1":   "/api/node/abc/info?x=1",
+		"//evil.com":               "/",
+		"/\\evil.com":              "/",
+		"/\t/evil.com":             "/",
+		"http://evil.com/":         "/",
+		"evil.com":                 "/",
+		"https:evil.com":           "/",
+		"/path/with//double/slash": "/path/with//double/slash",
+	}
+	for returnPath, expected := range tests {
+		c.Assert(localReturnPath(returnPath), Equals, expected, Commentf("return path %q", returnPath))
+	}
+}
+
+func (s *ServerSuite) TestVerifyIDToken(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	oidc.Lock()
+	oidc.keys = map[string]*rsa.PublicKey{"test": &key.PublicKey}
+	oidc.keysFetched = time.Now()
+	oidc.Unlock()
+	defer func() {
+		oidc.Lock()
+		oidc.keys = nil
+		oidc.keysFetched = time.Time{}
+		oidc.Unlock()
+	}()
+	config := &OIDCConfig{Issuer: "https://issuer", ClientID: "dvid"}
+	now := time.Now()
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		c.Assert(err, IsNil)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	claims := func(aud interface{}, azp string) map[string]interface{} {
+		m := map[string]interface{}{"iss": "https://issuer", "aud": aud, "exp": now.Add(time.Hour).Unix(), "nonce": "n"}
+		if azp != "" {
+			m["azp"] = azp
+		}
+		return m
+	}
+
+	verified, err := verifyIDToken(config, sign(claims("dvid", "")), now)
+	c.Assert(err, IsNil)
+	c.Assert(verified["nonce"], Equals, "n")
+	_, err = verifyIDToken(config, sign(claims("dvid", "dvid")), now)
+	c.Assert(err, IsNil)
+	_, err = verifyIDToken(config, sign(claims("dvid", "other")), now)
+	c.Assert(err, NotNil)
+
+	// Tokens for several audiences must be authorized for this client.
+	_, err = verifyIDToken(config, sign(claims([]string{"dvid", "other"}, "")), now)
+	c.Assert(err, NotNil)
+	_, err = verifyIDToken(config, sign(claims([]string{"dvid", "other"}, "dvid")), now)
+	c.Assert(err, IsNil)
+	_, err = verifyIDToken(config, sign(claims("other", "")), now)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestSecureCookies(c *C) {
+	r := httptest.NewRequest("GET", "http://emdata/api/login/callback", nil)
+	c.Assert(secureCookies(&OIDCConfig{RedirectURL: "http://emdata/api/login/callback"}, r), Equals, false)
+	c.Assert(secureCookies(&OIDCConfig{RedirectURL: "https://emdata/api/login/callback"}, r), Equals, true)
+	r = httptest.NewRequest("GET", "https://emdata/api/login/callback", nil)
+	c.Assert(secureCookies(&OIDCConfig{RedirectURL: "http://emdata/api/login/callback"}, r), Equals, true)
+}
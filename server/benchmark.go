@@ -0,0 +1,424 @@
+/*
+	This file implements the "benchmark" command, which generates a synthetic voxels
+	instance and measures ingest throughput, random slice latency, and subvolume
+	bandwidth through the running server's HTTP API.  Reports are JSON so runs with
+	different storage backends or server settings can be compared.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const BenchmarkHelp = `
+	benchmark [<setting>=<value> ...]
+
+	Creates a new dataset with a synthetic voxels instance, then measures ingest
+	throughput, random XY slice latency, and random subvolume bandwidth through this
+	server's HTTP API.  Returns a JSON report.  Settings:
+
+	type          Voxels datatype to benchmark: "grayscale8" (default) or "rgba8"
+	volume        Size of the synthetic volume (default "256,256,256")
+	chunk         Edge length of the cubes POSTed during ingest (default 128)
+	slices        Number of random XY slices to GET (default 100)
+	slicesize     Edge length of each slice (default 256)
+	sliceformat   Image format for slices (default "png")
+	subvolumes    Number of random subvolumes to GET (default 20)
+	subvolsize    Edge length of each subvolume (default 64)
+	concurrency   Number of concurrent requests (default 4)
+	seed          Seed for the random data and locations (default 1)
+`
+
+// benchmarkTypes gives the bytes per voxel of the datatypes that can be benchmarked.
+var benchmarkTypes = map[string]int{
+	"grayscale8": 1,
+	"rgba8":      4,
+}
+
+// BenchmarkConfig holds the parameters of a benchmark run.
+type BenchmarkConfig struct {
+	Datatype    string
+	Volume      dvid.Point3d
+	Chunk       int32
+	Slices      int
+	SliceSize   int32
+	SliceFormat string
+	Subvolumes  int
+	SubvolSize  int32
+	Concurrency int
+	Seed        int64
+}
+
+// DefaultBenchmarkConfig returns the configuration used for unspecified settings.
+func DefaultBenchmarkConfig() BenchmarkConfig {
+	return BenchmarkConfig{
+		Datatype:    "grayscale8",
+		Volume:      dvid.Point3d{256, 256, 256},
+		Chunk:       128,
+		Slices:      100,
+		SliceSize:   256,
+		SliceFormat: "png",
+		Subvolumes:  20,
+		SubvolSize:  64,
+		Concurrency: 4,
+		Seed:        1,
+	}
+}
+
+// NewBenchmarkConfig returns a benchmark configuration from command settings.
+func NewBenchmarkConfig(settings dvid.Config) (BenchmarkConfig, error) {
+	config := DefaultBenchmarkConfig()
+	if s, found, err := settings.GetString("type"); err != nil {
+		return config, err
+	} else if found {
+		config.Datatype = s
+	}
+	if _, found := benchmarkTypes[config.Datatype]; !found {
+		return config, fmt.Errorf("Can't benchmark datatype %q", config.Datatype)
+	}
+	if s, found, err := settings.GetString("volume"); err != nil {
+		return config, err
+	} else if found {
+		p, err := dvid.StringToPoint(s, ",")
+		if err != nil {
+			return config, err
+		}
+		volume, ok := p.(dvid.Point3d)
+		if !ok {
+			return config, fmt.Errorf("Benchmark volume must be 3d, not %q", s)
+		}
+		config.Volume = volume
+	}
+	if s, found, err := settings.GetString("sliceformat"); err != nil {
+		return config, err
+	} else if found {
+		config.SliceFormat = s
+	}
+	ints := []struct {
+		key   string
+		value *int
+	}{
+		{"slices", &config.Slices},
+		{"subvolumes", &config.Subvolumes},
+		{"concurrency", &config.Concurrency},
+	}
+	for _, setting := range ints {
+		if i, found, err := settings.GetInt(setting.key); err != nil {
+			return config, err
+		} else if found {
+			*setting.value = i
+		}
+	}
+	sizes := []struct {
+		key   string
+		value *int32
+	}{
+		{"chunk", &config.Chunk},
+		{"slicesize", &config.SliceSize},
+		{"subvolsize", &config.SubvolSize},
+	}
+	for _, setting := range sizes {
+		if i, found, err := settings.GetInt(setting.key); err != nil {
+			return config, err
+		} else if found {
+			*setting.value = int32(i)
+		}
+	}
+	if i, found, err := settings.GetInt("seed"); err != nil {
+		return config, err
+	} else if found {
+		config.Seed = int64(i)
+	}
+
+	for dim := 0; dim < 3; dim++ {
+		if config.Volume[dim] <= 0 {
+			return config, fmt.Errorf("Benchmark volume must be positive, not %s", config.Volume)
+		}
+	}
+	if config.Chunk <= 0 || config.SliceSize <= 0 || config.SubvolSize <= 0 {
+		return config, fmt.Errorf("Benchmark chunk, slice, and subvolume sizes must be positive")
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	return config, nil
+}
+
+// LatencyStats summarizes the latencies of a set of requests in milliseconds.
+type LatencyStats struct {
+	Count int
+	Mean  float64
+	P50   float64
+	P95   float64
+	P99   float64
+	Max   float64
+}
+
+func newLatencyStats(latencies []time.Duration) LatencyStats {
+	stats := LatencyStats{Count: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ms := func(d time.Duration) float64 { return d.Seconds() * 1000 }
+	percentile := func(p float64) float64 {
+		return ms(sorted[int(p*float64(len(sorted)-1))])
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	stats.Mean = ms(total) / float64(len(sorted))
+	stats.P50 = percentile(0.50)
+	stats.P95 = percentile(0.95)
+	stats.P99 = percentile(0.99)
+	stats.Max = ms(sorted[len(sorted)-1])
+	return stats
+}
+
+// ThroughputStats summarizes the bandwidth and latencies of a set of requests.
+type ThroughputStats struct {
+	Bytes     int64
+	Seconds   float64
+	MBPerSec  float64
+	Latencies LatencyStats
+}
+
+func newThroughputStats(bytes int64, elapsed time.Duration, latencies []time.Duration) ThroughputStats {
+	stats := ThroughputStats{
+		Bytes:     bytes,
+		Seconds:   elapsed.Seconds(),
+		Latencies: newLatencyStats(latencies),
+	}
+	if stats.Seconds > 0 {
+		stats.MBPerSec = float64(bytes) / float64(dvid.Mega) / stats.Seconds
+	}
+	return stats
+}
+
+// BenchmarkReport is the result of a benchmark run.
+type BenchmarkReport struct {
+	Config     BenchmarkConfig
+	UUID       dvid.UUID
+	Data       dvid.DataString
+	Started    time.Time
+	Ingest     ThroughputStats
+	Slices     LatencyStats
+	Subvolumes ThroughputStats
+}
+
+// benchmarkRequest is a single HTTP request in a benchmark.
+type benchmarkRequest struct {
+	method string
+	url    string
+	body   []byte
+}
+
+// RunBenchmark creates a new dataset with synthetic data and measures this server's
+// performance through its HTTP API.  It stops early if the context is done.
+func RunBenchmark(ctx context.Context, config BenchmarkConfig) (*BenchmarkReport, error) {
+	bytesPerVoxel, found := benchmarkTypes[config.Datatype]
+	if !found {
+		return nil, fmt.Errorf("Can't benchmark datatype %q", config.Datatype)
+	}
+	uuid, _, err := runningService.NewDataset()
+	if err != nil {
+		return nil, err
+	}
+	report := &BenchmarkReport{
+		Config:  config,
+		UUID:    uuid,
+		Data:    dvid.DataString("benchmark-" + config.Datatype),
+		Started: time.Now(),
+	}
+	if err = runningService.NewData(uuid, dvid.TypeString(config.Datatype), report.Data, dvid.Config{}); err != nil {
+		return nil, err
+	}
+	address := runningService.WebAddress
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	dataURL := fmt.Sprintf("http://%s%s/node/%s/%s", address, WebAPIPath, uuid, report.Data)
+	random := rand.New(rand.NewSource(config.Seed))
+
+	// Ingest the volume in cubes of synthetic data.
+	var requests []benchmarkRequest
+	var ingestBytes int64
+	for z := int32(0); z < config.Volume[2]; z += config.Chunk {
+		for y := int32(0); y < config.Volume[1]; y += config.Chunk {
+			for x := int32(0); x < config.Volume[0]; x += config.Chunk {
+				var size dvid.Point3d
+				for dim, beg := range []int32{x, y, z} {
+					size[dim] = config.Chunk
+					if beg+size[dim] > config.Volume[dim] {
+						size[dim] = config.Volume[dim] - beg
+					}
+				}
+				data := make([]byte, size.Prod()*int64(bytesPerVoxel))
+				random.Read(data)
+				ingestBytes += int64(len(data))
+				requests = append(requests, benchmarkRequest{
+					method: "POST",
+					url:    fmt.Sprintf("%s/raw/0_1_2/%d_%d_%d/%d_%d_%d", dataURL, size[0], size[1], size[2], x, y, z),
+					body:   data,
+				})
+			}
+		}
+	}
+	startTime := time.Now()
+	latencies, _, err := runBenchmarkRequests(ctx, requests, config.Concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("Benchmark ingest failed: %s", err.Error())
+	}
+	report.Ingest = newThroughputStats(ingestBytes, time.Since(startTime), latencies)
+
+	// GET random XY slices, clipped to the volume.
+	randomOffset := func(size int32, dim int) int32 {
+		if size >= config.Volume[dim] {
+			return 0
+		}
+		return random.Int31n(config.Volume[dim] - size)
+	}
+	requests = make([]benchmarkRequest, config.Slices)
+	for n := range requests {
+		requests[n] = benchmarkRequest{
+			method: "GET",
+			url: fmt.Sprintf("%s/raw/0_1/%d_%d/%d_%d_%d/%s", dataURL, config.SliceSize, config.SliceSize,
+				randomOffset(config.SliceSize, 0), randomOffset(config.SliceSize, 1),
+				random.Int31n(config.Volume[2]), config.SliceFormat),
+		}
+	}
+	latencies, _, err = runBenchmarkRequests(ctx, requests, config.Concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("Benchmark slice requests failed: %s", err.Error())
+	}
+	report.Slices = newLatencyStats(latencies)
+
+	// GET random subvolumes.
+	requests = make([]benchmarkRequest, config.Subvolumes)
+	for n := range requests {
+		requests[n] = benchmarkRequest{
+			method: "GET",
+			url: fmt.Sprintf("%s/raw/0_1_2/%d_%d_%d/%d_%d_%d", dataURL,
+				config.SubvolSize, config.SubvolSize, config.SubvolSize,
+				randomOffset(config.SubvolSize, 0), randomOffset(config.SubvolSize, 1),
+				randomOffset(config.SubvolSize, 2)),
+		}
+	}
+	startTime = time.Now()
+	latencies, subvolBytes, err := runBenchmarkRequests(ctx, requests, config.Concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("Benchmark subvolume requests failed: %s", err.Error())
+	}
+	report.Subvolumes = newThroughputStats(subvolBytes, time.Since(startTime), latencies)
+	return report, nil
+}
+
+// runBenchmarkRequests sends requests using a number of concurrent clients, returning
+// the latency of each request and the total bytes received.  Any failed request
+// stops the run.
+func runBenchmarkRequests(ctx context.Context, requests []benchmarkRequest, concurrency int) (
+	latencies []time.Duration, received int64, err error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	latencies = make([]time.Duration, 0, len(requests))
+	queue := make(chan benchmarkRequest)
+	wg := new(sync.WaitGroup)
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				start := time.Now()
+				bytes, reqErr := sendBenchmarkRequest(ctx, req)
+				elapsed := time.Since(start)
+				mu.Lock()
+				if reqErr != nil {
+					if err == nil {
+						err = reqErr
+						cancel()
+					}
+				} else {
+					latencies = append(latencies, elapsed)
+					received += bytes
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, req := range requests {
+		select {
+		case queue <- req:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+func sendBenchmarkRequest(ctx context.Context, req benchmarkRequest) (int64, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, req.url, body)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	received, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return received, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return received, fmt.Errorf("%s %s returned status %d", req.method, req.url, resp.StatusCode)
+	}
+	return received, nil
+}
+
+// benchmarkCommand handles the "benchmark" RPC command.
+func benchmarkCommand(ctx context.Context, settings dvid.Config) (string, error) {
+	config, err := NewBenchmarkConfig(settings)
+	if err != nil {
+		return "", err
+	}
+	report, err := RunBenchmark(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	return string(m) + "\n", nil
+}
@@ -0,0 +1,206 @@
+/*
+	This file lets long-running jobs, e.g., ingests and exports, survive a server restart
+	instead of starting over.  A resumable job records a checkpoint of its completed work,
+	e.g., the last completed block or section.  When the server shuts down, e.g., on SIGTERM
+	or SIGINT, running resumable jobs are stopped and their checkpoints are saved in the
+	datastore directory.  When the server next starts, each job is resumed from its
+	checkpoint by the JobResumer registered for its kind.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// JobCheckpointFilename is the file in the datastore directory holding the checkpoints
+// of jobs interrupted by a shutdown.
+const JobCheckpointFilename = "dvid-job-checkpoints.json"
+
+// JobStopTimeout is how long a shutdown waits for resumable jobs to stop before saving
+// their checkpoints.
+var JobStopTimeout = 10 * time.Second
+
+// JobResumer runs a resumable job given the JSON arguments it was started with and its
+// last JSON checkpoint, which is nil if the job made no checkpoint.  The job should stop
+// and return the context's error when the context is canceled.
+type JobResumer func(ctx context.Context, job *Job, args, checkpoint json.RawMessage) error
+
+var jobResumers struct {
+	sync.RWMutex
+	byKind map[string]JobResumer
+}
+
+// RegisterJobResumer sets the function resuming jobs of a kind after a restart.  It's
+// usually called in the init() of the package starting the jobs.
+func RegisterJobResumer(kind string, resume JobResumer) {
+	jobResumers.Lock()
+	defer jobResumers.Unlock()
+	if jobResumers.byKind == nil {
+		jobResumers.byKind = make(map[string]JobResumer)
+	}
+	jobResumers.byKind[kind] = resume
+}
+
+// NewResumableJob registers a running job of a kind with a JobResumer.  The arguments
+// must have a JSON encoding from which the resumer can restart the job.
+func NewResumableJob(kind, description string, args interface{}) (*Job, error) {
+	jobResumers.RLock()
+	_, found := jobResumers.byKind[kind]
+	jobResumers.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("No resumer registered for jobs of kind %q", kind)
+	}
+	m, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	job := NewJob(description)
+	job.Lock()
+	job.kind, job.args = kind, m
+	job.Unlock()
+	return job, nil
+}
+
+// Checkpoint records the completed work of a resumable job, which must have a JSON
+// encoding the job's resumer can continue from.
+func (job *Job) Checkpoint(state interface{}) error {
+	m, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	job.Lock()
+	job.checkpoint = m
+	job.Unlock()
+	return nil
+}
+
+// jobCheckpoint is the saved state of an interrupted job.
+type jobCheckpoint struct {
+	Kind        string
+	Description string
+	Args        json.RawMessage
+	Checkpoint  json.RawMessage `json:",omitempty"`
+}
+
+// jobCheckpointPath returns the path of the checkpoint file or an empty string if no
+// datastore is open.
+func jobCheckpointPath() string {
+	if runningService.DatastorePath == "" {
+		return ""
+	}
+	return filepath.Join(runningService.DatastorePath, JobCheckpointFilename)
+}
+
+// interruptedJobs returns the resumable jobs that haven't finished.
+func interruptedJobs() []*Job {
+	var interrupted []*Job
+	for _, job := range Jobs() {
+		job.RLock()
+		if job.kind != "" && (job.Status == JobRunning || job.Status == JobInterrupted) {
+			interrupted = append(interrupted, job)
+		}
+		job.RUnlock()
+	}
+	return interrupted
+}
+
+// saveJobCheckpoints waits up to JobStopTimeout for resumable jobs to stop after the
+// server context is canceled, then saves the checkpoints of those that didn't finish.
+func saveJobCheckpoints() error {
+	path := jobCheckpointPath()
+	if path == "" {
+		return nil
+	}
+	deadline := time.Now().Add(JobStopTimeout)
+	for time.Now().Before(deadline) {
+		var running int
+		for _, job := range interruptedJobs() {
+			job.RLock()
+			if job.Status == JobRunning {
+				running++
+			}
+			job.RUnlock()
+		}
+		if running == 0 {
+			break
+		}
+		log.Printf("Waiting for %d resumable jobs to stop...\n", running)
+		time.Sleep(100 * time.Millisecond)
+	}
+	var checkpoints []jobCheckpoint
+	for _, job := range interruptedJobs() {
+		job.RLock()
+		checkpoints = append(checkpoints, jobCheckpoint{job.kind, job.Description, job.args, job.checkpoint})
+		job.RUnlock()
+	}
+	if len(checkpoints) == 0 {
+		return nil
+	}
+	m, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, m, 0644); err != nil {
+		return err
+	}
+	log.Printf("Saved checkpoints of %d interrupted jobs to %s\n", len(checkpoints), path)
+	return nil
+}
+
+// resumeJobs restarts the jobs interrupted by the last shutdown from their checkpoints.
+func resumeJobs() {
+	path := jobCheckpointPath()
+	if path == "" {
+		return
+	}
+	m, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		dvid.Error("Unable to read job checkpoints %s: %s\n", path, err.Error())
+		return
+	}
+	// Remove the checkpoints so jobs that fail on resume aren't retried forever.
+	if err := os.Remove(path); err != nil {
+		dvid.Error("Unable to remove job checkpoints %s: %s\n", path, err.Error())
+		return
+	}
+	var checkpoints []jobCheckpoint
+	if err := json.Unmarshal(m, &checkpoints); err != nil {
+		dvid.Error("Bad job checkpoints in %s: %s\n", path, err.Error())
+		return
+	}
+	for _, cp := range checkpoints {
+		jobResumers.RLock()
+		resume, found := jobResumers.byKind[cp.Kind]
+		jobResumers.RUnlock()
+		if !found {
+			dvid.Error("Unable to resume %q: no resumer for jobs of kind %q\n", cp.Description, cp.Kind)
+			continue
+		}
+		job := NewJob(cp.Description)
+		job.Lock()
+		job.kind, job.args, job.checkpoint = cp.Kind, cp.Args, cp.Checkpoint
+		job.Unlock()
+		dvid.Log(dvid.Normal, "Resuming job %d: %s\n", job.ID, cp.Description)
+		go func(cp jobCheckpoint) {
+			err := resume(serverCtx, job, cp.Args, cp.Checkpoint)
+			if err != nil {
+				dvid.Error("%s: %s\n", cp.Description, err.Error())
+			}
+			job.Finish(err)
+		}(cp)
+	}
+}
@@ -36,18 +36,32 @@ func NewClient(rpcAddress string) *Client {
 
 // Send transmits an RPC command if a server is available.
 func (c *Client) Send(request datastore.Request) error {
-	var reply datastore.Response
+	var reply *datastore.Response
 	if c.client != nil {
-		err := c.client.Call("RPCConnection.Do", request, &reply)
-		if err != nil {
-			if dvid.Mode == dvid.Debug {
-				return fmt.Errorf("RPC error for '%s': %s", request.Command, err.Error())
-			} else {
-				return fmt.Errorf("RPC error: %s", err.Error())
-			}
+		var err error
+		if reply, err = c.Reply(request); err != nil {
+			return err
 		}
 	} else {
+		reply = &datastore.Response{}
 		reply.Output = []byte(fmt.Sprintf("No DVID server is available: %s\n", request.Command))
 	}
 	return reply.Write(os.Stdout)
 }
+
+// Reply transmits an RPC command and returns the server's reply.
+func (c *Client) Reply(request datastore.Request) (*datastore.Response, error) {
+	if c.client == nil {
+		return nil, fmt.Errorf("No DVID server is available at %s", c.rpcAddress)
+	}
+	var reply datastore.Response
+	err := c.client.Call("RPCConnection.Do", request, &reply)
+	if err != nil {
+		if dvid.ModeOn(dvid.Debug) {
+			return nil, fmt.Errorf("RPC error for '%s': %s", request.Command, err.Error())
+		} else {
+			return nil, fmt.Errorf("RPC error: %s", err.Error())
+		}
+	}
+	return &reply, nil
+}
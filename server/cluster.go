@@ -0,0 +1,438 @@
+/*
+	This file implements an optional cluster of DVID servers, a first step toward scaling
+	beyond one machine.  Servers register with a coordinator, which is itself a DVID server
+	started in coordinator mode, and periodically send it the UUIDs they hold.  New
+	datasets are assigned to servers by consistent hashing of their root UUID, and any
+	server proxies requests for UUIDs it doesn't hold to the server that does.
+
+	Proxied requests don't carry the client's ID token or API key.  Instead they carry
+	the cluster token and the user authenticated by the proxying member, which members
+	trust if the token matches their own.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// ClusterCoordinator is the HTTP address of the cluster coordinator this server
+	// registers with.  Empty means this server isn't part of a cluster.
+	ClusterCoordinator string
+
+	// CoordinatorMode makes this server the coordinator of a cluster.
+	CoordinatorMode bool
+
+	// ClusterHeartbeat is the interval between registrations with the coordinator.
+	// Members that miss three registrations are dropped from the cluster.
+	ClusterHeartbeat = 10 * time.Second
+
+	// ClusterToken is a shared secret members send when registering.  If set, the
+	// coordinator only accepts registrations carrying it.  Otherwise registrations must
+	// be admin requests.
+	ClusterToken string
+)
+
+const (
+	// clusterTokenHeader is the HTTP header carrying the cluster token of registrations
+	// and proxied requests.
+	clusterTokenHeader = "X-DVID-Cluster-Token"
+
+	// clusterUserHeader, clusterGroupsHeader, and clusterKeyHeader carry the user, the
+	// user's groups, and the ID of the API key of a proxied request.
+	clusterUserHeader   = "X-DVID-Cluster-User"
+	clusterGroupsHeader = "X-DVID-Cluster-Groups"
+	clusterKeyHeader    = "X-DVID-Cluster-Key"
+)
+
+// ClusterMember describes a server in the cluster.
+type ClusterMember struct {
+	WebAddress string
+	RPCAddress string
+	UUIDs      []dvid.UUID
+	LastSeen   time.Time
+}
+
+// clusterState is the view of the cluster held by each server.  The coordinator's
+// view is authoritative; members replace theirs after each registration.
+type clusterState struct {
+	sync.RWMutex
+	members map[string]*ClusterMember // keyed by web address
+	owners  map[dvid.UUID]string      // web address of the server holding each UUID
+	ring    *dvid.HashRing
+	proxies map[string]*httputil.ReverseProxy
+}
+
+var cluster = &clusterState{
+	members: make(map[string]*ClusterMember),
+	owners:  make(map[dvid.UUID]string),
+	ring:    dvid.NewHashRing(dvid.DefaultRingReplicas),
+	proxies: make(map[string]*httputil.ReverseProxy),
+}
+
+// IsClustered returns true if this server is part of a cluster.
+func IsClustered() bool {
+	return CoordinatorMode || ClusterCoordinator != ""
+}
+
+// setMembers replaces the cluster view with the given members.
+func (c *clusterState) setMembers(members []*ClusterMember) {
+	c.Lock()
+	defer c.Unlock()
+	c.members = make(map[string]*ClusterMember, len(members))
+	c.owners = make(map[dvid.UUID]string)
+	c.ring = dvid.NewHashRing(dvid.DefaultRingReplicas)
+	for _, member := range members {
+		c.members[member.WebAddress] = member
+		c.ring.Add(member.WebAddress)
+		for _, u := range member.UUIDs {
+			c.owners[u] = member.WebAddress
+		}
+	}
+}
+
+// register records a member on the coordinator, dropping members that haven't
+// registered recently, and returns the current members.
+func (c *clusterState) register(member *ClusterMember) []*ClusterMember {
+	c.Lock()
+	member.LastSeen = time.Now()
+	c.members[member.WebAddress] = member
+	members := make([]*ClusterMember, 0, len(c.members))
+	for addr, m := range c.members {
+		if time.Since(m.LastSeen) > 3*ClusterHeartbeat {
+			dvid.Log(dvid.Normal, "Dropping cluster member %s, last seen %s\n", addr, m.LastSeen)
+			continue
+		}
+		members = append(members, m)
+	}
+	c.Unlock()
+	c.setMembers(members)
+	return members
+}
+
+// memberList returns the members in the current view.
+func (c *clusterState) memberList() []*ClusterMember {
+	c.RLock()
+	defer c.RUnlock()
+	members := make([]*ClusterMember, 0, len(c.members))
+	for _, member := range c.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// ownerOf returns the other member holding the node matching a UUID string, which may
+// be a prefix of the UUID, or nil if no other member holds one.  It's an error if the
+// string matches nodes on more than one server, including this one if local is true.
+func (c *clusterState) ownerOf(uuidStr string, local bool) (*ClusterMember, error) {
+	c.RLock()
+	defer c.RUnlock()
+	var owner string
+	for u, addr := range c.owners {
+		if addr == runningService.WebAddress || !strings.HasPrefix(string(u), uuidStr) {
+			continue
+		}
+		if local || owner != "" && owner != addr {
+			return nil, fmt.Errorf("UUID %q is ambiguous: it matches nodes on more than one cluster member", uuidStr)
+		}
+		owner = addr
+	}
+	if owner == "" {
+		return nil, nil
+	}
+	return c.members[owner], nil
+}
+
+// proxy returns a reverse proxy to a member's web server.
+func (c *clusterState) proxy(webAddress string) *httputil.ReverseProxy {
+	c.Lock()
+	defer c.Unlock()
+	p, found := c.proxies[webAddress]
+	if !found {
+		p = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: webAddress})
+		c.proxies[webAddress] = p
+	}
+	return p
+}
+
+// checkMemberAddress returns an error if a member's address can't be reached by other
+// members, e.g., the default "localhost:8000".
+func checkMemberAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Bad cluster member address %q: %s", address, err.Error())
+	}
+	ip := net.ParseIP(host)
+	if host == "" || host == "localhost" || ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+		return fmt.Errorf("Cluster members must be given addresses other members can reach, not %q", address)
+	}
+	return nil
+}
+
+// selfMember describes this server for registration.
+func selfMember() *ClusterMember {
+	var uuids []dvid.UUID
+	if runningService.Service != nil && runningService.Service.Datasets != nil {
+		uuids = runningService.Service.Datasets.UUIDs()
+	}
+	return &ClusterMember{
+		WebAddress: runningService.WebAddress,
+		RPCAddress: runningService.RPCAddress,
+		UUIDs:      uuids,
+	}
+}
+
+// registerWithCoordinator sends this server's UUIDs to the coordinator and updates
+// its view of the cluster with the response.
+func registerWithCoordinator() error {
+	if CoordinatorMode {
+		cluster.register(selfMember())
+		return nil
+	}
+	m, err := json.Marshal(selfMember())
+	if err != nil {
+		return err
+	}
+	registerURL := fmt.Sprintf("http://%s%scluster/register", ClusterCoordinator, WebAPIPath)
+	req, err := http.NewRequest("POST", registerURL, bytes.NewReader(m))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ClusterToken != "" {
+		req.Header.Set(clusterTokenHeader, ClusterToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Coordinator at %s returned status %d", ClusterCoordinator, resp.StatusCode)
+	}
+	var members []*ClusterMember
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return fmt.Errorf("Bad membership from coordinator at %s: %s", ClusterCoordinator, err.Error())
+	}
+	cluster.setMembers(members)
+	return nil
+}
+
+// runClusterMember registers this server with the coordinator every heartbeat until
+// the server shuts down.
+func runClusterMember() {
+	ticker := time.NewTicker(ClusterHeartbeat)
+	defer ticker.Stop()
+	for {
+		if err := registerWithCoordinator(); err != nil {
+			dvid.Error("Unable to register with cluster coordinator: %s\n", err.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+	}
+}
+
+// clusterRequest handles the /api/cluster endpoints.
+func clusterRequest(w http.ResponseWriter, r *http.Request) {
+	lenPath := len(WebAPIPath + "cluster/")
+	parts := strings.Split(r.URL.Path[lenPath:], "/")
+	action := strings.ToLower(r.Method)
+
+	var members []*ClusterMember
+	switch {
+	case len(parts) == 1 && parts[0] == "members" && action == "get":
+		members = cluster.memberList()
+	case len(parts) == 1 && parts[0] == "register" && action == "post":
+		if !CoordinatorMode {
+			BadRequest(w, r, "This DVID server is not a cluster coordinator")
+			return
+		}
+		if ClusterToken != "" {
+			token := r.Header.Get(clusterTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(ClusterToken)) != 1 {
+				dvid.Error("Refused cluster registration from %s with a bad cluster token\n", r.RemoteAddr)
+				http.Error(w, "Cluster registration requires the cluster token", http.StatusForbidden)
+				return
+			}
+		} else if !adminRequest(w, r) {
+			return
+		}
+		member := new(ClusterMember)
+		if err := json.NewDecoder(r.Body).Decode(member); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+			return
+		}
+		if member.WebAddress == "" {
+			BadRequest(w, r, "Cluster registration requires a web address")
+			return
+		}
+		members = cluster.register(member)
+	default:
+		BadRequest(w, r, WebAPIPath+"cluster/ must be followed with 'members' (GET) or 'register' (POST)")
+		return
+	}
+	m, err := json.Marshal(members)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// proxyToOwner sends a HTTP request for a UUID not held by this server to the cluster
+// member holding it, or replies with an error if the UUID is ambiguous.  It returns
+// false if the request should be handled locally.
+func proxyToOwner(w http.ResponseWriter, r *http.Request, uuidStr string) bool {
+	if !IsClustered() || uuidStr == "" {
+		return false
+	}
+	_, localErr := MatchingUUID(uuidStr)
+	owner, err := cluster.ownerOf(uuidStr, localErr == nil)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return true
+	}
+	if owner == nil {
+		return false
+	}
+	dvid.Log(dvid.Debug, "Proxying %s %s to cluster member %s\n", r.Method, r.URL.Path, owner.WebAddress)
+	cluster.proxy(owner.WebAddress).ServeHTTP(w, peerRequest(r))
+	return true
+}
+
+// peerRequest returns a copy of a request for another member without the client's
+// credentials, which instead carries the cluster token and the authenticated user.
+func peerRequest(r *http.Request) *http.Request {
+	peer := withoutCredentials(r)
+	if ClusterToken == "" {
+		return peer
+	}
+	peer.Header.Set(clusterTokenHeader, ClusterToken)
+	if user := RequestUser(r); user != nil {
+		peer.Header.Set(clusterUserHeader, user.Name)
+		for _, group := range user.Groups {
+			peer.Header.Add(clusterGroupsHeader, group)
+		}
+	}
+	if key := RequestAPIKey(r); key != nil {
+		peer.Header.Set(clusterKeyHeader, key.ID)
+	}
+	return peer
+}
+
+// withoutCredentials returns a copy of a request without its ID token, API key, or
+// cluster headers, so they aren't sent to other servers.
+func withoutCredentials(r *http.Request) *http.Request {
+	peer := r.WithContext(r.Context())
+	peer.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Cookie", clusterTokenHeader, clusterUserHeader, clusterGroupsHeader, clusterKeyHeader:
+			continue
+		}
+		peer.Header[name] = append([]string(nil), values...)
+	}
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != IDTokenCookie && cookie.Name != loginStateCookie {
+			peer.AddCookie(cookie)
+		}
+	}
+	return peer
+}
+
+// authenticatePeer returns a request proxied by another member with the user that
+// member authenticated, and true if the request carries the cluster token.  Requests
+// made with API keys keep a key, without its scope since the proxying member checked
+// it, so they're still refused as admin requests.
+func authenticatePeer(r *http.Request) (*http.Request, bool) {
+	token := r.Header.Get(clusterTokenHeader)
+	if ClusterToken == "" || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ClusterToken)) != 1 {
+		return r, false
+	}
+	name := r.Header.Get(clusterUserHeader)
+	if name == "" {
+		return r, true
+	}
+	ctx := context.WithValue(r.Context(), userKey{}, &User{Name: name, Groups: r.Header[clusterGroupsHeader]})
+	if keyID := r.Header.Get(clusterKeyHeader); keyID != "" {
+		ctx = context.WithValue(ctx, apiKeyKey{}, &datastore.APIKey{ID: keyID, User: name, Write: true})
+	}
+	return r.WithContext(ctx), true
+}
+
+// forwardToOwner runs a RPC command for a UUID not held by this server on the cluster
+// member holding it.  It returns false if the command should be run locally, and an
+// error if the UUID is ambiguous.
+func forwardToOwner(cmd datastore.Request, reply *datastore.Response, uuidStr string) (bool, error) {
+	if !IsClustered() || uuidStr == "" {
+		return false, nil
+	}
+	_, localErr := MatchingUUID(uuidStr)
+	owner, err := cluster.ownerOf(uuidStr, localErr == nil)
+	if err != nil {
+		return true, err
+	}
+	if owner == nil {
+		return false, nil
+	}
+	return true, callMember(owner, cmd, reply)
+}
+
+// newDataset creates a dataset, returning its root UUID.  In a cluster, the dataset
+// is created on the member that its root UUID hashes to.
+func newDataset() (dvid.UUID, error) {
+	if !IsClustered() {
+		root, _, err := runningService.NewDataset()
+		return root, err
+	}
+	root := dvid.NewUUID()
+	cluster.RLock()
+	ownerAddr := cluster.ring.Owner(string(root))
+	owner, found := cluster.members[ownerAddr]
+	cluster.RUnlock()
+	if !found || ownerAddr == runningService.WebAddress {
+		root, _, err := runningService.NewDatasetWithRoot(root)
+		return root, err
+	}
+	cmd := datastore.Request{Command: dvid.Command{"datasets", "new", "root=" + string(root)}}
+	var reply datastore.Response
+	if err := callMember(owner, cmd, &reply); err != nil {
+		return "", err
+	}
+	// Add the dataset to this server's view until the next registration.
+	cluster.Lock()
+	cluster.owners[root] = ownerAddr
+	cluster.Unlock()
+	return root, nil
+}
+
+// callMember runs a RPC command on a cluster member.
+func callMember(member *ClusterMember, cmd datastore.Request, reply *datastore.Response) error {
+	client, err := rpc.DialHTTP("tcp", member.RPCAddress)
+	if err != nil {
+		return fmt.Errorf("Unable to reach cluster member at %s: %s", member.RPCAddress, err.Error())
+	}
+	defer client.Close()
+	dvid.Log(dvid.Debug, "Forwarding command %q to cluster member %s\n", cmd.Command, member.RPCAddress)
+	return client.Call("RPCConnection.Do", cmd, reply)
+}
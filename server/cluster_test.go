@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *ServerSuite) TestPeerRequest(c *C) {
+	defer func(token string) { ClusterToken = token }(ClusterToken)
+	ClusterToken = "shared-secret"
+
+	r := httptest.NewRequest("GET", "/api/node/3f8c/grayscale/info", nil)
+	r.Header.Set("Authorization", "Bearer client-token")
+	r.AddCookie(&http.Cookie{Name: IDTokenCookie, Value: "client-token"})
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	r.Header.Set(clusterUserHeader, "mallory")
+	user := &User{Name: "alice", Groups: []string{"admins", "tracers"}}
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+
+	// Client credentials are replaced by the cluster token and the authenticated user.
+	peer := peerRequest(r)
+	c.Assert(peer.Header.Get("Authorization"), Equals, "")
+	_, err := peer.Cookie(IDTokenCookie)
+	c.Assert(err, NotNil)
+	cookie, err := peer.Cookie("theme")
+	c.Assert(err, IsNil)
+	c.Assert(cookie.Value, Equals, "dark")
+	c.Assert(r.Header.Get("Authorization"), Equals, "Bearer client-token")
+
+	received := httptest.NewRequest("GET", "/api/node/3f8c/grayscale/info", nil)
+	received.Header = peer.Header
+	authenticated, ok := authenticatePeer(received)
+	c.Assert(ok, Equals, true)
+	c.Assert(RequestUser(authenticated), DeepEquals, user)
+	c.Assert(RequestAPIKey(authenticated), IsNil)
+
+	// Requests without the right token aren't trusted.
+	received.Header.Set(clusterTokenHeader, "guess")
+	_, ok = authenticatePeer(received)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ServerSuite) TestCheckMemberAddress(c *C) {
+	c.Assert(checkMemberAddress("emdata3:8000"), IsNil)
+	c.Assert(checkMemberAddress("10.0.0.5:8001"), IsNil)
+	c.Assert(checkMemberAddress(DefaultWebAddress), NotNil)
+	c.Assert(checkMemberAddress(":8000"), NotNil)
+	c.Assert(checkMemberAddress("0.0.0.0:8000"), NotNil)
+	c.Assert(checkMemberAddress("emdata3"), NotNil)
+}
+
+func (s *ServerSuite) TestClusterAmbiguousPrefix(c *C) {
+	defer cluster.setMembers(nil)
+	cluster.setMembers([]*ClusterMember{
+		{WebAddress: "emdata1:8000", UUIDs: []dvid.UUID{"ab1f00", "cd0000"}},
+		{WebAddress: "emdata2:8000", UUIDs: []dvid.UUID{"ab2f00"}},
+	})
+
+	owner, err := cluster.ownerOf("ab1", false)
+	c.Assert(err, IsNil)
+	c.Assert(owner.WebAddress, Equals, "emdata1:8000")
+	owner, err = cluster.ownerOf("ef", false)
+	c.Assert(err, IsNil)
+	c.Assert(owner, IsNil)
+
+	// Prefixes matching nodes on more than one server are errors.
+	_, err = cluster.ownerOf("ab", false)
+	c.Assert(err, NotNil)
+	_, err = cluster.ownerOf("cd", true)
+	c.Assert(err, NotNil)
+}
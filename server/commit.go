@@ -0,0 +1,48 @@
+/*
+	This file handles the work done after a node is locked, i.e., a version is committed.
+	Data that can precompute something for committed versions, e.g., read-optimized views,
+	implement Committer and are given a job for each locked node of their dataset.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Committer is implemented by data that does work on versions once they're locked.
+type Committer interface {
+	Commit(ctx context.Context, uuid dvid.UUID) error
+}
+
+// onCommit starts a job for each Committer in the dataset of a just locked node and
+// regenerates the dataset's thumbnails if Thumbnails is set.
+func onCommit(uuid dvid.UUID) {
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		dvid.Error("Unable to run commit hooks for node %s: %s\n", uuid, err.Error())
+		return
+	}
+	for _, name := range dataset.DataNames() {
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			continue
+		}
+		committer, ok := dataservice.(Committer)
+		if !ok {
+			continue
+		}
+		job := NewJob(fmt.Sprintf("Commit data '%s' at node %s", name, uuid))
+		go func() {
+			err := committer.Commit(serverCtx, uuid)
+			if err != nil {
+				dvid.Error("Unable to commit data '%s' at node %s: %s\n", name, uuid, err.Error())
+			}
+			job.Finish(err)
+		}()
+	}
+	thumbnailsOnCommit(uuid)
+}
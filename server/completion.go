@@ -0,0 +1,193 @@
+/*
+	This file completes partial command lines for the "complete" command, which the dvid
+	shell and bash completion use to offer UUID prefixes, data names, and datatype
+	commands known to this server.
+*/
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// rpcCommands are the commands handled by RPCConnection.Do.
+var rpcCommands = []string{
+	"about", "backup", "benchmark", "dataset", "datasets", "gc", "handlers", "help", "jobs",
+	"keys", "logging", "mirror", "node", "pull", "reload", "shutdown", "thumbnails", "types",
+	"upload",
+}
+
+// datasetCommands are the subcommands of "dataset <UUID>" besides data names.
+var datasetCommands = []string{
+	"accounting", "alias", "aliases", "delete", "delete-template", "init-template", "new",
+	"purge", "restore", "scratch", "template", "templates", "trash", "unalias",
+}
+
+// nodeCommands are the subcommands of "node <UUID>" besides data names.
+var nodeCommands = []string{
+	"branch", "delete-scratch", "lock", "publish", "scratch", "validate", "validation",
+}
+
+// completeCommand returns the candidates for the last of the given words of a command,
+// which may be partial or empty.
+func completeCommand(words []string) []string {
+	if len(words) == 0 {
+		return nil
+	}
+	prefix := words[len(words)-1]
+	prior := words[:len(words)-1]
+	if len(prior) == 0 {
+		return matching(prefix, rpcCommands)
+	}
+	switch prior[0] {
+	case "types", "handlers":
+		switch len(prior) {
+		case 1:
+			return matching(prefix, typeNames())
+		case 2:
+			if prior[0] == "types" {
+				return matching(prefix, []string{"help"})
+			}
+		}
+	case "datasets":
+		if len(prior) == 1 {
+			return matching(prefix, []string{"info", "new"})
+		}
+	case "keys":
+		if len(prior) == 1 {
+			return matching(prefix, []string{"bandwidth", "new", "revoke"})
+		}
+	case "logging":
+		switch len(prior) {
+		case 1:
+			return matching(prefix, []string{dvid.AllModules})
+		case 2:
+			return matching(prefix, []string{"benchmark", "debug", "normal", "reset"})
+		}
+	case "thumbnails", "pull":
+		if len(prior) <= 2 {
+			return completeUUID(prefix)
+		}
+	case "dataset":
+		return completeDataset(prior, prefix)
+	case "node":
+		return completeNode(prior, prefix)
+	}
+	return nil
+}
+
+// completeDataset completes "dataset <UUID> ..." commands.
+func completeDataset(prior []string, prefix string) []string {
+	if len(prior) == 1 {
+		return completeUUID(prefix)
+	}
+	uuid, err := MatchingUUID(prior[1])
+	if err != nil {
+		return nil
+	}
+	switch len(prior) {
+	case 2:
+		return append(matching(prefix, datasetCommands), completeDataName(uuid, prefix)...)
+	case 3:
+		switch prior[2] {
+		case "new":
+			return matching(prefix, typeNames())
+		case "delete":
+			return completeDataName(uuid, prefix)
+		case "delete-template", "init-template":
+			templates, err := runningService.Templates(uuid)
+			if err != nil {
+				return nil
+			}
+			names := make([]string, len(templates))
+			for i, t := range templates {
+				names[i] = t.Name
+			}
+			return matching(prefix, names)
+		case "unalias":
+			aliases, err := runningService.Aliases(uuid)
+			if err != nil {
+				return nil
+			}
+			var names []string
+			for alias := range aliases {
+				names = append(names, string(alias))
+			}
+			sort.Strings(names)
+			return matching(prefix, names)
+		default:
+			if _, err := runningService.DataServiceByUUID(uuid, dvid.DataString(prior[2])); err == nil {
+				return matching(prefix, []string{"help"})
+			}
+		}
+	case 4:
+		if prior[2] == "alias" {
+			return completeDataName(uuid, prefix)
+		}
+	}
+	return nil
+}
+
+// completeNode completes "node <UUID> ..." commands, including datatype commands.
+func completeNode(prior []string, prefix string) []string {
+	if len(prior) == 1 {
+		return completeUUID(prefix)
+	}
+	uuid, err := MatchingUUID(prior[1])
+	if err != nil {
+		return nil
+	}
+	switch len(prior) {
+	case 2:
+		return append(matching(prefix, nodeCommands), completeDataName(uuid, prefix)...)
+	case 3:
+		dataservice, err := runningService.DataServiceByUUID(uuid, dvid.DataString(prior[2]))
+		if err != nil {
+			return nil
+		}
+		return matching(prefix, datastore.DatatypeCommands(dataservice))
+	}
+	return nil
+}
+
+// completeUUID returns the UUIDs of versions starting with the prefix.
+func completeUUID(prefix string) []string {
+	if runningService.Service == nil {
+		return nil
+	}
+	return runningService.CompleteUUID(prefix)
+}
+
+// completeDataName returns the data names and aliases starting with the prefix.
+func completeDataName(uuid dvid.UUID, prefix string) []string {
+	names, err := runningService.CompleteDataName(uuid, prefix)
+	if err != nil {
+		return nil
+	}
+	return names
+}
+
+// typeNames returns the names of datatypes compiled into this server, sorted.
+func typeNames() []string {
+	var names []string
+	for _, t := range datastore.CompiledTypes {
+		names = append(names, string(t.DatatypeName()))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matching returns the candidates starting with the prefix.
+func matching(prefix string, candidates []string) []string {
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
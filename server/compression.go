@@ -0,0 +1,155 @@
+/*
+	This file decompresses request bodies sent with "Content-Encoding: gzip", so clients on
+	slow links can send compressible data, e.g., label subvolumes, key-value pairs, or
+	annotation imports, far faster.  Bodies are decompressed as handlers read them, so
+	large bodies are never held compressed and decompressed at once.
+
+	Parts of a multi-part upload are stored as sent.  The Content-Encoding of the POST that
+	completes the upload applies to the assembled parts.  Other encodings, e.g., zstd, are
+	refused with a 415 status.  Bodies decompressing to more than MaxRequestBody bytes
+	fail to read and get a 413 status, as do bodies read whole by handlers with ReadBody.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxRequestBody is the most bytes a compressed request body may decompress to, which
+// keeps small bodies of highly compressible data from exhausting memory or disk, and the
+// most bytes read by ReadBody.  It is set with the -maxbody flag.
+var MaxRequestBody int64 = 4 * dvid.Giga
+
+// ErrBodyTooLarge is returned by ReadBody for bodies of more than MaxRequestBody bytes.
+// Handlers reply to it with TooLarge.
+var ErrBodyTooLarge = errors.New("Request body exceeds this DVID server's limit")
+
+// ReadBody reads a whole request body, returning ErrBodyTooLarge instead of reading more
+// than MaxRequestBody bytes.
+func ReadBody(r *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxRequestBody+1))
+	if gz, ok := r.Body.(*gzipBody); ok && gz.tooLarge {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxRequestBody {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
+
+// gzipBody decompresses a gzip request body, closing the original body when closed.
+type gzipBody struct {
+	*gzip.Reader
+	body      io.ReadCloser
+	remaining int64
+	tooLarge  bool
+}
+
+// Read returns an error once the body decompresses to more than MaxRequestBody bytes.
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.Reader.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.tooLarge = true
+		return n, fmt.Errorf("Request body decompresses to more than %d bytes", MaxRequestBody)
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// supportedEncoding returns true if request bodies with a Content-Encoding can be read.
+func supportedEncoding(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity", "gzip", "x-gzip":
+		return true
+	}
+	return false
+}
+
+// decompressBody returns a reader of a body decompressed according to a Content-Encoding.
+func decompressBody(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("Bad gzip request body: %s", err.Error())
+		}
+		return &gzipBody{Reader: zr, body: body, remaining: MaxRequestBody}, nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Encoding %q: use gzip", encoding)
+}
+
+// decodedWriter replies with a 413 in place of the error status of a handler that failed
+// because its request body decompressed to more than MaxRequestBody bytes.
+type decodedWriter struct {
+	http.ResponseWriter
+	body *gzipBody
+}
+
+func (w *decodedWriter) WriteHeader(status int) {
+	if status >= 400 && w.body.tooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends buffered data to the client if the underlying writer can.
+func (w *decodedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// decodeRequestBody replaces the body of a request sent with a Content-Encoding with one
+// that decompresses it, replying with a 400 for a malformed body or a 415 for an
+// unsupported encoding and returning false.  It returns the writer for the reply, which
+// replies with a 413 if the handler fails on a body that decompresses too large.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, parts []string) (http.ResponseWriter, bool) {
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding == "" || r.Body == nil || !isWriteMethod(r.Method) || parts[0] == "uploads" ||
+		r.URL.Query().Get("upload") != "" {
+		return w, true
+	}
+	if !supportedEncoding(encoding) {
+		errorMsg := fmt.Sprintf("ERROR using REST API: Unsupported Content-Encoding %q: use gzip (%s).\n",
+			encoding, r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusUnsupportedMediaType)
+		return w, false
+	}
+	body, err := decompressBody(r.Body, encoding)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return w, false
+	}
+	r.Body = body
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	if gz, ok := body.(*gzipBody); ok {
+		return &decodedWriter{w, gz}, true
+	}
+	return w, true
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func gzipped(c *C, size int) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(make([]byte, size))
+	c.Assert(err, IsNil)
+	c.Assert(zw.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *ServerSuite) TestDecompressedBodyLimit(c *C) {
+	defer func(max int64) { MaxRequestBody = max }(MaxRequestBody)
+	MaxRequestBody = 1000
+
+	body, err := decompressBody(ioutil.NopCloser(bytes.NewReader(gzipped(c, 1000))), "gzip")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(body)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 1000)
+
+	// A handler failing on a body that decompresses too large replies with a 413.
+	r := httptest.NewRequest("POST", "/api/node/abc/data/key/a", bytes.NewReader(gzipped(c, 1001)))
+	r.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	w, ok := decodeRequestBody(recorder, r, []string{"node"})
+	c.Assert(ok, Equals, true)
+	_, err = ioutil.ReadAll(r.Body)
+	c.Assert(err, NotNil)
+	BadRequest(w, r, err.Error())
+	c.Assert(recorder.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	// Bodies read whole are limited whether or not they're compressed.
+	r = httptest.NewRequest("POST", "/api/node/abc/data/key/a", bytes.NewReader(make([]byte, 1001)))
+	_, err = ReadBody(r)
+	c.Assert(err, Equals, ErrBodyTooLarge)
+	r = httptest.NewRequest("POST", "/api/node/abc/data/key/a", bytes.NewReader(gzipped(c, 1001)))
+	r.Header.Set("Content-Encoding", "gzip")
+	_, ok = decodeRequestBody(httptest.NewRecorder(), r, []string{"node"})
+	c.Assert(ok, Equals, true)
+	_, err = ReadBody(r)
+	c.Assert(err, Equals, ErrBodyTooLarge)
+	r = httptest.NewRequest("POST", "/api/node/abc/data/key/a", bytes.NewReader(make([]byte, 1000)))
+	data, err = ReadBody(r)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 1000)
+}
@@ -0,0 +1,161 @@
+/*
+	This file implements read-your-writes consistency for clients that need a read to observe
+	writes the server already acknowledged but may still be storing, e.g., POSTs with
+	"async=true" or tiles regenerated after their source changes.  Adding "consistency=strong"
+	to the query string of a read makes it wait for those pending writes that overlap what it
+	reads.  Writes and reads can be grouped by a client session with "session=<session ID>",
+	in which case a strong read only waits for pending writes of its session.
+
+	GET /api/node/<UUID>/<data name>/...?consistency=strong&session=<session ID>
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Consistency levels of reads.
+const (
+	// EventualConsistency reads whatever is stored, which is the default.
+	EventualConsistency = "eventual"
+
+	// StrongConsistency reads observe all writes acknowledged before the read.
+	StrongConsistency = "strong"
+)
+
+type consistencyKey struct{}
+
+// readConsistency is attached to the context of strongly consistent reads.
+type readConsistency struct {
+	session string
+}
+
+// pendingWrite is an acknowledged write that hasn't been stored yet.
+type pendingWrite struct {
+	session string
+	uuid    dvid.UUID
+	dataset dvid.DatasetLocalID
+	data    dvid.DataLocalID
+
+	// Bounds of the write, which covers all the data if nil.
+	minPt, maxPt dvid.Point
+
+	done chan struct{}
+}
+
+var pendingWrites struct {
+	sync.Mutex
+	writes map[*pendingWrite]struct{}
+}
+
+// RequestSession returns the client session of a request given by its "session" query string.
+func RequestSession(r *http.Request) string {
+	return r.URL.Query().Get("session")
+}
+
+// UseConsistency returns the request with the consistency given by its "consistency"
+// query string attached to its context, so data reads can call AwaitWrites.
+func UseConsistency(r *http.Request) (*http.Request, error) {
+	switch level := r.URL.Query().Get("consistency"); level {
+	case "", EventualConsistency:
+		return r, nil
+	case StrongConsistency:
+		ctx := context.WithValue(r.Context(), consistencyKey{}, readConsistency{RequestSession(r)})
+		return r.WithContext(ctx), nil
+	default:
+		return nil, fmt.Errorf("Unknown consistency %q: must be %q or %q", level,
+			EventualConsistency, StrongConsistency)
+	}
+}
+
+// IsStrongRead returns true if a read with the given context requires strong consistency.
+func IsStrongRead(ctx context.Context) bool {
+	_, strong := ctx.Value(consistencyKey{}).(readConsistency)
+	return strong
+}
+
+// TrackWrite registers an acknowledged write of data at a version within the given bounds,
+// or all the data if the bounds are nil, that's still being stored.  The returned function
+// must be called once the write is stored or has failed.
+func TrackWrite(session string, uuid dvid.UUID, dataID datastore.DataID, minPt, maxPt dvid.Point) (done func()) {
+	write := &pendingWrite{
+		session: session,
+		uuid:    uuid,
+		dataset: dataID.DsetID,
+		data:    dataID.ID,
+		minPt:   minPt,
+		maxPt:   maxPt,
+		done:    make(chan struct{}),
+	}
+	pendingWrites.Lock()
+	if pendingWrites.writes == nil {
+		pendingWrites.writes = make(map[*pendingWrite]struct{})
+	}
+	pendingWrites.writes[write] = struct{}{}
+	pendingWrites.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pendingWrites.Lock()
+			delete(pendingWrites.writes, write)
+			pendingWrites.Unlock()
+			close(write.done)
+		})
+	}
+}
+
+// AwaitWrites waits, if the context requires strong consistency, for the pending writes
+// of data at a version that overlap the given bounds, or all the data if the bounds are
+// nil.  If the read has a session, only writes of the session are waited for.
+func AwaitWrites(ctx context.Context, uuid dvid.UUID, dataID datastore.DataID, minPt, maxPt dvid.Point) error {
+	consistency, strong := ctx.Value(consistencyKey{}).(readConsistency)
+	if !strong {
+		return nil
+	}
+	var waitFor []*pendingWrite
+	pendingWrites.Lock()
+	for write := range pendingWrites.writes {
+		if write.uuid != uuid || write.dataset != dataID.DsetID || write.data != dataID.ID {
+			continue
+		}
+		if consistency.session != "" && write.session != consistency.session {
+			continue
+		}
+		if overlaps(write.minPt, write.maxPt, minPt, maxPt) {
+			waitFor = append(waitFor, write)
+		}
+	}
+	pendingWrites.Unlock()
+	for _, write := range waitFor {
+		select {
+		case <-write.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// overlaps returns true if two bounds intersect, where nil bounds cover everything.
+func overlaps(minPt1, maxPt1, minPt2, maxPt2 dvid.Point) bool {
+	if minPt1 == nil || maxPt1 == nil || minPt2 == nil || maxPt2 == nil {
+		return true
+	}
+	if minPt1.NumDims() != minPt2.NumDims() {
+		return true
+	}
+	for dim := uint8(0); dim < minPt1.NumDims(); dim++ {
+		if maxPt1.Value(dim) < minPt2.Value(dim) || maxPt2.Value(dim) < minPt1.Value(dim) {
+			return false
+		}
+	}
+	return true
+}
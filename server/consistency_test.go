@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *ServerSuite) TestStrongConsistency(c *C) {
+	_, err := UseConsistency(httptest.NewRequest("GET", "/?consistency=sometimes", nil))
+	c.Assert(err, ErrorMatches, "Unknown consistency.*")
+	r, err := UseConsistency(httptest.NewRequest("GET", "/", nil))
+	c.Assert(err, IsNil)
+	c.Assert(IsStrongRead(r.Context()), Equals, false)
+
+	// Strong reads wait only for overlapping pending writes of their session.
+	dataID := datastore.DataID{Name: "consistent", ID: 1, DsetID: 1}
+	done := TrackWrite("ingest", "abc", dataID, dvid.Point3d{0, 0, 0}, dvid.Point3d{31, 31, 31})
+	read := func(session string, offset dvid.Point3d) chan error {
+		r, err := UseConsistency(httptest.NewRequest("GET", "/?consistency=strong&session="+session, nil))
+		c.Assert(err, IsNil)
+		c.Assert(IsStrongRead(r.Context()), Equals, true)
+		maxPt := dvid.Point3d{offset[0] + 7, offset[1] + 7, offset[2] + 7}
+		result := make(chan error, 1)
+		go func() { result <- AwaitWrites(r.Context(), "abc", dataID, offset, maxPt) }()
+		return result
+	}
+	c.Assert(<-read("other", dvid.Point3d{0, 0, 0}), IsNil)
+	c.Assert(<-read("ingest", dvid.Point3d{40, 40, 40}), IsNil)
+	blocked := read("ingest", dvid.Point3d{16, 16, 16})
+	select {
+	case <-blocked:
+		c.Fatalf("Strong read didn't wait for a pending write")
+	case <-time.After(20 * time.Millisecond):
+	}
+	done()
+	c.Assert(<-blocked, IsNil)
+
+	// Eventual reads never wait.
+	done = TrackWrite("", "abc", dataID, nil, nil)
+	defer done()
+	c.Assert(AwaitWrites(context.Background(), "abc", dataID, dvid.Point3d{0, 0, 0}, dvid.Point3d{7, 7, 7}), IsNil)
+}
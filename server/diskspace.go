@@ -0,0 +1,254 @@
+/*
+	This file monitors free space on the volumes holding the datastore and uploads.  When
+	free space drops below DiskWarnBytes, /api/server/info shows a warning, and below
+	DiskRefuseBytes the server refuses requests and commands that add data while still
+	serving reads and deletions, so a full disk doesn't crash the server mid-load.  The
+	smallest free space and the number of refused writes are also reported by /api/load.
+	Free space is read by the platform-specific diskUsage.
+
+	GET /api/server/disk   Returns the space of each volume, whether writes are refused,
+	                       and how many have been refused since the server started.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// DiskWarnBytes is the free space below which a volume is reported as low.  Zero
+	// turns off the warning.
+	DiskWarnBytes uint64
+
+	// DiskRefuseBytes is the free space below which writes are refused.  Zero turns
+	// off refusals.
+	DiskRefuseBytes uint64
+
+	// DiskCheckInterval is how often free space is checked.
+	DiskCheckInterval = 30 * time.Second
+)
+
+// Status of a volume's free space.
+const (
+	DiskOK       = "ok"
+	DiskLow      = "low"
+	DiskCritical = "refusing writes"
+)
+
+// DiskVolume describes the space of a volume holding server files.
+type DiskVolume struct {
+	Path       string
+	TotalBytes uint64
+	FreeBytes  uint64
+	Status     string
+	Error      string `json:",omitempty"`
+}
+
+var diskSpace struct {
+	sync.RWMutex
+	volumes  []DiskVolume
+	checked  time.Time
+	refusing bool
+}
+
+// diskRefusals is the number of requests and commands refused for lack of disk space.
+var diskRefusals int64
+
+// diskPaths returns the paths whose volumes are monitored.
+func diskPaths() []string {
+	var paths []string
+	if runningService.DatastorePath != "" {
+		paths = append(paths, runningService.DatastorePath)
+	}
+	if UploadDir != "" {
+		paths = append(paths, UploadDir)
+	}
+	return paths
+}
+
+// checkDiskSpace updates the space of monitored volumes, logging changes in status.
+func checkDiskSpace() {
+	var volumes []DiskVolume
+	var refusing bool
+	for _, path := range diskPaths() {
+		volume := DiskVolume{Path: path, Status: DiskOK}
+		total, free, err := diskUsage(path)
+		if err != nil {
+			volume.Error = err.Error()
+		} else {
+			volume.TotalBytes, volume.FreeBytes = total, free
+			switch {
+			case DiskRefuseBytes > 0 && free < DiskRefuseBytes:
+				volume.Status = DiskCritical
+				refusing = true
+			case DiskWarnBytes > 0 && free < DiskWarnBytes:
+				volume.Status = DiskLow
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+
+	diskSpace.Lock()
+	previous := diskSpace.volumes
+	diskSpace.volumes, diskSpace.checked, diskSpace.refusing = volumes, time.Now(), refusing
+	diskSpace.Unlock()
+
+	for i, volume := range volumes {
+		if i < len(previous) && previous[i].Path == volume.Path && previous[i].Status == volume.Status {
+			continue
+		}
+		switch volume.Status {
+		case DiskCritical:
+			dvid.Error("Only %s free on volume of %s: refusing writes until space is freed\n",
+				diskBytes(volume.FreeBytes), volume.Path)
+		case DiskLow:
+			dvid.Error("Only %s free on volume of %s\n", diskBytes(volume.FreeBytes), volume.Path)
+		default:
+			if volume.Error != "" {
+				dvid.Error("Unable to check free space of %s: %s\n", volume.Path, volume.Error)
+			} else if i < len(previous) {
+				dvid.Log(dvid.Normal, "%s free on volume of %s\n", diskBytes(volume.FreeBytes), volume.Path)
+			}
+		}
+	}
+}
+
+// runDiskMonitor checks free space every DiskCheckInterval until the server shuts down.
+func runDiskMonitor() {
+	ticker := time.NewTicker(DiskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		checkDiskSpace()
+	}
+}
+
+// DiskVolumes returns the space of monitored volumes as of the last check.
+func DiskVolumes() []DiskVolume {
+	diskSpace.RLock()
+	defer diskSpace.RUnlock()
+	volumes := make([]DiskVolume, len(diskSpace.volumes))
+	copy(volumes, diskSpace.volumes)
+	return volumes
+}
+
+// DiskSpaceError returns an error if writes are refused because a volume is nearly full.
+func DiskSpaceError() error {
+	diskSpace.RLock()
+	defer diskSpace.RUnlock()
+	if !diskSpace.refusing {
+		return nil
+	}
+	for _, volume := range diskSpace.volumes {
+		if volume.Status == DiskCritical {
+			atomic.AddInt64(&diskRefusals, 1)
+			return fmt.Errorf("Refusing writes: only %s free on volume of %s (minimum %s)",
+				diskBytes(volume.FreeBytes), volume.Path, diskBytes(DiskRefuseBytes))
+		}
+	}
+	return nil
+}
+
+// diskWarning returns a description of volumes low on space, or an empty string.
+func diskWarning() string {
+	var warnings []string
+	for _, volume := range DiskVolumes() {
+		if volume.Status != DiskOK {
+			warnings = append(warnings, fmt.Sprintf("%s free on volume of %s (%s)",
+				diskBytes(volume.FreeBytes), volume.Path, volume.Status))
+		}
+	}
+	return strings.Join(warnings, "; ")
+}
+
+// diskLoad returns the smallest free space of monitored volumes, which is zero if none
+// could be checked, and the number of writes refused for lack of space.
+func diskLoad() (free uint64, refusals int64) {
+	checked := false
+	for _, volume := range DiskVolumes() {
+		if volume.Error == "" && (!checked || volume.FreeBytes < free) {
+			free, checked = volume.FreeBytes, true
+		}
+	}
+	return free, atomic.LoadInt64(&diskRefusals)
+}
+
+func diskBytes(bytes uint64) string {
+	return fmt.Sprintf("%.1f GB", float64(bytes)/float64(dvid.Giga))
+}
+
+// refuseDiskWrite rejects a HTTP request that would add data while writes are refused,
+// returning true if it was rejected.  Deletions and server settings are allowed.
+func refuseDiskWrite(w http.ResponseWriter, r *http.Request, parts []string) bool {
+	switch r.Method {
+	case "POST", "PUT", "PATCH":
+	default:
+		return false
+	}
+	if isReadOnlyPost(r) {
+		return false
+	}
+	if parts[0] == "server" || parts[0] == "cluster" || parts[0] == "login" {
+		return false
+	}
+	err := DiskSpaceError()
+	if err == nil {
+		return false
+	}
+	dvid.Log(dvid.Normal, "Rejected %s %s: %s\n", r.Method, r.URL.Path, err.Error())
+	http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	return true
+}
+
+// isDiskWriteCommand returns true if a RPC command adds data.
+func isDiskWriteCommand(cmd datastore.Request) bool {
+	if !isWriteCommand(cmd) {
+		return false
+	}
+	if cmd.Name() == "dataset" {
+		var uuidStr, action string
+		cmd.CommandArgs(1, &uuidStr, &action)
+		return action != "delete" && action != "purge"
+	}
+	return true
+}
+
+// diskRequest handles GET /api/server/disk.
+func diskRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Disk space can only be retrieved with HTTP GET method")
+		return
+	}
+	diskSpace.RLock()
+	status := struct {
+		Volumes        []DiskVolume
+		Checked        time.Time
+		RefusingWrites bool
+		RefusedWrites  int64
+		WarnBytes      uint64
+		RefuseBytes    uint64
+	}{diskSpace.volumes, diskSpace.checked, diskSpace.refusing, atomic.LoadInt64(&diskRefusals),
+		DiskWarnBytes, DiskRefuseBytes}
+	m, err := json.Marshal(status)
+	diskSpace.RUnlock()
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,11 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package server
+
+import "fmt"
+
+// diskUsage returns an error since free space can't be checked on this platform.
+func diskUsage(path string) (total, free uint64, err error) {
+	err = fmt.Errorf("Free space can't be checked on this platform")
+	return
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestDiskSpace(c *C) {
+	UploadDir = c.MkDir()
+	defer func(refuse uint64) {
+		UploadDir = ""
+		DiskRefuseBytes = refuse
+		checkDiskSpace()
+	}(DiskRefuseBytes)
+
+	DiskRefuseBytes = 0
+	checkDiskSpace()
+	volumes := DiskVolumes()
+	c.Assert(volumes, HasLen, 1)
+	c.Assert(volumes[0].Error, Equals, "")
+	c.Assert(volumes[0].Status, Equals, DiskOK)
+	c.Assert(volumes[0].TotalBytes >= volumes[0].FreeBytes, Equals, true)
+	c.Assert(DiskSpaceError(), IsNil)
+	free, refusals := diskLoad()
+	c.Assert(free, Equals, volumes[0].FreeBytes)
+
+	// Below the minimum, writes are refused and counted while reads are served.
+	DiskRefuseBytes = math.MaxUint64
+	checkDiskSpace()
+	c.Assert(DiskVolumes()[0].Status, Equals, DiskCritical)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", WebAPIPath+"node/abc/data/raw", nil)
+	c.Assert(refuseDiskWrite(w, r, []string{"node", "abc", "data", "raw"}), Equals, true)
+	c.Assert(w.Code, Equals, http.StatusInsufficientStorage)
+	r = httptest.NewRequest("GET", WebAPIPath+"node/abc/data/raw", nil)
+	c.Assert(refuseDiskWrite(httptest.NewRecorder(), r, []string{"node", "abc", "data", "raw"}), Equals, false)
+	_, after := diskLoad()
+	c.Assert(after, Equals, refusals+1)
+}
@@ -0,0 +1,16 @@
+// +build darwin dragonfly freebsd linux
+
+package server
+
+import "syscall"
+
+// diskUsage returns the total and available bytes of the volume holding a path.
+func diskUsage(path string) (total, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return
+	}
+	total = uint64(stat.Blocks) * uint64(stat.Bsize)
+	free = uint64(stat.Bavail) * uint64(stat.Bsize)
+	return
+}
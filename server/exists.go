@@ -0,0 +1,62 @@
+/*
+	This file supports bulk existence checks, which let ingest clients resume interrupted
+	loads by asking which of many blocks or keys were already written at a version instead
+	of writing everything again.  Replies are bitmasks: bit i, counting from the least
+	significant bit of the first byte, is set if the i-th requested key exists.
+
+	Existence checks are POSTed since their lists can be long, but they only read.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxExistsKeys is the maximum number of keys in one existence check.
+const MaxExistsKeys = 1000000
+
+// KeysExist returns whether data has a key/value written at the version for each index.
+// Keys of ancestor versions don't count.
+func KeysExist(uuid dvid.UUID, data datastore.DataID, indices []dvid.Index) ([]bool, error) {
+	if len(indices) > MaxExistsKeys {
+		return nil, fmt.Errorf("Existence checks are limited to %d keys, not %d", MaxExistsKeys, len(indices))
+	}
+	versionID, err := VersionLocalID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OrderedKeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(indices))
+	for i, index := range indices {
+		value, err := db.Get(&datastore.DataKey{data.DsetID, data.ID, versionID, index})
+		if err != nil {
+			return nil, fmt.Errorf("Error checking key %s of data %s: %s", index, data.Name, err.Error())
+		}
+		found[i] = value != nil
+	}
+	return found, nil
+}
+
+// WriteExists replies to an existence check with the bitmask of keys found.
+func WriteExists(w http.ResponseWriter, found []bool) {
+	bitmask := make([]byte, (len(found)+7)/8)
+	var count int
+	for i, exists := range found {
+		if exists {
+			bitmask[i/8] |= 1 << uint(i%8)
+			count++
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Dvid-Keys", fmt.Sprintf("%d", len(found)))
+	w.Header().Set("X-Dvid-Found", fmt.Sprintf("%d", count))
+	w.Write(bitmask)
+}
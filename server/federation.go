@@ -0,0 +1,175 @@
+/*
+	This file implements federation of DVID servers.  A federation table maps dataset UUID
+	prefixes to the base URLs of remote DVID servers, and requests for nodes that aren't
+	held locally are proxied or redirected to the matching server.  This lets an
+	institution present many DVID servers behind one API endpoint.  Proxied requests
+	don't carry the client's ID token or API key, which are only valid for this server.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// FederationEntry maps nodes whose UUIDs start with a prefix to a remote DVID server.
+type FederationEntry struct {
+	// Prefix of the UUIDs held by the remote server.
+	Prefix string
+
+	// URL is the base URL of the remote server, e.g., "http://emdata2:8000".
+	URL string
+
+	// Redirect sends clients a 307 redirect to the remote server instead of proxying.
+	Redirect bool
+}
+
+type federationEntry struct {
+	FederationEntry
+	base  *url.URL
+	proxy *httputil.ReverseProxy
+}
+
+var federation struct {
+	sync.RWMutex
+	entries []federationEntry
+}
+
+// SetFederation replaces the federation table.
+func SetFederation(entries []FederationEntry) error {
+	table := make([]federationEntry, len(entries))
+	for i, entry := range entries {
+		if entry.Prefix == "" {
+			return fmt.Errorf("Federation entry for %q must have a UUID prefix", entry.URL)
+		}
+		base, err := url.Parse(entry.URL)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			return fmt.Errorf("Federation entry for prefix %q has bad URL %q", entry.Prefix, entry.URL)
+		}
+		table[i] = federationEntry{entry, base, httputil.NewSingleHostReverseProxy(base)}
+	}
+	federation.Lock()
+	federation.entries = table
+	federation.Unlock()
+	return nil
+}
+
+// Federation returns the federation table.
+func Federation() []FederationEntry {
+	federation.RLock()
+	defer federation.RUnlock()
+	entries := make([]FederationEntry, len(federation.entries))
+	for i, entry := range federation.entries {
+		entries[i] = entry.FederationEntry
+	}
+	return entries
+}
+
+// LoadFederation sets the federation table from a JSON file holding a list of entries.
+func LoadFederation(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var entries []FederationEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("Bad federation table in %s: %s", filename, err.Error())
+	}
+	return SetFederation(entries)
+}
+
+// federatedEntry returns the entry with the longest prefix matching a UUID string.
+// The UUID string may itself be a prefix, so it matches entries in either direction,
+// and it's an error if it's a prefix of entries for different servers since the node
+// could be on any of them.
+func federatedEntry(uuidStr string) (entry federationEntry, found bool, err error) {
+	federation.RLock()
+	defer federation.RUnlock()
+	var shorter string
+	for _, e := range federation.entries {
+		if strings.HasPrefix(e.Prefix, uuidStr) && len(uuidStr) < len(e.Prefix) {
+			if shorter != "" && shorter != e.URL {
+				return entry, false, fmt.Errorf("UUID %q is ambiguous: it matches nodes on federated servers %s and %s",
+					uuidStr, shorter, e.URL)
+			}
+			shorter = e.URL
+		}
+		if strings.HasPrefix(uuidStr, e.Prefix) || strings.HasPrefix(e.Prefix, uuidStr) {
+			if !found || len(e.Prefix) > len(entry.Prefix) {
+				entry, found = e, true
+			}
+		}
+	}
+	return entry, found, nil
+}
+
+// federate sends a HTTP request for a UUID not held by this server to the federated
+// server holding it, or replies with an error if the UUID is ambiguous.  It returns
+// false if the request should be handled locally.
+func federate(w http.ResponseWriter, r *http.Request, uuidStr string) bool {
+	if uuidStr == "" {
+		return false
+	}
+	entry, found, err := federatedEntry(uuidStr)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return true
+	}
+	if !found {
+		return false
+	}
+	if uuid, err := MatchingUUID(uuidStr); err == nil {
+		if string(uuid) != uuidStr {
+			BadRequest(w, r, fmt.Sprintf("UUID %q is ambiguous: it matches a local node and nodes on federated server %s",
+				uuidStr, entry.URL))
+			return true
+		}
+		return false
+	}
+	if entry.Redirect {
+		target := *entry.base
+		target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+		target.RawQuery = r.URL.RawQuery
+		dvid.Log(dvid.Debug, "Redirecting %s %s to %s\n", r.Method, r.URL.Path, target.String())
+		http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+		return true
+	}
+	dvid.Log(dvid.Debug, "Proxying %s %s to federated server %s\n", r.Method, r.URL.Path, entry.URL)
+	entry.proxy.ServeHTTP(w, withoutCredentials(r))
+	return true
+}
+
+// federationRequest handles GET and POST of the federation table.  Only admins may POST
+// since the table determines where requests are proxied.
+func federationRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) == "post" {
+		if !adminRequest(w, r) {
+			return
+		}
+		var entries []FederationEntry
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+			return
+		}
+		if err := SetFederation(entries); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+	}
+	m, err := json.Marshal(Federation())
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestFederationRequiresAdmin(c *C) {
+	defer SetFederation(nil)
+	oidc.Lock()
+	oidc.config = &OIDCConfig{Issuer: "https://issuer", ClientID: "dvid", AdminGroups: []string{"admins"}}
+	oidc.Unlock()
+	defer func() {
+		oidc.Lock()
+		oidc.config = nil
+		oidc.Unlock()
+	}()
+
+	post := func(user *User) int {
+		body := `[{"Prefix": "abc", "URL": "http://evil.example.com"}]`
+		r := httptest.NewRequest("POST", WebAPIPath+"server/federation", strings.NewReader(body))
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		w := httptest.NewRecorder()
+		federationRequest(w, r)
+		return w.Code
+	}
+	c.Assert(post(nil), Equals, http.StatusForbidden)
+	c.Assert(post(&User{Name: "joe", Groups: []string{"users"}}), Equals, http.StatusForbidden)
+	c.Assert(Federation(), HasLen, 0)
+
+	c.Assert(post(&User{Name: "ann", Groups: []string{"admins"}}), Equals, http.StatusOK)
+	c.Assert(Federation(), HasLen, 1)
+}
+
+func (s *ServerSuite) TestFederatedAmbiguousPrefix(c *C) {
+	defer SetFederation(nil)
+	c.Assert(SetFederation([]FederationEntry{
+		{Prefix: "ab1", URL: "http://emdata1:8000"},
+		{Prefix: "ab2", URL: "http://emdata2:8000"},
+		{Prefix: "ab21", URL: "http://emdata2:8000"},
+	}), IsNil)
+
+	entry, found, err := federatedEntry("ab1f")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(entry.URL, Equals, "http://emdata1:8000")
+	entry, found, err = federatedEntry("ab2")
+	c.Assert(err, IsNil)
+	c.Assert(entry.URL, Equals, "http://emdata2:8000")
+
+	// A prefix of entries for different servers could be a node on either.
+	_, _, err = federatedEntry("ab")
+	c.Assert(err, NotNil)
+	w := httptest.NewRecorder()
+	c.Assert(federate(w, httptest.NewRequest("GET", WebAPIPath+"node/ab/info", nil), "ab"), Equals, true)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,143 @@
+/*
+	This file implements the pools of chunk handlers (goroutines) used by each datatype.
+	Each datatype gets its own pool so operators can tune label-heavy and grayscale-heavy
+	servers differently, and pool sizes can be changed while the server runs.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// HandlerPool limits the number of concurrent chunk handlers for a datatype.
+// Acquire a handler before spawning a goroutine that processes chunks and release it
+// when the goroutine finishes.  See ProcessChunk() in datatype/voxels for example.
+type HandlerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int
+	active int
+	queued int
+}
+
+func newHandlerPool(size int) *HandlerPool {
+	p := &HandlerPool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Acquire blocks until a handler is available in the pool.
+func (p *HandlerPool) Acquire() {
+	p.mu.Lock()
+	p.queued++
+	for p.active >= p.size {
+		p.cond.Wait()
+	}
+	p.queued--
+	p.active++
+	p.mu.Unlock()
+}
+
+// Release returns a handler to the pool.
+func (p *HandlerPool) Release() {
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// SetSize changes the number of handlers in the pool.  Handlers already acquired
+// beyond a smaller size finish normally.
+func (p *HandlerPool) SetSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("Handler pool size must be at least 1, not %d", size)
+	}
+	p.mu.Lock()
+	p.size = size
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	return nil
+}
+
+// HandlerPoolStats describes the size and load of a handler pool.
+type HandlerPoolStats struct {
+	Size   int // Maximum number of concurrent handlers.
+	Active int // Handlers currently processing chunks.
+	Queued int // Requests waiting for a handler.
+}
+
+// Stats returns the current size and load of the pool.
+func (p *HandlerPool) Stats() HandlerPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return HandlerPoolStats{Size: p.size, Active: p.active, Queued: p.queued}
+}
+
+var (
+	handlerPoolsMu sync.Mutex
+	handlerPools   = make(map[dvid.TypeString]*HandlerPool)
+)
+
+// HandlerPoolFor returns the chunk handler pool for a datatype, creating a pool of
+// MaxChunkHandlers handlers if the datatype doesn't have one yet.
+func HandlerPoolFor(typename dvid.TypeString) *HandlerPool {
+	handlerPoolsMu.Lock()
+	defer handlerPoolsMu.Unlock()
+	p, found := handlerPools[typename]
+	if !found {
+		p = newHandlerPool(MaxChunkHandlers)
+		handlerPools[typename] = p
+	}
+	return p
+}
+
+// SetHandlerPoolSize sets the number of chunk handlers for a compiled datatype.
+func SetHandlerPoolSize(typename dvid.TypeString, size int) error {
+	if _, err := datastore.TypeServiceByName(typename); err != nil {
+		return err
+	}
+	return HandlerPoolFor(typename).SetSize(size)
+}
+
+// AllHandlerPoolStats returns the size and load of each datatype's handler pool.
+func AllHandlerPoolStats() map[dvid.TypeString]HandlerPoolStats {
+	handlerPoolsMu.Lock()
+	defer handlerPoolsMu.Unlock()
+	stats := make(map[dvid.TypeString]HandlerPoolStats, len(handlerPools))
+	for typename, p := range handlerPools {
+		stats[typename] = p.Stats()
+	}
+	return stats
+}
+
+// totalHandlerStats sums the stats over all handler pools.
+func totalHandlerStats() (total HandlerPoolStats) {
+	for _, stats := range AllHandlerPoolStats() {
+		total.Size += stats.Size
+		total.Active += stats.Active
+		total.Queued += stats.Queued
+	}
+	return
+}
+
+// handlerPoolsText returns a table of handler pools for the "handlers" command.
+func handlerPoolsText() string {
+	stats := AllHandlerPoolStats()
+	names := make([]string, 0, len(stats))
+	for typename := range stats {
+		names = append(names, string(typename))
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("%-20s %8s %8s %8s\n", "Datatype", "Size", "Active", "Queued")
+	for _, name := range names {
+		s := stats[dvid.TypeString(name)]
+		text += fmt.Sprintf("%-20s %8d %8d %8d\n", name, s.Size, s.Active, s.Queued)
+	}
+	return text
+}
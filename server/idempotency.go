@@ -0,0 +1,332 @@
+/*
+	This file implements client-generated idempotency keys for requests that modify data.
+	A client that retries a POST or PUT with the same "Idempotency-Key" header, or a RPC
+	command with the same idempotency key, gets the original result instead of repeating
+	the write, e.g., a duplicate append or load after a dropped connection.
+
+	Keys are scoped to the user and data instance, and a key can only be reused for the
+	same request and body.  Completed results are saved in the datastore so retries after
+	a restart are also answered, and are deleted after IdempotencyKeyAge.  Failed requests
+	and accepted requests whose work continues asynchronously aren't recorded, so they
+	can be retried, and a retry of a request still in progress waits for its result.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// IdempotencyKeyHeader is the HTTP header holding a client-generated idempotency key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var (
+	// IdempotencyKeyAge is how long the result of a request with an idempotency key is kept.
+	IdempotencyKeyAge = 24 * time.Hour
+
+	// IdempotencySweepInterval is how often results older than IdempotencyKeyAge are deleted.
+	IdempotencySweepInterval = 10 * time.Minute
+)
+
+// idempotentResult is the result of a request with an idempotency key.  The exported
+// fields are saved in the datastore once the request completes.
+type idempotentResult struct {
+	Request     string    // method and URL or command, to detect reused keys
+	Fingerprint string    // hash of the request body or command input, if known
+	Completed   time.Time // zero until the request succeeds
+
+	Status int
+	Header http.Header
+	Body   []byte
+	Reply  *datastore.Response
+
+	done chan struct{} // closed when the request completes
+}
+
+var idempotency struct {
+	sync.Mutex
+	results map[string]*idempotentResult
+}
+
+// loadIdempotentResult returns the saved result for a key or nil if there's none.
+func loadIdempotentResult(key string) (*idempotentResult, error) {
+	if runningService.Service == nil {
+		return nil, nil
+	}
+	value, err := runningService.GetIdempotentResult(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var result idempotentResult
+	if err := json.Unmarshal(value, &result); err != nil {
+		return nil, fmt.Errorf("Bad result for idempotency key %q: %s", key, err.Error())
+	}
+	if time.Since(result.Completed) > IdempotencyKeyAge {
+		return nil, nil
+	}
+	result.done = make(chan struct{})
+	close(result.done)
+	return &result, nil
+}
+
+// claimIdempotencyKey returns the completed result for a key or, if there's none,
+// a new result that the caller must finish.
+func claimIdempotencyKey(key, request string) (result *idempotentResult, claimed bool, err error) {
+	for {
+		idempotency.Lock()
+		if idempotency.results == nil {
+			idempotency.results = make(map[string]*idempotentResult)
+		}
+		result, found := idempotency.results[key]
+		if !found {
+			if result, err = loadIdempotentResult(key); err != nil {
+				idempotency.Unlock()
+				return nil, false, err
+			}
+			if result == nil {
+				result = &idempotentResult{Request: request, done: make(chan struct{})}
+				idempotency.results[key] = result
+				idempotency.Unlock()
+				return result, true, nil
+			}
+			idempotency.results[key] = result
+		}
+		idempotency.Unlock()
+		if result.Request != request {
+			return nil, false, fmt.Errorf("Idempotency key was already used for %s", result.Request)
+		}
+		<-result.done
+		idempotency.Lock()
+		completed := !result.Completed.IsZero()
+		idempotency.Unlock()
+		if completed {
+			return result, false, nil
+		}
+		// The request failed, so try to claim the key again.
+	}
+}
+
+// finishIdempotencyKey records whether a claimed request succeeded, saving the result
+// of a successful request, and wakes any retries.
+func finishIdempotencyKey(key string, result *idempotentResult, succeeded bool) {
+	idempotency.Lock()
+	if succeeded {
+		result.Completed = time.Now()
+	} else {
+		delete(idempotency.results, key)
+	}
+	idempotency.Unlock()
+	if succeeded && runningService.Service != nil {
+		value, err := json.Marshal(result)
+		if err == nil {
+			err = runningService.PutIdempotentResult(key, value)
+		}
+		if err != nil {
+			dvid.Error("Unable to save result for idempotency key %q: %s\n", key, err.Error())
+		}
+	}
+	close(result.done)
+}
+
+// sweepIdempotencyKeys deletes the results completed more than IdempotencyKeyAge ago.
+func sweepIdempotencyKeys() error {
+	idempotency.Lock()
+	for key, result := range idempotency.results {
+		if !result.Completed.IsZero() && time.Since(result.Completed) > IdempotencyKeyAge {
+			delete(idempotency.results, key)
+		}
+	}
+	idempotency.Unlock()
+
+	if runningService.Service == nil {
+		return nil
+	}
+	var expired []string
+	err := runningService.ProcessIdempotentResults(func(key string, value []byte) {
+		var stored struct{ Completed time.Time }
+		if err := json.Unmarshal(value, &stored); err != nil || time.Since(stored.Completed) > IdempotencyKeyAge {
+			expired = append(expired, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := runningService.DeleteIdempotentResult(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runIdempotencySweeper deletes expired results every IdempotencySweepInterval until
+// the server shuts down.
+func runIdempotencySweeper() {
+	ticker := time.NewTicker(IdempotencySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		if err := sweepIdempotencyKeys(); err != nil {
+			dvid.Error("Unable to delete expired idempotency keys: %s\n", err.Error())
+		}
+	}
+}
+
+// idempotencyKey returns the key for a user's key within a data instance.  The user is
+// "" without authentication.
+func idempotencyKey(uuid dvid.UUID, dataname dvid.DataString, user, clientKey string) string {
+	return fmt.Sprintf("%s/%s/%q/%s", uuid, dataname, user, clientKey)
+}
+
+// fingerprint returns the hash of a request body or command input.
+func fingerprint(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashingBody hashes a request body as it's read.
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// finish reads the rest of the body and returns its fingerprint, or "" if the body
+// couldn't be read.
+func (b *hashingBody) finish() string {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return ""
+	}
+	return fingerprint(b.hash)
+}
+
+// recordingWriter writes a response while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// finalStatus returns true if a response status is the final result of a request that
+// succeeded.  Accepted requests continue asynchronously, so their outcome isn't known.
+func finalStatus(status int) bool {
+	return status < 300 && status != http.StatusAccepted
+}
+
+// serveIdempotent handles a HTTP request with the given handler unless it's a retry of
+// a completed POST or PUT with the same idempotency key, in which case the original
+// response is returned.  The handler returns false if the request failed.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString,
+	handler func(w http.ResponseWriter) bool) {
+
+	clientKey := r.Header.Get(IdempotencyKeyHeader)
+	if clientKey == "" || (r.Method != "POST" && r.Method != "PUT") {
+		handler(w)
+		return
+	}
+	key := idempotencyKey(uuid, dataname, requestUserName(r), clientKey)
+	result, claimed, err := claimIdempotencyKey(key, r.Method+" "+r.URL.RequestURI())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	body := &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+	if !claimed {
+		if result.Fingerprint != "" && body.finish() != result.Fingerprint {
+			http.Error(w, "Idempotency key was already used with a different request body",
+				http.StatusUnprocessableEntity)
+			return
+		}
+		dvid.Log(dvid.Debug, "Replaying result for idempotency key %q\n", clientKey)
+		for name, values := range result.Header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(result.Status)
+		w.Write(result.Body)
+		return
+	}
+	r.Body = body
+	recorder := &recordingWriter{ResponseWriter: w}
+	succeeded := handler(recorder)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	succeeded = succeeded && finalStatus(recorder.status)
+	if succeeded {
+		result.Fingerprint = body.finish()
+		result.Status = recorder.status
+		result.Header = w.Header().Clone()
+		result.Body = recorder.body.Bytes()
+	}
+	finishIdempotencyKey(key, result, succeeded)
+}
+
+// doIdempotent runs a RPC command with the given function unless it's a retry of a
+// completed command with the same idempotency key, in which case the original reply
+// is returned.
+func doIdempotent(cmd datastore.Request, reply *datastore.Response, uuid dvid.UUID,
+	dataname dvid.DataString, do func() error) error {
+
+	if cmd.IdempotencyKey == "" {
+		return do()
+	}
+	key := idempotencyKey(uuid, dataname, "", cmd.IdempotencyKey)
+	result, claimed, err := claimIdempotencyKey(key, cmd.String())
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write(cmd.Input)
+	input := fingerprint(h)
+	if !claimed {
+		if result.Fingerprint != input {
+			return fmt.Errorf("Idempotency key was already used with different input")
+		}
+		dvid.Log(dvid.Debug, "Replaying result for idempotency key %q\n", cmd.IdempotencyKey)
+		*reply = *result.Reply
+		return nil
+	}
+	err = do()
+	if err == nil {
+		saved := *reply
+		result.Fingerprint = input
+		result.Reply = &saved
+	}
+	finishIdempotencyKey(key, result, err == nil)
+	return err
+}
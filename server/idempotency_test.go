@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestIdempotencyKeys(c *C) {
+	var calls int
+	status := http.StatusOK
+	serve := func(key, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/node/abc/data/append", bytes.NewBufferString(body))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		if user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, &User{Name: user}))
+		}
+		w := httptest.NewRecorder()
+		serveIdempotent(w, r, "abc", "data", func(w http.ResponseWriter) bool {
+			calls++
+			ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+			w.Write([]byte("done"))
+			return true
+		})
+		return w
+	}
+
+	// A retry with the same body is replayed.
+	w := serve("k1", "alice", "payload")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = serve("k1", "alice", "payload")
+	c.Assert(calls, Equals, 1)
+	c.Assert(w.Body.String(), Equals, "done")
+	c.Assert(w.Header().Get("Idempotent-Replayed"), Equals, "true")
+
+	// Reusing the key with another body is rejected.
+	w = serve("k1", "alice", "other")
+	c.Assert(w.Code, Equals, http.StatusUnprocessableEntity)
+	c.Assert(calls, Equals, 1)
+
+	// Keys are scoped to the user.
+	serve("k1", "bob", "payload")
+	c.Assert(calls, Equals, 2)
+
+	// Accepted requests aren't final, so they aren't replayed.
+	status = http.StatusAccepted
+	serve("k2", "alice", "payload")
+	serve("k2", "alice", "payload")
+	c.Assert(calls, Equals, 4)
+}
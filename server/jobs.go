@@ -0,0 +1,276 @@
+/*
+	This file implements a registry of long-running jobs, e.g., mesh generation, so
+	clients can start work with one request and poll for its progress.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxFinishedJobs is the number of finished jobs kept for status queries.
+var MaxFinishedJobs = 100
+
+// JobStatus describes the state of a job.
+type JobStatus string
+
+const (
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+
+	// JobInterrupted is the status of a resumable job stopped by a server shutdown.  The
+	// job is resumed from its last checkpoint when the server restarts.
+	JobInterrupted JobStatus = "interrupted"
+)
+
+// Job is a long-running task whose progress can be queried via the /api/jobs
+// endpoints or the "jobs" command.  It is safe for concurrent use.
+type Job struct {
+	sync.RWMutex
+	ID          int
+	Description string
+	Status      JobStatus
+	Progress    float32 // Fraction of work done, from 0 to 1.
+	Error       string
+	Started     time.Time
+	Finished    time.Time
+
+	// Resumable jobs have a kind with a registered JobResumer, the JSON arguments
+	// they were started with, and the JSON checkpoint of their completed work.
+	kind       string
+	args       json.RawMessage
+	checkpoint json.RawMessage
+}
+
+var jobs struct {
+	sync.RWMutex
+	lastID int
+	byID   map[int]*Job
+}
+
+// NewJob registers a running job with the given description.
+func NewJob(description string) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if jobs.byID == nil {
+		jobs.byID = make(map[int]*Job)
+	}
+	jobs.lastID++
+	job := &Job{
+		ID:          jobs.lastID,
+		Description: description,
+		Status:      JobRunning,
+		Started:     time.Now(),
+	}
+	jobs.byID[job.ID] = job
+	pruneJobs()
+	return job
+}
+
+// pruneJobs drops the oldest finished jobs beyond MaxFinishedJobs.  It must be called
+// with the jobs lock held.
+func pruneJobs() {
+	var finished []int
+	for id, job := range jobs.byID {
+		job.RLock()
+		if job.Status != JobRunning {
+			finished = append(finished, id)
+		}
+		job.RUnlock()
+	}
+	if len(finished) <= MaxFinishedJobs {
+		return
+	}
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-MaxFinishedJobs] {
+		delete(jobs.byID, id)
+	}
+}
+
+// SetProgress sets the fraction of the job that is done.
+func (job *Job) SetProgress(fraction float32) {
+	job.Lock()
+	job.Progress = fraction
+	job.Unlock()
+}
+
+// Finish marks the job done or, if err is not nil, failed.  Resumable jobs stopped by
+// a server shutdown are marked interrupted instead of failed.
+func (job *Job) Finish(err error) {
+	job.Lock()
+	defer job.Unlock()
+	job.Finished = time.Now()
+	if err != nil && job.kind != "" && serverCtx.Err() != nil {
+		job.Status = JobInterrupted
+		job.Error = err.Error()
+		return
+	}
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		return
+	}
+	job.Status = JobDone
+	job.Progress = 1
+}
+
+// MarshalJSON returns a JSON description of the job.
+func (job *Job) MarshalJSON() ([]byte, error) {
+	job.RLock()
+	defer job.RUnlock()
+	type jobJSON struct {
+		ID          int
+		Description string
+		Status      JobStatus
+		Progress    float32
+		Error       string `json:",omitempty"`
+		Started     time.Time
+		Finished    *time.Time `json:",omitempty"`
+	}
+	j := jobJSON{job.ID, job.Description, job.Status, job.Progress, job.Error, job.Started, nil}
+	if !job.Finished.IsZero() {
+		finished := job.Finished
+		j.Finished = &finished
+	}
+	return json.Marshal(j)
+}
+
+// ForEachParallel calls fn for each of n items, running up to workers calls at once.  It
+// stops at the first error or cancellation of ctx, which is returned.  If progress is not
+// nil, it's called with the fraction of items done.
+func ForEachParallel(ctx context.Context, n, workers int, fn func(ctx context.Context, i int) error,
+	progress func(float32)) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if workers < 1 {
+		workers = 1
+	}
+	items := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	var done int
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				err := fn(ctx, i)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				done++
+				if progress != nil && firstErr == nil {
+					progress(float32(done) / float32(n))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case items <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(items)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// GetJob returns the job with the given ID.
+func GetJob(id int) (*Job, error) {
+	jobs.RLock()
+	defer jobs.RUnlock()
+	job, found := jobs.byID[id]
+	if !found {
+		return nil, fmt.Errorf("No job with ID %d", id)
+	}
+	return job, nil
+}
+
+// Jobs returns all known jobs ordered by ID.
+func Jobs() []*Job {
+	jobs.RLock()
+	defer jobs.RUnlock()
+	list := make([]*Job, 0, len(jobs.byID))
+	for _, job := range jobs.byID {
+		list = append(list, job)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// jobsText returns a description of jobs for the "jobs" command.
+func jobsText(list []*Job) string {
+	var buf bytes.Buffer
+	for _, job := range list {
+		job.RLock()
+		fmt.Fprintf(&buf, "Job %d [%s, %.0f%%]: %s", job.ID, job.Status, job.Progress*100, job.Description)
+		if job.Error != "" {
+			fmt.Fprintf(&buf, " (%s)", job.Error)
+		}
+		buf.WriteString("\n")
+		job.RUnlock()
+	}
+	if len(list) == 0 {
+		buf.WriteString("No jobs\n")
+	}
+	return buf.String()
+}
+
+// jobsRequest handles GET of all jobs or a job given by ID.
+func jobsRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Jobs can only be queried with GET")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path[len(WebAPIPath):], "/"), "/")
+	var result interface{}
+	switch len(parts) {
+	case 1:
+		result = Jobs()
+	case 2:
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad job ID %q", parts[1]))
+			return
+		}
+		job, err := GetJob(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result = job
+	default:
+		BadRequest(w, r, WebAPIPath+"jobs/ must be followed by at most a job ID")
+		return
+	}
+	m, err := json.Marshal(result)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,123 @@
+/*
+	This file lets administrators change the run mode of modules while the server runs,
+	e.g., to log storage-layer debug messages for ten minutes while diagnosing a problem.
+
+	GET    /api/server/logging             Lists the global mode and the modes set for modules.
+	POST   /api/server/logging             Sets modules' modes from a JSON object like
+	                                       {"storage": {"Mode": "debug", "Duration": "10m"}}.
+	DELETE /api/server/logging/<module>    Returns a module to the global mode.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// loggingSetting is the requested run mode of a module.  An empty Duration never expires.
+type loggingSetting struct {
+	Mode     string
+	Duration string
+}
+
+// setModuleMode sets the run mode of a module from its name and an optional duration
+// like "10m".
+func setModuleMode(module, modeName, durationStr string) error {
+	if module == "" {
+		return fmt.Errorf("A module, e.g., 'storage' or %q, must be given", dvid.AllModules)
+	}
+	mode, err := dvid.ParseModeFlag(modeName)
+	if err != nil {
+		return err
+	}
+	var duration time.Duration
+	if durationStr != "" {
+		if duration, err = time.ParseDuration(durationStr); err != nil || duration < 0 {
+			return fmt.Errorf("Bad duration %q for module %q", durationStr, module)
+		}
+	}
+	dvid.SetModuleMode(module, mode, duration)
+	dvid.Log(dvid.Normal, "Run mode of module %q set to %s for %s\n", module, mode, durationText(duration))
+	return nil
+}
+
+// durationText describes how long a module's mode is kept.
+func durationText(duration time.Duration) string {
+	if duration == 0 {
+		return "the life of the server"
+	}
+	return duration.String()
+}
+
+// loggingJSON returns the global run mode and the unexpired modes set for modules.
+func loggingJSON() ([]byte, error) {
+	modules := make(map[string]interface{})
+	for _, setting := range dvid.ModuleModes() {
+		modules[setting.Module] = map[string]interface{}{
+			"Mode":    setting.Mode.String(),
+			"Expires": setting.Expires,
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"Mode":    dvid.Mode.String(),
+		"Modules": modules,
+	})
+}
+
+// loggingText returns the global run mode and the modes set for modules as a table.
+func loggingText() string {
+	text := fmt.Sprintf("Global mode: %s\n", dvid.Mode)
+	modes := dvid.ModuleModes()
+	if len(modes) == 0 {
+		return text
+	}
+	text += fmt.Sprintf("%-20s %-10s %s\n", "Module", "Mode", "Expires")
+	for _, setting := range modes {
+		expires := "never"
+		if !setting.Expires.IsZero() {
+			expires = setting.Expires.Format(time.RFC3339)
+		}
+		text += fmt.Sprintf("%-20s %-10s %s\n", setting.Module, setting.Mode, expires)
+	}
+	return text
+}
+
+// loggingRequest handles the /api/server/logging endpoints.
+func loggingRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !adminRequest(w, r) {
+		return
+	}
+	switch action := strings.ToLower(r.Method); {
+	case action == "get" && len(parts) == 1:
+	case action == "post" && len(parts) == 1:
+		var settings map[string]loggingSetting
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+			return
+		}
+		for module, setting := range settings {
+			if err := setModuleMode(module, setting.Mode, setting.Duration); err != nil {
+				BadRequest(w, r, err.Error())
+				return
+			}
+		}
+	case action == "delete" && len(parts) == 2:
+		dvid.ResetModuleMode(parts[1])
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET or POST /api/server/logging, or DELETE /api/server/logging/<module>")
+		return
+	}
+	m, err := loggingJSON()
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
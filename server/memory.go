@@ -0,0 +1,72 @@
+/*
+	This file implements admission control for memory-intensive requests.  Requests
+	reserve an estimate of their memory before allocating buffers, and requests that
+	would push the total reservations past the budget wait until enough memory is
+	released.  This keeps a handful of large concurrent GETs from exhausting memory.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryBudget is the maximum number of bytes that concurrent requests may reserve
+// through AdmitMemory.  Zero means there is no budget.  It should be set before
+// serving requests.
+var MemoryBudget int64
+
+var admission = struct {
+	sync.Mutex
+	reserved int64
+	released chan struct{} // closed and replaced whenever memory is released
+}{released: make(chan struct{})}
+
+// AdmitMemory reserves an estimated number of bytes for a request.  If the reservation
+// would exceed MemoryBudget, the request is queued until enough memory is released or
+// the context is done, e.g., because of a client disconnect or request timeout.
+// Requests that could never fit in the budget are rejected immediately.  The returned
+// function releases the reservation and must be called when the request is finished.
+func AdmitMemory(ctx context.Context, bytes int64) (release func(), err error) {
+	if MemoryBudget <= 0 || bytes <= 0 {
+		return func() {}, nil
+	}
+	if bytes > MemoryBudget {
+		return nil, fmt.Errorf("Request needs an estimated %d bytes, exceeding this DVID server's memory budget (%d bytes)",
+			bytes, MemoryBudget)
+	}
+	for {
+		admission.Lock()
+		if admission.reserved+bytes <= MemoryBudget {
+			admission.reserved += bytes
+			admission.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { releaseMemory(bytes) }) }, nil
+		}
+		released := admission.released
+		admission.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Request for %d bytes gave up waiting for memory: %s", bytes, ctx.Err().Error())
+		}
+	}
+}
+
+func releaseMemory(bytes int64) {
+	admission.Lock()
+	admission.reserved -= bytes
+	close(admission.released)
+	admission.released = make(chan struct{})
+	admission.Unlock()
+}
+
+// MemoryReserved returns the number of bytes currently reserved by admitted requests.
+func MemoryReserved() int64 {
+	admission.Lock()
+	defer admission.Unlock()
+	return admission.reserved
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestMemoryBudget(c *C) {
+	MemoryBudget = 1000
+	defer func() { MemoryBudget = 0 }()
+
+	// Requests that can never fit are rejected.
+	_, err := AdmitMemory(context.Background(), 1001)
+	c.Assert(err, NotNil)
+
+	// Requests wait for reservations to be released.
+	release, err := AdmitMemory(context.Background(), 600)
+	c.Assert(err, IsNil)
+	c.Assert(MemoryReserved(), Equals, int64(600))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = AdmitMemory(ctx, 600)
+	cancel()
+	c.Assert(err, NotNil)
+
+	admitted := make(chan error)
+	go func() {
+		release2, err := AdmitMemory(context.Background(), 600)
+		if err == nil {
+			release2()
+		}
+		admitted <- err
+	}()
+	release()
+	c.Assert(<-admitted, IsNil)
+	c.Assert(MemoryReserved(), Equals, int64(0))
+}
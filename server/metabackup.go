@@ -0,0 +1,115 @@
+/*
+	This file continuously backs up dataset metadata to an object store when
+	MetadataBackupTarget is set.  Changed metadata is committed every
+	MetadataBackupInterval and once more on shutdown.  See datastore/metabackup.go for
+	the layout of backups and "dvid restore-metadata" for recovering from one.
+
+	GET /api/server/backup    Returns the backup target, latest commit, and last error.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+var (
+	// MetadataBackupTarget is the object store receiving metadata backups, e.g.,
+	// "s3://bucket/dvid-metadata" or a local directory.  Backups are off if it's empty.
+	MetadataBackupTarget string
+
+	// MetadataBackupInterval is the time between checks for changed metadata.
+	MetadataBackupInterval = time.Minute
+)
+
+// BackupStatus describes the metadata backup of the server.
+type BackupStatus struct {
+	Target     string
+	Head       string    `json:",omitempty"`
+	LastCommit time.Time `json:",omitempty"`
+	LastError  string    `json:",omitempty"`
+}
+
+var metadataBackup struct {
+	sync.Mutex
+	backup *datastore.MetadataBackup
+	status BackupStatus
+}
+
+// backupMetadata commits any changed metadata, recording the outcome.
+func backupMetadata() {
+	metadataBackup.Lock()
+	defer metadataBackup.Unlock()
+	if metadataBackup.backup == nil {
+		return
+	}
+	committed, err := metadataBackup.backup.Backup(runningService.Service)
+	if err != nil {
+		dvid.Error("Unable to back up metadata to %s: %s\n", MetadataBackupTarget, err.Error())
+		metadataBackup.status.LastError = err.Error()
+		return
+	}
+	metadataBackup.status.LastError = ""
+	if committed {
+		metadataBackup.status.Head = metadataBackup.backup.Head()
+		metadataBackup.status.LastCommit = time.Now()
+		dvid.Log(dvid.Debug, "Committed metadata backup %s to %s\n", metadataBackup.status.Head,
+			MetadataBackupTarget)
+	}
+}
+
+// runMetadataBackup backs up metadata every MetadataBackupInterval until the server stops.
+func runMetadataBackup() {
+	if MetadataBackupTarget == "" {
+		return
+	}
+	store, err := storage.NewObjectStore(MetadataBackupTarget, dvid.NewConfig())
+	if err == nil {
+		metadataBackup.Lock()
+		metadataBackup.status.Target = MetadataBackupTarget
+		metadataBackup.backup, err = datastore.NewMetadataBackup(store)
+		metadataBackup.Unlock()
+	}
+	if err != nil {
+		dvid.Error("Unable to back up metadata to %s: %s\n", MetadataBackupTarget, err.Error())
+		return
+	}
+	dvid.Log(dvid.Normal, "Backing up metadata to %s every %s\n", MetadataBackupTarget, MetadataBackupInterval)
+	backupMetadata()
+	ticker := time.NewTicker(MetadataBackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		backupMetadata()
+	}
+}
+
+// backupRequest handles the /api/server/backup endpoint.
+func backupRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Only GET is supported on /api/server/backup")
+		return
+	}
+	if MetadataBackupTarget == "" {
+		http.Error(w, "Metadata backups are off.  Start the server with -metabackup to turn them on.",
+			http.StatusNotFound)
+		return
+	}
+	metadataBackup.Lock()
+	status := metadataBackup.status
+	metadataBackup.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,155 @@
+/*
+	This file mirrors data from another DVID server into a local instance using only the
+	remote's HTTP API, so data can be copied from servers that don't support push/pull
+	replication.  Each datatype that can be mirrored decides which remote endpoints to read,
+	e.g., voxels read subvolumes and keyvalue reads keys, and requests run in parallel.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultMirrorRequests is the default number of concurrent requests to a remote server
+// while mirroring.
+const DefaultMirrorRequests = 8
+
+// Mirrorer is implemented by data that can copy a remote instance into a version.
+// Settings are the datatype-specific settings of the "mirror" command.
+type Mirrorer interface {
+	Mirror(ctx context.Context, remote *MirrorSource, uuid dvid.UUID, settings dvid.Config,
+		progress func(float32)) error
+}
+
+// MirrorSource is a data instance at a version of a remote DVID server.
+type MirrorSource struct {
+	// URL is the base URL of the remote server, e.g., "http://emdata2:8000".
+	URL string
+
+	UUID dvid.UUID
+	Name dvid.DataString
+
+	// Requests is the number of concurrent requests made to the remote server.
+	Requests int
+
+	client *http.Client
+}
+
+// NewMirrorSource returns a source for data at a remote server given its base URL.
+func NewMirrorSource(baseURL string, uuid dvid.UUID, name dvid.DataString, requests int) (*MirrorSource, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Bad remote DVID server URL %q", baseURL)
+	}
+	if requests <= 0 {
+		requests = DefaultMirrorRequests
+	}
+	return &MirrorSource{
+		URL:      strings.TrimRight(baseURL, "/"),
+		UUID:     uuid,
+		Name:     name,
+		Requests: requests,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (src *MirrorSource) String() string {
+	return fmt.Sprintf("%s%snode/%s/%s", src.URL, WebAPIPath, src.UUID, src.Name)
+}
+
+// Get returns the body of a GET of an endpoint of the remote data, e.g., "info" or
+// "raw/0_1_2/64_64_64/0_0_0".  If the remote returns 404, found is false.  Bodies of
+// more than MaxRequestBody bytes are refused.
+func (src *MirrorSource) Get(ctx context.Context, endpoint string) (body []byte, found bool, err error) {
+	req, err := http.NewRequest("GET", src.String()+"/"+endpoint, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := src.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, MaxRequestBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > MaxRequestBody {
+		return nil, false, fmt.Errorf("GET %s/%s returned more than %d bytes", src, endpoint, MaxRequestBody)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, true, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("GET %s/%s returned status %d: %s", src, endpoint, resp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+}
+
+// Info decodes the JSON of the remote data's info endpoint into v.
+func (src *MirrorSource) Info(ctx context.Context, v interface{}) error {
+	body, found, err := src.Get(ctx, "info")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("No data %q at version %s of %s", src.Name, src.UUID, src.URL)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("Bad info from %s: %s", src, err.Error())
+	}
+	return nil
+}
+
+// ForEach calls mirror for each of n items, running up to src.Requests at once.  It stops
+// at the first error, which is returned.  If progress is not nil, it's called with the
+// fraction of items done.
+func (src *MirrorSource) ForEach(ctx context.Context, n int, mirror func(ctx context.Context, i int) error,
+	progress func(float32)) error {
+	return ForEachParallel(ctx, n, src.Requests, mirror, progress)
+}
+
+// StartMirrorJob starts a job that mirrors remote data into local data at a version,
+// unless the version is frozen by a publication.
+func StartMirrorJob(remote *MirrorSource, uuid dvid.UUID, name dvid.DataString, settings dvid.Config) (*Job, error) {
+	if err := runningService.WritesBlocked(uuid); err != nil {
+		return nil, err
+	}
+	dataservice, err := runningService.DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	mirrorer, ok := dataservice.(Mirrorer)
+	if !ok {
+		return nil, fmt.Errorf("Data %q of type %q can't be mirrored", name, dataservice.DatatypeName())
+	}
+	description := fmt.Sprintf("Mirror %s into %q at %s", remote, name, uuid)
+	job := NewJob(description)
+	go func() {
+		startTime := time.Now()
+		err := mirrorer.Mirror(serverCtx, remote, uuid, settings, job.SetProgress)
+		if err != nil {
+			dvid.Error("%s: %s\n", description, err.Error())
+		} else {
+			dvid.ElapsedTime(dvid.Normal, startTime, description)
+		}
+		job.Finish(err)
+	}()
+	return job, nil
+}
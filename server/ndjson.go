@@ -0,0 +1,111 @@
+/*
+	This file supports streaming large query results as newline-delimited JSON (NDJSON),
+	one JSON value per line, so clients can process results as they arrive and the server
+	needn't hold the whole result.  Clients ask for NDJSON with an "Accept:
+	application/x-ndjson" header or a "format=ndjson" query string.  Since the status is
+	sent with the first lines, a query that fails partway ends the stream with a line
+	{"Error": "<message>"}.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// NDJSONContentType is the content type of newline-delimited JSON.
+const NDJSONContentType = "application/x-ndjson"
+
+// ndjsonFlushLines is the number of lines between flushes of a stream to the client.
+const ndjsonFlushLines = 256
+
+// WantsNDJSON returns true if a request asks for results as newline-delimited JSON.
+func WantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), NDJSONContentType)
+}
+
+// NDJSONWriter streams JSON values to a HTTP client, one per line.
+type NDJSONWriter struct {
+	w     http.ResponseWriter
+	buf   *bufio.Writer
+	lines int
+	bytes int
+	err   error
+}
+
+// NewNDJSONWriter returns a writer streaming newline-delimited JSON as the reply.
+func NewNDJSONWriter(w http.ResponseWriter) *NDJSONWriter {
+	w.Header().Set("Content-Type", NDJSONContentType)
+	return &NDJSONWriter{w: w, buf: bufio.NewWriter(w)}
+}
+
+// WriteLine writes a JSON value that's already encoded without newlines.
+func (nw *NDJSONWriter) WriteLine(m []byte) error {
+	if nw.err != nil {
+		return nw.err
+	}
+	if _, nw.err = nw.buf.Write(m); nw.err == nil {
+		nw.err = nw.buf.WriteByte('\n')
+	}
+	nw.lines++
+	nw.bytes += len(m) + 1
+	if nw.err == nil && nw.lines%ndjsonFlushLines == 0 {
+		nw.flush()
+	}
+	return nw.err
+}
+
+// Encode writes a value as a line of JSON.
+func (nw *NDJSONWriter) Encode(v interface{}) error {
+	m, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return nw.WriteLine(m)
+}
+
+// Lines returns the number of lines written.
+func (nw *NDJSONWriter) Lines() int {
+	return nw.lines
+}
+
+// Started returns true if part of the reply may have been sent to the client.
+func (nw *NDJSONWriter) Started() bool {
+	return nw.bytes > nw.buf.Buffered()
+}
+
+// flush sends the buffered lines to the client.
+func (nw *NDJSONWriter) flush() {
+	if nw.err == nil {
+		nw.err = nw.buf.Flush()
+	}
+	if flusher, ok := nw.w.(http.Flusher); ok && nw.err == nil {
+		flusher.Flush()
+	}
+}
+
+// Close ends the stream given the error, if any, of the query producing it.  If the reply
+// hasn't started, nothing is sent on error so the caller can reply with an error status.
+// Otherwise, the error is written as a final line.  It returns the first error of the
+// query or the stream.
+func (nw *NDJSONWriter) Close(err error) error {
+	if err != nil {
+		if !nw.Started() {
+			return err
+		}
+		if nw.err == nil {
+			nw.Encode(struct{ Error string }{err.Error()})
+		}
+	}
+	nw.flush()
+	if err != nil {
+		return err
+	}
+	return nw.err
+}
@@ -0,0 +1,116 @@
+/*
+	This file supports conditional writes for optimistic concurrency.  Data types reply to
+	GET requests for single values with an ETag header, and writes with an "If-Match"
+	header only succeed if the value's current ETag is listed, or for "*", if the value
+	exists.  Writes with "If-None-Match: *" only succeed if the value doesn't exist yet.
+	Failed preconditions get a 412 status, so clients can read the value again, merge
+	their edits, and retry.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// numWriteLocks is the number of locks that writes of values are spread over.
+const numWriteLocks = 256
+
+var writeLocks [numWriteLocks]sync.Mutex
+
+// writeLock returns the index of the lock for a value.
+func writeLock(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % numWriteLocks)
+}
+
+// LockWrite keeps writes to a value, identified by a string unique to the value, from
+// interleaving between checking preconditions and writing.  Every write of a value that
+// supports preconditions must hold the lock, conditional or not, or it could land between
+// another write's check and store.  It returns the unlock function.
+func LockWrite(id string) func() {
+	mu := &writeLocks[writeLock(id)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// LockWrites is LockWrite for writes of several values at once.  Locks are taken in a
+// fixed order so concurrent writes of overlapping values can't deadlock.
+func LockWrites(ids ...string) func() {
+	var locked [numWriteLocks]bool
+	for _, id := range ids {
+		locked[writeLock(id)] = true
+	}
+	for i := range writeLocks {
+		if locked[i] {
+			writeLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i := range writeLocks {
+			if locked[i] {
+				writeLocks[i].Unlock()
+			}
+		}
+	}
+}
+
+// ETag returns the strong entity tag of a value.
+func ETag(value []byte) string {
+	hash := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagListed returns true if a If-Match or If-None-Match header lists an ETag.  Weak tags
+// never match since conditional writes need strong comparison.
+func etagListed(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPreconditions returns true if a request has If-Match or If-None-Match headers.
+func HasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// CheckPreconditions returns an error if a request's If-Match or If-None-Match headers
+// aren't met by a value with the given ETag, which is ignored if the value doesn't exist.
+func CheckPreconditions(r *http.Request, etag string, exists bool) error {
+	if ifMatch := strings.TrimSpace(r.Header.Get("If-Match")); ifMatch != "" {
+		if !exists {
+			return fmt.Errorf("If-Match precondition failed: value doesn't exist")
+		}
+		if ifMatch != "*" && !etagListed(ifMatch, etag) {
+			return fmt.Errorf("If-Match precondition failed: value has changed (ETag %s)", etag)
+		}
+	}
+	if ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match")); ifNoneMatch != "" && exists {
+		if ifNoneMatch == "*" {
+			return fmt.Errorf("If-None-Match precondition failed: value already exists")
+		}
+		if etagListed(ifNoneMatch, etag) {
+			return fmt.Errorf("If-None-Match precondition failed: value has ETag %s", etag)
+		}
+	}
+	return nil
+}
+
+// PreconditionFailed replies with a 412 for writes whose preconditions aren't met.
+func PreconditionFailed(w http.ResponseWriter, r *http.Request, message string) {
+	errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", message, r.URL.Path)
+	dvid.Log(dvid.Normal, errorMsg)
+	http.Error(w, errorMsg, http.StatusPreconditionFailed)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestLockWrites(c *C) {
+	// Values sharing a lock, or listed twice, are locked once.
+	unlock := LockWrites("a", "a", "b", "c")
+	locked := make(chan struct{})
+	go func() {
+		defer LockWrite("b")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		c.Fatalf("Write of a locked value wasn't blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		c.Fatalf("Write wasn't unblocked once values were unlocked")
+	}
+}
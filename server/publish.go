@@ -0,0 +1,78 @@
+/*
+	This file handles publishing datasets, e.g., for data papers, which freezes a node and
+	its ancestors and serves a manifest of the published data.
+
+	POST /api/node/<UUID>/publish        Publishes the node with an optional JSON object of
+	                                     citation metadata as the body, returning the manifest.
+	GET  /api/dataset/<UUID>/manifest    Returns the manifest of the published dataset.
+
+	The manifest URL is stable for any UUID within the dataset, e.g., the root UUID.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// startWrite registers a HTTP request that would write data at a node and returns a
+// function to call once the request is done.  It replies with a 403 and returns false if
+// the node is frozen by publication or has been deleted.
+func startWrite(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) (done func(), ok bool) {
+	if !isWriteRequest(r) {
+		return func() {}, true
+	}
+	err := runningService.WritesBlocked(uuid)
+	if err == nil {
+		done, err = runningService.BeginWrite(uuid)
+	}
+	if err != nil {
+		message := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+		dvid.Log(dvid.Normal, message)
+		http.Error(w, message, http.StatusForbidden)
+		return nil, false
+	}
+	return done, true
+}
+
+// publishRequest handles POST /api/node/<UUID>/publish.
+func publishRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Publishing a node must be done with HTTP POST method")
+		return
+	}
+	citation, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	manifest, err := runningService.Publish(uuid, citation)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	dvid.Log(dvid.Normal, "Published dataset %s at node %s\n", manifest.Dataset, manifest.Node)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// manifestRequest handles GET /api/dataset/<UUID>/manifest.
+func manifestRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Manifests can only be retrieved with HTTP GET method")
+		return
+	}
+	manifest, err := runningService.Manifest(uuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
@@ -0,0 +1,267 @@
+/*
+	This file implements read replicas.  A replica serves reads from its own copy of a
+	primary's datastore, e.g., one copied from a locked snapshot, so tile-serving load for
+	big public datasets can be spread over several servers.  Requests that would modify
+	data are forwarded to the primary or, if writes are rejected, refused.  Reads of
+	forwarded writes only reflect them once the replica's copy is refreshed.
+
+	A replica's copy is refreshed incrementally with "pull <UUID> <synced UUID>", which
+	gets from the primary only the key/value pairs written after the last synced node:
+
+	GET /api/node/<UUID>/delta/<synced UUID>   Returns the delta of a node since a locked ancestor.
+
+	Deltas hold every data instance's keys, so they're only served to admin requests or
+	requests carrying the replica token shared by the primary and its replicas.
+*/
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// PrimaryWebAddress is the HTTP address of the primary server if this server is a
+	// read replica.  Empty means this server is not a replica.
+	PrimaryWebAddress string
+
+	// PrimaryRPCAddress is the RPC address of the primary server for forwarding
+	// commands that modify data.  If empty, a replica rejects such commands.
+	PrimaryRPCAddress string
+
+	// RejectWrites makes a replica reject HTTP writes instead of forwarding them.
+	RejectWrites bool
+
+	// ReplicaToken is a shared secret replicas send when pulling deltas.  If set, the
+	// primary serves deltas to requests carrying it.  Otherwise deltas are admin requests.
+	ReplicaToken string
+
+	primaryProxy     *httputil.ReverseProxy
+	primaryProxyOnce sync.Once
+)
+
+// replicaTokenHeader is the HTTP header carrying the replica token of delta requests.
+const replicaTokenHeader = "X-DVID-Replica-Token"
+
+// replicaRequest returns true if a request for a delta carries the replica token.
+func replicaRequest(r *http.Request, parts []string) bool {
+	if len(parts) < 3 || parts[0] != "node" || parts[2] != "delta" {
+		return false
+	}
+	token := r.Header.Get(replicaTokenHeader)
+	return ReplicaToken != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ReplicaToken)) == 1
+}
+
+// IsReplica returns true if this server is a read replica.
+func IsReplica() bool {
+	return PrimaryWebAddress != ""
+}
+
+// isWriteMethod returns true if a HTTP method modifies data.
+func isWriteMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "DELETE", "PATCH":
+		return true
+	}
+	return false
+}
+
+// isWriteRequest returns true if a HTTP request modifies data.
+func isWriteRequest(r *http.Request) bool {
+	return isWriteMethod(r.Method) && !isReadOnlyPost(r)
+}
+
+// IsWriteRequest returns true if a HTTP request modifies data, so it's checked and
+// recorded as a write.
+func IsWriteRequest(r *http.Request) bool {
+	return isWriteRequest(r)
+}
+
+// isReadOnlyPost returns true if a HTTP request is a POST that only reads, i.e., one to
+// an endpoint its data declares read-only through datastore.ReadOnlyPoster, like a bulk
+// existence check, or a validation job.
+func isReadOnlyPost(r *http.Request) bool {
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, WebAPIPath) {
+		return false
+	}
+	if isValidationPost(r) {
+		return true
+	}
+	parts := strings.Split(strings.TrimSuffix(r.URL.Path[len(WebAPIPath):], "/"), "/")
+	if len(parts) != 4 || parts[0] != "node" || runningService.Service == nil {
+		return false
+	}
+	uuid, err := MatchingUUID(parts[1])
+	if err != nil {
+		return false
+	}
+	dataservice, err := runningService.DataServiceByUUID(uuid, dvid.DataString(parts[2]))
+	if err != nil {
+		return false
+	}
+	poster, ok := dataservice.(datastore.ReadOnlyPoster)
+	return ok && poster.ReadOnlyPost(parts[3])
+}
+
+// isValidationPost returns true if a HTTP request starts a validation job, which only
+// reads data but, unlike other reads, runs a job over whole data instances.
+func isValidationPost(r *http.Request) bool {
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, WebAPIPath) {
+		return false
+	}
+	parts := strings.Split(strings.TrimSuffix(r.URL.Path[len(WebAPIPath):], "/"), "/")
+	return len(parts) == 3 && parts[0] == "node" && parts[2] == "validate"
+}
+
+// isReadOnlyCommand returns true if a "node <UUID> <data name> ..." RPC command only
+// reads, as declared by its data through datastore.ReadOnlyCommander.
+func isReadOnlyCommand(cmd datastore.Request) bool {
+	var uuidStr, dataName string
+	cmd.CommandArgs(1, &uuidStr, &dataName)
+	if runningService.Service == nil {
+		return false
+	}
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		return false
+	}
+	dataservice, err := runningService.DataServiceByUUID(uuid, dvid.DataString(dataName))
+	if err != nil {
+		return false
+	}
+	commander, ok := dataservice.(datastore.ReadOnlyCommander)
+	return ok && commander.ReadOnlyCommand(cmd)
+}
+
+// replicaWrite handles a HTTP request that would modify data on a replica by
+// forwarding it to the primary or rejecting it.
+func replicaWrite(w http.ResponseWriter, r *http.Request) {
+	if RejectWrites {
+		message := fmt.Sprintf("This DVID server is a read-only replica.  Send %s requests to the primary at %s.",
+			r.Method, PrimaryWebAddress)
+		dvid.Log(dvid.Normal, "Rejected %s %s: %s\n", r.Method, r.URL.Path, message)
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+	primaryProxyOnce.Do(func() {
+		primaryProxy = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: PrimaryWebAddress})
+	})
+	dvid.Log(dvid.Debug, "Forwarding %s %s to primary at %s\n", r.Method, r.URL.Path, PrimaryWebAddress)
+	primaryProxy.ServeHTTP(w, r)
+}
+
+// isWriteCommand returns true if a RPC command could modify data or server metadata
+// and must be run on the primary.
+func isWriteCommand(cmd datastore.Request) bool {
+	var arg1, arg2, arg3 string
+	cmd.CommandArgs(1, &arg1, &arg2, &arg3)
+	switch cmd.Name() {
+	case "datasets":
+		return arg1 == "new"
+	case "dataset":
+		switch arg2 {
+		case "new", "delete", "restore", "purge", "template", "delete-template", "init-template",
+			"alias", "unalias":
+			return true
+		}
+		return false
+	case "node":
+		return arg3 != "help" && arg2 != "validate" && arg2 != "validation" && !isReadOnlyCommand(cmd)
+	case "benchmark":
+		return arg1 != "help"
+	case "keys":
+		return arg1 == "new" || arg1 == "revoke" || arg1 == "bandwidth"
+	case "thumbnails", "mirror", "upload":
+		return true
+	}
+	return false
+}
+
+// forwardCommand runs a RPC command on the primary server.
+func forwardCommand(cmd datastore.Request, reply *datastore.Response) error {
+	if PrimaryRPCAddress == "" {
+		return fmt.Errorf("This DVID server is a read-only replica.  Run %q on the primary.", cmd.Command)
+	}
+	client, err := rpc.DialHTTP("tcp", PrimaryRPCAddress)
+	if err != nil {
+		return fmt.Errorf("Unable to reach primary at %s to forward %q: %s", PrimaryRPCAddress,
+			cmd.Command, err.Error())
+	}
+	defer client.Close()
+	dvid.Log(dvid.Debug, "Forwarding command %q to primary at %s\n", cmd.Command, PrimaryRPCAddress)
+	return client.Call("RPCConnection.Do", cmd, reply)
+}
+
+// deltaRequest handles GET /api/node/<UUID>/delta/<synced UUID>, streaming the key/value
+// pairs written since the synced node to replicas or admins.
+func deltaRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Deltas can only be retrieved with HTTP GET method")
+		return
+	}
+	if !replicaRequest(r, append([]string{"node"}, parts...)) && !adminRequest(w, r) {
+		return
+	}
+	if len(parts) < 3 || parts[2] == "" {
+		BadRequest(w, r, "Bad URL: Expecting /api/node/<UUID>/delta/<synced UUID>")
+		return
+	}
+	synced, err := MatchingUUID(parts[2])
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	stats, err := runningService.WriteDelta(r.Context(), w, uuid, synced)
+	if err != nil {
+		// Clients detect a delta cut short by an error from its missing end marker.
+		BadRequest(w, r, err.Error())
+		return
+	}
+	dvid.Log(dvid.Normal, "Sent delta of node %s since %s: %d versions, %d keys, %d bytes\n",
+		uuid, synced, stats.Versions, stats.Keys, stats.Bytes)
+}
+
+// PullDelta gets from the primary the key/value pairs of a node written since a synced
+// node and stores them, so a replica's copy is refreshed without a full copy.  The
+// request carries the replica token, which the primary must share.
+func PullDelta(uuid, synced dvid.UUID) (*datastore.DeltaStats, error) {
+	if !IsReplica() {
+		return nil, fmt.Errorf("Only read replicas can pull deltas from a primary")
+	}
+	url := fmt.Sprintf("http://%s%snode/%s/delta/%s", PrimaryWebAddress, WebAPIPath, uuid, synced)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ReplicaToken != "" {
+		req.Header.Set(replicaTokenHeader, ReplicaToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach primary at %s: %s", PrimaryWebAddress, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Primary refused delta (status %d): %s", resp.StatusCode, message)
+	}
+	stats, err := runningService.ApplyDelta(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	dvid.Log(dvid.Normal, "Pulled delta of node %s since %s: %d versions, %d keys, %d bytes\n",
+		uuid, synced, stats.Versions, stats.Keys, stats.Bytes)
+	return stats, nil
+}
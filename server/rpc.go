@@ -5,9 +5,11 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
@@ -18,7 +20,12 @@ const RPCHelpMessage = `Commands executed on the server (rpc address = %s):
 
 	help
 	about
-	shutdown
+
+	shutdown             (admin command; with an admin RPC port, admin commands are only
+	                      accepted there and need "dvid -adminrpc=<address>")
+	backup               (admin command; commits changed metadata to the -metabackup store)
+	gc                   (admin command; frees unused memory)
+	reload               (admin command; rereads -oidc, -federation, and -access files)
 
 	types
 	types <datatype name> help
@@ -28,11 +35,79 @@ const RPCHelpMessage = `Commands executed on the server (rpc address = %s):
 
 	dataset <UUID> new <datatype name> <data name> <datatype-specific config>...
 	dataset <UUID> <data name> help
+	dataset <UUID> delete <data name>    (moves data to the trash)
+	dataset <UUID> trash                 (lists trashed data)
+	dataset <UUID> restore <data name>
+	dataset <UUID> purge <data name>     (permanently deletes trashed data)
+	dataset <UUID> aliases               (lists aliases of data as JSON)
+	dataset <UUID> alias <alias> <data name>
+	                     (makes the alias refer to the data in all requests; reassignments
+	                      are recorded in the audit log)
+	dataset <UUID> unalias <alias>
+	dataset <UUID> scratch               (lists scratch nodes as JSON)
+	dataset <UUID> accounting            (starts a job accounting storage of each node)
+	dataset <UUID> templates             (lists templates of data instances as JSON)
+	dataset <UUID> template <name>       (defines a template from JSON via -stdin)
+	dataset <UUID> delete-template <name>
+	dataset <UUID> init-template <name>  (creates all data instances of a template)
 
 	node <UUID> lock
 	node <UUID> branch   (returns UUID of new child node)
+	node <UUID> scratch [idle=<duration>]
+	                     (returns UUID of a new scratch child, which is hidden from listings,
+	                      can't be locked, and is deleted once unused for the idle period,
+	                      e.g., 30m, or the server's -scratchidle)
+	node <UUID> delete-scratch
+	node <UUID> publish  (freezes node and ancestors; citation JSON object via -stdin)
+	node <UUID> validate (starts a job checking invariants between data, optionally only
+	                      of data given by JSON via -stdin mapping names to related data)
+	node <UUID> validation
+	                     (returns the report of the node's latest validation as JSON)
 	node <UUID> <data name> <type-specific commands>
 
+	handlers             (admin command; lists chunk handler pools per datatype)
+	handlers <datatype name> <pool size>
+
+	logging              (admin command; lists the global run mode and modes set for modules)
+	logging <module> <mode> [<duration>]
+	                     (sets the run mode, e.g., debug, of messages logged by a module like
+	                      storage, server, or voxels, or "all" modules, optionally for a
+	                      duration like 10m before returning to the global mode)
+	logging <module> reset
+
+	benchmark [<setting>=<value> ...]   (returns JSON report; see "benchmark help")
+
+	pull <UUID> <synced UUID>   (replicas only; gets data written since a locked node)
+
+	mirror <remote URL> <UUID> <data name> [local=<UUID>] [name=<data name>] [requests=<n>] ...
+	                     (starts a job copying data from another DVID server's HTTP API
+	                      into existing local data of the same type; by default the local
+	                      data has the same UUID and name.  Voxels data takes offset=x,y,z
+	                      and size=nx,ny,nz settings, and keyvalue data requires keys=k1,k2,...)
+
+	keys [<user>]        (admin command; lists API keys issued to a user or all users,
+	                      including revoked keys)
+	keys new <user> [datasets=<UUID>,<UUID>,...] [write=true] [bandwidth=<bytes/sec>]
+	                     (issues an API key for the given datasets, or all datasets, that's
+	                      read-only unless write=true; the key is only shown once)
+	keys bandwidth <key ID> <bytes/sec>
+	                     (caps the bandwidth of replies to all requests with the key,
+	                      where 0 is unlimited)
+	keys revoke <key ID>
+
+	jobs                 (lists long-running jobs and their progress; ingests and exports
+	                      interrupted by SIGTERM or SIGINT resume when the server restarts)
+	jobs <job ID>
+
+	thumbnails [<UUID>]  (starts a job generating thumbnails of a dataset or all datasets)
+
+	upload new           (starts a session receiving a file in parts; see "dvid -upload")
+	upload part <upload ID> <n> <SHA-256>    (stores input as part n if it matches the checksum)
+	upload file <upload ID> <name>           (joins parts into a file and returns its path)
+	upload remove <upload ID>
+
+	complete <word>...   (lists completions of the last, possibly empty, word of a command)
+
 %s
 
 For further information, use a web browser to visit the server for this
@@ -41,11 +116,25 @@ datastore:
 	http://%s
 `
 
+// commandContext returns a context derived from a command's context, which holds values
+// like the command's timings, that is also canceled when the server shuts down.
+func commandContext(cmd datastore.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(cmd.Context())
+	go func() {
+		select {
+		case <-serverCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // RPCConnection will export all of its functions for rpc access.
 type RPCConnection struct{}
 
 // Do acts as a switchboard for remote command execution
-func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) error {
+func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) (err error) {
 	if reply == nil {
 		dvid.Log(dvid.Debug, "reply is nil coming in!\n")
 		return nil
@@ -56,6 +145,31 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	if runningService.Service == nil {
 		return fmt.Errorf("Datastore not open!  Cannot execute command.")
 	}
+	if AdminRPCAddress != "" && IsAdminCommand(cmd.Name()) {
+		return fmt.Errorf("The %q command is only accepted on the admin RPC port.  Use -adminrpc to give its address.",
+			cmd.Name())
+	}
+	// Uploads are held by this server, so they're resolved before forwarding.
+	if cmd.InputUpload != "" {
+		if cmd.Input, err = uploadInput(cmd.InputUpload); err != nil {
+			return err
+		}
+		cmd.InputUpload = ""
+	}
+	if IsReplica() && isWriteCommand(cmd) {
+		return forwardCommand(cmd, reply)
+	}
+	if isDiskWriteCommand(cmd) {
+		if err := DiskSpaceError(); err != nil {
+			return err
+		}
+	}
+	cmd, logSlowQuery := slowQueryCommand(cmd)
+	defer func() { logSlowQuery(err) }()
+	if AuditLog && isWriteCommand(cmd) {
+		start := time.Now()
+		defer func() { auditCommand(cmd, reply, start, err) }()
+	}
 
 	switch cmd.Name() {
 
@@ -67,17 +181,8 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	case "about":
 		reply.Text = fmt.Sprintf("%s\n", runningService.About())
 
-	case "shutdown":
-		Shutdown()
-		// Make this process shutdown in a second to allow time for RPC to finish.
-		// TODO -- Better way to do this?
-		log.Printf("DVID server halted due to 'shutdown' command.")
-		reply.Text = fmt.Sprintf("DVID server at %s has been halted.\n",
-			runningService.RPCAddress)
-		go func() {
-			time.Sleep(1 * time.Second)
-			os.Exit(0)
-		}()
+	case "shutdown", "backup", "gc", "reload", "keys", "logging", "handlers":
+		return adminCommand(cmd, reply)
 
 	case "types":
 		if len(cmd.Command) == 1 {
@@ -106,7 +211,17 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 			}
 			reply.Text = jsonStr
 		case "new":
-			uuid, _, err := runningService.NewDataset()
+			// Cluster members forward new datasets with a root UUID chosen by the sender.
+			var uuid dvid.UUID
+			root, found, err := cmd.Settings().GetString("root")
+			if err != nil {
+				return err
+			}
+			if found {
+				uuid, _, err = runningService.NewDatasetWithRoot(dvid.UUID(root))
+			} else {
+				uuid, err = newDataset()
+			}
 			if err != nil {
 				return err
 			}
@@ -118,6 +233,9 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	case "dataset":
 		var uuidStr, subcommand, typename, dataname string
 		cmd.CommandArgs(1, &uuidStr, &subcommand)
+		if forwarded, err := forwardToOwner(cmd, reply, uuidStr); forwarded {
+			return err
+		}
 		uuid, err := MatchingUUID(uuidStr)
 		if err != nil {
 			return err
@@ -131,6 +249,120 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 				return err
 			}
 			reply.Text = fmt.Sprintf("Data %q [%s] added to node %s\n", dataname, typename, uuidStr)
+		case "delete":
+			cmd.CommandArgs(3, &dataname)
+			if err := runningService.DeleteData(uuid, dvid.DataString(dataname)); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q moved to the trash of dataset with node %s\n", dataname, uuidStr)
+		case "accounting":
+			job := StartAccountingJob(uuid)
+			reply.Text = fmt.Sprintf("Started job %d to account storage of dataset.  Use 'dvid jobs %d' for progress.\n",
+				job.ID, job.ID)
+		case "scratch":
+			nodes, err := runningService.ScratchVersions(uuid)
+			if err != nil {
+				return err
+			}
+			m, err := json.MarshalIndent(nodes, "", "  ")
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m) + "\n"
+		case "aliases":
+			aliases, err := runningService.Aliases(uuid)
+			if err != nil {
+				return err
+			}
+			m, err := json.MarshalIndent(aliases, "", "  ")
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m) + "\n"
+		case "alias":
+			var alias string
+			cmd.CommandArgs(3, &alias, &dataname)
+			if dataname == "" {
+				return fmt.Errorf("Usage: dataset <UUID> alias <alias> <data name>")
+			}
+			text, err := setAlias(nil, uuid, dvid.DataString(alias), dvid.DataString(dataname))
+			if err != nil {
+				return err
+			}
+			reply.Text = text + "\n"
+		case "unalias":
+			var alias string
+			cmd.CommandArgs(3, &alias)
+			text, err := deleteAlias(nil, uuid, dvid.DataString(alias))
+			if err != nil {
+				return err
+			}
+			reply.Text = text + "\n"
+		case "templates":
+			templates, err := runningService.Templates(uuid)
+			if err != nil {
+				return err
+			}
+			m, err := json.MarshalIndent(templates, "", "  ")
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m) + "\n"
+		case "template":
+			var name string
+			cmd.CommandArgs(3, &name)
+			if name == "" || len(cmd.Input) == 0 {
+				return fmt.Errorf("Usage: dataset <UUID> template <name> -stdin < template.json")
+			}
+			var t datastore.Template
+			if err := json.Unmarshal(cmd.Input, &t); err != nil {
+				return fmt.Errorf("Bad template JSON: %s", err.Error())
+			}
+			t.Name = name
+			if err := runningService.SetTemplate(uuid, &t); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Template %q with %d instances saved\n", name, len(t.Instances))
+		case "delete-template":
+			var name string
+			cmd.CommandArgs(3, &name)
+			if err := runningService.DeleteTemplate(uuid, name); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Template %q deleted\n", name)
+		case "init-template":
+			var name string
+			cmd.CommandArgs(3, &name)
+			created, err := runningService.InitTemplate(uuid, name)
+			for _, dataname := range created {
+				reply.Text += fmt.Sprintf("Data %q added to node %s\n", dataname, uuidStr)
+			}
+			if err != nil {
+				return err
+			}
+		case "trash":
+			entries, err := runningService.Trash(uuid)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				reply.Text += fmt.Sprintf("%s [%s] deleted %s\n", entry.Name, entry.TypeName,
+					entry.Deleted.Format(time.RFC3339))
+			}
+		case "restore":
+			cmd.CommandArgs(3, &dataname)
+			if err := runningService.RestoreData(uuid, dvid.DataString(dataname)); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q restored from the trash\n", dataname)
+		case "purge":
+			cmd.CommandArgs(3, &dataname)
+			deleted, err := runningService.PurgeData(uuid, dvid.DataString(dataname))
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q purged: reclaimed %d keys of %d bytes\n", dataname,
+				deleted.Keys, deleted.Bytes)
 		default:
 			dataname := dvid.DataString(subcommand)
 			dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
@@ -149,6 +381,9 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	case "node":
 		var uuidStr, descriptor string
 		cmd.CommandArgs(1, &uuidStr, &descriptor)
+		if forwarded, err := forwardToOwner(cmd, reply, uuidStr); forwarded {
+			return err
+		}
 		uuid, err := MatchingUUID(uuidStr)
 		if err != nil {
 			return err
@@ -159,12 +394,62 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 			if err != nil {
 				return err
 			}
+			onCommit(uuid)
 		case "branch":
 			newuuid, err := runningService.NewVersion(uuid)
 			if err != nil {
 				return err
 			}
 			reply.Text = string(newuuid)
+		case "scratch":
+			idleStr, _, err := cmd.Settings().GetString("idle")
+			if err != nil {
+				return err
+			}
+			idle, err := parseScratchIdle(idleStr)
+			if err != nil {
+				return err
+			}
+			scratch, err := runningService.NewScratchVersion(uuid, idle)
+			if err != nil {
+				return err
+			}
+			reply.Text = string(scratch)
+		case "delete-scratch":
+			deleted, err := runningService.DeleteScratchVersion(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Deleted scratch node %s: reclaimed %d keys of %d bytes\n",
+				deleted.Node, deleted.Keys, deleted.Bytes)
+		case "publish":
+			manifest, err := runningService.Publish(uuid, cmd.Input)
+			if err != nil {
+				return err
+			}
+			m, err := json.MarshalIndent(manifest, "", "  ")
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m) + "\n"
+		case "validate":
+			related, err := parseValidationRelated(cmd.Input)
+			if err != nil {
+				return err
+			}
+			job := StartValidationJob(uuid, related)
+			reply.Text = fmt.Sprintf("Started job %d to validate node %s.  Use 'dvid jobs %d' for progress.\n",
+				job.ID, uuid, job.ID)
+		case "validation":
+			report, err := latestValidation(uuid)
+			if err != nil {
+				return err
+			}
+			m, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m) + "\n"
 
 		default:
 			dataname := dvid.DataString(descriptor)
@@ -178,8 +463,131 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 				reply.Text = dataservice.Help()
 				return nil
 			}
-			return dataservice.DoRPC(cmd, reply)
+			if !isReadOnlyCommand(cmd) {
+				if err := runningService.WritesBlocked(uuid); err != nil {
+					return err
+				}
+				writeDone, err := runningService.BeginWrite(uuid)
+				if err != nil {
+					return err
+				}
+				defer writeDone()
+			}
+			ctx, cancel := commandContext(cmd)
+			defer cancel()
+			return doIdempotent(cmd, reply, uuid, dataname, func() error {
+				return dataservice.DoRPC(cmd.WithContext(ctx), reply)
+			})
+		}
+
+	case "thumbnails":
+		var uuidStr string
+		cmd.CommandArgs(1, &uuidStr)
+		var uuid dvid.UUID
+		if uuidStr != "" {
+			var err error
+			if uuid, err = MatchingUUID(uuidStr); err != nil {
+				return err
+			}
+		}
+		job := StartThumbnailJob(uuid)
+		reply.Text = fmt.Sprintf("Started job %d to generate thumbnails.  Use 'dvid jobs %d' for progress.\n",
+			job.ID, job.ID)
+
+	case "upload":
+		return uploadCommand(cmd, reply)
+
+	case "complete":
+		if candidates := completeCommand(cmd.Command[1:]); len(candidates) != 0 {
+			reply.Text = strings.Join(candidates, "\n") + "\n"
+		}
+
+	case "benchmark":
+		var subcommand string
+		cmd.CommandArgs(1, &subcommand)
+		if subcommand == "help" {
+			reply.Text = BenchmarkHelp
+			return nil
+		}
+		text, err := benchmarkCommand(serverCtx, cmd.Settings())
+		if err != nil {
+			return err
+		}
+		reply.Text = text
+
+	case "pull":
+		var uuidStr, syncedStr string
+		cmd.CommandArgs(1, &uuidStr, &syncedStr)
+		if syncedStr == "" {
+			return fmt.Errorf("Usage: pull <UUID> <synced UUID>")
+		}
+		synced, err := MatchingUUID(syncedStr)
+		if err != nil {
+			return err
+		}
+		stats, err := PullDelta(dvid.UUID(uuidStr), synced)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Pulled %d keys (%d bytes) in %d versions\n", stats.Keys,
+			stats.Bytes, stats.Versions)
+
+	case "mirror":
+		var remoteURL, uuidStr, dataName string
+		cmd.CommandArgs(1, &remoteURL, &uuidStr, &dataName)
+		if dataName == "" {
+			return fmt.Errorf("Usage: mirror <remote URL> <UUID> <data name> [local=<UUID>] [name=<data name>]")
+		}
+		settings := cmd.Settings()
+		localStr, found, err := settings.GetString("local")
+		if err != nil {
+			return err
+		}
+		if !found {
+			localStr = uuidStr
+		}
+		uuid, err := MatchingUUID(localStr)
+		if err != nil {
+			return err
+		}
+		name, found, err := settings.GetString("name")
+		if err != nil {
+			return err
+		}
+		if !found {
+			name = dataName
+		}
+		requests, _, err := settings.GetInt("requests")
+		if err != nil {
+			return err
+		}
+		remote, err := NewMirrorSource(remoteURL, dvid.UUID(uuidStr), dvid.DataString(dataName), requests)
+		if err != nil {
+			return err
+		}
+		job, err := StartMirrorJob(remote, uuid, dvid.DataString(name), settings)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Started job %d to mirror %s into %q.  Use 'dvid jobs %d' for progress.\n",
+			job.ID, remote, name, job.ID)
+
+	case "jobs":
+		var idStr string
+		cmd.CommandArgs(1, &idStr)
+		if idStr == "" {
+			reply.Text = jobsText(Jobs())
+			return nil
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("Bad job ID %q", idStr)
+		}
+		job, err := GetJob(id)
+		if err != nil {
+			return err
 		}
+		reply.Text = jobsText([]*Job{job})
 
 	default:
 		return fmt.Errorf("Unknown command: '%s'", cmd)
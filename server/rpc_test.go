@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *ServerSuite) TestCommandContext(c *C) {
+	// Timings of the command are kept in the context passed to data services.
+	reqCtx, timings := dvid.WithTimings(context.Background())
+	cmd := datastore.Request{Command: dvid.Command{"node", "3f8c", "grayscale", "put"}}.WithContext(reqCtx)
+	ctx, cancel := commandContext(cmd)
+	dvid.AddTiming(ctx, dvid.StorageTime, time.Now().Add(-time.Millisecond))
+	c.Assert(timings.Milliseconds()[dvid.StorageTime] > 0, Equals, true)
+	c.Assert(ctx.Err(), IsNil)
+	cancel()
+	c.Assert(ctx.Err(), NotNil)
+	c.Assert(reqCtx.Err(), IsNil)
+}
@@ -0,0 +1,96 @@
+/*
+	This file handles scratch nodes, ephemeral children of a locked node for trying out
+	writes.  Scratch nodes are hidden from dataset listings and deleted with their keys
+	once they haven't been requested for their idle period, ScratchIdle by default.
+
+	POST   /api/node/<UUID>/scratch[?idle=<duration>]   Creates a scratch child of the node.
+	DELETE /api/node/<UUID>/scratch                     Deletes a scratch node now.
+	GET    /api/dataset/<UUID>/scratch                  Lists the dataset's scratch nodes.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ScratchIdle is how long a scratch node can go unused before it's deleted, unless an
+// idle period is given when it's created.
+var ScratchIdle = datastore.DefaultScratchIdle
+
+// parseScratchIdle returns the idle period given by a duration string like "30m", or
+// ScratchIdle if the string is empty.
+func parseScratchIdle(s string) (time.Duration, error) {
+	if s == "" {
+		return ScratchIdle, nil
+	}
+	idle, err := time.ParseDuration(s)
+	if err != nil || idle <= 0 {
+		return 0, fmt.Errorf("Bad idle period %q: must be a positive duration like \"30m\"", s)
+	}
+	return idle, nil
+}
+
+// deleteIdleScratch deletes scratch nodes that have been idle past their idle period,
+// logging the space reclaimed.
+func deleteIdleScratch(now time.Time) {
+	deleted, err := runningService.DeleteIdleScratch(now)
+	for _, d := range deleted {
+		dvid.Log(dvid.Normal, "Deleted idle scratch node %s in dataset %s: reclaimed %d keys of %d bytes\n",
+			d.Node, d.Dataset, d.Keys, d.Bytes)
+	}
+	if err != nil {
+		dvid.Error("Unable to delete idle scratch nodes: %s\n", err.Error())
+	}
+}
+
+// scratchRequest handles the /api/node/<UUID>/scratch endpoint.
+func scratchRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	switch strings.ToLower(r.Method) {
+	case "post":
+		idle, err := parseScratchIdle(r.URL.Query().Get("idle"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		scratch, err := runningService.NewScratchVersion(uuid, idle)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %q}", "Scratch", scratch)
+	case "delete":
+		deleted, err := runningService.DeleteScratchVersion(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deleted)
+	default:
+		BadRequest(w, r, "Scratch nodes are created with HTTP POST and deleted with HTTP DELETE")
+	}
+}
+
+// scratchListRequest handles GET /api/dataset/<UUID>/scratch.
+func scratchListRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Scratch nodes can only be listed with HTTP GET method")
+		return
+	}
+	nodes, err := runningService.ScratchVersions(uuid)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
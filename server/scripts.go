@@ -0,0 +1,296 @@
+/*
+	This file handles script hooks, which let administrators transform the values read
+	from or written to a data instance with small sandboxed scripts, e.g., to redact a
+	region or remap label IDs, without recompiling DVID.  Read hooks transform the replies
+	to successful GET requests and write hooks transform the bodies of POST and PUT
+	requests before the data sees them.  When several hooks apply, they run in order of
+	name.  See dvid/script.go for writing scripts.
+
+	GET /api/scripts              Returns all script hooks.
+	POST /api/scripts             Registers or replaces a hook given a JSON object with
+	                              "name", "dataset" (a UUID in the dataset), "data",
+	                              "event" ("read" or "write"), optional "endpoints", e.g.,
+	                              ["raw", "label"], and the script "source".
+	GET /api/scripts/<name>       Returns a hook.
+	DELETE /api/scripts/<name>    Removes a hook.
+
+	If authentication is configured, only members of the OIDC AdminGroups may use these
+	endpoints.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// compiledHook is a hook with its compiled script.
+type compiledHook struct {
+	*datastore.ScriptHook
+	script *dvid.Script
+}
+
+var scriptHooks struct {
+	sync.RWMutex
+	byName map[string]*compiledHook
+}
+
+// setScriptHook compiles a hook's script and makes it active, replacing any hook with
+// the same name.
+func setScriptHook(hook *datastore.ScriptHook) error {
+	script, err := dvid.CompileScript(hook.Name, hook.Source)
+	if err != nil {
+		return err
+	}
+	scriptHooks.Lock()
+	defer scriptHooks.Unlock()
+	if scriptHooks.byName == nil {
+		scriptHooks.byName = make(map[string]*compiledHook)
+	}
+	scriptHooks.byName[hook.Name] = &compiledHook{hook, script}
+	return nil
+}
+
+// loadScriptHooks makes the stored hooks active.  Hooks whose scripts don't compile,
+// e.g., because DVID was built without script support, are logged and skipped.
+func loadScriptHooks() {
+	hooks, err := runningService.ScriptHooks()
+	if err != nil {
+		dvid.Error("Unable to load script hooks: %s\n", err.Error())
+		return
+	}
+	for _, hook := range hooks {
+		if err := setScriptHook(hook); err != nil {
+			dvid.Error("Unable to activate script hook %q: %s\n", hook.Name, err.Error())
+		}
+	}
+}
+
+// matchingHooks returns the active hooks for an event and endpoint of data in a dataset,
+// ordered by name.
+func matchingHooks(root dvid.UUID, name dvid.DataString, event, endpoint string) []*compiledHook {
+	scriptHooks.RLock()
+	defer scriptHooks.RUnlock()
+	var hooks []*compiledHook
+	for _, hook := range scriptHooks.byName {
+		if hook.Dataset == root && hook.Data == name && hook.Applies(event, endpoint) {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Name < hooks[j].Name })
+	return hooks
+}
+
+// runHooks passes a value through each hook's script in turn.
+func runHooks(r *http.Request, hooks []*compiledHook, value []byte, req dvid.ScriptRequest) ([]byte, error) {
+	for _, hook := range hooks {
+		var err error
+		if value, err = hook.script.Transform(r.Context(), value, req); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// scriptWriter holds a reply so read hooks can transform it before it's sent.  Replies
+// larger than scripts can be given are refused as they're written.
+type scriptWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *scriptWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *scriptWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.tooLarge || w.body.Len()+len(b) > dvid.ScriptMaxBytes {
+		w.tooLarge = true
+		w.body.Reset()
+		return 0, fmt.Errorf("Reply is more than the %d bytes scripts can transform", dvid.ScriptMaxBytes)
+	}
+	return w.body.Write(b)
+}
+
+// scriptHTTP applies the hooks of a request to data at a version, given the name of the
+// data after resolving any alias or prefix of the request.  Write hooks replace
+// the request body.  If read hooks apply, the returned writer holds the reply until the
+// returned function transforms and sends it.  It returns false if the request failed.
+func scriptHTTP(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, name dvid.DataString,
+	parts []string) (http.ResponseWriter, *http.Request, func(), bool) {
+
+	noop := func() {}
+	var event string
+	switch r.Method {
+	case "GET":
+		event = datastore.ScriptRead
+	case "POST", "PUT":
+		event = datastore.ScriptWrite
+	default:
+		return w, r, noop, true
+	}
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		return w, r, noop, true
+	}
+	var endpoint string
+	var path []string
+	if len(parts) > 2 {
+		endpoint, path = parts[2], parts[3:]
+	}
+	hooks := matchingHooks(dataset.Root, name, event, endpoint)
+	if len(hooks) == 0 {
+		return w, r, noop, true
+	}
+	req := dvid.ScriptRequest{Method: r.Method, UUID: uuid, Data: name, Endpoint: endpoint, Path: path,
+		Query: make(map[string]string)}
+	for key, values := range r.URL.Query() {
+		req.Query[key] = values[0]
+	}
+
+	if event == datastore.ScriptWrite {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(dvid.ScriptMaxBytes)+1))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return w, r, noop, false
+		}
+		body, err = runHooks(r, hooks, body, req)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return w, r, noop, false
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		return w, r, noop, true
+	}
+
+	sw := &scriptWriter{ResponseWriter: w}
+	return sw, r, func() {
+		if sw.tooLarge {
+			message := fmt.Sprintf("Reply to %s is more than the %d bytes scripts can transform",
+				r.URL.Path, dvid.ScriptMaxBytes)
+			dvid.Error("%s\n", message)
+			w.Header().Del("Content-Length")
+			http.Error(w, message, http.StatusInternalServerError)
+			return
+		}
+		if sw.status != 0 && sw.status != http.StatusOK {
+			w.WriteHeader(sw.status)
+			w.Write(sw.body.Bytes())
+			return
+		}
+		value, err := runHooks(r, hooks, sw.body.Bytes(), req)
+		if err != nil {
+			dvid.Error("Unable to transform reply to %s: %s\n", r.URL.Path, err.Error())
+			w.Header().Del("Content-Length")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Del("Content-Length")
+		w.Write(value)
+	}, true
+}
+
+// scriptsRequest handles the /api/scripts endpoints.
+func scriptsRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !adminRequest(w, r) {
+		return
+	}
+	action := strings.ToLower(r.Method)
+	var result interface{}
+	switch {
+	case len(parts) == 1 && action == "get":
+		hooks, err := runningService.ScriptHooks()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		result = hooks
+
+	case len(parts) == 1 && action == "post":
+		var config struct {
+			Name      string   `json:"name"`
+			Dataset   string   `json:"dataset"`
+			Data      string   `json:"data"`
+			Event     string   `json:"event"`
+			Endpoints []string `json:"endpoints"`
+			Source    string   `json:"source"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad script hook JSON: %s", err.Error()))
+			return
+		}
+		uuid, err := MatchingUUID(config.Dataset)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		// Hooks match the data's name, not an alias of it.
+		dataservice, err := runningService.DataServiceByUUID(uuid, dvid.DataString(config.Data))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		hook := &datastore.ScriptHook{Name: config.Name, Dataset: uuid, Data: dataservice.DataName(),
+			Event: config.Event, Endpoints: config.Endpoints, Source: config.Source}
+		if _, err := dvid.CompileScript(hook.Name, hook.Source); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		if err := runningService.PutScriptHook(hook); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		if err := setScriptHook(hook); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		dvid.Log(dvid.Normal, "Set %s script hook %q on data %q of dataset %s\n", hook.Event, hook.Name,
+			hook.Data, hook.Dataset)
+		result = hook
+
+	case len(parts) == 2 && action == "get":
+		hook, err := runningService.GetScriptHook(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result = hook
+
+	case len(parts) == 2 && action == "delete":
+		hook, err := runningService.DeleteScriptHook(parts[1])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		scriptHooks.Lock()
+		delete(scriptHooks.byName, hook.Name)
+		scriptHooks.Unlock()
+		dvid.Log(dvid.Normal, "Removed script hook %q\n", hook.Name)
+		result = hook
+
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET or POST /api/scripts or GET or DELETE /api/scripts/<name>")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *ServerSuite) TestScriptWriterLimit(c *C) {
+	defer func(max int) { dvid.ScriptMaxBytes = max }(dvid.ScriptMaxBytes)
+	dvid.ScriptMaxBytes = 10
+
+	w := &scriptWriter{ResponseWriter: httptest.NewRecorder()}
+	n, err := w.Write(make([]byte, 6))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 6)
+
+	// The reply isn't buffered past the limit.
+	_, err = w.Write(make([]byte, 6))
+	c.Assert(err, NotNil)
+	c.Assert(w.tooLarge, Equals, true)
+	c.Assert(w.body.Len(), Equals, 0)
+	_, err = w.Write(make([]byte, 1))
+	c.Assert(err, NotNil)
+}
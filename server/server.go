@@ -2,6 +2,7 @@ package server
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -56,14 +57,10 @@ var (
 	// Running tally of active handlers up to the last second
 	curActiveHandlers int
 
-	// MaxChunkHandlers sets the maximum number of chunk handlers (goroutines) that
-	// can be multiplexed onto available cores.  (See -numcpu setting in dvid.go)
+	// MaxChunkHandlers sets the default number of chunk handlers (goroutines) in each
+	// datatype's handler pool.  (See -numcpu setting in dvid.go and HandlerPoolFor())
 	MaxChunkHandlers = runtime.NumCPU()
 
-	// HandlerToken is buffered channel to limit spawning of goroutines.
-	// See ProcessChunk() in datatype/voxels for example.
-	HandlerToken = make(chan int, MaxChunkHandlers)
-
 	// SpawnGoroutineMutex is a global lock for compute-intense processes that want to
 	// spawn goroutines that consume handler tokens.  This lets processes capture most
 	// if not all available handler tokens in a FIFO basis rather than have multiple
@@ -73,17 +70,39 @@ var (
 	// Timeout in seconds for waiting to open a datastore for exclusive access.
 	TimeoutSecs int
 
+	// RequestTimeoutSecs is the default number of seconds allowed for a HTTP API request
+	// before its processing is canceled.  Zero means no timeout.
+	RequestTimeoutSecs int
+
+	// HTTPIdleTimeout is how long a keep-alive connection waits for its next request
+	// before it's closed.
+	HTTPIdleTimeout = 2 * time.Minute
+
+	// HTTP2MaxStreams is the number of concurrent requests, e.g., tile GETs, a client can
+	// make over one HTTP/2 connection.
+	HTTP2MaxStreams = 1000
+
+	// HTTP2HeaderTableSize is the size in bytes of the tables compressing the headers
+	// of each HTTP/2 connection, which are nearly identical across tile requests.
+	HTTP2HeaderTableSize = 64 * 1024
+
+	// TLSCertFile and TLSKeyFile, if set, serve HTTP over TLS, which browsers require
+	// before using HTTP/2.
+	TLSCertFile, TLSKeyFile string
+
+	// DataReapInterval is how often data instances past their TTL or trash retention,
+	// and idle scratch nodes, are deleted.
+	DataReapInterval = time.Minute
+
+	// serverCtx is canceled on shutdown so long-running commands stop early.
+	serverCtx, cancelServer = context.WithCancel(context.Background())
+
 	// Keep track of the startup time for uptime.
 	startupTime time.Time = time.Now()
 )
 
 func init() {
-	// Initialize the number of handler tokens available.
-	for i := 0; i < MaxChunkHandlers; i++ {
-		HandlerToken <- 1
-	}
-
-	// Monitor the handler token load, resetting every second.
+	// Monitor the handler load, resetting every second.
 	loadCheckTimer := time.Tick(10 * time.Millisecond)
 	ticks := 0
 	go func() {
@@ -94,7 +113,7 @@ func init() {
 				ActiveHandlers = curActiveHandlers
 				curActiveHandlers = 0
 			}
-			numHandlers := MaxChunkHandlers - len(HandlerToken)
+			numHandlers := totalHandlerStats().Active
 			if numHandlers > curActiveHandlers {
 				curActiveHandlers = numHandlers
 			}
@@ -169,12 +188,20 @@ func StorageEngine() (storage.Engine, error) {
 // This may not be so graceful if the chunk handler uses cgo since the interrupt
 // may be caught during cgo execution.
 func Shutdown() {
+	cancelServer()
+	if err := saveJobCheckpoints(); err != nil {
+		log.Printf("Unable to save checkpoints of interrupted jobs: %s\n", err.Error())
+	}
+	backupMetadata()
+	if err := saveUsage(); err != nil {
+		log.Printf("Unable to save read counts: %s\n", err.Error())
+	}
 	if runningService.Service != nil {
 		runningService.Service.Shutdown()
 	}
 	waits := 0
 	for {
-		active := MaxChunkHandlers - len(HandlerToken)
+		active := totalHandlerStats().Active
 		if waits >= 20 {
 			log.Printf("Already waited for 20 seconds.  Continuing with shutdown...")
 			break
@@ -209,6 +236,16 @@ func OpenDatastore(datastorePath string) (service *Service, err error) {
 		err = openErr
 		return
 	}
+	runningService.DatastorePath = datastorePath
+
+	// Quickly check the consistency of dataset metadata.
+	if problems := runningService.QuickCheck(); len(problems) > 0 {
+		for _, problem := range problems {
+			dvid.Error("Datastore check: %s\n", problem)
+		}
+		dvid.Error("Found %d problems in datastore at %s.  Stop the server and run \"dvid fsck\" to repair them.\n",
+			len(problems), datastorePath)
+	}
 	runningService.ErrorLogDir = filepath.Dir(datastorePath)
 
 	service = &runningService
@@ -223,6 +260,9 @@ type Service struct {
 	// The currently opened DVID datastore
 	*datastore.Service
 
+	// The path of the opened datastore
+	DatastorePath string
+
 	// Error log directory
 	ErrorLogDir string
 
@@ -283,10 +323,58 @@ func (service *Service) Serve(webAddress, webClientDir, rpcAddress string) error
 	}
 	dvid.SetErrorLoggingFile(file)
 
+	// Join a cluster if requested, registering the addresses that will be served, which
+	// must be given since the defaults can't be reached by other members.
+	if IsClustered() {
+		for _, address := range []string{webAddress, rpcAddress} {
+			if err := checkMemberAddress(address); err != nil {
+				return err
+			}
+		}
+		runningService.WebAddress, runningService.RPCAddress = webAddress, rpcAddress
+		go runClusterMember()
+	}
+
+	// Export traces of requests to a collector.
+	startTracing()
+
+	// Monitor free disk space, refusing writes when nearly full.
+	checkDiskSpace()
+	go runDiskMonitor()
+
+	// Delete data instances as their TTLs expire and scratch nodes once idle.
+	go runDataReaper()
+
+	// Delete audit entries past their retention.
+	go runAuditReaper()
+
+	// Back up dataset metadata as it changes.
+	go runMetadataBackup()
+
+	// Keep read counts across restarts.
+	go runUsageSaver()
+
+	// Delete the saved results of idempotent requests once they expire.
+	go runIdempotencySweeper()
+
+	// Restart ingests and exports interrupted by the last shutdown.
+	resumeJobs()
+
+	// Activate the stored script hooks.
+	loadScriptHooks()
+
+	// Generate thumbnails of all datasets for the web console.
+	if Thumbnails {
+		StartThumbnailJob("")
+	}
+
 	// Launch the web server
 	go runningService.ServeHttp(webAddress, webClientDir)
 
-	// Launch the rpc server
+	// Launch the admin rpc server, if any, and the rpc server
+	if err := runningService.ServeAdminRpc(); err != nil {
+		log.Fatalln(err.Error())
+	}
 	err = runningService.ServeRpc(rpcAddress)
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -295,6 +383,31 @@ func (service *Service) Serve(webAddress, webClientDir, rpcAddress string) error
 	return nil
 }
 
+// runDataReaper deletes expired data instances, purges expired trash, and deletes idle
+// scratch nodes every DataReapInterval until the server shuts down, logging the space
+// reclaimed.
+func runDataReaper() {
+	ticker := time.NewTicker(DataReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		deleted, err := runningService.DeleteExpiredData(time.Now())
+		for _, d := range deleted {
+			dvid.Log(dvid.Normal, "Deleted expired data '%s' in dataset %s: reclaimed %d keys of %d bytes\n",
+				d.Name, d.Dataset, d.Keys, d.Bytes)
+		}
+		if err != nil {
+			dvid.Error("Unable to delete expired data: %s\n", err.Error())
+		}
+		purgeExpiredTrash(time.Now())
+		deleteIdleScratch(time.Now())
+	}
+}
+
 // Wrapper function so that http handlers recover from panics gracefully
 // without crashing the entire program.  The error message is written to
 // the log.
@@ -311,10 +424,31 @@ func logHttpPanics(handler func(http.ResponseWriter, *http.Request)) func(http.R
 	}
 }
 
-// Listen and serve HTTP requests using address and don't let stay-alive
-// connections hog goroutines for more than an hour.
+// newWebServer returns a HTTP server for address that speaks HTTP/2, over TLS or to
+// clients like proxies that know to use it without TLS, so the many small requests of
+// tile viewers share a few connections with compressed headers.  Idle keep-alive
+// connections are closed after HTTPIdleTimeout so they don't hog goroutines.
 // See for discussion:
 // http://stackoverflow.com/questions/10971800/golang-http-server-leaving-open-goroutines
+func newWebServer(address string) *http.Server {
+	src := &http.Server{
+		Addr:        address,
+		ReadTimeout: 1 * time.Hour,
+		IdleTimeout: HTTPIdleTimeout,
+		Protocols:   new(http.Protocols),
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams:      HTTP2MaxStreams,
+			MaxDecoderHeaderTableSize: HTTP2HeaderTableSize,
+			MaxEncoderHeaderTableSize: HTTP2HeaderTableSize,
+		},
+	}
+	src.Protocols.SetHTTP1(true)
+	src.Protocols.SetHTTP2(true)
+	src.Protocols.SetUnencryptedHTTP2(true)
+	return src
+}
+
+// Listen and serve HTTP requests using address.
 func (service *Service) ServeHttp(address, clientDir string) {
 	if address == "" {
 		address = DefaultWebAddress
@@ -323,20 +457,36 @@ func (service *Service) ServeHttp(address, clientDir string) {
 	service.WebClientPath = clientDir
 	fmt.Printf("Web server listening at %s ...\n", address)
 
-	src := &http.Server{
-		Addr:        address,
-		ReadTimeout: 1 * time.Hour,
+	src := newWebServer(address)
+	src.Handler = filterAccess(service.newWebMux(clientDir), "")
+
+	// Serve it up!
+	var err error
+	if TLSCertFile != "" {
+		err = src.ListenAndServeTLS(TLSCertFile, TLSKeyFile)
+	} else {
+		err = src.ListenAndServe()
 	}
+	if err != nil && err != http.ErrServerClosed {
+		dvid.Error("Web server at %s stopped: %s\n", address, err.Error())
+	}
+}
+
+// newWebMux returns the handlers of the web server.  It's separate from the handlers of
+// the RPC ports so each port only serves its own requests and is checked against its own
+// access rules.
+func (service *Service) newWebMux(clientDir string) *http.ServeMux {
+	mux := http.NewServeMux()
 
 	// Handle RAML interface
-	http.HandleFunc("/interface/raw", logHttpPanics(service.interfaceHandler))
-	http.HandleFunc("/interface/version", logHttpPanics(versionHandler))
-	http.HandleFunc("/interface", logHttpPanics(service.apiHelpHandler))
+	mux.HandleFunc("/interface/raw", logHttpPanics(service.interfaceHandler))
+	mux.HandleFunc("/interface/version", logHttpPanics(versionHandler))
+	mux.HandleFunc("/interface", logHttpPanics(service.apiHelpHandler))
 
 	// Handle Level 2 REST API.
-	http.HandleFunc(WebAPIPath, logHttpPanics(apiHandler))
+	mux.HandleFunc(WebAPIPath, logHttpPanics(apiHandler))
 
-	// http.HandleFunc(WebAPIPath, logHttpPanics(makeGzipHandler(apiHandler)))
+	// mux.HandleFunc(WebAPIPath, logHttpPanics(makeGzipHandler(apiHandler)))
 	//
 	// Could wrap HTTP handler with Gzip handler at this level, but it's too
 	// broad a brush.  Individual data types might already store gzipped or
@@ -353,10 +503,15 @@ func (service *Service) ServeHttp(address, clientDir string) {
 	} else {
 		dvid.Log(dvid.Normal, "Serving web pages from %s\n", clientDir)
 	}
-	http.HandleFunc("/", logHttpPanics(service.mainHandler))
+	mux.HandleFunc("/", logHttpPanics(service.mainHandler))
+	return mux
+}
 
-	// Serve it up!
-	src.ListenAndServe()
+// newRPCMux returns a handler that only serves the RPC server at the standard RPC path.
+func newRPCMux(server *rpc.Server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	return mux
 }
 
 // Listen and serve RPC requests using address.
@@ -367,14 +522,15 @@ func (service *Service) ServeRpc(address string) error {
 	service.RPCAddress = address
 	dvid.Log(dvid.Debug, "Rpc server listening at %s ...\n", address)
 
-	c := new(RPCConnection)
-	rpc.Register(c)
-	rpc.HandleHTTP()
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(new(RPCConnection)); err != nil {
+		return err
+	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
-	http.Serve(listener, nil)
+	http.Serve(listener, filterAccess(newRPCMux(rpcServer), "rpc"))
 	return nil
 }
 
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+// Each port only serves its own requests, so access rules can't be bypassed by making
+// a request through the other port.
+func (s *ServerSuite) TestPortsServeOwnRequests(c *C) {
+	defer SetAccessRules(nil)
+	c.Assert(SetAccessRules([]AccessRule{{Path: "rpc", Deny: []string{"192.0.2.0/24"}}}), IsNil)
+
+	dir := c.MkDir()
+	saved := runningService.WebClientPath
+	runningService.WebClientPath = dir
+	defer func() { runningService.WebClientPath = saved }()
+	service := &Service{WebClientPath: dir}
+	web := filterAccess(service.newWebMux(dir), "")
+	rpcPort := filterAccess(newRPCMux(rpc.NewServer()), "rpc")
+
+	// A client denied the RPC port can't reach RPC through the web port.
+	r := httptest.NewRequest("CONNECT", rpc.DefaultRPCPath, nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	w := httptest.NewRecorder()
+	web.ServeHTTP(w, r)
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "Connected"), Equals, false)
+
+	r = httptest.NewRequest("CONNECT", rpc.DefaultRPCPath, nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	w = httptest.NewRecorder()
+	rpcPort.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// The HTTP API isn't served on the RPC port.
+	r = httptest.NewRequest("GET", WebAPIPath+"server/info", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	w = httptest.NewRecorder()
+	rpcPort.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+// A request can shorten or lengthen the timeout but can't turn it off.
+func (s *ServerSuite) TestRequestTimeout(c *C) {
+	for _, bad := range []string{"0", "-1", "abc", "4294967296"} {
+		r := httptest.NewRequest("GET", WebAPIPath+"node/abc/data/raw?timeout="+bad, nil)
+		_, _, err := requestContext(r)
+		c.Assert(err, ErrorMatches, ".*must be a positive number of seconds.*")
+	}
+	r := httptest.NewRequest("GET", WebAPIPath+"node/abc/data/raw?timeout=5", nil)
+	ctx, cancel, err := requestContext(r)
+	c.Assert(err, IsNil)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	c.Assert(ok, Equals, true)
+}
@@ -0,0 +1,296 @@
+/*
+	This file logs requests slower than SlowQueryThreshold so operators can find and
+	reproduce them.  Each entry has a curl or dvid command that repeats the request and
+	a breakdown of the time spent reading and writing storage, decoding, and encoding.
+	Entries are appended as JSON lines to a log file that's rotated at SlowQueryMaxBytes,
+	and the most recent entries are kept in memory for the admin endpoint.
+
+	GET /api/server/slowqueries[?limit=<number>]   Returns recent slow requests, newest first.
+
+	If authentication is configured, only members of the OIDC AdminGroups may get slow requests.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// SlowQueryLogFilename is the default slow query log, stored in the datastore directory.
+	SlowQueryLogFilename = "dvid-slow-queries.log"
+
+	// SlowQueriesKept is the number of recent slow requests kept for the admin endpoint.
+	SlowQueriesKept = 1000
+)
+
+var (
+	// SlowQueryThreshold is the latency above which requests are logged.  Zero turns off
+	// the slow query log.
+	SlowQueryThreshold time.Duration
+
+	// SlowQueryLog is the path of the slow query log.  If empty, it's SlowQueryLogFilename
+	// in the datastore directory.
+	SlowQueryLog string
+
+	// SlowQueryMaxBytes is the size at which the slow query log is rotated, keeping
+	// SlowQueryBackups older logs with suffixes ".1", ".2", etc.
+	SlowQueryMaxBytes int64 = 64 * dvid.Mega
+	SlowQueryBackups        = 3
+)
+
+// SlowQuery describes a request slower than SlowQueryThreshold.
+type SlowQuery struct {
+	Time         time.Time
+	Operation    string
+	User         string `json:",omitempty"`
+	Status       int
+	Milliseconds float64
+
+	// Breakdown gives the milliseconds spent in phases of the request, e.g., "storage".
+	Breakdown map[string]float64 `json:",omitempty"`
+
+	// Command reproduces the request.
+	Command string
+}
+
+var slowQueries struct {
+	sync.Mutex
+	recent []SlowQuery // ring buffer of the most recent entries
+	next   int
+	file   *os.File
+	size   int64
+}
+
+// recordSlowQuery appends a slow request to the log file and the recent entries.
+func recordSlowQuery(query SlowQuery) {
+	dvid.Log(dvid.Normal, "Slow request (%.0f ms): %s\n", query.Milliseconds, query.Operation)
+	line, err := json.Marshal(query)
+	if err != nil {
+		dvid.Error("Unable to encode slow request: %s\n", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	slowQueries.Lock()
+	defer slowQueries.Unlock()
+	if len(slowQueries.recent) < SlowQueriesKept {
+		slowQueries.recent = append(slowQueries.recent, query)
+	} else {
+		slowQueries.recent[slowQueries.next] = query
+	}
+	slowQueries.next = (slowQueries.next + 1) % SlowQueriesKept
+	if err := writeSlowQueryLog(line); err != nil {
+		dvid.Error("Unable to write slow query log: %s\n", err.Error())
+	}
+}
+
+// slowQueryLogPath returns the path of the slow query log.
+func slowQueryLogPath() string {
+	if SlowQueryLog != "" {
+		return SlowQueryLog
+	}
+	return filepath.Join(runningService.ErrorLogDir, SlowQueryLogFilename)
+}
+
+// writeSlowQueryLog appends a line to the slow query log, rotating it if it would exceed
+// SlowQueryMaxBytes.  The caller must hold the slowQueries lock.
+func writeSlowQueryLog(line []byte) error {
+	path := slowQueryLogPath()
+	if slowQueries.file != nil && slowQueries.size+int64(len(line)) > SlowQueryMaxBytes {
+		slowQueries.file.Close()
+		slowQueries.file = nil
+		for i := SlowQueryBackups; i > 0; i-- {
+			older := fmt.Sprintf("%s.%d", path, i-1)
+			if i == 1 {
+				older = path
+			}
+			os.Rename(older, fmt.Sprintf("%s.%d", path, i))
+		}
+		if SlowQueryBackups <= 0 {
+			os.Remove(path)
+		}
+	}
+	if slowQueries.file == nil {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		slowQueries.file, slowQueries.size = file, info.Size()
+	}
+	n, err := slowQueries.file.Write(line)
+	slowQueries.size += int64(n)
+	return err
+}
+
+// RecentSlowQueries returns up to limit of the most recent slow requests, newest first.
+// A limit of zero returns all kept requests.
+func RecentSlowQueries(limit int) []SlowQuery {
+	slowQueries.Lock()
+	defer slowQueries.Unlock()
+	n := len(slowQueries.recent)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	queries := make([]SlowQuery, 0, limit)
+	for i := 1; i <= limit; i++ {
+		queries = append(queries, slowQueries.recent[(slowQueries.next-i+n)%n])
+	}
+	return queries
+}
+
+// shellQuote quotes a string for POSIX shells.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./:=,@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// curlCommand returns a curl command reproducing a HTTP request.  Request bodies aren't
+// kept, so the command reads the body from a file named "body", and credentials are
+// left as a $TOKEN variable.
+func curlCommand(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = runningService.WebAddress
+	}
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	args := []string{"curl"}
+	if r.Method != "GET" {
+		args = append(args, "-X", r.Method)
+	}
+	if r.Header.Get("Authorization") != "" {
+		args = append(args, "-H", shellQuote("Authorization: Bearer $TOKEN"))
+	}
+	for _, header := range []string{"Content-Type", "Accept", "traceparent"} {
+		if value := r.Header.Get(header); value != "" {
+			args = append(args, "-H", shellQuote(header+": "+value))
+		}
+	}
+	if r.ContentLength != 0 && r.Method != "GET" && r.Method != "HEAD" {
+		args = append(args, "--data-binary", "@body")
+	}
+	args = append(args, shellQuote("http://"+host+r.URL.RequestURI()))
+	return strings.Join(args, " ")
+}
+
+// dvidCommand returns the dvid command line reproducing a RPC command.
+func dvidCommand(cmd datastore.Request) string {
+	args := []string{"dvid"}
+	if len(cmd.Input) > 0 {
+		args = append(args, "-stdin")
+	}
+	for _, arg := range cmd.Command {
+		args = append(args, shellQuote(arg))
+	}
+	if len(cmd.Input) > 0 {
+		args = append(args, "< input")
+	}
+	return strings.Join(args, " ")
+}
+
+// slowQueryHTTP times an API request that started at the given time, accumulating the
+// breakdown of its time, and returns the writer and request to use and a function that
+// logs the request if it was slow.
+func slowQueryHTTP(w http.ResponseWriter, r *http.Request, start time.Time) (http.ResponseWriter,
+	*http.Request, func()) {
+
+	if SlowQueryThreshold <= 0 {
+		return w, r, func() {}
+	}
+	ctx, timings := dvid.WithTimings(r.Context())
+	r = r.WithContext(ctx)
+	writer := &statusWriter{ResponseWriter: w}
+	return writer, r, func() {
+		elapsed := time.Since(start)
+		if elapsed < SlowQueryThreshold {
+			return
+		}
+		query := SlowQuery{
+			Time:         start,
+			Operation:    r.Method + " " + r.URL.RequestURI(),
+			Status:       writer.status,
+			Milliseconds: float64(elapsed) / float64(time.Millisecond),
+			Breakdown:    timings.Milliseconds(),
+			Command:      curlCommand(r),
+		}
+		if query.Status == 0 {
+			query.Status = http.StatusOK
+		}
+		if user := RequestUser(r); user != nil {
+			query.User = user.Name
+		}
+		recordSlowQuery(query)
+	}
+}
+
+// slowQueryCommand times a RPC command, returning the command to run and a function that
+// logs the command if it was slow.
+func slowQueryCommand(cmd datastore.Request) (datastore.Request, func(err error)) {
+	if SlowQueryThreshold <= 0 {
+		return cmd, func(error) {}
+	}
+	start := time.Now()
+	ctx, timings := dvid.WithTimings(cmd.Context())
+	return cmd.WithContext(ctx), func(err error) {
+		elapsed := time.Since(start)
+		if elapsed < SlowQueryThreshold {
+			return
+		}
+		query := SlowQuery{
+			Time:         start,
+			Operation:    "rpc " + cmd.String(),
+			Status:       http.StatusOK,
+			Milliseconds: float64(elapsed) / float64(time.Millisecond),
+			Breakdown:    timings.Milliseconds(),
+			Command:      dvidCommand(cmd),
+		}
+		if err != nil {
+			query.Status = http.StatusBadRequest
+		}
+		recordSlowQuery(query)
+	}
+}
+
+// slowQueriesRequest handles GET /api/server/slowqueries.
+func slowQueriesRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Slow queries can only be retrieved with HTTP GET method")
+		return
+	}
+	if !adminRequest(w, r) {
+		return
+	}
+	var limit int
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			BadRequest(w, r, fmt.Sprintf("Bad 'limit' %q", limitStr))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecentSlowQueries(limit))
+}
@@ -0,0 +1,128 @@
+/*
+	This file caps the bandwidth of replies to requests made with API keys that have a
+	bandwidth limit, so one collaborator pulling a full volume can't saturate the
+	uplink.  All concurrent requests with a key share its limit.  See apikeys.go for
+	assigning limits.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+)
+
+// bandwidthLimiter is a token bucket holding up to one second of a key's bandwidth.
+type bandwidthLimiter struct {
+	sync.Mutex
+	rate   int64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// chunkSize returns the most bytes to send at once, about a tenth of a second's worth,
+// so large replies are sent smoothly instead of in bursts.
+func (l *bandwidthLimiter) chunkSize() int {
+	l.Lock()
+	defer l.Unlock()
+	if size := int(l.rate / 10); size > 1024 {
+		return size
+	}
+	return 1024
+}
+
+// bandwidthLimiters holds the limiter of each API key with a bandwidth limit.
+var bandwidthLimiters struct {
+	sync.Mutex
+	byKey map[string]*bandwidthLimiter
+}
+
+// keyLimiter returns the limiter for a key, updating its rate if the key's limit changed.
+func keyLimiter(key *datastore.APIKey) *bandwidthLimiter {
+	bandwidthLimiters.Lock()
+	defer bandwidthLimiters.Unlock()
+	if bandwidthLimiters.byKey == nil {
+		bandwidthLimiters.byKey = make(map[string]*bandwidthLimiter)
+	}
+	l, found := bandwidthLimiters.byKey[key.ID]
+	if !found {
+		l = &bandwidthLimiter{rate: key.Bandwidth, tokens: float64(key.Bandwidth), last: time.Now()}
+		bandwidthLimiters.byKey[key.ID] = l
+		return l
+	}
+	l.Lock()
+	l.rate = key.Bandwidth
+	l.Unlock()
+	return l
+}
+
+// throttledWriter sends a reply no faster than its limiter allows.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+	ctx     context.Context
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	chunk := w.limiter.chunkSize()
+	for written < len(b) {
+		end := written + chunk
+		if end > len(b) {
+			end = len(b)
+		}
+		if wait := w.limiter.reserve(end - written); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+		n, err := w.ResponseWriter.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Flush sends buffered data to the client if the underlying writer can.
+func (w *throttledWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// throttleHTTP returns the writer for the reply to a request, which is throttled if the
+// request was made with an API key that has a bandwidth limit.
+func throttleHTTP(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	key := RequestAPIKey(r)
+	if key == nil || key.Bandwidth <= 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, limiter: keyLimiter(key), ctx: r.Context()}
+}
@@ -0,0 +1,188 @@
+/*
+	This file generates thumbnails of data for the dataset browser of the web console.
+	A thumbnail job walks datasets and stores a PNG for each data instance that can render
+	one, e.g., a composite of mid-slices of voxels at the dataset's latest locked node.
+	A JSON gallery listing the thumbnails is stored with them.  Thumbnails are stored by
+	the server apart from the dataset, so generating them doesn't add data to it.  When
+	Thumbnails is set, all datasets get thumbnails when the server starts, and a dataset's
+	thumbnails are regenerated when a node is locked.
+
+	GET  /api/dataset/<UUID>/gallery          Returns the gallery of the dataset as JSON.
+	GET  /api/dataset/<UUID>/gallery/<name>   Returns a thumbnail listed in the gallery.
+	POST /api/dataset/<UUID>/gallery          Starts a job regenerating the dataset's
+	                                          thumbnails.  Only admins may do this.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// GalleryKey is the name under which the gallery JSON is stored with the thumbnails.
+const GalleryKey = "gallery.json"
+
+var (
+	// Thumbnails turns on generating thumbnails of all datasets at startup and of a
+	// dataset whenever one of its nodes is locked.
+	Thumbnails bool
+
+	// ThumbnailSize is the maximum width and height in pixels of each image in a thumbnail.
+	ThumbnailSize = 256
+)
+
+// Thumbnailer is implemented by data that can render a preview image of a version.
+type Thumbnailer interface {
+	Thumbnail(ctx context.Context, uuid dvid.UUID, size int) (image.Image, error)
+}
+
+// GalleryEntry describes the thumbnail of a data instance.
+type GalleryEntry struct {
+	Name     dvid.DataString
+	TypeName dvid.TypeString
+	URL      string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// Gallery lists the thumbnails of a dataset.
+type Gallery struct {
+	Dataset    dvid.UUID
+	Node       dvid.UUID // node shown by the thumbnails
+	Generated  time.Time
+	Thumbnails []GalleryEntry
+}
+
+// GenerateGallery stores thumbnails of all data in the dataset holding the given UUID
+// at the dataset's latest locked node, returning the new gallery.  Data whose thumbnail
+// fails is listed with the error.
+func GenerateGallery(ctx context.Context, uuid dvid.UUID) (*Gallery, error) {
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	gallery := &Gallery{
+		Dataset:    dataset.Root,
+		Node:       dataset.LatestLocked(),
+		Generated:  time.Now(),
+		Thumbnails: []GalleryEntry{},
+	}
+	for _, name := range dataset.DataNames() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			return nil, err
+		}
+		thumbnailer, ok := dataservice.(Thumbnailer)
+		if !ok {
+			continue
+		}
+		entry := GalleryEntry{Name: name, TypeName: dataservice.DatatypeName()}
+		key := string(name) + ".png"
+		img, err := thumbnailer.Thumbnail(ctx, gallery.Node, ThumbnailSize)
+		var buf bytes.Buffer
+		if err == nil {
+			err = png.Encode(&buf, img)
+		}
+		if err == nil {
+			err = runningService.PutThumbnail(dataset.Root, key, buf.Bytes())
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.URL = fmt.Sprintf("%sdataset/%s/gallery/%s", WebAPIPath, dataset.Root, key)
+		}
+		gallery.Thumbnails = append(gallery.Thumbnails, entry)
+	}
+	m, err := json.Marshal(gallery)
+	if err != nil {
+		return nil, err
+	}
+	if err := runningService.PutThumbnail(dataset.Root, GalleryKey, m); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// StartThumbnailJob starts a job generating the thumbnails of the dataset holding the
+// given UUID or, if the UUID is empty, of all datasets.
+func StartThumbnailJob(uuid dvid.UUID) *Job {
+	var roots []dvid.UUID
+	description := "Generate thumbnails of all datasets"
+	if uuid == "" {
+		roots = runningService.Roots()
+	} else {
+		roots = []dvid.UUID{uuid}
+		description = fmt.Sprintf("Generate thumbnails of dataset with node %s", uuid)
+	}
+	job := NewJob(description)
+	go func() {
+		var firstErr error
+		for i, root := range roots {
+			if _, err := GenerateGallery(serverCtx, root); err != nil {
+				dvid.Error("Unable to generate thumbnails for dataset with node %s: %s\n", root, err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			job.SetProgress(float32(i+1) / float32(len(roots)))
+		}
+		job.Finish(firstErr)
+	}()
+	return job
+}
+
+// thumbnailsOnCommit regenerates the thumbnails of a dataset after one of its nodes
+// is locked if Thumbnails is set.
+func thumbnailsOnCommit(uuid dvid.UUID) {
+	if Thumbnails {
+		StartThumbnailJob(uuid)
+	}
+}
+
+// galleryRequest handles the /api/dataset/<UUID>/gallery endpoints.
+func galleryRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		dataset, err := runningService.DatasetFromUUID(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		name, contentType := GalleryKey, "application/json"
+		if len(parts) > 2 && parts[2] != "" {
+			name, contentType = parts[2], "image/png"
+		}
+		m, err := runningService.GetThumbnail(dataset.Root, name)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		if m == nil {
+			http.Error(w, fmt.Sprintf("No thumbnail %q for dataset %s", name, dataset.Root), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(m)
+	case "post":
+		if !adminRequest(w, r) {
+			return
+		}
+		job := StartThumbnailJob(uuid)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	default:
+		BadRequest(w, r, "Gallery requests must be GET or POST")
+	}
+}
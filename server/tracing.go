@@ -0,0 +1,294 @@
+/*
+	This file exports request traces to an OpenTelemetry collector using OTLP over HTTP
+	with JSON encoding.  When TraceEndpoint is set, each API request gets a span, continuing
+	the trace of a "traceparent" header if sent, with child spans for the data type handler
+	and storage calls.  The request's "traceparent" is returned in the response so clients
+	can find their trace.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// TraceBatchSize is the maximum number of spans sent to the collector at once.
+	TraceBatchSize = 512
+
+	// TraceQueueSize is the number of finished spans buffered for export.  Spans are
+	// dropped while the queue is full rather than slowing requests.
+	TraceQueueSize = 8192
+)
+
+var (
+	// TraceEndpoint is the base URL of an OTLP/HTTP collector, e.g., "http://otel:4318".
+	// If empty, requests aren't traced.
+	TraceEndpoint string
+
+	// TraceServiceName is the service name given to the collector.
+	TraceServiceName = "dvid"
+
+	// TraceFlushInterval is how often buffered spans are sent to the collector.
+	TraceFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter batches finished spans and sends them to an OTLP/HTTP collector.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	spans       chan *dvid.Span
+}
+
+// NewOTLPExporter returns an exporter sending to the collector at the given base URL.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		spans:       make(chan *dvid.Span, TraceQueueSize),
+	}
+}
+
+// ExportSpan queues a finished span for the collector.
+func (exporter *OTLPExporter) ExportSpan(span *dvid.Span) {
+	select {
+	case exporter.spans <- span:
+	default:
+	}
+}
+
+// Run sends queued spans in batches every TraceFlushInterval until the context is
+// done, then sends any remaining spans.
+func (exporter *OTLPExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(TraceFlushInterval)
+	defer ticker.Stop()
+	var batch []*dvid.Span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := exporter.Send(batch); err != nil {
+			dvid.Error("Unable to export %d trace spans: %s\n", len(batch), err.Error())
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-exporter.spans:
+			batch = append(batch, span)
+			if len(batch) >= TraceBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-ctx.Done():
+			for len(exporter.spans) > 0 {
+				batch = append(batch, <-exporter.spans)
+			}
+			send()
+			return
+		}
+	}
+}
+
+// Send posts spans to the collector.
+func (exporter *OTLPExporter) Send(spans []*dvid.Span) error {
+	m, err := json.Marshal(otlpRequest(exporter.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := exporter.client.Post(exporter.url, "application/json", bytes.NewReader(m))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector %s returned status %d", exporter.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of spans.  Trace and span IDs are hex and 64-bit integers are
+// strings, as required by OTLP/JSON.
+type (
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// OTLP span kinds and status codes.  Spans without errors have an unset status.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int, int32, int64, uint8, uint32, uint64:
+		s := fmt.Sprintf("%d", value)
+		v.IntValue = &s
+	case float32:
+		f := float64(value)
+		v.DoubleValue = &f
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprintf("%v", value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{key, v}
+}
+
+// otlpRequest returns the OTLP export request for spans of a service.
+func otlpRequest(serviceName string, spans []*dvid.Span) otlpTraces {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "github.com/janelia-flyem/dvid"
+	scope.Spans = make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: fmt.Sprintf("%d", span.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprintf("%d", span.End.UnixNano()),
+		}
+		if span.ParentID.IsValid() {
+			s.ParentSpanID = span.ParentID.String()
+		}
+		if strings.HasPrefix(span.Name, "HTTP ") {
+			s.Kind = otlpKindServer
+		}
+		for key, value := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttr(key, value))
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{otlpStatusError, span.Error}
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", serviceName)}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTraces{[]otlpResourceSpans{resource}}
+}
+
+// startTracing turns on tracing if TraceEndpoint is set, exporting spans until the
+// server shuts down.
+func startTracing() {
+	if TraceEndpoint == "" {
+		return
+	}
+	exporter := NewOTLPExporter(TraceEndpoint, TraceServiceName)
+	dvid.SetSpanExporter(exporter)
+	go exporter.Run(serverCtx)
+	dvid.Log(dvid.Normal, "Exporting traces to %s\n", exporter.url)
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// traceHTTP starts the span of an API request, continuing the trace of its "traceparent"
+// header, and returns the writer and request to use and a function ending the span.
+func traceHTTP(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	if !dvid.TracingEnabled() {
+		return w, r, func() {}
+	}
+	ctx := dvid.ContextWithTraceParent(r.Context(), r.Header.Get("traceparent"))
+	ctx, span := dvid.StartSpan(ctx, "HTTP "+r.Method)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	span.SetAttribute("net.peer.name", r.RemoteAddr)
+	w.Header().Set("traceparent", span.TraceParent())
+	writer := &statusWriter{ResponseWriter: w}
+	return writer, r.WithContext(ctx), func() {
+		status := writer.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("HTTP status %d", status))
+		}
+		span.Finish()
+	}
+}
+
+// traceDataHTTP handles a request with a data service inside a span for its data type.
+func traceDataHTTP(r *http.Request, typename dvid.TypeString, dataname dvid.DataString,
+	handle func(r *http.Request) error) error {
+
+	ctx, span := dvid.StartSpan(r.Context(), fmt.Sprintf("%s %s", typename, r.Method))
+	if span == nil {
+		return handle(r)
+	}
+	span.SetAttribute("dvid.datatype", string(typename))
+	span.SetAttribute("dvid.data", string(dataname))
+	err := handle(r.WithContext(ctx))
+	span.SetError(err)
+	span.Finish()
+	return err
+}
@@ -0,0 +1,392 @@
+/*
+	This file streams files from command-line clients to the server over RPC, so commands
+	can use files the server can't see without sending each file in one RPC message.
+	Files are sent as upload sessions (see uploads.go) in bounded chunks over parallel RPC
+	connections, and each chunk is verified against its SHA-256 checksum.
+
+	upload new                             Starts a session, returning its ID.
+	upload part <ID> <n> <SHA-256>         Stores the command's input as part n.
+	upload file <ID> <name>                Joins the parts into a file, returning its path.
+	upload remove <ID>                     Removes the session and its files.
+
+	Joining clears the parts, so the files matching an image glob are sent one after another
+	to a single session and the glob is then matched in the session's directory.  A command
+	whose InputUpload names a session receives the joined parts as its input, and the
+	session is then removed.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// DefaultTransferChunkSize is the size of chunks of files streamed to the server.
+	DefaultTransferChunkSize = 8 * dvid.Mega
+
+	// DefaultTransferConnections is the number of RPC connections streaming chunks.
+	DefaultTransferConnections = 4
+
+	// TransferRetries is the number of attempts made to send each chunk.
+	TransferRetries = 3
+)
+
+// File joins the parts of the upload into a file in the session's directory and returns
+// its path.  The parts are then cleared so another file can be sent.  The file is removed
+// with the session.
+func (upload *Upload) File(name string) (string, error) {
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, "part-") ||
+		strings.HasPrefix(name, "incoming-") {
+		return "", fmt.Errorf("Bad name %q for file of upload %s", name, upload.ID)
+	}
+	body, _, err := upload.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	path := filepath.Join(upload.dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("Error joining parts of upload %s: %s", upload.ID, err.Error())
+	}
+	upload.Lock()
+	for n := range upload.parts {
+		os.Remove(upload.partPath(n))
+	}
+	upload.parts = make(map[int]int64)
+	upload.Unlock()
+	return path, nil
+}
+
+// uploadCommand handles the "upload" commands.
+func uploadCommand(cmd datastore.Request, reply *datastore.Response) error {
+	var action, id, arg1, arg2 string
+	cmd.CommandArgs(1, &action, &id, &arg1, &arg2)
+	if action == "new" {
+		upload, err := NewUpload()
+		if err != nil {
+			return err
+		}
+		reply.Text = upload.ID
+		return nil
+	}
+	upload, err := GetUpload(id)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "part":
+		n, err := strconv.Atoi(arg1)
+		if err != nil {
+			return fmt.Errorf("Bad part number %q", arg1)
+		}
+		checksum := sha256.Sum256(cmd.Input)
+		if hex.EncodeToString(checksum[:]) != strings.ToLower(arg2) {
+			return fmt.Errorf("Part %d of upload %s doesn't match its checksum", n, id)
+		}
+		written, err := upload.PutPart(n, bytes.NewReader(cmd.Input))
+		if err != nil {
+			return err
+		}
+		reply.Text = strconv.FormatInt(written, 10)
+	case "file":
+		path, err := upload.File(arg1)
+		if err != nil {
+			return err
+		}
+		reply.Text = path
+	case "remove":
+		upload.Remove()
+	default:
+		return fmt.Errorf("Unknown upload command: %q", action)
+	}
+	return nil
+}
+
+// uploadInput returns the joined parts of an upload session, which is then removed.  The
+// parts are read straight into one buffer of their total size.
+func uploadInput(id string) ([]byte, error) {
+	upload, err := GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Remove()
+	body, size, err := upload.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	input := make([]byte, size)
+	if _, err := io.ReadFull(body, input); err != nil {
+		return nil, fmt.Errorf("Error reading upload %s: %s", id, err.Error())
+	}
+	return input, nil
+}
+
+// connections returns up to n RPC connections to the server, dialing more if needed.
+func (c *Client) connections(n int) []*rpc.Client {
+	clients := []*rpc.Client{c.client}
+	for len(clients) < n {
+		client, err := rpc.DialHTTP("tcp", c.rpcAddress)
+		if err != nil {
+			break
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Upload streams data to a new upload session in chunks of chunkSize sent over up to
+// the given number of RPC connections, and returns the session's ID.  At most one chunk
+// per connection is held in memory.
+func (c *Client) Upload(r io.Reader, connections, chunkSize int) (string, error) {
+	id, err := c.newUpload()
+	if err != nil {
+		return "", err
+	}
+	if err := c.sendParts(id, r, connections, chunkSize); err != nil {
+		c.Reply(datastore.Request{Command: dvid.Command{"upload", "remove", id}})
+		return "", err
+	}
+	return id, nil
+}
+
+func (c *Client) newUpload() (string, error) {
+	reply, err := c.Reply(datastore.Request{Command: dvid.Command{"upload", "new"}})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply.Text), nil
+}
+
+// sendParts streams data as the parts of an upload session.
+func (c *Client) sendParts(id string, r io.Reader, connections, chunkSize int) error {
+	clients := c.connections(connections)
+	defer func() {
+		for _, client := range clients[1:] {
+			client.Close()
+		}
+	}()
+
+	type chunk struct {
+		n    int
+		data []byte
+	}
+	chunks := make(chan chunk, len(clients))
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *rpc.Client) {
+			defer wg.Done()
+			for chunk := range chunks {
+				if failed() {
+					continue
+				}
+				if err := sendChunk(client, id, chunk.n, chunk.data); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}(client)
+	}
+	for n := 1; !failed(); n++ {
+		data := make([]byte, chunkSize)
+		size, err := io.ReadFull(r, data)
+		if size > 0 || n == 1 {
+			chunks <- chunk{n, data[:size]}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			mu.Lock()
+			firstErr = err
+			mu.Unlock()
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	return firstErr
+}
+
+// sendChunk sends a part of an upload with its checksum, retrying failures.
+func sendChunk(client *rpc.Client, id string, n int, data []byte) error {
+	checksum := sha256.Sum256(data)
+	request := datastore.Request{
+		Command: dvid.Command{"upload", "part", id, strconv.Itoa(n), hex.EncodeToString(checksum[:])},
+		Input:   data,
+	}
+	var err error
+	for attempt := 0; attempt < TransferRetries; attempt++ {
+		var reply datastore.Response
+		if err = client.Call("RPCConnection.Do", request, &reply); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Error sending part %d of upload %s: %s", n, id, err.Error())
+}
+
+// localFileArgs returns the indices of arguments that may name local files or image
+// globs in the node commands that read them: "put <key> <file>", "put local <plane>
+// <offset> <image glob>", "load <file>", "load <offset> <image glob>", "load raveler
+// <file> <file>", and "generate <config file>".  Other arguments are sent as is, so
+// paths the server writes, e.g., export targets, are never replaced.
+func localFileArgs(command dvid.Command) []int {
+	if len(command) < 5 || command[0] != "node" {
+		return nil
+	}
+	switch verb := command[3]; {
+	case verb == "put" && command[4] == "local":
+		return []int{7}
+	case verb == "put":
+		return []int{5}
+	case verb == "load" && command[4] == "raveler":
+		return []int{5, 6}
+	case verb == "load":
+		return []int{4, 5}
+	case verb == "generate":
+		return []int{4}
+	}
+	return nil
+}
+
+// localFiles returns the regular files named by an argument, which is either a file or
+// a glob, or nil if there are none.  Files matched by a glob must have distinct names
+// since they're copied into one directory on the server.
+func localFiles(arg string) ([]string, error) {
+	if info, err := os.Stat(arg); err == nil {
+		if info.Mode().IsRegular() {
+			return []string{arg}, nil
+		}
+		return nil, nil
+	}
+	if !strings.ContainsAny(arg, "*?[") {
+		return nil, nil
+	}
+	matches, err := filepath.Glob(arg)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	names := make(map[string]bool, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Base(match)
+		if names[name] {
+			return nil, fmt.Errorf("Files matching %q must have distinct names, but %q is repeated", arg, name)
+		}
+		names[name] = true
+		files = append(files, match)
+	}
+	return files, nil
+}
+
+// SendWithUploads transmits a RPC command after streaming its local files to the
+// server, replacing each argument naming a local file with the path of its copy on the
+// server, and each image glob with the same glob in the directory of its copied files.
+// Only arguments of commands that read files are considered; see localFileArgs.  If
+// stdin is not nil, it's streamed and becomes the command's input.  The copies are
+// removed once the command is done.
+func (c *Client) SendWithUploads(request datastore.Request, stdin io.Reader, connections, chunkSize int) error {
+	if c.client == nil {
+		return c.Send(request)
+	}
+	if connections < 1 {
+		connections = DefaultTransferConnections
+	}
+	if chunkSize < 1 {
+		chunkSize = DefaultTransferChunkSize
+	}
+	var ids []string
+	defer func() {
+		for _, id := range ids {
+			c.Reply(datastore.Request{Command: dvid.Command{"upload", "remove", id}})
+		}
+	}()
+	command := make(dvid.Command, len(request.Command))
+	copy(command, request.Command)
+	for _, i := range localFileArgs(command) {
+		if i >= len(command) {
+			continue
+		}
+		arg := command[i]
+		files, err := localFiles(arg)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		id, err := c.newUpload()
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		var path string
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			err = c.sendParts(id, f, connections, chunkSize)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("Error streaming %s to server: %s", file, err.Error())
+			}
+			reply, err := c.Reply(datastore.Request{Command: dvid.Command{"upload", "file", id, filepath.Base(file)}})
+			if err != nil {
+				return err
+			}
+			path = strings.TrimSpace(reply.Text)
+		}
+		if files[0] == arg {
+			command[i] = path
+		} else {
+			command[i] = filepath.Join(filepath.Dir(path), filepath.Base(arg))
+		}
+	}
+	request.Command = command
+	if stdin != nil {
+		id, err := c.Upload(stdin, connections, chunkSize)
+		if err != nil {
+			return fmt.Errorf("Error streaming standard input to server: %s", err.Error())
+		}
+		request.InputUpload = id
+	}
+	return c.Send(request)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *ServerSuite) TestLocalFileArgs(c *C) {
+	dir := c.MkDir()
+	for _, name := range []string{"s_001.png", "s_002.png", "config.json"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644), IsNil)
+	}
+	c.Assert(os.Mkdir(filepath.Join(dir, "s_003.png"), 0755), IsNil)
+	glob := filepath.Join(dir, "s_*.png")
+	config := filepath.Join(dir, "config.json")
+
+	// Only arguments of commands reading files are considered.
+	cmd := dvid.Command{"node", "3f8c", "grayscale", "put", "local", "xy", "0,0,100", glob}
+	c.Assert(localFileArgs(cmd), DeepEquals, []int{7})
+	cmd = dvid.Command{"node", "3f8c", "kv", "put", "mykey", config}
+	c.Assert(localFileArgs(cmd), DeepEquals, []int{5})
+	cmd = dvid.Command{"node", "3f8c", "grayscale", "export", "nifti", config}
+	c.Assert(localFileArgs(cmd), HasLen, 0)
+
+	// Globs are expanded to their regular files, and other arguments name no files.
+	files, err := localFiles(glob)
+	c.Assert(err, IsNil)
+	c.Assert(files, DeepEquals, []string{filepath.Join(dir, "s_001.png"), filepath.Join(dir, "s_002.png")})
+	files, err = localFiles(config)
+	c.Assert(err, IsNil)
+	c.Assert(files, DeepEquals, []string{config})
+	files, err = localFiles("0,0,100")
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+	files, err = localFiles(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+}
@@ -0,0 +1,181 @@
+/*
+	This file handles the registry of coordinate transforms between data instances.  See
+	datastore/transforms.go for how transforms relate instances through a canonical space.
+
+	GET    /api/dataset/<UUID>/transforms                Lists transforms by data name as JSON.
+	GET    /api/dataset/<UUID>/transform/<data name>     Returns the transform of the data.
+	POST   /api/dataset/<UUID>/transform/<data name>     Sets the transform of the data to the
+	                                                     POSTed JSON, e.g.,
+	    {"Affine": [1, 0, 0, 10, 0, 1, 0, 0, 0, 0, 1, 0],
+	     "Field": {"Origin": [0, 0, 0], "Spacing": [64, 64, 64], "Size": [nx, ny, nz],
+	               "Vectors": [[dx, dy, dz], ...]}}
+	DELETE /api/dataset/<UUID>/transform/<data name>     Removes the transform of the data.
+
+	GET    /api/dataset/<UUID>/map/<from>/<to>?point=x_y_z[&point=x_y_z...]
+	POST   /api/dataset/<UUID>/map/<from>/<to>
+	    Maps points and boxes from the coordinates of one data instance to another's.  POSTs
+	    give {"Points": [[x, y, z], ...], "Boxes": [{"Min": [x, y, z], "Max": [x, y, z]}, ...]}
+	    and both return the mapped points and boxes in the same form.  At most
+	    MaxMapPoints points, counting 8 corners per box, are mapped per request.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxMapPoints is the maximum number of points mapped by one request, where each box
+// counts as its 8 corners.
+const MaxMapPoints = 1000000
+
+// MappedCoordinates are points and boxes in the coordinates of a data instance.
+type MappedCoordinates struct {
+	Points [][3]float64    `json:",omitempty"`
+	Boxes  []datastore.Box `json:",omitempty"`
+}
+
+// parsePoint parses a point given as "x_y_z" with finite coordinates.
+func parsePoint(s string) ([3]float64, error) {
+	var p [3]float64
+	coords := strings.Split(s, "_")
+	if len(coords) != 3 {
+		return p, fmt.Errorf("Bad point %q: expected x_y_z", s)
+	}
+	for i, coord := range coords {
+		f, err := strconv.ParseFloat(coord, 64)
+		if err != nil {
+			return p, fmt.Errorf("Bad point %q: %s", s, err.Error())
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return p, fmt.Errorf("Bad point %q: coordinates must be finite", s)
+		}
+		p[i] = f
+	}
+	return p, nil
+}
+
+// decodeBody decodes a JSON request body of at most MaxRequestBody bytes, replying with
+// an error and returning false if it can't.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	data, err := ReadBody(r)
+	if err == ErrBodyTooLarge {
+		TooLarge(w, r, err.Error())
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+		return false
+	}
+	return true
+}
+
+// transformRequest handles the /api/dataset/<UUID>/transforms, /api/dataset/<UUID>/transform,
+// and /api/dataset/<UUID>/map endpoints.
+func transformRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	action := strings.ToLower(r.Method)
+	var reply interface{}
+	switch {
+	case parts[1] == "transforms" && len(parts) == 2 && action == "get":
+		transforms, err := runningService.Transforms(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		reply = transforms
+
+	case parts[1] == "transform" && len(parts) == 3 && action == "get":
+		transform, found, err := runningService.Transform(uuid, dvid.DataString(parts[2]))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("No transform for data '%s'", parts[2]), http.StatusNotFound)
+			return
+		}
+		reply = transform
+
+	case parts[1] == "transform" && len(parts) == 3 && action == "post":
+		transform := new(datastore.Transform)
+		if !decodeBody(w, r, transform) {
+			return
+		}
+		if err := runningService.SetTransform(uuid, dvid.DataString(parts[2]), transform); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		dvid.Log(dvid.Normal, "Set transform of data '%s' in dataset %s\n", parts[2], uuid)
+		reply = map[string]string{"result": fmt.Sprintf("Set transform of data '%s'", parts[2])}
+
+	case parts[1] == "transform" && len(parts) == 3 && action == "delete":
+		if err := runningService.DeleteTransform(uuid, dvid.DataString(parts[2])); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		dvid.Log(dvid.Normal, "Deleted transform of data '%s' in dataset %s\n", parts[2], uuid)
+		reply = map[string]string{"result": fmt.Sprintf("Deleted transform of data '%s'", parts[2])}
+
+	case parts[1] == "map" && len(parts) == 4 && (action == "get" || action == "post"):
+		var coords MappedCoordinates
+		if action == "post" {
+			if !decodeBody(w, r, &coords) {
+				return
+			}
+		} else {
+			if len(r.URL.Query()["point"]) > MaxMapPoints {
+				TooLarge(w, r, fmt.Sprintf("At most %d points can be mapped per request", MaxMapPoints))
+				return
+			}
+			for _, s := range r.URL.Query()["point"] {
+				p, err := parsePoint(s)
+				if err != nil {
+					BadRequest(w, r, err.Error())
+					return
+				}
+				coords.Points = append(coords.Points, p)
+			}
+		}
+		if int64(len(coords.Points))+8*int64(len(coords.Boxes)) > MaxMapPoints {
+			TooLarge(w, r, fmt.Sprintf("At most %d points, counting 8 per box, can be mapped per request", MaxMapPoints))
+			return
+		}
+		from, to := dvid.DataString(parts[2]), dvid.DataString(parts[3])
+		var mapped MappedCoordinates
+		var err error
+		if mapped.Points, err = runningService.MapPoints(uuid, from, to, coords.Points); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		if mapped.Boxes, err = runningService.MapBoxes(uuid, from, to, coords.Boxes); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		reply = mapped
+
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET /api/dataset/<UUID>/transforms, "+
+			"GET, POST, or DELETE /api/dataset/<UUID>/transform/<data name>, "+
+			"or GET or POST /api/dataset/<UUID>/map/<from>/<to>")
+		return
+	}
+	// Encode the reply before writing so failures aren't hidden behind a 200 status.
+	jsonBytes, err := json.Marshal(reply)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(jsonBytes))
+}
@@ -0,0 +1,15 @@
+package server
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestParsePoint(c *C) {
+	p, err := parsePoint("1.5_-2_3e2")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, [3]float64{1.5, -2, 300})
+	for _, bad := range []string{"1_2", "1_2_x", "NaN_0_0", "0_+Inf_0", "0_0_1e400"} {
+		_, err = parsePoint(bad)
+		c.Assert(err, NotNil)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+	This file handles soft deletion of data instances.  Deleted data is moved to its
+	dataset's trash, where an admin can restore it or purge it permanently.  Trashed
+	data is purged automatically once it's been in the trash for TrashRetention.
+
+	POST /api/dataset/<UUID>/delete/<data name>          Moves the data to the trash.
+	GET  /api/dataset/<UUID>/trash                       Lists the trashed data as JSON.
+	POST /api/dataset/<UUID>/trash/<data name>/restore   Restores the trashed data.
+	POST /api/dataset/<UUID>/trash/<data name>/purge     Permanently deletes the trashed data.
+
+	If authentication is configured, only members of the OIDC AdminGroups may restore
+	or purge trashed data.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TrashRetention is how long deleted data is kept in the trash before it's purged.
+// Zero keeps trashed data until it's explicitly purged.
+var TrashRetention = 7 * 24 * time.Hour
+
+// deleteDataRequest handles POST /api/dataset/<UUID>/delete/<data name>.
+func deleteDataRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Deleting data must be done with HTTP POST method")
+		return
+	}
+	if len(parts) != 3 {
+		BadRequest(w, r, "Bad URL: Expecting /api/dataset/<UUID>/delete/<data name>")
+		return
+	}
+	dataname := dvid.DataString(parts[2])
+	if err := runningService.DeleteData(uuid, dataname); err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{%q: \"Moved data '%s' to the trash of dataset with node %s\"}", "result", dataname, uuid)
+}
+
+// trashRequest handles the /api/dataset/<UUID>/trash endpoints.
+func trashRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	action := strings.ToLower(r.Method)
+	if len(parts) == 2 {
+		if action != "get" {
+			BadRequest(w, r, "Trash can only be listed with HTTP GET method")
+			return
+		}
+		entries, err := runningService.Trash(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	if len(parts) != 4 || action != "post" {
+		BadRequest(w, r, "Bad URL: Expecting POST /api/dataset/<UUID>/trash/<data name>/<restore or purge>")
+		return
+	}
+	if !adminRequest(w, r) {
+		return
+	}
+	dataname := dvid.DataString(parts[2])
+	switch parts[3] {
+	case "restore":
+		if err := runningService.RestoreData(uuid, dataname); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: \"Restored data '%s' from the trash\"}", "result", dataname)
+	case "purge":
+		deleted, err := runningService.PurgeData(uuid, dataname)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deleted)
+	default:
+		BadRequest(w, r, fmt.Sprintf("Unknown trash action %q", parts[3]))
+	}
+}
+
+// purgeExpiredTrash permanently deletes data that's been in the trash for TrashRetention,
+// logging the space reclaimed.
+func purgeExpiredTrash(now time.Time) {
+	if TrashRetention <= 0 {
+		return
+	}
+	deleted, err := runningService.PurgeExpiredTrash(now.Add(-TrashRetention))
+	for _, d := range deleted {
+		dvid.Log(dvid.Normal, "Purged trashed data '%s' in dataset %s: reclaimed %d keys of %d bytes\n",
+			d.Name, d.Dataset, d.Keys, d.Bytes)
+	}
+	if err != nil {
+		dvid.Error("Unable to purge trashed data: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,380 @@
+/*
+	This file implements multi-part upload sessions so clients on high-latency links can
+	push huge POST bodies as parts sent over parallel streams, retrying only failed parts.
+
+	POST   /api/uploads                  Starts a session, returning {"Upload": "<upload ID>"}.
+	POST   /api/uploads/<upload ID>/<n>  Stores part n (1, 2, ...), replacing any earlier try.
+	GET    /api/uploads/<upload ID>      Returns the bytes received for each part.
+	DELETE /api/uploads/<upload ID>      Aborts the session.
+
+	A session is completed by adding "upload=<upload ID>" to the query string of any POST
+	to a node's data, which then receives the parts, in order, as its body.  If that POST
+	has a Content-Encoding, e.g., gzip, the assembled parts are decompressed.  The session is
+	removed once the data accepts the body, so a failed completion can be retried.
+
+	Upload IDs are random, and a session can only be used by the user who started it.
+	Sessions are limited to MaxUploadParts parts of at most MaxUploadPartSize bytes and
+	MaxUploadSize bytes in all, and at most MaxUploads sessions are open at once.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// UploadDir is the directory holding the parts of upload sessions.  If empty, the
+// system's temporary directory is used.
+var UploadDir string
+
+// MaxUploadAge is how long an upload session is kept after its last part arrives.
+var MaxUploadAge = 24 * time.Hour
+
+var (
+	// MaxUploads is the most upload sessions open at once.
+	MaxUploads = 1000
+
+	// MaxUploadParts is the most parts of an upload session.
+	MaxUploadParts = 10000
+
+	// MaxUploadPartSize is the largest part of an upload session in bytes.
+	MaxUploadPartSize int64 = 5 << 30
+
+	// MaxUploadSize is the largest total size of the parts of an upload session in bytes.
+	MaxUploadSize int64 = 500 << 30
+)
+
+// UploadLimitError is returned when an upload exceeds one of the upload limits.
+type UploadLimitError struct {
+	message string
+}
+
+func (e *UploadLimitError) Error() string {
+	return e.message
+}
+
+// Upload is a multi-part upload session.  It is safe for concurrent use.
+type Upload struct {
+	sync.Mutex
+	ID      string
+	owner   string // name of the user who started the session, if authenticated
+	dir     string
+	parts   map[int]int64 // bytes received for each part
+	updated time.Time
+}
+
+var uploads struct {
+	sync.Mutex
+	byID map[string]*Upload
+}
+
+// requestUserName returns the name of the authenticated user of a request or "" if
+// there's none.
+func requestUserName(r *http.Request) string {
+	if user := RequestUser(r); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
+// NewUpload starts an upload session for a user, which is "" without authentication.
+// Sessions left idle past MaxUploadAge are removed.
+func NewUpload(owner string) (*Upload, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(random)
+
+	uploads.Lock()
+	defer uploads.Unlock()
+	if uploads.byID == nil {
+		uploads.byID = make(map[string]*Upload)
+	}
+	for id, old := range uploads.byID {
+		old.Lock()
+		stale := time.Since(old.updated) > MaxUploadAge
+		old.Unlock()
+		if stale {
+			delete(uploads.byID, id)
+			os.RemoveAll(old.dir)
+		}
+	}
+	if len(uploads.byID) >= MaxUploads {
+		return nil, &UploadLimitError{fmt.Sprintf("Already %d upload sessions open, the most allowed", len(uploads.byID))}
+	}
+
+	parent := UploadDir
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	dir := filepath.Join(parent, "dvid-upload-"+id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create upload directory: %s", err.Error())
+	}
+	upload := &Upload{
+		ID:      id,
+		owner:   owner,
+		dir:     dir,
+		parts:   make(map[int]int64),
+		updated: time.Now(),
+	}
+	uploads.byID[upload.ID] = upload
+	return upload, nil
+}
+
+// GetUpload returns the upload session with the given ID started by a user, which is ""
+// without authentication.  Sessions of other users aren't found.
+func GetUpload(id, user string) (*Upload, error) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	upload, found := uploads.byID[id]
+	if !found || upload.owner != user {
+		return nil, fmt.Errorf("No upload with ID %q", id)
+	}
+	return upload, nil
+}
+
+// Remove deletes the session and its parts.
+func (upload *Upload) Remove() {
+	uploads.Lock()
+	delete(uploads.byID, upload.ID)
+	uploads.Unlock()
+
+	upload.Lock()
+	defer upload.Unlock()
+	os.RemoveAll(upload.dir)
+}
+
+func (upload *Upload) partPath(n int) string {
+	return filepath.Join(upload.dir, fmt.Sprintf("part-%d", n))
+}
+
+// PutPart stores part n, numbered from 1, of the upload.  Parts can be sent concurrently
+// and in any order.  A part that is sent again replaces the earlier one.  Parts beyond
+// the upload limits return an *UploadLimitError.
+func (upload *Upload) PutPart(n int, r io.Reader) (int64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("Upload parts are numbered from 1, not %d", n)
+	}
+	if n > MaxUploadParts {
+		return 0, &UploadLimitError{fmt.Sprintf("Upload part %d exceeds the %d parts allowed", n, MaxUploadParts)}
+	}
+	f, err := ioutil.TempFile(upload.dir, "incoming-")
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(f, io.LimitReader(r, MaxUploadPartSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written > MaxUploadPartSize {
+		err = &UploadLimitError{fmt.Sprintf("Part %d of upload %s exceeds the %d bytes allowed per part",
+			n, upload.ID, MaxUploadPartSize)}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		if _, ok := err.(*UploadLimitError); ok {
+			return 0, err
+		}
+		return 0, fmt.Errorf("Error receiving part %d of upload %s: %s", n, upload.ID, err.Error())
+	}
+
+	// The rename makes a retried part replace a failed one atomically.
+	upload.Lock()
+	defer upload.Unlock()
+	total := written
+	for m, size := range upload.parts {
+		if m != n {
+			total += size
+		}
+	}
+	if total > MaxUploadSize {
+		os.Remove(f.Name())
+		return 0, &UploadLimitError{fmt.Sprintf("Upload %s would exceed the %d bytes allowed per upload",
+			upload.ID, MaxUploadSize)}
+	}
+	if err := os.Rename(f.Name(), upload.partPath(n)); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	upload.parts[n] = written
+	upload.updated = time.Now()
+	return written, nil
+}
+
+// Parts returns the number of bytes received for each part.
+func (upload *Upload) Parts() map[int]int64 {
+	upload.Lock()
+	defer upload.Unlock()
+	parts := make(map[int]int64, len(upload.parts))
+	for n, size := range upload.parts {
+		parts[n] = size
+	}
+	return parts
+}
+
+// Reader returns the concatenated parts and their total size.  Parts must be numbered
+// consecutively from 1.
+func (upload *Upload) Reader() (io.ReadCloser, int64, error) {
+	upload.Lock()
+	defer upload.Unlock()
+	numbers := make([]int, 0, len(upload.parts))
+	for n := range upload.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	if len(numbers) == 0 {
+		return nil, 0, fmt.Errorf("Upload %s has no parts", upload.ID)
+	}
+	files := make([]*os.File, 0, len(numbers))
+	readers := make([]io.Reader, 0, len(numbers))
+	var total int64
+	for i, n := range numbers {
+		if n != i+1 {
+			closeFiles(files)
+			return nil, 0, fmt.Errorf("Upload %s is missing part %d", upload.ID, i+1)
+		}
+		f, err := os.Open(upload.partPath(n))
+		if err != nil {
+			closeFiles(files)
+			return nil, 0, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+		total += upload.parts[n]
+	}
+	return &partsReader{io.MultiReader(readers...), files}, total, nil
+}
+
+type partsReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *partsReader) Close() error {
+	closeFiles(r.files)
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// UseUpload replaces the body of a request having an "upload" query string with the
+// parts of that upload session.  If the request has no upload, the returned function
+// is nil.  Otherwise, it must be called when the request is done, removing the session
+// if the request succeeded.
+func UseUpload(r *http.Request) (done func(succeeded bool), err error) {
+	id := r.URL.Query().Get("upload")
+	if id == "" {
+		return nil, nil
+	}
+	upload, err := GetUpload(id, requestUserName(r))
+	if err != nil {
+		return nil, err
+	}
+	body, size, err := upload.Reader()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+	r.ContentLength = size
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		if r.Body, err = decompressBody(body, encoding); err != nil {
+			body.Close()
+			return nil, err
+		}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+	}
+	return func(succeeded bool) {
+		body.Close()
+		if succeeded {
+			upload.Remove()
+		}
+	}, nil
+}
+
+// uploadsRequest handles the /api/uploads endpoints.
+func uploadsRequest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len(WebAPIPath):], "/"), "/")
+	action := strings.ToLower(r.Method)
+	var result interface{}
+	switch {
+	case len(parts) == 1 && action == "post":
+		upload, err := NewUpload(requestUserName(r))
+		if err != nil {
+			if _, ok := err.(*UploadLimitError); ok {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+			} else {
+				BadRequest(w, r, err.Error())
+			}
+			return
+		}
+		result = map[string]string{"Upload": upload.ID}
+		dvid.Log(dvid.Debug, "Started upload %s\n", upload.ID)
+	case len(parts) == 2 || len(parts) == 3:
+		upload, err := GetUpload(parts[1], requestUserName(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		switch {
+		case len(parts) == 3 && (action == "post" || action == "put"):
+			n, err := strconv.Atoi(parts[2])
+			if err != nil {
+				BadRequest(w, r, fmt.Sprintf("Bad part number %q", parts[2]))
+				return
+			}
+			written, err := upload.PutPart(n, r.Body)
+			if err != nil {
+				if _, ok := err.(*UploadLimitError); ok {
+					TooLarge(w, r, err.Error())
+				} else {
+					BadRequest(w, r, err.Error())
+				}
+				return
+			}
+			result = map[string]int64{"Part": int64(n), "Bytes": written}
+		case len(parts) == 2 && action == "get":
+			result = struct {
+				Upload string
+				Parts  map[int]int64
+			}{upload.ID, upload.Parts()}
+		case len(parts) == 2 && action == "delete":
+			upload.Remove()
+			return
+		default:
+			BadRequest(w, r, fmt.Sprintf("Unsupported %s of %s", r.Method, r.URL.Path))
+			return
+		}
+	default:
+		BadRequest(w, r, WebAPIPath+"uploads/ must be followed by at most an upload ID and part number")
+		return
+	}
+	m, err := json.Marshal(result)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
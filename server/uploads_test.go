@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *ServerSuite) TestUploadLimits(c *C) {
+	UploadDir = c.MkDir()
+	defer func(parts int, partSize, size int64) {
+		UploadDir = ""
+		MaxUploadParts, MaxUploadPartSize, MaxUploadSize = parts, partSize, size
+	}(MaxUploadParts, MaxUploadPartSize, MaxUploadSize)
+	MaxUploadParts, MaxUploadPartSize, MaxUploadSize = 3, 4, 6
+
+	upload, err := NewUpload("alice")
+	c.Assert(err, IsNil)
+	c.Assert(upload.ID, HasLen, 32)
+
+	// Sessions are only found by their owner.
+	_, err = GetUpload(upload.ID, "alice")
+	c.Assert(err, IsNil)
+	_, err = GetUpload(upload.ID, "bob")
+	c.Assert(err, NotNil)
+	_, err = GetUpload(upload.ID, "")
+	c.Assert(err, NotNil)
+
+	// Parts are limited in number and size, and so is the whole upload.
+	_, err = upload.PutPart(1, bytes.NewBufferString("abcd"))
+	c.Assert(err, IsNil)
+	_, err = upload.PutPart(2, bytes.NewBufferString("abcde"))
+	c.Assert(err, FitsTypeOf, &UploadLimitError{})
+	_, err = upload.PutPart(4, bytes.NewBufferString("a"))
+	c.Assert(err, FitsTypeOf, &UploadLimitError{})
+	_, err = upload.PutPart(2, bytes.NewBufferString("abc"))
+	c.Assert(err, FitsTypeOf, &UploadLimitError{})
+	_, err = upload.PutPart(2, bytes.NewBufferString("ab"))
+	c.Assert(err, IsNil)
+
+	// A replaced part only counts once.
+	_, err = upload.PutPart(1, bytes.NewBufferString("a"))
+	c.Assert(err, IsNil)
+	_, err = upload.PutPart(3, bytes.NewBufferString("abc"))
+	c.Assert(err, IsNil)
+	upload.Remove()
+}
+
+func (s *ServerSuite) TestMultipartUpload(c *C) {
+	UploadDir = c.MkDir()
+	defer func() { UploadDir = "" }()
+
+	upload, err := NewUpload("")
+	c.Assert(err, IsNil)
+	_, err = upload.PutPart(3, bytes.NewBufferString("ghi"))
+	c.Assert(err, IsNil)
+	_, err = upload.PutPart(1, bytes.NewBufferString("abc"))
+	c.Assert(err, IsNil)
+
+	// A request can't use an upload until all its parts are there.
+	r := httptest.NewRequest("POST", "/?upload="+upload.ID, nil)
+	_, err = UseUpload(r)
+	c.Assert(err, ErrorMatches, ".*missing part 2.*")
+
+	_, err = upload.PutPart(2, bytes.NewBufferString("def"))
+	c.Assert(err, IsNil)
+	done, err := UseUpload(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.ContentLength, Equals, int64(9))
+	body, err := ioutil.ReadAll(r.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "abcdefghi")
+
+	// A successful request removes the session.
+	done(true)
+	_, err = GetUpload(upload.ID, "")
+	c.Assert(err, NotNil)
+
+	// Requests without an upload keep their body.
+	done, err = UseUpload(httptest.NewRequest("POST", "/", nil))
+	c.Assert(err, IsNil)
+	c.Assert(done, IsNil)
+}
@@ -0,0 +1,484 @@
+/*
+	This file tracks read access to datasets and their data so operators can decide what to
+	keep on fast storage and what to archive.  Reads of each data instance are counted per
+	hour for the last UsageHistory, and voxel reads are also counted per coarse cell of
+	UsageCellSize voxels on a side to give an access heatmap.  Only reads by clients are
+	counted, not those of exports, pyramids, or other server jobs.  Counts are kept in
+	memory, saved to the datastore every UsageSaveInterval and on shutdown, and loaded when
+	the server starts.  Cells not read within UsageHistory are dropped, and at most
+	UsageMaxCells cells are counted per data instance.
+
+	GET /api/server/usage[?top=<number>]
+		Returns the most read datasets and data instances, most read first, with the
+		hourly reads of each data instance.
+
+	GET /api/server/usage/heatmap/<UUID>/<data name>[?top=<number>]
+		Returns the reads of the coarse cells of a data instance, most read first.
+
+	If authentication is configured, only members of the OIDC AdminGroups may get usage.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// UsageCellSize is the size in voxels of each side of the cells counting region reads.
+	UsageCellSize int32 = 1024
+
+	// UsageHistory is how long hourly read counts and cells without reads are kept.
+	UsageHistory = 7 * 24 * time.Hour
+
+	// UsageMaxCells is the most cells whose reads are counted for a data instance.
+	UsageMaxCells = 100000
+
+	// UsageSaveInterval is how often read counts are saved to the datastore.
+	UsageSaveInterval = 10 * time.Minute
+)
+
+// usageKey identifies data by its dataset root so reads of all versions are counted together.
+type usageKey struct {
+	root dvid.UUID
+	name dvid.DataString
+}
+
+// cellUsage holds the read counts of a coarse cell.
+type cellUsage struct {
+	Reads    int64
+	LastHour int64 // hours since the Unix epoch of the last read
+}
+
+// dataUsage holds the read counts of a data instance.  Each has its own lock so reads of
+// different data don't contend.
+type dataUsage struct {
+	sync.Mutex
+	reads    int64
+	lastRead time.Time
+	hourly   map[int64]int64 // reads keyed by hours since the Unix epoch
+	cells    map[dvid.Point3d]*cellUsage
+	modified bool // changed since last saved
+}
+
+func newDataUsage() *dataUsage {
+	return &dataUsage{hourly: make(map[int64]int64), cells: make(map[dvid.Point3d]*cellUsage)}
+}
+
+// prune drops the hourly counts and cells older than the given hour.  The data's lock
+// must be held.
+func (u *dataUsage) prune(oldest int64) {
+	for h := range u.hourly {
+		if h < oldest {
+			delete(u.hourly, h)
+		}
+	}
+	for cell, c := range u.cells {
+		if c.LastHour < oldest {
+			delete(u.cells, cell)
+		}
+	}
+}
+
+var usage struct {
+	sync.RWMutex
+	byData map[usageKey]*dataUsage
+}
+
+// dataUsageOf returns the counts of a data instance, creating them if necessary.
+func dataUsageOf(key usageKey) *dataUsage {
+	usage.RLock()
+	u, found := usage.byData[key]
+	usage.RUnlock()
+	if found {
+		return u
+	}
+	usage.Lock()
+	defer usage.Unlock()
+	if usage.byData == nil {
+		usage.byData = make(map[usageKey]*dataUsage)
+	}
+	if u, found = usage.byData[key]; !found {
+		u = newDataUsage()
+		usage.byData[key] = u
+	}
+	return u
+}
+
+// allDataUsage returns the keys and counts of all data instances with reads.
+func allDataUsage() map[usageKey]*dataUsage {
+	usage.RLock()
+	defer usage.RUnlock()
+	all := make(map[usageKey]*dataUsage, len(usage.byData))
+	for key, u := range usage.byData {
+		all[key] = u
+	}
+	return all
+}
+
+// usageKeyOf returns the usage key of data at a version.
+func usageKeyOf(uuid dvid.UUID, name dvid.DataString) (usageKey, error) {
+	if runningService.Service == nil {
+		return usageKey{}, fmt.Errorf("No datastore service is running")
+	}
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		return usageKey{}, err
+	}
+	return usageKey{dataset.Root, name}, nil
+}
+
+// RecordDataRead counts a read of data at a version.
+func RecordDataRead(uuid dvid.UUID, name dvid.DataString) {
+	key, err := usageKeyOf(uuid, name)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	hour := now.Unix() / 3600
+
+	u := dataUsageOf(key)
+	u.Lock()
+	defer u.Unlock()
+	u.reads++
+	u.lastRead = now
+	if _, found := u.hourly[hour]; !found {
+		u.prune(now.Add(-UsageHistory).Unix() / 3600)
+	}
+	u.hourly[hour]++
+	u.modified = true
+}
+
+// usageCell returns the coarse cell holding a point.  Points with fewer than three
+// dimensions lie in the cells at zero along the missing dimensions.
+func usageCell(pt dvid.Point) dvid.Point3d {
+	var cell dvid.Point3d
+	for dim := uint8(0); dim < 3 && dim < pt.NumDims(); dim++ {
+		v := pt.Value(dim)
+		if v < 0 {
+			cell[dim] = (v+1)/UsageCellSize - 1
+		} else {
+			cell[dim] = v / UsageCellSize
+		}
+	}
+	return cell
+}
+
+// RecordRegionRead counts a read of the voxels of data within the given bounds in each
+// coarse cell the bounds overlap.
+func RecordRegionRead(uuid dvid.UUID, data datastore.DataID, minPt, maxPt dvid.Point) {
+	if minPt == nil || maxPt == nil {
+		return
+	}
+	key, err := usageKeyOf(uuid, data.Name)
+	if err != nil {
+		return
+	}
+	minCell, maxCell := usageCell(minPt), usageCell(maxPt)
+	hour := time.Now().Unix() / 3600
+
+	u := dataUsageOf(key)
+	u.Lock()
+	defer u.Unlock()
+	for z := minCell[2]; z <= maxCell[2]; z++ {
+		for y := minCell[1]; y <= maxCell[1]; y++ {
+			for x := minCell[0]; x <= maxCell[0]; x++ {
+				cell := dvid.Point3d{x, y, z}
+				c, found := u.cells[cell]
+				if !found {
+					if len(u.cells) >= UsageMaxCells {
+						continue
+					}
+					c = &cellUsage{}
+					u.cells[cell] = c
+				}
+				c.Reads++
+				c.LastHour = hour
+			}
+		}
+	}
+	u.modified = true
+}
+
+// storedUsage is the stored form of the read counts of a data instance.
+type storedUsage struct {
+	Reads    int64
+	LastRead time.Time
+	Hourly   map[int64]int64
+	Cells    []storedCell
+}
+
+type storedCell struct {
+	Cell dvid.Point3d
+	cellUsage
+}
+
+// loadUsage adds the read counts saved in the datastore to those in memory.
+func loadUsage() error {
+	if runningService.Service == nil {
+		return fmt.Errorf("No datastore service is running")
+	}
+	oldest := time.Now().Add(-UsageHistory).Unix() / 3600
+	var decodeErr error
+	err := runningService.ProcessUsage(func(root dvid.UUID, name dvid.DataString, value []byte) {
+		var stored storedUsage
+		if err := json.Unmarshal(value, &stored); err != nil {
+			decodeErr = fmt.Errorf("Bad usage of %s in %s: %s", name, root, err.Error())
+			return
+		}
+		u := dataUsageOf(usageKey{root, name})
+		u.Lock()
+		u.reads += stored.Reads
+		if stored.LastRead.After(u.lastRead) {
+			u.lastRead = stored.LastRead
+		}
+		for hour, reads := range stored.Hourly {
+			u.hourly[hour] += reads
+		}
+		for _, c := range stored.Cells {
+			cell, found := u.cells[c.Cell]
+			if !found {
+				cell = &cellUsage{}
+				u.cells[c.Cell] = cell
+			}
+			cell.Reads += c.Reads
+			if c.LastHour > cell.LastHour {
+				cell.LastHour = c.LastHour
+			}
+		}
+		u.prune(oldest)
+		u.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// saveUsage saves the read counts changed since they were last saved and forgets data
+// that hasn't been read within UsageHistory.
+func saveUsage() error {
+	if runningService.Service == nil {
+		return nil
+	}
+	oldest := time.Now().Add(-UsageHistory)
+	for key, u := range allDataUsage() {
+		u.Lock()
+		if u.lastRead.Before(oldest) {
+			u.Unlock()
+			usage.Lock()
+			delete(usage.byData, key)
+			usage.Unlock()
+			if err := runningService.DeleteUsage(key.root, key.name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !u.modified {
+			u.Unlock()
+			continue
+		}
+		u.prune(oldest.Unix() / 3600)
+		stored := storedUsage{Reads: u.reads, LastRead: u.lastRead, Hourly: u.hourly}
+		for cell, c := range u.cells {
+			stored.Cells = append(stored.Cells, storedCell{cell, *c})
+		}
+		value, err := json.Marshal(stored)
+		u.modified = false
+		u.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := runningService.PutUsage(key.root, key.name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runUsageSaver loads the saved read counts and then saves them every UsageSaveInterval
+// until the server shuts down, which saves them a last time.
+func runUsageSaver() {
+	if err := loadUsage(); err != nil {
+		dvid.Error("Unable to load read counts: %s\n", err.Error())
+	}
+	ticker := time.NewTicker(UsageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+		if err := saveUsage(); err != nil {
+			dvid.Error("Unable to save read counts: %s\n", err.Error())
+		}
+	}
+}
+
+// HourlyReads is the number of reads during an hour.
+type HourlyReads struct {
+	Hour  time.Time
+	Reads int64
+}
+
+// DataUsage describes the reads of a data instance.
+type DataUsage struct {
+	Root     dvid.UUID
+	Name     dvid.DataString
+	Reads    int64
+	LastRead time.Time
+	Hourly   []HourlyReads
+}
+
+// DatasetUsage describes the reads of all data in a dataset.
+type DatasetUsage struct {
+	Root     dvid.UUID
+	Reads    int64
+	LastRead time.Time
+}
+
+// UsageReport holds the most read datasets and data instances, most read first.
+type UsageReport struct {
+	Since    time.Time
+	Datasets []DatasetUsage
+	Data     []DataUsage
+}
+
+// CellReads is the number of reads of a coarse cell, whose voxels start at the cell
+// coordinate times the cell size.
+type CellReads struct {
+	Cell  dvid.Point3d
+	Reads int64
+}
+
+// Heatmap holds the reads of the coarse cells of a data instance, most read first.
+type Heatmap struct {
+	Root     dvid.UUID
+	Name     dvid.DataString
+	CellSize int32
+	Cells    []CellReads
+}
+
+// Usage returns up to top of the most read datasets and data instances.  A top of zero
+// returns all of them.
+func Usage(top int) UsageReport {
+	oldest := time.Now().Add(-UsageHistory).Unix() / 3600
+	report := UsageReport{Since: time.Now().Add(-UsageHistory)}
+	datasets := make(map[dvid.UUID]*DatasetUsage)
+
+	for key, u := range allDataUsage() {
+		u.Lock()
+		data := DataUsage{Root: key.root, Name: key.name, Reads: u.reads, LastRead: u.lastRead}
+		for hour, reads := range u.hourly {
+			if hour >= oldest {
+				data.Hourly = append(data.Hourly, HourlyReads{time.Unix(hour*3600, 0), reads})
+			}
+		}
+		u.Unlock()
+		sort.Slice(data.Hourly, func(i, j int) bool { return data.Hourly[i].Hour.Before(data.Hourly[j].Hour) })
+		report.Data = append(report.Data, data)
+
+		dataset, found := datasets[key.root]
+		if !found {
+			dataset = &DatasetUsage{Root: key.root}
+			datasets[key.root] = dataset
+		}
+		dataset.Reads += data.Reads
+		if data.LastRead.After(dataset.LastRead) {
+			dataset.LastRead = data.LastRead
+		}
+	}
+
+	for _, dataset := range datasets {
+		report.Datasets = append(report.Datasets, *dataset)
+	}
+	sort.Slice(report.Datasets, func(i, j int) bool {
+		return report.Datasets[i].Reads > report.Datasets[j].Reads
+	})
+	sort.Slice(report.Data, func(i, j int) bool { return report.Data[i].Reads > report.Data[j].Reads })
+	if top > 0 && len(report.Datasets) > top {
+		report.Datasets = report.Datasets[:top]
+	}
+	if top > 0 && len(report.Data) > top {
+		report.Data = report.Data[:top]
+	}
+	return report
+}
+
+// UsageHeatmap returns up to top of the most read cells of data at a version.  A top of
+// zero returns all cells that were read.
+func UsageHeatmap(uuid dvid.UUID, name dvid.DataString, top int) (*Heatmap, error) {
+	key, err := usageKeyOf(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	heatmap := &Heatmap{Root: key.root, Name: name, CellSize: UsageCellSize, Cells: []CellReads{}}
+	oldest := time.Now().Add(-UsageHistory).Unix() / 3600
+	usage.RLock()
+	u, found := usage.byData[key]
+	usage.RUnlock()
+	if found {
+		u.Lock()
+		for cell, c := range u.cells {
+			if c.LastHour >= oldest {
+				heatmap.Cells = append(heatmap.Cells, CellReads{cell, c.Reads})
+			}
+		}
+		u.Unlock()
+	}
+	sort.Slice(heatmap.Cells, func(i, j int) bool { return heatmap.Cells[i].Reads > heatmap.Cells[j].Reads })
+	if top > 0 && len(heatmap.Cells) > top {
+		heatmap.Cells = heatmap.Cells[:top]
+	}
+	return heatmap, nil
+}
+
+// usageRequest handles GET /api/server/usage and /api/server/usage/heatmap/<UUID>/<data name>.
+func usageRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Usage can only be retrieved with HTTP GET method")
+		return
+	}
+	if !adminRequest(w, r) {
+		return
+	}
+	var top int
+	if topStr := r.URL.Query().Get("top"); topStr != "" {
+		var err error
+		if top, err = strconv.Atoi(topStr); err != nil || top < 0 {
+			BadRequest(w, r, fmt.Sprintf("Bad 'top' %q", topStr))
+			return
+		}
+	}
+	switch {
+	case len(parts) == 1:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Usage(top))
+	case len(parts) == 4 && parts[1] == "heatmap":
+		uuid, err := MatchingUUID(parts[2])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		heatmap, err := UsageHeatmap(uuid, dvid.DataString(parts[3]), top)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(heatmap)
+	default:
+		BadRequest(w, r, "Bad URL: Expecting GET /api/server/usage or /api/server/usage/heatmap/<UUID>/<data name>")
+	}
+}
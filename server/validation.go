@@ -0,0 +1,216 @@
+/*
+	This file checks invariants between data instances, e.g., that every annotation lies
+	within the extents of voxels or every supervoxel of a labelmap has voxels in its labels,
+	since drift between derived instances is otherwise only noticed when something breaks.
+	Each data that can check itself against related data implements Validator, and a
+	validation job runs the checks of a version and keeps a report of the violations found.
+
+	POST /api/node/<UUID>/validate    Starts a validation job, returning the job.
+	GET  /api/node/<UUID>/validate    Returns the report of the latest validation.
+
+	The POST body can be JSON mapping data names to the names of related data they should
+	be checked against, e.g., {"synapses": ["grayscale"]}, which limits validation to the
+	listed data.  Data with an empty list are checked against the data they reference.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxViolations is the number of violations kept in a validation report.
+var MaxViolations = 10000
+
+// Validator is implemented by data that can check invariants with related data.  If no
+// related data are given, the data checks against the data it references.
+type Validator interface {
+	Validate(ctx context.Context, uuid dvid.UUID, related []dvid.DataString, violation func(Violation)) error
+}
+
+// Violation is a broken invariant between data instances.
+type Violation struct {
+	Data    dvid.DataString
+	Related dvid.DataString `json:",omitempty"`
+	Check   string
+	Detail  string
+}
+
+// ValidationCheck gives the result of validating one data instance.
+type ValidationCheck struct {
+	Data       dvid.DataString
+	Related    []dvid.DataString `json:",omitempty"`
+	Violations int
+	Error      string `json:",omitempty"`
+}
+
+// ValidationReport describes the violations found by a validation job.
+type ValidationReport struct {
+	Node     dvid.UUID
+	Job      int
+	Started  time.Time
+	Finished time.Time
+	Checks   []ValidationCheck
+
+	// Violations lists up to MaxViolations violations, and Truncated is set if more
+	// were found.
+	Violations []Violation
+	Truncated  bool
+}
+
+// validationReports holds the latest validation report of each node.
+var validationReports struct {
+	sync.Mutex
+	byNode map[dvid.UUID]*ValidationReport
+}
+
+// Validate runs the checks of all validators at a version, or of the data named in
+// related, and returns the report.
+func Validate(ctx context.Context, uuid dvid.UUID, related map[dvid.DataString][]dvid.DataString,
+	progress func(float32)) (*ValidationReport, error) {
+
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	names := dataset.DataNames()
+	if related != nil {
+		names = nil
+		for name := range related {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	}
+	report := &ValidationReport{
+		Node:       uuid,
+		Started:    time.Now(),
+		Checks:     []ValidationCheck{},
+		Violations: []Violation{},
+	}
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			return nil, err
+		}
+		validator, ok := dataservice.(Validator)
+		if !ok {
+			if related != nil {
+				return nil, fmt.Errorf("Data '%s' has no invariants to validate", name)
+			}
+			continue
+		}
+		check := ValidationCheck{Data: name, Related: related[name]}
+		err = validator.Validate(ctx, uuid, check.Related, func(v Violation) {
+			v.Data = name
+			check.Violations++
+			if len(report.Violations) < MaxViolations {
+				report.Violations = append(report.Violations, v)
+			} else {
+				report.Truncated = true
+			}
+		})
+		if err != nil {
+			check.Error = err.Error()
+		}
+		report.Checks = append(report.Checks, check)
+		if progress != nil {
+			progress(float32(i+1) / float32(len(names)))
+		}
+	}
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// StartValidationJob starts a job validating data at a version and keeps its report as
+// the node's latest.
+func StartValidationJob(uuid dvid.UUID, related map[dvid.DataString][]dvid.DataString) *Job {
+	job := NewJob(fmt.Sprintf("Validate data at node %s", uuid))
+	go func() {
+		report, err := Validate(serverCtx, uuid, related, job.SetProgress)
+		if err == nil {
+			report.Job = job.ID
+			validationReports.Lock()
+			if validationReports.byNode == nil {
+				validationReports.byNode = make(map[dvid.UUID]*ValidationReport)
+			}
+			validationReports.byNode[uuid] = report
+			validationReports.Unlock()
+			var violations int
+			for _, check := range report.Checks {
+				violations += check.Violations
+			}
+			if violations > 0 {
+				dvid.Log(dvid.Normal, "Validation of node %s found %d violations\n", uuid, violations)
+			}
+		}
+		job.Finish(err)
+	}()
+	return job
+}
+
+// latestValidation returns the report of the latest validation at a node.
+func latestValidation(uuid dvid.UUID) (*ValidationReport, error) {
+	validationReports.Lock()
+	defer validationReports.Unlock()
+	report, found := validationReports.byNode[uuid]
+	if !found {
+		return nil, fmt.Errorf("No validation has been run at node %s", uuid)
+	}
+	return report, nil
+}
+
+// parseValidationRelated parses the JSON mapping data names to related data, returning
+// nil for an empty body.
+func parseValidationRelated(body []byte) (map[dvid.DataString][]dvid.DataString, error) {
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, nil
+	}
+	var related map[dvid.DataString][]dvid.DataString
+	if err := json.Unmarshal(body, &related); err != nil {
+		return nil, fmt.Errorf("Expected JSON mapping data names to lists of related data: %s", err.Error())
+	}
+	return related, nil
+}
+
+// validateRequest handles the /api/node/<UUID>/validate endpoint.
+func validateRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID) {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		report, err := latestValidation(uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	case "post":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		related, err := parseValidationRelated(body)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		job := StartValidationJob(uuid, related)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	default:
+		BadRequest(w, r, "Validation requests must be GET or POST")
+	}
+}
@@ -6,10 +6,12 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -95,6 +97,23 @@ func BadRequest(w http.ResponseWriter, r *http.Request, message string) {
 	http.Error(w, errorMsg, http.StatusBadRequest)
 }
 
+// TooLarge replies with a 413 for requests exceeding a query limit of the data.
+func TooLarge(w http.ResponseWriter, r *http.Request, message string) {
+	errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", message, r.URL.Path)
+	dvid.Log(dvid.Normal, errorMsg)
+	http.Error(w, errorMsg, http.StatusRequestEntityTooLarge)
+}
+
+// RequestError replies with a 413 for errors from requests that exceed a query limit
+// of the data or the server's body limit, and otherwise with a 400 like BadRequest.
+func RequestError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*datastore.LimitError); ok || err == ErrBodyTooLarge {
+		TooLarge(w, r, err.Error())
+		return
+	}
+	BadRequest(w, r, err.Error())
+}
+
 // DecodeJSON decodes JSON passed in a request into a dvid.Config.
 func DecodeJSON(r *http.Request) (dvid.Config, error) {
 	config := dvid.NewConfig()
@@ -114,10 +133,45 @@ func (service *Service) mainHandler(w http.ResponseWriter, r *http.Request) {
 	service.sendContent(r.URL.Path, w, r)
 }
 
+// requestContext returns the context for an API request, which is canceled when the
+// client disconnects or after a timeout in seconds given by the "timeout" query string
+// or, if absent, RequestTimeoutSecs.  A request can't turn the timeout off, so the
+// "timeout" must be positive.  Data types pass the context to voxel retrieval and storage
+// so abandoned requests stop early.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeoutSecs := RequestTimeoutSecs
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		secs, err := strconv.ParseInt(timeoutStr, 10, 32)
+		if err != nil || secs <= 0 {
+			return nil, nil, fmt.Errorf("Bad timeout '%s': must be a positive number of seconds", timeoutStr)
+		}
+		timeoutSecs = int(secs)
+	}
+	if timeoutSecs == 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeoutSecs)*time.Second)
+	return ctx, cancel, nil
+}
+
 // Handler for API commands.  Results come back in JSON.
 // We assume all DVID API commands have URLs with prefix /api/...
 // See WebAPIHelp for expected calling URLs and HTTP verbs.
 func apiHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// Trace requests if exporting traces to a collector.
+	w, r, endTrace := traceHTTP(w, r)
+	defer endTrace()
+
 	// Break URL request into arguments
 	lenPath := len(WebAPIPath)
 	url := r.URL.Path[lenPath:]
@@ -127,20 +181,75 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Authenticate requests if the server delegates authentication to a provider.
+	r, ok := authenticate(w, r, parts)
+	if !ok {
+		return
+	}
+
+	// Cap the bandwidth of replies to requests with API keys that have a limit.
+	w = throttleHTTP(w, r)
+
+	// Log requests slower than the slow query threshold.
+	w, r, logSlowQuery := slowQueryHTTP(w, r, start)
+	defer logSlowQuery()
+
+	// Record requests that modify data if auditing.
+	w, r, recordAudit := auditHTTP(w, r, parts)
+	defer recordAudit()
+
+	// Decompress request bodies sent with a Content-Encoding.
+	w, ok = decodeRequestBody(w, r, parts)
+	if !ok {
+		return
+	}
+
+	// Replicas send writes to the primary, except for settings of this server.
+	if IsReplica() && isWriteRequest(r) && parts[0] != "server" && parts[0] != "cluster" {
+		replicaWrite(w, r)
+		return
+	}
+
+	// Refuse writes that add data when a volume is nearly full.
+	if refuseDiskWrite(w, r, parts) {
+		return
+	}
+
+	// Requests for nodes held elsewhere go to other cluster members or federated servers.
+	if (parts[0] == "node" || parts[0] == "dataset") && len(parts) > 1 {
+		if proxyToOwner(w, r, parts[1]) || federate(w, r, parts[1]) {
+			return
+		}
+	}
+
 	// Handle the requests
 	switch parts[0] {
 	case "help":
 		helpRequest(w, r)
+	case "login":
+		loginRequest(w, r, parts)
 	case "load":
 		loadRequest(w, r)
 	case "server":
 		serverRequest(w, r)
+	case "cluster":
+		clusterRequest(w, r)
 	case "datasets":
 		datasetsRequest(w, r)
 	case "dataset":
 		datasetRequest(w, r)
 	case "node":
 		nodeRequest(w, r)
+	case "jobs":
+		jobsRequest(w, r)
+	case "uploads":
+		uploadsRequest(w, r)
+	case "audit":
+		auditLogRequest(w, r)
+	case "keys":
+		apiKeysRequest(w, r, parts)
+	case "scripts":
+		scriptsRequest(w, r, parts)
 	default:
 		BadRequest(w, r, "Request not in API")
 	}
@@ -152,6 +261,16 @@ func helpRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func loadRequest(w http.ResponseWriter, r *http.Request) {
+	handlers := totalHandlerStats()
+	if handlers.Size == 0 {
+		handlers.Size = MaxChunkHandlers
+	}
+	buffers := dvid.BufferStats()
+	var buffersReused int
+	if buffers.Gets > 0 {
+		buffersReused = int(100 * buffers.Reused / buffers.Gets)
+	}
+	diskFree, diskRefusals := diskLoad()
 	m, err := json.Marshal(map[string]int{
 		"file bytes read":     storage.FileBytesReadPerSec,
 		"file bytes written":  storage.FileBytesWrittenPerSec,
@@ -161,8 +280,14 @@ func loadRequest(w http.ResponseWriter, r *http.Request) {
 		"value bytes written": storage.StoreValueBytesWrittenPerSec,
 		"GET requests":        storage.GetsPerSec,
 		"PUT requests":        storage.PutsPerSec,
-		"handlers active":     int(100 * ActiveHandlers / MaxChunkHandlers),
+		"handlers active":     int(100 * ActiveHandlers / handlers.Size),
+		"handlers queued":     handlers.Queued,
 		"goroutines":          runtime.NumGoroutine(),
+		"memory reserved":     int(MemoryReserved()),
+		"buffers pooled":      int(buffers.Puts),
+		"buffers reused":      buffersReused,
+		"disk bytes free":     int(diskFree),
+		"disk writes refused": int(diskRefusals),
 	})
 	if err != nil {
 		BadRequest(w, r, err.Error())
@@ -181,6 +306,12 @@ func aboutJSON() (jsonStr string, err error) {
 		"Storage driver":  storage.Driver,
 		"Server uptime":   time.Since(startupTime).String(),
 	}
+	if IsReplica() {
+		data["Replica of"] = PrimaryWebAddress
+	}
+	if warning := diskWarning(); warning != "" {
+		data["Disk space warning"] = warning
+	}
 	m, err := json.Marshal(data)
 	if err != nil {
 		return
@@ -195,13 +326,22 @@ func serverRequest(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(url, "/")
 
 	badRequest := func() {
-		BadRequest(w, r, WebAPIPath+"server/ must be followed with 'info' or 'types'")
+		BadRequest(w, r, WebAPIPath+"server/ must be followed with 'info', 'types', 'handlers', 'federation', 'slowqueries', 'usage', 'disk', 'backup', 'access', or 'logging'")
 	}
 
+	if parts[0] == "logging" {
+		loggingRequest(w, r, parts)
+		return
+	}
+	if parts[0] == "usage" {
+		usageRequest(w, r, parts)
+		return
+	}
 	if len(parts) != 1 {
 		badRequest()
 		return
 	}
+	action := strings.ToLower(r.Method)
 
 	switch parts[0] {
 	case "info":
@@ -220,6 +360,41 @@ func serverRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
+	case "handlers":
+		// POSTs set pool sizes using JSON mapping datatype names to sizes.
+		if action == "post" {
+			if !adminRequest(w, r) {
+				return
+			}
+			var sizes map[dvid.TypeString]int
+			if err := json.NewDecoder(r.Body).Decode(&sizes); err != nil {
+				BadRequest(w, r, fmt.Sprintf("Malformed JSON request in body: %s", err.Error()))
+				return
+			}
+			for typename, size := range sizes {
+				if err := SetHandlerPoolSize(typename, size); err != nil {
+					BadRequest(w, r, err.Error())
+					return
+				}
+			}
+		}
+		m, err := json.Marshal(AllHandlerPoolStats())
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+	case "federation":
+		federationRequest(w, r)
+	case "slowqueries":
+		slowQueriesRequest(w, r)
+	case "disk":
+		diskRequest(w, r)
+	case "backup":
+		backupRequest(w, r)
+	case "access":
+		accessRequest(w, r)
 	default:
 		badRequest()
 	}
@@ -262,9 +437,10 @@ func datasetsRequest(w http.ResponseWriter, r *http.Request) {
 			BadRequest(w, r, "Datasets 'new' request must be made with HTTP POST method")
 			return
 		}
-		root, _, err := runningService.NewDataset()
+		root, err := newDataset()
 		if err != nil {
 			BadRequest(w, r, err.Error())
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, "{%q: %q}", "Root", root)
@@ -303,6 +479,12 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Handle request for the manifest of a published dataset.
+	if parts[1] == "manifest" {
+		manifestRequest(w, r, uuid)
+		return
+	}
+
 	// Handle creation of new data in dataset via POST.
 	if parts[1] == "new" {
 		if action != "post" {
@@ -315,9 +497,7 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		typename := dvid.TypeString(parts[2])
 		dataname := dvid.DataString(parts[3])
-		decoder := json.NewDecoder(r.Body)
-		config := dvid.NewConfig()
-		err = decoder.Decode(&config)
+		config, err := DecodeJSON(r)
 		if err != nil {
 			BadRequest(w, r, fmt.Sprintf("Error decoding POSTed JSON config for 'new': %s", err.Error()))
 			return
@@ -332,6 +512,46 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Handle storage accounting of the version DAG.
+	if parts[1] == "accounting" {
+		accountingRequest(w, r, uuid)
+		return
+	}
+
+	// Handle the gallery of data thumbnails.
+	if parts[1] == "gallery" {
+		galleryRequest(w, r, uuid, parts)
+		return
+	}
+
+	// Handle soft deletion of data and its trash.
+	if parts[1] == "delete" {
+		deleteDataRequest(w, r, uuid, parts)
+		return
+	}
+	if parts[1] == "trash" {
+		trashRequest(w, r, uuid, parts)
+		return
+	}
+
+	// Handle aliases of data unless data has the endpoint's name.
+	if (parts[1] == "aliases" || parts[1] == "alias") && !isDataName(uuid, dvid.DataString(parts[1])) {
+		aliasRequest(w, r, uuid, parts)
+		return
+	}
+
+	// Handle coordinate transforms of data and mapping between them.
+	if parts[1] == "transforms" || parts[1] == "transform" || parts[1] == "map" {
+		transformRequest(w, r, uuid, parts)
+		return
+	}
+
+	// Handle request for the scratch nodes hidden from dataset listings.
+	if parts[1] == "scratch" {
+		scratchListRequest(w, r, uuid)
+		return
+	}
+
 	// Forward all other commands to the data service.
 	dataname := dvid.DataString(parts[1])
 	dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
@@ -339,10 +559,35 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 		BadRequest(w, r, err.Error())
 		return
 	}
-	err = dataservice.DoHTTP(uuid, w, r)
+	writeDone, ok := startWrite(w, r, uuid)
+	if !ok {
+		return
+	}
+	defer writeDone()
+	consistentReq, err := UseConsistency(r)
 	if err != nil {
 		BadRequest(w, r, err.Error())
+		return
+	}
+	r = consistentReq
+	if r.Method == "GET" {
+		RecordDataRead(uuid, dataname)
+	}
+	w, r, finishScripts, ok := scriptHTTP(w, r, uuid, dataservice.DataName(), parts)
+	if !ok {
+		return
 	}
+	defer finishScripts()
+	serveIdempotent(w, r, uuid, dataname, func(w http.ResponseWriter) bool {
+		err := traceDataHTTP(r, dataservice.DatatypeName(), dataname, func(r *http.Request) error {
+			return dataservice.DoHTTP(uuid, w, r)
+		})
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return false
+		}
+		return true
+	})
 }
 
 func nodeRequest(w http.ResponseWriter, r *http.Request) {
@@ -369,6 +614,7 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			BadRequest(w, r, err.Error())
 		} else {
+			onCommit(uuid)
 			w.Header().Set("Content-Type", "text/plain")
 			fmt.Fprintln(w, "Lock on node %s successful.", uuid)
 		}
@@ -382,6 +628,18 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "{%q: %q}", "Branch", newuuid)
 		}
 
+	case "scratch":
+		scratchRequest(w, r, uuid)
+
+	case "publish":
+		publishRequest(w, r, uuid)
+
+	case "validate":
+		validateRequest(w, r, uuid)
+
+	case "delta":
+		deltaRequest(w, r, uuid, parts)
+
 	default:
 		dataname := dvid.DataString(parts[1])
 		dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
@@ -389,9 +647,42 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 			BadRequest(w, r, err.Error())
 			return
 		}
-		err = dataservice.DoHTTP(uuid, w, r)
+		writeDone, ok := startWrite(w, r, uuid)
+		if !ok {
+			return
+		}
+		defer writeDone()
+		consistentReq, err := UseConsistency(r)
 		if err != nil {
 			BadRequest(w, r, err.Error())
+			return
+		}
+		r = consistentReq
+		if r.Method == "GET" {
+			RecordDataRead(uuid, dataname)
+		}
+		w, r, finishScripts, ok := scriptHTTP(w, r, uuid, dataservice.DataName(), parts)
+		if !ok {
+			return
 		}
+		defer finishScripts()
+		serveIdempotent(w, r, uuid, dataname, func(w http.ResponseWriter) bool {
+			uploadDone, err := UseUpload(r)
+			if err != nil {
+				BadRequest(w, r, err.Error())
+				return false
+			}
+			err = traceDataHTTP(r, dataservice.DatatypeName(), dataname, func(r *http.Request) error {
+				return dataservice.DoHTTP(uuid, w, r)
+			})
+			if uploadDone != nil {
+				uploadDone(err == nil)
+			}
+			if err != nil {
+				BadRequest(w, r, err.Error())
+				return false
+			}
+			return true
+		})
 	}
 }
@@ -0,0 +1,263 @@
+/*
+	This file implements "dvid shell", an interactive prompt that runs commands against a
+	DVID server with history and tab-completion of UUID prefixes, data names, and datatype
+	commands fetched from the server.  It also completes command lines for bash when dvid
+	is registered with "complete -C dvid dvid".
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// maxHistory is the number of commands kept in the shell's history file.
+const maxHistory = 1000
+
+// localCommands are commands run without a server, which can't be used in the shell.
+var localCommands = []string{"init", "serve", "repair", "fsck", "migrate-keys", "restore-metadata", "shell"}
+
+// isLocalCommand returns true if the named command is one of localCommands.
+func isLocalCommand(name string) bool {
+	for _, command := range localCommands {
+		if command == name {
+			return true
+		}
+	}
+	return false
+}
+
+// completions returns the candidates for the last, possibly empty, word of a command line.
+func completions(client *server.Client, words []string) []string {
+	var candidates []string
+	if len(words) == 1 {
+		for _, command := range localCommands {
+			if strings.HasPrefix(command, words[0]) {
+				candidates = append(candidates, command)
+			}
+		}
+	}
+	reply, err := client.Reply(datastore.Request{Command: append(dvid.Command{"complete"}, words...)})
+	if err != nil {
+		return candidates
+	}
+	for _, candidate := range strings.Split(reply.Text, "\n") {
+		if candidate != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// completionWords splits a command line into words, ending with an empty word if the
+// line is blank or ends with a space.
+func completionWords(line string) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	return words
+}
+
+// DoBashCompletion prints completions of the command line in COMP_LINE, as bash
+// expects of commands registered with "complete -C".
+func DoBashCompletion(line string) {
+	var words []string
+	for _, word := range completionWords(line)[1:] {
+		if !strings.HasPrefix(word, "-") {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return
+	}
+	for _, candidate := range completions(server.NewClient(*rpcAddress), words) {
+		fmt.Println(candidate)
+	}
+}
+
+// shell reads and runs commands, keeping their history.
+type shell struct {
+	client  *server.Client
+	history []string
+	file    string
+}
+
+// DoShell runs an interactive prompt until "exit" or end of input.
+func DoShell(cmd dvid.Command) error {
+	sh := &shell{client: server.NewClient(*rpcAddress)}
+	if home, err := os.UserHomeDir(); err == nil {
+		sh.file = filepath.Join(home, ".dvid_history")
+		sh.loadHistory()
+	}
+	fmt.Printf("DVID shell for server at %s.  Use tab to complete commands and \"exit\" to quit.\n", *rpcAddress)
+	input := bufio.NewReader(os.Stdin)
+	for {
+		line, err := sh.readLine(input, "dvid> ")
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sh.addHistory(line)
+		command := dvid.Command(strings.Fields(line))
+		switch name := command.Name(); {
+		case name == "exit" || name == "quit":
+			return nil
+		case isLocalCommand(name):
+			fmt.Fprintf(os.Stderr, "The %q command can't be run from the shell.\n", name)
+			continue
+		}
+		if err := DoCommand(command); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+}
+
+// readLine reads a command line, editing it in the terminal if possible so tab can
+// complete words and the arrow keys recall history.
+func (sh *shell) readLine(input *bufio.Reader, prompt string) (string, error) {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		fmt.Print(prompt)
+		line, err := input.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return line, err
+	}
+	defer restore()
+
+	var line []rune
+	recalled := len(sh.history)
+	redraw := func() {
+		fmt.Printf("\r\x1b[K%s%s", prompt, string(line))
+	}
+	redraw()
+	for {
+		r, _, err := input.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(line), nil
+		case 3: // ctrl-C clears the line.
+			line = line[:0]
+			fmt.Print("^C\r\n")
+			redraw()
+		case 4: // ctrl-D quits on an empty line.
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case 21: // ctrl-U clears the line.
+			line = line[:0]
+			redraw()
+		case 127, 8:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				redraw()
+			}
+		case '\t':
+			line = []rune(sh.complete(string(line)))
+			redraw()
+		case 27: // Escape sequences for up and down arrows recall history.
+			if next, _ := input.ReadByte(); next != '[' {
+				continue
+			}
+			key, _ := input.ReadByte()
+			switch {
+			case key == 'A' && recalled > 0:
+				recalled--
+			case key == 'B' && recalled < len(sh.history):
+				recalled++
+			default:
+				continue
+			}
+			line = line[:0]
+			if recalled < len(sh.history) {
+				line = []rune(sh.history[recalled])
+			}
+			redraw()
+		default:
+			if r >= ' ' {
+				line = append(line, r)
+				fmt.Print(string(r))
+			}
+		}
+	}
+}
+
+// complete returns the line with its last word completed as far as the candidates
+// agree, listing the candidates if they can't be narrowed further.
+func (sh *shell) complete(line string) string {
+	words := completionWords(line)
+	prefix := words[len(words)-1]
+	candidates := completions(sh.client, words)
+	if len(candidates) == 0 {
+		return line
+	}
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	} else if common == prefix {
+		fmt.Print("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+	}
+	return line[:len(line)-len(prefix)] + common
+}
+
+// loadHistory reads the history file, if any.
+func (sh *shell) loadHistory() {
+	f, err := os.Open(sh.file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			sh.history = append(sh.history, line)
+		}
+	}
+	if len(sh.history) > maxHistory {
+		sh.history = sh.history[len(sh.history)-maxHistory:]
+	}
+}
+
+// addHistory adds a command to the history and appends it to the history file.
+func (sh *shell) addHistory(line string) {
+	if n := len(sh.history); n != 0 && sh.history[n-1] == line {
+		return
+	}
+	sh.history = append(sh.history, line)
+	if sh.file == "" {
+		return
+	}
+	f, err := os.OpenFile(sh.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(f, line)
+	f.Close()
+}
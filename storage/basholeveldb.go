@@ -305,6 +305,10 @@ func (db *LevelDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 			if err != nil {
 				return
 			}
+			if !inRange(kStart, kEnd, key) {
+				it.Next()
+				continue
+			}
 			values = append(values, KeyValue{key, itValue})
 			it.Next()
 		} else {
@@ -341,6 +345,10 @@ func (db *LevelDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 			if err != nil {
 				return
 			}
+			if !inRange(kStart, kEnd, key) {
+				it.Next()
+				continue
+			}
 			keys = append(keys, key)
 			it.Next()
 		} else {
@@ -350,6 +358,42 @@ func (db *LevelDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 	}
 }
 
+// ProcessKeys sends the keys of a range to f without reading their values.
+func (db *LevelDB) ProcessKeys(kStart, kEnd Key, op *ChunkOp, f func(Key)) error {
+	dvid.StartCgo()
+	ro := levigo.NewReadOptions()
+	it := db.ldb.NewIterator(ro)
+	defer func() {
+		it.Close()
+		dvid.StopCgo()
+	}()
+
+	endBytes := kEnd.Bytes()
+	it.Seek(kStart.Bytes())
+	for {
+		if it.Valid() {
+			itKey := it.Key()
+			StoreKeyBytesRead <- len(itKey)
+			if bytes.Compare(itKey, endBytes) > 0 {
+				return nil
+			}
+			key, err := kStart.BytesToKey(itKey)
+			if err != nil {
+				return err
+			}
+			if err = op.Err(); err != nil {
+				return err
+			}
+			if inRange(kStart, kEnd, key) {
+				f(key)
+			}
+			it.Next()
+		} else {
+			return it.GetError()
+		}
+	}
+}
+
 // ProcessRange sends a range of key-value pairs to chunk handlers.
 func (db *LevelDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
 	dvid.StartCgo()
@@ -377,6 +421,13 @@ func (db *LevelDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) e
 				return err
 			}
 
+			if err = op.Err(); err != nil {
+				return err
+			}
+			if !inRange(kStart, kEnd, key) {
+				it.Next()
+				continue
+			}
 			if op.Wg != nil {
 				op.Wg.Add(1)
 			}
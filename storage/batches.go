@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+)
+
+// RangeBatchSize is a default number of key-value pairs read at a time by
+// ProcessRangeBatches.
+const RangeBatchSize = 1000
+
+// resumeKey starts a range query at the bytes of a key already found while keeping the
+// filtering of the query's original first key.
+type resumeKey struct {
+	Key
+	b []byte
+}
+
+func (k resumeKey) Bytes() []byte       { return k.b }
+func (k resumeKey) BytesString() string { return string(k.b) }
+
+func (k resumeKey) InRange(kEnd, found Key) bool {
+	return inRange(k.Key, kEnd, found)
+}
+
+// RangeStart returns the key a range query started from and the bytes at which it
+// starts, which are those of the last key found when a range is read in batches.
+func RangeStart(k Key) (Key, []byte) {
+	if resume, ok := k.(resumeKey); ok {
+		return resume.Key, resume.b
+	}
+	return k, k.Bytes()
+}
+
+// ProcessRangeBatches calls f on the key-value pairs of a range like ProcessRange, but
+// reads at most batchSize pairs at a time and calls f between reads.  A slow f, e.g.,
+// one writing to a HTTP client, then doesn't hold the database's iterators, snapshots,
+// or transactions open, and f can read the database itself.  It stops at the first
+// error returned by f or once ctx is done.
+func ProcessRangeBatches(ctx context.Context, db OrderedKeyValueGetter, kStart, kEnd Key, batchSize int,
+	f func(*KeyValue) error) error {
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	start := kStart
+	var last []byte
+	for {
+		batch := make([]KeyValue, 0, batchSize)
+		scanCtx, cancel := context.WithCancel(ctx)
+		err := db.ProcessRange(start, kEnd, &ChunkOp{Ctx: scanCtx}, func(chunk *Chunk) {
+			if len(batch) == batchSize {
+				return
+			}
+			if last != nil && bytes.Equal(chunk.K.Bytes(), last) {
+				return
+			}
+			value := make([]byte, len(chunk.V))
+			copy(value, chunk.V)
+			batch = append(batch, KeyValue{chunk.K, value})
+			if len(batch) == batchSize {
+				cancel()
+			}
+		})
+		cancel()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil && len(batch) < batchSize {
+			return err
+		}
+		for i := range batch {
+			if err := f(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		last = batch[len(batch)-1].K.Bytes()
+		start = resumeKey{kStart, last}
+	}
+}
+
+// KeyProcessor is implemented by databases that can send the keys of a range without
+// reading their values.
+type KeyProcessor interface {
+	ProcessKeys(kStart, kEnd Key, op *ChunkOp, f func(Key)) error
+}
+
+// ProcessKeys sends the keys of a range to f, without reading values if the database is
+// a KeyProcessor.
+func ProcessKeys(db OrderedKeyValueGetter, kStart, kEnd Key, op *ChunkOp, f func(Key)) error {
+	if processor, ok := db.(KeyProcessor); ok {
+		return processor.ProcessKeys(kStart, kEnd, op, f)
+	}
+	return db.ProcessRange(kStart, kEnd, op, func(chunk *Chunk) {
+		f(chunk.K)
+	})
+}
+
+// ProcessKeyBatches calls f on the keys of a range in batches of at most batchSize keys,
+// like ProcessRangeBatches but without copying values, so f can delete the keys.  It
+// stops at the first error returned by f or once ctx is done.
+func ProcessKeyBatches(ctx context.Context, db OrderedKeyValueGetter, kStart, kEnd Key, batchSize int,
+	f func([]Key) error) error {
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	start := kStart
+	var last []byte
+	for {
+		keys := make([]Key, 0, batchSize)
+		scanCtx, cancel := context.WithCancel(ctx)
+		err := ProcessKeys(db, start, kEnd, &ChunkOp{Ctx: scanCtx}, func(key Key) {
+			if len(keys) == batchSize {
+				return
+			}
+			if last != nil && bytes.Equal(key.Bytes(), last) {
+				return
+			}
+			keys = append(keys, key)
+			if len(keys) == batchSize {
+				cancel()
+			}
+		})
+		cancel()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil && len(keys) < batchSize {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if len(keys) < batchSize {
+			return nil
+		}
+		last = keys[len(keys)-1].Bytes()
+		start = resumeKey{kStart, last}
+	}
+}
@@ -52,19 +52,13 @@ func NewStore(path string, create bool, config dvid.Config) (Engine, error) {
 		db:      db,
 	}
 
-	// Create buckets for each key type.
+	// Create buckets for each key type, adding any new key types to existing databases.
 	db.Update(func(tx *bolt.Tx) error {
-		if err := tx.CreateBucket(KeyDatasets.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeyDataset.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeyData.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeySync.String()); err != nil {
-			return err
+		keyTypes := []KeyType{KeyDatasets, KeyDataset, KeyData, KeySync, KeyAudit, KeyAPIKey, KeyScript, KeyVersionIndex, KeyUsage, KeyIdempotency, KeyThumbnail}
+		for _, keyType := range keyTypes {
+			if err := tx.CreateBucketIfNotExists(keyType.String()); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -136,6 +130,10 @@ func (bdb *BoltDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 			if err != nil {
 				return err
 			}
+			if !inRange(kStart, kEnd, key) {
+				k, v = c.Next()
+				continue
+			}
 			values = append(values, KeyValue{key, v})
 			k, v = c.Next()
 		}
@@ -169,6 +167,10 @@ func (bdb *BoltDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 			if err != nil {
 				return err
 			}
+			if !inRange(kStart, kEnd, key) {
+				k, v = c.Next()
+				continue
+			}
 			keys = append(keys, key)
 			k, v = c.Next()
 		}
@@ -199,6 +201,13 @@ func (bdb *BoltDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) e
 			if err != nil {
 				return err
 			}
+			if err = op.Err(); err != nil {
+				return err
+			}
+			if !inRange(kStart, kEnd, key) {
+				k, v = c.Next()
+				continue
+			}
 			if op.Wg != nil {
 				op.Wg.Add(1)
 			}
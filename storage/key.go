@@ -34,6 +34,33 @@ const (
 	// Key group that holds Sync links between Data.  Sync key/value pairs designate
 	// what values need to be updated when its linked data changes.
 	KeySync
+
+	// Key group that holds the audit log of mutating operations, ordered by time.
+	KeyAudit
+
+	// Key group that holds API keys issued to users, keyed by key ID.
+	KeyAPIKey
+
+	// Key group that temporarily holds data keys while they're converted to a new layout.
+	KeyMigration
+
+	// Key group that holds scripts transforming data on reads or writes, keyed by name.
+	KeyScript
+
+	// Key group that indexes data keys by the version that wrote them, so the keys of one
+	// version can be found without scanning the keys of every version.
+	KeyVersionIndex
+
+	// Key group that holds the read counts of data instances, keyed by dataset root and
+	// data name.
+	KeyUsage
+
+	// Key group that holds the results of requests with client-generated idempotency keys.
+	KeyIdempotency
+
+	// Key group that holds the thumbnails of data instances, keyed by dataset root and
+	// thumbnail name.
+	KeyThumbnail
 )
 
 func (t KeyType) String() string {
@@ -46,6 +73,22 @@ func (t KeyType) String() string {
 		return "Data Key Type"
 	case KeySync:
 		return "Data Sync Key Type"
+	case KeyAudit:
+		return "Audit Key Type"
+	case KeyAPIKey:
+		return "API Key Type"
+	case KeyMigration:
+		return "Migrating Key Type"
+	case KeyScript:
+		return "Script Key Type"
+	case KeyVersionIndex:
+		return "Version Index Key Type"
+	case KeyUsage:
+		return "Usage Key Type"
+	case KeyIdempotency:
+		return "Idempotency Key Type"
+	case KeyThumbnail:
+		return "Thumbnail Key Type"
 	default:
 		return "Unknown Key Type"
 	}
@@ -59,6 +102,21 @@ type Key interface {
 	String() string
 }
 
+// RangeFilter is implemented by keys whose ranges can hold keys that don't belong, e.g.,
+// the keys of other versions interleaved with the keys of one version.  Range queries
+// starting at such a key only return the keys within the range for which InRange is true.
+type RangeFilter interface {
+	InRange(kEnd, k Key) bool
+}
+
+// inRange returns true if a key found between kStart and kEnd belongs to the range.
+func inRange(kStart, kEnd, k Key) bool {
+	if filter, ok := kStart.(RangeFilter); ok {
+		return filter.InRange(kEnd, k)
+	}
+	return true
+}
+
 // KeyValue stores a key-value pair.
 type KeyValue struct {
 	K Key
@@ -187,6 +187,9 @@ func (db *LMDB) GetRange(kStart, kEnd Key) ([]KeyValue, error) {
 		if err != nil {
 			return nil, err
 		}
+		if !inRange(kStart, kEnd, key) {
+			continue
+		}
 		values = append(values, KeyValue{key, v})
 	}
 	return values, nil
@@ -234,6 +237,9 @@ func (db *LMDB) KeysInRange(kStart, kEnd Key) ([]Key, error) {
 		if err != nil {
 			return nil, err
 		}
+		if !inRange(kStart, kEnd, key) {
+			continue
+		}
 		keys = append(keys, key)
 	}
 	return keys, nil
@@ -279,6 +285,12 @@ func (db *LMDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) erro
 		if err != nil {
 			return err
 		}
+		if err = op.Err(); err != nil {
+			return err
+		}
+		if !inRange(kStart, kEnd, key) {
+			continue
+		}
 		if op.Wg != nil {
 			op.Wg.Add(1)
 		}
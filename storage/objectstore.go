@@ -0,0 +1,443 @@
+/*
+	This file provides a minimal object store interface for writing exports directly to
+	cloud buckets (Amazon S3 and S3-compatible stores, Google Cloud Storage) or to a local
+	directory.  Requests to cloud stores are signed with AWS Signature Version 4, which
+	Google Cloud Storage accepts for its XML API using HMAC interoperability keys.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ObjectStore reads and writes whole objects by key, where keys use "/" separators
+// relative to the store's prefix.
+type ObjectStore interface {
+	// PutObject stores data under the key, replacing any existing object.
+	PutObject(key string, data []byte) error
+
+	// GetObject returns the data stored under the key or nil if there is no such object.
+	GetObject(key string) ([]byte, error)
+
+	String() string
+}
+
+// ObjectStoreRetries is the number of attempts made for each cloud store request before
+// giving up.
+const ObjectStoreRetries = 3
+
+// contextGetter is implemented by object stores whose requests can be canceled.
+type contextGetter interface {
+	getObject(ctx context.Context, key string) ([]byte, error)
+}
+
+// GetObjectContext returns the data stored under the key in a store or nil if there is
+// no such object.  Requests and retries to remote stores stop when the context is done.
+func GetObjectContext(ctx context.Context, store ObjectStore, key string) ([]byte, error) {
+	if getter, ok := store.(contextGetter); ok {
+		return getter.getObject(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.GetObject(key)
+}
+
+// retryWait waits before a retry of a failed request, returning an error if the
+// context is done first.
+func retryWait(ctx context.Context, attempt int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(attempt) * time.Second):
+		return nil
+	}
+}
+
+// NewObjectStore returns an ObjectStore for a target of the form "s3://bucket/prefix",
+// "gs://bucket/prefix", "file:///path", or a local directory path.  Cloud credentials are
+// read from the environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and optionally
+// AWS_SESSION_TOKEN for S3, or GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY (HMAC keys) for
+// Google Cloud Storage.  The optional "endpoint" setting selects an S3-compatible server,
+// e.g., "http://localhost:9000" for MinIO, and "region" overrides the S3 region.
+func NewObjectStore(target string, config dvid.Config) (ObjectStore, error) {
+	endpoint, _, err := config.GetString("endpoint")
+	if err != nil {
+		return nil, err
+	}
+	region, _, err := config.GetString("region")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		creds := awsCredentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return newCloudStore(target[len("s3://"):], endpoint, region, creds)
+	case strings.HasPrefix(target, "gs://"):
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		if region == "" {
+			region = "auto"
+		}
+		creds := awsCredentials{
+			accessKey: os.Getenv("GCS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("GCS_SECRET_ACCESS_KEY"),
+		}
+		return newCloudStore(target[len("gs://"):], endpoint, region, creds)
+	case strings.HasPrefix(target, "file://"):
+		return NewDirStore(target[len("file://"):]), nil
+	case strings.Contains(target, "://"):
+		return nil, fmt.Errorf("Unsupported object store target %q", target)
+	}
+	return NewDirStore(target), nil
+}
+
+// DirStore is an ObjectStore that writes objects as files under a local directory.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns an ObjectStore rooted at the directory.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir}
+}
+
+func (s *DirStore) String() string {
+	return s.dir
+}
+
+// PutObject writes the data to a file, creating intermediate directories as needed.
+func (s *DirStore) PutObject(key string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// GetObject returns the data in a file or nil if the file does not exist.
+func (s *DirStore) GetObject(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// HTTPStore is a read-only ObjectStore that GETs objects relative to a base URL, e.g.,
+// public buckets served over HTTPS.
+type HTTPStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPStore returns a read-only ObjectStore for objects under the base URL.
+func NewHTTPStore(baseURL string) *HTTPStore {
+	return &HTTPStore{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (s *HTTPStore) String() string {
+	return s.baseURL
+}
+
+// PutObject returns an error since HTTP sources are read-only.
+func (s *HTTPStore) PutObject(key string, data []byte) error {
+	return fmt.Errorf("Unable to write %q: %s is read-only", key, s.baseURL)
+}
+
+// GetObject downloads an object, returning nil if it does not exist.  Failed requests
+// are retried.
+func (s *HTTPStore) GetObject(key string) ([]byte, error) {
+	return s.getObject(context.Background(), key)
+}
+
+func (s *HTTPStore) getObject(ctx context.Context, key string) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt < ObjectStoreRetries; attempt++ {
+		if attempt > 0 {
+			if err := retryWait(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest("GET", s.baseURL+"/"+awsURIEscape(key, true), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, nil
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("GET of %s failed with status %s", key, resp.Status)
+		case resp.StatusCode >= 300:
+			return nil, fmt.Errorf("GET of %s failed with status %s: %s", key, resp.Status, body)
+		default:
+			return body, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// NewSourceObjectStore returns an ObjectStore for reading from a source, which may be
+// any target accepted by NewObjectStore or an "http://" or "https://" URL.  Buckets are
+// read anonymously through their public HTTPS URLs if no credentials are set.
+func NewSourceObjectStore(source string, config dvid.Config) (ObjectStore, error) {
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return NewHTTPStore(source), nil
+	case strings.HasPrefix(source, "gs://"):
+		if os.Getenv("GCS_ACCESS_KEY_ID") == "" || os.Getenv("GCS_SECRET_ACCESS_KEY") == "" {
+			return NewHTTPStore("https://storage.googleapis.com/" + source[len("gs://"):]), nil
+		}
+	case strings.HasPrefix(source, "s3://"):
+		if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+			elems := strings.SplitN(source[len("s3://"):], "/", 2)
+			baseURL := fmt.Sprintf("https://%s.s3.amazonaws.com", elems[0])
+			if len(elems) == 2 {
+				baseURL += "/" + elems[1]
+			}
+			return NewHTTPStore(baseURL), nil
+		}
+	}
+	return NewObjectStore(source, config)
+}
+
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// cloudStore is an ObjectStore for S3-compatible buckets.
+type cloudStore struct {
+	baseURL string // scheme://host[/bucket] where keys are appended
+	bucket  string
+	prefix  string
+	region  string
+	creds   awsCredentials
+	client  *http.Client
+}
+
+// newCloudStore returns a store for "bucket/prefix".  Without an endpoint, AWS
+// virtual-hosted style URLs are used; otherwise requests use path-style URLs.
+func newCloudStore(bucketPath, endpoint, region string, creds awsCredentials) (*cloudStore, error) {
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, fmt.Errorf("No credentials for object store bucket %q.  See help for environment variables.",
+			bucketPath)
+	}
+	elems := strings.SplitN(bucketPath, "/", 2)
+	if elems[0] == "" {
+		return nil, fmt.Errorf("Object store target requires a bucket name")
+	}
+	store := &cloudStore{
+		bucket: elems[0],
+		region: region,
+		creds:  creds,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(elems) == 2 {
+		store.prefix = strings.Trim(elems[1], "/")
+	}
+	if endpoint == "" {
+		store.baseURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", store.bucket, region)
+	} else {
+		store.baseURL = strings.TrimRight(endpoint, "/") + "/" + store.bucket
+	}
+	return store, nil
+}
+
+func (s *cloudStore) String() string {
+	return s.baseURL + "/" + s.prefix
+}
+
+func (s *cloudStore) objectURL(key string) string {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	return s.baseURL + "/" + awsURIEscape(key, true)
+}
+
+// PutObject uploads the data, retrying failed requests.
+func (s *cloudStore) PutObject(key string, data []byte) error {
+	_, err := s.do(context.Background(), "PUT", key, data)
+	return err
+}
+
+// GetObject downloads an object, returning nil if it does not exist.
+func (s *cloudStore) GetObject(key string) ([]byte, error) {
+	return s.do(context.Background(), "GET", key, nil)
+}
+
+func (s *cloudStore) getObject(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, "GET", key, nil)
+}
+
+func (s *cloudStore) do(ctx context.Context, method, key string, data []byte) ([]byte, error) {
+	payloadHash := sha256.Sum256(data)
+	var lastErr error
+	for attempt := 0; attempt < ObjectStoreRetries; attempt++ {
+		if attempt > 0 {
+			if err := retryWait(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(data))
+		signV4(req, hex.EncodeToString(payloadHash[:]), s.creds, s.region, time.Now())
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = err
+		case resp.StatusCode == http.StatusNotFound && method == "GET":
+			return nil, nil
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("%s of %s failed with status %s", method, key, resp.Status)
+		case resp.StatusCode >= 300:
+			return nil, fmt.Errorf("%s of %s failed with status %s: %s", method, key, resp.Status, body)
+		default:
+			return body, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// awsURIEscape encodes a string as required by AWS Signature Version 4, leaving only
+// unreserved characters and, if keepSlash is true, "/" unescaped.
+func awsURIEscape(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && keepSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 adds AWS Signature Version 4 headers to a request for the "s3" service.
+// All headers already set on the request are signed along with the host.
+func signV4(req *http.Request, payloadHash string, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	var queryParts []string
+	for _, key := range queryKeys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			queryParts = append(queryParts, awsURIEscape(key, false)+"="+awsURIEscape(value, false))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
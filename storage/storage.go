@@ -17,6 +17,7 @@
 package storage
 
 import (
+	"context"
 	"sync"
 
 	"github.com/janelia-flyem/dvid/dvid"
@@ -37,10 +38,20 @@ const (
 )
 
 // ChunkOp is a type-specific operation with an optional WaitGroup to
-// sync mapping before reduce.
+// sync mapping before reduce.  If Ctx is set, ProcessRange stops sending
+// chunks once the context is canceled, e.g., when a HTTP client disconnects.
 type ChunkOp struct {
-	Op interface{}
-	Wg *sync.WaitGroup
+	Op  interface{}
+	Wg  *sync.WaitGroup
+	Ctx context.Context
+}
+
+// Err returns the error of the operation's context, if any, once it is done.
+func (op *ChunkOp) Err() error {
+	if op == nil || op.Ctx == nil {
+		return nil
+	}
+	return op.Ctx.Err()
 }
 
 // Chunk is the unit passed down channels to chunk handlers.  Chunks can be passed
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -147,3 +148,108 @@ func (s *DataSuite) TestMultipleItems(c *C) {
 		c.Assert(string(kv.V), Equals, string(items[i].V))
 	}
 }
+
+func (s *DataSuite) TestProcessRangeCanceled(c *C) {
+	kvDB, ok := s.db.(OrderedKeyValueDB)
+	if !ok {
+		c.Fail()
+	}
+
+	err := kvDB.PutRange([]KeyValue{
+		{K: NewKey("range 1"), V: []byte("1")},
+		{K: NewKey("range 2"), V: []byte("2")},
+	})
+	c.Assert(err, IsNil)
+
+	var numChunks int
+	countChunks := func(chunk *Chunk) { numChunks++ }
+	err = kvDB.ProcessRange(NewKey("range 1"), NewKey("range 2"), &ChunkOp{}, countChunks)
+	c.Assert(err, IsNil)
+	c.Assert(numChunks, Equals, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	numChunks = 0
+	err = kvDB.ProcessRange(NewKey("range 1"), NewKey("range 2"), &ChunkOp{Ctx: ctx}, countChunks)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(numChunks, Equals, 0)
+}
+
+func (s *DataSuite) TestProcessRangeBatches(c *C) {
+	kvDB, ok := s.db.(OrderedKeyValueDB)
+	if !ok {
+		c.Fail()
+	}
+
+	var items []KeyValue
+	for i := 1; i <= 5; i++ {
+		items = append(items, KeyValue{K: NewKey(fmt.Sprintf("batch %d", i)), V: []byte{byte(i)}})
+	}
+	c.Assert(kvDB.PutRange(items), IsNil)
+
+	// All pairs are sent in order, and f can read the database between batches.
+	var found []string
+	err := ProcessRangeBatches(context.Background(), kvDB, NewKey("batch 1"), NewKey("batch 5"), 2,
+		func(kv *KeyValue) error {
+			value, err := kvDB.Get(kv.K)
+			if err != nil {
+				return err
+			}
+			c.Assert(value, DeepEquals, kv.V)
+			found = append(found, string(kv.K.Bytes()))
+			return nil
+		})
+	c.Assert(err, IsNil)
+	c.Assert(found, DeepEquals, []string{"batch 1", "batch 2", "batch 3", "batch 4", "batch 5"})
+
+	// Errors of f stop the scan.
+	stop := fmt.Errorf("stop")
+	found = nil
+	err = ProcessRangeBatches(context.Background(), kvDB, NewKey("batch 1"), NewKey("batch 5"), 2,
+		func(kv *KeyValue) error {
+			found = append(found, string(kv.K.Bytes()))
+			if len(found) == 3 {
+				return stop
+			}
+			return nil
+		})
+	c.Assert(err, Equals, stop)
+	c.Assert(found, HasLen, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ProcessRangeBatches(ctx, kvDB, NewKey("batch 1"), NewKey("batch 5"), 2,
+		func(kv *KeyValue) error { return nil })
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *DataSuite) TestProcessKeyBatches(c *C) {
+	kvDB, ok := s.db.(OrderedKeyValueDB)
+	if !ok {
+		c.Fail()
+	}
+
+	var items []KeyValue
+	for i := 1; i <= 5; i++ {
+		items = append(items, KeyValue{K: NewKey(fmt.Sprintf("keybatch %d", i)), V: []byte{byte(i)}})
+	}
+	c.Assert(kvDB.PutRange(items), IsNil)
+
+	// Keys come in bounded batches, and f can delete them between batches.
+	var sizes []int
+	err := ProcessKeyBatches(context.Background(), kvDB, NewKey("keybatch 1"), NewKey("keybatch 5"), 2,
+		func(keys []Key) error {
+			sizes = append(sizes, len(keys))
+			for _, key := range keys {
+				if err := kvDB.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	c.Assert(err, IsNil)
+	c.Assert(sizes, DeepEquals, []int{2, 2, 1})
+	keys, err := kvDB.KeysInRange(NewKey("keybatch 1"), NewKey("keybatch 5"))
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+}
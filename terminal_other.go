@@ -0,0 +1,14 @@
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// makeRaw always fails on this platform, so the shell reads whole lines without
+// completion.
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, fmt.Errorf("Terminal editing is not supported on this platform")
+}